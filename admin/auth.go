@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+// authHandler authenticates requests with HTTP basic auth by broker users
+// Only listed users are allowed, other authenticated users are forbidden, so empty list denies everybody
+type authHandler struct {
+	amqpServer *server.Server
+	realm      string
+	users      map[string]bool
+	next       http.Handler
+}
+
+func newAuthHandler(amqpServer *server.Server, realm string, users []string, next http.Handler) *authHandler {
+	allowed := make(map[string]bool)
+	for _, user := range users {
+		allowed[user] = true
+	}
+	return &authHandler{amqpServer: amqpServer, realm: realm, users: allowed, next: next}
+}
+
+func (h *authHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if user, password, ok := req.BasicAuth(); ok {
+		if identity, err := h.amqpServer.Authenticate(user, password); err == nil {
+			if !h.users[identity.Username] {
+				JSONResponse(resp, &ErrorResponse{Error: "forbidden"}, http.StatusForbidden)
+				return
+			}
+			h.next.ServeHTTP(resp, req)
+			return
+		}
+	}
+	resp.Header().Set("WWW-Authenticate", `Basic realm="`+h.realm+`"`)
+	JSONResponse(resp, &ErrorResponse{Error: "unauthorized"}, http.StatusUnauthorized)
+}
@@ -0,0 +1,116 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/valinurovam/garagemq/config"
+	"github.com/valinurovam/garagemq/server"
+)
+
+// DebugServer serves net/http/pprof profiles and runtime stats on its own port, separate from admin server
+// Requests are authenticated with HTTP basic auth by broker users, only listed users are allowed
+type DebugServer struct {
+	s *http.Server
+}
+
+// DebugStatsHandler reports runtime stats and counters of server subsystems
+// GET /debug/stats
+type DebugStatsHandler struct {
+	amqpServer *server.Server
+}
+
+type DebugStatsResponse struct {
+	Goroutines int            `json:"goroutines"`
+	HeapInUse  uint64         `json:"heap_in_use"`
+	HeapAlloc  uint64         `json:"heap_alloc"`
+	GC         *DebugGCStats  `json:"gc"`
+	Counters   map[string]int `json:"counters"`
+}
+
+// DebugGCStats represents garbage collector stats, pauses are in nanoseconds
+type DebugGCStats struct {
+	NumGC      uint32 `json:"num_gc"`
+	PauseTotal uint64 `json:"pause_total_ns"`
+	LastPause  uint64 `json:"last_pause_ns"`
+	LastGC     uint64 `json:"last_gc_unix_ns"`
+}
+
+func NewDebugServer(amqpServer *server.Server, cfg config.Debug) *DebugServer {
+	mux := NewProfilerHandler()
+	mux.Handle("/debug/stats", NewDebugStatsHandler(amqpServer))
+
+	return &DebugServer{
+		s: &http.Server{
+			Addr:    fmt.Sprintf("%s:%s", cfg.IP, cfg.Port),
+			Handler: newAuthHandler(amqpServer, "garagemq debug", cfg.Users, mux),
+		},
+	}
+}
+
+func (server *DebugServer) Start() error {
+	return server.s.ListenAndServe()
+}
+
+// NewProfilerHandler returns mux serving net/http/pprof handlers under /debug/pprof/
+func NewProfilerHandler() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+func NewDebugStatsHandler(amqpServer *server.Server) http.Handler {
+	return &DebugStatsHandler{amqpServer: amqpServer}
+}
+
+func (h *DebugStatsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	response := &DebugStatsResponse{
+		Goroutines: runtime.NumGoroutine(),
+		HeapInUse:  memStats.HeapInuse,
+		HeapAlloc:  memStats.HeapAlloc,
+		GC: &DebugGCStats{
+			NumGC:      memStats.NumGC,
+			PauseTotal: memStats.PauseTotalNs,
+			LastPause:  memStats.PauseNs[(memStats.NumGC+255)%256],
+			LastGC:     memStats.LastGC,
+		},
+		Counters: map[string]int{
+			"vhosts":           0,
+			"exchanges":        0,
+			"queues":           0,
+			"connections":      0,
+			"channels":         0,
+			"consumers":        0,
+			"messages_ready":   0,
+			"messages_unacked": 0,
+		},
+	}
+
+	for _, vhost := range h.amqpServer.GetVhosts() {
+		response.Counters["vhosts"]++
+		response.Counters["exchanges"] += len(vhost.GetExchanges())
+		for _, qu := range vhost.GetQueues() {
+			response.Counters["queues"]++
+			response.Counters["messages_ready"] += int(qu.Length())
+		}
+	}
+	for _, conn := range h.amqpServer.GetConnections() {
+		response.Counters["connections"]++
+		for _, ch := range conn.GetChannels() {
+			response.Counters["channels"]++
+			response.Counters["consumers"] += ch.GetConsumersCount()
+			response.Counters["messages_unacked"] += ch.GetUnackedCount()
+		}
+	}
+
+	JSONResponse(resp, response, http.StatusOK)
+}
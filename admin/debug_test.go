@@ -0,0 +1,69 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/config"
+	"github.com/valinurovam/garagemq/metrics"
+	"github.com/valinurovam/garagemq/server"
+)
+
+func newDebugTestServer() *server.Server {
+	metrics.NewTrackRegistry(15, time.Second, true)
+	cfg, _ := config.CreateDefault()
+	return server.NewServer("localhost", "0", cfg.Proto, cfg)
+}
+
+func TestDebugStatsHandler_Fields(t *testing.T) {
+	resp := httptest.NewRecorder()
+	NewDebugStatsHandler(newDebugTestServer()).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/debug/stats", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, actual %d", http.StatusOK, resp.Code)
+	}
+
+	var stats map[string]interface{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"goroutines", "heap_in_use", "heap_alloc"} {
+		if value, ok := stats[field].(float64); !ok || value <= 0 {
+			t.Errorf("Expected positive '%s', actual %v", field, stats[field])
+		}
+	}
+	gc, _ := stats["gc"].(map[string]interface{})
+	for _, field := range []string{"num_gc", "pause_total_ns", "last_pause_ns", "last_gc_unix_ns"} {
+		if _, ok := gc[field].(float64); !ok {
+			t.Errorf("Expected gc field '%s', actual %v", field, stats["gc"])
+		}
+	}
+	counters, _ := stats["counters"].(map[string]interface{})
+	for _, field := range []string{"vhosts", "exchanges", "queues", "connections", "channels", "consumers", "messages_ready", "messages_unacked"} {
+		if _, ok := counters[field].(float64); !ok {
+			t.Errorf("Expected counter '%s', actual %v", field, stats["counters"])
+		}
+	}
+}
+
+func TestDebugServer_Unauthorized(t *testing.T) {
+	debugServer := NewDebugServer(newDebugTestServer(), config.Debug{IP: "127.0.0.1", Port: "0"})
+
+	for _, path := range []string{"/debug/stats", "/debug/pprof/"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		resp := httptest.NewRecorder()
+		debugServer.s.Handler.ServeHTTP(resp, req)
+		if resp.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d without credentials on %s, actual %d", http.StatusUnauthorized, path, resp.Code)
+		}
+
+		req.SetBasicAuth("guest", "wrong")
+		resp = httptest.NewRecorder()
+		debugServer.s.Handler.ServeHTTP(resp, req)
+		if resp.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d with wrong credentials on %s, actual %d", http.StatusUnauthorized, path, resp.Code)
+		}
+	}
+}
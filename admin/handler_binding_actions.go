@@ -0,0 +1,77 @@
+package admin
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+const bindingActionsPrefix = "/api/bindings/"
+
+// BindingActionsHandler enables or disables bindings without removing them
+// POST /api/bindings/enable?exchange={exchange}&destination={queue}&routing_key={key}
+// POST /api/bindings/disable?exchange={exchange}&destination={queue}&routing_key={key}
+// Binding vhost can be set by vhost query param, default vhost is "/", destination is queue
+// or destination exchange of exchange-to-exchange binding, all matching bindings are changed
+type BindingActionsHandler struct {
+	amqpServer *server.Server
+}
+
+type BindingActionResponse struct {
+	Vhost       string `json:"vhost"`
+	Exchange    string `json:"exchange"`
+	Destination string `json:"destination"`
+	RoutingKey  string `json:"routing_key"`
+	Enabled     bool   `json:"enabled"`
+	Changed     int    `json:"changed"`
+}
+
+func NewBindingActionsHandler(amqpServer *server.Server) http.Handler {
+	return &BindingActionsHandler{amqpServer: amqpServer}
+}
+
+func (h *BindingActionsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		JSONResponse(resp, &ErrorResponse{Error: "method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var enabled bool
+	switch strings.TrimPrefix(req.URL.Path, bindingActionsPrefix) {
+	case "enable":
+		enabled = true
+	case "disable":
+		enabled = false
+	default:
+		JSONResponse(resp, &ErrorResponse{Error: "unknown action"}, http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+	vhostName := query.Get("vhost")
+	if vhostName == "" {
+		vhostName = "/"
+	}
+	vhost := h.amqpServer.GetVhost(vhostName)
+	if vhost == nil {
+		JSONResponse(resp, &ErrorResponse{Error: "vhost not found"}, http.StatusNotFound)
+		return
+	}
+
+	exName, destination, routingKey := query.Get("exchange"), query.Get("destination"), query.Get("routing_key")
+	changed, err := vhost.SetBindingsEnabled(exName, destination, routingKey, enabled)
+	if err != nil {
+		JSONResponse(resp, &ErrorResponse{Error: err.Error()}, http.StatusNotFound)
+		return
+	}
+
+	JSONResponse(resp, &BindingActionResponse{
+		Vhost:       vhostName,
+		Exchange:    exName,
+		Destination: destination,
+		RoutingKey:  routingKey,
+		Enabled:     enabled,
+		Changed:     changed,
+	}, http.StatusOK)
+}
@@ -2,7 +2,9 @@ package admin
 
 import (
 	"net/http"
+	"sort"
 
+	"github.com/valinurovam/garagemq/binding"
 	"github.com/valinurovam/garagemq/server"
 )
 
@@ -15,15 +17,22 @@ type BindingsResponse struct {
 }
 
 type Binding struct {
-	Queue      string `json:"queue"`
-	Exchange   string `json:"exchange"`
-	RoutingKey string `json:"routing_key"`
+	Queue        string `json:"queue"`
+	Exchange     string `json:"exchange"`
+	RoutingKey   string `json:"routing_key"`
+	Routed       uint64 `json:"routed"`
+	LastRoutedAt int64  `json:"last_routed_at"`
+	Enabled      bool   `json:"enabled"`
+	// Implicit binding of default exchange is implied by queue, it can't be bound or unbound
+	Implicit bool `json:"implicit"`
 }
 
 func NewBindingsHandler(amqpServer *server.Server) http.Handler {
 	return &BindingsHandler{amqpServer: amqpServer}
 }
 
+// ServeHTTP lists bindings of exchange given by "exchange" param, empty name is default exchange
+// Without param bindings of all vhost exchanges are listed
 func (h *BindingsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	response := &BindingsResponse{}
 	req.ParseForm()
@@ -36,22 +45,48 @@ func (h *BindingsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	exchange := vhost.GetExchange(exName)
-	if exchange == nil {
-		JSONResponse(resp, response, 200)
-		return
+	// default exchange bindings are synthesized from queues
+	_, filtered := req.Form["exchange"]
+	if !filtered || exName == "" {
+		response.Items = appendBindings(response.Items, vhost.ImplicitBindings(), true)
+	}
+
+	names := []string{exName}
+	if !filtered {
+		names = names[:0]
+		for _, snapshot := range vhost.SnapshotExchanges() {
+			names = append(names, snapshot.Name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		if exchange := vhost.GetExchange(name); exchange != nil && name != "" {
+			response.Items = appendBindings(response.Items, exchange.GetBindings(), false)
+		}
 	}
 
-	for _, bind := range exchange.GetBindings() {
-		response.Items = append(
-			response.Items,
+	JSONResponse(resp, response, 200)
+}
+
+func appendBindings(items []*Binding, bindings []*binding.Binding, implicit bool) []*Binding {
+	for _, bind := range bindings {
+		// unix timestamp of the last routed message, 0 for never used binding
+		var lastRoutedAt int64
+		if routedAt := bind.LastRoutedAt(); !routedAt.IsZero() {
+			lastRoutedAt = routedAt.Unix()
+		}
+		items = append(
+			items,
 			&Binding{
-				Queue:      bind.GetQueue(),
-				Exchange:   bind.GetExchange(),
-				RoutingKey: bind.GetExchange(),
+				Queue:        bind.GetQueue(),
+				Exchange:     bind.GetExchange(),
+				RoutingKey:   bind.GetRoutingKey(),
+				Routed:       bind.RoutedCount(),
+				LastRoutedAt: lastRoutedAt,
+				Enabled:      bind.IsEnabled(),
+				Implicit:     implicit,
 			},
 		)
 	}
-
-	JSONResponse(resp, response, 200)
+	return items
 }
@@ -18,6 +18,7 @@ type ConnectionsResponse struct {
 
 type Connection struct {
 	ID            int                `json:"id"`
+	Name          string             `json:"name"`
 	Vhost         string             `json:"vhost"`
 	Addr          string             `json:"addr"`
 	ChannelsCount int                `json:"channels_count"`
@@ -38,6 +39,7 @@ func (h *ConnectionsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reque
 			response.Items,
 			&Connection{
 				ID:            int(conn.GetID()),
+				Name:          conn.GetClientName(),
 				Vhost:         conn.GetVirtualHost().GetName(),
 				Addr:          conn.GetRemoteAddr().String(),
 				ChannelsCount: len(conn.GetChannels()),
@@ -0,0 +1,45 @@
+package admin
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+// DefinitionsHandler handles export and import of broker topology
+// GET /api/definitions exports vhosts, exchanges, queues and bindings
+// POST /api/definitions imports definitions from request body, existing equivalent entities are kept
+type DefinitionsHandler struct {
+	amqpServer *server.Server
+}
+
+func NewDefinitionsHandler(amqpServer *server.Server) http.Handler {
+	return &DefinitionsHandler{amqpServer: amqpServer}
+}
+
+func (h *DefinitionsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		JSONResponse(resp, h.amqpServer.ExportDefinitions(), http.StatusOK)
+	case http.MethodPost, http.MethodPut:
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			JSONResponse(resp, &ErrorResponse{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		definitions, err := server.ParseDefinitions(data)
+		if err != nil {
+			JSONResponse(resp, &ErrorResponse{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		report, err := h.amqpServer.ImportDefinitions(definitions)
+		if err != nil {
+			JSONResponse(resp, &ErrorResponse{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		JSONResponse(resp, report, http.StatusOK)
+	default:
+		JSONResponse(resp, &ErrorResponse{Error: "method not allowed"}, http.StatusMethodNotAllowed)
+	}
+}
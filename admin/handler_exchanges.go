@@ -23,6 +23,7 @@ type Exchange struct {
 	Durable    bool               `json:"durable"`
 	Internal   bool               `json:"internal"`
 	AutoDelete bool               `json:"auto_delete"`
+	Policy     string             `json:"policy"`
 	MsgRateIn  *metrics.TrackItem `json:"msg_rate_in"`
 	MsgRateOut *metrics.TrackItem `json:"msg_rate_out"`
 }
@@ -35,8 +36,8 @@ func (h *ExchangesHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request
 	response := &ExchangesResponse{}
 
 	for vhostName, vhost := range h.amqpServer.GetVhosts() {
-		for _, exchange := range vhost.GetExchanges() {
-			name := exchange.GetName()
+		for _, exchange := range vhost.SnapshotExchanges() {
+			name := exchange.Name
 			if name == "" {
 				name = "(AMQP default)"
 			}
@@ -45,12 +46,13 @@ func (h *ExchangesHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request
 				&Exchange{
 					Name:       name,
 					Vhost:      vhostName,
-					Durable:    exchange.IsDurable(),
-					Internal:   exchange.IsInternal(),
-					AutoDelete: exchange.IsAutoDelete(),
-					Type:       exchange.GetTypeAlias(),
-					MsgRateIn:  exchange.GetMetrics().MsgIn.Track.GetLastDiffTrackItem(),
-					MsgRateOut: exchange.GetMetrics().MsgOut.Track.GetLastDiffTrackItem(),
+					Durable:    exchange.Durable,
+					Internal:   exchange.Internal,
+					Policy:     exchange.Policy,
+					AutoDelete: exchange.AutoDelete,
+					Type:       exchange.Type,
+					MsgRateIn:  exchange.MsgRateIn,
+					MsgRateOut: exchange.MsgRateOut,
 				},
 			)
 		}
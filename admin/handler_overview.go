@@ -2,6 +2,7 @@ package admin
 
 import (
 	"net/http"
+	"sort"
 
 	"github.com/valinurovam/garagemq/metrics"
 	"github.com/valinurovam/garagemq/server"
@@ -77,6 +78,20 @@ func (h *OverviewHandler) populateMetrics(response *OverviewResponse) {
 		Name:   "server.total",
 		Sample: serverMetrics.Total.Track.GetTrack(),
 	})
+
+	// published messages by routing key prefix buckets
+	routingMetrics := h.amqpServer.GetRoutingMetrics()
+	buckets := make([]string, 0, len(routingMetrics))
+	for bucket := range routingMetrics {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	for _, bucket := range buckets {
+		response.Metrics = append(response.Metrics, &Metric{
+			Name:   "server.routing." + bucket,
+			Sample: routingMetrics[bucket].Track.GetDiffTrack(),
+		})
+	}
 }
 
 func (h *OverviewHandler) populateCounters(response *OverviewResponse) {
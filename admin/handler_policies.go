@@ -0,0 +1,117 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/server"
+)
+
+// PoliciesHandler handles vhost policies management
+// GET /api/policies?vhost={vhost} lists policies
+// PUT /api/policies?vhost={vhost} creates or replaces policy from request body
+// DELETE /api/policies?vhost={vhost}&name={name} removes policy
+// Default vhost is "/"
+type PoliciesHandler struct {
+	amqpServer *server.Server
+}
+
+type PolicyInfo struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost"`
+	Pattern    string                 `json:"pattern"`
+	ApplyTo    string                 `json:"apply-to"`
+	Priority   int                    `json:"priority"`
+	Definition map[string]interface{} `json:"definition"`
+}
+
+type PoliciesResponse struct {
+	Items []*PolicyInfo `json:"items"`
+}
+
+func NewPoliciesHandler(amqpServer *server.Server) http.Handler {
+	return &PoliciesHandler{amqpServer: amqpServer}
+}
+
+func (h *PoliciesHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	vhostName := req.URL.Query().Get("vhost")
+	if vhostName == "" {
+		vhostName = "/"
+	}
+
+	vhost := h.amqpServer.GetVhost(vhostName)
+	if vhost == nil {
+		JSONResponse(resp, &ErrorResponse{Error: "vhost not found"}, http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		response := &PoliciesResponse{Items: []*PolicyInfo{}}
+		for _, policy := range vhost.GetPolicies() {
+			response.Items = append(response.Items, &PolicyInfo{
+				Name:       policy.Name,
+				Vhost:      vhostName,
+				Pattern:    policy.Pattern,
+				ApplyTo:    policy.ApplyTo,
+				Priority:   policy.Priority,
+				Definition: policy.Definition,
+			})
+		}
+		JSONResponse(resp, response, http.StatusOK)
+	case http.MethodPut, http.MethodPost:
+		info := &PolicyInfo{}
+		decoder := json.NewDecoder(req.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(info); err != nil {
+			JSONResponse(resp, &ErrorResponse{Error: "invalid policy: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		policy, err := server.NewPolicy(info.Name, info.Pattern, info.ApplyTo, info.Priority, convertDefinition(info.Definition))
+		if err != nil {
+			JSONResponse(resp, &ErrorResponse{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		vhost.SetPolicy(policy)
+		info.Vhost = vhostName
+		info.ApplyTo = policy.ApplyTo
+		JSONResponse(resp, info, http.StatusOK)
+	case http.MethodDelete:
+		if !vhost.DeletePolicy(req.URL.Query().Get("name")) {
+			JSONResponse(resp, &ErrorResponse{Error: "policy not found"}, http.StatusNotFound)
+			return
+		}
+		JSONResponse(resp, struct{}{}, http.StatusOK)
+	default:
+		JSONResponse(resp, &ErrorResponse{Error: "method not allowed"}, http.StatusMethodNotAllowed)
+	}
+}
+
+// convertDefinition converts json values into ones supported by amqp table
+func convertDefinition(definition map[string]interface{}) amqp.Table {
+	table := amqp.Table{}
+	for key, value := range definition {
+		table[key] = convertValue(value)
+	}
+	return table
+}
+
+func convertValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]interface{}:
+		return convertDefinition(value)
+	case []interface{}:
+		for i, item := range value {
+			value[i] = convertValue(item)
+		}
+		return value
+	}
+	return value
+}
@@ -0,0 +1,384 @@
+package admin
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/server"
+)
+
+const queueActionsPrefix = "/api/queues/"
+
+const (
+	defaultPeekCount     = 10
+	maxPeekCount         = 1000
+	defaultPeekBodyLimit = 1024
+	maxPeekBodyLimit     = 64 * 1024
+	defaultRetireTimeout = 30 * time.Second
+)
+
+// QueueActionsHandler handles management operations on specific queue
+// POST /api/queues/{name}/pause
+// POST /api/queues/{name}/resume
+// POST /api/queues/{name}/move?dest={queue}&count={count}&copy=true
+// GET /api/queues/{name}/peek?count={count}&body=true&body_limit={bytes}
+// POST /api/queues/{name}/retire?timeout={duration}&on_timeout={abort|delete|dead-letter}&dead_letter={queue}
+// POST /api/queues/{name}/requeue-unacked
+// POST /api/queues/{name}/replay?dest={queue}&from={offset|timestamp}&to={offset|timestamp}
+// Queue vhost can be set by vhost query param, default vhost is "/"
+// Move publishes messages into dest queue by default exchange, or through exchange and routing_key query params,
+// zero or absent count means all ready messages, copy keeps messages in source queue
+// Peek returns first ready messages without removing them, bodies are base64-encoded and truncated to body_limit
+// Retire refuses publishes into queue and deletes it once consumers drain it, see server.RetireQueue,
+// default timeout is 30s and retire is aborted on timeout by default
+// Requeue-unacked returns messages delivered to consumers of any channel and not acked yet into queue,
+// see server.RequeueUnacked
+// Replay copies messages of stream queue within range into dest queue, from and to are offsets, RFC3339 timestamps
+// or named offsets, see server.ReplayStream
+type QueueActionsHandler struct {
+	amqpServer *server.Server
+}
+
+type QueueActionResponse struct {
+	Name   string `json:"name"`
+	Vhost  string `json:"vhost"`
+	Paused bool   `json:"paused"`
+}
+
+type QueueMoveResponse struct {
+	Name  string `json:"name"`
+	Vhost string `json:"vhost"`
+	Moved int    `json:"moved"`
+	Copy  bool   `json:"copy"`
+	// Error is set if move is stopped before all messages are moved
+	Error string `json:"error,omitempty"`
+}
+
+type QueueRetireResponse struct {
+	Name    string `json:"name"`
+	Vhost   string `json:"vhost"`
+	Deleted bool   `json:"deleted"`
+	// Discarded is count of messages deleted or dead-lettered on timeout
+	Discarded int `json:"discarded"`
+}
+
+type QueueRequeueResponse struct {
+	Name     string `json:"name"`
+	Vhost    string `json:"vhost"`
+	Requeued int    `json:"requeued"`
+}
+
+type QueueReplayResponse struct {
+	Name     string `json:"name"`
+	Vhost    string `json:"vhost"`
+	Dest     string `json:"dest"`
+	Replayed int    `json:"replayed"`
+	// Error is set if replay is stopped before all messages are replayed
+	Error string `json:"error,omitempty"`
+}
+
+type QueuePeekResponse struct {
+	Name     string           `json:"name"`
+	Vhost    string           `json:"vhost"`
+	Messages []*PeekedMessage `json:"messages"`
+}
+
+// PeekedMessage represents message metadata and optionally its base64-encoded body
+type PeekedMessage struct {
+	ID            uint64                 `json:"id"`
+	Exchange      string                 `json:"exchange"`
+	RoutingKey    string                 `json:"routing_key"`
+	DeliveryCount uint32                 `json:"delivery_count"`
+	BodySize      uint64                 `json:"body_size"`
+	Properties    map[string]interface{} `json:"properties"`
+	Body          string                 `json:"body,omitempty"`
+	// Truncated is set if body is longer than body_limit
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func NewQueueActionsHandler(amqpServer *server.Server) http.Handler {
+	return &QueueActionsHandler{amqpServer: amqpServer}
+}
+
+func (h *QueueActionsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, queueActionsPrefix)
+	sepIdx := strings.LastIndex(path, "/")
+	if sepIdx <= 0 {
+		JSONResponse(resp, &ErrorResponse{Error: "not found"}, http.StatusNotFound)
+		return
+	}
+	queueName, action := path[:sepIdx], path[sepIdx+1:]
+
+	// peek only reads messages, other actions change queue state
+	method := http.MethodPost
+	if action == "peek" {
+		method = http.MethodGet
+	}
+	if req.Method != method {
+		JSONResponse(resp, &ErrorResponse{Error: "method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+
+	vhostName := req.URL.Query().Get("vhost")
+	if vhostName == "" {
+		vhostName = "/"
+	}
+
+	vhost := h.amqpServer.GetVhost(vhostName)
+	if vhost == nil {
+		JSONResponse(resp, &ErrorResponse{Error: "vhost not found"}, http.StatusNotFound)
+		return
+	}
+
+	queue := vhost.GetQueue(queueName)
+	if queue == nil {
+		JSONResponse(resp, &ErrorResponse{Error: "queue not found"}, http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "pause":
+		queue.Pause()
+	case "resume":
+		queue.Resume()
+	case "move":
+		h.move(resp, req, vhost, queueName)
+		return
+	case "peek":
+		h.peek(resp, req, vhost, queueName)
+		return
+	case "retire":
+		h.retire(resp, req, vhost, queueName)
+		return
+	case "replay":
+		h.replay(resp, req, vhost, queueName)
+		return
+	case "requeue-unacked":
+		requeued, err := vhost.RequeueUnacked(queueName)
+		if err != nil {
+			JSONResponse(resp, &ErrorResponse{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		JSONResponse(resp, &QueueRequeueResponse{Name: queueName, Vhost: vhostName, Requeued: requeued}, http.StatusOK)
+		return
+	default:
+		JSONResponse(resp, &ErrorResponse{Error: "unknown action"}, http.StatusNotFound)
+		return
+	}
+
+	JSONResponse(resp, &QueueActionResponse{Name: queueName, Vhost: vhostName, Paused: queue.IsPaused()}, http.StatusOK)
+}
+
+func (h *QueueActionsHandler) move(resp http.ResponseWriter, req *http.Request, vhost *server.VirtualHost, queueName string) {
+	query := req.URL.Query()
+	exName, routingKey := query.Get("exchange"), query.Get("routing_key")
+	if exName == "" {
+		routingKey = query.Get("dest")
+		if routingKey == "" {
+			JSONResponse(resp, &ErrorResponse{Error: "dest or exchange is required"}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	count := 0
+	if value := query.Get("count"); value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil || count < 0 {
+			JSONResponse(resp, &ErrorResponse{Error: "invalid count"}, http.StatusBadRequest)
+			return
+		}
+	}
+	copyOnly := query.Get("copy") == "true"
+
+	moved, err := vhost.MoveMessages(queueName, exName, routingKey, count, copyOnly)
+	if err != nil && moved == 0 {
+		JSONResponse(resp, &ErrorResponse{Error: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	response := &QueueMoveResponse{Name: queueName, Vhost: vhost.GetName(), Moved: moved, Copy: copyOnly}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	JSONResponse(resp, response, http.StatusOK)
+}
+
+func (h *QueueActionsHandler) replay(resp http.ResponseWriter, req *http.Request, vhost *server.VirtualHost, queueName string) {
+	query := req.URL.Query()
+	dest := query.Get("dest")
+	if dest == "" {
+		JSONResponse(resp, &ErrorResponse{Error: "dest is required"}, http.StatusBadRequest)
+		return
+	}
+
+	replayed, err := vhost.ReplayStream(queueName, dest, streamOffsetParam(query.Get("from")), streamOffsetParam(query.Get("to")))
+	if err != nil && replayed == 0 {
+		JSONResponse(resp, &ErrorResponse{Error: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	response := &QueueReplayResponse{Name: queueName, Vhost: vhost.GetName(), Dest: dest, Replayed: replayed}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	JSONResponse(resp, response, http.StatusOK)
+}
+
+// streamOffsetParam converts query param into stream offset: integer offset, RFC3339 timestamp or named offset,
+// empty value is nil
+func streamOffsetParam(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	if offset, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return offset
+	}
+	if timestamp, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return timestamp
+	}
+	return value
+}
+
+func (h *QueueActionsHandler) retire(resp http.ResponseWriter, req *http.Request, vhost *server.VirtualHost, queueName string) {
+	query := req.URL.Query()
+	timeout := defaultRetireTimeout
+	if value := query.Get("timeout"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout < 0 {
+			JSONResponse(resp, &ErrorResponse{Error: "invalid timeout"}, http.StatusBadRequest)
+			return
+		}
+	}
+	onTimeout := query.Get("on_timeout")
+	switch onTimeout {
+	case "":
+		onTimeout = server.RetireAbort
+	case server.RetireAbort, server.RetireDelete, server.RetireDeadLetter:
+	default:
+		JSONResponse(resp, &ErrorResponse{Error: "invalid on_timeout"}, http.StatusBadRequest)
+		return
+	}
+
+	discarded, err := vhost.RetireQueue(queueName, timeout, onTimeout, query.Get("dead_letter"))
+	if err != nil {
+		JSONResponse(resp, &ErrorResponse{Error: err.Error()}, http.StatusConflict)
+		return
+	}
+	JSONResponse(resp, &QueueRetireResponse{Name: queueName, Vhost: vhost.GetName(), Deleted: true, Discarded: discarded}, http.StatusOK)
+}
+
+func (h *QueueActionsHandler) peek(resp http.ResponseWriter, req *http.Request, vhost *server.VirtualHost, queueName string) {
+	query := req.URL.Query()
+	count, err := queryInt(query.Get("count"), defaultPeekCount, maxPeekCount)
+	if err != nil {
+		JSONResponse(resp, &ErrorResponse{Error: "invalid count"}, http.StatusBadRequest)
+		return
+	}
+	bodyLimit, err := queryInt(query.Get("body_limit"), defaultPeekBodyLimit, maxPeekBodyLimit)
+	if err != nil {
+		JSONResponse(resp, &ErrorResponse{Error: "invalid body_limit"}, http.StatusBadRequest)
+		return
+	}
+	withBody := query.Get("body") == "true"
+
+	queue := vhost.GetQueue(queueName)
+	if queue == nil {
+		JSONResponse(resp, &ErrorResponse{Error: "queue not found"}, http.StatusNotFound)
+		return
+	}
+
+	response := &QueuePeekResponse{Name: queueName, Vhost: vhost.GetName(), Messages: []*PeekedMessage{}}
+	for _, message := range queue.Peek(count) {
+		response.Messages = append(response.Messages, peekedMessage(message, withBody, bodyLimit))
+	}
+	JSONResponse(resp, response, http.StatusOK)
+}
+
+// queryInt parses positive int query param, empty value means defaultValue, greater values are capped by maxValue
+func queryInt(value string, defaultValue int, maxValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil || result <= 0 {
+		return 0, strconv.ErrSyntax
+	}
+	if result > maxValue {
+		result = maxValue
+	}
+	return result, nil
+}
+
+func peekedMessage(message *amqp.Message, withBody bool, bodyLimit int) *PeekedMessage {
+	// body compressed by broker transparently is shown as it is delivered
+	if message.Header != nil && message.IsBrokerGzipped() {
+		if restored, err := message.Gunzipped(0); err == nil {
+			message = restored
+		}
+	}
+
+	peeked := &PeekedMessage{
+		ID:            message.ID,
+		Exchange:      message.Exchange,
+		RoutingKey:    message.RoutingKey,
+		DeliveryCount: message.DeliveryCount,
+		BodySize:      message.BodySize,
+		Properties:    make(map[string]interface{}),
+	}
+	if message.Header != nil && message.Header.PropertyList != nil {
+		peeked.Properties = messageProperties(message.Header.PropertyList)
+	}
+	if !withBody {
+		return peeked
+	}
+
+	body := make([]byte, 0, bodyLimit)
+	for _, frame := range message.Body {
+		if len(body)+len(frame.Payload) > bodyLimit {
+			body = append(body, frame.Payload[:bodyLimit-len(body)]...)
+			peeked.Truncated = true
+			break
+		}
+		body = append(body, frame.Payload...)
+	}
+	peeked.Body = base64.StdEncoding.EncodeToString(body)
+	return peeked
+}
+
+// messageProperties returns set basic properties keyed by their amqp names
+func messageProperties(propertyList *amqp.BasicPropertyList) map[string]interface{} {
+	properties := make(map[string]interface{})
+	setString := func(name string, value *string) {
+		if value != nil {
+			properties[name] = *value
+		}
+	}
+	setString("content_type", propertyList.ContentType)
+	setString("content_encoding", propertyList.ContentEncoding)
+	setString("correlation_id", propertyList.CorrelationID)
+	setString("reply_to", propertyList.ReplyTo)
+	setString("expiration", propertyList.Expiration)
+	setString("message_id", propertyList.MessageID)
+	setString("type", propertyList.Type)
+	setString("user_id", propertyList.UserID)
+	setString("app_id", propertyList.AppID)
+	if propertyList.Headers != nil {
+		properties["headers"] = *propertyList.Headers
+	}
+	if propertyList.DeliveryMode != nil {
+		properties["delivery_mode"] = *propertyList.DeliveryMode
+	}
+	if propertyList.Priority != nil {
+		properties["priority"] = *propertyList.Priority
+	}
+	if propertyList.Timestamp != nil {
+		properties["timestamp"] = propertyList.Timestamp.Unix()
+	}
+	return properties
+}
@@ -17,13 +17,19 @@ type QueuesResponse struct {
 }
 
 type Queue struct {
-	Name       string `json:"name"`
-	Vhost      string `json:"vhost"`
-	Durable    bool   `json:"durable"`
-	AutoDelete bool   `json:"auto_delete"`
-	Exclusive  bool   `json:"exclusive"`
+	Name          string `json:"name"`
+	Vhost         string `json:"vhost"`
+	Durable       bool   `json:"durable"`
+	AutoDelete    bool   `json:"auto_delete"`
+	Exclusive     bool   `json:"exclusive"`
+	Paused        bool   `json:"paused"`
+	Policy        string `json:"policy"`
+	MasterLocator string `json:"master_locator,omitempty"`
 
-	Counters map[string]*metrics.TrackItem `json:"counters"`
+	Counters   map[string]*metrics.TrackItem `json:"counters"`
+	BodySizes  map[string]uint64             `json:"body_sizes"`
+	InMemory   uint64                        `json:"in_memory"`
+	OnDiskOnly uint64                        `json:"on_disk_only"`
 }
 
 func NewQueuesHandler(amqpServer *server.Server) http.Handler {
@@ -33,34 +39,22 @@ func NewQueuesHandler(amqpServer *server.Server) http.Handler {
 func (h *QueuesHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	response := &QueuesResponse{}
 	for vhostName, vhost := range h.amqpServer.GetVhosts() {
-		for _, queue := range vhost.GetQueues() {
-			ready := queue.GetMetrics().Ready.Track.GetLastTrackItem()
-			total := queue.GetMetrics().Total.Track.GetLastTrackItem()
-			unacked := queue.GetMetrics().Unacked.Track.GetLastTrackItem()
-
-			incoming := queue.GetMetrics().Incoming.Track.GetLastDiffTrackItem()
-			deliver := queue.GetMetrics().Deliver.Track.GetLastDiffTrackItem()
-			get := queue.GetMetrics().Get.Track.GetLastDiffTrackItem()
-			ack := queue.GetMetrics().Ack.Track.GetLastDiffTrackItem()
-
+		for _, queue := range vhost.SnapshotQueues() {
 			response.Items = append(
 				response.Items,
 				&Queue{
-					Name:       queue.GetName(),
-					Vhost:      vhostName,
-					Durable:    queue.IsDurable(),
-					AutoDelete: queue.IsAutoDelete(),
-					Exclusive:  queue.IsExclusive(),
-					Counters: map[string]*metrics.TrackItem{
-						"ready":   ready,
-						"total":   total,
-						"unacked": unacked,
-
-						"get":      get,
-						"ack":      ack,
-						"incoming": incoming,
-						"deliver":  deliver,
-					},
+					Name:          queue.Name,
+					Vhost:         vhostName,
+					Durable:       queue.Durable,
+					AutoDelete:    queue.AutoDelete,
+					Exclusive:     queue.Exclusive,
+					Paused:        queue.Paused,
+					Policy:        queue.Policy,
+					MasterLocator: queue.MasterLocator,
+					Counters:      queue.Counters,
+					BodySizes:     queue.Stats.BodySizes,
+					InMemory:      queue.Stats.InMemory,
+					OnDiskOnly:    queue.Stats.OnDiskOnly,
 				},
 			)
 		}
@@ -0,0 +1,41 @@
+package admin
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+// ReadyHandler reports server readiness to accept publishes
+// GET /api/ready responds 503 if any vhost is in drain mode or server is replication follower
+type ReadyHandler struct {
+	amqpServer *server.Server
+}
+
+type ReadyResponse struct {
+	Ready          bool     `json:"ready"`
+	DrainingVhosts []string `json:"draining_vhosts"`
+}
+
+func NewReadyHandler(amqpServer *server.Server) http.Handler {
+	return &ReadyHandler{amqpServer: amqpServer}
+}
+
+func (h *ReadyHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	response := &ReadyResponse{DrainingVhosts: []string{}}
+	for name, vhost := range h.amqpServer.GetVhosts() {
+		if vhost.IsDraining() {
+			response.DrainingVhosts = append(response.DrainingVhosts, name)
+		}
+	}
+	sort.Strings(response.DrainingVhosts)
+	role, _ := h.amqpServer.ReplicationState()
+	response.Ready = len(response.DrainingVhosts) == 0 && role != server.ReplicationFollower
+
+	status := http.StatusOK
+	if !response.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	JSONResponse(resp, response, status)
+}
@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+const replicationPromotePath = "/api/replication/promote"
+
+// ReplicationHandler reports replication state and promotes follower
+// GET /api/replication
+// POST /api/replication/promote
+type ReplicationHandler struct {
+	amqpServer *server.Server
+}
+
+type ReplicationResponse struct {
+	Role string `json:"role"`
+	Seq  uint64 `json:"seq"`
+}
+
+func NewReplicationHandler(amqpServer *server.Server) http.Handler {
+	return &ReplicationHandler{amqpServer: amqpServer}
+}
+
+func (h *ReplicationHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == replicationPromotePath {
+		if req.Method != http.MethodPost {
+			JSONResponse(resp, &ErrorResponse{Error: "method not allowed"}, http.StatusMethodNotAllowed)
+			return
+		}
+		if err := h.amqpServer.Promote(); err != nil {
+			JSONResponse(resp, &ErrorResponse{Error: err.Error()}, http.StatusConflict)
+			return
+		}
+	} else if req.Method != http.MethodGet {
+		JSONResponse(resp, &ErrorResponse{Error: "method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+
+	role, seq := h.amqpServer.ReplicationState()
+	JSONResponse(resp, &ReplicationResponse{Role: role, Seq: seq}, http.StatusOK)
+}
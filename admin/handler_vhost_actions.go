@@ -0,0 +1,66 @@
+package admin
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/valinurovam/garagemq/server"
+)
+
+const vhostActionsPrefix = "/api/vhosts/"
+
+// VhostActionsHandler handles management operations on specific virtual host
+// POST /api/vhosts/{vhost}/drain
+// POST /api/vhosts/{vhost}/resume
+// Vhost name must be url-encoded, e.g. default vhost is %2F
+type VhostActionsHandler struct {
+	amqpServer *server.Server
+}
+
+type VhostActionResponse struct {
+	Vhost    string `json:"vhost"`
+	Draining bool   `json:"draining"`
+}
+
+func NewVhostActionsHandler(amqpServer *server.Server) http.Handler {
+	return &VhostActionsHandler{amqpServer: amqpServer}
+}
+
+func (h *VhostActionsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		JSONResponse(resp, &ErrorResponse{Error: "method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.EscapedPath(), vhostActionsPrefix)
+	sepIdx := strings.LastIndex(path, "/")
+	if sepIdx <= 0 {
+		JSONResponse(resp, &ErrorResponse{Error: "not found"}, http.StatusNotFound)
+		return
+	}
+	vhostName, err := url.PathUnescape(path[:sepIdx])
+	if err != nil {
+		JSONResponse(resp, &ErrorResponse{Error: "not found"}, http.StatusNotFound)
+		return
+	}
+	action := path[sepIdx+1:]
+
+	vhost := h.amqpServer.GetVhost(vhostName)
+	if vhost == nil {
+		JSONResponse(resp, &ErrorResponse{Error: "vhost not found"}, http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "drain":
+		vhost.SetDraining(true)
+	case "resume":
+		vhost.SetDraining(false)
+	default:
+		JSONResponse(resp, &ErrorResponse{Error: "unknown action"}, http.StatusNotFound)
+		return
+	}
+
+	JSONResponse(resp, &VhostActionResponse{Vhost: vhostName, Draining: vhost.IsDraining()}, http.StatusOK)
+}
@@ -3,7 +3,9 @@ package admin
 import (
 	"fmt"
 	"net/http"
+	"strings"
 
+	"github.com/valinurovam/garagemq/config"
 	"github.com/valinurovam/garagemq/server"
 )
 
@@ -11,18 +13,39 @@ type AdminServer struct {
 	s *http.Server
 }
 
-func NewAdminServer(amqpServer *server.Server, host string, port string) *AdminServer {
-	http.Handle("/", http.FileServer(http.Dir("admin-frontend/build")))
-	http.Handle("/overview", NewOverviewHandler(amqpServer))
-	http.Handle("/exchanges", NewExchangesHandler(amqpServer))
-	http.Handle("/queues", NewQueuesHandler(amqpServer))
-	http.Handle("/connections", NewConnectionsHandler(amqpServer))
-	http.Handle("/bindings", NewBindingsHandler(amqpServer))
-	http.Handle("/channels", NewChannelsHandler(amqpServer))
+// NewAdminServer returns admin server, requests are authenticated with HTTP basic auth by broker users,
+// only users listed by config are allowed
+func NewAdminServer(amqpServer *server.Server, cfg config.AdminConfig) *AdminServer {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("admin-frontend/build")))
+	mux.Handle("/overview", NewOverviewHandler(amqpServer))
+	mux.Handle("/exchanges", NewExchangesHandler(amqpServer))
+	mux.Handle("/queues", NewQueuesHandler(amqpServer))
+	mux.Handle("/connections", NewConnectionsHandler(amqpServer))
+	mux.Handle("/bindings", NewBindingsHandler(amqpServer))
+	mux.Handle("/api/bindings", NewBindingsHandler(amqpServer))
+	mux.Handle("/channels", NewChannelsHandler(amqpServer))
+	mux.Handle(queueActionsPrefix, NewQueueActionsHandler(amqpServer))
+	mux.Handle(bindingActionsPrefix, NewBindingActionsHandler(amqpServer))
+	mux.Handle("/api/ready", NewReadyHandler(amqpServer))
+	mux.Handle("/api/policies", NewPoliciesHandler(amqpServer))
+	mux.Handle("/api/definitions", NewDefinitionsHandler(amqpServer))
+	replicationHandler := NewReplicationHandler(amqpServer)
+	mux.Handle("/api/replication", replicationHandler)
+	mux.Handle(replicationPromotePath, replicationHandler)
 
 	adminServer := &AdminServer{}
+	vhostActions := NewVhostActionsHandler(amqpServer)
 	adminServer.s = &http.Server{
-		Addr: fmt.Sprintf("%s:%s", host, port),
+		Addr: fmt.Sprintf("%s:%s", cfg.IP, cfg.Port),
+		// vhost actions are served before mux, cause mux redirects escaped default vhost %2F as double slash
+		Handler: newAuthHandler(amqpServer, "garagemq admin", cfg.Users, http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if strings.HasPrefix(req.URL.Path, vhostActionsPrefix) {
+				vhostActions.ServeHTTP(resp, req)
+				return
+			}
+			mux.ServeHTTP(resp, req)
+		})),
 	}
 
 	return adminServer
@@ -0,0 +1,111 @@
+package admin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/config"
+	"github.com/valinurovam/garagemq/metrics"
+	"github.com/valinurovam/garagemq/replication"
+	"github.com/valinurovam/garagemq/server"
+)
+
+// startFollowerTestServer starts server following test leader, it waits for promotion with initialized users
+func startFollowerTestServer(t *testing.T, dir string) *server.Server {
+	metrics.NewTrackRegistry(15, time.Second, true)
+	cfg, _ := config.CreateDefault()
+	cfg.Users = append(cfg.Users, config.User{
+		Username: "admin",
+		Password: "21232f297a57a5a743894a0e4a801fc3", // admin md5 hash
+	})
+	cfg.Db.DefaultPath = dir
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	leader := replication.NewLeader(100, "secret")
+	go leader.Serve(listener)
+	cfg.Replication.LeaderAddr = listener.Addr().String()
+	cfg.Replication.Secret = "secret"
+
+	amqpServer := server.NewServer("localhost", "0", cfg.Proto, cfg)
+	go amqpServer.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if role, _ := amqpServer.ReplicationState(); role == server.ReplicationFollower {
+			return amqpServer
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected server follows leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func serveAdmin(adminServer *AdminServer, method string, path string, user string, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.SetBasicAuth(user, password)
+	resp := httptest.NewRecorder()
+	adminServer.s.Handler.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestAdminServer_Unauthorized(t *testing.T) {
+	adminServer := NewAdminServer(newDebugTestServer(), config.AdminConfig{IP: "127.0.0.1", Port: "0"})
+
+	for _, path := range []string{"/overview", "/queues", "/api/queues/test/peek", "/api/vhosts/%2F/drain"} {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		resp := httptest.NewRecorder()
+		adminServer.s.Handler.ServeHTTP(resp, req)
+		if resp.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d without credentials on %s, actual %d", http.StatusUnauthorized, path, resp.Code)
+		}
+
+		req.SetBasicAuth("guest", "wrong")
+		resp = httptest.NewRecorder()
+		adminServer.s.Handler.ServeHTTP(resp, req)
+		if resp.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d with wrong credentials on %s, actual %d", http.StatusUnauthorized, path, resp.Code)
+		}
+	}
+}
+
+func TestAdminServer_Forbidden(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "admin")
+	defer os.RemoveAll(dir)
+	amqpServer := startFollowerTestServer(t, dir)
+
+	for _, users := range [][]string{nil, {"admin"}} {
+		adminServer := NewAdminServer(amqpServer, config.AdminConfig{IP: "127.0.0.1", Port: "0", Users: users})
+		for _, path := range []string{"/overview", "/api/replication/promote", "/api/vhosts/%2F/drain"} {
+			if resp := serveAdmin(adminServer, http.MethodPost, path, "guest", "guest"); resp.Code != http.StatusForbidden {
+				t.Errorf("Expected status %d for not admin user on %s with users %v, actual %d", http.StatusForbidden, path, users, resp.Code)
+			}
+		}
+	}
+	if role, _ := amqpServer.ReplicationState(); role != server.ReplicationFollower {
+		t.Errorf("Expected server is not promoted by not admin user, actual role %s", role)
+	}
+}
+
+func TestAdminServer_Promote(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "admin")
+	defer os.RemoveAll(dir)
+	amqpServer := startFollowerTestServer(t, dir)
+	adminServer := NewAdminServer(amqpServer, config.AdminConfig{IP: "127.0.0.1", Port: "0", Users: []string{"admin"}})
+
+	resp := serveAdmin(adminServer, http.MethodPost, "/api/replication/promote", "admin", "admin")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d on promote, actual %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	var state ReplicationResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Role != server.ReplicationStandalone {
+		t.Errorf("Expected promoted server role %s, actual %s", server.ReplicationStandalone, state.Role)
+	}
+}
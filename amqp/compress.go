@@ -0,0 +1,135 @@
+package amqp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// ContentEncodingGzip is content-encoding property value for gzip-compressed message body
+const ContentEncodingGzip = "gzip"
+
+// MaxGunzippedSize is max size of decompressed body, larger bodies are not decompressed, so compressed body
+// of small message can't make broker inflate it in memory without limit
+const MaxGunzippedSize = 16 << 20
+
+// ErrGunzippedTooLarge is error of decompressed body exceeding MaxGunzippedSize
+var ErrGunzippedTooLarge = errors.New("decompressed body exceeds max size")
+
+// IsGzipped returns is message body compressed with gzip according content-encoding property
+func (m *Message) IsGzipped() bool {
+	encoding := m.Header.PropertyList.ContentEncoding
+	return encoding != nil && *encoding == ContentEncodingGzip
+}
+
+// IsBrokerGzipped returns is message body compressed by broker transparently
+// It is marked by message field instead of property, so publisher can't make broker decompress body on delivery
+func (m *Message) IsBrokerGzipped() bool {
+	return m.brokerGzipped
+}
+
+// Gzipped returns copy of message with gzip-compressed body and content-encoding property set
+// Message is returned as is if it already has content-encoding or compressed body is not smaller
+// Body of the copy is split into frames of frameSize, the source message is not modified
+func (m *Message) Gzipped(frameSize int) (*Message, error) {
+	return m.gzipped(frameSize, false)
+}
+
+// BrokerGzipped returns copy of message compressed like Gzipped, but marked as compressed transparently by broker,
+// content-encoding property is not set
+func (m *Message) BrokerGzipped(frameSize int) (*Message, error) {
+	return m.gzipped(frameSize, true)
+}
+
+func (m *Message) gzipped(frameSize int, transparent bool) (*Message, error) {
+	if m.Header.PropertyList.ContentEncoding != nil || m.brokerGzipped {
+		return m, nil
+	}
+	// body compressed transparently must be restored on delivery
+	if transparent && m.BodySize > MaxGunzippedSize {
+		return m, nil
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	for _, frame := range m.Body {
+		if _, err := writer.Write(frame.Payload); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	if uint64(buf.Len()) >= m.BodySize {
+		return m, nil
+	}
+
+	if transparent {
+		message := m.withBody(buf.Bytes(), frameSize, nil)
+		message.brokerGzipped = true
+		return message, nil
+	}
+	encoding := ContentEncodingGzip
+	return m.withBody(buf.Bytes(), frameSize, &encoding), nil
+}
+
+// Gunzipped returns copy of gzip-compressed message with decompressed body and content-encoding property cleared
+// Message is returned as is if it is not compressed with gzip neither by publisher nor by broker
+// Body of the copy is split into frames of frameSize, the source message is not modified
+// Body decompressed into more than MaxGunzippedSize bytes is refused with ErrGunzippedTooLarge
+func (m *Message) Gunzipped(frameSize int) (*Message, error) {
+	if !m.IsGzipped() && !m.IsBrokerGzipped() {
+		return m, nil
+	}
+
+	var buf bytes.Buffer
+	for _, frame := range m.Body {
+		buf.Write(frame.Payload)
+	}
+
+	reader, err := gzip.NewReader(&buf)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, MaxGunzippedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxGunzippedSize {
+		return nil, ErrGunzippedTooLarge
+	}
+
+	message := m.withBody(data, frameSize, nil)
+	message.brokerGzipped = false
+	return message, nil
+}
+
+// withBody returns copy of message with given body and content-encoding property
+func (m *Message) withBody(data []byte, frameSize int, encoding *string) *Message {
+	if frameSize <= 0 {
+		frameSize = len(data)
+	}
+
+	propertyList := *m.Header.PropertyList
+	propertyList.ContentEncoding = encoding
+	header := *m.Header
+	header.PropertyList = &propertyList
+	header.BodySize = uint64(len(data))
+
+	message := *m
+	message.Header = &header
+	message.Body = make([]*Frame, 0)
+	message.BodySize = 0
+	for offset := 0; offset < len(data); offset += frameSize {
+		end := offset + frameSize
+		if end > len(data) {
+			end = len(data)
+		}
+		message.Append(&Frame{Type: byte(FrameBody), Payload: data[offset:end]})
+	}
+
+	return &message
+}
@@ -0,0 +1,159 @@
+package amqp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newBodyMessage(body []byte, frameSize int) *Message {
+	contentType := "text/plain"
+	message := &Message{
+		Header: &ContentHeader{
+			ClassID:      ClassBasic,
+			BodySize:     uint64(len(body)),
+			PropertyList: &BasicPropertyList{ContentType: &contentType},
+		},
+	}
+	for offset := 0; offset < len(body); offset += frameSize {
+		end := offset + frameSize
+		if end > len(body) {
+			end = len(body)
+		}
+		message.Append(&Frame{Type: byte(FrameBody), Payload: body[offset:end]})
+	}
+	return message
+}
+
+func messageBody(message *Message) []byte {
+	var buf bytes.Buffer
+	for _, frame := range message.Body {
+		buf.Write(frame.Payload)
+	}
+	return buf.Bytes()
+}
+
+func TestMessage_Gzipped_Gunzipped(t *testing.T) {
+	body := bytes.Repeat([]byte("compressible body "), 1000)
+	message := newBodyMessage(body, 1024)
+
+	compressed, err := message.Gzipped(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compressed.IsGzipped() || compressed.BodySize >= message.BodySize || compressed.Header.BodySize != compressed.BodySize {
+		t.Fatal("Expected compressed message")
+	}
+	for _, frame := range compressed.Body {
+		if len(frame.Payload) > 64 {
+			t.Errorf("Expected frames not larger than %d, actual %d", 64, len(frame.Payload))
+		}
+	}
+	if message.IsGzipped() || message.BodySize != uint64(len(body)) {
+		t.Error("Expected source message not modified")
+	}
+
+	// already encoded message should not be compressed twice
+	if twice, _ := compressed.Gzipped(64); twice != compressed {
+		t.Error("Expected compressed message returned as is")
+	}
+
+	decompressed, err := compressed.Gunzipped(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decompressed.IsGzipped() || decompressed.Header.PropertyList.ContentEncoding != nil {
+		t.Error("Expected content-encoding cleared")
+	}
+	if *decompressed.Header.PropertyList.ContentType != "text/plain" {
+		t.Error("Expected other properties preserved")
+	}
+	if !bytes.Equal(messageBody(decompressed), body) || len(decompressed.Body) != len(message.Body) {
+		t.Error("Expected original body after decompression")
+	}
+}
+
+func TestMessage_BrokerGzipped_Gunzipped(t *testing.T) {
+	body := bytes.Repeat([]byte("compressible body "), 1000)
+	message := newBodyMessage(body, 1024)
+
+	compressed, err := message.BrokerGzipped(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compressed.IsBrokerGzipped() || compressed.IsGzipped() || compressed.BodySize >= message.BodySize {
+		t.Fatal("Expected message compressed by broker")
+	}
+
+	if compressed.Header.PropertyList.ContentEncoding != nil {
+		t.Error("Expected content-encoding not set by broker compression")
+	}
+
+	// flag is kept by storage
+	data, err := compressed.Marshal(ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := &Message{}
+	if err := stored.Unmarshal(data, ProtoRabbit); err != nil || !stored.IsBrokerGzipped() {
+		t.Fatalf("Expected stored message compressed by broker, error %v", err)
+	}
+
+	restored, err := stored.Gunzipped(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.IsBrokerGzipped() || restored.Header.PropertyList.ContentEncoding != nil || !bytes.Equal(messageBody(restored), body) {
+		t.Error("Expected original message restored")
+	}
+}
+
+// publisher can't mark body as compressed by broker, so it is not decompressed on delivery
+func TestMessage_BrokerGzipped_PublisherEncoding(t *testing.T) {
+	message := newBodyMessage(bytes.Repeat([]byte("compressible body "), 1000), 1024)
+	compressed, err := message.Gzipped(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoding := "x-broker-gzip"
+	compressed.Header.PropertyList.ContentEncoding = &encoding
+
+	if compressed.IsBrokerGzipped() {
+		t.Error("Expected message with publisher content-encoding not compressed by broker")
+	}
+	if restored, _ := compressed.Gunzipped(1024); restored != compressed {
+		t.Error("Expected message with publisher content-encoding delivered as is")
+	}
+}
+
+func TestMessage_Gzipped_Incompressible(t *testing.T) {
+	message := newBodyMessage([]byte("short"), 1024)
+	if compressed, _ := message.Gzipped(1024); compressed != message {
+		t.Error("Expected message returned as is if compressed body is not smaller")
+	}
+	if decompressed, _ := message.Gunzipped(1024); decompressed != message {
+		t.Error("Expected not compressed message returned as is")
+	}
+}
+
+func TestMessage_Gunzipped_TooLarge(t *testing.T) {
+	message := newBodyMessage(make([]byte, MaxGunzippedSize+1), 1<<20)
+	compressed, err := message.Gzipped(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compressed.Gunzipped(1024); err != ErrGunzippedTooLarge {
+		t.Errorf("Expected error on too large decompressed body, actual %v", err)
+	}
+	if brokerCompressed, _ := message.BrokerGzipped(1024); brokerCompressed != message {
+		t.Error("Expected message larger than max decompressed size not compressed transparently")
+	}
+}
+
+func TestMessage_Gunzipped_Failed(t *testing.T) {
+	message := newBodyMessage([]byte("not a gzip data"), 1024)
+	encoding := ContentEncodingGzip
+	message.Header.PropertyList.ContentEncoding = &encoding
+	if _, err := message.Gunzipped(1024); err == nil {
+		t.Error("Expected error on invalid gzip body")
+	}
+}
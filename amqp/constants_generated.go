@@ -135,6 +135,12 @@ const MethodConnectionBlocked = 60
 // MethodConnectionUnblocked identifier
 const MethodConnectionUnblocked = 61
 
+// MethodConnectionUpdateSecret identifier
+const MethodConnectionUpdateSecret = 70
+
+// MethodConnectionUpdateSecretOk identifier
+const MethodConnectionUpdateSecretOk = 71
+
 // ClassChannel identifier
 const ClassChannel = 20
 
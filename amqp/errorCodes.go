@@ -0,0 +1,76 @@
+package amqp
+
+import "strings"
+
+// Error codes
+// Channel and connection errors carry stable machine-readable code in addition to human text. Code is appended
+// to reply text in parentheses, e.g. "PRECONDITION_FAILED - inequivalent arg 'type' for exchange 'logs':
+// received 'topic' but current is 'direct' (ERR_EXCHANGE_TYPE_MISMATCH)", so reply text keeps its usual prefix
+// and tools can match the code by `\((ERR_[A-Z_]+)\)$`. Error without specific code gets one by reply code,
+// e.g. ERR_NOT_FOUND. Codes are part of API and are never renamed.
+const (
+	ErrExchangeTypeMismatch = "ERR_EXCHANGE_TYPE_MISMATCH"
+	ErrInequivalentArg      = "ERR_INEQUIVALENT_ARG"
+	ErrInvalidArgument      = "ERR_INVALID_ARGUMENT"
+	ErrExchangeNotFound     = "ERR_EXCHANGE_NOT_FOUND"
+	ErrQueueNotFound        = "ERR_QUEUE_NOT_FOUND"
+	ErrQueueLocked          = "ERR_QUEUE_LOCKED"
+	ErrReservedName         = "ERR_RESERVED_NAME"
+	ErrDefaultExchange      = "ERR_DEFAULT_EXCHANGE"
+	ErrNameRequired         = "ERR_NAME_REQUIRED"
+	ErrAccessDenied         = "ERR_ACCESS_DENIED"
+	ErrUserIDMismatch       = "ERR_USER_ID_MISMATCH"
+	ErrInvalidProperty      = "ERR_INVALID_PROPERTY"
+	ErrLoginFailure         = "ERR_LOGIN_FAILURE"
+	ErrVhostNotFound        = "ERR_VHOST_NOT_FOUND"
+	ErrVhostDraining        = "ERR_VHOST_DRAINING"
+	ErrRateLimitExceeded    = "ERR_RATE_LIMIT_EXCEEDED"
+	ErrUnknownDeliveryTag   = "ERR_UNKNOWN_DELIVERY_TAG"
+	ErrConsumerTagInUse     = "ERR_CONSUMER_TAG_IN_USE"
+	ErrConsumerNotFound     = "ERR_CONSUMER_NOT_FOUND"
+	ErrUnexpectedFrame      = "ERR_UNEXPECTED_FRAME"
+	ErrUnknownMethod        = "ERR_UNKNOWN_METHOD"
+	ErrIdleTimeout          = "ERR_IDLE_TIMEOUT"
+	ErrAliasCycle           = "ERR_ALIAS_CYCLE"
+	ErrLimitExceeded        = "ERR_LIMIT_EXCEEDED"
+	ErrServerShutdown       = "ERR_SERVER_SHUTDOWN"
+	ErrHeartbeatTimeout     = "ERR_HEARTBEAT_TIMEOUT"
+	ErrMalformedFrame       = "ERR_MALFORMED_FRAME"
+)
+
+// maxReplyTextLength is max length of short string reply text
+const maxReplyTextLength = 255
+
+// ReplyErrorCode returns default error code of reply code, e.g. ERR_NOT_FOUND for NotFound
+func ReplyErrorCode(code uint16) string {
+	name, ok := ConstantsNameMap[code]
+	if !ok {
+		return "ERR_UNKNOWN"
+	}
+	return "ERR_" + name
+}
+
+// WithCode sets error code and reply text with it, text is truncated so reply text fits into short string
+func (err *Error) WithCode(code string) *Error {
+	err.Code = code
+	prefix := ConstantsNameMap[err.ReplyCode] + " - "
+	suffix := " (" + code + ")"
+	text := err.text
+	if limit := maxReplyTextLength - len(prefix) - len(suffix); len(text) > limit {
+		text = text[:limit]
+	}
+	err.ReplyText = prefix + text + suffix
+	return err
+}
+
+// ParseErrorCode returns error code from reply text of channel or connection close or empty string
+func ParseErrorCode(replyText string) string {
+	if !strings.HasSuffix(replyText, ")") {
+		return ""
+	}
+	start := strings.LastIndex(replyText, " (ERR_")
+	if start < 0 {
+		return ""
+	}
+	return replyText[start+2 : len(replyText)-1]
+}
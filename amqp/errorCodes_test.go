@@ -0,0 +1,30 @@
+package amqp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestError_Code(t *testing.T) {
+	err := NewChannelError(NotFound, "queue 'test' not found", ClassQueue, MethodQueueDeclare)
+	if err.Code != "ERR_NOT_FOUND" || err.ReplyText != "NOT_FOUND - queue 'test' not found (ERR_NOT_FOUND)" {
+		t.Fatalf("Expected default code by reply code, actual '%s' in '%s'", err.Code, err.ReplyText)
+	}
+
+	err.WithCode(ErrQueueNotFound)
+	if err.ReplyText != "NOT_FOUND - queue 'test' not found (ERR_QUEUE_NOT_FOUND)" {
+		t.Fatalf("Expected specific code in reply text, actual '%s'", err.ReplyText)
+	}
+	if code := ParseErrorCode(err.ReplyText); code != ErrQueueNotFound {
+		t.Fatalf("Expected parsed code %s, actual '%s'", ErrQueueNotFound, code)
+	}
+	if code := ParseErrorCode("NOT_FOUND - no code"); code != "" {
+		t.Fatalf("Expected no code, actual '%s'", code)
+	}
+
+	// long text is truncated, code is kept
+	err = NewConnectionError(PreconditionFailed, strings.Repeat("a", 300), 0, 0).WithCode(ErrInvalidArgument)
+	if len(err.ReplyText) != maxReplyTextLength || ParseErrorCode(err.ReplyText) != ErrInvalidArgument {
+		t.Fatalf("Expected reply text of %d with code, actual %d '%s'", maxReplyTextLength, len(err.ReplyText), err.ReplyText)
+	}
+}
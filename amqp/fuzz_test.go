@@ -0,0 +1,122 @@
+//go:build go1.18
+// +build go1.18
+
+package amqp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// fuzzFrameMax bounds frames like server default frame max, so each input allocates at most that much
+const fuzzFrameMax = 128 << 10
+
+func frameBytes(frameType byte, payload []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	WriteFrame(buf, &Frame{Type: frameType, ChannelID: 1, Payload: payload})
+	return buf.Bytes()
+}
+
+func methodFrameBytes(method Method, protoVersion string) []byte {
+	payload := bytes.NewBuffer(nil)
+	WriteMethod(payload, method, protoVersion)
+	return frameBytes(FrameMethod, payload.Bytes())
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	contentType := "application/json"
+	timestamp := time.Unix(1500000000, 0)
+	table := &Table{"string": "value", "int": int32(1), "nested": Table{"array": []interface{}{int64(1), "item"}}}
+	for _, protoVersion := range []string{Proto091, ProtoRabbit} {
+		f.Add(methodFrameBytes(&ConnectionStartOk{ClientProperties: table, Mechanism: "PLAIN", Response: []byte("\x00guest\x00guest"), Locale: "en_US"}, protoVersion))
+		f.Add(methodFrameBytes(&QueueDeclare{Queue: "queue", Durable: true, Arguments: table}, protoVersion))
+		f.Add(methodFrameBytes(&BasicPublish{Exchange: "exchange", RoutingKey: "key", Mandatory: true}, protoVersion))
+
+		header := bytes.NewBuffer(nil)
+		WriteContentHeader(header, &ContentHeader{
+			ClassID:  ClassBasic,
+			BodySize: 4,
+			PropertyList: &BasicPropertyList{
+				ContentType: &contentType,
+				Headers:     table,
+				Timestamp:   &timestamp,
+			},
+		}, protoVersion)
+		f.Add(frameBytes(FrameHeader, header.Bytes()))
+	}
+	f.Add(frameBytes(FrameBody, []byte("body")))
+	f.Add(frameBytes(FrameHeartbeat, nil))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// frames are read from stream of unknown size, so frame max is the only bound of allocation
+		frame, err := ReadFrameMax(bufferedStream{bytes.NewReader(data)}, fuzzFrameMax)
+		if err != nil {
+			return
+		}
+		for _, protoVersion := range []string{Proto091, ProtoRabbit} {
+			switch frame.Type {
+			case FrameMethod:
+				ReadMethod(bytes.NewReader(frame.Payload), protoVersion)
+			case FrameHeader:
+				ReadContentHeader(bytes.NewReader(frame.Payload), protoVersion)
+			}
+		}
+	})
+}
+
+// bufferedStream hides size of underlying reader like network connection does
+type bufferedStream struct {
+	reader *bytes.Reader
+}
+
+func (stream bufferedStream) Read(p []byte) (int, error) {
+	return stream.reader.Read(p)
+}
+
+func TestReadFrameMax_Failed_TooLarge(t *testing.T) {
+	data := frameBytes(FrameBody, make([]byte, 100))
+
+	if _, err := ReadFrameMax(bufferedStream{bytes.NewReader(data)}, 100); err == nil {
+		t.Fatal("Expected error on frame larger than frame max")
+	} else if _, ok := err.(*DecodeError); !ok {
+		t.Fatalf("Expected decode error, actual %v", err)
+	}
+	if _, err := ReadFrameMax(bufferedStream{bytes.NewReader(data)}, 108); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadLongstr_Failed_DeclaredLengthExceedsData(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	WriteLong(buf, 1<<31)
+	buf.WriteString("short")
+
+	if _, err := ReadLongstr(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("Expected error on declared length exceeding data")
+	} else if _, ok := err.(*DecodeError); !ok {
+		t.Fatalf("Expected decode error, actual %v", err)
+	}
+	if _, err := ReadLongstr(bufferedStream{bytes.NewReader(buf.Bytes())}); err == nil {
+		t.Fatal("Expected error on declared length exceeding max")
+	}
+}
+
+func TestReadTable_Proto091_Values(t *testing.T) {
+	table := &Table{"string": "value", "bytes": []byte("bytes"), "nested": Table{"int": int32(1)}}
+	buf := bytes.NewBuffer(nil)
+	if err := WriteTable(buf, table, Proto091); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadTable(buf, Proto091)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*read)["string"] != "value" || string((*read)["bytes"].([]byte)) != "bytes" {
+		t.Fatalf("Expected string values read, actual %v", *read)
+	}
+	if nested, ok := (*read)["nested"].(*Table); !ok || (*nested)["int"] != int32(1) {
+		t.Fatalf("Expected nested table read, actual %v", (*read)["nested"])
+	}
+}
@@ -0,0 +1,48 @@
+package amqp
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// knownPropertyFlags are flags of basic properties, the lowest bits are continuation flag
+// and unused one, basic class has no properties behind them
+const knownPropertyFlags uint16 = 0xfffc
+
+// maxPriority is the highest priority property defined by AMQP 0-9-1
+const maxPriority = 9
+
+// Validate checks content header of published message is well-formed: basic class with zero weight,
+// no unknown property flags, reserved cluster-id property unset and property values in their ranges
+// Lenient parse passes such headers through, strict mode of vhost refuses them
+func (header *ContentHeader) Validate() error {
+	if header.ClassID != ClassBasic {
+		return fmt.Errorf("content header of class %d is not basic", header.ClassID)
+	}
+	if header.Weight != 0 {
+		return fmt.Errorf("content header weight %d is not zero", header.Weight)
+	}
+	if unknown := header.propertyFlags &^ knownPropertyFlags; unknown != 0 {
+		return fmt.Errorf("unknown property flags %#04x", unknown)
+	}
+
+	props := header.PropertyList
+	if props == nil {
+		return nil
+	}
+	if props.Reserved != nil {
+		return fmt.Errorf("reserved property cluster-id is set")
+	}
+	if props.DeliveryMode != nil && *props.DeliveryMode != 1 && *props.DeliveryMode != 2 {
+		return fmt.Errorf("invalid delivery-mode %d, expected 1 or 2", *props.DeliveryMode)
+	}
+	if props.Priority != nil && *props.Priority > maxPriority {
+		return fmt.Errorf("invalid priority %d, expected 0-%d", *props.Priority, maxPriority)
+	}
+	if props.Expiration != nil {
+		if _, err := strconv.ParseUint(*props.Expiration, 10, 32); err != nil {
+			return fmt.Errorf("invalid expiration '%s', expected milliseconds", *props.Expiration)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package amqp
+
+import "testing"
+
+func TestContentHeader_Validate(t *testing.T) {
+	deliveryMode, priority, expiration, clusterID := byte(2), byte(9), "60000", "cluster"
+	valid := &ContentHeader{ClassID: ClassBasic, PropertyList: &BasicPropertyList{
+		DeliveryMode: &deliveryMode,
+		Priority:     &priority,
+		Expiration:   &expiration,
+	}}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Expected valid header, actual %s", err)
+	}
+
+	invalidMode, invalidPriority, invalidExpiration := byte(3), byte(10), "-1"
+	invalid := []*ContentHeader{
+		{ClassID: ClassQueue, PropertyList: &BasicPropertyList{}},
+		{ClassID: ClassBasic, Weight: 1, PropertyList: &BasicPropertyList{}},
+		{ClassID: ClassBasic, propertyFlags: 1, PropertyList: &BasicPropertyList{}},
+		{ClassID: ClassBasic, PropertyList: &BasicPropertyList{Reserved: &clusterID}},
+		{ClassID: ClassBasic, PropertyList: &BasicPropertyList{DeliveryMode: &invalidMode}},
+		{ClassID: ClassBasic, PropertyList: &BasicPropertyList{Priority: &invalidPriority}},
+		{ClassID: ClassBasic, PropertyList: &BasicPropertyList{Expiration: &invalidExpiration}},
+	}
+	for i, header := range invalid {
+		if header.Validate() == nil {
+			t.Errorf("Expected error on invalid header %d", i)
+		}
+	}
+}
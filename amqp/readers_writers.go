@@ -25,6 +25,40 @@ const (
 	ProtoRabbit = "amqp-rabbit"
 )
 
+// MaxDeclaredLength caps declared length of long string, table or array read from stream of unknown size,
+// lengths read from in-memory buffers are checked against remaining data instead
+const MaxDeclaredLength = 128 << 20
+
+// DecodeError is returned on malformed input, e.g. declared length exceeding available data
+// Peer sent such input must be closed with frame-error
+type DecodeError struct {
+	Reason string
+}
+
+func (err *DecodeError) Error() string {
+	return "malformed data: " + err.Reason
+}
+
+// lenReader is reader with known remaining data size, e.g. bytes.Reader or bytes.Buffer
+type lenReader interface {
+	Len() int
+}
+
+// checkLength returns DecodeError if declared length can not be read from r,
+// so nothing is allocated for lengths of malformed input
+func checkLength(r io.Reader, length uint64) error {
+	if lr, ok := r.(lenReader); ok {
+		if length > uint64(lr.Len()) {
+			return &DecodeError{Reason: fmt.Sprintf("declared length %d exceeds remaining %d bytes", length, lr.Len())}
+		}
+		return nil
+	}
+	if length > MaxDeclaredLength {
+		return &DecodeError{Reason: fmt.Sprintf("declared length %d exceeds max %d bytes", length, MaxDeclaredLength)}
+	}
+	return nil
+}
+
 func writeSlice(wr io.Writer, data []byte) error {
 	_, err := wr.Write(data[:])
 	return err
@@ -49,6 +83,12 @@ To read a frame, we:
  3. Read the frame-end octet.
 */
 func ReadFrame(r io.Reader) (frame *Frame, err error) {
+	return ReadFrameMax(r, 0)
+}
+
+// ReadFrameMax reads frame like ReadFrame, but refuses frame larger than maxSize including header and frame-end
+// with DecodeError before payload is allocated, zero maxSize means frame size is checked only against remaining data
+func ReadFrameMax(r io.Reader, maxSize uint32) (frame *Frame, err error) {
 	// It does not matter that we call read methods 3 time
 	// Because net.TCPConn connection buffered by bufio.NewReader
 	frame = &Frame{}
@@ -63,6 +103,13 @@ func ReadFrame(r io.Reader) (frame *Frame, err error) {
 		return nil, err
 	}
 
+	if maxSize > 0 && uint64(payloadSize)+8 > uint64(maxSize) {
+		return nil, &DecodeError{Reason: fmt.Sprintf("frame size %d exceeds frame max %d", uint64(payloadSize)+8, maxSize)}
+	}
+	if err = checkLength(r, uint64(payloadSize)+1); err != nil {
+		return nil, err
+	}
+
 	var payload = make([]byte, payloadSize+1)
 	if _, err := io.ReadFull(r, payload); err != nil {
 		return nil, err
@@ -71,9 +118,9 @@ func ReadFrame(r io.Reader) (frame *Frame, err error) {
 
 	// check frame end
 	if payload[payloadSize] != FrameEnd {
-		return nil, fmt.Errorf(
+		return nil, &DecodeError{Reason: fmt.Sprintf(
 			"the frame-end octet MUST always be the hexadecimal value 'xCE', %x given",
-			payload[payloadSize])
+			payload[payloadSize])}
 	}
 
 	return frame, nil
@@ -100,6 +147,50 @@ func WriteFrame(wr io.Writer, frame *Frame) (err error) {
 	return nil
 }
 
+// Storage record format versions
+// Versioned record starts with zero marker byte followed by version byte.
+// Records written before versioning start with non-empty shortstr and are read as FormatVersion1
+// FormatVersion2 adds queue arguments
+const (
+	formatVersionMarker byte = 0
+
+	FormatVersion1       byte = 1
+	FormatVersion2       byte = 2
+	FormatVersionCurrent      = FormatVersion2
+)
+
+// WriteFormatVersion writes storage record version prefix
+func WriteFormatVersion(wr io.Writer, version byte) error {
+	if err := WriteOctet(wr, formatVersionMarker); err != nil {
+		return err
+	}
+	return WriteOctet(wr, version)
+}
+
+// IsVersionedFormat returns true if storage record has version prefix
+func IsVersionedFormat(data []byte) bool {
+	return len(data) > 0 && data[0] == formatVersionMarker
+}
+
+// ReadFormatVersion reads storage record version prefix
+// For record without prefix reader is rewound and FormatVersion1 returned
+func ReadFormatVersion(r *bytes.Reader) (version byte, err error) {
+	var marker byte
+	if marker, err = r.ReadByte(); err != nil {
+		return 0, err
+	}
+	if marker != formatVersionMarker {
+		return FormatVersion1, r.UnreadByte()
+	}
+	if version, err = r.ReadByte(); err != nil {
+		return 0, err
+	}
+	if version == 0 || version > FormatVersionCurrent {
+		return 0, fmt.Errorf("unsupported format version %d", version)
+	}
+	return version, nil
+}
+
 // ReadOctet reads octet (byte)
 func ReadOctet(r io.Reader) (data byte, err error) {
 	var b [1]byte
@@ -211,6 +302,9 @@ func ReadLongstr(r io.Reader) (data []byte, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = checkLength(r, uint64(length)); err != nil {
+		return nil, err
+	}
 
 	data = make([]byte, length)
 
@@ -234,15 +328,37 @@ func WriteLongstr(wr io.Writer, data []byte) error {
 	return nil
 }
 
+// Limits of decoded table, nested tables and arrays beyond them are refused with DecodeError
+const (
+	// MaxTableDepth is max nesting depth of tables and arrays
+	MaxTableDepth = 32
+	// MaxTableSize is total size budget of long strings, tables and arrays of one decoded table,
+	// nested values are copied from their parents, so budget bounds allocations on decode
+	MaxTableSize = 16 << 20
+)
+
+// tableDecoder tracks nesting depth and size budget while table is decoded
+type tableDecoder struct {
+	protoVersion string
+	depth        int
+	budget       int64
+}
+
 // ReadTable reads amqp table
 // Standard amqp table and rabbitmq table are little different
 // So we have second argument protoVersion to handle that issue
 func ReadTable(r io.Reader, protoVersion string) (data *Table, err error) {
+	decoder := &tableDecoder{protoVersion: protoVersion, budget: MaxTableSize}
+	return decoder.readTable(r)
+}
+
+func (decoder *tableDecoder) readTable(r io.Reader) (data *Table, err error) {
 	tmpData := Table{}
-	tableData, err := ReadLongstr(r)
+	tableData, err := decoder.readNested(r)
 	if err != nil {
 		return nil, err
 	}
+	defer decoder.leave()
 
 	tableReader := bytes.NewReader(tableData)
 	for tableReader.Len() > 0 {
@@ -252,7 +368,10 @@ func ReadTable(r io.Reader, protoVersion string) (data *Table, err error) {
 			return nil, errors.New("Unable to read key from table: " + err.Error())
 		}
 
-		if value, err = readV(tableReader, protoVersion); err != nil {
+		if value, err = decoder.readValue(tableReader); err != nil {
+			if _, ok := err.(*DecodeError); ok {
+				return nil, err
+			}
 			return nil, errors.New("Unable to read value from table: " + err.Error())
 		}
 
@@ -262,15 +381,52 @@ func ReadTable(r io.Reader, protoVersion string) (data *Table, err error) {
 	return &tmpData, nil
 }
 
-func readV(r io.Reader, protoVersion string) (data interface{}, err error) {
-	switch protoVersion {
+// readNested reads data of nested table or array, decoder.leave must be called after data is decoded
+func (decoder *tableDecoder) readNested(r io.Reader) ([]byte, error) {
+	if decoder.depth >= MaxTableDepth {
+		return nil, &DecodeError{Reason: fmt.Sprintf("table nesting depth exceeds max %d", MaxTableDepth)}
+	}
+	data, err := decoder.readLongstr(r)
+	if err != nil {
+		return nil, err
+	}
+	decoder.depth++
+	return data, nil
+}
+
+func (decoder *tableDecoder) leave() {
+	decoder.depth--
+}
+
+// readLongstr reads long string taking its length from size budget before it is allocated
+func (decoder *tableDecoder) readLongstr(r io.Reader) (data []byte, err error) {
+	var length uint32
+	if length, err = ReadLong(r); err != nil {
+		return nil, err
+	}
+	if decoder.budget -= int64(length); decoder.budget < 0 {
+		return nil, &DecodeError{Reason: fmt.Sprintf("table size exceeds max %d bytes", MaxTableSize)}
+	}
+	if err = checkLength(r, uint64(length)); err != nil {
+		return nil, err
+	}
+
+	data = make([]byte, length)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (decoder *tableDecoder) readValue(r io.Reader) (data interface{}, err error) {
+	switch decoder.protoVersion {
 	case Proto091:
-		return readValue091(r)
+		return readValue091(r, decoder)
 	case ProtoRabbit:
-		return readValueRabbit(r)
+		return readValueRabbit(r, decoder)
 	}
 
-	return nil, fmt.Errorf("unknown proto version [%s]", protoVersion)
+	return nil, fmt.Errorf("unknown proto version [%s]", decoder.protoVersion)
 }
 
 /*
@@ -295,7 +451,7 @@ Standard amqp-0-9-1 table fields
 'F' Table			field-table
 'V' nil				no-field
 */
-func readValue091(r io.Reader) (data interface{}, err error) {
+func readValue091(r io.Reader, decoder *tableDecoder) (data interface{}, err error) {
 	vType, err := ReadOctet(r)
 	if err != nil {
 		return nil, err
@@ -381,34 +537,34 @@ func readValue091(r io.Reader) (data interface{}, err error) {
 		return rData, nil
 	case 's':
 		var rData string
-		if rData, err = ReadShortstr(r); err == nil {
+		if rData, err = ReadShortstr(r); err != nil {
 			return nil, err
 		}
 
 		return rData, nil
 	case 'S':
 		var rData []byte
-		if rData, err = ReadLongstr(r); err == nil {
+		if rData, err = decoder.readLongstr(r); err != nil {
 			return nil, err
 		}
 
 		return rData, nil
 	case 'T':
 		var rData time.Time
-		if rData, err = ReadTimestamp(r); err == nil {
+		if rData, err = ReadTimestamp(r); err != nil {
 			return nil, err
 		}
 
 		return rData, nil
 	case 'A':
 		var rData []interface{}
-		if rData, err = readArray(r, Proto091); err == nil {
+		if rData, err = decoder.readArray(r); err != nil {
 			return nil, err
 		}
 		return rData, nil
 	case 'F':
 		var rData *Table
-		if rData, err = ReadTable(r, Proto091); err == nil {
+		if rData, err = decoder.readTable(r); err != nil {
 			return nil, err
 		}
 		return rData, nil
@@ -434,9 +590,10 @@ Rabbitmq table fields
 'T' time.Time		timestamp
 'F' Table			field-table
 'V' nil				no-field
-'x' []interface{} 	field-array
+'A' []interface{} 	field-array
+'x' []interface{} 	field-array, written by previous versions, kept to read stored messages
 */
-func readValueRabbit(r io.Reader) (data interface{}, err error) {
+func readValueRabbit(r io.Reader, decoder *tableDecoder) (data interface{}, err error) {
 	vType, err := ReadOctet(r)
 	if err != nil {
 		return nil, err
@@ -498,7 +655,7 @@ func readValueRabbit(r io.Reader) (data interface{}, err error) {
 		return rData, nil
 	case 'S':
 		var rData []byte
-		if rData, err = ReadLongstr(r); err != nil {
+		if rData, err = decoder.readLongstr(r); err != nil {
 			return nil, err
 		}
 
@@ -510,15 +667,15 @@ func readValueRabbit(r io.Reader) (data interface{}, err error) {
 		}
 
 		return rData, nil
-	case 'x':
+	case 'A', 'x':
 		var rData []interface{}
-		if rData, err = readArray(r, ProtoRabbit); err != nil {
+		if rData, err = decoder.readArray(r); err != nil {
 			return nil, err
 		}
 		return rData, nil
 	case 'F':
 		var rData *Table
-		if rData, err = ReadTable(r, ProtoRabbit); err != nil {
+		if rData, err = decoder.readTable(r); err != nil {
 			return nil, err
 		}
 		return rData, nil
@@ -680,7 +837,7 @@ Rabbitmq table fields
 'T' time.Time		timestamp
 'F' Table			field-table
 'V' nil				no-field
-'x' []interface{} 	field-array
+'A' []interface{} 	field-array
 */
 func writeValueRabbit(writer io.Writer, v interface{}) (err error) {
 	switch value := v.(type) {
@@ -751,7 +908,7 @@ func writeValueRabbit(writer io.Writer, v interface{}) (err error) {
 			err = WriteTimestamp(writer, value)
 		}
 	case []interface{}:
-		if err = WriteOctet(writer, byte('x')); err == nil {
+		if err = WriteOctet(writer, byte('A')); err == nil {
 			err = writeArray(writer, value, ProtoRabbit)
 		}
 	case Table:
@@ -779,17 +936,18 @@ func writeArray(writer io.Writer, array []interface{}, protoVersion string) erro
 	return WriteLongstr(writer, buf.Bytes())
 }
 
-func readArray(r io.Reader, protoVersion string) (data []interface{}, err error) {
+func (decoder *tableDecoder) readArray(r io.Reader) (data []interface{}, err error) {
 	data = make([]interface{}, 0)
 	var arrayData []byte
-	if arrayData, err = ReadLongstr(r); err != nil {
+	if arrayData, err = decoder.readNested(r); err != nil {
 		return nil, err
 	}
+	defer decoder.leave()
 
 	arrayBuffer := bytes.NewBuffer(arrayData)
 	for arrayBuffer.Len() > 0 {
 		var itemV interface{}
-		if itemV, err = readV(arrayBuffer, protoVersion); err != nil {
+		if itemV, err = decoder.readValue(arrayBuffer); err != nil {
 			return nil, err
 		}
 
@@ -3,6 +3,7 @@ package amqp
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 	"reflect"
 	"testing"
 	"time"
@@ -267,7 +268,7 @@ Rabbitmq table fields
 'T' time.Time		timestamp
 'F' Table			field-table
 'V' nil				no-field
-'x' []interface{} 	field-array
+'A' []interface{} 	field-array
 */
 func TestReadWriteTable(t *testing.T) {
 
@@ -313,3 +314,77 @@ func TestReadWriteTable(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func nestedTable(depth int) Table {
+	table := Table{}
+	for i := 0; i < depth; i++ {
+		table = Table{"t": table}
+	}
+	return table
+}
+
+func TestReadTable_Failed_DeepNesting(t *testing.T) {
+	for _, protoVersion := range []string{Proto091, ProtoRabbit} {
+		// top level table is the first nesting level
+		allowed := nestedTable(MaxTableDepth - 1)
+		wr := bytes.NewBuffer(make([]byte, 0))
+		if err := WriteTable(wr, &allowed, protoVersion); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadTable(wr, protoVersion); err != nil {
+			t.Fatalf("Expected table with max depth read, actual %v", err)
+		}
+
+		refused := nestedTable(MaxTableDepth)
+		wr.Reset()
+		if err := WriteTable(wr, &refused, protoVersion); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadTable(wr, protoVersion); err == nil {
+			t.Fatal("Expected error on table deeper than max depth")
+		} else if _, ok := err.(*DecodeError); !ok {
+			t.Fatalf("Expected decode error, actual %v", err)
+		}
+	}
+
+	// nested arrays are limited the same way
+	array := []interface{}{}
+	for i := 0; i < MaxTableDepth; i++ {
+		array = []interface{}{array}
+	}
+	wr := bytes.NewBuffer(make([]byte, 0))
+	if err := WriteTable(wr, &Table{"a": array}, ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadTable(wr, ProtoRabbit); err == nil {
+		t.Fatal("Expected error on array deeper than max depth")
+	}
+}
+
+func TestReadTable_Failed_OversizedDeclaredLength(t *testing.T) {
+	// nested long string declares 1Gb within small table
+	value := bytes.NewBuffer(make([]byte, 0))
+	WriteShortstr(value, "key")
+	WriteOctet(value, 'S')
+	WriteLong(value, 1<<30)
+	value.WriteString("data")
+	wr := bytes.NewBuffer(make([]byte, 0))
+	WriteLongstr(wr, value.Bytes())
+
+	for _, reader := range []io.Reader{bytes.NewReader(wr.Bytes()), bufferedStream{bytes.NewReader(wr.Bytes())}} {
+		if _, err := ReadTable(reader, ProtoRabbit); err == nil {
+			t.Fatal("Expected error on oversized declared length")
+		} else if _, ok := err.(*DecodeError); !ok {
+			t.Fatalf("Expected decode error, actual %v", err)
+		}
+	}
+
+	// top level table larger than size budget is refused before it is read
+	wr.Reset()
+	WriteLong(wr, MaxTableSize+1)
+	if _, err := ReadTable(bufferedStream{bytes.NewReader(wr.Bytes())}, ProtoRabbit); err == nil {
+		t.Fatal("Expected error on table larger than max size")
+	} else if _, ok := err.(*DecodeError); !ok {
+		t.Fatalf("Expected decode error, actual %v", err)
+	}
+}
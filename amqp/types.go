@@ -13,6 +13,32 @@ var emptyMessageBufferPool = pool.NewBufferPool(0)
 // Table - simple amqp-table implementation
 type Table map[string]interface{}
 
+// Int64 returns integer value of the table field converted to int64
+// ok is false if field not exists or value is not an integer
+func (table Table) Int64(key string) (value int64, ok bool) {
+	switch v := table[key].(type) {
+	case int8:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
+
 // Decimal represents amqp-decimal data
 type Decimal struct {
 	Scale uint8
@@ -44,6 +70,8 @@ type ConfirmMeta struct {
 	DeliveryTag      uint64
 	ExpectedConfirms int
 	ActualConfirms   int
+	// Nack means message was refused and publisher should be notified with basic.nack
+	Nack bool
 }
 
 // CanConfirm returns is message can be confirmed
@@ -52,6 +80,8 @@ func (meta *ConfirmMeta) CanConfirm() bool {
 }
 
 // Message represents amqp-message and meta-data
+// On fan-out the same message instance is pushed into every matched queue, so Header and Body
+// are shared between queues and deliveries and must not be modified after publish
 type Message struct {
 	ID            uint64
 	BodySize      uint64
@@ -63,6 +93,8 @@ type Message struct {
 	ConfirmMeta   *ConfirmMeta
 	Header        *ContentHeader
 	Body          []*Frame
+	// brokerGzipped is set for body compressed by broker transparently, see compress.go
+	brokerGzipped bool
 }
 
 // when server restart we can't start again count messages from 0
@@ -86,6 +118,70 @@ func (m *Message) IsPersistent() bool {
 	return deliveryMode != nil && *deliveryMode == 2
 }
 
+// DeadlineHeader is message header with absolute unix time in milliseconds,
+// message which is not delivered until it is dropped
+const DeadlineHeader = "x-deadline"
+
+// RoutingTraceHeader is message header with array of exchanges visited by message, it is set if routing trace
+// is enabled for vhost
+const RoutingTraceHeader = "x-routing-trace"
+
+// IsDeadlinePassed returns is deadline set by DeadlineHeader passed at given time
+func (m *Message) IsDeadlinePassed(now time.Time) bool {
+	if m.Header == nil || m.Header.PropertyList == nil || m.Header.PropertyList.Headers == nil {
+		return false
+	}
+	deadline, ok := m.Header.PropertyList.Headers.Int64(DeadlineHeader)
+	return ok && now.UnixNano()/int64(time.Millisecond) >= deadline
+}
+
+// Sender-selected distribution headers with arrays of additional routing keys, BCC header is not delivered
+const (
+	CCHeader  = "CC"
+	BCCHeader = "BCC"
+)
+
+// RoutingKeys returns routing key of message followed by keys from CC and BCC headers without duplicates
+func (m *Message) RoutingKeys() []string {
+	keys := []string{m.RoutingKey}
+	if m.Header == nil || m.Header.PropertyList == nil || m.Header.PropertyList.Headers == nil {
+		return keys
+	}
+	seen := map[string]bool{m.RoutingKey: true}
+	for _, header := range []string{CCHeader, BCCHeader} {
+		values, _ := (*m.Header.PropertyList.Headers)[header].([]interface{})
+		for _, value := range values {
+			var key string
+			switch v := value.(type) {
+			case string:
+				key = v
+			case []byte:
+				key = string(v)
+			default:
+				continue
+			}
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// WithoutBCC returns message itself if it has no BCC header, otherwise copy of message without it
+func (m *Message) WithoutBCC() *Message {
+	if m.Header == nil || m.Header.PropertyList == nil || m.Header.PropertyList.Headers == nil {
+		return m
+	}
+	if _, ok := (*m.Header.PropertyList.Headers)[BCCHeader]; !ok {
+		return m
+	}
+	message := m.Copy()
+	delete(*message.Header.PropertyList.Headers, BCCHeader)
+	return message
+}
+
 // GenerateSeq returns next message ID
 func (m *Message) GenerateSeq() {
 	if m.ID == 0 {
@@ -93,6 +189,34 @@ func (m *Message) GenerateSeq() {
 	}
 }
 
+// Copy returns copy of message with own header, property list and headers table
+// Body frames and confirm meta are shared with the source message
+func (m *Message) Copy() *Message {
+	message := *m
+	message.Body = make([]*Frame, len(m.Body))
+	copy(message.Body, m.Body)
+
+	if m.Header == nil {
+		return &message
+	}
+	header := *m.Header
+	message.Header = &header
+	if m.Header.PropertyList == nil {
+		return &message
+	}
+	propertyList := *m.Header.PropertyList
+	header.PropertyList = &propertyList
+	if propertyList.Headers != nil {
+		headers := make(Table, len(*propertyList.Headers))
+		for key, value := range *propertyList.Headers {
+			headers[key] = value
+		}
+		propertyList.Headers = &headers
+	}
+
+	return &message
+}
+
 // Append appends new body-frame into message and increase bodySize
 func (m *Message) Append(body *Frame) {
 	m.Body = append(m.Body, body)
@@ -123,6 +247,16 @@ func (m *Message) Marshal(protoVersion string) (data []byte, err error) {
 			return nil, err
 		}
 	}
+	// delivery count follows body, so message recovered from storage keeps its redelivered flag
+	if err = WriteLong(buffer, m.DeliveryCount); err != nil {
+		return nil, err
+	}
+	// flag follows delivery count and is written only if set, so other records are stored as before
+	if m.brokerGzipped {
+		if err = WriteOctet(buffer, 1); err != nil {
+			return nil, err
+		}
+	}
 
 	data = make([]byte, buffer.Len())
 	copy(data, buffer.Bytes())
@@ -154,6 +288,20 @@ func (m *Message) Unmarshal(buffer []byte, protoVersion string) (err error) {
 		m.Append(body)
 	}
 
+	// records stored before delivery count was kept end with body
+	if reader.Len() > 0 {
+		if m.DeliveryCount, err = ReadLong(reader); err != nil {
+			return err
+		}
+	}
+	if reader.Len() > 0 {
+		var brokerGzipped byte
+		if brokerGzipped, err = ReadOctet(reader); err != nil {
+			return err
+		}
+		m.brokerGzipped = brokerGzipped == 1
+	}
+
 	return nil
 }
 
@@ -164,36 +312,35 @@ const (
 )
 
 // Error represents AMQP-error data
+// Code is stable machine-readable error code, it is appended to ReplyText, see errorCodes.go
 type Error struct {
 	ReplyCode uint16
 	ReplyText string
 	ClassID   uint16
 	MethodID  uint16
 	ErrorType int
+	Code      string
+	text      string
 }
 
 // NewConnectionError returns new connection error. If caused - connection should be closed
 func NewConnectionError(code uint16, text string, classID uint16, methodID uint16) *Error {
-	err := &Error{
-		ReplyCode: code,
-		ReplyText: ConstantsNameMap[code] + " - " + text,
-		ClassID:   classID,
-		MethodID:  methodID,
-		ErrorType: ErrorOnConnection,
-	}
-
-	return err
+	return newError(code, text, classID, methodID, ErrorOnConnection)
 }
 
 // NewChannelError returns new channel error& If caused - channel should be closed
 func NewChannelError(code uint16, text string, classID uint16, methodID uint16) *Error {
+	return newError(code, text, classID, methodID, ErrorOnChannel)
+}
+
+func newError(code uint16, text string, classID uint16, methodID uint16, errorType int) *Error {
 	err := &Error{
 		ReplyCode: code,
-		ReplyText: ConstantsNameMap[code] + " - " + text,
 		ClassID:   classID,
 		MethodID:  methodID,
-		ErrorType: ErrorOnChannel,
+		ErrorType: errorType,
+		text:      text,
 	}
 
-	return err
+	return err.WithCode(ReplyErrorCode(code))
 }
@@ -106,6 +106,7 @@ func TestMessage_Marshal_Unmarshal(t *testing.T) {
 			},
 		},
 	}
+	mM.DeliveryCount = 2
 
 	bytes, err := mM.Marshal(ProtoRabbit)
 	if err != nil {
@@ -117,6 +118,33 @@ func TestMessage_Marshal_Unmarshal(t *testing.T) {
 	if !reflect.DeepEqual(mM, mU) {
 		t.Fatalf("Marshaled and unmarshaled structures not equal")
 	}
+
+	// record stored without delivery count
+	mU = &Message{}
+	if err = mU.Unmarshal(bytes[:len(bytes)-4], ProtoRabbit); err != nil || mU.DeliveryCount != 0 || mU.BodySize != 4 {
+		t.Fatalf("Expected message without delivery count, actual %d, error %v", mU.DeliveryCount, err)
+	}
+}
+
+func TestMessage_Copy(t *testing.T) {
+	headers := Table{"key": "value"}
+	m := &Message{
+		RoutingKey:  "test",
+		ConfirmMeta: &ConfirmMeta{},
+		Header:      &ContentHeader{PropertyList: &BasicPropertyList{Headers: &headers}},
+	}
+	m.Append(&Frame{Type: byte(FrameBody), Payload: []byte("test")})
+
+	c := m.Copy()
+	(*c.Header.PropertyList.Headers)["key"] = "changed"
+	c.Append(&Frame{Type: byte(FrameBody), Payload: []byte("more")})
+
+	if headers["key"] != "value" || len(m.Body) != 1 {
+		t.Error("Expected source message is not changed by its copy")
+	}
+	if c.RoutingKey != m.RoutingKey || c.ConfirmMeta != m.ConfirmMeta || c.Body[0] != m.Body[0] {
+		t.Error("Expected copy with the same routing key, confirm meta and body frames")
+	}
 }
 
 func TestMessage_IsPersistent(t *testing.T) {
@@ -164,3 +192,56 @@ func TestNewConnectionError(t *testing.T) {
 		t.Fatal("Expected connection error")
 	}
 }
+
+func TestTable_Int64(t *testing.T) {
+	table := Table{
+		"int8":   int8(-8),
+		"uint16": uint16(16),
+		"int32":  int32(32),
+		"uint64": uint64(64),
+		"string": "64",
+	}
+
+	if value, ok := table.Int64("int8"); !ok || value != -8 {
+		t.Errorf("Expected %d, actual %d", -8, value)
+	}
+	if value, ok := table.Int64("uint16"); !ok || value != 16 {
+		t.Errorf("Expected %d, actual %d", 16, value)
+	}
+	if value, ok := table.Int64("int32"); !ok || value != 32 {
+		t.Errorf("Expected %d, actual %d", 32, value)
+	}
+	if value, ok := table.Int64("uint64"); !ok || value != 64 {
+		t.Errorf("Expected %d, actual %d", 64, value)
+	}
+	if _, ok := table.Int64("string"); ok {
+		t.Error("Expected not ok on string value")
+	}
+	if _, ok := table.Int64("missing"); ok {
+		t.Error("Expected not ok on missing field")
+	}
+}
+
+func TestMessage_RoutingKeys(t *testing.T) {
+	message := &Message{RoutingKey: "key", Header: &ContentHeader{PropertyList: &BasicPropertyList{
+		Headers: &Table{
+			CCHeader:  []interface{}{"cc", []byte("key")},
+			BCCHeader: []interface{}{[]byte("bcc"), "cc", int32(1)},
+		},
+	}}}
+
+	if keys := message.RoutingKeys(); !reflect.DeepEqual(keys, []string{"key", "cc", "bcc"}) {
+		t.Errorf("Expected routing keys [key cc bcc], actual %v", keys)
+	}
+
+	stripped := message.WithoutBCC()
+	if _, ok := (*stripped.Header.PropertyList.Headers)[BCCHeader]; ok {
+		t.Error("Expected BCC header removed")
+	}
+	if _, ok := (*message.Header.PropertyList.Headers)[BCCHeader]; !ok {
+		t.Error("Expected BCC header kept in source message")
+	}
+	if stripped.WithoutBCC() != stripped {
+		t.Error("Expected message without BCC returned as is")
+	}
+}
@@ -0,0 +1,232 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Overflow policies of full records buffer
+const (
+	// OverflowDrop drops records while buffer is full, publishers are never blocked
+	OverflowDrop = "drop"
+	// OverflowBlock blocks publishers until buffer has free space
+	OverflowBlock = "block"
+)
+
+// Record is metadata of published message
+// Sequence is assigned by log and increases by one for each record, so gaps show dropped records
+type Record struct {
+	Sequence   uint64    `json:"seq"`
+	Timestamp  time.Time `json:"timestamp"`
+	Vhost      string    `json:"vhost"`
+	Exchange   string    `json:"exchange"`
+	RoutingKey string    `json:"routingKey"`
+	User       string    `json:"user"`
+	Size       uint64    `json:"size"`
+	Body       []byte    `json:"body,omitempty"`
+}
+
+// Log is append-only log of records written as JSON lines by background writer,
+// file is rotated into path.1 ... path.<maxFiles> when its size exceeds maxSize
+type Log struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	block    bool
+
+	records  chan *Record
+	seq      uint64
+	dropped  uint64
+	lock     sync.RWMutex
+	closed   bool
+	done     chan struct{}
+	file     *os.File
+	writer   *bufio.Writer
+	fileSize int64
+}
+
+// NewLog returns new instance of Log appending to file at path, zero maxSize disables rotation
+func NewLog(path string, maxSize int64, maxFiles int, bufferSize int, overflow string) (*Log, error) {
+	l, err := newLog(path, maxSize, maxFiles, bufferSize, overflow)
+	if err != nil {
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+func newLog(path string, maxSize int64, maxFiles int, bufferSize int, overflow string) (*Log, error) {
+	if overflow != OverflowDrop && overflow != OverflowBlock {
+		return nil, fmt.Errorf("invalid audit overflow policy '%s': expected '%s' or '%s'", overflow, OverflowDrop, OverflowBlock)
+	}
+	l := &Log{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		block:    overflow == OverflowBlock,
+		records:  make(chan *Record, bufferSize),
+		done:     make(chan struct{}),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write queues record to be written and returns false if record is dropped
+func (l *Log) Write(record *Record) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.closed {
+		return false
+	}
+
+	// sequence is taken before send, so dropped record leaves gap
+	record.Sequence = atomic.AddUint64(&l.seq, 1)
+	if l.block {
+		l.records <- record
+		return true
+	}
+
+	select {
+	case l.records <- record:
+		return true
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+		return false
+	}
+}
+
+// Dropped returns count of records dropped on full buffer
+func (l *Log) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// Close writes queued records and closes log file, records written after close are dropped
+func (l *Log) Close() error {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.records)
+	l.lock.Unlock()
+
+	<-l.done
+	if err := l.writer.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+func (l *Log) run() {
+	defer close(l.done)
+	for record := range l.records {
+		if err := l.write(record); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"path": l.path,
+			}).Error("Error on writing audit record")
+		}
+		// flush once buffered records are written, so log is not behind publishes for long
+		if len(l.records) == 0 {
+			if err := l.writer.Flush(); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"path": l.path,
+				}).Error("Error on flushing audit log")
+			}
+		}
+	}
+}
+
+func (l *Log) write(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.maxSize > 0 && l.fileSize > 0 && l.fileSize+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.writer.Write(line)
+	l.fileSize += int64(n)
+	return err
+}
+
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.fileSize = info.Size()
+	if l.writer == nil {
+		l.writer = bufio.NewWriter(file)
+	} else {
+		l.writer.Reset(file)
+	}
+	return nil
+}
+
+// rotate shifts path.N into path.N+1 dropping the oldest one and reopens empty file at path
+func (l *Log) rotate() error {
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	if l.maxFiles > 0 {
+		os.Remove(rotatedPath(l.path, l.maxFiles))
+		for i := l.maxFiles - 1; i > 0; i-- {
+			os.Rename(rotatedPath(l.path, i), rotatedPath(l.path, i+1))
+		}
+		if err := os.Rename(l.path, rotatedPath(l.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+func rotatedPath(path string, index int) string {
+	return fmt.Sprintf("%s.%d", path, index)
+}
+
+// Replay reads records written into log file and calls fn for each of them in order
+func Replay(r io.Reader, fn func(record *Record) error) error {
+	decoder := json.NewDecoder(r)
+	for {
+		record := &Record{}
+		if err := decoder.Decode(record); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readRecords(t *testing.T, path string) []*Record {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []*Record
+	if err := Replay(file, func(record *Record) error {
+		records = append(records, record)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestLog_Write_Success(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := NewLog(path, 0, 0, 16, OverflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"first", "second"} {
+		l.Write(&Record{Exchange: "ex", RoutingKey: key, User: "guest", Size: 4, Body: []byte("test")})
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l.Write(&Record{}) {
+		t.Error("Expected record written after close dropped")
+	}
+
+	records := readRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("Expected %d records, actual %d", 2, len(records))
+	}
+	for i, key := range []string{"first", "second"} {
+		record := records[i]
+		if record.Sequence != uint64(i+1) || record.RoutingKey != key || record.Exchange != "ex" || record.User != "guest" || string(record.Body) != "test" {
+			t.Errorf("Unexpected record %+v", record)
+		}
+	}
+}
+
+func TestLog_Rotate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := NewLog(path, 1, 2, 16, OverflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		l.Write(&Record{Exchange: "ex"})
+	}
+	l.Close()
+
+	// each record exceeds max size, so every file keeps single record and the oldest one is removed
+	for path, seq := range map[string]uint64{path: 4, path + ".1": 3, path + ".2": 2} {
+		records := readRecords(t, path)
+		if len(records) != 1 || records[0].Sequence != seq {
+			t.Errorf("Expected record %d in %s, actual %+v", seq, path, records)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Expected oldest rotated file removed")
+	}
+}
+
+func TestLog_Write_Drop(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// writer is not started, so buffer is never drained
+	l, err := newLog(path, 0, 0, 1, OverflowDrop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Write(&Record{}) {
+		t.Fatal("Expected record queued")
+	}
+	if l.Write(&Record{}) {
+		t.Fatal("Expected record dropped on full buffer")
+	}
+	if l.Dropped() != 1 {
+		t.Errorf("Expected %d dropped records, actual %d", 1, l.Dropped())
+	}
+
+	go l.run()
+	l.Close()
+	if records := readRecords(t, path); len(records) != 1 || records[0].Sequence != 1 {
+		t.Errorf("Expected only first record written, actual %+v", records)
+	}
+}
+
+func TestNewLog_Failed_InvalidOverflow(t *testing.T) {
+	if _, err := NewLog("audit.log", 0, 0, 1, "wait"); err == nil {
+		t.Error("Expected error on invalid overflow policy")
+	}
+}
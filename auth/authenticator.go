@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrLoginFailure is returned on any authentication failure,
+// so client can't find out whether user exists or password is wrong
+var ErrLoginFailure = errors.New("login failure")
+
+// Identity represents user resolved by Authenticator
+// Authorizer is set if permissions are resolved along with identity, e.g. from token scopes,
+// otherwise server authorizer is used
+type Identity struct {
+	Username   string
+	Authorizer Authorizer
+}
+
+// Authenticator validates user credentials and resolves user identity
+type Authenticator interface {
+	Authenticate(user string, password string) (Identity, error)
+}
+
+// UsersAuthenticator authenticates users from local user store with hashed passwords
+type UsersAuthenticator struct {
+	sync.RWMutex
+	users map[string]string
+	isMd5 bool
+}
+
+// NewUsersAuthenticator returns new instance of UsersAuthenticator
+// users maps user name to password hash
+func NewUsersAuthenticator(users map[string]string, isMd5 bool) *UsersAuthenticator {
+	return &UsersAuthenticator{
+		users: users,
+		isMd5: isMd5,
+	}
+}
+
+// Authenticate checks password of local user
+func (authenticator *UsersAuthenticator) Authenticate(user string, password string) (Identity, error) {
+	authenticator.RLock()
+	hash, ok := authenticator.users[user]
+	authenticator.RUnlock()
+	if !ok || !CheckPasswordHash(password, hash, authenticator.isMd5) {
+		return Identity{}, ErrLoginFailure
+	}
+	return Identity{Username: user}, nil
+}
+
+// SetUsers replaces local user store, e.g. on config reload
+func (authenticator *UsersAuthenticator) SetUsers(users map[string]string) {
+	authenticator.Lock()
+	defer authenticator.Unlock()
+	authenticator.users = users
+}
+
+// ChainAuthenticator tries authenticators in order until one accepts credentials
+type ChainAuthenticator []Authenticator
+
+// Authenticate returns identity resolved by first authenticator accepted credentials
+// Backend errors other than ErrLoginFailure are returned to be logged, if no authenticator accepted credentials
+func (chain ChainAuthenticator) Authenticate(user string, password string) (Identity, error) {
+	lastErr := ErrLoginFailure
+	for _, authenticator := range chain {
+		identity, err := authenticator.Authenticate(user, password)
+		if err == nil {
+			return identity, nil
+		}
+		if err != ErrLoginFailure {
+			lastErr = err
+		}
+	}
+	return Identity{}, lastErr
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwks represents JSON Web Key Set document
+type jwks struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// jwksRefetchInterval limits reloads of key set on unknown key id, so tokens with random key ids
+// can't make broker flood JWKS endpoint
+const jwksRefetchInterval = 10 * time.Second
+
+// jwksCache holds RSA keys loaded from JWKS endpoint, keys are reloaded when refresh interval is passed
+// or token is signed by unknown key, e.g. after key rotation
+// Key set is fetched under loadLock only, so authentications with cached keys don't wait for JWKS endpoint
+type jwksCache struct {
+	sync.Mutex
+	loadLock        sync.Mutex
+	url             string
+	refreshInterval time.Duration
+	refetchInterval time.Duration
+	client          *http.Client
+	keys            map[string]*rsa.PublicKey
+	loaded          time.Time
+	refetched       time.Time
+}
+
+func newJWKSCache(url string, refreshInterval time.Duration, client *http.Client) *jwksCache {
+	return &jwksCache{
+		url:             url,
+		refreshInterval: refreshInterval,
+		refetchInterval: jwksRefetchInterval,
+		client:          client,
+	}
+}
+
+// key returns key by id, empty id is allowed if key set contains the only key
+func (cache *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	cache.Lock()
+	keys, loaded := cache.keys, cache.loaded
+	cache.Unlock()
+
+	var err error
+	if keys == nil || time.Since(loaded) >= cache.refreshInterval {
+		if keys, loaded, err = cache.reload(loaded, false); err != nil {
+			return nil, err
+		}
+	}
+	if key := findKey(keys, kid); key != nil {
+		return key, nil
+	}
+
+	if keys, _, err = cache.reload(loaded, true); err != nil {
+		return nil, err
+	}
+	if key := findKey(keys, kid); key != nil {
+		return key, nil
+	}
+	return nil, ErrLoginFailure
+}
+
+// reload fetches key set unless it is loaded by other request after given load time,
+// refetch on unknown key is skipped within refetch interval
+func (cache *jwksCache) reload(since time.Time, refetch bool) (map[string]*rsa.PublicKey, time.Time, error) {
+	cache.loadLock.Lock()
+	defer cache.loadLock.Unlock()
+
+	cache.Lock()
+	if cache.keys != nil && cache.loaded.After(since) {
+		defer cache.Unlock()
+		return cache.keys, cache.loaded, nil
+	}
+	if refetch {
+		if time.Since(cache.refetched) < cache.refetchInterval {
+			defer cache.Unlock()
+			return cache.keys, cache.loaded, nil
+		}
+		cache.refetched = time.Now()
+	}
+	cache.Unlock()
+
+	keys, err := cache.fetch()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+	cache.keys = keys
+	cache.loaded = time.Now()
+	return cache.keys, cache.loaded, nil
+}
+
+func findKey(keys map[string]*rsa.PublicKey, kid string) *rsa.PublicKey {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+	return keys[kid]
+}
+
+func (cache *jwksCache) fetch() (map[string]*rsa.PublicKey, error) {
+	response, err := cache.client.Get(cache.url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected JWKS response status %d", response.StatusCode)
+	}
+
+	var keySet jwks
+	if err := json.NewDecoder(response.Body).Decode(&keySet); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) == 0 {
+			return nil, errors.New("invalid RSA key in JWKS")
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
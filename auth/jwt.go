@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha256" // register hashes of RS256, RS384 and RS512
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string     `json:"sub"`
+	ExpiresAt int64      `json:"exp"`
+	NotBefore int64      `json:"nbf"`
+	Audience  stringList `json:"aud"`
+	Scope     stringList `json:"scope"`
+}
+
+// stringList is JSON claim which may be either string or array of strings
+type stringList []string
+
+func (list *stringList) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*list = stringList{value}
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*list = values
+	return nil
+}
+
+func (list stringList) contains(value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// JWTAuthenticator authenticates clients by OAuth 2.0 access token in JWT format passed as password,
+// user name is ignored and identity is resolved from token subject
+// Token signature is verified by RSA keys from JWKS endpoint, token scopes with resource server id prefix
+// grant permissions, see ScopeAuthorizer
+type JWTAuthenticator struct {
+	keys             *jwksCache
+	resourceServerID string
+	now              func() time.Time
+}
+
+// NewJWTAuthenticator returns new instance of JWTAuthenticator
+// JWKS keys are cached and reloaded after refresh interval, token audience must contain resource server id if it is set
+func NewJWTAuthenticator(jwksURL string, refreshInterval time.Duration, resourceServerID string, client *http.Client) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		keys:             newJWKSCache(jwksURL, refreshInterval, client),
+		resourceServerID: resourceServerID,
+		now:              time.Now,
+	}
+}
+
+// Authenticate verifies token and returns identity with permissions from token scopes
+// Invalid or expired token returns ErrLoginFailure, JWKS loading errors are returned as is
+func (authenticator *JWTAuthenticator) Authenticate(user string, token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, ErrLoginFailure
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return Identity{}, ErrLoginFailure
+	}
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return Identity{}, ErrLoginFailure
+	}
+
+	key, err := authenticator.keys.key(header.Kid)
+	if err != nil {
+		return Identity{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, ErrLoginFailure
+	}
+	digest := hash.New()
+	digest.Write([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, hash, digest.Sum(nil), signature) != nil {
+		return Identity{}, ErrLoginFailure
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return Identity{}, ErrLoginFailure
+	}
+	now := authenticator.now().Unix()
+	if claims.Subject == "" || claims.ExpiresAt == 0 || now >= claims.ExpiresAt || now < claims.NotBefore {
+		return Identity{}, ErrLoginFailure
+	}
+
+	prefix := ""
+	if authenticator.resourceServerID != "" {
+		if !claims.Audience.contains(authenticator.resourceServerID) {
+			return Identity{}, ErrLoginFailure
+		}
+		prefix = authenticator.resourceServerID + "."
+	}
+
+	var scopes []string
+	for _, scope := range claims.Scope {
+		scopes = append(scopes, strings.Fields(scope)...)
+	}
+
+	return Identity{
+		Username:   claims.Subject,
+		Authorizer: NewScopeAuthorizer(prefix, scopes),
+	}, nil
+}
+
+func decodeJWTPart(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type jwtTestIssuer struct {
+	sync.Mutex
+	kid      string
+	key      *rsa.PrivateKey
+	blocked  chan struct{}
+	server   *httptest.Server
+	requests int32
+}
+
+func newJWTTestIssuer(t *testing.T) *jwtTestIssuer {
+	issuer := &jwtTestIssuer{}
+	issuer.rotate(t, "test")
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&issuer.requests, 1)
+		issuer.Lock()
+		kid, key, blocked := issuer.kid, issuer.key, issuer.blocked
+		issuer.Unlock()
+		if blocked != nil {
+			<-blocked
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": kid,
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	return issuer
+}
+
+// rotate replaces signing key, JWKS endpoint serves the new key only
+func (issuer *jwtTestIssuer) rotate(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.Lock()
+	defer issuer.Unlock()
+	issuer.kid = kid
+	issuer.key = key
+}
+
+func (issuer *jwtTestIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	issuer.Lock()
+	kid, key := issuer.kid, issuer.key
+	issuer.Unlock()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthenticator_Success(t *testing.T) {
+	issuer := newJWTTestIssuer(t)
+	defer issuer.server.Close()
+
+	authenticator := NewJWTAuthenticator(issuer.server.URL, time.Minute, "garagemq", http.DefaultClient)
+	token := issuer.sign(t, map[string]interface{}{
+		"sub":   "client",
+		"aud":   []string{"garagemq", "other"},
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"scope": "garagemq.write:%2F/* garagemq.read:%2F/events-* other.configure:*/*",
+	})
+
+	identity, err := authenticator.Authenticate("", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "client" {
+		t.Fatalf("username expected %s, actual %s", "client", identity.Username)
+	}
+	if identity.Authorizer == nil {
+		t.Fatal("Expected authorizer resolved from token scopes")
+	}
+
+	if !identity.Authorizer.VhostAllowed("client", "/") || identity.Authorizer.VhostAllowed("client", "other") {
+		t.Fatal("Expected access to default vhost only")
+	}
+	if !identity.Authorizer.Allowed("client", "/", AccessWrite, "any") {
+		t.Fatal("Expected write allowed by scope")
+	}
+	if !identity.Authorizer.Allowed("client", "/", AccessRead, "events-1") {
+		t.Fatal("Expected read allowed by scope")
+	}
+	if identity.Authorizer.Allowed("client", "/", AccessRead, "orders") {
+		t.Fatal("Expected read refused by scope pattern")
+	}
+	if identity.Authorizer.Allowed("client", "/", AccessConfigure, "any") {
+		t.Fatal("Expected configure refused, scope of other resource server is ignored")
+	}
+
+	// keys are cached until refresh interval
+	if _, err := authenticator.Authenticate("", token); err != nil {
+		t.Fatal(err)
+	}
+	if requests := atomic.LoadInt32(&issuer.requests); requests != 1 {
+		t.Fatalf("Expected JWKS loaded once, actual %d", requests)
+	}
+}
+
+func TestJWTAuthenticator_Failed(t *testing.T) {
+	issuer := newJWTTestIssuer(t)
+	defer issuer.server.Close()
+	other := newJWTTestIssuer(t)
+	defer other.server.Close()
+
+	authenticator := NewJWTAuthenticator(issuer.server.URL, time.Minute, "garagemq", http.DefaultClient)
+	valid := map[string]interface{}{
+		"sub":   "client",
+		"aud":   "garagemq",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"scope": "garagemq.read:*/*",
+	}
+	claims := func(key string, value interface{}) map[string]interface{} {
+		changed := make(map[string]interface{})
+		for k, v := range valid {
+			changed[k] = v
+		}
+		changed[key] = value
+		return changed
+	}
+
+	tokens := map[string]string{
+		"expired":     issuer.sign(t, claims("exp", time.Now().Add(-time.Second).Unix())),
+		"no expiry":   issuer.sign(t, claims("exp", 0)),
+		"not before":  issuer.sign(t, claims("nbf", time.Now().Add(time.Minute).Unix())),
+		"audience":    issuer.sign(t, claims("aud", "other")),
+		"subject":     issuer.sign(t, claims("sub", "")),
+		"signature":   other.sign(t, valid),
+		"malformed":   "guest",
+		"not encoded": "a.b.c",
+	}
+	for name, token := range tokens {
+		if _, err := authenticator.Authenticate("", token); err != ErrLoginFailure {
+			t.Fatalf("Expected login failure for %s token, actual %v", name, err)
+		}
+	}
+}
+
+func newJWTTestClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":   "client",
+		"aud":   "garagemq",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"scope": "garagemq.read:*/*",
+	}
+}
+
+func TestJWTAuthenticator_KeyRotation(t *testing.T) {
+	issuer := newJWTTestIssuer(t)
+	defer issuer.server.Close()
+
+	authenticator := NewJWTAuthenticator(issuer.server.URL, time.Minute, "garagemq", http.DefaultClient)
+	if _, err := authenticator.Authenticate("", issuer.sign(t, newJWTTestClaims())); err != nil {
+		t.Fatal(err)
+	}
+
+	// token signed by rotated key is accepted before refresh interval is passed
+	issuer.rotate(t, "rotated")
+	if _, err := authenticator.Authenticate("", issuer.sign(t, newJWTTestClaims())); err != nil {
+		t.Fatal(err)
+	}
+	if requests := atomic.LoadInt32(&issuer.requests); requests != 2 {
+		t.Fatalf("Expected JWKS reloaded on unknown key, actual %d requests", requests)
+	}
+
+	// reload on unknown key is rate limited
+	issuer.rotate(t, "unknown")
+	if _, err := authenticator.Authenticate("", issuer.sign(t, newJWTTestClaims())); err != ErrLoginFailure {
+		t.Fatalf("Expected login failure within refetch interval, actual %v", err)
+	}
+	if requests := atomic.LoadInt32(&issuer.requests); requests != 2 {
+		t.Fatalf("Expected JWKS not reloaded within refetch interval, actual %d requests", requests)
+	}
+}
+
+func TestJWTAuthenticator_SlowJWKS(t *testing.T) {
+	issuer := newJWTTestIssuer(t)
+	defer issuer.server.Close()
+
+	authenticator := NewJWTAuthenticator(issuer.server.URL, time.Minute, "garagemq", http.DefaultClient)
+	cached := issuer.sign(t, newJWTTestClaims())
+	if _, err := authenticator.Authenticate("", cached); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := make(chan struct{})
+	defer close(blocked)
+	issuer.Lock()
+	issuer.blocked = blocked
+	issuer.Unlock()
+	issuer.rotate(t, "rotated")
+	go authenticator.Authenticate("", issuer.sign(t, newJWTTestClaims()))
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&issuer.requests) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected JWKS reloaded on unknown key")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// token signed by cached key is checked while key set is reloaded
+	done := make(chan error, 1)
+	go func() {
+		_, err := authenticator.Authenticate("", cached)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected authentication by cached key not blocked by JWKS request")
+	}
+}
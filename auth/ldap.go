@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// UsernamePlaceholder is replaced with user name in LDAP user DN pattern
+const UsernamePlaceholder = "${username}"
+
+// LDAPAuthenticator authenticates users by binding to LDAP server as user
+type LDAPAuthenticator struct {
+	url           string
+	userDNPattern string
+	startTLS      bool
+	tlsConfig     *tls.Config
+	timeout       time.Duration
+}
+
+// NewLDAPAuthenticator returns new instance of LDAPAuthenticator
+// tlsConfig is used for ldaps:// connections and StartTLS
+func NewLDAPAuthenticator(url string, userDNPattern string, startTLS bool, tlsConfig *tls.Config, timeout time.Duration) *LDAPAuthenticator {
+	return &LDAPAuthenticator{
+		url:           url,
+		userDNPattern: userDNPattern,
+		startTLS:      startTLS,
+		tlsConfig:     tlsConfig,
+		timeout:       timeout,
+	}
+}
+
+// Authenticate binds to LDAP server with user DN and password
+// Rejected bind returns ErrLoginFailure, other errors are returned as is
+func (authenticator *LDAPAuthenticator) Authenticate(user string, password string) (Identity, error) {
+	// unauthenticated bind with empty password always succeeds, so it never means valid credentials
+	if user == "" || password == "" {
+		return Identity{}, ErrLoginFailure
+	}
+
+	conn, err := ldap.DialURL(authenticator.url, ldap.DialWithTLSConfig(authenticator.tlsConfig))
+	if err != nil {
+		return Identity{}, err
+	}
+	defer conn.Close()
+	if authenticator.timeout > 0 {
+		conn.SetTimeout(authenticator.timeout)
+	}
+
+	if authenticator.startTLS {
+		if err = conn.StartTLS(authenticator.tlsConfig); err != nil {
+			return Identity{}, err
+		}
+	}
+
+	userDN := strings.Replace(authenticator.userDNPattern, UsernamePlaceholder, escapeDN(user), -1)
+	if err = conn.Bind(userDN, password); err != nil {
+		// any result from server means bind is rejected, client side codes are connection errors
+		if ldapErr, ok := err.(*ldap.Error); ok && ldapErr.ResultCode < ldap.ErrorNetwork {
+			return Identity{}, ErrLoginFailure
+		}
+		return Identity{}, err
+	}
+
+	return Identity{Username: user}, nil
+}
+
+// escapeDN escapes user name to be used as DN attribute value, see RFC 4514
+func escapeDN(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		char := value[i]
+		switch {
+		case strings.IndexByte(`"+,;<>\=`, char) >= 0,
+			i == 0 && (char == ' ' || char == '#'),
+			i == len(value)-1 && char == ' ':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(char)
+		default:
+			escaped.WriteByte(char)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// mockLDAPServer accepts simple binds of users with given DN and password
+type mockLDAPServer struct {
+	listener net.Listener
+	users    map[string]string
+}
+
+func newMockLDAPServer(t *testing.T, users map[string]string) *mockLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &mockLDAPServer{listener: listener, users: users}
+	go server.serve()
+	return server
+}
+
+func (server *mockLDAPServer) url() string {
+	return "ldap://" + server.listener.Addr().String()
+}
+
+func (server *mockLDAPServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *mockLDAPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+		if request.Tag != ldap.ApplicationBindRequest {
+			return
+		}
+
+		dn := request.Children[1].Value.(string)
+		password := string(request.Children[2].Data.Bytes())
+		resultCode := ldap.LDAPResultInvalidCredentials
+		if expected, ok := server.users[dn]; ok && expected == password {
+			resultCode = ldap.LDAPResultSuccess
+		}
+
+		response := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+		response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+		bindResponse := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindResponse, nil, "Bind Response")
+		bindResponse.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, resultCode, "resultCode"))
+		bindResponse.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+		bindResponse.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+		response.AppendChild(bindResponse)
+		if _, err := conn.Write(response.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func TestLDAPAuthenticator_Success(t *testing.T) {
+	server := newMockLDAPServer(t, map[string]string{"cn=guest,dc=test": "guest"})
+	defer server.listener.Close()
+
+	authenticator := NewLDAPAuthenticator(server.url(), "cn=${username},dc=test", false, nil, time.Second)
+	identity, err := authenticator.Authenticate("guest", "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "guest" {
+		t.Fatalf("username expected %s, actual %s", "guest", identity.Username)
+	}
+}
+
+func TestLDAPAuthenticator_Failed(t *testing.T) {
+	server := newMockLDAPServer(t, map[string]string{"cn=guest,dc=test": "guest"})
+	defer server.listener.Close()
+
+	authenticator := NewLDAPAuthenticator(server.url(), "cn=${username},dc=test", false, nil, time.Second)
+	for _, credentials := range [][2]string{{"guest", "wrong"}, {"unknown", "guest"}, {"guest", ""}, {"guest,dc=test", "guest"}} {
+		if _, err := authenticator.Authenticate(credentials[0], credentials[1]); err != ErrLoginFailure {
+			t.Fatalf("Expected login failure for %v, actual %v", credentials, err)
+		}
+	}
+}
+
+func TestLDAPAuthenticator_Failed_Unavailable(t *testing.T) {
+	server := newMockLDAPServer(t, nil)
+	server.listener.Close()
+
+	authenticator := NewLDAPAuthenticator(server.url(), "cn=${username},dc=test", false, nil, time.Second)
+	if _, err := authenticator.Authenticate("guest", "guest"); err == nil || err == ErrLoginFailure {
+		t.Fatalf("Expected connection error, actual %v", err)
+	}
+}
+
+func TestChainAuthenticator(t *testing.T) {
+	server := newMockLDAPServer(t, map[string]string{"cn=ldap,dc=test": "ldap"})
+	defer server.listener.Close()
+
+	chain := ChainAuthenticator{
+		NewUsersAuthenticator(map[string]string{"guest": "084e0343a0486ff05530df6c705c8bb4"}, true),
+		NewLDAPAuthenticator(server.url(), "cn=${username},dc=test", false, nil, time.Second),
+	}
+	for _, user := range []string{"guest", "ldap"} {
+		if _, err := chain.Authenticate(user, user); err != nil {
+			t.Fatalf("Expected %s authenticated, actual %v", user, err)
+		}
+	}
+	if _, err := chain.Authenticate("guest", "ldap"); err != ErrLoginFailure {
+		t.Fatalf("Expected login failure, actual %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"strings"
+	"sync"
+)
+
+// Mechanism authenticates client by response of SASL mechanism
+type Mechanism interface {
+	Authenticate(response []byte) (Identity, error)
+}
+
+// PlainMechanism implements SASL PLAIN mechanism, credentials are checked by Authenticator
+type PlainMechanism struct {
+	authenticator Authenticator
+}
+
+// NewPlainMechanism returns new instance of PlainMechanism
+func NewPlainMechanism(authenticator Authenticator) *PlainMechanism {
+	return &PlainMechanism{authenticator: authenticator}
+}
+
+// Authenticate parses PLAIN response and authenticates its credentials
+func (mechanism *PlainMechanism) Authenticate(response []byte) (Identity, error) {
+	saslData, err := ParsePlain(response)
+	if err != nil {
+		return Identity{}, ErrLoginFailure
+	}
+	return mechanism.authenticator.Authenticate(saslData.Username, saslData.Password)
+}
+
+// Mechanisms is registry of SASL mechanisms keyed by mechanism name
+type Mechanisms struct {
+	sync.RWMutex
+	names      []string
+	mechanisms map[string]Mechanism
+}
+
+// NewMechanisms returns new empty registry of SASL mechanisms
+func NewMechanisms() *Mechanisms {
+	return &Mechanisms{
+		mechanisms: make(map[string]Mechanism),
+	}
+}
+
+// Register adds mechanism with given name or replaces already registered one
+func (registry *Mechanisms) Register(name string, mechanism Mechanism) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.mechanisms[name]; !ok {
+		registry.names = append(registry.names, name)
+	}
+	registry.mechanisms[name] = mechanism
+}
+
+// Get returns mechanism by name or nil if it is not registered
+func (registry *Mechanisms) Get(name string) Mechanism {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.mechanisms[name]
+}
+
+// Names returns space-separated names of registered mechanisms in registration order, as sent in connection.start
+func (registry *Mechanisms) Names() string {
+	registry.RLock()
+	defer registry.RUnlock()
+	return strings.Join(registry.names, " ")
+}
@@ -0,0 +1,29 @@
+package auth
+
+import "testing"
+
+func TestMechanisms_Register(t *testing.T) {
+	registry := NewMechanisms()
+	plain := NewPlainMechanism(NewUsersAuthenticator(map[string]string{"guest": "084e0343a0486ff05530df6c705c8bb4"}, true))
+	registry.Register(SaslPlain, plain)
+	registry.Register("EXTERNAL", plain)
+	registry.Register(SaslPlain, plain)
+
+	if names := registry.Names(); names != "PLAIN EXTERNAL" {
+		t.Fatalf("mechanisms expected %s, actual %s", "PLAIN EXTERNAL", names)
+	}
+	if registry.Get("AMQPLAIN") != nil {
+		t.Fatal("Expected nil for not registered mechanism")
+	}
+
+	identity, err := registry.Get(SaslPlain).Authenticate([]byte("\x00guest\x00guest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "guest" {
+		t.Fatalf("username expected %s, actual %s", "guest", identity.Username)
+	}
+	if _, err := registry.Get(SaslPlain).Authenticate([]byte("guest")); err != ErrLoginFailure {
+		t.Fatalf("Expected login failure on wrong response, actual %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Access represents kind of operation on vhost resource
+type Access int
+
+// Access kinds, RabbitMQ-style
+const (
+	// AccessConfigure to declare and delete resources
+	AccessConfigure Access = iota
+	// AccessWrite to publish into exchange and bind queue or exchange destination
+	AccessWrite
+	// AccessRead to consume or get from queue and bind from exchange source
+	AccessRead
+)
+
+// Authorizer checks user access to vhosts and their resources
+type Authorizer interface {
+	VhostAllowed(user string, vhost string) bool
+	Allowed(user string, vhost string, access Access, resource string) bool
+}
+
+// Permissions represents compiled configure/write/read patterns of resource names
+// Empty pattern denies any access
+type Permissions struct {
+	patterns [3]*regexp.Regexp
+}
+
+// NewPermissions compiles permissions patterns
+func NewPermissions(configure string, write string, read string) (*Permissions, error) {
+	permissions := &Permissions{}
+	for access, pattern := range []string{configure, write, read} {
+		if pattern == "" {
+			continue
+		}
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		permissions.patterns[access] = compiled
+	}
+	return permissions, nil
+}
+
+// Allowed returns is access to resource with given name allowed
+func (permissions *Permissions) Allowed(access Access, resource string) bool {
+	pattern := permissions.patterns[access]
+	return pattern != nil && pattern.MatchString(resource)
+}
+
+// StaticAuthorizer is Authorizer with permissions loaded once, e.g. from config
+// Users without own permissions get default ones. If defaults are not set, local users (added by AddUser)
+// are not restricted for compatibility with configs without permissions, other users, e.g. authenticated
+// by external backend, are denied
+type StaticAuthorizer struct {
+	sync.RWMutex
+	users    map[string]map[string]*Permissions
+	local    map[string]bool
+	defaults map[string]*Permissions
+}
+
+// NewStaticAuthorizer returns new instance of StaticAuthorizer
+func NewStaticAuthorizer() *StaticAuthorizer {
+	return &StaticAuthorizer{
+		users: make(map[string]map[string]*Permissions),
+		local: make(map[string]bool),
+	}
+}
+
+// AddUser marks user as local one, e.g. defined by config
+func (authorizer *StaticAuthorizer) AddUser(user string) {
+	authorizer.Lock()
+	defer authorizer.Unlock()
+	authorizer.local[user] = true
+}
+
+// SetDefaultPermissions sets permissions for vhost of users without own permissions
+func (authorizer *StaticAuthorizer) SetDefaultPermissions(vhost string, permissions *Permissions) {
+	authorizer.Lock()
+	defer authorizer.Unlock()
+	if authorizer.defaults == nil {
+		authorizer.defaults = make(map[string]*Permissions)
+	}
+	authorizer.defaults[vhost] = permissions
+}
+
+// SetPermissions sets user permissions for vhost
+func (authorizer *StaticAuthorizer) SetPermissions(user string, vhost string, permissions *Permissions) {
+	authorizer.Lock()
+	defer authorizer.Unlock()
+	if authorizer.users[user] == nil {
+		authorizer.users[user] = make(map[string]*Permissions)
+	}
+	authorizer.users[user][vhost] = permissions
+}
+
+// Replace sets permissions of all users from other authorizer, e.g. on config reload,
+// so connections holding current authorizer are checked by new permissions
+func (authorizer *StaticAuthorizer) Replace(other *StaticAuthorizer) {
+	other.RLock()
+	users, local, defaults := other.users, other.local, other.defaults
+	other.RUnlock()
+
+	authorizer.Lock()
+	defer authorizer.Unlock()
+	authorizer.users = users
+	authorizer.local = local
+	authorizer.defaults = defaults
+}
+
+// userPermissions returns permissions of user by vhost, restricted is false for unrestricted user,
+// must be called under lock
+func (authorizer *StaticAuthorizer) userPermissions(user string) (vhosts map[string]*Permissions, restricted bool) {
+	if vhosts, ok := authorizer.users[user]; ok {
+		return vhosts, true
+	}
+	if authorizer.defaults != nil {
+		return authorizer.defaults, true
+	}
+	return nil, !authorizer.local[user]
+}
+
+// VhostAllowed returns is user allowed to open vhost
+func (authorizer *StaticAuthorizer) VhostAllowed(user string, vhost string) bool {
+	authorizer.RLock()
+	defer authorizer.RUnlock()
+	vhosts, restricted := authorizer.userPermissions(user)
+	if !restricted {
+		return true
+	}
+	_, ok := vhosts[vhost]
+	return ok
+}
+
+// Allowed returns is user allowed to access vhost resource
+func (authorizer *StaticAuthorizer) Allowed(user string, vhost string, access Access, resource string) bool {
+	authorizer.RLock()
+	defer authorizer.RUnlock()
+	vhosts, restricted := authorizer.userPermissions(user)
+	if !restricted {
+		return true
+	}
+	permissions, ok := vhosts[vhost]
+	return ok && permissions.Allowed(access, resource)
+}
+
+// ScopeAuthorizer is Authorizer with permissions granted by OAuth 2.0 scopes of token,
+// scope format is <prefix><access>:<vhost>/<resource>, where access is configure, write or read,
+// vhost is url-encoded (%2F for default vhost) and * in vhost and resource matches any sequence
+// User is not checked, because it is resolved from the same token
+type ScopeAuthorizer struct {
+	scopes []scopePermission
+}
+
+type scopePermission struct {
+	access   Access
+	vhost    *regexp.Regexp
+	resource *regexp.Regexp
+}
+
+var accessNames = map[string]Access{
+	"configure": AccessConfigure,
+	"write":     AccessWrite,
+	"read":      AccessRead,
+}
+
+// NewScopeAuthorizer returns new instance of ScopeAuthorizer
+// Scopes without prefix or in unknown format are ignored
+func NewScopeAuthorizer(prefix string, scopes []string) *ScopeAuthorizer {
+	authorizer := &ScopeAuthorizer{}
+	for _, scope := range scopes {
+		if !strings.HasPrefix(scope, prefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(scope, prefix), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		access, ok := accessNames[parts[0]]
+		if !ok {
+			continue
+		}
+		target := strings.SplitN(parts[1], "/", 2)
+		if len(target) != 2 {
+			continue
+		}
+		vhost, err := url.PathUnescape(target[0])
+		if err != nil {
+			continue
+		}
+		authorizer.scopes = append(authorizer.scopes, scopePermission{
+			access:   access,
+			vhost:    wildcardPattern(vhost),
+			resource: wildcardPattern(target[1]),
+		})
+	}
+	return authorizer
+}
+
+// VhostAllowed returns true if any scope is granted for vhost
+func (authorizer *ScopeAuthorizer) VhostAllowed(user string, vhost string) bool {
+	for _, scope := range authorizer.scopes {
+		if scope.vhost.MatchString(vhost) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns true if any scope grants access to vhost resource
+func (authorizer *ScopeAuthorizer) Allowed(user string, vhost string, access Access, resource string) bool {
+	for _, scope := range authorizer.scopes {
+		if scope.access == access && scope.vhost.MatchString(vhost) && scope.resource.MatchString(resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardPattern compiles pattern with * matching any sequence into anchored regexp
+func wildcardPattern(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$")
+}
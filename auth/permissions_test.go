@@ -0,0 +1,71 @@
+package auth
+
+import "testing"
+
+func TestStaticAuthorizer_Allowed(t *testing.T) {
+	authorizer := NewStaticAuthorizer()
+	permissions, err := NewPermissions("^conf-", "", ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer.SetPermissions("user", "/", permissions)
+	authorizer.AddUser("guest")
+
+	if !authorizer.Allowed("user", "/", AccessConfigure, "conf-queue") {
+		t.Fatal("Expected configure allowed by pattern")
+	}
+	if authorizer.Allowed("user", "/", AccessConfigure, "queue") {
+		t.Fatal("Expected configure refused by pattern")
+	}
+	if authorizer.Allowed("user", "/", AccessWrite, "queue") {
+		t.Fatal("Expected write refused by empty pattern")
+	}
+	if !authorizer.Allowed("user", "/", AccessRead, "queue") {
+		t.Fatal("Expected read allowed by pattern")
+	}
+	if authorizer.VhostAllowed("user", "other") || authorizer.Allowed("user", "other", AccessRead, "queue") {
+		t.Fatal("Expected access refused to vhost without permissions")
+	}
+	if !authorizer.VhostAllowed("guest", "other") || !authorizer.Allowed("guest", "other", AccessWrite, "queue") {
+		t.Fatal("Expected access allowed for local user without permissions")
+	}
+	if authorizer.VhostAllowed("external", "/") || authorizer.Allowed("external", "/", AccessRead, "queue") {
+		t.Fatal("Expected access refused for not local user without permissions")
+	}
+}
+
+func TestStaticAuthorizer_DefaultPermissions(t *testing.T) {
+	authorizer := NewStaticAuthorizer()
+	permissions, _ := NewPermissions("", "", ".*")
+	authorizer.SetDefaultPermissions("/", permissions)
+	authorizer.AddUser("guest")
+
+	for _, user := range []string{"guest", "external"} {
+		if !authorizer.Allowed(user, "/", AccessRead, "queue") || authorizer.Allowed(user, "/", AccessWrite, "queue") {
+			t.Fatalf("Expected access of %s checked by default permissions", user)
+		}
+		if authorizer.VhostAllowed(user, "other") {
+			t.Fatalf("Expected %s refused to vhost without default permissions", user)
+		}
+	}
+}
+
+func TestStaticAuthorizer_Replace(t *testing.T) {
+	authorizer := NewStaticAuthorizer()
+	permissions, _ := NewPermissions(".*", ".*", ".*")
+	authorizer.SetPermissions("user", "/", permissions)
+
+	reloaded := NewStaticAuthorizer()
+	reloaded.SetPermissions("user", "other", permissions)
+	authorizer.Replace(reloaded)
+
+	if authorizer.VhostAllowed("user", "/") || !authorizer.VhostAllowed("user", "other") {
+		t.Fatal("Expected permissions replaced by reloaded ones")
+	}
+}
+
+func TestNewPermissions_Failed_WrongPattern(t *testing.T) {
+	if _, err := NewPermissions("(", "", ""); err == nil {
+		t.Fatal("Expected pattern compile error, actual nil")
+	}
+}
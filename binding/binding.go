@@ -6,8 +6,32 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/filter"
+)
+
+// FilterArg is binding argument with filter expression for x-filter exchange
+const FilterArg = "x-filter"
+
+// ExcludeArg is topic binding argument with pattern or array of patterns, message matched by binding
+// routing key is not routed if its routing key matches any of them, e.g. "orders.#" excluding "orders.test.#"
+const ExcludeArg = "x-exclude"
+
+// Binding destination types set by DestinationTypeArg, queue is destination by default
+const (
+	DestinationTypeArg = "x-destination-type"
+	// DestinationFile routes messages into append-only debug file named by binding destination
+	DestinationFile = "file"
+)
+
+// flags of stored binding
+const (
+	flagTopic byte = 1 << iota
+	flagToExchange
+	flagDisabled
 )
 
 // MatchType is the x-match attribute in a binding argument table
@@ -22,13 +46,26 @@ const (
 
 // Binding represents AMQP-binding
 type Binding struct {
+	// routing stats are first fields to be 64-bit aligned for atomic operations
+	routedCount  uint64
+	lastRoutedAt int64
+	// disabled binding is kept but never matches, it is inverted enabled flag so new binding is enabled
+	disabled int32
+
+	// Queue is binding destination, destination exchange for exchange-to-exchange binding
 	Queue      string
 	Exchange   string
 	RoutingKey string
 	Arguments  *amqp.Table
 	regexp     *regexp.Regexp
 	topic      bool
+	toExchange bool
+	toFile     bool
+	filter     *filter.Expression
 	MatchType  MatchType
+
+	// excludes are compiled x-exclude patterns of topic binding
+	excludes []*regexp.Regexp
 }
 
 // NewBinding returns new instance of Binding
@@ -54,6 +91,14 @@ func NewBinding(queue string, exchange string, routingKey string, arguments *amq
 		return binding, nil
 	}
 
+	if err := binding.compileFilter(); err != nil {
+		return nil, err
+	}
+
+	if err := binding.compileExcludes(); err != nil {
+		return nil, err
+	}
+
 	// @spec-note AMQP 0.9.1
 	//
 	// Any field starting with 'x-' other than 'x-match' is
@@ -84,6 +129,28 @@ func NewBinding(queue string, exchange string, routingKey string, arguments *amq
 	return binding, nil
 }
 
+// NewExchangeBinding returns new instance of exchange-to-exchange Binding
+// Messages matched by binding are routed from source exchange to destination one
+func NewExchangeBinding(destination string, source string, routingKey string, arguments *amqp.Table, topic bool) (*Binding, error) {
+	binding, err := NewBinding(destination, source, routingKey, arguments, topic)
+	if err != nil {
+		return nil, err
+	}
+	binding.toExchange = true
+	return binding, nil
+}
+
+// NewFileBinding returns new instance of Binding routing messages into file sink with given name
+// File bindings are transient debug taps, they are not persisted
+func NewFileBinding(file string, exchange string, routingKey string, arguments *amqp.Table, topic bool) (*Binding, error) {
+	binding, err := NewBinding(file, exchange, routingKey, arguments, topic)
+	if err != nil {
+		return nil, err
+	}
+	binding.toFile = true
+	return binding, nil
+}
+
 // @todo may be better will be trie or dfa than regexp
 // @see http://www.rabbitmq.com/blog/2010/09/14/very-fast-and-scalable-topic-routing-part-1/
 // @see http://www.rabbitmq.com/blog/2011/03/28/very-fast-and-scalable-topic-routing-part-2/
@@ -128,28 +195,115 @@ func buildRegexp(routingKey string) (*regexp.Regexp, error) {
 	return regexp.Compile(pattern)
 }
 
+// compileFilter compiles x-filter expression from binding arguments if it set
+func (b *Binding) compileFilter() (err error) {
+	if b.Arguments == nil {
+		return nil
+	}
+	value, ok := (*b.Arguments)[FilterArg]
+	if !ok {
+		return nil
+	}
+	source, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("invalid %s field, expected string", FilterArg)
+	}
+	if b.filter, err = filter.Compile(source); err != nil {
+		return fmt.Errorf("bad filter expression %s -- %s", source, err.Error())
+	}
+	return nil
+}
+
+// compileExcludes compiles x-exclude topic patterns from binding arguments if they set
+func (b *Binding) compileExcludes() error {
+	if !b.topic || b.Arguments == nil {
+		return nil
+	}
+	value, ok := (*b.Arguments)[ExcludeArg]
+	if !ok {
+		return nil
+	}
+	var patterns []string
+	switch value := value.(type) {
+	case string:
+		patterns = []string{value}
+	case []interface{}:
+		for _, item := range value {
+			pattern, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("invalid %s field, expected string or array of strings", ExcludeArg)
+			}
+			patterns = append(patterns, pattern)
+		}
+	default:
+		return fmt.Errorf("invalid %s field, expected string or array of strings", ExcludeArg)
+	}
+	b.excludes = make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := buildRegexp(pattern)
+		if err != nil {
+			return fmt.Errorf("bad exclude topic pattern %s -- %s", pattern, err.Error())
+		}
+		b.excludes = append(b.excludes, re)
+	}
+	return nil
+}
+
+// excluded returns is routing key matched by any x-exclude pattern
+func (b *Binding) excluded(routingKey string) bool {
+	for _, re := range b.excludes {
+		if re.MatchString(routingKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTopicHeaders check is message can be routed from topic-exchange to queue
+// with match topic-pattern and, if binding has arguments without "x-" prefix, match them with message headers
+// by x-match rules like headers-exchange does, other "x-" arguments are ignored
+func (b *Binding) MatchTopicHeaders(exchange string, routingKey string, headers *amqp.Table) bool {
+	if !b.MatchTopic(exchange, routingKey) {
+		return false
+	}
+	return !b.hasHeaderValues() || b.MatchHeader(exchange, headers)
+}
+
+// hasHeaderValues returns is binding has arguments without "x-" prefix to match with message headers
+func (b *Binding) hasHeaderValues() bool {
+	if b.Arguments == nil {
+		return false
+	}
+	for key := range *b.Arguments {
+		if !strings.HasPrefix(key, "x-") {
+			return true
+		}
+	}
+	return false
+}
+
 // MatchDirect check is message can be routed from direct-exchange to queue
 // with compare exchange and routing key
 func (b *Binding) MatchDirect(exchange string, routingKey string) bool {
-	return b.Exchange == exchange && b.RoutingKey == routingKey
+	return b.IsEnabled() && b.Exchange == exchange && b.RoutingKey == routingKey
 }
 
 // MatchFanout check is message can be routed from fanout-exchange to queue
 // with compare only exchange
 func (b *Binding) MatchFanout(exchange string) bool {
-	return b.Exchange == exchange
+	return b.IsEnabled() && b.Exchange == exchange
 }
 
 // MatchTopic check is message can be routed from topic-exchange to queue
-// with compare exchange and match topic-pattern with routing key
+// with compare exchange and match topic-pattern with routing key, key matched by x-exclude pattern is not routed
 func (b *Binding) MatchTopic(exchange string, routingKey string) bool {
-	return b.Exchange == exchange && b.regexp.MatchString(routingKey)
+	return b.IsEnabled() && b.Exchange == exchange && b.regexp.MatchString(routingKey) && !b.excluded(routingKey)
 }
 
 // MatchHeader checks whether the message can be routed on `b` for a
 // header exchange type.
 func (b *Binding) MatchHeader(exchange string, headers *amqp.Table) bool {
-	if b.Exchange != exchange {
+	if !b.IsEnabled() || b.Exchange != exchange {
 		return false
 	}
 
@@ -221,6 +375,46 @@ func (b *Binding) MatchHeader(exchange string, headers *amqp.Table) bool {
 		!hasNonXArgs && matchType == MatchAny
 }
 
+// MatchFilter check is message can be routed from filter-exchange to queue
+// with compare exchange and evaluate binding's filter expression, binding without expression matches all messages
+func (b *Binding) MatchFilter(exchange string, message *amqp.Message) bool {
+	return b.IsEnabled() && b.Exchange == exchange && (b.filter == nil || b.filter.Match(message))
+}
+
+// SetEnabled enables or disables binding, disabled binding never matches messages
+func (b *Binding) SetEnabled(enabled bool) {
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+	atomic.StoreInt32(&b.disabled, disabled)
+}
+
+// IsEnabled returns is binding matches messages
+func (b *Binding) IsEnabled() bool {
+	return atomic.LoadInt32(&b.disabled) == 0
+}
+
+// MarkRouted updates binding routing stats, called by exchange on each matched message
+func (b *Binding) MarkRouted() {
+	atomic.AddUint64(&b.routedCount, 1)
+	atomic.StoreInt64(&b.lastRoutedAt, time.Now().UnixNano())
+}
+
+// RoutedCount returns count of messages routed through binding
+func (b *Binding) RoutedCount() uint64 {
+	return atomic.LoadUint64(&b.routedCount)
+}
+
+// LastRoutedAt returns time of the last message routed through binding, zero time if binding was never used
+func (b *Binding) LastRoutedAt() time.Time {
+	lastRoutedAt := atomic.LoadInt64(&b.lastRoutedAt)
+	if lastRoutedAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastRoutedAt)
+}
+
 // GetExchange returns binding's exchange
 func (b *Binding) GetExchange() string {
 	return b.Exchange
@@ -236,26 +430,68 @@ func (b *Binding) GetQueue() string {
 	return b.Queue
 }
 
+// IsToExchange returns is binding destination an exchange
+func (b *Binding) IsToExchange() bool {
+	return b.toExchange
+}
+
+// IsToFile returns is binding destination a file sink
+func (b *Binding) IsToFile() bool {
+	return b.toFile
+}
+
+// IsTopic returns is binding routing key a topic pattern
+func (b *Binding) IsTopic() bool {
+	return b.topic
+}
+
+// HasFilter returns is binding has x-filter expression
+func (b *Binding) HasFilter() bool {
+	return b.filter != nil
+}
+
+// HasHeadersArguments returns is binding has arguments to match message headers,
+// x-match or any argument without "x-" prefix
+func (b *Binding) HasHeadersArguments() bool {
+	if b.Arguments == nil {
+		return false
+	}
+	for key := range *b.Arguments {
+		if key == "x-match" || !strings.HasPrefix(key, "x-") {
+			return true
+		}
+	}
+	return false
+}
+
 // Equal returns is given binding equal to current
 // with compare exchange, routing key and queue
 func (b *Binding) Equal(bind *Binding) bool {
 	return b.Exchange == bind.GetExchange() &&
 		b.Queue == bind.GetQueue() &&
 		b.RoutingKey == bind.GetRoutingKey() &&
+		b.toExchange == bind.IsToExchange() &&
+		b.toFile == bind.IsToFile() &&
 		reflect.DeepEqual(b.Arguments, bind.Arguments)
 }
 
 // GetName generate binding name by concatenating its params
 func (b *Binding) GetName() string {
-	return strings.Join(
-		[]string{b.Queue, b.Exchange, b.RoutingKey},
-		"_",
-	)
+	parts := []string{b.Queue, b.Exchange, b.RoutingKey}
+	if b.toExchange {
+		parts = append([]string{"e2e"}, parts...)
+	} else if b.toFile {
+		parts = append([]string{"file"}, parts...)
+	}
+	return strings.Join(parts, "_")
 }
 
 // Marshal returns raw representation of binding to store into storage
 func (b *Binding) Marshal(protoVersion string) (data []byte, err error) {
 	buf := bytes.NewBuffer(make([]byte, 0))
+	if err = amqp.WriteFormatVersion(buf, amqp.FormatVersionCurrent); err != nil {
+		return nil, err
+	}
 	if err = amqp.WriteShortstr(buf, b.Queue); err != nil {
 		return nil, err
 	}
@@ -271,11 +507,17 @@ func (b *Binding) Marshal(protoVersion string) (data []byte, err error) {
 	if err = amqp.WriteTable(buf, b.Arguments, protoVersion); err != nil {
 		return nil, err
 	}
-	var topic byte
+	var flags byte
 	if b.topic {
-		topic = 1
+		flags |= flagTopic
 	}
-	if err = amqp.WriteOctet(buf, topic); err != nil {
+	if b.toExchange {
+		flags |= flagToExchange
+	}
+	if !b.IsEnabled() {
+		flags |= flagDisabled
+	}
+	if err = amqp.WriteOctet(buf, flags); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
@@ -284,6 +526,19 @@ func (b *Binding) Marshal(protoVersion string) (data []byte, err error) {
 // Unmarshal returns binding from storage raw bytes data
 func (b *Binding) Unmarshal(data []byte, protoVersion string) (err error) {
 	buf := bytes.NewReader(data)
+	var version byte
+	if version, err = amqp.ReadFormatVersion(buf); err != nil {
+		return err
+	}
+
+	switch version {
+	case amqp.FormatVersion1, amqp.FormatVersion2:
+		err = b.unmarshalV1(buf, protoVersion)
+	}
+	return
+}
+
+func (b *Binding) unmarshalV1(buf *bytes.Reader, protoVersion string) (err error) {
 	if b.Queue, err = amqp.ReadShortstr(buf); err != nil {
 		return err
 	}
@@ -296,11 +551,13 @@ func (b *Binding) Unmarshal(data []byte, protoVersion string) (err error) {
 	if b.Arguments, err = amqp.ReadTable(buf, protoVersion); err != nil {
 		return err
 	}
-	var topic byte
-	if topic, err = amqp.ReadOctet(buf); err != nil {
+	var flags byte
+	if flags, err = amqp.ReadOctet(buf); err != nil {
 		return err
 	}
-	b.topic = topic == 1
+	b.topic = flags&flagTopic != 0
+	b.toExchange = flags&flagToExchange != 0
+	b.SetEnabled(flags&flagDisabled == 0)
 
 	if b.topic {
 		if b.regexp, err = buildRegexp(b.RoutingKey); err != nil {
@@ -308,5 +565,8 @@ func (b *Binding) Unmarshal(data []byte, protoVersion string) (err error) {
 		}
 	}
 
-	return
+	if err = b.compileFilter(); err != nil {
+		return err
+	}
+	return b.compileExcludes()
 }
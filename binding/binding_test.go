@@ -1,6 +1,7 @@
 package binding_test
 
 import (
+	"bytes"
 	"sort"
 	"strings"
 	"testing"
@@ -225,6 +226,175 @@ func TestBinding_MatchHeader(t *testing.T) {
 	}
 }
 
+func TestBinding_MatchTopicHeaders(t *testing.T) {
+	b, err := binding.NewBinding("test_q", "test_ex", "logs.*", &amqp.Table{
+		"level":     "error",
+		"x-unknown": "ignored",
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		routingKey string
+		headers    *amqp.Table
+		expected   bool
+	}{
+		{"logs.app", &amqp.Table{"level": "error"}, true},
+		{"logs.app", &amqp.Table{"level": "info"}, false},
+		{"logs.app", nil, false},
+		{"metrics.app", &amqp.Table{"level": "error"}, false},
+	}
+	for _, c := range cases {
+		if b.MatchTopicHeaders("test_ex", c.routingKey, c.headers) != c.expected {
+			t.Errorf("Expected match %t for routing key '%s' and headers %v", c.expected, c.routingKey, c.headers)
+		}
+	}
+
+	// x- arguments are ignored, so binding matches by pattern only
+	plain, _ := binding.NewBinding("test_q", "test_ex", "logs.*", &amqp.Table{"x-unknown": "ignored"}, true)
+	if !plain.MatchTopicHeaders("test_ex", "logs.app", nil) {
+		t.Errorf("Expected topic binding without header arguments matches by pattern only")
+	}
+}
+
+func TestBinding_MatchFilter(t *testing.T) {
+	b, err := binding.NewBinding("test_q", "test_ex", "", &amqp.Table{
+		binding.FilterArg: "headers.amount >= 100",
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := amqp.Table{"amount": int32(100)}
+	message := &amqp.Message{Header: &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{Headers: &headers}}}
+	if !b.MatchFilter("test_ex", message) {
+		t.Error("Expected filter match")
+	}
+	if b.MatchFilter("no_exchange", message) {
+		t.Error("Expected no match for other exchange")
+	}
+
+	headers["amount"] = int32(99)
+	if b.MatchFilter("test_ex", message) {
+		t.Error("Expected no filter match")
+	}
+
+	noFilter, _ := binding.NewBinding("test_q", "test_ex", "", &amqp.Table{}, false)
+	if !noFilter.MatchFilter("test_ex", message) {
+		t.Error("Expected binding without filter matches all messages")
+	}
+}
+
+func TestBinding_Marshal_Filter(t *testing.T) {
+	b, _ := binding.NewBinding("test_q", "test_ex", "", &amqp.Table{
+		binding.FilterArg: "headers.amount >= 100",
+	}, false)
+
+	data, err := b.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bUm := &binding.Binding{}
+	if err = bUm.Unmarshal(data, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := amqp.Table{"amount": int64(150)}
+	if !bUm.MatchFilter("test_ex", &amqp.Message{Header: &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{Headers: &headers}}}) {
+		t.Error("Expected unmarshaled binding with compiled filter")
+	}
+}
+
+func TestNewFileBinding(t *testing.T) {
+	b, _ := binding.NewFileBinding("debug.jsonl", "test_ex", "test.#", &amqp.Table{}, true)
+	bQueue, _ := binding.NewBinding("debug.jsonl", "test_ex", "test.#", &amqp.Table{}, true)
+	if !b.IsToFile() || b.IsToExchange() {
+		t.Error("Expected file binding")
+	}
+	if b.Equal(bQueue) || b.GetName() == bQueue.GetName() {
+		t.Error("Expected file binding differs from queue binding with the same destination")
+	}
+	if !b.MatchTopic("test_ex", "test.key") {
+		t.Error("Expected file binding matched as topic one")
+	}
+}
+
+func TestBinding_Marshal_ToExchange(t *testing.T) {
+	b, _ := binding.NewExchangeBinding("test_dest", "test_ex", "test.#", &amqp.Table{}, true)
+	bQueue, _ := binding.NewBinding("test_dest", "test_ex", "test.#", &amqp.Table{}, true)
+	if b.Equal(bQueue) || b.GetName() == bQueue.GetName() {
+		t.Error("Expected exchange binding differs from queue binding with the same destination")
+	}
+
+	data, err := b.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bUm := &binding.Binding{}
+	if err = bUm.Unmarshal(data, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bUm.IsToExchange() || !bUm.Equal(b) {
+		t.Error("Expected unmarshaled exchange binding")
+	}
+	if !bUm.MatchTopic("test_ex", "test.key") {
+		t.Error("Expected unmarshaled topic binding")
+	}
+}
+
+func TestBinding_NewBinding_FailedBadFilter(t *testing.T) {
+	if _, err := binding.NewBinding("test_q", "test_ex", "", &amqp.Table{binding.FilterArg: "body == 1"}, false); err == nil {
+		t.Error("Expected error on unknown field in filter")
+	}
+	if _, err := binding.NewBinding("test_q", "test_ex", "", &amqp.Table{binding.FilterArg: int32(1)}, false); err == nil {
+		t.Error("Expected error on non-string filter")
+	}
+}
+
+func TestBinding_MatchTopic_Exclude(t *testing.T) {
+	b, err := binding.NewBinding("test_q", "test_ex", "orders.#", &amqp.Table{
+		binding.ExcludeArg: []interface{}{"orders.test.#", "*.*.draft"},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	included := []string{"orders", "orders.created", "orders.eu.paid"}
+	for _, key := range included {
+		if !b.MatchTopic("test_ex", key) {
+			t.Errorf("Expected key '%s' is matched", key)
+		}
+	}
+	excluded := []string{"orders.test", "orders.test.created", "orders.eu.draft", "logs.test"}
+	for _, key := range excluded {
+		if b.MatchTopic("test_ex", key) {
+			t.Errorf("Expected key '%s' is not matched", key)
+		}
+	}
+
+	single, _ := binding.NewBinding("test_q", "test_ex", "orders.#", &amqp.Table{binding.ExcludeArg: "orders.test.#"}, true)
+	if single.MatchTopic("test_ex", "orders.test.created") || !single.MatchTopic("test_ex", "orders.created") {
+		t.Error("Expected single exclude pattern is applied")
+	}
+
+	data, _ := b.Marshal(amqp.ProtoRabbit)
+	bUm := &binding.Binding{}
+	if err := bUm.Unmarshal(data, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if bUm.MatchTopic("test_ex", "orders.test.created") || !bUm.MatchTopic("test_ex", "orders.created") {
+		t.Error("Expected exclude patterns of unmarshaled binding")
+	}
+
+	if _, err := binding.NewBinding("test_q", "test_ex", "orders.#", &amqp.Table{binding.ExcludeArg: int32(1)}, true); err == nil {
+		t.Error("Expected error on non-string exclude pattern")
+	}
+	if _, err := binding.NewBinding("test_q", "test_ex", "orders.#", &amqp.Table{binding.ExcludeArg: []interface{}{"orders.test", int32(1)}}, true); err == nil {
+		t.Error("Expected error on non-string item of exclude patterns")
+	}
+}
+
 func TestBinding_Equal(t *testing.T) {
 	b1, err1 := binding.NewBinding("test_q", "test_ex", "test_key", &amqp.Table{}, true)
 	b2, err2 := binding.NewBinding("test_q", "test_ex", "test_key", &amqp.Table{}, true)
@@ -358,6 +528,64 @@ func TestBinding_Marshal(t *testing.T) {
 	}
 }
 
+func TestBinding_SetEnabled(t *testing.T) {
+	b, bindErr := binding.NewBinding("test_q", "test_ex", "test_key", &amqp.Table{}, false)
+	if bindErr != nil {
+		t.Fatal(bindErr)
+	}
+	if !b.IsEnabled() || !b.MatchDirect("test_ex", "test_key") {
+		t.Fatal("Expected new binding is enabled and matches")
+	}
+
+	b.SetEnabled(false)
+	if b.IsEnabled() || b.MatchDirect("test_ex", "test_key") || b.MatchFanout("test_ex") {
+		t.Fatal("Expected disabled binding does not match")
+	}
+
+	data, err := b.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bUm := &binding.Binding{}
+	if err = bUm.Unmarshal(data, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if bUm.IsEnabled() {
+		t.Fatal("Expected unmarshaled binding is disabled")
+	}
+
+	b.SetEnabled(true)
+	if !b.MatchDirect("test_ex", "test_key") {
+		t.Fatal("Expected re-enabled binding matches")
+	}
+}
+
+func TestBinding_Unmarshal_Version1(t *testing.T) {
+	b, bindErr := binding.NewBinding("test_q", "test_ex", "test.*", &amqp.Table{
+		"arg1": "value1",
+	}, true)
+	if bindErr != nil {
+		t.Fatal(bindErr)
+	}
+
+	// record written before format versioning, without version prefix
+	buf := bytes.NewBuffer(make([]byte, 0))
+	amqp.WriteShortstr(buf, b.Queue)
+	amqp.WriteShortstr(buf, b.Exchange)
+	amqp.WriteShortstr(buf, b.RoutingKey)
+	amqp.WriteTable(buf, b.Arguments, amqp.ProtoRabbit)
+	amqp.WriteOctet(buf, 1)
+
+	bUm := &binding.Binding{}
+	if err := bUm.Unmarshal(buf.Bytes(), amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+
+	if !b.Equal(bUm) {
+		t.Fatal("Unmarshaled binding does not equal version 1 record")
+	}
+}
+
 func TestBinding_NewBindingPanicOnBadXMatch(t *testing.T) {
 	_, err := binding.NewBinding("sample1", "", "", &amqp.Table{
 		"x-match": "invalid_value",
@@ -2,70 +2,281 @@ package config
 
 import (
 	"io/ioutil"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 // Config represents server changeable se
 type Config struct {
-	Proto      string
-	Users      []User
-	TCP        TCPConfig
-	Queue      Queue
-	Db         Db
-	Vhost      Vhost
-	Security   Security
-	Connection Connection
-	Admin      AdminConfig
+	Proto       string
+	Users       []User
+	TCP         TCPConfig
+	TLS         TLSConfig
+	Queue       Queue
+	Exchange    Exchange
+	Db          Db
+	Vhost       Vhost
+	Security    Security
+	Connection  Connection
+	Admin       AdminConfig
+	Audit       Audit
+	FileSink    FileSink
+	Replication Replication
+	Debug       Debug
+	Log         Log
+	Policies    []Policy
+	// Definitions is path of topology JSON file imported on start, see server.Definitions
+	Definitions string
 }
 
 // User for auth check
+// Permissions restrict user access to listed vhosts, user without permissions has Security.DefaultPermissions
+// or full access if they are not set
 type User struct {
-	Username string
-	Password string
+	Username    string
+	Password    string
+	Permissions []Permission
+}
+
+// Permission represents RabbitMQ-style regexp patterns of vhost resource names
+// user is allowed to configure, write and read, empty pattern denies access
+type Permission struct {
+	Vhost     string
+	Configure string
+	Write     string
+	Read      string
+}
+
+// Policy represents vhost policy defined by config, see server.Policy
+// Policies are applied on start and on reload, policies removed from config are deleted on reload
+type Policy struct {
+	Vhost      string                 `yaml:"vhost"`
+	Name       string                 `yaml:"name"`
+	Pattern    string                 `yaml:"pattern"`
+	ApplyTo    string                 `yaml:"applyTo"`
+	Priority   int                    `yaml:"priority"`
+	Definition map[string]interface{} `yaml:"definition"`
+}
+
+// Log settings, non-empty Level overrides log level set by command line
+type Log struct {
+	Level string `yaml:"level"`
 }
 
 // TCPConfig represents properties for tune network connections
+// Backlog is listen backlog size, zero means system default
+// KeepAlive is keepalive probes period of accepted connections, zero disables keepalive
 type TCPConfig struct {
 	IP           string `yaml:"ip"`
 	Port         string
 	Nodelay      bool
-	ReadBufSize  int `yaml:"readBufSize"`
-	WriteBufSize int `yaml:"writeBufSize"`
+	ReuseAddr    bool          `yaml:"reuseAddr"`
+	Backlog      int           `yaml:"backlog"`
+	KeepAlive    time.Duration `yaml:"keepAlive"`
+	ReadBufSize  int           `yaml:"readBufSize"`
+	WriteBufSize int           `yaml:"writeBufSize"`
+}
+
+// TLSConfig represents properties for TLS listener, empty Port disables it
+type TLSConfig struct {
+	Port     string
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
 }
 
 // AdminConfig represents properties for admin server
+// Requests are authenticated with HTTP basic auth by broker users, only listed Users are allowed
 type AdminConfig struct {
-	IP   string `yaml:"ip"`
-	Port string
+	IP    string `yaml:"ip"`
+	Port  string
+	Users []string `yaml:"users"`
 }
 
 // Queue settings
+// OverflowToDisk enables spilling messages of non-durable queues over MaxMessagesInRAM into transient storage,
+// otherwise they are kept in memory
+// DrainTimeout is max time server shutdown waits for consumers to get delivered messages acked, zero means disabled
+// Non-zero CompressThreshold enables transparent compression of message bodies not smaller than threshold in bytes,
+// bodies are kept compressed in queues and storage and restored on delivery, queue can override it
+// by x-compress-threshold argument
 type Queue struct {
-	ShardSize        int    `yaml:"shardSize"`
-	MaxMessagesInRAM uint64 `yaml:"maxMessagesInRam"`
+	ShardSize         int           `yaml:"shardSize"`
+	MaxMessagesInRAM  uint64        `yaml:"maxMessagesInRam"`
+	OverflowToDisk    bool          `yaml:"overflowToDisk"`
+	DrainTimeout      time.Duration `yaml:"drainTimeout"`
+	CompressThreshold uint64        `yaml:"compressThreshold"`
+}
+
+// Exchange settings
+// MaxBindings limits bindings count of each exchange except default one, zero means unlimited
+// DefaultRoutesToExchange enables default exchange to route message into exchange named by routing key
+// if there is no queue with such name
+// QueueExchange declares amq.queue exchange in each vhost, it enqueues message directly into queue named by routing key
+// RoutingKeyPrefixes are buckets of published messages metrics, e.g. "orders." or "orders.*"
+type Exchange struct {
+	MaxBindings             int  `yaml:"maxBindings"`
+	DefaultRoutesToExchange bool `yaml:"defaultRoutesToExchange"`
+	QueueExchange           bool `yaml:"queueExchange"`
+
+	RoutingKeyPrefixes []string `yaml:"routingKeyPrefixes"`
 }
 
 // Db settings, such as path to load/save and engine
 type Db struct {
-	DefaultPath string `yaml:"defaultPath"`
-	Engine      string `yaml:"engine"`
+	DefaultPath string   `yaml:"defaultPath"`
+	Engine      string   `yaml:"engine"`
+	Mirror      DbMirror `yaml:"mirror"`
+}
+
+// DbMirror settings of secondary storage mirroring persisted messages of durable queues, empty Path disables it
+// Engine defaults to engine of primary storage, WaitSecondary makes confirms wait for write into both storages,
+// otherwise they wait for primary only and secondary is written in background
+type DbMirror struct {
+	Path          string `yaml:"path"`
+	Engine        string `yaml:"engine"`
+	WaitSecondary bool   `yaml:"waitSecondary"`
 }
 
 // Vhost settings
+// SNI maps TLS server name to vhost opened by client without explicit vhost or with default one
+// StampTimestamp enables setting timestamp property by broker clock on messages published without it
+// Limits are ceilings of queue arguments keyed by vhost name
+// RoutingTrace lists vhosts where messages get x-routing-trace header with exchanges they were routed through
+// StrictProperties refuses publishes with unknown or invalid basic properties instead of passing them through
 type Vhost struct {
-	DefaultPath string `yaml:"defaultPath"`
+	DefaultPath    string                 `yaml:"defaultPath"`
+	SNI            map[string]string      `yaml:"sni"`
+	StampTimestamp bool                   `yaml:"stampTimestamp"`
+	Limits         map[string]VhostLimits `yaml:"limits"`
+	RoutingTrace   []string               `yaml:"routingTrace"`
+
+	StrictProperties bool `yaml:"strictProperties"`
+}
+
+// VhostLimits bound x-message-ttl (milliseconds) and x-max-length of vhost queues, zero means no limit
+// Greater values are clamped to limits and queues without arguments get limits as defaults
+type VhostLimits struct {
+	MessageTTL int64 `yaml:"messageTTL"`
+	MaxLength  int64 `yaml:"maxLength"`
 }
 
 // Security settings
+// AuthBackends are authentication backends (internal, ldap or jwt) tried in order until one accepts credentials
 type Security struct {
-	PasswordCheck string `yaml:"passwordCheck"`
+	PasswordCheck string   `yaml:"passwordCheck"`
+	AuthBackends  []string `yaml:"authBackends"`
+	LDAP          LDAP     `yaml:"ldap"`
+	JWT           JWT      `yaml:"jwt"`
+	// DefaultPermissions are permissions of users without own ones, including users authenticated
+	// by ldap backend. If they are not set, config users have full access and ldap users are denied
+	DefaultPermissions []Permission `yaml:"defaultPermissions"`
+}
+
+// LDAP settings of ldap authentication backend
+// URL is ldap:// or ldaps:// server address, StartTLS upgrades ldap:// connection to TLS
+// UserDNPattern is DN to bind as user, ${username} is replaced with escaped user name
+type LDAP struct {
+	URL                string        `yaml:"url"`
+	UserDNPattern      string        `yaml:"userDnPattern"`
+	StartTLS           bool          `yaml:"startTls"`
+	CACertFile         string        `yaml:"caCertFile"`
+	InsecureSkipVerify bool          `yaml:"insecureSkipVerify"`
+	Timeout            time.Duration `yaml:"timeout"`
+}
+
+// JWT settings of jwt authentication backend, token is passed as password of PLAIN mechanism
+// Keys from JWKSURL are reloaded every RefreshInterval and on token signed by unknown key, but not more often than
+// every 10 seconds then, token audience must contain ResourceServerID
+// and its scopes <ResourceServerID>.configure|write|read:<vhost>/<resource> grant permissions
+type JWT struct {
+	JWKSURL          string        `yaml:"jwksUrl"`
+	RefreshInterval  time.Duration `yaml:"refreshInterval"`
+	ResourceServerID string        `yaml:"resourceServerId"`
+	Timeout          time.Duration `yaml:"timeout"`
 }
 
 // Connection settings for AMQP-connection
+// Non-zero FlushInterval enables delivery batching: outgoing frames are coalesced into the write buffer
+// and flushed by threshold or by timer, so added latency is bounded by interval
+// IdleTimeout closes connection without any incoming frames (heartbeats included),
+// ChannelIdleTimeout closes channel without incoming frames and consumers, zero means disabled
+// ConsumerTimeout requeues messages delivered but not acked within timeout, zero means disabled,
+// consumer can override it with x-consumer-timeout argument in milliseconds,
+// CancelStuckConsumers also cancels consumer which exceeded timeout
+// ConsumerResumeTimeout keeps unacked messages of closed channel consumer with x-consumer-id argument
+// for consumer with the same id instead of requeue, zero means disabled
+// Non-zero ConfirmBatchInterval or ConfirmBatchSize enables confirm batching: publisher confirms are sent
+// every interval or by size as basic.ack with multiple bit for contiguous delivery tags
+// OutputBufferSize is a size of write buffer of connection socket in bytes
+// OutputHighWatermark limits bytes of outgoing frames queued for connection socket, when limit is reached
+// consumers of connection are skipped until frames are written, zero means unlimited
+// WriteTimeout closes connection which socket doesn't accept written data within timeout, zero means disabled
+// MaxUnackedPerChannel caps unacked messages of channel whatever prefetch client sets, zero means unlimited
+// CloseAckGrace delays requeue of unacked messages of channels of closed connection until acks already sent
+// by client are handled or grace is over, consumer can prolong it with x-close-grace argument in milliseconds
+// up to CloseAckGraceMax, zero means messages are requeued immediately
 type Connection struct {
-	ChannelsMax  uint16 `yaml:"channelsMax"`
-	FrameMaxSize uint32 `yaml:"frameMaxSize"`
+	ChannelsMax           uint16        `yaml:"channelsMax"`
+	FrameMaxSize          uint32        `yaml:"frameMaxSize"`
+	FlushInterval         time.Duration `yaml:"flushInterval"`
+	IdleTimeout           time.Duration `yaml:"idleTimeout"`
+	ChannelIdleTimeout    time.Duration `yaml:"channelIdleTimeout"`
+	ConsumerTimeout       time.Duration `yaml:"consumerTimeout"`
+	CancelStuckConsumers  bool          `yaml:"cancelStuckConsumers"`
+	ConsumerResumeTimeout time.Duration `yaml:"consumerResumeTimeout"`
+	ConfirmBatchInterval  time.Duration `yaml:"confirmBatchInterval"`
+	ConfirmBatchSize      int           `yaml:"confirmBatchSize"`
+	OutputBufferSize      int           `yaml:"outputBufferSize"`
+	OutputHighWatermark   int           `yaml:"outputHighWatermark"`
+	WriteTimeout          time.Duration `yaml:"writeTimeout"`
+	MaxUnackedPerChannel  uint16        `yaml:"maxUnackedPerChannel"`
+	CloseAckGrace         time.Duration `yaml:"closeAckGrace"`
+	CloseAckGraceMax      time.Duration `yaml:"closeAckGraceMax"`
+}
+
+// Audit settings of published messages log
+// Records of messages published into exchanges are written asynchronously as JSON lines into Path,
+// file is rotated when it exceeds MaxSize bytes keeping MaxFiles rotated files, zero MaxSize disables rotation
+// BufferSize is count of records queued for writer, when it is full Overflow policy "drop" drops records
+// and "block" blocks publishers, IncludeBody adds message bodies into records
+type Audit struct {
+	Enabled     bool   `yaml:"enabled"`
+	Path        string `yaml:"path"`
+	MaxSize     int64  `yaml:"maxSize"`
+	MaxFiles    int    `yaml:"maxFiles"`
+	BufferSize  int    `yaml:"bufferSize"`
+	Overflow    string `yaml:"overflow"`
+	IncludeBody bool   `yaml:"includeBody"`
+}
+
+// FileSink settings of debug bindings routing messages into files
+// Bindings with x-destination-type "file" are allowed only if Enabled, binding destination is file name inside Dir
+// Records are written as JSON lines like audit ones, file is rotated when it exceeds MaxSize bytes keeping
+// MaxFiles rotated files, records exceeding BufferSize or MaxRate records per second of file are dropped,
+// IncludeBody adds message bodies into records
+type FileSink struct {
+	Enabled     bool   `yaml:"enabled"`
+	Dir         string `yaml:"dir"`
+	MaxSize     int64  `yaml:"maxSize"`
+	MaxFiles    int    `yaml:"maxFiles"`
+	BufferSize  int    `yaml:"bufferSize"`
+	MaxRate     int64  `yaml:"maxRate"`
+	IncludeBody bool   `yaml:"includeBody"`
+}
+
+// Replication settings of leader/follower replication of storages of server and persisted messages
+// Listen is address leader serves followers on, TailSize is count of latest batches retained for reconnected
+// followers, older followers get snapshot
+// Non-empty LeaderAddr starts server as follower applying leader storages without accepting clients
+// until it is promoted, then it serves followers on Listen if set
+// Secret is shared secret followers are authenticated with, it is required for both roles
+type Replication struct {
+	Listen         string        `yaml:"listen"`
+	LeaderAddr     string        `yaml:"leaderAddr"`
+	Secret         string        `yaml:"secret"`
+	TailSize       int           `yaml:"tailSize"`
+	ReconnectDelay time.Duration `yaml:"reconnectDelay"`
 }
 
 // CreateFromFile creates config from file
@@ -87,3 +298,12 @@ func CreateFromFile(path string) (*Config, error) {
 func CreateDefault() (*Config, error) {
 	return defaultConfig(), nil
 }
+
+// Debug settings of debug server serving net/http/pprof profiles and runtime stats on separate port
+// Requests are authenticated with HTTP basic auth by broker users, only listed Users are allowed
+type Debug struct {
+	Enabled bool     `yaml:"enabled"`
+	IP      string   `yaml:"ip"`
+	Port    string   `yaml:"port"`
+	Users   []string `yaml:"users"`
+}
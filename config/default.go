@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 const (
 	dbBuntDB = "buntdb"
 	dbBadger = "badger"
@@ -17,17 +19,21 @@ func defaultConfig() *Config {
 		TCP: TCPConfig{
 			IP:           "0.0.0.0",
 			Port:         "5672",
-			Nodelay:      false,
+			Nodelay:      true,
+			ReuseAddr:    true,
+			KeepAlive:    15 * time.Second,
 			ReadBufSize:  128 << 10, // 128Kb
 			WriteBufSize: 128 << 10, // 128Kb
 		},
 		Admin: AdminConfig{
-			IP:   "0.0.0.0",
+			IP:   "127.0.0.1",
 			Port: "15672",
 		},
 		Queue: Queue{
-			ShardSize:        8 << 10, // 8k
+			ShardSize:        8 << 10,      // 8k
 			MaxMessagesInRAM: 10 * 8 << 10, // 10 buckets
+			OverflowToDisk:   true,
+			DrainTimeout:     5 * time.Second,
 		},
 		Db: Db{
 			DefaultPath: "db",
@@ -38,10 +44,46 @@ func defaultConfig() *Config {
 		},
 		Security: Security{
 			PasswordCheck: "md5",
+			AuthBackends:  []string{"internal"},
+			LDAP: LDAP{
+				Timeout: 5 * time.Second,
+			},
+			JWT: JWT{
+				RefreshInterval:  5 * time.Minute,
+				ResourceServerID: "garagemq",
+				Timeout:          5 * time.Second,
+			},
 		},
 		Connection: Connection{
-			ChannelsMax:  4096,
-			FrameMaxSize: 65536,
+			ChannelsMax:           4096,
+			FrameMaxSize:          65536,
+			OutputBufferSize:      128 << 10, // 128Kb
+			OutputHighWatermark:   4 << 20,   // 4Mb
+			WriteTimeout:          time.Minute,
+			ConsumerResumeTimeout: 30 * time.Second,
+			CloseAckGraceMax:      10 * time.Second,
+		},
+		Audit: Audit{
+			Path:       "audit.log",
+			MaxSize:    100 << 20, // 100Mb
+			MaxFiles:   5,
+			BufferSize: 8 << 10, // 8k
+			Overflow:   "drop",
+		},
+		FileSink: FileSink{
+			Dir:        "sinks",
+			MaxSize:    10 << 20, // 10Mb
+			MaxFiles:   1,
+			BufferSize: 1 << 10, // 1k
+			MaxRate:    100,
+		},
+		Replication: Replication{
+			TailSize:       10000,
+			ReconnectDelay: 5 * time.Second,
+		},
+		Debug: Debug{
+			IP:   "127.0.0.1",
+			Port: "6060",
 		},
 	}
 }
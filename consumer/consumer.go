@@ -1,6 +1,7 @@
 package consumer
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -16,10 +17,17 @@ const (
 	started = iota
 	stopped
 	paused
+	draining
 )
 
 var cid uint64
 
+// Scheduler decides when consumer can deliver next message
+// Schedule returns false if consumer is already waiting for its turn
+type Scheduler interface {
+	Schedule(consumer *Consumer) bool
+}
+
 // Consumer implements AMQP consumer
 type Consumer struct {
 	ID          uint64
@@ -31,15 +39,36 @@ type Consumer struct {
 	statusLock  sync.RWMutex
 	status      int
 	qos         []*qos.AmqpQos
-	consume     chan struct{}
+	scheduler   Scheduler
+	ackTimeout  time.Duration
+	// grace period for acks in flight when channel is closed, zero means server default
+	closeGrace time.Duration
+	// unacked messages delivered by consumer, drain waits them to be acked
+	unacked int64
+	acked   chan struct{}
+	// max body frame size for decompressed messages, zero means messages are delivered as is
+	decompressFrameSize int
+	// weight in split of shared channel prefetch, zero means weight is not set
+	prefetchWeight int64
+	// consumer share of shared channel prefetch, inactive until channel splits prefetch
+	shareQos *qos.AmqpQos
+	// stable client-supplied identity, unacked messages of closed channel are kept for consumer with the same one
+	resumeID string
+	// offset of the next message read from stream queue
+	streamOffset uint64
+	// credit granted by client, nil if consumer is not in credit mode
+	creditQos *qos.AmqpQos
+	// number of messages client acks at once, consumer delivers them in bursts of that size
+	ackBatch int
 }
 
 // NewConsumer returns new instance of Consumer
-func NewConsumer(queueName string, consumerTag string, noAck bool, channel interfaces.Channel, queue *queue.Queue, qos []*qos.AmqpQos) *Consumer {
+func NewConsumer(queueName string, consumerTag string, noAck bool, channel interfaces.Channel, queue *queue.Queue, qosList []*qos.AmqpQos, scheduler Scheduler) *Consumer {
 	id := atomic.AddUint64(&cid, 1)
 	if consumerTag == "" {
 		consumerTag = generateTag(id)
 	}
+	shareQos := qos.NewAmqpQos(0, 0)
 	return &Consumer{
 		ID:          id,
 		Queue:       queueName,
@@ -47,8 +76,10 @@ func NewConsumer(queueName string, consumerTag string, noAck bool, channel inter
 		noAck:       noAck,
 		channel:     channel,
 		queue:       queue,
-		qos:         qos,
-		consume:     make(chan struct{}, 1),
+		qos:         append(qosList, shareQos),
+		scheduler:   scheduler,
+		acked:       make(chan struct{}, 1),
+		shareQos:    shareQos,
 	}
 }
 
@@ -59,39 +90,82 @@ func generateTag(id uint64) string {
 // Start starting consumer to fetch messages from queue
 func (consumer *Consumer) Start() {
 	consumer.status = started
-	go consumer.startConsume()
 	consumer.Consume()
 }
 
-// startConsume waiting a signal from consume channel and try to pop message from queue
+// Deliver try to pop message from queue and send it to the client, called by scheduler on consumer's turn
 // if not set noAck consumer pop message with qos rules and add message to unacked message queue
-func (consumer *Consumer) startConsume() {
-	for range consumer.consume {
-		consumer.retrieveAndSendMessage()
+// Consumer with ack batch hint delivers burst of messages per turn when free prefetch fits the whole burst
+// Returns true if message was delivered, so consumer can wait for the next turn
+func (consumer *Consumer) Deliver() bool {
+	consumer.statusLock.RLock()
+	defer consumer.statusLock.RUnlock()
+	if consumer.status != started {
+		return false
+	}
+
+	if consumer.ackBatch <= 1 {
+		return consumer.deliverOne()
+	}
+	if !consumer.burstReady() {
+		return false
+	}
+	delivered := false
+	for i := 0; i < consumer.ackBatch; i++ {
+		if !consumer.deliverOne() {
+			break
+		}
+		delivered = true
+	}
+	return delivered
+}
+
+// burstReady checks free prefetch of every count-limited qos fits burst of ack batch size
+// Burst is cut to prefetch count if prefetch is smaller, so consumer is never blocked by its own hint
+func (consumer *Consumer) burstReady() bool {
+	if consumer.noAck {
+		return true
+	}
+	for _, q := range consumer.qos {
+		free, prefetchCount := q.FreeCount()
+		if prefetchCount == 0 {
+			continue
+		}
+		burst := consumer.ackBatch
+		if int(prefetchCount) < burst {
+			burst = int(prefetchCount)
+		}
+		if int(free) < burst {
+			return false
+		}
 	}
+	return true
 }
 
-func (consumer *Consumer) retrieveAndSendMessage() {
+// deliverOne pops single message from queue and sends it to the client
+func (consumer *Consumer) deliverOne() bool {
 	var message *amqp.Message
-	consumer.statusLock.RLock()
-	defer consumer.statusLock.RUnlock()
-	if consumer.status == stopped {
-		return
+	if consumer.queue.IsStream() {
+		return consumer.deliverStream()
 	}
 
-	if consumer.noAck {
+	if consumer.noAck && consumer.creditQos != nil {
+		message = consumer.queue.PopQos([]*qos.AmqpQos{consumer.creditQos})
+	} else if consumer.noAck {
 		message = consumer.queue.Pop()
 	} else {
 		message = consumer.queue.PopQos(consumer.qos)
 	}
 
 	if message == nil {
-		return
+		return false
 	}
 
 	dTag := consumer.channel.NextDeliveryTag()
 	if !consumer.noAck {
 		consumer.channel.AddUnackedMessage(dTag, consumer.ConsumerTag, consumer.queue.GetName(), message)
+		atomic.AddInt64(&consumer.unacked, 1)
+		consumer.queue.MarkDelivered(message)
 	}
 
 	// handle metrics
@@ -106,55 +180,160 @@ func (consumer *Consumer) retrieveAndSendMessage() {
 	consumer.queue.GetMetrics().Ready.Counter.Dec(1)
 	consumer.queue.GetMetrics().ServerReady.Counter.Dec(1)
 
+	// delivery count is incremented on each requeue, so any requeued message is redelivered
+	consumer.send(dTag, message, message.DeliveryCount > 0)
+
+	return true
+}
+
+// deliverStream reads message at consumer offset from stream queue, message is kept in stream
+func (consumer *Consumer) deliverStream() bool {
+	var qosList []*qos.AmqpQos
+	if !consumer.noAck {
+		qosList = consumer.qos
+	} else if consumer.creditQos != nil {
+		qosList = []*qos.AmqpQos{consumer.creditQos}
+	}
+	message, next := consumer.queue.ReadStream(consumer.streamOffset, qosList)
+	if message == nil {
+		return false
+	}
+	consumer.streamOffset = next
+
+	dTag := consumer.channel.NextDeliveryTag()
+	if !consumer.noAck {
+		consumer.channel.AddUnackedMessage(dTag, consumer.ConsumerTag, consumer.queue.GetName(), message)
+		atomic.AddInt64(&consumer.unacked, 1)
+		consumer.queue.GetMetrics().Unacked.Counter.Inc(1)
+		consumer.queue.GetMetrics().ServerUnacked.Counter.Inc(1)
+	}
+	consumer.send(dTag, message, false)
+
+	return true
+}
+
+// Resume delivers messages left unacked by consumer with the same resume id when its channel was closed
+// Messages are still counted as unacked by queue and are delivered as redelivered ones within consumer qos
+// Returns messages exceeding qos, they have to be requeued
+func (consumer *Consumer) Resume(messages []*amqp.Message) []*amqp.Message {
+	for i, message := range messages {
+		if !consumer.takeQos(message) {
+			return messages[i:]
+		}
+
+		dTag := consumer.channel.NextDeliveryTag()
+		consumer.channel.AddUnackedMessage(dTag, consumer.ConsumerTag, consumer.queue.GetName(), message)
+		atomic.AddInt64(&consumer.unacked, 1)
+		consumer.send(dTag, message, true)
+	}
+	return nil
+}
+
+// takeQos increments all active qos of consumer, taken ones are released if any of them is exceeded
+func (consumer *Consumer) takeQos(message *amqp.Message) bool {
+	for i, q := range consumer.qos {
+		if !q.IsActive() {
+			continue
+		}
+		if !q.Inc(1, uint32(message.BodySize)) {
+			for _, taken := range consumer.qos[:i] {
+				if taken.IsActive() {
+					taken.Dec(1, uint32(message.BodySize))
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (consumer *Consumer) send(dTag uint64, message *amqp.Message, redelivered bool) {
+	// unacked store keeps the original message, so it will be requeued as it was stored
+	delivered := message
+	if consumer.decompressFrameSize > 0 && message.IsGzipped() {
+		if decompressed, err := message.Gunzipped(consumer.decompressFrameSize); err == nil {
+			delivered = decompressed
+		}
+	}
+
 	consumer.channel.SendContent(&amqp.BasicDeliver{
 		ConsumerTag: consumer.ConsumerTag,
 		DeliveryTag: dTag,
-		Redelivered: message.DeliveryCount > 1,
+		Redelivered: redelivered,
 		Exchange:    message.Exchange,
 		RoutingKey:  message.RoutingKey,
-	}, message)
+	}, delivered)
 
 	consumer.queue.GetMetrics().Deliver.Counter.Inc(1)
 	consumer.queue.GetMetrics().ServerDeliver.Counter.Inc(1)
-
-	consumer.consumeMsg()
-
-	return
 }
 
 // Pause pause consumer, used by channel.flow change
 func (consumer *Consumer) Pause() {
 	consumer.statusLock.Lock()
 	defer consumer.statusLock.Unlock()
-	consumer.status = paused
+	if consumer.status == started {
+		consumer.status = paused
+	}
 }
 
 // UnPause unpause consumer, used by channel.flow change
 func (consumer *Consumer) UnPause() {
 	consumer.statusLock.Lock()
 	defer consumer.statusLock.Unlock()
-	consumer.status = started
+	if consumer.status == paused {
+		consumer.status = started
+	}
 }
 
-// Consume send signal into consumer channel, than consumer can try to pop message from queue
-func (consumer *Consumer) Consume() bool {
-	consumer.statusLock.RLock()
-	defer consumer.statusLock.RUnlock()
+// Acked is called by channel when message delivered by consumer is acked or rejected
+func (consumer *Consumer) Acked() {
+	if atomic.AddInt64(&consumer.unacked, -1) <= 0 {
+		select {
+		case consumer.acked <- struct{}{}:
+		default:
+		}
+	}
+}
 
-	return consumer.consumeMsg()
+// UnackedCount returns count of messages delivered by consumer and not acked yet
+func (consumer *Consumer) UnackedCount() int64 {
+	return atomic.LoadInt64(&consumer.unacked)
 }
 
-func (consumer *Consumer) consumeMsg() bool {
-	if consumer.status == stopped || consumer.status == paused {
-		return false
+// Drain stops delivering new messages, waits for delivered messages to be acked and then stops consumer
+// If context is done before all messages are acked consumer is stopped anyway and context error is returned
+// Unlike Stop and Cancel it lets consumer finish in-flight work, used by graceful shutdown
+func (consumer *Consumer) Drain(ctx context.Context) error {
+	consumer.statusLock.Lock()
+	if consumer.status == stopped {
+		consumer.statusLock.Unlock()
+		return nil
 	}
+	consumer.status = draining
+	consumer.statusLock.Unlock()
 
-	select {
-	case consumer.consume <- struct{}{}:
-		return true
-	default:
+	defer consumer.Stop()
+	for atomic.LoadInt64(&consumer.unacked) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-consumer.acked:
+		}
+	}
+	return nil
+}
+
+// Consume schedules consumer's turn, than consumer can try to pop message from queue
+func (consumer *Consumer) Consume() bool {
+	consumer.statusLock.RLock()
+	defer consumer.statusLock.RUnlock()
+
+	if consumer.status != started {
 		return false
 	}
+
+	return consumer.scheduler.Schedule(consumer)
 }
 
 // Stop stops consumer and remove it from queue consumers list
@@ -167,7 +346,6 @@ func (consumer *Consumer) Stop() {
 	consumer.status = stopped
 	consumer.statusLock.Unlock()
 	consumer.queue.RemoveConsumer(consumer.ConsumerTag)
-	close(consumer.consume)
 }
 
 // Cancel stops consumer and send basic.cancel method to the client
@@ -176,6 +354,98 @@ func (consumer *Consumer) Cancel() {
 	consumer.channel.SendMethod(&amqp.BasicCancel{ConsumerTag: consumer.ConsumerTag, NoWait: true})
 }
 
+// SetAckTimeout sets timeout for acknowledge delivered messages, zero means server default
+func (consumer *Consumer) SetAckTimeout(timeout time.Duration) {
+	consumer.ackTimeout = timeout
+}
+
+// AckTimeout returns timeout for acknowledge delivered messages
+func (consumer *Consumer) AckTimeout() time.Duration {
+	return consumer.ackTimeout
+}
+
+// SetCloseGrace sets grace period for acks in flight when channel is closed, zero means server default
+func (consumer *Consumer) SetCloseGrace(grace time.Duration) {
+	consumer.closeGrace = grace
+}
+
+// CloseGrace returns grace period for acks in flight when channel is closed
+func (consumer *Consumer) CloseGrace() time.Duration {
+	return consumer.closeGrace
+}
+
+// SetDecompress sets consumer capability to receive gzip-compressed messages decompressed
+// with body frames not larger than frameSize, zero frameSize disables decompression
+func (consumer *Consumer) SetDecompress(frameSize int) {
+	consumer.decompressFrameSize = frameSize
+}
+
+// SetPrefetchWeight sets consumer weight in split of shared channel prefetch between channel consumers
+func (consumer *Consumer) SetPrefetchWeight(weight int64) {
+	consumer.prefetchWeight = weight
+}
+
+// PrefetchWeight returns consumer weight in split of shared channel prefetch, zero if weight is not set
+func (consumer *Consumer) PrefetchWeight() int64 {
+	return consumer.prefetchWeight
+}
+
+// SetResumeID sets stable consumer identity, unacked messages of consumer are kept after its channel is closed
+// and are resumed by consumer with the same identity
+func (consumer *Consumer) SetResumeID(id string) {
+	consumer.resumeID = id
+}
+
+// ResumeID returns stable consumer identity, empty if it is not set
+func (consumer *Consumer) ResumeID() string {
+	return consumer.resumeID
+}
+
+// SetStreamOffset sets offset of the first message consumer reads from stream queue
+func (consumer *Consumer) SetStreamOffset(offset uint64) {
+	consumer.streamOffset = offset
+}
+
+// ShareQos returns qos limiting consumer share of shared channel prefetch, it is inactive if prefetch is not split
+func (consumer *Consumer) ShareQos() *qos.AmqpQos {
+	return consumer.shareQos
+}
+
+// EnableCredit switches consumer into credit mode with initial credit, every delivery takes one credit
+// Credit qos is the last one in qos list, so it is not taken when other qos refuse delivery
+func (consumer *Consumer) EnableCredit(credit uint32) {
+	consumer.creditQos = qos.NewCreditQos(credit)
+	consumer.qos = append(consumer.qos, consumer.creditQos)
+}
+
+// GrantCredit adds credit to consumer and wakes it to deliver messages
+// Returns false if consumer is not in credit mode
+func (consumer *Consumer) GrantCredit(credit uint32) bool {
+	if consumer.creditQos == nil || !consumer.creditQos.Grant(credit) {
+		return false
+	}
+	consumer.Consume()
+	return true
+}
+
+// Credit returns outstanding consumer credit and false if consumer is not in credit mode
+func (consumer *Consumer) Credit() (uint32, bool) {
+	if consumer.creditQos == nil {
+		return 0, false
+	}
+	return consumer.creditQos.Credit(), true
+}
+
+// SetAckBatch sets hint that client acks messages in batches of size, values below 2 disable burst delivery
+func (consumer *Consumer) SetAckBatch(size int) {
+	consumer.ackBatch = size
+}
+
+// AckBatch returns ack batch hint of consumer, zero if hint is not set
+func (consumer *Consumer) AckBatch() int {
+	return consumer.ackBatch
+}
+
 // Tag returns consumer tag
 func (consumer *Consumer) Tag() string {
 	return consumer.ConsumerTag
@@ -0,0 +1,35 @@
+package exchange
+
+import (
+	"fmt"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// AliasArg makes exchange an alias of exchange with given name, publishes to alias are routed by target
+// Alias keeps its own bindings, but they are not used while alias is set, so target can be swapped
+// by redeclare or policy without client changes. Aliases can be chained, cycles are refused.
+const AliasArg = "x-exchange-alias"
+
+// aliasFromArguments returns alias target from arguments or empty string
+func aliasFromArguments(name string, arguments *amqp.Table) (string, error) {
+	value, ok := (*arguments)[AliasArg]
+	if !ok {
+		return "", nil
+	}
+	alias, ok := value.(string)
+	if !ok || alias == "" {
+		return "", fmt.Errorf("invalid arg '%s' for exchange '%s': expected exchange name", AliasArg, name)
+	}
+	if alias == name {
+		return "", fmt.Errorf("invalid arg '%s' for exchange '%s': exchange can't be alias of itself", AliasArg, name)
+	}
+	return alias, nil
+}
+
+// Alias returns name of exchange which publishes are routed by or empty string
+func (ex *Exchange) Alias() string {
+	ex.argLock.RLock()
+	defer ex.argLock.RUnlock()
+	return ex.alias
+}
@@ -0,0 +1,24 @@
+package exchange
+
+import (
+	"testing"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+func TestExchange_SetArguments_Alias(t *testing.T) {
+	ex := NewExchange("orders", ExTypeDirect, false, false, false, false)
+	if err := ex.SetArguments(&amqp.Table{AliasArg: "orders.v2"}); err != nil || ex.Alias() != "orders.v2" {
+		t.Fatalf("Expected alias 'orders.v2', actual '%s', %v", ex.Alias(), err)
+	}
+
+	for _, value := range []interface{}{"", "orders", int32(1)} {
+		if ex.SetArguments(&amqp.Table{AliasArg: value}) == nil {
+			t.Errorf("Expected error on alias %v", value)
+		}
+	}
+
+	if err := ex.SetArguments(&amqp.Table{}); err != nil || ex.Alias() != "" {
+		t.Fatalf("Expected alias removed, actual '%s'", ex.Alias())
+	}
+}
@@ -16,20 +16,29 @@ const (
 	ExTypeFanout
 	ExTypeTopic
 	ExTypeHeaders
+	// ExTypeFilter routes message to queues with bindings whose x-filter expression matches the message
+	ExTypeFilter
+	// ExTypeSplitter routes message to all bound queues and exchanges like fanout,
+	// but each bound exchange receives its own copy of message
+	ExTypeSplitter
 )
 
 var exchangeTypeIDAliasMap = map[byte]string{
-	ExTypeDirect:  "direct",
-	ExTypeFanout:  "fanout",
-	ExTypeTopic:   "topic",
-	ExTypeHeaders: "headers",
+	ExTypeDirect:   "direct",
+	ExTypeFanout:   "fanout",
+	ExTypeTopic:    "topic",
+	ExTypeHeaders:  "headers",
+	ExTypeFilter:   "x-filter",
+	ExTypeSplitter: "x-splitter",
 }
 
 var exchangeTypeAliasIDMap = map[string]byte{
-	"direct":  ExTypeDirect,
-	"fanout":  ExTypeFanout,
-	"topic":   ExTypeTopic,
-	"headers": ExTypeHeaders,
+	"direct":     ExTypeDirect,
+	"fanout":     ExTypeFanout,
+	"topic":      ExTypeTopic,
+	"headers":    ExTypeHeaders,
+	"x-filter":   ExTypeFilter,
+	"x-splitter": ExTypeSplitter,
 }
 
 // MetricsState implements exchange's metrics state
@@ -40,15 +49,27 @@ type MetricsState struct {
 
 // Exchange implements AMQP-exchange
 type Exchange struct {
-	Name       string
-	exType     byte
-	durable    bool
-	autoDelete bool
-	internal   bool
-	system     bool
-	bindLock   sync.Mutex
-	bindings   []*binding.Binding
-	metrics    *MetricsState
+	Name        string
+	exType      byte
+	durable     bool
+	autoDelete  bool
+	internal    bool
+	system      bool
+	bindLock    sync.Mutex
+	bindings    []*binding.Binding
+	maxBindings int
+	metrics     *MetricsState
+	// arguments from exchange.declare, effective arguments are merged with policy definition
+	argLock           sync.RWMutex
+	declaredArguments *amqp.Table
+	arguments         *amqp.Table
+	policy            string
+	policyDefinition  amqp.Table
+	rateLimiter       *RateLimiter
+	// target of alias, see alias.go
+	alias string
+	// routing key rewrite rules, see rewrite.go
+	rewriter *keyRewriter
 }
 
 // NewExchange returns new instance of Exchange
@@ -90,9 +111,130 @@ func (ex *Exchange) GetTypeAlias() string {
 	return alias
 }
 
+// SetMaxBindings sets limit of exchange bindings count, zero means unlimited
+func (ex *Exchange) SetMaxBindings(maxBindings int) {
+	ex.bindLock.Lock()
+	defer ex.bindLock.Unlock()
+	ex.maxBindings = maxBindings
+}
+
+// SetArguments sets exchange declared arguments merged with policy definition
+func (ex *Exchange) SetArguments(arguments *amqp.Table) error {
+	if arguments == nil {
+		arguments = &amqp.Table{}
+	}
+
+	ex.argLock.RLock()
+	definition := ex.policyDefinition
+	ex.argLock.RUnlock()
+
+	if err := ex.applyArguments(mergeArguments(arguments, definition)); err != nil {
+		return err
+	}
+
+	ex.argLock.Lock()
+	ex.declaredArguments = arguments
+	ex.argLock.Unlock()
+	return nil
+}
+
+// SetPolicy applies policy definition as defaults for declared arguments
+// Exchange keeps current arguments if definition contains invalid ones
+func (ex *Exchange) SetPolicy(name string, definition amqp.Table) error {
+	ex.argLock.RLock()
+	declared := ex.declaredArguments
+	ex.argLock.RUnlock()
+	if declared == nil {
+		declared = &amqp.Table{}
+	}
+
+	if err := ex.applyArguments(mergeArguments(declared, definition)); err != nil {
+		return err
+	}
+
+	ex.argLock.Lock()
+	ex.policy = name
+	ex.policyDefinition = definition
+	ex.argLock.Unlock()
+	return nil
+}
+
+func (ex *Exchange) applyArguments(arguments *amqp.Table) error {
+	rateLimiter, err := newRateLimiterFromArguments(ex.Name, arguments)
+	if err != nil {
+		return err
+	}
+	alias, err := aliasFromArguments(ex.Name, arguments)
+	if err != nil {
+		return err
+	}
+	rewriter, err := newKeyRewriterFromArguments(ex.Name, arguments)
+	if err != nil {
+		return err
+	}
+
+	ex.argLock.Lock()
+	ex.arguments = arguments
+	ex.rateLimiter = rateLimiter
+	ex.alias = alias
+	ex.rewriter = rewriter
+	ex.argLock.Unlock()
+	return nil
+}
+
+// RateLimiter returns publish rate limiter or nil if exchange is not limited
+func (ex *Exchange) RateLimiter() *RateLimiter {
+	ex.argLock.RLock()
+	defer ex.argLock.RUnlock()
+	return ex.rateLimiter
+}
+
+// Policy returns name of applied policy or empty string
+func (ex *Exchange) Policy() string {
+	ex.argLock.RLock()
+	defer ex.argLock.RUnlock()
+	return ex.policy
+}
+
+// Arguments returns exchange effective arguments, declared ones merged with policy definition
+func (ex *Exchange) Arguments() *amqp.Table {
+	ex.argLock.RLock()
+	defer ex.argLock.RUnlock()
+	if ex.arguments == nil {
+		return &amqp.Table{}
+	}
+	return ex.arguments
+}
+
+// DeclaredArguments returns exchange arguments from exchange.declare without policy definition
+func (ex *Exchange) DeclaredArguments() *amqp.Table {
+	ex.argLock.RLock()
+	defer ex.argLock.RUnlock()
+	if ex.declaredArguments == nil {
+		return &amqp.Table{}
+	}
+	return ex.declaredArguments
+}
+
+// mergeArguments returns declared arguments with defaults from policy definition
+func mergeArguments(declared *amqp.Table, definition amqp.Table) *amqp.Table {
+	if len(definition) == 0 {
+		return declared
+	}
+	merged := amqp.Table{}
+	for key, value := range definition {
+		merged[key] = value
+	}
+	for key, value := range *declared {
+		merged[key] = value
+	}
+	return &merged
+}
+
 // AppendBinding check and append binding
 // method check if binding already exists and ignore it
-func (ex *Exchange) AppendBinding(newBind *binding.Binding) {
+// Returns added false for duplicate binding and error if exchange bindings count limit is reached
+func (ex *Exchange) AppendBinding(newBind *binding.Binding) (added bool, err error) {
 	ex.bindLock.Lock()
 	defer ex.bindLock.Unlock()
 
@@ -101,22 +243,47 @@ func (ex *Exchange) AppendBinding(newBind *binding.Binding) {
 	// with identical arguments ­ without treating these as an error.
 	for _, bind := range ex.bindings {
 		if bind.Equal(newBind) {
-			return
+			return false, nil
 		}
 	}
+
+	if ex.maxBindings > 0 && len(ex.bindings) >= ex.maxBindings {
+		return false, fmt.Errorf("max bindings count %d reached for exchange '%s'", ex.maxBindings, ex.Name)
+	}
+
 	ex.bindings = append(ex.bindings, newBind)
+	return true, nil
+}
+
+// CheckBinding returns error if binding is not compatible with exchange type,
+// e.g. topic binding for non-topic exchange or headers binding for exchange other than headers or topic
+func (ex *Exchange) CheckBinding(bind *binding.Binding) error {
+	alias := ex.GetTypeAlias()
+	if bind.IsTopic() != (ex.exType == ExTypeTopic) {
+		return fmt.Errorf("binding '%s' routing key type is incompatible with %s exchange '%s'", bind.GetName(), alias, ex.Name)
+	}
+	if bind.HasFilter() && ex.exType != ExTypeFilter {
+		return fmt.Errorf("filter binding '%s' is incompatible with %s exchange '%s'", bind.GetName(), alias, ex.Name)
+	}
+	// topic bindings may match headers alongside routing key pattern
+	if bind.HasHeadersArguments() && ex.exType != ExTypeHeaders && ex.exType != ExTypeTopic {
+		return fmt.Errorf("headers binding '%s' is incompatible with %s exchange '%s'", bind.GetName(), alias, ex.Name)
+	}
+	return nil
 }
 
 // RemoveBinding remove binding
-func (ex *Exchange) RemoveBinding(rmBind *binding.Binding) {
+// Returns false if exchange has no such binding
+func (ex *Exchange) RemoveBinding(rmBind *binding.Binding) bool {
 	ex.bindLock.Lock()
 	defer ex.bindLock.Unlock()
 	for i, bind := range ex.bindings {
 		if bind.Equal(rmBind) {
 			ex.bindings = append(ex.bindings[:i], ex.bindings[i+1:]...)
-			return
+			return true
 		}
 	}
+	return false
 }
 
 // RemoveQueueBindings remove bindings for queue and return removed bindings
@@ -126,7 +293,7 @@ func (ex *Exchange) RemoveQueueBindings(queueName string) []*binding.Binding {
 	ex.bindLock.Lock()
 	defer ex.bindLock.Unlock()
 	for _, bind := range ex.bindings {
-		if bind.GetQueue() != queueName {
+		if bind.IsToExchange() || bind.IsToFile() || bind.GetQueue() != queueName {
 			newBindings = append(newBindings, bind)
 		} else {
 			removedBindings = append(removedBindings, bind)
@@ -138,31 +305,70 @@ func (ex *Exchange) RemoveQueueBindings(queueName string) []*binding.Binding {
 }
 
 // GetMatchedQueues returns queues matched for message routing key
+// Destination exchanges of exchange-to-exchange bindings are not included, see Route
 func (ex *Exchange) GetMatchedQueues(message *amqp.Message) (matchedQueues map[string]bool) {
+	matchedQueues, _, _ = ex.Route(message)
+	return
+}
+
+// Route returns queues, destination exchanges and file sinks matched for message routing key
+// Bindings are matched against exchange itself, so message can be routed through exchange-to-exchange bindings
+func (ex *Exchange) Route(message *amqp.Message) (matchedQueues map[string]bool, matchedExchanges map[string]bool, matchedFiles map[string]bool) {
+	matchedQueues = make(map[string]bool)
+	matchedExchanges = make(map[string]bool)
+	matchedFiles = make(map[string]bool)
+	for _, bind := range ex.MatchBindings(message) {
+		if bind.IsToExchange() {
+			matchedExchanges[bind.GetQueue()] = true
+		} else if bind.IsToFile() {
+			matchedFiles[bind.GetQueue()] = true
+		} else {
+			matchedQueues[bind.GetQueue()] = true
+		}
+	}
+	return
+}
+
+// MatchBindings returns bindings matched for message routing key, matched bindings are marked as routed
+// Routing key is rewritten by exchange rules before matching, message is not modified
+func (ex *Exchange) MatchBindings(message *amqp.Message) (matchedBindings []*binding.Binding) {
+	if routingKey := ex.RewriteRoutingKey(message.RoutingKey); routingKey != message.RoutingKey {
+		rewritten := *message
+		rewritten.RoutingKey = routingKey
+		message = &rewritten
+	}
+
 	// @spec-note
 	// The server MUST implement these standard exchange types: fanout, direct.
 	// The server SHOULD implement these standard exchange types: topic, headers.
 
 	// TODO implement "headers" exchange
-	matchedQueues = make(map[string]bool)
+	matched := func(bind *binding.Binding) {
+		bind.MarkRouted()
+		matchedBindings = append(matchedBindings, bind)
+	}
+
 	switch ex.exType {
 	case ExTypeDirect:
+		// message is routed by the first matched binding, file bindings only tee it
+		routed := false
 		for _, bind := range ex.bindings {
-			if bind.MatchDirect(message.Exchange, message.RoutingKey) {
-				matchedQueues[bind.GetQueue()] = true
-				return
+			if (!routed || bind.IsToFile()) && bind.MatchDirect(ex.Name, message.RoutingKey) {
+				matched(bind)
+				routed = routed || !bind.IsToFile()
 			}
 		}
-	case ExTypeFanout:
+	case ExTypeFanout, ExTypeSplitter:
 		for _, bind := range ex.bindings {
-			if bind.MatchFanout(message.Exchange) {
-				matchedQueues[bind.GetQueue()] = true
+			if bind.MatchFanout(ex.Name) {
+				matched(bind)
 			}
 		}
 	case ExTypeTopic:
+		header := messageHeaders(message)
 		for _, bind := range ex.bindings {
-			if bind.MatchTopic(message.Exchange, message.RoutingKey) {
-				matchedQueues[bind.GetQueue()] = true
+			if bind.MatchTopicHeaders(ex.Name, message.RoutingKey, header) {
+				matched(bind)
 			}
 		}
 	case ExTypeHeaders:
@@ -175,14 +381,28 @@ func (ex *Exchange) GetMatchedQueues(message *amqp.Message) (matchedQueues map[s
 		}
 		header := props.Headers
 		for _, bind := range ex.bindings {
-			if bind.MatchHeader(message.Exchange, header) {
-				matchedQueues[bind.GetQueue()] = true
+			if bind.MatchHeader(ex.Name, header) {
+				matched(bind)
+			}
+		}
+	case ExTypeFilter:
+		for _, bind := range ex.bindings {
+			if bind.MatchFilter(ex.Name, message) {
+				matched(bind)
 			}
 		}
 	}
 	return
 }
 
+// messageHeaders returns message headers, nil if message has no properties
+func messageHeaders(message *amqp.Message) *amqp.Table {
+	if message.Header == nil || message.Header.PropertyList == nil {
+		return nil
+	}
+	return message.Header.PropertyList.Headers
+}
+
 // EqualWithErr returns is given exchange equal to current
 func (ex *Exchange) EqualWithErr(exB *Exchange) error {
 	errTemplate := "inequivalent arg '%s' for exchange '%s': received '%s' but current is '%s'"
@@ -246,6 +466,9 @@ func (ex *Exchange) IsInternal() bool {
 // Marshal returns raw representation of exchange to store into storage
 func (ex *Exchange) Marshal(protoVersion string) (data []byte, err error) {
 	buf := bytes.NewBuffer(make([]byte, 0))
+	if err = amqp.WriteFormatVersion(buf, amqp.FormatVersionCurrent); err != nil {
+		return nil, err
+	}
 	if err = amqp.WriteShortstr(buf, ex.Name); err != nil {
 		return nil, err
 	}
@@ -256,8 +479,21 @@ func (ex *Exchange) Marshal(protoVersion string) (data []byte, err error) {
 }
 
 // Unmarshal returns exchange from storage raw bytes data
-func (ex *Exchange) Unmarshal(data []byte) (err error) {
+func (ex *Exchange) Unmarshal(data []byte, protoVersion string) (err error) {
 	buf := bytes.NewReader(data)
+	var version byte
+	if version, err = amqp.ReadFormatVersion(buf); err != nil {
+		return err
+	}
+
+	switch version {
+	case amqp.FormatVersion1, amqp.FormatVersion2:
+		err = ex.unmarshalV1(buf)
+	}
+	return
+}
+
+func (ex *Exchange) unmarshalV1(buf *bytes.Reader) (err error) {
 	if ex.Name, err = amqp.ReadShortstr(buf); err != nil {
 		return err
 	}
@@ -36,8 +36,12 @@ func TestExchange_AppendBinding(t *testing.T) {
 		return
 	}
 
-	e.AppendBinding(b)
-	e.AppendBinding(b)
+	if added, err := e.AppendBinding(b); !added || err != nil {
+		t.Fatalf("Expected new binding added, actual added %t, error %v", added, err)
+	}
+	if added, err := e.AppendBinding(b); added || err != nil {
+		t.Fatalf("Expected duplicate binding ignored, actual added %t, error %v", added, err)
+	}
 	l := len(e.GetBindings())
 	if l != 1 {
 		t.Fatalf("Expected 1 binding in exchange, %d given", l)
@@ -55,6 +59,26 @@ func TestExchange_AppendBinding(t *testing.T) {
 	}
 }
 
+func TestExchange_AppendBinding_MaxBindings(t *testing.T) {
+	e := getTestEx()
+	e.SetMaxBindings(1)
+	b1, _ := binding.NewBinding("test", "test", "test1", &amqp.Table{}, false)
+	b2, _ := binding.NewBinding("test", "test", "test2", &amqp.Table{}, false)
+
+	if _, err := e.AppendBinding(b1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AppendBinding(b1); err != nil {
+		t.Fatalf("Expected duplicate binding ignored, actual error %s", err)
+	}
+	if _, err := e.AppendBinding(b2); err == nil {
+		t.Fatal("Expected error on append binding over limit")
+	}
+	if l := len(e.GetBindings()); l != 1 {
+		t.Fatalf("Expected 1 binding in exchange, %d given", l)
+	}
+}
+
 func TestExchange_RemoveBinding(t *testing.T) {
 	e := getTestEx()
 	b, err := binding.NewBinding("test", "test", "test", &amqp.Table{}, false)
@@ -279,6 +303,171 @@ func TestExchange_GetMatchedQueues_Topic(t *testing.T) {
 	}
 }
 
+func TestExchange_Route_ExchangeBindings(t *testing.T) {
+	e := &Exchange{
+		Name:   "test",
+		exType: ExTypeFanout,
+	}
+
+	bQueue, _ := binding.NewBinding("test_q", "test", "", &amqp.Table{}, false)
+	bExchange, _ := binding.NewExchangeBinding("test_ex", "test", "", &amqp.Table{}, false)
+	bSameName, _ := binding.NewExchangeBinding("test_q", "test", "", &amqp.Table{}, false)
+	e.AppendBinding(bQueue)
+	e.AppendBinding(bExchange)
+	e.AppendBinding(bSameName)
+
+	queues, exchanges, _ := e.Route(&amqp.Message{Exchange: "test"})
+	if len(queues) != 1 || !queues["test_q"] {
+		t.Errorf("Expected only queue test_q matched, actual %v", queues)
+	}
+	if len(exchanges) != 2 || !exchanges["test_ex"] || !exchanges["test_q"] {
+		t.Errorf("Expected exchanges test_ex and test_q matched, actual %v", exchanges)
+	}
+
+	e.RemoveQueueBindings("test_q")
+	if l := len(e.GetBindings()); l != 2 {
+		t.Errorf("Expected exchange bindings kept after queue bindings removed, actual %d bindings", l)
+	}
+}
+
+func TestExchange_Route_FileBindings(t *testing.T) {
+	e := &Exchange{
+		Name:   "test",
+		exType: ExTypeDirect,
+	}
+
+	bQueue, _ := binding.NewBinding("test_q", "test", "key", &amqp.Table{}, false)
+	bFile, _ := binding.NewFileBinding("test.jsonl", "test", "key", &amqp.Table{}, false)
+	e.AppendBinding(bQueue)
+	e.AppendBinding(bFile)
+
+	// file binding after the first matched queue binding still tees message
+	queues, _, files := e.Route(&amqp.Message{Exchange: "test", RoutingKey: "key"})
+	if len(queues) != 1 || !queues["test_q"] {
+		t.Errorf("Expected only queue test_q matched, actual %v", queues)
+	}
+	if len(files) != 1 || !files["test.jsonl"] {
+		t.Errorf("Expected file test.jsonl matched, actual %v", files)
+	}
+
+	e.RemoveQueueBindings("test.jsonl")
+	if l := len(e.GetBindings()); l != 2 {
+		t.Errorf("Expected file bindings kept after queue bindings removed, actual %d bindings", l)
+	}
+}
+
+func TestExchange_GetMatchedQueues_BindingStats(t *testing.T) {
+	e := &Exchange{
+		Name:   "test",
+		exType: ExTypeTopic,
+	}
+
+	bAll, _ := binding.NewBinding("test_q1", "test", "orders.*", &amqp.Table{}, true)
+	bCreated, _ := binding.NewBinding("test_q2", "test", "orders.created", &amqp.Table{}, true)
+	bUnused, _ := binding.NewBinding("test_q3", "test", "payments.#", &amqp.Table{}, true)
+	e.AppendBinding(bAll)
+	e.AppendBinding(bCreated)
+	e.AppendBinding(bUnused)
+
+	for _, routingKey := range []string{"orders.created", "orders.created", "orders.created", "orders.deleted", "orders.deleted"} {
+		e.GetMatchedQueues(&amqp.Message{Exchange: "test", RoutingKey: routingKey})
+	}
+
+	if bAll.RoutedCount() != 5 {
+		t.Errorf("Expected %d routed messages, actual %d", 5, bAll.RoutedCount())
+	}
+	if bCreated.RoutedCount() != 3 {
+		t.Errorf("Expected %d routed messages, actual %d", 3, bCreated.RoutedCount())
+	}
+	if bUnused.RoutedCount() != 0 {
+		t.Errorf("Expected %d routed messages, actual %d", 0, bUnused.RoutedCount())
+	}
+
+	if bAll.LastRoutedAt().IsZero() || bCreated.LastRoutedAt().IsZero() {
+		t.Error("Expected last routed time for used bindings")
+	}
+	if !bUnused.LastRoutedAt().IsZero() {
+		t.Error("Expected zero last routed time for unused binding")
+	}
+}
+
+func TestExchange_GetMatchedQueues_Filter(t *testing.T) {
+	e := NewExchange("test", ExTypeFilter, false, false, false, false)
+
+	expensive, err := binding.NewBinding("expensive", "test", "", &amqp.Table{binding.FilterArg: "headers.price > 100"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cheap, err := binding.NewBinding("cheap", "test", "", &amqp.Table{binding.FilterArg: "headers.price <= 100 && headers.price > 0"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.AppendBinding(expensive)
+	e.AppendBinding(cheap)
+
+	getMessage := func(price interface{}) *amqp.Message {
+		headers := amqp.Table{"price": price}
+		return &amqp.Message{
+			Exchange: "test",
+			Header:   &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{Headers: &headers}},
+		}
+	}
+
+	matched := e.GetMatchedQueues(getMessage(int32(150)))
+	if len(matched) != 1 || !matched["expensive"] {
+		t.Fatalf("Expected match only %s, actual %v", "expensive", matched)
+	}
+
+	matched = e.GetMatchedQueues(getMessage(float64(99.5)))
+	if len(matched) != 1 || !matched["cheap"] {
+		t.Fatalf("Expected match only %s, actual %v", "cheap", matched)
+	}
+
+	matched = e.GetMatchedQueues(getMessage("free"))
+	if len(matched) != 0 {
+		t.Fatalf("Expected no match, actual %v", matched)
+	}
+}
+
+func TestExchange_GetMatchedQueues_TopicHeaders(t *testing.T) {
+	e := NewExchange("test", ExTypeTopic, false, false, false, false)
+
+	errorLogs, err := binding.NewBinding("errors", "test", "logs.#", &amqp.Table{"x-match": "all", "level": "error"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := binding.NewBinding("all", "test", "logs.#", &amqp.Table{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.AppendBinding(errorLogs)
+	e.AppendBinding(all)
+
+	getMessage := func(routingKey string, level string) *amqp.Message {
+		headers := amqp.Table{"level": level}
+		return &amqp.Message{
+			Exchange:   "test",
+			RoutingKey: routingKey,
+			Header:     &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{Headers: &headers}},
+		}
+	}
+
+	matched := e.GetMatchedQueues(getMessage("logs.app", "error"))
+	if len(matched) != 2 {
+		t.Fatalf("Expected match %s and %s, actual %v", "errors", "all", matched)
+	}
+
+	// both pattern and headers must match
+	matched = e.GetMatchedQueues(getMessage("logs.app", "info"))
+	if len(matched) != 1 || !matched["all"] {
+		t.Fatalf("Expected match only %s, actual %v", "all", matched)
+	}
+	matched = e.GetMatchedQueues(getMessage("metrics.app", "error"))
+	if len(matched) != 0 {
+		t.Fatalf("Expected no match, actual %v", matched)
+	}
+}
+
 func TestExchange_EqualWithErr_Success(t *testing.T) {
 	e1 := &Exchange{
 		Name:       "test",
@@ -511,17 +700,39 @@ func TestExchange_Marshal(t *testing.T) {
 		t.Fatal(err)
 	}
 	ex := &Exchange{}
-	ex.Unmarshal(data)
+	ex.Unmarshal(data, amqp.Proto091)
 
 	if err := e.EqualWithErr(ex); err != nil {
 		t.Fatal("Unmarshaled exchange does not equal marshaled", err)
 	}
 }
 
+func TestExchange_Unmarshal_Version1(t *testing.T) {
+	// record written before format versioning, without version prefix
+	data := []byte{4, 't', 'e', 's', 't', ExTypeTopic}
+
+	ex := &Exchange{}
+	if err := ex.Unmarshal(data, amqp.Proto091); err != nil {
+		t.Fatal(err)
+	}
+
+	if ex.GetName() != "test" || ex.ExType() != ExTypeTopic || !ex.IsDurable() {
+		t.Fatal("Unmarshaled exchange does not equal version 1 record")
+	}
+}
+
+// useless, for coverage only
+func TestExchange_Unmarshal_FailedUnsupportedVersion(t *testing.T) {
+	ex := &Exchange{}
+	if ex.Unmarshal([]byte{0, amqp.FormatVersionCurrent + 1, 4, 't', 'e', 's', 't', ExTypeTopic}, amqp.Proto091) == nil {
+		t.Fatal("Expected unmarshal error")
+	}
+}
+
 // useless, for coverage only
 func TestExchange_Unmarshal_FailedEmpty(t *testing.T) {
 	ex := &Exchange{}
-	if ex.Unmarshal([]byte{}) == nil {
+	if ex.Unmarshal([]byte{}, amqp.Proto091) == nil {
 		t.Fatal("Expected unmarshal error")
 	}
 }
@@ -529,7 +740,7 @@ func TestExchange_Unmarshal_FailedEmpty(t *testing.T) {
 // useless, for coverage only
 func TestExchange_Unmarshal_FailedNameOnly(t *testing.T) {
 	ex := &Exchange{}
-	if ex.Unmarshal([]byte{4, 't', 'e', 's', 't'}) == nil {
+	if ex.Unmarshal([]byte{4, 't', 'e', 's', 't'}, amqp.Proto091) == nil {
 		t.Fatal("Expected unmarshal error")
 	}
 }
@@ -581,3 +792,48 @@ func TestExchange_GetTypeAlias(t *testing.T) {
 		}
 	}
 }
+
+func TestExchange_CheckBinding(t *testing.T) {
+	direct := NewExchange("test", ExTypeDirect, false, false, false, false)
+	topic := NewExchange("test", ExTypeTopic, false, false, false, false)
+	headers := NewExchange("test", ExTypeHeaders, false, false, false, false)
+	filterEx := NewExchange("test", ExTypeFilter, false, false, false, false)
+
+	plainBind, _ := binding.NewBinding("q", "test", "rk", &amqp.Table{}, false)
+	topicBind, _ := binding.NewBinding("q", "test", "rk.*", &amqp.Table{}, true)
+	headersBind, _ := binding.NewBinding("q", "test", "", &amqp.Table{"x-match": "any", "type": "log"}, false)
+	filterBind, _ := binding.NewBinding("q", "test", "", &amqp.Table{binding.FilterArg: `routing_key == "rk"`}, false)
+	topicHeadersBind, _ := binding.NewBinding("q", "test", "rk.*", &amqp.Table{"type": "log"}, true)
+
+	compatible := []struct {
+		ex   *Exchange
+		bind *binding.Binding
+	}{
+		{direct, plainBind},
+		{topic, topicBind},
+		{headers, headersBind},
+		{headers, plainBind},
+		{filterEx, filterBind},
+		{topic, topicHeadersBind},
+	}
+	for _, c := range compatible {
+		if err := c.ex.CheckBinding(c.bind); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	incompatible := []struct {
+		ex   *Exchange
+		bind *binding.Binding
+	}{
+		{direct, topicBind},
+		{topic, plainBind},
+		{direct, headersBind},
+		{direct, filterBind},
+	}
+	for _, c := range incompatible {
+		if c.ex.CheckBinding(c.bind) == nil {
+			t.Fatalf("Expected binding '%s' is incompatible with %s exchange", c.bind.GetName(), c.ex.GetTypeAlias())
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package exchange
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// Exchange arguments of publish rate limit
+const (
+	// RateLimitMsgsArg limits published messages per second
+	RateLimitMsgsArg = "x-rate-limit-msgs"
+	// RateLimitBytesArg limits published body bytes per second
+	RateLimitBytesArg = "x-rate-limit-bytes"
+	// RateLimitModeArg sets what happens to publishes above limit, RateLimitDelay by default
+	RateLimitModeArg = "x-rate-limit-mode"
+)
+
+// Modes of publish rate limit
+const (
+	// RateLimitDelay delays publishes above limit blocking publishing channel
+	RateLimitDelay = "delay"
+	// RateLimitReject rejects publishes above limit, nack is sent in confirm mode
+	RateLimitReject = "reject"
+)
+
+// RateLimiter is token bucket limiting messages and bytes per second with burst of one second
+// Each bucket keeps single theoretical arrival time refilled and taken by CAS, so publishers do not lock each other
+type RateLimiter struct {
+	msgs   *rateBucket
+	bytes  *rateBucket
+	reject bool
+}
+
+// NewRateLimiter returns new instance of RateLimiter, zero rate means unlimited
+func NewRateLimiter(msgsPerSecond int64, bytesPerSecond int64, reject bool) *RateLimiter {
+	return &RateLimiter{
+		msgs:   newRateBucket(msgsPerSecond),
+		bytes:  newRateBucket(bytesPerSecond),
+		reject: reject,
+	}
+}
+
+// newRateLimiterFromArguments returns limiter configured by exchange arguments or nil if exchange is not limited
+func newRateLimiterFromArguments(name string, arguments *amqp.Table) (*RateLimiter, error) {
+	var rates [2]int64
+	for i, arg := range []string{RateLimitMsgsArg, RateLimitBytesArg} {
+		value, exists := (*arguments)[arg]
+		if !exists {
+			continue
+		}
+		rate, ok := arguments.Int64(arg)
+		if !ok || rate <= 0 {
+			return nil, fmt.Errorf("invalid arg '%s' for exchange '%s': expected positive integer, actual '%v'", arg, name, value)
+		}
+		rates[i] = rate
+	}
+
+	mode := RateLimitDelay
+	if value, exists := (*arguments)[RateLimitModeArg]; exists {
+		mode, _ = value.(string)
+		if mode != RateLimitDelay && mode != RateLimitReject {
+			return nil, fmt.Errorf("invalid arg '%s' for exchange '%s': expected '%s' or '%s', actual '%v'", RateLimitModeArg, name, RateLimitDelay, RateLimitReject, value)
+		}
+	}
+
+	if rates[0] == 0 && rates[1] == 0 {
+		return nil, nil
+	}
+	return NewRateLimiter(rates[0], rates[1], mode == RateLimitReject), nil
+}
+
+// IsReject returns are publishes above limit rejected instead of delayed
+func (limiter *RateLimiter) IsReject() bool {
+	return limiter.reject
+}
+
+// Take takes tokens for message with given body size
+// In delay mode tokens are always taken and returned duration is time to wait before publish
+// In reject mode tokens are taken only if available and ok is false otherwise
+func (limiter *RateLimiter) Take(size uint64) (wait time.Duration, ok bool) {
+	now := time.Now().UnixNano()
+	msgsWait, ok := limiter.msgs.take(now, 1, limiter.reject)
+	if !ok {
+		return 0, false
+	}
+	bytesWait, ok := limiter.bytes.take(now, int64(size), limiter.reject)
+	if !ok {
+		limiter.msgs.give(1)
+		return 0, false
+	}
+	if bytesWait > msgsWait {
+		return bytesWait, true
+	}
+	return msgsWait, true
+}
+
+// rateBucket is token bucket in form of generic cell rate algorithm:
+// tat is time when bucket becomes full again, each token moves it forward by interval
+type rateBucket struct {
+	tat      int64
+	interval int64
+	burst    int64
+}
+
+func newRateBucket(perSecond int64) *rateBucket {
+	if perSecond <= 0 {
+		return nil
+	}
+	interval := int64(time.Second) / perSecond
+	if interval == 0 {
+		interval = 1
+	}
+	return &rateBucket{interval: interval, burst: int64(time.Second)}
+}
+
+// take returns time to wait until taken tokens are refilled,
+// if onlyAvailable is set tokens are not taken when they would have to be waited for
+func (bucket *rateBucket) take(now int64, tokens int64, onlyAvailable bool) (time.Duration, bool) {
+	if bucket == nil || tokens == 0 {
+		return 0, true
+	}
+	for {
+		tat := atomic.LoadInt64(&bucket.tat)
+		newTat := tat
+		if newTat < now {
+			newTat = now
+		}
+		newTat += tokens * bucket.interval
+		wait := newTat - now - bucket.burst
+		if wait > 0 && onlyAvailable {
+			return 0, false
+		}
+		if atomic.CompareAndSwapInt64(&bucket.tat, tat, newTat) {
+			if wait < 0 {
+				wait = 0
+			}
+			return time.Duration(wait), true
+		}
+	}
+}
+
+// give returns taken tokens back
+func (bucket *rateBucket) give(tokens int64) {
+	if bucket != nil {
+		atomic.AddInt64(&bucket.tat, -tokens*bucket.interval)
+	}
+}
@@ -0,0 +1,78 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+func TestRateLimiter_Take_Reject(t *testing.T) {
+	limiter := NewRateLimiter(10, 1000, true)
+
+	for i := 0; i < 10; i++ {
+		if _, ok := limiter.Take(10); !ok {
+			t.Fatalf("Expected message %d allowed within burst", i)
+		}
+	}
+	if _, ok := limiter.Take(10); ok {
+		t.Fatal("Expected message above messages limit rejected")
+	}
+
+	limiter = NewRateLimiter(10, 1000, true)
+	if _, ok := limiter.Take(1001); ok {
+		t.Fatal("Expected message above bytes limit rejected")
+	}
+	// refused message does not take tokens of other bucket
+	for i := 0; i < 10; i++ {
+		if _, ok := limiter.Take(1); !ok {
+			t.Fatalf("Expected message %d allowed within burst", i)
+		}
+	}
+}
+
+func TestRateLimiter_Take_Delay(t *testing.T) {
+	limiter := NewRateLimiter(0, 100, false)
+
+	if wait, ok := limiter.Take(100); !ok || wait != 0 {
+		t.Fatalf("Expected burst allowed without wait, actual %s", wait)
+	}
+	wait, ok := limiter.Take(50)
+	if !ok {
+		t.Fatal("Expected message delayed, not rejected")
+	}
+	if wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Fatalf("Expected wait about %s, actual %s", 500*time.Millisecond, wait)
+	}
+}
+
+func TestExchange_SetArguments_RateLimit(t *testing.T) {
+	ex := NewExchange("test", ExTypeDirect, false, false, false, false)
+	if ex.RateLimiter() != nil {
+		t.Fatal("Expected exchange without limit")
+	}
+
+	if err := ex.SetArguments(&amqp.Table{RateLimitMsgsArg: int32(10), RateLimitModeArg: RateLimitReject}); err != nil {
+		t.Fatal(err)
+	}
+	if limiter := ex.RateLimiter(); limiter == nil || !limiter.IsReject() {
+		t.Fatal("Expected rejecting limiter")
+	}
+
+	if ex.SetPolicy("invalid", amqp.Table{RateLimitBytesArg: "fast"}) == nil {
+		t.Fatal("Expected error on invalid policy definition")
+	}
+	if ex.Policy() != "" || ex.RateLimiter() == nil {
+		t.Fatal("Expected current arguments kept on invalid policy")
+	}
+
+	if err := ex.SetPolicy("limit", amqp.Table{RateLimitBytesArg: int64(1000)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.SetArguments(nil); err != nil {
+		t.Fatal(err)
+	}
+	if limiter := ex.RateLimiter(); limiter == nil || limiter.IsReject() {
+		t.Fatal("Expected delaying limiter from policy")
+	}
+}
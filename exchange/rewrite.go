@@ -0,0 +1,80 @@
+package exchange
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// Routing key rewrite
+// Exchange declared with rewrite arguments (or given them by policy) transforms routing key of incoming message
+// before its bindings are matched, so exchange can adapt publishers to foreign topology. x-rewrite-strip-prefix
+// removes prefix from key, then x-rewrite-pattern regexp is replaced by x-rewrite-replacement ($1 expands
+// submatches, empty by default). Message itself keeps its routing key, so it is delivered and passed
+// to bound exchanges with original key. Rewrite is off without arguments.
+const (
+	RewriteStripPrefixArg = "x-rewrite-strip-prefix"
+	RewritePatternArg     = "x-rewrite-pattern"
+	RewriteReplacementArg = "x-rewrite-replacement"
+)
+
+// keyRewriter transforms routing keys by exchange rewrite rules
+type keyRewriter struct {
+	prefix      string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// newKeyRewriterFromArguments returns rewriter configured by exchange arguments or nil if keys are not rewritten
+func newKeyRewriterFromArguments(name string, arguments *amqp.Table) (*keyRewriter, error) {
+	var values [3]string
+	for i, arg := range []string{RewriteStripPrefixArg, RewritePatternArg, RewriteReplacementArg} {
+		value, exists := (*arguments)[arg]
+		if !exists {
+			continue
+		}
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid arg '%s' for exchange '%s': expected string, actual '%v'", arg, name, value)
+		}
+		values[i] = str
+	}
+	prefix, source, replacement := values[0], values[1], values[2]
+	if source == "" && replacement != "" {
+		return nil, fmt.Errorf("invalid arg '%s' for exchange '%s': '%s' is not set", RewriteReplacementArg, name, RewritePatternArg)
+	}
+	if prefix == "" && source == "" {
+		return nil, nil
+	}
+
+	rewriter := &keyRewriter{prefix: prefix, replacement: replacement}
+	if source != "" {
+		var err error
+		if rewriter.pattern, err = regexp.Compile(source); err != nil {
+			return nil, fmt.Errorf("invalid arg '%s' for exchange '%s': %s", RewritePatternArg, name, err.Error())
+		}
+	}
+	return rewriter, nil
+}
+
+// rewrite returns routing key transformed by rules
+func (rewriter *keyRewriter) rewrite(routingKey string) string {
+	routingKey = strings.TrimPrefix(routingKey, rewriter.prefix)
+	if rewriter.pattern != nil {
+		routingKey = rewriter.pattern.ReplaceAllString(routingKey, rewriter.replacement)
+	}
+	return routingKey
+}
+
+// RewriteRoutingKey returns routing key which bindings of exchange are matched with
+func (ex *Exchange) RewriteRoutingKey(routingKey string) string {
+	ex.argLock.RLock()
+	rewriter := ex.rewriter
+	ex.argLock.RUnlock()
+	if rewriter == nil {
+		return routingKey
+	}
+	return rewriter.rewrite(routingKey)
+}
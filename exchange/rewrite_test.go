@@ -0,0 +1,60 @@
+package exchange
+
+import (
+	"testing"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/binding"
+)
+
+func TestExchange_RewriteRoutingKey(t *testing.T) {
+	ex := NewExchange("adapter", ExTypeTopic, false, false, false, false)
+	if key := ex.RewriteRoutingKey("legacy.orders.created"); key != "legacy.orders.created" {
+		t.Errorf("Expected key is not rewritten by default, actual '%s'", key)
+	}
+
+	if err := ex.SetArguments(&amqp.Table{RewriteStripPrefixArg: "legacy."}); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"legacy.orders.created": "orders.created", "orders.paid": "orders.paid"} {
+		if actual := ex.RewriteRoutingKey(key); actual != expected {
+			t.Errorf("Expected key '%s' rewritten into '%s', actual '%s'", key, expected, actual)
+		}
+	}
+
+	if err := ex.SetArguments(&amqp.Table{
+		RewriteStripPrefixArg: "legacy.",
+		RewritePatternArg:     `^(\w+)_(\w+)$`,
+		RewriteReplacementArg: "$1.$2",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if key := ex.RewriteRoutingKey("legacy.orders_created"); key != "orders.created" {
+		t.Errorf("Expected key rewritten into 'orders.created', actual '%s'", key)
+	}
+
+	for _, arguments := range []amqp.Table{
+		{RewriteStripPrefixArg: int32(1)},
+		{RewritePatternArg: "("},
+		{RewriteReplacementArg: "$1"},
+	} {
+		if ex.SetArguments(&arguments) == nil {
+			t.Errorf("Expected error on rewrite arguments %v", arguments)
+		}
+	}
+}
+
+func TestExchange_MatchBindings_Rewrite(t *testing.T) {
+	ex := NewExchange("adapter", ExTypeDirect, false, false, false, false)
+	ex.SetArguments(&amqp.Table{RewriteStripPrefixArg: "legacy."})
+	bind, _ := binding.NewBinding("orders", "adapter", "orders", &amqp.Table{}, false)
+	ex.AppendBinding(bind)
+
+	message := &amqp.Message{RoutingKey: "legacy.orders"}
+	if queues := ex.GetMatchedQueues(message); !queues["orders"] {
+		t.Errorf("Expected message routed by rewritten key, actual %v", queues)
+	}
+	if message.RoutingKey != "legacy.orders" {
+		t.Errorf("Expected message keeps routing key, actual '%s'", message.RoutingKey)
+	}
+}
@@ -0,0 +1,498 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// Expression limits, language has no loops and function calls,
+// so evaluation cost is bounded by the number of nodes
+const (
+	MaxLength = 1024
+	MaxNodes  = 64
+)
+
+const headersPrefix = "headers."
+
+// properties is the whitelist of message fields available in expressions
+var properties = map[string]func(message *amqp.Message) interface{}{
+	"routing_key": func(message *amqp.Message) interface{} { return message.RoutingKey },
+	"exchange":    func(message *amqp.Message) interface{} { return message.Exchange },
+	"content_type": func(message *amqp.Message) interface{} {
+		return stringValue(message.Header.PropertyList.ContentType)
+	},
+	"content_encoding": func(message *amqp.Message) interface{} {
+		return stringValue(message.Header.PropertyList.ContentEncoding)
+	},
+	"delivery_mode": func(message *amqp.Message) interface{} {
+		return byteValue(message.Header.PropertyList.DeliveryMode)
+	},
+	"priority": func(message *amqp.Message) interface{} {
+		return byteValue(message.Header.PropertyList.Priority)
+	},
+	"correlation_id": func(message *amqp.Message) interface{} {
+		return stringValue(message.Header.PropertyList.CorrelationID)
+	},
+	"reply_to": func(message *amqp.Message) interface{} {
+		return stringValue(message.Header.PropertyList.ReplyTo)
+	},
+	"expiration": func(message *amqp.Message) interface{} {
+		return stringValue(message.Header.PropertyList.Expiration)
+	},
+	"message_id": func(message *amqp.Message) interface{} {
+		return stringValue(message.Header.PropertyList.MessageID)
+	},
+	"timestamp": func(message *amqp.Message) interface{} {
+		if ts := message.Header.PropertyList.Timestamp; ts != nil {
+			return float64(ts.Unix())
+		}
+		return nil
+	},
+	"type": func(message *amqp.Message) interface{} {
+		return stringValue(message.Header.PropertyList.Type)
+	},
+	"user_id": func(message *amqp.Message) interface{} {
+		return stringValue(message.Header.PropertyList.UserID)
+	},
+	"app_id": func(message *amqp.Message) interface{} {
+		return stringValue(message.Header.PropertyList.AppID)
+	},
+}
+
+// Expression is compiled predicate over message routing key, properties and headers
+//
+// Grammar:
+//
+//	expr       = or
+//	or         = and { "||" and }
+//	and        = not { "&&" not }
+//	not        = "!" not | comparison
+//	comparison = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) operand ]
+//	operand    = number | string | "true" | "false" | field | "(" expr ")"
+//	field      = property | "headers." name | "headers[" string "]"
+//
+// Numbers are compared as numbers, strings lexicographically,
+// any comparison with missing field or values of different types is false
+type Expression struct {
+	source string
+	root   node
+}
+
+// Compile parses expression source and checks used fields against whitelist
+func Compile(source string) (*Expression, error) {
+	if len(source) > MaxLength {
+		return nil, fmt.Errorf("filter expression is longer than %d", MaxLength)
+	}
+
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s' in filter expression", p.tokens[p.pos].value)
+	}
+
+	return &Expression{source: source, root: root}, nil
+}
+
+// String returns expression source
+func (expr *Expression) String() string {
+	return expr.source
+}
+
+// Match evaluates expression for message, non-boolean result is false
+func (expr *Expression) Match(message *amqp.Message) bool {
+	result, _ := expr.root.eval(message).(bool)
+	return result
+}
+
+type node interface {
+	eval(message *amqp.Message) interface{}
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(message *amqp.Message) interface{} {
+	return n.value
+}
+
+type propertyNode struct {
+	get func(message *amqp.Message) interface{}
+}
+
+func (n *propertyNode) eval(message *amqp.Message) interface{} {
+	if message.Header == nil || message.Header.PropertyList == nil {
+		return nil
+	}
+	return n.get(message)
+}
+
+type headerNode struct {
+	name string
+}
+
+func (n *headerNode) eval(message *amqp.Message) interface{} {
+	if message.Header == nil || message.Header.PropertyList == nil || message.Header.PropertyList.Headers == nil {
+		return nil
+	}
+	return normalize((*message.Header.PropertyList.Headers)[n.name])
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(message *amqp.Message) interface{} {
+	value, ok := n.operand.eval(message).(bool)
+	if !ok {
+		return nil
+	}
+	return !value
+}
+
+type logicalNode struct {
+	and         bool
+	left, right node
+}
+
+func (n *logicalNode) eval(message *amqp.Message) interface{} {
+	left, _ := n.left.eval(message).(bool)
+	if n.and != left {
+		return left
+	}
+	right, _ := n.right.eval(message).(bool)
+	return right
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n *compareNode) eval(message *amqp.Message) interface{} {
+	left := n.left.eval(message)
+	right := n.right.eval(message)
+	if left == nil || right == nil {
+		return false
+	}
+
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return false
+		}
+		if l < r {
+			cmp = -1
+		} else if l > r {
+			cmp = 1
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(l, r)
+	case bool:
+		r, ok := right.(bool)
+		if !ok {
+			return false
+		}
+		switch n.op {
+		case "==":
+			return l == r
+		case "!=":
+			return l != r
+		}
+		return false
+	default:
+		return false
+	}
+
+	switch n.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// normalize converts header value into one of comparable types
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int8:
+		return float64(v)
+	case uint8:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case uint16:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case int:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case float64, string, bool:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return nil
+}
+
+func stringValue(value *string) interface{} {
+	if value == nil {
+		return nil
+	}
+	return *value
+}
+
+func byteValue(value *byte) interface{} {
+	if value == nil {
+		return nil
+	}
+	return float64(*value)
+}
+
+const (
+	tokenNumber = iota
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+type token struct {
+	kind  int
+	value string
+}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, errors.New("unterminated string in filter expression")
+			}
+			tokens = append(tokens, token{kind: tokenString, value: string(runes[i+1 : end])})
+			i = end + 1
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			end := i + 1
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, value: string(runes[i:end])})
+			i = end
+		case unicode.IsLetter(r) || r == '_':
+			end := i + 1
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || strings.ContainsRune("_.-", runes[end])) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, value: string(runes[i:end])})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]"} {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected '%c' in filter expression", r)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, value: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	nodes  int
+}
+
+func (p *parser) peekOperator(ops ...string) string {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenOperator {
+		return ""
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].value == op {
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *parser) newNode(n node) (node, error) {
+	p.nodes++
+	if p.nodes > MaxNodes {
+		return nil, fmt.Errorf("filter expression has more than %d nodes", MaxNodes)
+	}
+	return n, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOperator("||") != "" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.newNode(&logicalNode{and: false, left: left, right: right}); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOperator("&&") != "" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.newNode(&logicalNode{and: true, left: left, right: right}); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.peekOperator("!") != "" {
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return p.newNode(&notNode{operand: operand})
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peekOperator("==", "!=", "<=", ">=", "<", ">")
+	if op == "" {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return p.newNode(&compareNode{op: op, left: left, right: right})
+}
+
+func (p *parser) parseOperand() (node, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of filter expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+
+	switch tok.kind {
+	case tokenNumber:
+		value, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number '%s' in filter expression", tok.value)
+		}
+		return p.newNode(&literalNode{value: value})
+	case tokenString:
+		return p.newNode(&literalNode{value: tok.value})
+	case tokenIdent:
+		return p.parseIdent(tok.value)
+	case tokenOperator:
+		if tok.value == "(" {
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if p.peekOperator(")") == "" {
+				return nil, errors.New("missing ')' in filter expression")
+			}
+			p.pos++
+			return inner, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected '%s' in filter expression", tok.value)
+}
+
+func (p *parser) parseIdent(name string) (node, error) {
+	switch name {
+	case "true":
+		return p.newNode(&literalNode{value: true})
+	case "false":
+		return p.newNode(&literalNode{value: false})
+	case "headers":
+		if p.peekOperator("[") == "" || p.pos+2 >= len(p.tokens) ||
+			p.tokens[p.pos+1].kind != tokenString || p.tokens[p.pos+2].value != "]" {
+			return nil, errors.New("expected headers[\"name\"] in filter expression")
+		}
+		header := p.tokens[p.pos+1].value
+		p.pos += 3
+		return p.newNode(&headerNode{name: header})
+	}
+
+	if strings.HasPrefix(name, headersPrefix) && len(name) > len(headersPrefix) {
+		return p.newNode(&headerNode{name: strings.TrimPrefix(name, headersPrefix)})
+	}
+	if get, ok := properties[name]; ok {
+		return p.newNode(&propertyNode{get: get})
+	}
+	return nil, fmt.Errorf("unknown field '%s' in filter expression", name)
+}
@@ -0,0 +1,99 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+func newMessage(routingKey string, headers amqp.Table) *amqp.Message {
+	contentType := "application/json"
+	priority := byte(5)
+	return &amqp.Message{
+		Exchange:   "test",
+		RoutingKey: routingKey,
+		Header: &amqp.ContentHeader{
+			PropertyList: &amqp.BasicPropertyList{
+				ContentType: &contentType,
+				Priority:    &priority,
+				Headers:     &headers,
+			},
+		},
+	}
+}
+
+func TestExpression_Match(t *testing.T) {
+	message := newMessage("orders.created", amqp.Table{
+		"amount":   int32(150),
+		"currency": "EUR",
+		"urgent":   true,
+		"x-weight": float64(2.5),
+	})
+
+	cases := map[string]bool{
+		`headers.amount > 100`:                                     true,
+		`headers.amount >= 150 && headers.amount <= 150`:           true,
+		`headers.amount < 100`:                                     false,
+		`headers["x-weight"] == 2.5`:                               true,
+		`headers.x-weight > -1`:                                    true,
+		`headers.currency == "EUR" || headers.currency == 'USD'`:   true,
+		`!(headers.currency == "EUR")`:                             false,
+		`headers.urgent == true`:                                   true,
+		`headers.urgent`:                                           true,
+		`headers.missing > 0 || headers.missing <= 0`:              false,
+		`headers.missing != 1`:                                     false,
+		`headers.currency > 100`:                                   false,
+		`routing_key == "orders.created" && priority > 3`:          true,
+		`content_type == "application/json" && exchange == "test"`: true,
+		`reply_to == "x"`:                                          false,
+		`headers.amount`:                                           false,
+	}
+
+	for source, expected := range cases {
+		expr, err := Compile(source)
+		if err != nil {
+			t.Fatalf("Unexpected error on compile '%s': %s", source, err)
+		}
+		if expr.Match(message) != expected {
+			t.Errorf("Expected '%s' is %t", source, expected)
+		}
+	}
+}
+
+func TestExpression_Match_NoHeaders(t *testing.T) {
+	expr, _ := Compile(`headers.amount > 100 || routing_key == "key"`)
+	if !expr.Match(&amqp.Message{RoutingKey: "key", Header: &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{}}}) {
+		t.Error("Expected match by routing key for message without headers")
+	}
+}
+
+func TestCompile_Failed(t *testing.T) {
+	sources := []string{
+		``,
+		`headers.amount >`,
+		`headers.amount > 100)`,
+		`(headers.amount > 100`,
+		`body == "secret"`,
+		`os.exit == 1`,
+		`headers[amount] == 1`,
+		`headers.amount + 1`,
+		`"unterminated`,
+		strings.Repeat(`headers.a == 1 && `, 40) + `true`,
+		strings.Repeat(" ", MaxLength+1),
+	}
+
+	for _, source := range sources {
+		if _, err := Compile(source); err == nil {
+			t.Errorf("Expected error on compile '%s'", source)
+		}
+	}
+}
+
+func TestExpression_String(t *testing.T) {
+	source := `headers.amount > 100`
+	expr, _ := Compile(source)
+	if expr.String() != source {
+		t.Errorf("Expected %s, actual %s", source, expr.String())
+	}
+}
@@ -1,6 +1,8 @@
 package interfaces
 
 import (
+	"context"
+
 	"github.com/valinurovam/garagemq/amqp"
 )
 
@@ -17,6 +19,8 @@ type Consumer interface {
 	Consume() bool
 	Tag() string
 	Cancel()
+	Drain(ctx context.Context) error
+	UnackedCount() int64
 }
 
 // OpSet identifier for set data into storeage
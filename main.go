@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"runtime"
 	"strings"
@@ -50,7 +49,6 @@ func main() {
 		os.Exit(0)
 	}
 
-	initLogger(viper.GetString("log-level"), viper.GetString("log-file"))
 	var cfg *config.Config
 	var err error
 	if viper.GetString("config") != "" {
@@ -62,9 +60,15 @@ func main() {
 		cfg, _ = config.CreateDefault()
 	}
 
+	logLevel := viper.GetString("log-level")
+	if cfg.Log.Level != "" {
+		logLevel = cfg.Log.Level
+	}
+	initLogger(logLevel, viper.GetString("log-file"))
+
 	if viper.GetBool("hprof") {
-		// for hprof debugging
-		go http.ListenAndServe(fmt.Sprintf("%s:%s", viper.GetString("hprof-host"), viper.GetString("hprof-port")), nil)
+		// for hprof debugging, profiles are not served by admin server
+		go http.ListenAndServe(fmt.Sprintf("%s:%s", viper.GetString("hprof-host"), viper.GetString("hprof-port")), admin.NewProfilerHandler())
 	}
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -72,7 +76,9 @@ func main() {
 	metrics.NewTrackRegistry(15, time.Second, false)
 
 	srv := server.NewServer(cfg.TCP.IP, cfg.TCP.Port, cfg.Proto, cfg)
-	adminServer := admin.NewAdminServer(srv, cfg.Admin.IP, cfg.Admin.Port)
+	// config file is re-read on SIGHUP
+	srv.SetConfigFile(viper.GetString("config"))
+	adminServer := admin.NewAdminServer(srv, cfg.Admin)
 
 	// Start admin server
 	go func() {
@@ -81,6 +87,16 @@ func main() {
 		}
 	}()
 
+	// Start debug server
+	if cfg.Debug.Enabled {
+		debugServer := admin.NewDebugServer(srv, cfg.Debug)
+		go func() {
+			if err := debugServer.Start(); err != nil {
+				panic("Failed to start debugServer - " + err.Error())
+			}
+		}()
+	}
+
 	// Start GarageMQ broker
 	srv.Start()
 }
@@ -22,6 +22,7 @@ type MsgStorage struct {
 	del           map[string]*amqp.Message
 	protoVersion  string
 	closeCh       chan bool
+	closingCh     chan struct{}
 	confirmSyncCh chan *amqp.Message
 	confirmMode   bool
 	writeCh       chan struct{}
@@ -29,15 +30,21 @@ type MsgStorage struct {
 
 // NewMsgStorage returns new instance of message storage
 func NewMsgStorage(db interfaces.DbStorage, protoVersion string) *MsgStorage {
+	msgStorage := newMsgStorage(db, protoVersion)
+	go msgStorage.periodicPersist()
+	return msgStorage
+}
+
+func newMsgStorage(db interfaces.DbStorage, protoVersion string) *MsgStorage {
 	msgStorage := &MsgStorage{
 		db:            db,
 		protoVersion:  protoVersion,
 		closeCh:       make(chan bool),
+		closingCh:     make(chan struct{}),
 		confirmSyncCh: make(chan *amqp.Message, 4096),
 		writeCh:       make(chan struct{}, 5),
 	}
 	msgStorage.cleanPersistQueue()
-	go msgStorage.periodicPersist()
 	return msgStorage
 }
 
@@ -50,16 +57,28 @@ func (storage *MsgStorage) cleanPersistQueue() {
 // We try to persist messages every 20ms and every 1000msg
 func (storage *MsgStorage) periodicPersist() {
 	tick := time.NewTicker(20 * time.Millisecond)
+	done := make(chan struct{})
 
 	go func() {
-		for range tick.C {
-			storage.writeCh <- struct{}{}
+		for {
+			select {
+			case <-tick.C:
+				select {
+				case storage.writeCh <- struct{}{}:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
 		}
 	}()
 
 	for range storage.writeCh {
 		select {
 		case <-storage.closeCh:
+			tick.Stop()
+			close(done)
 			return
 		default:
 			storage.persist()
@@ -80,11 +99,15 @@ func (storage *MsgStorage) persist() {
 	storage.cleanPersistQueue()
 	storage.persistLock.Unlock()
 
+	// messages added and deleted within the same batch are never written,
+	// but still have to be confirmed after batch is processed
 	rmDel := make([]string, 0)
+	rmAdd := make([]*amqp.Message, 0)
 	for delKey := range del {
-		if _, ok := add[delKey]; ok {
+		if message, ok := add[delKey]; ok {
 			delete(add, delKey)
 			rmDel = append(rmDel, delKey)
+			rmAdd = append(rmAdd, message)
 		}
 
 		delete(update, delKey)
@@ -129,14 +152,30 @@ func (storage *MsgStorage) persist() {
 		)
 	}
 
-	if err := storage.db.ProcessBatch(batch); err != nil {
-		panic(err)
+	// ProcessBatch returns after batch is synced to disk (BuntDB SyncPolicy Always, Badger SyncWrites),
+	// so confirms below are sent only for durably stored messages
+	// idle ticks produce empty batches, they are not written to avoid needless sync
+	if len(batch) > 0 {
+		if err := storage.db.ProcessBatch(batch); err != nil {
+			panic(err)
+		}
 	}
 
 	for _, message := range add {
-		if message.ConfirmMeta != nil && storage.confirmMode && message.ConfirmMeta.DeliveryTag > 0 {
-			message.ConfirmMeta.ActualConfirms++
-			storage.confirmSyncCh <- message
+		storage.confirm(message)
+	}
+	for _, message := range rmAdd {
+		storage.confirm(message)
+	}
+}
+
+// confirm sends confirm to vhost, confirms are dropped on close, cause vhost may not read them anymore
+func (storage *MsgStorage) confirm(message *amqp.Message) {
+	if message.ConfirmMeta != nil && storage.confirmMode && message.ConfirmMeta.DeliveryTag > 0 {
+		message.ConfirmMeta.ActualConfirms++
+		select {
+		case storage.confirmSyncCh <- message:
+		case <-storage.closingCh:
 		}
 	}
 }
@@ -169,7 +208,13 @@ func (storage *MsgStorage) Update(message *amqp.Message, queue string) error {
 }
 
 // Del append message into del-queue
+// Deletions of acked messages are persisted in batches, so message acked within the last batch interval
+// before crash is restored on next start, acking it again is safe as deletion of missing key is not an error
 func (storage *MsgStorage) Del(message *amqp.Message, queue string) error {
+	if storage.getQueueLen() > 1000 {
+		storage.writeCh <- struct{}{}
+	}
+
 	storage.persistLock.Lock()
 	defer storage.persistLock.Unlock()
 	storage.del[makeKey(message.ID, queue)] = message
@@ -232,9 +277,16 @@ func (storage *MsgStorage) PurgeQueue(queue string) {
 
 // Close properly "stop" message storage
 func (storage *MsgStorage) Close() error {
+	// persist blocked on full confirms buffer is released, so close does not wait for it
+	close(storage.closingCh)
 	storage.closeCh <- true
+	// operations queued after the last periodic persist, e.g. deletions of just acked messages,
+	// are persisted before close, so acked messages are not restored on next start
+	storage.persist()
 	storage.persistLock.Lock()
 	defer storage.persistLock.Unlock()
+	// persist loop is stopped, no more confirms will be sent
+	close(storage.confirmSyncCh)
 	return storage.db.Close()
 }
 
@@ -0,0 +1,119 @@
+package msgstorage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/interfaces"
+	"github.com/valinurovam/garagemq/storage"
+)
+
+const testQueue = "test"
+
+func newTestMessage(id uint64) *amqp.Message {
+	var dMode byte = 2
+	return &amqp.Message{
+		ID:         id,
+		RoutingKey: testQueue,
+		Header: &amqp.ContentHeader{
+			PropertyList: &amqp.BasicPropertyList{
+				DeliveryMode: &dMode,
+			},
+		},
+	}
+}
+
+func queueIDs(storage *MsgStorage) []uint64 {
+	var ids []uint64
+	storage.IterateByQueue(testQueue, 0, func(message *amqp.Message) {
+		ids = append(ids, message.ID)
+	})
+	return ids
+}
+
+func TestMsgStorage_Ack_CrashBeforePersist(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "msgstorage")
+	defer os.RemoveAll(dir)
+
+	var db interfaces.DbStorage = storage.NewBadger(dir)
+	msgStorage := newMsgStorage(db, amqp.ProtoRabbit)
+	msgStorage.Add(newTestMessage(1), testQueue)
+	msgStorage.Add(newTestMessage(2), testQueue)
+	msgStorage.persist()
+
+	// ack deletion is queued, but storage is lost before batch is persisted
+	msgStorage.Del(newTestMessage(1), testQueue)
+	db.Close()
+
+	db = storage.NewBadger(dir)
+	defer db.Close()
+	msgStorage = newMsgStorage(db, amqp.ProtoRabbit)
+	if ids := queueIDs(msgStorage); len(ids) != 2 {
+		t.Fatalf("Expected acked message restored after crash, actual %v", ids)
+	}
+
+	// restored message is acked again, deletion of already deleted message is not an error
+	msgStorage.Del(newTestMessage(1), testQueue)
+	msgStorage.Del(newTestMessage(1), testQueue)
+	msgStorage.persist()
+	msgStorage.Del(newTestMessage(1), testQueue)
+	msgStorage.persist()
+	if ids := queueIDs(msgStorage); len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("Expected only unacked message stored, actual %v", ids)
+	}
+}
+
+func TestMsgStorage_Close_PersistsPendingAcks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "msgstorage")
+	defer os.RemoveAll(dir)
+
+	db := storage.NewBadger(dir)
+	msgStorage := NewMsgStorage(db, amqp.ProtoRabbit)
+	msgStorage.Add(newTestMessage(1), testQueue)
+	msgStorage.Add(newTestMessage(2), testQueue)
+	msgStorage.Close()
+
+	db = storage.NewBadger(dir)
+	msgStorage = NewMsgStorage(db, amqp.ProtoRabbit)
+	msgStorage.Del(newTestMessage(1), testQueue)
+	msgStorage.Close()
+
+	db = storage.NewBadger(dir)
+	defer db.Close()
+	if ids := queueIDs(newMsgStorage(db, amqp.ProtoRabbit)); len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("Expected ack persisted on close, actual %v", ids)
+	}
+}
+
+func TestMsgStorage_Close_ConfirmsNotRead(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "msgstorage")
+	defer os.RemoveAll(dir)
+
+	db := storage.NewBadger(dir)
+	msgStorage := NewMsgStorage(db, amqp.ProtoRabbit)
+	confirms := msgStorage.ReceiveConfirms()
+	// confirms reader is stopped with full buffer
+	for len(confirms) < cap(confirms) {
+		confirms <- newTestMessage(0)
+	}
+
+	// message added and deleted within the same batch is confirmed without write
+	message := newTestMessage(1)
+	message.ConfirmMeta = &amqp.ConfirmMeta{DeliveryTag: 1, ExpectedConfirms: 1}
+	msgStorage.Add(message, testQueue)
+	msgStorage.Del(message, testQueue)
+
+	closed := make(chan struct{})
+	go func() {
+		msgStorage.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected close does not wait for confirms reader")
+	}
+}
@@ -1,14 +1,21 @@
 package qos
 
-import "sync"
+import (
+	"math"
+	"sync"
+)
 
 // AmqpQos represents qos system
+// In credit mode deliveries are limited by credit granted by consumer instead of prefetch window,
+// each delivery takes credit, acks do not return it and new credit is added only by Grant
 type AmqpQos struct {
 	sync.Mutex
 	prefetchCount uint16
 	currentCount  uint16
 	prefetchSize  uint32
 	currentSize   uint32
+	creditMode    bool
+	credit        uint32
 }
 
 // NewAmqpQos returns new instance of AmqpQos
@@ -21,18 +28,34 @@ func NewAmqpQos(prefetchCount uint16, prefetchSize uint32) *AmqpQos {
 	}
 }
 
+// NewCreditQos returns new instance of AmqpQos in credit mode with initial credit
+func NewCreditQos(credit uint32) *AmqpQos {
+	return &AmqpQos{
+		creditMode: true,
+		credit:     credit,
+	}
+}
+
 // PrefetchCount returns prefetchCount
 func (qos *AmqpQos) PrefetchCount() uint16 {
+	qos.Lock()
+	defer qos.Unlock()
 	return qos.prefetchCount
 }
 
 // PrefetchSize returns prefetchSize
 func (qos *AmqpQos) PrefetchSize() uint32 {
+	qos.Lock()
+	defer qos.Unlock()
 	return qos.prefetchSize
 }
 
 // Update set new prefetchCount and prefetchSize
+// Current count and size are kept as is, so if new limits are lower than current values
+// Inc will fail until enough messages will be released by Dec
 func (qos *AmqpQos) Update(prefetchCount uint16, prefetchSize uint32) {
+	qos.Lock()
+	defer qos.Unlock()
 	qos.prefetchCount = prefetchCount
 	qos.prefetchSize = prefetchSize
 }
@@ -40,7 +63,39 @@ func (qos *AmqpQos) Update(prefetchCount uint16, prefetchSize uint32) {
 // IsActive check is qos rules are active
 // both prefetchSize and prefetchCount must be 0
 func (qos *AmqpQos) IsActive() bool {
-	return qos.prefetchCount != 0 || qos.prefetchSize != 0
+	qos.Lock()
+	defer qos.Unlock()
+	return qos.creditMode || qos.prefetchCount != 0 || qos.prefetchSize != 0
+}
+
+// IsCredit check is qos in credit mode
+func (qos *AmqpQos) IsCredit() bool {
+	qos.Lock()
+	defer qos.Unlock()
+	return qos.creditMode
+}
+
+// Credit returns outstanding credit
+func (qos *AmqpQos) Credit() uint32 {
+	qos.Lock()
+	defer qos.Unlock()
+	return qos.credit
+}
+
+// Grant adds credit, outstanding credit is saturated at max uint32
+// Returns false if qos is not in credit mode
+func (qos *AmqpQos) Grant(credit uint32) bool {
+	qos.Lock()
+	defer qos.Unlock()
+	if !qos.creditMode {
+		return false
+	}
+	if qos.credit+credit < qos.credit {
+		qos.credit = math.MaxUint32
+	} else {
+		qos.credit += credit
+	}
+	return true
 }
 
 // Inc increment current count and size
@@ -50,6 +105,14 @@ func (qos *AmqpQos) Inc(count uint16, size uint32) bool {
 	qos.Lock()
 	defer qos.Unlock()
 
+	if qos.creditMode {
+		if uint32(count) > qos.credit {
+			return false
+		}
+		qos.credit -= uint32(count)
+		return true
+	}
+
 	newCount := qos.currentCount + count
 	newSize := qos.currentSize + size
 
@@ -63,10 +126,15 @@ func (qos *AmqpQos) Inc(count uint16, size uint32) bool {
 }
 
 // Dec decrement current count and size
+// Credit taken by Inc is not returned in credit mode
 func (qos *AmqpQos) Dec(count uint16, size uint32) {
 	qos.Lock()
 	defer qos.Unlock()
 
+	if qos.creditMode {
+		return
+	}
+
 	if qos.currentCount < count {
 		qos.currentCount = 0
 	} else {
@@ -80,6 +148,20 @@ func (qos *AmqpQos) Dec(count uint16, size uint32) {
 	}
 }
 
+// FreeCount returns number of messages which can be taken before prefetchCount is exceeded and prefetchCount itself
+// Returns zero prefetchCount if count is not limited or qos is in credit mode
+func (qos *AmqpQos) FreeCount() (free uint16, prefetchCount uint16) {
+	qos.Lock()
+	defer qos.Unlock()
+	if qos.creditMode || qos.prefetchCount == 0 {
+		return 0, 0
+	}
+	if qos.currentCount >= qos.prefetchCount {
+		return 0, qos.prefetchCount
+	}
+	return qos.prefetchCount - qos.currentCount, qos.prefetchCount
+}
+
 // Release reset current count and size
 func (qos *AmqpQos) Release() {
 	qos.Lock()
@@ -97,5 +179,7 @@ func (qos *AmqpQos) Copy() *AmqpQos {
 		prefetchSize:  qos.prefetchSize,
 		currentCount:  qos.currentCount,
 		currentSize:   qos.currentSize,
+		creditMode:    qos.creditMode,
+		credit:        qos.credit,
 	}
 }
@@ -1,6 +1,9 @@
 package qos
 
-import "testing"
+import (
+	"math"
+	"testing"
+)
 
 func TestAmqpQos_IsActive(t *testing.T) {
 	q := NewAmqpQos(1, 10)
@@ -96,6 +99,28 @@ func TestAmqpQos_Release(t *testing.T) {
 	}
 }
 
+func TestAmqpQos_FreeCount(t *testing.T) {
+	q := NewAmqpQos(5, 0)
+	q.Inc(2, 0)
+
+	if free, prefetch := q.FreeCount(); free != 3 || prefetch != 5 {
+		t.Fatalf("Expected free %d of %d, actual %d of %d", 3, 5, free, prefetch)
+	}
+
+	q.Update(1, 0)
+	if free, prefetch := q.FreeCount(); free != 0 || prefetch != 1 {
+		t.Fatalf("Expected free %d of %d, actual %d of %d", 0, 1, free, prefetch)
+	}
+
+	if _, prefetch := NewAmqpQos(0, 10).FreeCount(); prefetch != 0 {
+		t.Fatal("Expected unlimited count")
+	}
+
+	if _, prefetch := NewCreditQos(10).FreeCount(); prefetch != 0 {
+		t.Fatal("Expected unlimited count in credit mode")
+	}
+}
+
 func TestAmqpQos_Copy(t *testing.T) {
 	q := NewAmqpQos(5, 10)
 	q.Inc(1, 6)
@@ -111,3 +136,38 @@ func TestAmqpQos_Copy(t *testing.T) {
 		t.Fatalf("Expected currentSize %d, actual %d", 0, q.currentCount)
 	}
 }
+
+func TestAmqpQos_Credit(t *testing.T) {
+	q := NewCreditQos(0)
+	if !q.IsActive() || !q.IsCredit() {
+		t.Fatalf("Expected active credit qos")
+	}
+
+	delivered := 0
+	for _, grant := range []uint32{1, 3, 2} {
+		if !q.Grant(grant) {
+			t.Fatalf("Grant: Expected successful grant")
+		}
+		for q.Inc(1, 100) {
+			delivered++
+			// acks do not return credit
+			q.Dec(1, 100)
+		}
+		if q.Credit() != 0 {
+			t.Fatalf("Credit: Expected %d, actual %d", 0, q.Credit())
+		}
+	}
+	if delivered != 6 {
+		t.Fatalf("Inc: Expected %d deliveries, actual %d", 6, delivered)
+	}
+
+	q.Grant(math.MaxUint32)
+	q.Grant(1)
+	if q.Credit() != math.MaxUint32 {
+		t.Fatalf("Grant: Expected saturated credit, actual %d", q.Credit())
+	}
+
+	if NewAmqpQos(1, 0).Grant(1) {
+		t.Fatalf("Grant: Expected failed grant on prefetch qos")
+	}
+}
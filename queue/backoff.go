@@ -0,0 +1,107 @@
+package queue
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// Requeue backoff
+// x-requeue-backoff (milliseconds) delays requeued messages, so failing consumer does not get the same message
+// in a hot loop. Delay grows exponentially by delivery count: x-requeue-backoff * 2^(delivery count - 1),
+// it is limited by x-requeue-backoff-max which is one minute by default.
+// Delayed message is held aside and returned to its position in queue when delay is passed, it is counted
+// in queue length, but is not delivered, peeked or snapshotted meanwhile. Purge, delete and stop drop held messages,
+// persistent ones are kept in storage by durable queue and loaded on next start.
+const (
+	RequeueBackoffArg    = "x-requeue-backoff"
+	RequeueBackoffMaxArg = "x-requeue-backoff-max"
+)
+
+// defaultRequeueBackoffMax is max delay in milliseconds of queue without x-requeue-backoff-max
+const defaultRequeueBackoffMax int64 = 60000
+
+// parseRequeueBackoff returns base and max delay of requeued messages, zero base means no backoff
+func parseRequeueBackoff(arguments *amqp.Table, queueName string) (base time.Duration, max time.Duration, err error) {
+	baseMs, maxMs := int64(0), defaultRequeueBackoffMax
+	for name, value := range map[string]*int64{RequeueBackoffArg: &baseMs, RequeueBackoffMaxArg: &maxMs} {
+		if _, ok := (*arguments)[name]; !ok {
+			continue
+		}
+		parsed, ok := arguments.Int64(name)
+		if !ok || parsed < 0 {
+			return 0, 0, fmt.Errorf("invalid arg '%s' for queue '%s': expected non-negative integer", name, queueName)
+		}
+		// zero max is the default one
+		if parsed > 0 || name == RequeueBackoffArg {
+			*value = parsed
+		}
+	}
+	return time.Duration(baseMs) * time.Millisecond, time.Duration(maxMs) * time.Millisecond, nil
+}
+
+// requeueDelay returns delay of message requeued with given delivery count, must be called under actLock
+func (queue *Queue) requeueDelay(deliveryCount uint32) time.Duration {
+	if queue.requeueBackoff == 0 || deliveryCount == 0 {
+		return 0
+	}
+	delay := queue.requeueBackoff
+	for i := uint32(1); i < deliveryCount && delay < queue.requeueBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > queue.requeueBackoffMax {
+		delay = queue.requeueBackoffMax
+	}
+	return delay
+}
+
+// holdRequeued holds message aside until its delay is passed, must be called under actLock
+func (queue *Queue) holdRequeued(message *amqp.Message, delay time.Duration) {
+	queue.backoffLock.Lock()
+	defer queue.backoffLock.Unlock()
+	if queue.backoffHeld == nil {
+		queue.backoffHeld = make(map[*amqp.Message]*time.Timer)
+	}
+	queue.backoffHeld[message] = time.AfterFunc(delay, func() {
+		queue.releaseRequeued(message)
+	})
+}
+
+// releaseRequeued returns held message into queue, message dropped by purge meanwhile is not returned
+func (queue *Queue) releaseRequeued(message *amqp.Message) {
+	queue.actLock.RLock()
+	if !queue.active {
+		queue.actLock.RUnlock()
+		return
+	}
+	queue.backoffLock.Lock()
+	_, ok := queue.backoffHeld[message]
+	delete(queue.backoffHeld, message)
+	queue.backoffLock.Unlock()
+	if ok {
+		queue.SafeQueue.PushOrdered(message)
+	}
+	queue.actLock.RUnlock()
+
+	if ok {
+		queue.callConsumers()
+	}
+}
+
+// heldCount returns count of messages held by backoff
+func (queue *Queue) heldCount() int {
+	queue.backoffLock.Lock()
+	defer queue.backoffLock.Unlock()
+	return len(queue.backoffHeld)
+}
+
+// purgeBackoff drops held messages, must be called under actLock
+func (queue *Queue) purgeBackoff() {
+	queue.backoffLock.Lock()
+	defer queue.backoffLock.Unlock()
+	for _, timer := range queue.backoffHeld {
+		timer.Stop()
+	}
+	queue.backoffHeld = nil
+}
@@ -0,0 +1,32 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+func TestQueue_RequeueDelay(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	if err := queue.SetArguments(&amqp.Table{RequeueBackoffArg: int32(100), RequeueBackoffMaxArg: int32(500)}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []time.Duration{0, 100, 200, 400, 500, 500}
+	for count, delay := range expected {
+		if actual := queue.requeueDelay(uint32(count)); actual != delay*time.Millisecond {
+			t.Fatalf("Expected delay %v of delivery count %d, actual %v", delay*time.Millisecond, count, actual)
+		}
+	}
+
+	if err := queue.SetArguments(&amqp.Table{RequeueBackoffArg: int32(100)}); err != nil || queue.requeueBackoffMax != time.Minute {
+		t.Fatalf("Expected default max delay, actual %v, %v", queue.requeueBackoffMax, err)
+	}
+	if err := queue.SetArguments(&amqp.Table{}); err != nil || queue.requeueDelay(1) != 0 {
+		t.Fatal("Expected no delay without argument", err)
+	}
+	if err := queue.SetArguments(&amqp.Table{RequeueBackoffArg: int32(-1)}); err == nil {
+		t.Fatal("Expected error on negative backoff")
+	}
+}
@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"sync/atomic"
+)
+
+// EventType is kind of queue state change
+type EventType int
+
+const (
+	// EventLength is sent when queue length changed
+	EventLength EventType = iota + 1
+	// EventConsumers is sent when queue consumers count changed
+	EventConsumers
+)
+
+// Event represents queue state after change
+type Event struct {
+	Queue          string
+	Type           EventType
+	Length         uint64
+	ConsumersCount int
+}
+
+// AddListener registers channel to receive queue length and consumers count changes
+// Events are sent without blocking, so listener with full channel misses them
+func (queue *Queue) AddListener(listener chan<- Event) {
+	queue.listenersLock.Lock()
+	defer queue.listenersLock.Unlock()
+	queue.listeners = append(queue.listeners, listener)
+}
+
+// RemoveListener unregisters listener channel
+func (queue *Queue) RemoveListener(listener chan<- Event) {
+	queue.listenersLock.Lock()
+	defer queue.listenersLock.Unlock()
+	for i, l := range queue.listeners {
+		if l == listener {
+			queue.listeners = append(queue.listeners[:i], queue.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+func (queue *Queue) notify(eventType EventType) {
+	queue.listenersLock.RLock()
+	defer queue.listenersLock.RUnlock()
+	if len(queue.listeners) == 0 {
+		return
+	}
+
+	event := Event{
+		Queue:          queue.name,
+		Type:           eventType,
+		Length:         queue.Length(),
+		ConsumersCount: int(atomic.LoadInt32(&queue.consumersCount)),
+	}
+	for _, listener := range queue.listeners {
+		select {
+		case listener <- event:
+		default:
+		}
+	}
+}
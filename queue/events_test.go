@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+func expectEvent(t *testing.T, events chan Event, expected Event) {
+	select {
+	case event := <-events:
+		if event != expected {
+			t.Fatalf("Expected event %+v, actual %+v", expected, event)
+		}
+	default:
+		t.Fatalf("Expected event %+v", expected)
+	}
+}
+
+func TestQueue_Listener(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+
+	events := make(chan Event, 10)
+	queue.AddListener(events)
+
+	queue.Push(&amqp.Message{ID: 1})
+	expectEvent(t, events, Event{Queue: "test", Type: EventLength, Length: 1, ConsumersCount: 0})
+
+	queue.AddConsumer(&ConsumerMock{tag: "test"}, false)
+	expectEvent(t, events, Event{Queue: "test", Type: EventConsumers, Length: 1, ConsumersCount: 1})
+
+	queue.Pop()
+	expectEvent(t, events, Event{Queue: "test", Type: EventLength, Length: 0, ConsumersCount: 1})
+
+	// nothing to pop, no event expected
+	queue.Pop()
+
+	queue.RemoveConsumer("test")
+	expectEvent(t, events, Event{Queue: "test", Type: EventConsumers, Length: 0, ConsumersCount: 0})
+
+	queue.RemoveListener(events)
+	queue.Push(&amqp.Message{ID: 2})
+	if len(events) != 0 {
+		t.Fatalf("Expected no events after remove listener, actual %d", len(events))
+	}
+}
+
+func TestQueue_Listener_NonBlocking(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+
+	events := make(chan Event, 1)
+	queue.AddListener(events)
+
+	queue.Push(&amqp.Message{ID: 1})
+	queue.Push(&amqp.Message{ID: 2})
+	if queue.Length() != 2 {
+		t.Fatalf("Expected %d elements, have %d", 2, queue.Length())
+	}
+	expectEvent(t, events, Event{Queue: "test", Type: EventLength, Length: 1, ConsumersCount: 0})
+}
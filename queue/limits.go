@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// Message TTL and max length
+// x-message-ttl (milliseconds) sets deadline of messages pushed into queue by amqp.DeadlineHeader, so message
+// older than TTL is dropped when it reaches queue head, earlier deadline set by publisher is kept.
+// x-max-length limits count of ready messages and x-max-length-bytes limits their total body size, the oldest ones
+// are dropped from head by push over the limits until both of them are satisfied, so one large message can drop
+// several small ones. Stream queues keep their log by retention arguments and ignore x-message-ttl and x-max-length.
+// Operator limits bound arguments: greater value is clamped to the limit and queue without argument
+// gets the limit as default, so clients can't exceed them. Effective arguments contain clamped values.
+const (
+	MessageTTLArg = "x-message-ttl"
+	MaxLengthArg  = "x-max-length"
+)
+
+// unlimited is value of x-message-ttl, x-max-length and x-max-length-bytes which are not set
+const unlimited int64 = -1
+
+// Limits are operator ceilings of x-message-ttl and x-max-length, zero means no limit
+type Limits struct {
+	MessageTTL int64
+	MaxLength  int64
+}
+
+// SetLimits sets ceilings of arguments, they are applied by next SetArguments or SetPolicy
+func (queue *Queue) SetLimits(limits Limits) {
+	queue.actLock.Lock()
+	defer queue.actLock.Unlock()
+	queue.limits = limits
+}
+
+// limitArgument returns non-negative integer argument clamped by limit, unlimited if argument is not set
+// Clamped value is set into copy of arguments, so given ones are not modified
+func limitArgument(arguments *amqp.Table, name string, limit int64, queueName string) (*amqp.Table, int64, error) {
+	value := unlimited
+	if _, ok := (*arguments)[name]; ok {
+		if value, ok = arguments.Int64(name); !ok || value < 0 {
+			return nil, 0, fmt.Errorf("invalid arg '%s' for queue '%s': expected non-negative integer", name, queueName)
+		}
+	}
+	if limit <= 0 || (value != unlimited && value <= limit) {
+		return arguments, value, nil
+	}
+
+	limited := make(amqp.Table, len(*arguments)+1)
+	for key, argument := range *arguments {
+		limited[key] = argument
+	}
+	limited[name] = limit
+	return &limited, limit, nil
+}
+
+// withTTL returns copy of message with deadline by TTL, message itself is shared between queues
+// Message is returned as is if its deadline is earlier
+func withTTL(message *amqp.Message, ttl int64, now time.Time) *amqp.Message {
+	deadline := now.UnixNano()/int64(time.Millisecond) + ttl
+	if message.Header != nil && message.Header.PropertyList != nil && message.Header.PropertyList.Headers != nil {
+		if current, ok := message.Header.PropertyList.Headers.Int64(amqp.DeadlineHeader); ok && current <= deadline {
+			return message
+		}
+	}
+
+	limited := message.Copy()
+	if limited.Header == nil {
+		limited.Header = &amqp.ContentHeader{}
+	}
+	if limited.Header.PropertyList == nil {
+		limited.Header.PropertyList = &amqp.BasicPropertyList{}
+	}
+	if limited.Header.PropertyList.Headers == nil {
+		limited.Header.PropertyList.Headers = &amqp.Table{}
+	}
+	(*limited.Header.PropertyList.Headers)[amqp.DeadlineHeader] = deadline
+	return limited
+}
+
+// overLength returns is queue longer than x-max-length or larger than x-max-length-bytes
+func (queue *Queue) overLength() bool {
+	if queue.maxLength != unlimited && atomic.LoadInt64(&queue.queueLength) > queue.maxLength {
+		return true
+	}
+	return queue.maxLengthBytes != unlimited && atomic.LoadInt64(&queue.queueBytes) > queue.maxLengthBytes
+}
+
+// dropOverLength drops messages from queue head while queue is over x-max-length or x-max-length-bytes,
+// must be called under actLock
+func (queue *Queue) dropOverLength() {
+	if queue.maxLength == unlimited && queue.maxLengthBytes == unlimited {
+		return
+	}
+
+	var dropped []*amqp.Message
+	queue.SafeQueue.Lock()
+	for queue.overLength() {
+		message := queue.SafeQueue.DirtyPop()
+		if message == nil {
+			break
+		}
+		atomic.AddInt64(&queue.queueLength, -1)
+		atomic.AddInt64(&queue.queueBytes, -int64(message.BodySize))
+		dropped = append(dropped, message)
+	}
+	queue.SafeQueue.Unlock()
+
+	if len(dropped) > 0 {
+		queue.dropExpired(dropped)
+	}
+}
@@ -0,0 +1,135 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+func TestQueue_SetArguments_Limits(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.SetLimits(Limits{MessageTTL: 10000, MaxLength: 100})
+
+	declared := &amqp.Table{MessageTTLArg: int32(60000), MaxLengthArg: int32(10)}
+	if err := queue.SetArguments(declared); err != nil {
+		t.Fatal(err)
+	}
+	if queue.messageTTL != 10000 || (*queue.Arguments())[MessageTTLArg] != int64(10000) {
+		t.Fatalf("Expected x-message-ttl clamped to %d, actual %d", 10000, queue.messageTTL)
+	}
+	if queue.maxLength != 10 || (*queue.Arguments())[MaxLengthArg] != int32(10) {
+		t.Fatalf("Expected x-max-length %d under limit kept, actual %d", 10, queue.maxLength)
+	}
+	if (*declared)[MessageTTLArg] != int32(60000) {
+		t.Fatal("Expected declared arguments not modified")
+	}
+
+	if err := queue.SetArguments(&amqp.Table{}); err != nil || queue.messageTTL != 10000 || queue.maxLength != 100 {
+		t.Fatalf("Expected limits as defaults, actual ttl %d and max length %d", queue.messageTTL, queue.maxLength)
+	}
+	if queue.SetArguments(&amqp.Table{MaxLengthArg: int32(-1)}) == nil {
+		t.Fatal("Expected error on negative x-max-length")
+	}
+
+	unlimitedQueue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	if err := unlimitedQueue.SetArguments(&amqp.Table{}); err != nil || unlimitedQueue.messageTTL != unlimited || unlimitedQueue.maxLength != unlimited {
+		t.Fatal("Expected no ttl and max length without arguments and limits")
+	}
+}
+
+func TestQueue_Push_MaxLength(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.SetArguments(&amqp.Table{MaxLengthArg: int32(3)})
+	queue.Start()
+	for id := uint64(1); id <= 5; id++ {
+		queue.Push(&amqp.Message{ID: id})
+	}
+
+	if queue.Length() != 3 {
+		t.Fatalf("Expected length %d, actual %d", 3, queue.Length())
+	}
+	// the oldest messages are dropped
+	for id := uint64(3); id <= 5; id++ {
+		if message := queue.Pop(); message == nil || message.ID != id {
+			t.Fatalf("Expected message %d, actual %v", id, message)
+		}
+	}
+}
+
+func TestQueue_Push_MaxLengthBytes(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.SetArguments(&amqp.Table{MaxLengthArg: int32(100), MaxLengthBytesArg: int32(250)})
+	queue.Start()
+	for id := uint64(1); id <= 4; id++ {
+		queue.Push(&amqp.Message{ID: id, BodySize: 50})
+	}
+	// large message drops several small ones until bytes fit
+	queue.Push(&amqp.Message{ID: 5, BodySize: 200})
+
+	if queue.Length() != 2 || queue.queueBytes != 250 {
+		t.Fatalf("Expected length %d and %d bytes, actual %d and %d", 2, 250, queue.Length(), queue.queueBytes)
+	}
+	for _, id := range []uint64{4, 5} {
+		if message := queue.Pop(); message == nil || message.ID != id {
+			t.Fatalf("Expected message %d, actual %v", id, message)
+		}
+	}
+	if queue.queueBytes != 0 {
+		t.Fatalf("Expected no bytes in empty queue, actual %d", queue.queueBytes)
+	}
+}
+
+func TestQueue_Push_MaxLengthWithBytes(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.SetArguments(&amqp.Table{MaxLengthArg: int32(2), MaxLengthBytesArg: int32(10000)})
+	queue.Start()
+	for id := uint64(1); id <= 5; id++ {
+		queue.Push(&amqp.Message{ID: id, BodySize: 100})
+	}
+
+	if queue.Length() != 2 || queue.queueBytes != 200 {
+		t.Fatalf("Expected length %d and %d bytes, actual %d and %d", 2, 200, queue.Length(), queue.queueBytes)
+	}
+	message := queue.Pop()
+	if message == nil || message.ID != 4 {
+		t.Fatalf("Expected message %d, actual %v", 4, message)
+	}
+	// requeued message is counted again
+	queue.Requeue(message)
+	if queue.Length() != 2 || queue.queueBytes != 200 {
+		t.Fatalf("Expected length %d and %d bytes after requeue, actual %d and %d", 2, 200, queue.Length(), queue.queueBytes)
+	}
+	if queue.SetArguments(&amqp.Table{MaxLengthBytesArg: "large"}) == nil {
+		t.Fatal("Expected error on invalid x-max-length-bytes")
+	}
+}
+
+func TestQueue_Push_MessageTTL(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.SetArguments(&amqp.Table{MessageTTLArg: int32(50)})
+	queue.Start()
+
+	earlier := time.Now().UnixNano()/int64(time.Millisecond) + 10
+	shared := &amqp.Message{ID: 1}
+	queue.Push(shared)
+	queue.Push(&amqp.Message{ID: 2, Header: &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{
+		Headers: &amqp.Table{amqp.DeadlineHeader: earlier},
+	}}})
+	if shared.Header != nil {
+		t.Fatal("Expected pushed message not modified")
+	}
+
+	peeked := queue.Peek(-1)
+	if deadline, ok := peeked[0].Header.PropertyList.Headers.Int64(amqp.DeadlineHeader); !ok || deadline <= earlier {
+		t.Fatalf("Expected deadline by ttl, actual %d", deadline)
+	}
+	if deadline, _ := peeked[1].Header.PropertyList.Headers.Int64(amqp.DeadlineHeader); deadline != earlier {
+		t.Fatalf("Expected earlier deadline %d kept, actual %d", earlier, deadline)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if message := queue.Pop(); message != nil {
+		t.Fatalf("Expected expired messages dropped, actual %d", message.ID)
+	}
+}
@@ -0,0 +1,10 @@
+package queue
+
+// Consumer cap
+// x-max-consumers limits count of consumers attached to queue, basic.consume over the cap is refused,
+// so misconfigured fan-in is noticed instead of silently sharing messages. Cancelled consumer frees its slot.
+// Lowered cap does not cancel already attached consumers.
+const MaxConsumersArg = "x-max-consumers"
+
+// errMaxConsumers is error template of consumer refused by x-max-consumers
+const errMaxConsumers = "queue '%s' has reached max consumers limit %d"
@@ -0,0 +1,112 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// Overflow of non-durable queue
+// When in-memory length reaches maxMessagesInRAM, next messages are spilled into transient storage
+// and loaded back by chunks when in-memory length falls below half of limit.
+// Spilled messages get own per-queue sequence as storage ID, so they are read back in push order
+// no matter which IDs were generated for them by other queues.
+// Storage writes are asynchronous, so loader does not treat missing sequence as the end of overflow
+// and retries until all spilled messages are loaded.
+
+// overflowSeqBase keeps all sequence numbers of the same length, so storage keys are sorted numerically
+const overflowSeqBase uint64 = 1e18
+
+// overflowRetryInterval is interval to retry load of spilled messages which are not written into storage yet
+const overflowRetryInterval = 20 * time.Millisecond
+
+// pushTransient puts message into memory or spills it into transient storage, must be called under actLock
+func (queue *Queue) pushTransient(message *amqp.Message) {
+	if message.ConfirmMeta != nil {
+		message.ConfirmMeta.ActualConfirms++
+	}
+
+	queue.overflowLock.Lock()
+	defer queue.overflowLock.Unlock()
+
+	if !queue.overflowToDisk || (queue.overflowTail == queue.overflowHead && queue.SafeQueue.Length() < queue.maxMessagesInRAM) {
+		queue.SafeQueue.Push(message)
+		queue.lastMemMsgID = message.ID
+		return
+	}
+
+	// message itself can be shared with other queues, so spilled copy gets own ID as storage key,
+	// original ID is restored on load to keep requeued messages ordered before loaded ones
+	spilled := *message
+	spilled.ID = queue.overflowTail
+	queue.msgTStorage.Add(&spilled, queue.name)
+	queue.overflowIDs = append(queue.overflowIDs, message.ID)
+	queue.overflowTail++
+}
+
+// loadOverflow loads spilled messages back into memory
+// Loader does not take actLock, because Stop waits for loader under it
+func (queue *Queue) loadOverflow() {
+	queue.overflowLock.Lock()
+	defer queue.overflowLock.Unlock()
+
+	if queue.overflowHead == queue.overflowTail {
+		return
+	}
+
+	currentLength := queue.SafeQueue.Length()
+	if currentLength >= queue.maxMessagesInRAM/2 {
+		return
+	}
+
+	needle := queue.maxMessagesInRAM - currentLength
+	if spilled := queue.overflowTail - queue.overflowHead; needle > spilled {
+		needle = spilled
+	}
+
+	var loaded uint64
+	queue.msgTStorage.IterateByQueueFromMsgID(queue.name, queue.overflowHead, needle, func(message *amqp.Message) {
+		// stop on gap, the rest is not written yet
+		if message.ID != queue.overflowHead {
+			return
+		}
+		queue.msgTStorage.Del(message, queue.name)
+		message.ID, queue.overflowIDs = queue.overflowIDs[0], queue.overflowIDs[1:]
+		queue.SafeQueue.Push(message)
+		queue.overflowHead++
+		loaded++
+	})
+
+	if loaded > 0 {
+		queue.callConsumers()
+	}
+
+	if loaded < needle {
+		time.AfterFunc(overflowRetryInterval, queue.retryLoadOverflow)
+	}
+}
+
+// retryLoadOverflow wakes up loader unless queue is stopped
+func (queue *Queue) retryLoadOverflow() {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	if !queue.active {
+		return
+	}
+	select {
+	case queue.maybeLoadFromStorageCh <- struct{}{}:
+	default:
+	}
+}
+
+// purgeOverflow drops spilled messages
+func (queue *Queue) purgeOverflow() {
+	queue.overflowLock.Lock()
+	defer queue.overflowLock.Unlock()
+	if queue.overflowHead == queue.overflowTail {
+		return
+	}
+	queue.msgTStorage.PurgeQueue(queue.name)
+	queue.overflowHead = queue.overflowTail
+	queue.overflowIDs = nil
+}
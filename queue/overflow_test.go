@@ -0,0 +1,334 @@
+package queue
+
+import (
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/config"
+)
+
+// overflowStorageMock keeps messages ordered by ID like real storage does
+type overflowStorageMock struct {
+	sync.Mutex
+	messages map[uint64]*amqp.Message
+	purged   bool
+}
+
+func newOverflowStorageMock() *overflowStorageMock {
+	return &overflowStorageMock{messages: make(map[uint64]*amqp.Message)}
+}
+
+func (storage *overflowStorageMock) Add(message *amqp.Message, queue string) error {
+	storage.Lock()
+	defer storage.Unlock()
+	storage.messages[message.ID] = message
+	return nil
+}
+
+func (storage *overflowStorageMock) Update(message *amqp.Message, queue string) error {
+	return nil
+}
+
+func (storage *overflowStorageMock) Del(message *amqp.Message, queue string) error {
+	storage.Lock()
+	defer storage.Unlock()
+	delete(storage.messages, message.ID)
+	return nil
+}
+
+func (storage *overflowStorageMock) PurgeQueue(queue string) {
+	storage.Lock()
+	defer storage.Unlock()
+	storage.messages = make(map[uint64]*amqp.Message)
+	storage.purged = true
+}
+
+func (storage *overflowStorageMock) GetQueueLength(queue string) uint64 {
+	storage.Lock()
+	defer storage.Unlock()
+	return uint64(len(storage.messages))
+}
+
+func (storage *overflowStorageMock) IterateByQueueFromMsgID(queue string, msgID uint64, limit uint64, fn func(message *amqp.Message)) uint64 {
+	storage.Lock()
+	ids := make([]uint64, 0, len(storage.messages))
+	for id := range storage.messages {
+		if id >= msgID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if uint64(len(ids)) > limit {
+		ids = ids[:limit]
+	}
+	messages := make([]*amqp.Message, 0, len(ids))
+	for _, id := range ids {
+		messages = append(messages, storage.messages[id])
+	}
+	storage.Unlock()
+
+	for _, message := range messages {
+		fn(message)
+	}
+	return uint64(len(messages))
+}
+
+func newOverflowMessage(routingKey string) *amqp.Message {
+	return &amqp.Message{
+		RoutingKey: routingKey,
+		Header: &amqp.ContentHeader{
+			PropertyList: &amqp.BasicPropertyList{},
+		},
+	}
+}
+
+func TestQueue_OverflowToDisk(t *testing.T) {
+	storage := newOverflowStorageMock()
+	cfg := config.Queue{ShardSize: SIZE, MaxMessagesInRAM: 10, OverflowToDisk: true}
+	queue := NewQueue("test", 0, false, false, false, cfg, nil, storage, nil)
+	queue.Start()
+	defer queue.Stop()
+
+	count := 100
+	for i := 0; i < count; i++ {
+		queue.Push(newOverflowMessage(strconv.Itoa(i)))
+	}
+
+	if queue.Length() != uint64(count) {
+		t.Fatalf("Expected length %d, actual %d", count, queue.Length())
+	}
+	if queue.SafeQueue.Length() != cfg.MaxMessagesInRAM {
+		t.Fatalf("Expected %d messages in memory, actual %d", cfg.MaxMessagesInRAM, queue.SafeQueue.Length())
+	}
+	if storage.GetQueueLength("test") != uint64(count)-cfg.MaxMessagesInRAM {
+		t.Fatalf("Expected %d messages on disk, actual %d", uint64(count)-cfg.MaxMessagesInRAM, storage.GetQueueLength("test"))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; i < count; {
+		message := queue.Pop()
+		if message == nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected message %d", i)
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if message.RoutingKey != strconv.Itoa(i) {
+			t.Fatalf("Expected message %d, actual %s", i, message.RoutingKey)
+		}
+		if queue.SafeQueue.Length() > cfg.MaxMessagesInRAM {
+			t.Fatalf("Expected not more than %d messages in memory, actual %d", cfg.MaxMessagesInRAM, queue.SafeQueue.Length())
+		}
+		i++
+	}
+
+	if storage.GetQueueLength("test") != 0 {
+		t.Fatalf("Expected overflow is loaded, %d messages left on disk", storage.GetQueueLength("test"))
+	}
+}
+
+func TestQueue_Stats_MemoryDiskSplit(t *testing.T) {
+	storage := newOverflowStorageMock()
+	cfg := config.Queue{ShardSize: SIZE, MaxMessagesInRAM: 10, OverflowToDisk: true}
+	queue := NewQueue("test", 0, false, false, false, cfg, nil, storage, nil)
+	queue.Start()
+	defer queue.Stop()
+
+	count := 50
+	for i := 0; i < count; i++ {
+		queue.Push(newOverflowMessage(strconv.Itoa(i)))
+	}
+
+	stats := queue.Stats()
+	if stats.InMemory != cfg.MaxMessagesInRAM || stats.OnDiskOnly != uint64(count)-cfg.MaxMessagesInRAM {
+		t.Fatalf("Expected %d messages in memory and %d on disk, actual %d and %d",
+			cfg.MaxMessagesInRAM, uint64(count)-cfg.MaxMessagesInRAM, stats.InMemory, stats.OnDiskOnly)
+	}
+
+	// consuming in-memory messages loads overflow back
+	popped := 0
+	deadline := time.Now().Add(5 * time.Second)
+	for popped < 20 && time.Now().Before(deadline) {
+		if queue.Pop() == nil {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		popped++
+	}
+	// loader works asynchronously, so wait for it is done
+	time.Sleep(50 * time.Millisecond)
+	if storage.GetQueueLength("test") == uint64(count)-cfg.MaxMessagesInRAM {
+		t.Fatal("Expected overflow is loaded")
+	}
+
+	stats = queue.Stats()
+	if stats.InMemory+stats.OnDiskOnly != uint64(count-popped) {
+		t.Fatalf("Expected split sums to %d, actual %d+%d", count-popped, stats.InMemory, stats.OnDiskOnly)
+	}
+	if stats.InMemory != queue.SafeQueue.Length() || stats.OnDiskOnly != storage.GetQueueLength("test") {
+		t.Fatalf("Expected %d messages in memory and %d on disk, actual %d and %d",
+			queue.SafeQueue.Length(), storage.GetQueueLength("test"), stats.InMemory, stats.OnDiskOnly)
+	}
+}
+
+func TestQueue_Stats_MemoryDiskSplit_Durable(t *testing.T) {
+	persistent := newOverflowStorageMock()
+	transient := newOverflowStorageMock()
+	cfg := config.Queue{ShardSize: SIZE, MaxMessagesInRAM: 10}
+	queue := NewQueue("test", 0, false, false, true, cfg, persistent, transient, nil)
+	queue.Start()
+	defer queue.Stop()
+
+	var deliveryMode byte = 2
+	count := 30
+	for i := 0; i < count; i++ {
+		message := newOverflowMessage(strconv.Itoa(i))
+		message.ID = uint64(i + 1)
+		message.Header.PropertyList.DeliveryMode = &deliveryMode
+		queue.Push(message)
+	}
+
+	// persistent messages resident in memory are stored too, but they are not counted as disk only
+	stats := queue.Stats()
+	if stats.InMemory != queue.SafeQueue.Length() || stats.InMemory+stats.OnDiskOnly != uint64(count) || stats.OnDiskOnly == 0 {
+		t.Fatalf("Expected messages over %d kept on disk only, actual %d in memory and %d on disk",
+			cfg.MaxMessagesInRAM, stats.InMemory, stats.OnDiskOnly)
+	}
+}
+
+func TestQueue_OverflowToDisk_Purge(t *testing.T) {
+	storage := newOverflowStorageMock()
+	cfg := config.Queue{ShardSize: SIZE, MaxMessagesInRAM: 10, OverflowToDisk: true}
+	queue := NewQueue("test", 0, false, false, false, cfg, nil, storage, nil)
+	queue.Start()
+	defer queue.Stop()
+
+	for i := 0; i < 30; i++ {
+		queue.Push(newOverflowMessage(strconv.Itoa(i)))
+	}
+
+	if length := queue.Purge(); length != 30 {
+		t.Fatalf("Expected purged 30, actual %d", length)
+	}
+	if !storage.purged || storage.GetQueueLength("test") != 0 {
+		t.Fatal("Expected overflow is purged")
+	}
+
+	queue.Push(newOverflowMessage("next"))
+	if message := queue.Pop(); message == nil || message.RoutingKey != "next" {
+		t.Fatal("Expected message pushed after purge is kept in memory")
+	}
+}
+
+// requeued message is older than messages loaded back from overflow, so it is delivered first
+func TestQueue_OverflowToDisk_RequeueBeforeLoaded(t *testing.T) {
+	storage := newOverflowStorageMock()
+	cfg := config.Queue{ShardSize: SIZE, MaxMessagesInRAM: 10, OverflowToDisk: true}
+	queue := NewQueue("test", 0, false, false, false, cfg, nil, storage, nil)
+	queue.Start()
+	defer queue.Stop()
+
+	// IDs are generated from unix nano time, so they are greater than overflow storage keys
+	baseID := uint64(time.Now().UnixNano())
+	count := 30
+	for i := 0; i < count; i++ {
+		message := newOverflowMessage(strconv.Itoa(i))
+		message.ID = baseID + uint64(i)
+		queue.Push(message)
+	}
+
+	requeued := queue.Pop()
+	popped := 1
+	// pop until loader moves spilled messages into memory
+	deadline := time.Now().Add(5 * time.Second)
+	for storage.GetQueueLength("test") == uint64(count)-cfg.MaxMessagesInRAM {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected overflow is loaded")
+		}
+		if queue.SafeQueue.Length() > cfg.MaxMessagesInRAM/2-1 {
+			queue.Pop()
+			popped++
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	queue.Requeue(requeued)
+
+	expected := []int{0}
+	for i := popped; i < count; i++ {
+		expected = append(expected, i)
+	}
+	for _, i := range expected {
+		var message *amqp.Message
+		for message = queue.Pop(); message == nil; message = queue.Pop() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected message %d", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if message.RoutingKey != strconv.Itoa(i) {
+			t.Fatalf("Expected message %d, actual %s", i, message.RoutingKey)
+		}
+		if message.ID != baseID+uint64(i) {
+			t.Fatalf("Expected original ID %d, actual %d", baseID+uint64(i), message.ID)
+		}
+	}
+}
+
+func TestQueue_OverflowToDisk_Disabled(t *testing.T) {
+	storage := newOverflowStorageMock()
+	cfg := config.Queue{ShardSize: SIZE, MaxMessagesInRAM: 10}
+	queue := NewQueue("test", 0, false, false, false, cfg, nil, storage, nil)
+	queue.Start()
+	defer queue.Stop()
+
+	for i := 0; i < 30; i++ {
+		queue.Push(newOverflowMessage(strconv.Itoa(i)))
+	}
+
+	if queue.SafeQueue.Length() != 30 || storage.GetQueueLength("test") != 0 {
+		t.Fatal("Expected all messages in memory")
+	}
+}
+
+// heap in use after pushing b.N messages with 4Kb body is bounded by maxMessagesInRAM with overflow enabled
+func benchmarkQueuePushMemory(b *testing.B, overflowToDisk bool) {
+	storage := newOverflowStorageMock()
+	cfg := config.Queue{ShardSize: SIZE, MaxMessagesInRAM: 1000, OverflowToDisk: overflowToDisk}
+	queue := NewQueue("test", 0, false, false, false, cfg, nil, storage, nil)
+	queue.Start()
+	defer queue.Stop()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		message := newOverflowMessage("")
+		message.Append(&amqp.Frame{Type: byte(amqp.FrameBody), Payload: make([]byte, 4<<10)})
+		queue.Push(message)
+	}
+	b.StopTimer()
+
+	// mock storage keeps spilled messages in memory too, so they are dropped before measure
+	storage.PurgeQueue("test")
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.Logf("messages: %d, in memory: %d, heap in use: %d Kb", b.N, queue.SafeQueue.Length(), (int64(after.HeapInuse)-int64(before.HeapInuse))>>10)
+}
+
+func Benchmark_Queue_Push_OverflowToDisk(b *testing.B) {
+	benchmarkQueuePushMemory(b, true)
+}
+
+func Benchmark_Queue_Push_InMemory(b *testing.B) {
+	benchmarkQueuePushMemory(b, false)
+}
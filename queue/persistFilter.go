@@ -0,0 +1,47 @@
+package queue
+
+import (
+	"fmt"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/filter"
+)
+
+// Selective persistence
+// Durable queue declared with x-persist-filter expression stores into persistent storage only persistent messages
+// matching it, other ones are kept in memory like transient messages, so low-value messages cost no disk writes.
+// Expression has the same language as x-filter of bindings, see filter.Expression.
+// Messages which are not stored are lost on crash or restart and are confirmed to publisher on push.
+const PersistFilterArg = "x-persist-filter"
+
+// parsePersistFilter returns compiled x-persist-filter expression, nil means all persistent messages are stored
+func parsePersistFilter(arguments *amqp.Table, queueName string) (*filter.Expression, error) {
+	value, ok := (*arguments)[PersistFilterArg]
+	if !ok {
+		return nil, nil
+	}
+	source, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid arg '%s' for queue '%s': expected string", PersistFilterArg, queueName)
+	}
+	expr, err := filter.Compile(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid arg '%s' for queue '%s': %s", PersistFilterArg, queueName, err.Error())
+	}
+	return expr, nil
+}
+
+// persists returns is message kept in persistent storage by queue, must be called under actLock
+func (queue *Queue) persists(message *amqp.Message) bool {
+	if !queue.durable || !message.IsPersistent() {
+		return false
+	}
+	return queue.persistFilter == nil || queue.persistFilter.Match(message)
+}
+
+// Persists returns is message pushed into queue kept in persistent storage, so it is confirmed by storage
+func (queue *Queue) Persists(message *amqp.Message) bool {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	return queue.persists(message)
+}
@@ -2,19 +2,48 @@ package queue
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/config"
+	"github.com/valinurovam/garagemq/filter"
 	"github.com/valinurovam/garagemq/interfaces"
 	"github.com/valinurovam/garagemq/metrics"
 	"github.com/valinurovam/garagemq/qos"
 	"github.com/valinurovam/garagemq/safequeue"
 )
 
+// CompressArg is queue argument to store message bodies compressed with gzip
+const CompressArg = "x-compress"
+
+// MasterLocatorArg is RabbitMQ HA placement hint of queue master, it is validated and kept,
+// but has no effect on single node
+const MasterLocatorArg = "x-queue-master-locator"
+
+// masterLocators are allowed values of MasterLocatorArg
+var masterLocators = map[string]bool{
+	"min-masters":  true,
+	"client-local": true,
+	"random":       true,
+}
+
+// CompressThresholdArg is queue argument with min body size in bytes to compress message body transparently,
+// such bodies are restored before delivery, zero disables compression set by queue.compressThreshold config
+const CompressThresholdArg = "x-compress-threshold"
+
+// ShutdownSnapshotArg is queue argument to snapshot messages of non-durable queue into storage on graceful
+// shutdown and restore them on startup, durable queues ignore it
+const ShutdownSnapshotArg = "x-shutdown-snapshot"
+
+// compressMinBodySize is min body size to compress message in compressed queue
+const compressMinBodySize = 1024
+
 // MetricsState represents current metrics states for queue
 type MetricsState struct {
 	Ready    *metrics.TrackCounter
@@ -48,6 +77,37 @@ type Queue struct {
 	shardSize   int
 	actLock     sync.RWMutex
 	active      bool
+	paused      bool
+	arguments   *amqp.Table
+	compress    bool
+	// publishes are refused while queue is retired, see SetPublishPaused
+	publishPaused bool
+	// min body size of transparent compression, zero means disabled,
+	// threshold of config is used by queues without x-compress-threshold argument
+	compressThreshold uint64
+	defaultThreshold  uint64
+	// master placement hint, see MasterLocatorArg
+	masterLocator string
+	// messages of non-durable queue are kept across graceful restart, see ShutdownSnapshotArg
+	shutdownSnapshot bool
+	// x-message-ttl and x-max-length clamped by limits, see limits.go
+	messageTTL int64
+	maxLength  int64
+	limits     Limits
+	// x-max-length-bytes of classic queue, see limits.go
+	maxLengthBytes int64
+	// only matching persistent messages are stored by durable queue, see persistFilter.go
+	persistFilter *filter.Expression
+	// x-max-consumers, see maxConsumers.go
+	maxConsumers int64
+	// classic, quorum or stream, see queueType.go
+	queueType string
+	// log of stream queue, nil for classic queue, see stream.go
+	stream *streamLog
+	// arguments from queue.declare, effective arguments are merged with policy definition
+	declaredArguments *amqp.Table
+	policy            string
+	policyDefinition  amqp.Table
 	// persistent storage
 	msgPStorage interfaces.MsgStorage
 	// transient storage
@@ -56,6 +116,11 @@ type Queue struct {
 	metrics         *MetricsState
 	autoDeleteQueue chan string
 	queueLength     int64
+	queueBytes      int64
+	consumersCount  int32
+	listenersLock   sync.RWMutex
+	listeners       []chan<- Event
+	bodySizes       bodySizeHistogram
 
 	// lock for sync load swapped-messages from disk
 	loadSwapLock           sync.Mutex
@@ -65,6 +130,19 @@ type Queue struct {
 	swappedToDisk          bool
 	maybeLoadFromStorageCh chan struct{}
 	wg                     *sync.WaitGroup
+
+	// overflow of non-durable queue, see overflow.go
+	overflowToDisk bool
+	overflowLock   sync.Mutex
+	overflowHead   uint64
+	overflowTail   uint64
+	overflowIDs    []uint64
+
+	// delay of requeued messages, see backoff.go
+	requeueBackoff    time.Duration
+	requeueBackoffMax time.Duration
+	backoffLock       sync.Mutex
+	backoffHeld       map[*amqp.Message]*time.Timer
 }
 
 // NewQueue returns new instance of Queue
@@ -88,6 +166,16 @@ func NewQueue(name string, connID uint64, exclusive bool, autoDelete bool, durab
 		autoDeleteQueue:        autoDeleteQueue,
 		swappedToDisk:          false,
 		wg:                     &sync.WaitGroup{},
+		overflowToDisk:         config.OverflowToDisk,
+		queueType:              QueueTypeClassic,
+		messageTTL:             unlimited,
+		maxLength:              unlimited,
+		maxLengthBytes:         unlimited,
+		maxConsumers:           unlimited,
+		compressThreshold:      config.CompressThreshold,
+		defaultThreshold:       config.CompressThreshold,
+		overflowHead:           overflowSeqBase,
+		overflowTail:           overflowSeqBase,
 		metrics: &MetricsState{
 			Ready:    metrics.NewTrackCounter(0, true),
 			Unacked:  metrics.NewTrackCounter(0, true),
@@ -121,21 +209,7 @@ func (queue *Queue) Start() error {
 	go func() {
 		defer queue.wg.Done()
 		for range queue.call {
-			func() {
-				queue.cmrLock.RLock()
-				defer queue.cmrLock.RUnlock()
-				cmrCount := len(queue.consumers)
-				for i := 0; i < cmrCount; i++ {
-					if !queue.active {
-						return
-					}
-					queue.currentConsumer = (queue.currentConsumer + 1) % cmrCount
-					cmr := queue.consumers[queue.currentConsumer]
-					if cmr.Consume() {
-						return
-					}
-				}
-			}()
+			queue.dispatch()
 		}
 	}()
 
@@ -150,6 +224,40 @@ func (queue *Queue) Start() error {
 	return nil
 }
 
+// dispatch calls consumers until one of them takes its turn
+// Least loaded consumers are called first, so consumer which is slow to ack gets fewer messages,
+// consumers with the same count of unacked messages are called in round-robin order
+func (queue *Queue) dispatch() {
+	queue.cmrLock.RLock()
+	defer queue.cmrLock.RUnlock()
+	for _, i := range queue.dispatchOrder() {
+		if !queue.active {
+			return
+		}
+		// every consumer reads stream on its own, so all of them are called
+		if queue.consumers[i].Consume() && queue.stream == nil {
+			queue.currentConsumer = i
+			return
+		}
+	}
+}
+
+// dispatchOrder returns indexes of consumers sorted by count of unacked messages,
+// starting from the one next to current, must be called under cmrLock
+func (queue *Queue) dispatchOrder() []int {
+	cmrCount := len(queue.consumers)
+	order := make([]int, cmrCount)
+	unacked := make([]int64, cmrCount)
+	for i := range order {
+		order[i] = (queue.currentConsumer + 1 + i) % cmrCount
+		unacked[order[i]] = queue.consumers[order[i]].UnackedCount()
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return unacked[order[i]] < unacked[order[j]]
+	})
+	return order
+}
+
 // Stop stops main queue loop
 // After stop no one can send or receive messages from queue
 func (queue *Queue) Stop() error {
@@ -157,12 +265,256 @@ func (queue *Queue) Stop() error {
 	defer queue.actLock.Unlock()
 
 	queue.active = false
+	queue.purgeBackoff()
 	close(queue.maybeLoadFromStorageCh)
 	close(queue.call)
 	queue.wg.Wait()
 	return nil
 }
 
+// Pause suspends delivery from queue
+// Paused queue still accepts messages, but consumers and basic.get receive nothing until Resume
+// Consumers and their unacked messages are kept as is
+func (queue *Queue) Pause() {
+	queue.actLock.Lock()
+	defer queue.actLock.Unlock()
+
+	queue.paused = true
+}
+
+// Resume resumes delivery from paused queue and wakes all consumers
+func (queue *Queue) Resume() {
+	queue.actLock.Lock()
+	if !queue.paused {
+		queue.actLock.Unlock()
+		return
+	}
+	queue.paused = false
+	queue.actLock.Unlock()
+
+	queue.cmrLock.RLock()
+	defer queue.cmrLock.RUnlock()
+	for _, cmr := range queue.consumers {
+		cmr.Consume()
+	}
+}
+
+// IsPaused returns is queue's delivery paused
+func (queue *Queue) IsPaused() bool {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+
+	return queue.paused
+}
+
+// SetPublishPaused makes queue refuse or accept new publishes, delivery of queued messages is not affected
+// Publishes routed into queue with paused publishes are rejected by channel, see Channel publish
+func (queue *Queue) SetPublishPaused(paused bool) {
+	queue.actLock.Lock()
+	defer queue.actLock.Unlock()
+
+	queue.publishPaused = paused
+}
+
+// IsPublishPaused returns is queue refusing new publishes
+func (queue *Queue) IsPublishPaused() bool {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+
+	return queue.publishPaused
+}
+
+// SetArguments sets queue declared arguments and applies known ones merged with policy definition
+func (queue *Queue) SetArguments(arguments *amqp.Table) error {
+	if arguments == nil {
+		arguments = &amqp.Table{}
+	}
+
+	queue.actLock.RLock()
+	definition := queue.policyDefinition
+	queue.actLock.RUnlock()
+
+	if err := queue.applyArguments(mergeArguments(arguments, definition)); err != nil {
+		return err
+	}
+
+	queue.actLock.Lock()
+	queue.declaredArguments = arguments
+	queue.actLock.Unlock()
+	return nil
+}
+
+// SetPolicy applies policy definition as defaults for declared arguments
+// Queue keeps current arguments if definition contains invalid ones
+func (queue *Queue) SetPolicy(name string, definition amqp.Table) error {
+	queue.actLock.RLock()
+	declared := queue.declaredArguments
+	queue.actLock.RUnlock()
+	if declared == nil {
+		declared = &amqp.Table{}
+	}
+
+	if err := queue.applyArguments(mergeArguments(declared, definition)); err != nil {
+		return err
+	}
+
+	queue.actLock.Lock()
+	queue.policy = name
+	queue.policyDefinition = definition
+	queue.actLock.Unlock()
+	return nil
+}
+
+// Policy returns name of applied policy or empty string
+func (queue *Queue) Policy() string {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	return queue.policy
+}
+
+// MasterLocator returns master placement hint or empty string
+func (queue *Queue) MasterLocator() string {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	return queue.masterLocator
+}
+
+func (queue *Queue) applyArguments(arguments *amqp.Table) error {
+	compress := false
+	if value, ok := (*arguments)[CompressArg]; ok {
+		if compress, ok = value.(bool); !ok {
+			return fmt.Errorf("invalid arg '%s' for queue '%s': expected bool", CompressArg, queue.name)
+		}
+	}
+
+	compressThreshold := queue.defaultThreshold
+	if _, ok := (*arguments)[CompressThresholdArg]; ok {
+		threshold, ok := arguments.Int64(CompressThresholdArg)
+		if !ok || threshold < 0 {
+			return fmt.Errorf("invalid arg '%s' for queue '%s': expected non-negative integer", CompressThresholdArg, queue.name)
+		}
+		compressThreshold = uint64(threshold)
+	}
+
+	masterLocator := ""
+	if value, ok := (*arguments)[MasterLocatorArg]; ok {
+		if masterLocator, ok = value.(string); !ok || !masterLocators[masterLocator] {
+			return fmt.Errorf("invalid arg '%s' for queue '%s': expected min-masters, client-local or random", MasterLocatorArg, queue.name)
+		}
+	}
+
+	shutdownSnapshot := false
+	if value, ok := (*arguments)[ShutdownSnapshotArg]; ok {
+		if shutdownSnapshot, ok = value.(bool); !ok {
+			return fmt.Errorf("invalid arg '%s' for queue '%s': expected bool", ShutdownSnapshotArg, queue.name)
+		}
+	}
+
+	queue.actLock.RLock()
+	limits := queue.limits
+	queue.actLock.RUnlock()
+	arguments, messageTTL, err := limitArgument(arguments, MessageTTLArg, limits.MessageTTL, queue.name)
+	if err != nil {
+		return err
+	}
+	arguments, maxLength, err := limitArgument(arguments, MaxLengthArg, limits.MaxLength, queue.name)
+	if err != nil {
+		return err
+	}
+	arguments, maxLengthBytes, err := limitArgument(arguments, MaxLengthBytesArg, 0, queue.name)
+	if err != nil {
+		return err
+	}
+	arguments, maxConsumers, err := limitArgument(arguments, MaxConsumersArg, 0, queue.name)
+	if err != nil {
+		return err
+	}
+
+	queueType, err := queue.parseQueueType(arguments)
+	if err != nil {
+		return err
+	}
+	stream, err := parseStreamArguments(arguments, queueType, queue.name)
+	if err != nil {
+		return err
+	}
+	requeueBackoff, requeueBackoffMax, err := parseRequeueBackoff(arguments, queue.name)
+	if err != nil {
+		return err
+	}
+	persistFilter, err := parsePersistFilter(arguments, queue.name)
+	if err != nil {
+		return err
+	}
+
+	queue.actLock.Lock()
+	defer queue.actLock.Unlock()
+	// messages of started queue are already kept in its log or in its queue
+	if queue.active && queueType != queue.queueType {
+		return fmt.Errorf("arg '%s' of queue '%s' can not be changed", QueueTypeArg, queue.name)
+	}
+	queue.arguments = arguments
+	queue.compress = compress
+	queue.compressThreshold = compressThreshold
+	queue.masterLocator = masterLocator
+	queue.shutdownSnapshot = shutdownSnapshot
+	queue.messageTTL = messageTTL
+	queue.maxLength = maxLength
+	queue.maxLengthBytes = maxLengthBytes
+	queue.requeueBackoff = requeueBackoff
+	queue.requeueBackoffMax = requeueBackoffMax
+	queue.persistFilter = persistFilter
+	queue.maxConsumers = maxConsumers
+	if !queue.active {
+		queue.queueType = queueType
+		queue.stream = stream
+	} else if stream != nil {
+		queue.stream.lock.Lock()
+		queue.stream.maxAge, queue.stream.maxBytes = stream.maxAge, stream.maxBytes
+		queue.stream.lock.Unlock()
+	}
+	return nil
+}
+
+// mergeArguments returns declared arguments with defaults from policy definition
+func mergeArguments(declared *amqp.Table, definition amqp.Table) *amqp.Table {
+	if len(definition) == 0 {
+		return declared
+	}
+	merged := amqp.Table{}
+	for key, value := range definition {
+		merged[key] = value
+	}
+	for key, value := range *declared {
+		merged[key] = value
+	}
+	return &merged
+}
+
+// IsShutdownSnapshot returns is non-durable queue snapshotted on graceful shutdown
+func (queue *Queue) IsShutdownSnapshot() bool {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	return queue.shutdownSnapshot && !queue.durable
+}
+
+// Arguments returns queue effective arguments, declared ones merged with policy definition
+func (queue *Queue) Arguments() *amqp.Table {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	return queue.arguments
+}
+
+// DeclaredArguments returns queue arguments from queue.declare without policy definition
+func (queue *Queue) DeclaredArguments() *amqp.Table {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	if queue.declaredArguments == nil {
+		return &amqp.Table{}
+	}
+	return queue.declaredArguments
+}
+
 // GetName returns queue name
 func (queue *Queue) GetName() string {
 	return queue.name
@@ -187,9 +539,36 @@ func (queue *Queue) Push(message *amqp.Message) {
 	queue.metrics.Ready.Counter.Inc(1)
 
 	message.GenerateSeq()
+	queue.bodySizes.add(message.BodySize)
+
+	if queue.compress && message.BodySize >= compressMinBodySize {
+		message = queue.compressMessage(message, false)
+	} else if queue.compressThreshold > 0 && message.BodySize >= queue.compressThreshold {
+		message = queue.compressMessage(message, true)
+	}
+
+	if queue.stream != nil {
+		queue.pushStream(message)
+		return
+	}
+
+	if queue.messageTTL != unlimited {
+		message = withTTL(message, queue.messageTTL, time.Now())
+	}
+	// size of message kept by queue, compressed one is counted by compressed body
+	atomic.AddInt64(&queue.queueBytes, int64(message.BodySize))
+
+	if !queue.durable {
+		queue.pushTransient(message)
+		queue.dropOverLength()
+		queue.metrics.Incoming.Counter.Inc(1)
+		queue.notify(EventLength)
+		queue.callConsumers()
+		return
+	}
 
 	persisted := false
-	if queue.durable && message.IsPersistent() {
+	if queue.persists(message) {
 		queue.msgPStorage.Add(message, queue.name)
 		persisted = true
 	} else {
@@ -214,10 +593,34 @@ func (queue *Queue) Push(message *amqp.Message) {
 		queue.SafeQueue.Push(message)
 		queue.lastMemMsgID = message.ID
 	}
+	queue.dropOverLength()
 
+	queue.notify(EventLength)
 	queue.callConsumers()
 }
 
+// compressMessage returns copy of message with compressed body, message itself is shared between queues
+// Compressed body is split into frames not larger than original ones, transparently compressed body
+// is restored before delivery
+func (queue *Queue) compressMessage(message *amqp.Message, transparent bool) *amqp.Message {
+	frameSize := 0
+	for _, frame := range message.Body {
+		if len(frame.Payload) > frameSize {
+			frameSize = len(frame.Payload)
+		}
+	}
+
+	compress := message.Gzipped
+	if transparent {
+		compress = message.BrokerGzipped
+	}
+	compressed, err := compress(frameSize)
+	if err != nil {
+		return message
+	}
+	return compressed
+}
+
 // Pop returns message from queue head without QOS check
 func (queue *Queue) Pop() *amqp.Message {
 	return queue.PopQos([]*qos.AmqpQos{})
@@ -226,7 +629,7 @@ func (queue *Queue) Pop() *amqp.Message {
 // PopQos returns message from queue head with QOS check
 func (queue *Queue) PopQos(qosList []*qos.AmqpQos) *amqp.Message {
 	queue.actLock.RLock()
-	if !queue.active {
+	if !queue.active || queue.paused {
 		queue.actLock.RUnlock()
 		return nil
 	}
@@ -238,15 +641,31 @@ func (queue *Queue) PopQos(qosList []*qos.AmqpQos) *amqp.Message {
 	}
 
 	queue.SafeQueue.Lock()
-	var message *amqp.Message
-	if message = queue.SafeQueue.HeadItem(); message != nil {
+	// messages with passed deadline are dropped from head instead of delivery
+	var expired []*amqp.Message
+	now := time.Now()
+	message := queue.SafeQueue.HeadItem()
+	for message != nil && message.IsDeadlinePassed(now) {
+		queue.SafeQueue.DirtyPop()
+		atomic.AddInt64(&queue.queueLength, -1)
+		atomic.AddInt64(&queue.queueBytes, -int64(message.BodySize))
+		expired = append(expired, message)
+		message = queue.SafeQueue.HeadItem()
+	}
+	if message != nil {
 		allowed := true
-		for _, q := range qosList {
+		for i, q := range qosList {
 			if !q.IsActive() {
 				continue
 			}
 			if !q.Inc(1, uint32(message.BodySize)) {
 				allowed = false
+				// release already taken qos, otherwise they leak on each refused pop
+				for _, taken := range qosList[:i] {
+					if taken.IsActive() {
+						taken.Dec(1, uint32(message.BodySize))
+					}
+				}
 				break
 			}
 		}
@@ -254,16 +673,44 @@ func (queue *Queue) PopQos(qosList []*qos.AmqpQos) *amqp.Message {
 		if allowed {
 			queue.SafeQueue.DirtyPop()
 			atomic.AddInt64(&queue.queueLength, -1)
+			atomic.AddInt64(&queue.queueBytes, -int64(message.BodySize))
 		} else {
 			message = nil
 		}
 	}
 	queue.SafeQueue.Unlock()
 
+	if len(expired) > 0 {
+		queue.dropExpired(expired)
+	}
+	if message != nil || len(expired) > 0 {
+		queue.notify(EventLength)
+	}
+
 	return message
 }
 
+// dropExpired removes messages with passed deadline or over max length popped from queue head
+func (queue *Queue) dropExpired(messages []*amqp.Message) {
+	for _, message := range messages {
+		if queue.durable && message.IsPersistent() {
+			queue.msgPStorage.Del(message, queue.name)
+		}
+	}
+
+	count := int64(len(messages))
+	queue.metrics.Ready.Counter.Dec(count)
+	queue.metrics.Total.Counter.Dec(count)
+	queue.metrics.ServerReady.Counter.Dec(count)
+	queue.metrics.ServerTotal.Counter.Dec(count)
+}
+
 func (queue *Queue) mayBeLoadFromStorage() {
+	if !queue.durable {
+		queue.loadOverflow()
+		return
+	}
+
 	swappedToPersistent := true
 	swappedToTransient := true
 
@@ -367,8 +814,14 @@ func (queue *Queue) mergeSortedMessageSlices(A, B []*amqp.Message) []*amqp.Messa
 
 // LoadFromMsgStorage loads messages into queue from msgstorage
 func (queue *Queue) LoadFromMsgStorage() {
+	if queue.stream != nil {
+		queue.loadStream()
+		return
+	}
+
 	iterated := queue.msgPStorage.IterateByQueueFromMsgID(queue.name, 0, queue.maxMessagesInRAM, func(message *amqp.Message) {
 		queue.SafeQueue.Push(message)
+		queue.queueBytes += int64(message.BodySize)
 
 		queue.lastStoredMsgID = message.ID
 		queue.lastMemMsgID = message.ID
@@ -380,6 +833,10 @@ func (queue *Queue) LoadFromMsgStorage() {
 
 	if iterated >= queue.maxMessagesInRAM {
 		queue.queueLength = int64(queue.msgPStorage.GetQueueLength(queue.name))
+		// messages left on disk are counted by size too, so x-max-length-bytes is exact after load
+		queue.msgPStorage.IterateByQueueFromMsgID(queue.name, queue.lastStoredMsgID+1, uint64(queue.queueLength)-iterated, func(message *amqp.Message) {
+			queue.queueBytes += int64(message.BodySize)
+		})
 	} else {
 		queue.queueLength = int64(iterated)
 	}
@@ -397,8 +854,18 @@ func (queue *Queue) AckMsg(message *amqp.Message) {
 		queue.actLock.RUnlock()
 		return
 	}
+	stream := queue.stream != nil
 	queue.actLock.RUnlock()
 
+	// stream message is kept in log after ack
+	if stream {
+		queue.metrics.Ack.Counter.Inc(1)
+		queue.metrics.ServerAck.Counter.Inc(1)
+		queue.metrics.Unacked.Counter.Dec(1)
+		queue.metrics.ServerUnacked.Counter.Dec(1)
+		return
+	}
+
 	if queue.durable && message.IsPersistent() {
 		// TODO handle error
 		queue.msgPStorage.Del(message, queue.name)
@@ -414,38 +881,81 @@ func (queue *Queue) AckMsg(message *amqp.Message) {
 	queue.metrics.ServerUnacked.Counter.Dec(1)
 }
 
+// MarkDelivered stores delivered-before marker of persistent message delivered with ack, so message recovered
+// after crash is delivered with redelivered flag. Marker is delivery count of stored copy, message itself can be
+// shared with other queues and is not modified. Requeued message is already stored with its delivery count
+func (queue *Queue) MarkDelivered(message *amqp.Message) {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	if !queue.active || queue.stream != nil || message.DeliveryCount > 0 || !queue.persists(message) {
+		return
+	}
+	marked := *message
+	marked.DeliveryCount = 1
+	// TODO handle error
+	queue.msgPStorage.Update(&marked, queue.name)
+}
+
 // Requeue add message into queue head
 func (queue *Queue) Requeue(message *amqp.Message) {
+	// purge is not allowed to run between length increment and push
 	queue.actLock.RLock()
 	if !queue.active {
 		queue.actLock.RUnlock()
 		return
 	}
-	queue.actLock.RUnlock()
+
+	// stream message is kept in log, consumer does not read it again
+	if queue.stream != nil {
+		queue.actLock.RUnlock()
+		queue.metrics.Unacked.Counter.Dec(1)
+		queue.metrics.ServerUnacked.Counter.Dec(1)
+		return
+	}
+
+	// length is incremented before push, so concurrent pop can't make it negative
+	atomic.AddInt64(&queue.queueLength, 1)
+	atomic.AddInt64(&queue.queueBytes, int64(message.BodySize))
 
 	message.DeliveryCount++
-	queue.SafeQueue.PushHead(message)
-	if queue.durable && message.IsPersistent() {
+	delay := queue.requeueDelay(message.DeliveryCount)
+	if delay > 0 {
+		queue.holdRequeued(message, delay)
+	} else {
+		// requeued message is restored to its original position to limit reordering
+		queue.SafeQueue.PushOrdered(message)
+	}
+	if queue.persists(message) {
 		// TODO handle error
 		queue.msgPStorage.Update(message, queue.name)
 	}
+	queue.actLock.RUnlock()
+
 	queue.metrics.Ready.Counter.Inc(1)
 	queue.metrics.ServerReady.Counter.Inc(1)
 
 	queue.metrics.Unacked.Counter.Dec(1)
 	queue.metrics.ServerUnacked.Counter.Dec(1)
 
-	atomic.AddInt64(&queue.queueLength, 1)
-
+	queue.notify(EventLength)
 	queue.callConsumers()
 }
 
 // Purge clean queue and message storage for durable queues
 func (queue *Queue) Purge() (length uint64) {
+	// push and requeue increment length before message is pushed, so they are not allowed during purge
+	queue.actLock.Lock()
+	defer queue.actLock.Unlock()
+	// overflow loader pushes into SafeQueue under overflowLock, so overflow is purged first
+	queue.purgeOverflow()
+	queue.purgeBackoff()
 	queue.SafeQueue.Lock()
 	defer queue.SafeQueue.Unlock()
 	length = uint64(atomic.LoadInt64(&queue.queueLength))
 	queue.SafeQueue.DirtyPurge()
+	if queue.stream != nil {
+		queue.purgeStream()
+	}
 
 	if queue.durable {
 		queue.msgPStorage.PurgeQueue(queue.name)
@@ -456,11 +966,21 @@ func (queue *Queue) Purge() (length uint64) {
 	queue.metrics.ServerTotal.Counter.Dec(int64(length))
 	queue.metrics.ServerReady.Counter.Dec(int64(length))
 	atomic.StoreInt64(&queue.queueLength, 0)
+	atomic.StoreInt64(&queue.queueBytes, 0)
+	queue.notify(EventLength)
 	return
 }
 
 // Delete cancel consumers and delete its messages from storage
 func (queue *Queue) Delete(ifUnused bool, ifEmpty bool) (uint64, error) {
+	// consumers remove themselves from queue on cancel, so they are cancelled after locks are released
+	var cancelled []interfaces.Consumer
+	defer func() {
+		for _, cmr := range cancelled {
+			cmr.Cancel()
+		}
+	}()
+
 	queue.actLock.Lock()
 	queue.cmrLock.Lock()
 	queue.SafeQueue.Lock()
@@ -474,12 +994,14 @@ func (queue *Queue) Delete(ifUnused bool, ifEmpty bool) (uint64, error) {
 		return 0, errors.New("queue has consumers")
 	}
 
-	if ifEmpty && queue.SafeQueue.DirtyLength() != 0 {
+	if ifEmpty && (queue.SafeQueue.DirtyLength() != 0 || queue.heldCount() != 0) {
 		return 0, errors.New("queue has messages")
 	}
 
-	queue.cancelConsumers()
+	cancelled = append(cancelled, queue.consumers...)
 	length := uint64(atomic.LoadInt64(&queue.queueLength))
+	queue.purgeOverflow()
+	queue.purgeBackoff()
 
 	if queue.durable {
 		queue.msgPStorage.PurgeQueue(queue.name)
@@ -496,6 +1018,11 @@ func (queue *Queue) Delete(ifUnused bool, ifEmpty bool) (uint64, error) {
 
 // AddConsumer add consumer to consumer messages with exclusive check
 func (queue *Queue) AddConsumer(consumer interfaces.Consumer, exclusive bool) error {
+	// actLock is taken before cmrLock by delete, so cap is read first
+	queue.actLock.RLock()
+	maxConsumers := queue.maxConsumers
+	queue.actLock.RUnlock()
+
 	queue.cmrLock.Lock()
 	defer queue.cmrLock.Unlock()
 
@@ -508,16 +1035,46 @@ func (queue *Queue) AddConsumer(consumer interfaces.Consumer, exclusive bool) er
 		return fmt.Errorf("queue is busy by %d consumers", len(queue.consumers))
 	}
 
+	if maxConsumers != unlimited && int64(len(queue.consumers)) >= maxConsumers {
+		return fmt.Errorf(errMaxConsumers, queue.name, maxConsumers)
+	}
+
 	if exclusive {
 		queue.consumeExcl = true
 	}
 
 	queue.consumers = append(queue.consumers, consumer)
+	atomic.StoreInt32(&queue.consumersCount, int32(len(queue.consumers)))
+	queue.notify(EventConsumers)
 
 	queue.callConsumers()
 	return nil
 }
 
+// DrainConsumers drains all queue consumers concurrently, see Consumer.Drain
+// Returns the first drain error, e.g. if context is done before consumers in-flight messages are acked
+func (queue *Queue) DrainConsumers(ctx context.Context) error {
+	queue.cmrLock.RLock()
+	consumers := make([]interfaces.Consumer, len(queue.consumers))
+	copy(consumers, queue.consumers)
+	queue.cmrLock.RUnlock()
+
+	errs := make(chan error, len(consumers))
+	for _, cmr := range consumers {
+		go func(cmr interfaces.Consumer) {
+			errs <- cmr.Drain(ctx)
+		}(cmr)
+	}
+
+	var drainErr error
+	for range consumers {
+		if err := <-errs; err != nil && drainErr == nil {
+			drainErr = err
+		}
+	}
+	return drainErr
+}
+
 // RemoveConsumer remove consumer
 // If it was last consumer and queue is auto-delete - queue will be removed
 func (queue *Queue) RemoveConsumer(cTag string) {
@@ -531,6 +1088,8 @@ func (queue *Queue) RemoveConsumer(cTag string) {
 		}
 	}
 	cmrCount := len(queue.consumers)
+	atomic.StoreInt32(&queue.consumersCount, int32(cmrCount))
+	queue.notify(EventConsumers)
 	if cmrCount == 0 {
 		queue.currentConsumer = 0
 		queue.consumeExcl = false
@@ -554,22 +1113,28 @@ func (queue *Queue) callConsumers() {
 	}
 }
 
-func (queue *Queue) cancelConsumers() {
-	for _, cmr := range queue.consumers {
-		cmr.Cancel()
+// Length returns queue length
+func (queue *Queue) Length() uint64 {
+	// length is never negative, but let's be sure it is not reported as overflowed uint64
+	if length := atomic.LoadInt64(&queue.queueLength); length > 0 {
+		return uint64(length)
 	}
+	return 0
 }
 
-// Length returns queue length
-func (queue *Queue) Length() uint64 {
-	return uint64(atomic.LoadInt64(&queue.queueLength))
+// Peek returns up to count messages from queue head without removing them, negative count means all
+// Delivery order and consumers are not affected, returned messages must not be modified
+// Only messages kept in memory are returned, messages swapped to disk are not loaded
+func (queue *Queue) Peek(count int) []*amqp.Message {
+	if queue.stream != nil {
+		return queue.peekStream(count)
+	}
+	return queue.SafeQueue.Peek(count)
 }
 
 // ConsumersCount returns consumers count
 func (queue *Queue) ConsumersCount() int {
-	queue.cmrLock.RLock()
-	defer queue.cmrLock.RUnlock()
-	return len(queue.consumers)
+	return int(atomic.LoadInt32(&queue.consumersCount))
 }
 
 // EqualWithErr returns is given queue equal to current
@@ -584,12 +1149,18 @@ func (queue *Queue) EqualWithErr(qB *Queue) error {
 	if queue.exclusive != qB.IsExclusive() {
 		return fmt.Errorf(errTemplate, "exclusive", queue.name, qB.IsExclusive(), queue.exclusive)
 	}
+	if queue.Type() != qB.Type() {
+		return fmt.Errorf("inequivalent arg '%s' for queue '%s': received '%s' but current is '%s'", QueueTypeArg, queue.name, qB.Type(), queue.Type())
+	}
 	return nil
 }
 
 // Marshal returns raw representation of queue to store into storage
 func (queue *Queue) Marshal(protoVersion string) (data []byte, err error) {
 	buf := bytes.NewBuffer(make([]byte, 0))
+	if err = amqp.WriteFormatVersion(buf, amqp.FormatVersionCurrent); err != nil {
+		return nil, err
+	}
 	if err = amqp.WriteShortstr(buf, queue.name); err != nil {
 		return nil, err
 	}
@@ -604,12 +1175,47 @@ func (queue *Queue) Marshal(protoVersion string) (data []byte, err error) {
 	if err = amqp.WriteOctet(buf, autoDelete); err != nil {
 		return nil, err
 	}
+
+	arguments := queue.declaredArguments
+	if arguments == nil {
+		arguments = &amqp.Table{}
+	}
+	if err = amqp.WriteTable(buf, arguments, protoVersion); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
 // Unmarshal returns queue from storage raw bytes data
 func (queue *Queue) Unmarshal(data []byte, protoVersion string) (err error) {
 	buf := bytes.NewReader(data)
+	var version byte
+	if version, err = amqp.ReadFormatVersion(buf); err != nil {
+		return err
+	}
+
+	switch version {
+	case amqp.FormatVersion1:
+		err = queue.unmarshalV1(buf)
+	case amqp.FormatVersion2:
+		err = queue.unmarshalV2(buf, protoVersion)
+	}
+	return
+}
+
+func (queue *Queue) unmarshalV2(buf *bytes.Reader, protoVersion string) (err error) {
+	if err = queue.unmarshalV1(buf); err != nil {
+		return err
+	}
+
+	var arguments *amqp.Table
+	if arguments, err = amqp.ReadTable(buf, protoVersion); err != nil {
+		return err
+	}
+	return queue.SetArguments(arguments)
+}
+
+func (queue *Queue) unmarshalV1(buf *bytes.Reader) (err error) {
 	if queue.name, err = amqp.ReadShortstr(buf); err != nil {
 		return err
 	}
@@ -0,0 +1,45 @@
+package queue
+
+import (
+	"fmt"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// Queue types
+// Queue is declared with x-queue-type "classic" (default), "quorum" or "stream", see stream.go.
+// There is no replication in GarageMQ yet, so quorum queue is a durable classic queue: it must be durable,
+// not exclusive and not auto-delete like RabbitMQ quorum queue, but it gives no additional data safety
+// and quorum-specific arguments are not applied. Queue type can not be changed after queue is declared.
+const (
+	QueueTypeArg     = "x-queue-type"
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+	QueueTypeStream  = "stream"
+)
+
+// parseQueueType returns queue type from arguments, classic if it is not set
+func (queue *Queue) parseQueueType(arguments *amqp.Table) (string, error) {
+	value, ok := (*arguments)[QueueTypeArg]
+	if !ok {
+		return QueueTypeClassic, nil
+	}
+	queueType, _ := value.(string)
+	switch queueType {
+	case QueueTypeClassic, QueueTypeStream:
+		return queueType, nil
+	case QueueTypeQuorum:
+		if !queue.durable || queue.exclusive || queue.autoDelete {
+			return "", fmt.Errorf("invalid queue '%s': %s queue must be durable, not exclusive and not auto-delete", queue.name, QueueTypeQuorum)
+		}
+		return queueType, nil
+	}
+	return "", fmt.Errorf("invalid arg '%s' for queue '%s': expected '%s', '%s' or '%s'", QueueTypeArg, queue.name, QueueTypeClassic, QueueTypeQuorum, QueueTypeStream)
+}
+
+// Type returns queue type
+func (queue *Queue) Type() string {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	return queue.queueType
+}
@@ -1,13 +1,17 @@
 package queue
 
 import (
+	"context"
+
 	"github.com/valinurovam/garagemq/qos"
 )
 
 // ConsumerMock implements AMQP consumer mock
 type ConsumerMock struct {
-	tag    string
-	cancel bool
+	tag     string
+	cancel  bool
+	drain   bool
+	unacked int64
 }
 
 // Consume send signal into consumer channel, than consumer can try to pop message from queue
@@ -25,6 +29,17 @@ func (consumer *ConsumerMock) Cancel() {
 	consumer.cancel = true
 }
 
+// Drain marks consumer drained
+func (consumer *ConsumerMock) Drain(ctx context.Context) error {
+	consumer.drain = true
+	return nil
+}
+
+// UnackedCount returns count of unacked messages set by test
+func (consumer *ConsumerMock) UnackedCount() int64 {
+	return consumer.unacked
+}
+
 // Tag returns consumer tag
 func (consumer *ConsumerMock) Tag() string {
 	return consumer.tag
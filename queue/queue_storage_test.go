@@ -39,6 +39,11 @@ func (storage *MsgStorageMock) Add(message *amqp.Message, queue string) error {
 // Update append message into update-queue
 func (storage *MsgStorageMock) Update(message *amqp.Message, queue string) error {
 	storage.update = true
+
+	if index, ok := storage.index[message.ID]; ok && storage.messages != nil {
+		storage.messages[index] = message
+	}
+
 	return nil
 }
 
@@ -105,14 +105,10 @@ func TestQueue_Requeue(t *testing.T) {
 		t.Fatalf("expected %d elements, have %d", queueLength, queue.Length())
 	}
 
-	var expected int
+	// requeued messages are restored to their original position
 	for item := 0; item < queueLength*2; item++ {
 		pop := queue.Pop()
-		if queueLength > item {
-			expected = queueLength - item
-		} else {
-			expected = item + 1 - queueLength
-		}
+		expected := item/2 + 1
 		if expected != int(pop.ID) {
 			t.Fatalf("Pop: expected %d, actual %d", expected, pop.ID)
 		}
@@ -241,6 +237,26 @@ func TestQueue_PopQos_Multiple(t *testing.T) {
 	}
 }
 
+func TestQueue_PopQos_Refused_ReleasesTaken(t *testing.T) {
+	shared := qos.NewAmqpQos(10, 0)
+	qosRules := []*qos.AmqpQos{shared, qos.NewAmqpQos(2, 0)}
+
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+	for item := 0; item < 5; item++ {
+		queue.Push(&amqp.Message{ID: uint64(item)})
+	}
+
+	for item := 0; item < 5; item++ {
+		queue.PopQos(qosRules)
+	}
+
+	// refused pops must not keep shared qos taken
+	if !shared.Inc(8, 0) || shared.Inc(1, 0) {
+		t.Fatal("Expected shared qos taken only by popped messages")
+	}
+}
+
 func TestQueue_Purge(t *testing.T) {
 	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
 	queue.Start()
@@ -283,6 +299,23 @@ func TestQueue_AddConsumer(t *testing.T) {
 	}
 }
 
+func TestQueue_DispatchOrder(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+	for _, unacked := range []int64{2, 0, 1, 0} {
+		queue.AddConsumer(&ConsumerMock{unacked: unacked}, false)
+	}
+
+	// the least loaded consumers go first, equally loaded ones keep round-robin order after current
+	queue.currentConsumer = 1
+	expected := []int{3, 1, 2, 0}
+	for i, index := range queue.dispatchOrder() {
+		if index != expected[i] {
+			t.Fatalf("Expected dispatch order %v, actual %v", expected, queue.dispatchOrder())
+		}
+	}
+}
+
 func TestQueue_AddConsumer_Exclusive(t *testing.T) {
 	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
 	queue.Start()
@@ -304,6 +337,31 @@ func TestQueue_AddConsumer_Exclusive(t *testing.T) {
 	}
 }
 
+func TestQueue_AddConsumer_MaxConsumers(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	if err := queue.SetArguments(&amqp.Table{MaxConsumersArg: int32(2)}); err != nil {
+		t.Fatal(err)
+	}
+	queue.Start()
+
+	for _, tag := range []string{"first", "second"} {
+		if err := queue.AddConsumer(&ConsumerMock{tag: tag}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if queue.AddConsumer(&ConsumerMock{tag: "third"}, false) == nil {
+		t.Fatal("Expected error on consumer over x-max-consumers")
+	}
+
+	queue.RemoveConsumer("first")
+	if err := queue.AddConsumer(&ConsumerMock{tag: "third"}, false); err != nil {
+		t.Fatalf("Expected slot freed by removed consumer, actual %s", err)
+	}
+	if queue.SetArguments(&amqp.Table{MaxConsumersArg: "two"}) == nil {
+		t.Fatal("Expected error on invalid x-max-consumers")
+	}
+}
+
 func TestQueue_RemoveConsumer(t *testing.T) {
 	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
 	queue.Start()
@@ -409,6 +467,93 @@ func TestQueue_Marshal(t *testing.T) {
 	}
 }
 
+func TestQueue_Unmarshal_Version1(t *testing.T) {
+	// record written before format versioning, without version prefix
+	data := []byte{4, 't', 'e', 's', 't', 1}
+
+	uQueue := &Queue{}
+	if err := uQueue.Unmarshal(data, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+
+	if uQueue.name != "test" || !uQueue.IsAutoDelete() || !uQueue.IsDurable() {
+		t.Fatal("Unmarshaled queue does not equal version 1 record")
+	}
+}
+
+func TestQueue_Marshal_Arguments(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	if err := queue.SetArguments(&amqp.Table{CompressArg: true}); err != nil {
+		t.Fatal(err)
+	}
+	marshaled, err := queue.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uQueue := &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if !uQueue.compress || (*uQueue.Arguments())[CompressArg] != true {
+		t.Fatal("Expected unmarshaled queue arguments")
+	}
+}
+
+func TestQueue_SetArguments_Failed(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	if queue.SetArguments(&amqp.Table{CompressArg: "yes"}) == nil {
+		t.Fatal("Expected error on invalid argument")
+	}
+}
+
+func TestQueue_SetArguments_CompressThreshold(t *testing.T) {
+	cfg := baseConfig
+	cfg.CompressThreshold = 4096
+	queue := NewQueue("test", 0, false, false, false, cfg, nil, nil, nil)
+	if err := queue.SetArguments(&amqp.Table{}); err != nil || queue.compressThreshold != 4096 {
+		t.Fatalf("Expected threshold of config %d, actual %d", 4096, queue.compressThreshold)
+	}
+	if err := queue.SetArguments(&amqp.Table{CompressThresholdArg: int32(0)}); err != nil || queue.compressThreshold != 0 {
+		t.Fatalf("Expected threshold disabled by argument, actual %d", queue.compressThreshold)
+	}
+	if queue.SetArguments(&amqp.Table{CompressThresholdArg: int32(-1)}) == nil {
+		t.Fatal("Expected error on negative threshold")
+	}
+}
+
+func TestQueue_SetPolicy(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	if err := queue.SetArguments(&amqp.Table{"x-declared": "queue"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.SetPolicy("policy", amqp.Table{CompressArg: true, "x-declared": "policy"}); err != nil {
+		t.Fatal(err)
+	}
+	if !queue.compress || (*queue.Arguments())["x-declared"] != "queue" {
+		t.Fatal("Expected policy definition merged with declared arguments precedence")
+	}
+	if queue.SetPolicy("invalid", amqp.Table{CompressArg: "yes"}) == nil {
+		t.Fatal("Expected error on invalid policy definition")
+	}
+	if queue.Policy() != "policy" || !queue.compress {
+		t.Fatal("Expected queue keeps previous policy")
+	}
+
+	// policy arguments are not persisted
+	marshaled, err := queue.Marshal(amqp.ProtoRabbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uQueue := &Queue{}
+	if err = uQueue.Unmarshal(marshaled, amqp.ProtoRabbit); err != nil {
+		t.Fatal(err)
+	}
+	if uQueue.compress {
+		t.Fatal("Expected unmarshaled queue without policy arguments")
+	}
+}
+
 // useless, for coverage only
 func TestQueue_Unmarshal_FailedEmpty(t *testing.T) {
 	queue := &Queue{}
@@ -708,6 +853,33 @@ func TestQueue_LoadFromMsgStorage_OverMaxMessages(t *testing.T) {
 	}
 }
 
+func TestQueue_MarkDelivered_Recovered(t *testing.T) {
+	var dMode byte = 2
+	storagePersisted := NewStorageMock(2)
+	queue := NewQueue("test", 0, false, false, true, baseConfig, storagePersisted, NewStorageMock(0), nil)
+	queue.Start()
+	for id := uint64(1); id <= 2; id++ {
+		queue.Push(&amqp.Message{ID: id, Header: &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{DeliveryMode: &dMode}}})
+	}
+
+	delivered := queue.Pop()
+	queue.MarkDelivered(delivered)
+	if delivered.DeliveryCount != 0 {
+		t.Fatalf("Expected delivered message not modified, actual delivery count %d", delivered.DeliveryCount)
+	}
+
+	// crash: unacked message is not requeued, queue is loaded from storage
+	recovered := NewQueue("test", 0, false, false, true, baseConfig, storagePersisted, NewStorageMock(0), nil)
+	recovered.LoadFromMsgStorage()
+	recovered.Start()
+	if message := recovered.Pop(); message == nil || message.ID != 1 || message.DeliveryCount == 0 {
+		t.Fatalf("Expected delivered message %d recovered as redelivered, actual %v", 1, message)
+	}
+	if message := recovered.Pop(); message == nil || message.ID != 2 || message.DeliveryCount != 0 {
+		t.Fatalf("Expected fresh message %d recovered as not delivered, actual %v", 2, message)
+	}
+}
+
 func TestQueue_AutoDelete(t *testing.T) {
 	autoDeleteCh := make(chan string, 1)
 
@@ -748,3 +920,119 @@ func TestQueue_CancelConsumers(t *testing.T) {
 		t.Fatalf("Expected call consumer.Cancel()")
 	}
 }
+
+func TestQueue_PauseResume(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+	queue.AddConsumer(&ConsumerMock{tag: "test"}, false)
+
+	queueLength := SIZE
+	for item := 0; item < queueLength; item++ {
+		queue.Push(&amqp.Message{ID: uint64(item + 1)})
+	}
+
+	queue.Pause()
+	if !queue.IsPaused() {
+		t.Fatalf("Expected IsPaused %t, actual %t", true, queue.IsPaused())
+	}
+
+	for item := queueLength; item < queueLength*2; item++ {
+		queue.Push(&amqp.Message{ID: uint64(item + 1)})
+	}
+
+	if queue.Length() != uint64(queueLength*2) {
+		t.Fatalf("Expected %d elements, have %d", queueLength*2, queue.Length())
+	}
+
+	if queue.Pop() != nil {
+		t.Fatal("Expected nil from paused queue")
+	}
+
+	if queue.ConsumersCount() != 1 {
+		t.Fatalf("Expected %d consumers, actual %d", 1, queue.ConsumersCount())
+	}
+
+	queue.Resume()
+	if queue.IsPaused() {
+		t.Fatalf("Expected IsPaused %t, actual %t", false, queue.IsPaused())
+	}
+
+	for item := 0; item < queueLength*2; item++ {
+		pop := queue.Pop()
+		if pop == nil || pop.ID != uint64(item+1) {
+			t.Fatalf("Pop: expected %v, actual %v", item+1, pop)
+		}
+	}
+}
+
+func TestQueue_Push_Compress(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.SetArguments(&amqp.Table{CompressArg: true})
+	queue.Start()
+
+	body := make([]byte, 4*compressMinBodySize)
+	message := &amqp.Message{
+		ID:     1,
+		Header: &amqp.ContentHeader{BodySize: uint64(len(body)), PropertyList: &amqp.BasicPropertyList{}},
+	}
+	message.Append(&amqp.Frame{Type: byte(amqp.FrameBody), Payload: body[:compressMinBodySize*2]})
+	message.Append(&amqp.Frame{Type: byte(amqp.FrameBody), Payload: body[compressMinBodySize*2:]})
+	queue.Push(message)
+
+	stored := queue.Pop()
+	if stored == message || !stored.IsGzipped() || stored.BodySize >= message.BodySize {
+		t.Fatal("Expected compressed copy of message in queue")
+	}
+	if message.IsGzipped() {
+		t.Fatal("Expected pushed message not modified")
+	}
+
+	small := &amqp.Message{
+		ID:     2,
+		Header: &amqp.ContentHeader{BodySize: 1, PropertyList: &amqp.BasicPropertyList{}},
+	}
+	small.Append(&amqp.Frame{Type: byte(amqp.FrameBody), Payload: []byte{0}})
+	queue.Push(small)
+	if queue.Pop() != small {
+		t.Fatal("Expected small message stored as is")
+	}
+}
+
+func TestQueue_Stats_BodySizes(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+
+	for _, size := range []uint64{0, 1023, 1 << 10, 64 << 10, 1 << 20, 8 << 20} {
+		queue.Push(&amqp.Message{BodySize: size})
+	}
+
+	expected := map[string]uint64{"<1KB": 2, "1KB-10KB": 1, "10KB-100KB": 1, "100KB-1MB": 0, ">=1MB": 2}
+	stats := queue.Stats()
+	for bucket, count := range expected {
+		if stats.BodySizes[bucket] != count {
+			t.Errorf("Expected %d messages in bucket %s, actual %d", count, bucket, stats.BodySizes[bucket])
+		}
+	}
+	if stats.Length != 6 {
+		t.Errorf("Expected length %d, actual %d", 6, stats.Length)
+	}
+}
+
+func TestQueue_Pop_DeadlinePassed(t *testing.T) {
+	queue := NewQueue("test", 0, false, false, false, baseConfig, nil, nil, nil)
+	queue.Start()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for id, deadline := range []int64{now - 1000, now - 1, now + 60000} {
+		queue.Push(&amqp.Message{
+			ID:     uint64(id + 1),
+			Header: &amqp.ContentHeader{PropertyList: &amqp.BasicPropertyList{Headers: &amqp.Table{amqp.DeadlineHeader: deadline}}},
+		})
+	}
+
+	if message := queue.Pop(); message == nil || message.ID != 3 {
+		t.Fatalf("Expected message with passed deadline dropped, actual %v", message)
+	}
+	if queue.Length() != 0 {
+		t.Fatalf("Expected %d elements, have %d", 0, queue.Length())
+	}
+}
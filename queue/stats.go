@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"sync/atomic"
+)
+
+// bodySizeBounds are upper bounds of message body size histogram buckets,
+// the last bucket counts messages greater or equal to the last bound
+var bodySizeBounds = [...]uint64{1 << 10, 10 << 10, 100 << 10, 1 << 20}
+
+// BodySizeBuckets are labels of message body size histogram buckets
+var BodySizeBuckets = [len(bodySizeBounds) + 1]string{"<1KB", "1KB-10KB", "10KB-100KB", "100KB-1MB", ">=1MB"}
+
+// bodySizeHistogram counts pushed messages by body size
+type bodySizeHistogram struct {
+	counts [len(bodySizeBounds) + 1]uint64
+}
+
+func (histogram *bodySizeHistogram) add(size uint64) {
+	bucket := len(bodySizeBounds)
+	for i, bound := range bodySizeBounds {
+		if size < bound {
+			bucket = i
+			break
+		}
+	}
+	atomic.AddUint64(&histogram.counts[bucket], 1)
+}
+
+func (histogram *bodySizeHistogram) snapshot() map[string]uint64 {
+	counts := make(map[string]uint64, len(BodySizeBuckets))
+	for i, label := range BodySizeBuckets {
+		counts[label] = atomic.LoadUint64(&histogram.counts[i])
+	}
+	return counts
+}
+
+// Stats represents queue state for capacity planning
+// BodySizes counts all messages pushed into queue by body size bucket, see BodySizeBuckets
+// InMemory counts ready messages resident in memory, OnDiskOnly counts ready messages kept only in storage
+// because of overflow or lazy mode, they are loaded into memory when resident ones are consumed
+type Stats struct {
+	Length         uint64
+	ConsumersCount int
+	BodySizes      map[string]uint64
+	InMemory       uint64
+	OnDiskOnly     uint64
+}
+
+// Stats returns current queue stats
+func (queue *Queue) Stats() Stats {
+	// memory part is counted by in-memory queue itself, moves between memory and storage keep it actual
+	length := queue.Length()
+	inMemory := queue.SafeQueue.Length()
+	if inMemory > length {
+		inMemory = length
+	}
+	return Stats{
+		Length:         length,
+		ConsumersCount: queue.ConsumersCount(),
+		BodySizes:      queue.bodySizes.snapshot(),
+		InMemory:       inMemory,
+		OnDiskOnly:     length - inMemory,
+	}
+}
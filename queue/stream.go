@@ -0,0 +1,312 @@
+package queue
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/qos"
+)
+
+// Stream queue
+// Queue declared with x-queue-type "stream" is an append-only log of messages with sequential offsets.
+// Messages are not removed by delivery: every consumer reads from its own offset, acks and rejects only release
+// consumer prefetch and rejected messages are not redelivered. Oldest messages are trimmed from the log once
+// they are older than x-max-age milliseconds or total body size of the log exceeds x-max-length-bytes,
+// limits are checked on publish and on read. Offset of delivered message is set into x-stream-offset header.
+// Persisted messages of durable stream are loaded on start with new offsets and age counted from load.
+const (
+	MaxAgeArg         = "x-max-age"
+	MaxLengthBytesArg = "x-max-length-bytes"
+	StreamOffsetArg   = "x-stream-offset"
+)
+
+// Named offsets of x-stream-offset consumer argument, consumer without argument starts from next message
+// Timestamp argument points to the first message stored at or after it
+const (
+	StreamOffsetFirst = "first"
+	StreamOffsetLast  = "last"
+	StreamOffsetNext  = "next"
+)
+
+type streamEntry struct {
+	message  *amqp.Message
+	storedAt time.Time
+}
+
+// streamLog keeps messages of stream queue, entries[i] has offset first+i
+type streamLog struct {
+	lock     sync.RWMutex
+	entries  []*streamEntry
+	first    uint64
+	bytes    uint64
+	maxAge   time.Duration
+	maxBytes uint64
+}
+
+func newStreamLog(maxAge time.Duration, maxBytes uint64) *streamLog {
+	return &streamLog{maxAge: maxAge, maxBytes: maxBytes}
+}
+
+// next returns offset of the next appended message, must be called under lock
+func (stream *streamLog) next() uint64 {
+	return stream.first + uint64(len(stream.entries))
+}
+
+// parseStreamArguments returns stream log for stream queue type and nil for other ones
+func parseStreamArguments(arguments *amqp.Table, queueType string, queueName string) (*streamLog, error) {
+	if queueType != QueueTypeStream {
+		return nil, nil
+	}
+
+	var maxAge, maxBytes int64
+	if _, ok := (*arguments)[MaxAgeArg]; ok {
+		if maxAge, ok = arguments.Int64(MaxAgeArg); !ok || maxAge < 0 {
+			return nil, fmt.Errorf("invalid arg '%s' for queue '%s': expected non-negative integer", MaxAgeArg, queueName)
+		}
+	}
+	if _, ok := (*arguments)[MaxLengthBytesArg]; ok {
+		if maxBytes, ok = arguments.Int64(MaxLengthBytesArg); !ok || maxBytes < 0 {
+			return nil, fmt.Errorf("invalid arg '%s' for queue '%s': expected non-negative integer", MaxLengthBytesArg, queueName)
+		}
+	}
+	return newStreamLog(time.Duration(maxAge)*time.Millisecond, uint64(maxBytes)), nil
+}
+
+// IsStream returns is queue a stream
+func (queue *Queue) IsStream() bool {
+	queue.actLock.RLock()
+	defer queue.actLock.RUnlock()
+	return queue.stream != nil
+}
+
+// pushStream appends message into stream log, must be called under actLock
+func (queue *Queue) pushStream(message *amqp.Message) {
+	if queue.persists(message) {
+		queue.msgPStorage.Add(message, queue.name)
+	} else if message.ConfirmMeta != nil {
+		message.ConfirmMeta.ActualConfirms++
+	}
+	queue.metrics.Incoming.Counter.Inc(1)
+
+	stream := queue.stream
+	stream.lock.Lock()
+	stream.entries = append(stream.entries, &streamEntry{message: message, storedAt: time.Now()})
+	stream.bytes += message.BodySize
+	stream.lock.Unlock()
+	queue.trimStream(time.Now())
+
+	queue.notify(EventLength)
+	queue.callConsumers()
+}
+
+// trimStream removes messages beyond age and size limits from stream log head
+func (queue *Queue) trimStream(now time.Time) {
+	stream := queue.stream
+	stream.lock.Lock()
+	var trimmed []*amqp.Message
+	for len(stream.entries) > 0 {
+		entry := stream.entries[0]
+		expired := stream.maxAge > 0 && now.Sub(entry.storedAt) >= stream.maxAge
+		oversized := stream.maxBytes > 0 && stream.bytes > stream.maxBytes
+		if !expired && !oversized {
+			break
+		}
+		stream.entries[0] = nil
+		stream.entries = stream.entries[1:]
+		stream.first++
+		stream.bytes -= entry.message.BodySize
+		trimmed = append(trimmed, entry.message)
+	}
+	stream.lock.Unlock()
+
+	if len(trimmed) == 0 {
+		return
+	}
+	for _, message := range trimmed {
+		if queue.durable && message.IsPersistent() {
+			queue.msgPStorage.Del(message, queue.name)
+		}
+	}
+	count := int64(len(trimmed))
+	atomic.AddInt64(&queue.queueLength, -count)
+	queue.metrics.Total.Counter.Dec(count)
+	queue.metrics.Ready.Counter.Dec(count)
+	queue.metrics.ServerTotal.Counter.Dec(count)
+	queue.metrics.ServerReady.Counter.Dec(count)
+	queue.notify(EventLength)
+}
+
+// ReadStream returns copy of stream message at offset or the first retained one if offset is already trimmed,
+// with x-stream-offset header set, and offset to read next
+// Returns nil if there is no message at offset yet or qos does not allow delivery
+func (queue *Queue) ReadStream(offset uint64, qosList []*qos.AmqpQos) (*amqp.Message, uint64) {
+	queue.actLock.RLock()
+	if !queue.active || queue.paused || queue.stream == nil {
+		queue.actLock.RUnlock()
+		return nil, offset
+	}
+	queue.actLock.RUnlock()
+
+	queue.trimStream(time.Now())
+
+	stream := queue.stream
+	stream.lock.RLock()
+	if offset < stream.first {
+		offset = stream.first
+	}
+	if offset >= stream.next() {
+		stream.lock.RUnlock()
+		return nil, offset
+	}
+	message := stream.entries[offset-stream.first].message
+	stream.lock.RUnlock()
+
+	if !acquireQos(qosList, message.BodySize) {
+		return nil, offset
+	}
+	return withStreamOffset(message, offset), offset + 1
+}
+
+// StreamOffset resolves x-stream-offset consumer argument into offset, nil value means next message
+func (queue *Queue) StreamOffset(value interface{}) (uint64, error) {
+	stream := queue.stream
+	stream.lock.RLock()
+	defer stream.lock.RUnlock()
+
+	switch offset := value.(type) {
+	case nil:
+		return stream.next(), nil
+	case time.Time:
+		// entries are appended in time order
+		position := sort.Search(len(stream.entries), func(i int) bool {
+			return !stream.entries[i].storedAt.Before(offset)
+		})
+		return stream.first + uint64(position), nil
+	case string:
+		switch offset {
+		case StreamOffsetFirst:
+			return stream.first, nil
+		case StreamOffsetLast:
+			if len(stream.entries) == 0 {
+				return stream.next(), nil
+			}
+			return stream.next() - 1, nil
+		case StreamOffsetNext:
+			return stream.next(), nil
+		}
+	default:
+		if number, ok := (amqp.Table{StreamOffsetArg: offset}).Int64(StreamOffsetArg); ok && number >= 0 {
+			return uint64(number), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid arg '%s': expected non-negative integer, timestamp or one of '%s', '%s', '%s'", StreamOffsetArg, StreamOffsetFirst, StreamOffsetLast, StreamOffsetNext)
+}
+
+// StreamRange returns copies of up to limit retained stream messages with offsets from start up to end exclusive,
+// with x-stream-offset header set, and offset to read the rest of range from. Already trimmed offsets are skipped
+func (queue *Queue) StreamRange(start uint64, end uint64, limit int) ([]*amqp.Message, uint64) {
+	if !queue.IsStream() {
+		return nil, end
+	}
+	queue.trimStream(time.Now())
+
+	stream := queue.stream
+	stream.lock.RLock()
+	defer stream.lock.RUnlock()
+	if start < stream.first {
+		start = stream.first
+	}
+	if end > stream.next() {
+		end = stream.next()
+	}
+	if start >= end {
+		return nil, end
+	}
+	if end-start > uint64(limit) {
+		end = start + uint64(limit)
+	}
+	messages := make([]*amqp.Message, 0, end-start)
+	for offset := start; offset < end; offset++ {
+		messages = append(messages, withStreamOffset(stream.entries[offset-stream.first].message, offset))
+	}
+	return messages, end
+}
+
+// loadStream loads persisted messages of durable stream into log
+func (queue *Queue) loadStream() {
+	stream := queue.stream
+	now := time.Now()
+	queue.msgPStorage.IterateByQueueFromMsgID(queue.name, 0, 0, func(message *amqp.Message) {
+		stream.entries = append(stream.entries, &streamEntry{message: message, storedAt: now})
+		stream.bytes += message.BodySize
+	})
+
+	queue.queueLength = int64(len(stream.entries))
+	queue.metrics.ServerTotal.Counter.Inc(queue.queueLength)
+	queue.metrics.ServerReady.Counter.Inc(queue.queueLength)
+	queue.metrics.Total.Counter.Inc(queue.queueLength)
+	queue.metrics.Ready.Counter.Inc(queue.queueLength)
+}
+
+// purgeStream removes all messages from stream log, offsets are not reset, must be called under actLock
+func (queue *Queue) purgeStream() {
+	stream := queue.stream
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	stream.first = stream.next()
+	stream.entries = nil
+	stream.bytes = 0
+}
+
+// acquireQos increments all active qos, taken ones are released if any of them is exceeded
+func acquireQos(qosList []*qos.AmqpQos, size uint64) bool {
+	for i, q := range qosList {
+		if !q.IsActive() {
+			continue
+		}
+		if !q.Inc(1, uint32(size)) {
+			for _, taken := range qosList[:i] {
+				if taken.IsActive() {
+					taken.Dec(1, uint32(size))
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// withStreamOffset returns copy of message with offset in x-stream-offset header
+// peekStream returns up to count retained stream messages from the first offset
+func (queue *Queue) peekStream(count int) []*amqp.Message {
+	stream := queue.stream
+	stream.lock.RLock()
+	defer stream.lock.RUnlock()
+	if count < 0 || count > len(stream.entries) {
+		count = len(stream.entries)
+	}
+	messages := make([]*amqp.Message, 0, count)
+	for i, entry := range stream.entries[:count] {
+		messages = append(messages, withStreamOffset(entry.message, stream.first+uint64(i)))
+	}
+	return messages
+}
+
+func withStreamOffset(message *amqp.Message, offset uint64) *amqp.Message {
+	delivered := message.Copy()
+	if delivered.Header == nil {
+		delivered.Header = &amqp.ContentHeader{}
+	}
+	if delivered.Header.PropertyList == nil {
+		delivered.Header.PropertyList = &amqp.BasicPropertyList{}
+	}
+	if delivered.Header.PropertyList.Headers == nil {
+		delivered.Header.PropertyList.Headers = &amqp.Table{}
+	}
+	(*delivered.Header.PropertyList.Headers)[StreamOffsetArg] = int64(offset)
+	return delivered
+}
@@ -0,0 +1,193 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+func newStreamQueue(t *testing.T, durable bool, arguments amqp.Table, storage *overflowStorageMock) *Queue {
+	arguments[QueueTypeArg] = QueueTypeStream
+	queue := NewQueue("test", 0, false, false, durable, baseConfig, storage, nil, nil)
+	if err := queue.SetArguments(&arguments); err != nil {
+		t.Fatal(err)
+	}
+	queue.Start()
+	return queue
+}
+
+func pushStreamMessage(queue *Queue, id uint64, size uint64) {
+	var dMode byte = 2
+	queue.Push(&amqp.Message{
+		ID:       id,
+		BodySize: size,
+		Header: &amqp.ContentHeader{
+			PropertyList: &amqp.BasicPropertyList{DeliveryMode: &dMode},
+		},
+	})
+}
+
+func readStreamOffsets(queue *Queue, offset uint64) []uint64 {
+	var offsets []uint64
+	for {
+		message, next := queue.ReadStream(offset, nil)
+		if message == nil {
+			return offsets
+		}
+		value, _ := message.Header.PropertyList.Headers.Int64(StreamOffsetArg)
+		offsets = append(offsets, uint64(value))
+		offset = next
+	}
+}
+
+func TestQueue_Stream_OffsetReads(t *testing.T) {
+	queue := newStreamQueue(t, false, amqp.Table{}, nil)
+	for id := uint64(1); id <= 3; id++ {
+		pushStreamMessage(queue, id, 1)
+	}
+
+	// reads are not destructive, so readers get the same messages independently
+	for _, reader := range []string{"first", "second"} {
+		if offsets := readStreamOffsets(queue, 0); len(offsets) != 3 || offsets[0] != 0 || offsets[2] != 2 {
+			t.Errorf("Expected %s reader got offsets [0 1 2], actual %v", reader, offsets)
+		}
+	}
+	if offsets := readStreamOffsets(queue, 2); len(offsets) != 1 || offsets[0] != 2 {
+		t.Errorf("Expected read from offset 2, actual %v", offsets)
+	}
+	if queue.Length() != 3 {
+		t.Errorf("Expected stream length %d after reads, actual %d", 3, queue.Length())
+	}
+	if message, next := queue.ReadStream(3, nil); message != nil || next != 3 {
+		t.Errorf("Expected no message beyond stream end, actual next offset %d", next)
+	}
+}
+
+func TestQueue_Stream_TrimByAge(t *testing.T) {
+	storage := newOverflowStorageMock()
+	queue := newStreamQueue(t, true, amqp.Table{MaxAgeArg: int32(50)}, storage)
+	pushStreamMessage(queue, 1, 1)
+	pushStreamMessage(queue, 2, 1)
+
+	time.Sleep(100 * time.Millisecond)
+	pushStreamMessage(queue, 3, 1)
+
+	if queue.Length() != 1 {
+		t.Errorf("Expected stream length %d after trim, actual %d", 1, queue.Length())
+	}
+	// trimmed offset is read from the first retained message
+	if offsets := readStreamOffsets(queue, 0); len(offsets) != 1 || offsets[0] != 2 {
+		t.Errorf("Expected offsets [2] after trim, actual %v", offsets)
+	}
+	if length := storage.GetQueueLength("test"); length != 1 {
+		t.Errorf("Expected trimmed messages deleted from storage, actual stored %d", length)
+	}
+
+	// age is checked on read as well
+	time.Sleep(100 * time.Millisecond)
+	if offsets := readStreamOffsets(queue, 0); len(offsets) != 0 || queue.Length() != 0 {
+		t.Errorf("Expected empty stream after trim on read, actual %v", offsets)
+	}
+}
+
+func TestQueue_Stream_TrimByBytes(t *testing.T) {
+	queue := newStreamQueue(t, false, amqp.Table{MaxLengthBytesArg: int32(10)}, nil)
+	for id := uint64(1); id <= 3; id++ {
+		pushStreamMessage(queue, id, 6)
+	}
+
+	if offsets := readStreamOffsets(queue, 0); len(offsets) != 1 || offsets[0] != 2 {
+		t.Errorf("Expected offsets [2] within size limit, actual %v", offsets)
+	}
+}
+
+func TestQueue_Stream_Offset(t *testing.T) {
+	queue := newStreamQueue(t, false, amqp.Table{}, nil)
+	for id := uint64(1); id <= 3; id++ {
+		pushStreamMessage(queue, id, 1)
+	}
+
+	for value, expected := range map[interface{}]uint64{
+		nil:               3,
+		StreamOffsetFirst: 0,
+		StreamOffsetLast:  2,
+		StreamOffsetNext:  3,
+		int32(1):          1,
+	} {
+		if offset, err := queue.StreamOffset(value); err != nil || offset != expected {
+			t.Errorf("Expected offset %d for %v, actual %d, %v", expected, value, offset, err)
+		}
+	}
+	for _, value := range []interface{}{"middle", int32(-1), true} {
+		if _, err := queue.StreamOffset(value); err == nil {
+			t.Errorf("Expected error on offset %v", value)
+		}
+	}
+
+	classic := NewQueue("classic", 0, false, false, false, baseConfig, nil, nil, nil)
+	if err := classic.SetArguments(&amqp.Table{QueueTypeArg: "lazy"}); err == nil {
+		t.Error("Expected error on unsupported queue type")
+	}
+}
+
+func TestQueue_Stream_Offset_Timestamp(t *testing.T) {
+	queue := newStreamQueue(t, false, amqp.Table{}, nil)
+	start := time.Now()
+	pushStreamMessage(queue, 1, 1)
+	pushStreamMessage(queue, 2, 1)
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now()
+	pushStreamMessage(queue, 3, 1)
+
+	for value, expected := range map[time.Time]uint64{
+		start.Add(-time.Hour):     0,
+		middle:                    2,
+		time.Now().Add(time.Hour): 3,
+	} {
+		if offset, err := queue.StreamOffset(value); err != nil || offset != expected {
+			t.Errorf("Expected offset %d for timestamp %v, actual %d, %v", expected, value, offset, err)
+		}
+	}
+}
+
+func TestQueue_Stream_Range(t *testing.T) {
+	queue := newStreamQueue(t, false, amqp.Table{MaxLengthBytesArg: int32(4)}, nil)
+	for id := uint64(1); id <= 5; id++ {
+		pushStreamMessage(queue, id, 1)
+	}
+
+	// offset 0 is trimmed by size limit
+	for _, rng := range [][3]uint64{{0, 3, 2}, {2, 4, 2}, {3, 10, 2}, {4, 2, 0}} {
+		messages, _ := queue.StreamRange(rng[0], rng[1], 10)
+		if uint64(len(messages)) != rng[2] {
+			t.Fatalf("Expected %d messages in range [%d, %d), actual %d", rng[2], rng[0], rng[1], len(messages))
+		}
+		for i, message := range messages {
+			offset, _ := message.Header.PropertyList.Headers.Int64(StreamOffsetArg)
+			expected := rng[0] + uint64(i)
+			if rng[0] == 0 {
+				expected++
+			}
+			if uint64(offset) != expected || message.ID != expected+1 {
+				t.Errorf("Expected message of offset %d, actual offset %d id %d", expected, offset, message.ID)
+			}
+		}
+	}
+	if queue.Length() != 4 {
+		t.Errorf("Expected stream length %d after range reads, actual %d", 4, queue.Length())
+	}
+
+	// range is read by batches of limit
+	if messages, next := queue.StreamRange(0, 10, 3); len(messages) != 3 || next != 4 {
+		t.Errorf("Expected batch of %d messages and next offset %d, actual %d and %d", 3, 4, len(messages), next)
+	}
+	if messages, next := queue.StreamRange(4, 10, 3); len(messages) != 1 || next != 5 {
+		t.Errorf("Expected batch of %d messages and next offset %d, actual %d and %d", 1, 5, len(messages), next)
+	}
+
+	classic := NewQueue("classic", 0, false, false, false, baseConfig, nil, nil, nil)
+	if messages, _ := classic.StreamRange(0, 10, 10); messages != nil {
+		t.Errorf("Expected no range of classic queue, actual %d messages", len(messages))
+	}
+}
@@ -0,0 +1,215 @@
+package replication
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/interfaces"
+)
+
+// Follower applies operation log streamed by leader to local storages, so they are warm standby of leader ones
+// Storages are opened by open func on first batch for them and are closed on promotion,
+// so promoted broker can open them as its own
+type Follower struct {
+	addr           string
+	secret         string
+	open           func(name string) interfaces.DbStorage
+	reconnectDelay time.Duration
+
+	lock     sync.Mutex
+	storages map[string]interfaces.DbStorage
+	epoch    uint64
+	seq      uint64
+	conn     net.Conn
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	done     chan struct{}
+}
+
+// NewFollower returns new instance of Follower of leader at addr, secret is shared secret of leader
+func NewFollower(addr string, secret string, open func(name string) interfaces.DbStorage, reconnectDelay time.Duration) *Follower {
+	return &Follower{
+		addr:           addr,
+		secret:         secret,
+		open:           open,
+		reconnectDelay: reconnectDelay,
+		storages:       make(map[string]interfaces.DbStorage),
+		stopCh:         make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+}
+
+// Start starts following leader, follower reconnects after connection is lost
+func (follower *Follower) Start() {
+	go follower.run()
+}
+
+// Seq returns sequence number of last applied batch
+func (follower *Follower) Seq() uint64 {
+	follower.lock.Lock()
+	defer follower.lock.Unlock()
+	return follower.seq
+}
+
+// Promote stops following leader and closes local storages, returns sequence number of last applied batch
+func (follower *Follower) Promote() (uint64, error) {
+	err := follower.Close()
+	return follower.Seq(), err
+}
+
+// Close stops following leader and closes local storages
+func (follower *Follower) Close() error {
+	follower.stopOnce.Do(func() {
+		close(follower.stopCh)
+	})
+	follower.lock.Lock()
+	if follower.conn != nil {
+		follower.conn.Close()
+	}
+	follower.lock.Unlock()
+	<-follower.done
+
+	follower.lock.Lock()
+	defer follower.lock.Unlock()
+	var closeErr error
+	for name, db := range follower.storages {
+		if err := db.Close(); err != nil {
+			closeErr = fmt.Errorf("error on closing storage '%s': %s", name, err)
+		}
+	}
+	follower.storages = make(map[string]interfaces.DbStorage)
+	return closeErr
+}
+
+func (follower *Follower) run() {
+	defer close(follower.done)
+	for {
+		if err := follower.follow(); err != nil {
+			select {
+			case <-follower.stopCh:
+				return
+			default:
+			}
+			log.WithError(err).WithFields(log.Fields{
+				"leader": follower.addr,
+			}).Error("Replication stream is interrupted")
+		}
+
+		select {
+		case <-follower.stopCh:
+			return
+		case <-time.After(follower.reconnectDelay):
+		}
+	}
+}
+
+func (follower *Follower) follow() error {
+	conn, err := net.Dial("tcp", follower.addr)
+	if err != nil {
+		return err
+	}
+	follower.lock.Lock()
+	select {
+	case <-follower.stopCh:
+		follower.lock.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	follower.conn = conn
+	hello := &frame{kind: frameHello, epoch: follower.epoch, seq: follower.seq}
+	follower.lock.Unlock()
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	challenge, err := readFrame(reader)
+	if err != nil {
+		return err
+	}
+	if challenge.kind != frameChallenge {
+		return fmt.Errorf("unexpected replication frame type %d on handshake", challenge.kind)
+	}
+	hello.auth = sign(follower.secret, challenge.auth)
+	writeFrame(writer, hello)
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	var snapshot *frame
+	for {
+		f, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+		if err := follower.apply(f, &snapshot); err != nil {
+			return err
+		}
+	}
+}
+
+// apply applies frame of replication stream, snapshot is begin frame of snapshot being received
+func (follower *Follower) apply(f *frame, snapshot **frame) error {
+	follower.lock.Lock()
+	defer follower.lock.Unlock()
+
+	switch f.kind {
+	case frameSnapshot:
+		// storages are cleared, so follower interrupted before end of snapshot gets it again on reconnect
+		follower.epoch = 0
+		follower.seq = 0
+		for _, db := range follower.storages {
+			if err := clearStorage(db); err != nil {
+				return err
+			}
+		}
+		*snapshot = f
+	case frameSnapshotEnd:
+		if *snapshot == nil {
+			return fmt.Errorf("unexpected end of replication snapshot")
+		}
+		follower.epoch = (*snapshot).epoch
+		follower.seq = (*snapshot).seq
+		*snapshot = nil
+		log.WithFields(log.Fields{
+			"leader": follower.addr,
+			"seq":    follower.seq,
+		}).Info("Replication snapshot is applied")
+	case frameBatch:
+		if *snapshot == nil && f.seq != follower.seq+1 {
+			return fmt.Errorf("replication batch %d does not follow applied batch %d", f.seq, follower.seq)
+		}
+		db, ok := follower.storages[f.storage]
+		if !ok {
+			db = follower.open(f.storage)
+			follower.storages[f.storage] = db
+		}
+		if err := applyBatch(db, f.batch); err != nil {
+			return err
+		}
+		if *snapshot == nil {
+			follower.seq = f.seq
+		}
+	default:
+		return fmt.Errorf("unexpected replication frame type %d", f.kind)
+	}
+	return nil
+}
+
+// clearStorage deletes all keys, it does not rely on DeleteByPrefix which is not implemented by every engine
+func clearStorage(db interfaces.DbStorage) error {
+	var batch []*interfaces.Operation
+	db.Iterate(func(key []byte, value []byte) {
+		batch = append(batch, &interfaces.Operation{Key: string(key), Op: interfaces.OpDel})
+	})
+	if len(batch) == 0 {
+		return nil
+	}
+	return db.ProcessBatch(batch)
+}
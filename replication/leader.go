@@ -0,0 +1,344 @@
+package replication
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/interfaces"
+)
+
+// snapshotChunkSize is count of operations in single batch frame of snapshot
+const snapshotChunkSize = 1000
+
+// followerBufferSize is count of batches queued for follower, follower which falls behind is disconnected
+// and catches up on reconnect
+const followerBufferSize = 4096
+
+// handshakeTimeout limits authentication of connected follower
+const handshakeTimeout = 10 * time.Second
+
+// writeTimeout limits write of single frame, follower which does not read stream is disconnected
+const writeTimeout = 30 * time.Second
+
+// errNotAuthenticated is returned on handshake with follower which does not know shared secret
+var errNotAuthenticated = errors.New("replication follower is not authenticated")
+
+// Leader streams operation log of wrapped storages to connected followers
+// Every batch processed by wrapped storage gets next sequence number and is kept in tail of tailSize batches,
+// so reconnected follower gets missed batches only, otherwise it gets snapshot of all storages
+// Epoch is generated on leader start, so follower of previous leader run always gets snapshot
+// Followers are authenticated by HMAC of random challenge with shared secret
+type Leader struct {
+	lock      sync.Mutex
+	secret    string
+	epoch     uint64
+	seq       uint64
+	tail      []*frame
+	tailSize  int
+	storages  map[string]interfaces.DbStorage
+	followers map[*followerConn]struct{}
+	listener  net.Listener
+}
+
+type followerConn struct {
+	conn   net.Conn
+	frames chan *frame
+}
+
+// NewLeader returns new instance of Leader accepting followers with given shared secret
+func NewLeader(tailSize int, secret string) *Leader {
+	return &Leader{
+		secret:    secret,
+		epoch:     uint64(time.Now().UnixNano()),
+		tailSize:  tailSize,
+		storages:  make(map[string]interfaces.DbStorage),
+		followers: make(map[*followerConn]struct{}),
+	}
+}
+
+// Seq returns sequence number of last processed batch
+func (leader *Leader) Seq() uint64 {
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+	return leader.seq
+}
+
+// Wrap returns storage replicating its writes to followers under given name
+func (leader *Leader) Wrap(name string, db interfaces.DbStorage) interfaces.DbStorage {
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+	leader.storages[name] = db
+	return &leaderStorage{DbStorage: db, name: name, leader: leader}
+}
+
+// Serve accepts followers on listener until it is closed
+func (leader *Leader) Serve(listener net.Listener) error {
+	leader.lock.Lock()
+	leader.listener = listener
+	leader.lock.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go leader.handleFollower(conn)
+	}
+}
+
+// Close stops accepting followers and disconnects connected ones
+func (leader *Leader) Close() error {
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+	for follower := range leader.followers {
+		leader.dropFollower(follower)
+	}
+	if leader.listener != nil {
+		return leader.listener.Close()
+	}
+	return nil
+}
+
+// process queues batch applied to storage for followers
+// Storage applies batch under own lock before it gets sequence number, so storages are written in parallel,
+// batches of the same storage are sequenced in order they are applied
+func (leader *Leader) process(storage *leaderStorage, batch []*interfaces.Operation) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if err := applyBatch(storage.DbStorage, batch); err != nil {
+		return err
+	}
+
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+
+	leader.seq++
+	f := &frame{kind: frameBatch, seq: leader.seq, storage: storage.name, batch: batch}
+	leader.tail = append(leader.tail, f)
+	if len(leader.tail) > leader.tailSize {
+		leader.tail[0] = nil
+		leader.tail = leader.tail[1:]
+	}
+
+	for follower := range leader.followers {
+		select {
+		case follower.frames <- f:
+		default:
+			log.WithFields(log.Fields{
+				"follower": follower.conn.RemoteAddr(),
+			}).Warn("Replication follower falls behind, disconnect it")
+			leader.dropFollower(follower)
+		}
+	}
+	return nil
+}
+
+// dropFollower must be called under lock
+func (leader *Leader) dropFollower(follower *followerConn) {
+	delete(leader.followers, follower)
+	close(follower.frames)
+	follower.conn.Close()
+}
+
+func (leader *Leader) handleFollower(conn net.Conn) {
+	logger := log.WithFields(log.Fields{
+		"follower": conn.RemoteAddr(),
+	})
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	hello, err := leader.handshake(conn, reader, writer)
+	if err != nil {
+		logger.WithError(err).Error("Error on replication handshake")
+		conn.Close()
+		return
+	}
+
+	follower := &followerConn{conn: conn, frames: make(chan *frame, followerBufferSize)}
+	// follower is registered with catch-up position under lock, so batches after it are queued
+	// while catch-up is written without blocking writes of storages
+	leader.lock.Lock()
+	catchUp, snapshot := leader.catchUp(hello)
+	leader.followers[follower] = struct{}{}
+	leader.lock.Unlock()
+
+	if err = writeCatchUp(conn, writer, catchUp, snapshot); err == nil {
+		logger.Info("Replication follower connected")
+		err = stream(conn, writer, follower.frames)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Error on replication stream")
+	}
+
+	leader.lock.Lock()
+	if _, ok := leader.followers[follower]; ok {
+		leader.dropFollower(follower)
+	}
+	leader.lock.Unlock()
+	logger.Info("Replication follower disconnected")
+}
+
+// handshake sends random challenge and checks that follower signed it with shared secret
+func (leader *Leader) handshake(conn net.Conn, reader *bufio.Reader, writer *bufio.Writer) (*frame, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	writeFrame(writer, &frame{kind: frameChallenge, auth: challenge})
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	hello, err := readFrame(reader)
+	if err != nil {
+		return nil, err
+	}
+	if hello.kind != frameHello || !hmac.Equal(hello.auth, sign(leader.secret, challenge)) {
+		return nil, errNotAuthenticated
+	}
+	return hello, nil
+}
+
+// catchUp returns batches follower missed from tail or begin frame and storages of snapshot
+// if they are not retained, must be called under lock
+// Snapshot is read after lock is released, so it may already contain batches queued for follower,
+// they are applied once more after snapshot, that is safe because every operation sets or deletes keys
+func (leader *Leader) catchUp(hello *frame) ([]*frame, map[string]interfaces.DbStorage) {
+	tailStart := leader.seq - uint64(len(leader.tail))
+	if hello.epoch == leader.epoch && hello.seq >= tailStart && hello.seq <= leader.seq {
+		missed := make([]*frame, len(leader.tail[hello.seq-tailStart:]))
+		copy(missed, leader.tail[hello.seq-tailStart:])
+		return missed, nil
+	}
+
+	storages := make(map[string]interfaces.DbStorage, len(leader.storages))
+	for name, db := range leader.storages {
+		storages[name] = db
+	}
+	return []*frame{{kind: frameSnapshot, epoch: leader.epoch, seq: leader.seq}}, storages
+}
+
+// writeCatchUp writes missed batches or snapshot of storages
+func writeCatchUp(conn net.Conn, writer *bufio.Writer, catchUp []*frame, snapshot map[string]interfaces.DbStorage) error {
+	for _, f := range catchUp {
+		if err := writeFrameDeadline(conn, writer, f); err != nil {
+			return err
+		}
+	}
+	if snapshot == nil {
+		return flushDeadline(conn, writer)
+	}
+
+	for name, db := range snapshot {
+		var err error
+		batch := make([]*interfaces.Operation, 0, snapshotChunkSize)
+		db.Iterate(func(key []byte, value []byte) {
+			if err != nil {
+				return
+			}
+			batch = append(batch, &interfaces.Operation{Key: string(key), Value: value, Op: interfaces.OpSet})
+			if len(batch) == snapshotChunkSize {
+				err = writeFrameDeadline(conn, writer, &frame{kind: frameBatch, storage: name, batch: batch})
+				batch = make([]*interfaces.Operation, 0, snapshotChunkSize)
+			}
+		})
+		if err == nil && len(batch) > 0 {
+			err = writeFrameDeadline(conn, writer, &frame{kind: frameBatch, storage: name, batch: batch})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeFrameDeadline(conn, writer, &frame{kind: frameSnapshotEnd}); err != nil {
+		return err
+	}
+	return flushDeadline(conn, writer)
+}
+
+// stream writes queued batches until follower is dropped
+func stream(conn net.Conn, writer *bufio.Writer, frames chan *frame) error {
+	for f := range frames {
+		if err := writeFrameDeadline(conn, writer, f); err != nil {
+			return err
+		}
+		// flush once queued batches are written
+		if len(frames) == 0 {
+			if err := flushDeadline(conn, writer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeFrameDeadline writes frame, buffered writer returns error of previous flush, e.g. on passed deadline
+func writeFrameDeadline(conn net.Conn, writer *bufio.Writer, f *frame) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writeFrame(writer, f)
+}
+
+func flushDeadline(conn net.Conn, writer *bufio.Writer) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writer.Flush()
+}
+
+// applyBatch applies replicated batch, prefix deletions are applied in order with other operations
+func applyBatch(db interfaces.DbStorage, batch []*interfaces.Operation) error {
+	start := 0
+	for i, op := range batch {
+		if op.Op != opDelPrefix {
+			continue
+		}
+		if i > start {
+			if err := db.ProcessBatch(batch[start:i]); err != nil {
+				return err
+			}
+		}
+		db.DeleteByPrefix([]byte(op.Key))
+		start = i + 1
+	}
+	if start < len(batch) {
+		return db.ProcessBatch(batch[start:])
+	}
+	return nil
+}
+
+// leaderStorage implements storage replicating writes through leader
+type leaderStorage struct {
+	interfaces.DbStorage
+	lock   sync.Mutex
+	name   string
+	leader *Leader
+}
+
+// ProcessBatch process batch of operations
+func (storage *leaderStorage) ProcessBatch(batch []*interfaces.Operation) error {
+	return storage.leader.process(storage, batch)
+}
+
+// Set adds a key-value pair to the database
+func (storage *leaderStorage) Set(key string, value []byte) error {
+	return storage.ProcessBatch([]*interfaces.Operation{{Key: key, Value: value, Op: interfaces.OpSet}})
+}
+
+// Del deletes a key
+func (storage *leaderStorage) Del(key string) error {
+	return storage.ProcessBatch([]*interfaces.Operation{{Key: key, Op: interfaces.OpDel}})
+}
+
+// DeleteByPrefix deletes keys with prefix
+func (storage *leaderStorage) DeleteByPrefix(prefix []byte) {
+	if err := storage.ProcessBatch([]*interfaces.Operation{{Key: string(prefix), Op: opDelPrefix}}); err != nil {
+		log.WithError(err).Error("Error on deleting keys by prefix")
+	}
+}
@@ -0,0 +1,175 @@
+package replication
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/valinurovam/garagemq/interfaces"
+)
+
+// Frame types of replication stream
+// Leader starts with frameChallenge carrying random bytes, follower answers with frameHello carrying
+// challenge signed with shared secret, leader epoch and sequence it has applied,
+// leader answers with snapshot (frameSnapshot, batches with zero sequence, frameSnapshotEnd) if follower
+// can not catch up from retained tail, and then streams batches in sequence order
+const (
+	frameHello       byte = 1
+	frameSnapshot    byte = 2
+	frameSnapshotEnd byte = 3
+	frameBatch       byte = 4
+	frameChallenge   byte = 5
+)
+
+// challengeSize is count of random bytes of leader challenge
+const challengeSize = 32
+
+// opDelPrefix replicates DeleteByPrefix, key of operation is prefix
+const opDelPrefix byte = 3
+
+// maxFieldSize limits declared length of key or value, so corrupted stream can not force huge allocation
+const maxFieldSize = 1 << 30
+
+// frame is unit of replication stream
+// epoch and seq are set for hello and snapshot frames, storage, seq and batch are set for batch frames,
+// auth is challenge of challenge frame and its signature of hello frame
+type frame struct {
+	kind    byte
+	epoch   uint64
+	seq     uint64
+	storage string
+	batch   []*interfaces.Operation
+	auth    []byte
+}
+
+// sign returns HMAC-SHA256 of challenge with shared secret, so secret itself is not sent to leader
+func sign(secret string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+func writeFrame(w *bufio.Writer, f *frame) error {
+	if err := w.WriteByte(f.kind); err != nil {
+		return err
+	}
+	switch f.kind {
+	case frameChallenge:
+		writeBytes(w, f.auth)
+	case frameHello:
+		writeUint64(w, f.epoch)
+		writeUint64(w, f.seq)
+		writeBytes(w, f.auth)
+	case frameSnapshot:
+		writeUint64(w, f.epoch)
+		writeUint64(w, f.seq)
+	case frameBatch:
+		writeUint64(w, f.seq)
+		writeBytes(w, []byte(f.storage))
+		writeUint64(w, uint64(len(f.batch)))
+		for _, op := range f.batch {
+			w.WriteByte(op.Op)
+			writeBytes(w, []byte(op.Key))
+			writeBytes(w, op.Value)
+		}
+	}
+	return nil
+}
+
+func readFrame(r *bufio.Reader) (*frame, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	f := &frame{kind: kind}
+	switch kind {
+	case frameChallenge:
+		if f.auth, err = readBytes(r); err != nil {
+			return nil, err
+		}
+	case frameHello, frameSnapshot:
+		if f.epoch, err = readUint64(r); err != nil {
+			return nil, err
+		}
+		if f.seq, err = readUint64(r); err != nil {
+			return nil, err
+		}
+		if kind == frameHello {
+			if f.auth, err = readBytes(r); err != nil {
+				return nil, err
+			}
+		}
+	case frameSnapshotEnd:
+	case frameBatch:
+		if f.seq, err = readUint64(r); err != nil {
+			return nil, err
+		}
+		storage, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		f.storage = string(storage)
+		count, err := readUint64(r)
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < count; i++ {
+			op := &interfaces.Operation{}
+			if op.Op, err = r.ReadByte(); err != nil {
+				return nil, err
+			}
+			key, err := readBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			op.Key = string(key)
+			if op.Value, err = readBytes(r); err != nil {
+				return nil, err
+			}
+			f.batch = append(f.batch, op)
+		}
+	default:
+		return nil, fmt.Errorf("unknown replication frame type %d", kind)
+	}
+	return f, nil
+}
+
+func writeUint64(w *bufio.Writer, value uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], value)
+	w.Write(buf[:])
+}
+
+func readUint64(r *bufio.Reader) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func writeBytes(w *bufio.Writer, value []byte) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(len(value)))
+	w.Write(buf[:])
+	w.Write(value)
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(buf[:])
+	if size > maxFieldSize {
+		return nil, fmt.Errorf("replication field size %d exceeds limit %d", size, maxFieldSize)
+	}
+	value := make([]byte, size)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
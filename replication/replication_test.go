@@ -0,0 +1,259 @@
+package replication
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/interfaces"
+	"github.com/valinurovam/garagemq/storage"
+)
+
+const testSecret = "secret"
+
+func newTestStorage(t *testing.T, dir string, name string) interfaces.DbStorage {
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(path, 0777); err != nil {
+		t.Fatal(err)
+	}
+	return storage.NewBadger(path)
+}
+
+func dump(db interfaces.DbStorage) map[string]string {
+	data := make(map[string]string)
+	db.Iterate(func(key []byte, value []byte) {
+		data[string(key)] = string(value)
+	})
+	return data
+}
+
+func waitSeq(t *testing.T, follower *Follower, seq uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for follower.Seq() != seq {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected follower at batch %d, actual %d", seq, follower.Seq())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func publish(t *testing.T, db interfaces.DbStorage, from int, to int) {
+	for i := from; i < to; i++ {
+		key := fmt.Sprintf("msg.q.%d", i)
+		if err := db.ProcessBatch([]*interfaces.Operation{{Key: key, Value: []byte(key), Op: interfaces.OpSet}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplication_FollowerConverges(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replication")
+	defer os.RemoveAll(dir)
+
+	leader := NewLeader(100, testSecret)
+	leaderDbs := map[string]interfaces.DbStorage{
+		"server":        newTestStorage(t, dir, "leader/server"),
+		"vhost_default": newTestStorage(t, dir, "leader/vhost_default"),
+	}
+	server := leader.Wrap("server", leaderDbs["server"])
+	vhost := leader.Wrap("vhost_default", leaderDbs["vhost_default"])
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go leader.Serve(listener)
+	defer leader.Close()
+
+	// written before follower connects, so they are received by snapshot
+	server.Set("vhost./", []byte("system"))
+	publish(t, vhost, 0, 10)
+	vhost.Del("msg.q.0")
+
+	follower := NewFollower(listener.Addr().String(), testSecret, func(name string) interfaces.DbStorage {
+		return newTestStorage(t, dir, "follower/"+name)
+	}, 10*time.Millisecond)
+	follower.Start()
+	waitSeq(t, follower, leader.Seq())
+
+	// streamed as tail
+	publish(t, vhost, 10, 20)
+	vhost.DeleteByPrefix([]byte("msg.q.1"))
+	waitSeq(t, follower, leader.Seq())
+
+	// missed while follower is disconnected, so received from retained tail on reconnect
+	leader.lock.Lock()
+	for f := range leader.followers {
+		leader.dropFollower(f)
+	}
+	leader.lock.Unlock()
+	publish(t, vhost, 20, 30)
+	waitSeq(t, follower, leader.Seq())
+
+	seq, err := follower.Promote()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != leader.Seq() {
+		t.Errorf("Expected promoted follower at batch %d, actual %d", leader.Seq(), seq)
+	}
+
+	// promoted follower storages are closed and can be opened as own ones
+	for name, leaderDb := range leaderDbs {
+		db := newTestStorage(t, dir, "follower/"+name)
+		if expected, actual := dump(leaderDb), dump(db); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Expected follower storage '%s' %v, actual %v", name, expected, actual)
+		}
+		db.Close()
+		leaderDb.Close()
+	}
+}
+
+func TestReplication_Snapshot_LeaderRestart(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replication")
+	defer os.RemoveAll(dir)
+
+	leaderDb := newTestStorage(t, dir, "leader")
+	defer leaderDb.Close()
+	leader := NewLeader(100, testSecret)
+	db := leader.Wrap("vhost_default", leaderDb)
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go leader.Serve(listener)
+	publish(t, db, 0, 5)
+
+	follower := NewFollower(listener.Addr().String(), testSecret, func(name string) interfaces.DbStorage {
+		return newTestStorage(t, dir, "follower/"+name)
+	}, 10*time.Millisecond)
+	follower.Start()
+	waitSeq(t, follower, leader.Seq())
+
+	// restarted leader has new epoch and sequence, so follower gets full snapshot of current state
+	leader.Close()
+	leaderDb.Del("msg.q.0")
+	leader = NewLeader(100, testSecret)
+	db = leader.Wrap("vhost_default", leaderDb)
+	listener, _ = net.Listen("tcp", listener.Addr().String())
+	go leader.Serve(listener)
+	defer leader.Close()
+	publish(t, db, 5, 7)
+
+	followerEpoch := func() uint64 {
+		follower.lock.Lock()
+		defer follower.lock.Unlock()
+		return follower.epoch
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for follower.Seq() != leader.Seq() || followerEpoch() != leader.epoch {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected follower converged with restarted leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	follower.Promote()
+
+	followerDb := newTestStorage(t, dir, "follower/vhost_default")
+	defer followerDb.Close()
+	if expected, actual := dump(leaderDb), dump(followerDb); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected follower storage %v, actual %v", expected, actual)
+	}
+}
+
+// dialLeader passes handshake signing challenge with given secret, follower starts from empty state
+func dialLeader(t *testing.T, addr string, secret string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	challenge, err := readFrame(reader)
+	if err != nil || challenge.kind != frameChallenge {
+		t.Fatalf("Expected challenge, actual %v, %v", challenge, err)
+	}
+	writer := bufio.NewWriter(conn)
+	writeFrame(writer, &frame{kind: frameHello, auth: sign(secret, challenge.auth)})
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader
+}
+
+func TestReplication_Handshake_WrongSecret(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replication")
+	defer os.RemoveAll(dir)
+
+	leaderDb := newTestStorage(t, dir, "leader")
+	defer leaderDb.Close()
+	leader := NewLeader(100, testSecret)
+	publish(t, leader.Wrap("vhost_default", leaderDb), 0, 5)
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go leader.Serve(listener)
+	defer leader.Close()
+
+	conn, reader := dialLeader(t, listener.Addr().String(), "wrong")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if f, err := readFrame(reader); err == nil {
+		t.Fatalf("Expected connection closed, actual frame %v", f)
+	}
+
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+	if len(leader.followers) != 0 {
+		t.Fatal("Expected follower is not registered")
+	}
+}
+
+// snapshot is written without lock, so follower which does not read it does not block writes
+func TestReplication_StalledFollower_WritesNotBlocked(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replication")
+	defer os.RemoveAll(dir)
+
+	leaderDb := newTestStorage(t, dir, "leader")
+	defer leaderDb.Close()
+	// snapshot is much larger than socket buffers
+	value := make([]byte, 1024)
+	for chunk := 0; chunk < 32; chunk++ {
+		batch := make([]*interfaces.Operation, 0, 1000)
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("msg.big.%d.%d", chunk, i)
+			batch = append(batch, &interfaces.Operation{Key: key, Value: value, Op: interfaces.OpSet})
+		}
+		if err := leaderDb.ProcessBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leader := NewLeader(100, testSecret)
+	db := leader.Wrap("vhost_default", leaderDb)
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go leader.Serve(listener)
+	defer leader.Close()
+
+	conn, _ := dialLeader(t, listener.Addr().String(), testSecret)
+	defer conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leader.lock.Lock()
+		registered := len(leader.followers)
+		leader.lock.Unlock()
+		if registered == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected follower is registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		publish(t, db, 0, 10)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected writes are not blocked by stalled follower")
+	}
+}
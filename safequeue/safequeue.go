@@ -64,7 +64,10 @@ func (queue *SafeQueue) Push(item *amqp.Message) {
 func (queue *SafeQueue) PushHead(item *amqp.Message) {
 	queue.Lock()
 	defer queue.Unlock()
+	queue.dirtyPushHead(item)
+}
 
+func (queue *SafeQueue) dirtyPushHead(item *amqp.Message) {
 	if queue.headPos == 0 {
 		buffer := make([][]*amqp.Message, len(queue.shards)+1)
 		copy(buffer[1:], queue.shards)
@@ -81,6 +84,41 @@ func (queue *SafeQueue) PushHead(item *amqp.Message) {
 	queue.head[queue.headPos] = item
 }
 
+// PushOrdered adds message before the first message with greater ID
+// Position is found by binary search, queued messages are expected to be ordered by ID
+func (queue *SafeQueue) PushOrdered(item *amqp.Message) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	lo, hi := uint64(0), queue.length
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if queue.item(mid).ID < item.ID {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	// messages before found position are shifted towards head
+	queue.dirtyPushHead(item)
+	for pos := uint64(0); pos < lo; pos++ {
+		queue.setItem(pos, queue.item(pos+1))
+	}
+	queue.setItem(lo, item)
+}
+
+// item returns message at position from head
+func (queue *SafeQueue) item(pos uint64) *amqp.Message {
+	abs := uint64(queue.headPos) + pos
+	return queue.shards[abs/uint64(queue.shardSize)][abs%uint64(queue.shardSize)]
+}
+
+func (queue *SafeQueue) setItem(pos uint64, item *amqp.Message) {
+	abs := uint64(queue.headPos) + pos
+	queue.shards[abs/uint64(queue.shardSize)][abs%uint64(queue.shardSize)] = item
+}
+
 // Pop retrieves message from head
 func (queue *SafeQueue) Pop() (item *amqp.Message) {
 	queue.Lock()
@@ -130,14 +168,30 @@ func (queue *SafeQueue) HeadItem() (res *amqp.Message) {
 	return queue.head[queue.headPos]
 }
 
+// Peek returns up to count messages from head in queue order without removing them
+func (queue *SafeQueue) Peek(count int) []*amqp.Message {
+	queue.RLock()
+	defer queue.RUnlock()
+	if count < 0 || uint64(count) > queue.length {
+		count = int(queue.length)
+	}
+	messages := make([]*amqp.Message, 0, count)
+	for pos := 0; pos < count; pos++ {
+		messages = append(messages, queue.item(uint64(pos)))
+	}
+	return messages
+}
+
 // DirtyPurge clear queue
 // This method is not thread safe
 func (queue *SafeQueue) DirtyPurge() {
 	queue.shards = [][]*amqp.Message{make([]*amqp.Message, queue.shardSize)}
 	queue.tailIdx = 0
 	queue.tail = queue.shards[queue.tailIdx]
+	queue.tailPos = 0
 	queue.headIdx = 0
 	queue.head = queue.shards[queue.headIdx]
+	queue.headPos = 0
 	queue.length = 0
 }
 
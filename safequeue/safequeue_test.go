@@ -63,6 +63,35 @@ func TestSafeQueue_PushHead(t *testing.T) {
 	}
 }
 
+func TestSafeQueue_PushOrdered(t *testing.T) {
+	// small shards to cross shards boundaries on ordered insert
+	shardSize := 8
+	queue := NewSafeQueue(shardSize)
+	queueLength := shardSize * 4
+	for item := 0; item < queueLength; item++ {
+		if item%3 == 0 {
+			continue
+		}
+		queue.Push(&amqp.Message{ID: uint64(item)})
+	}
+	for item := queueLength - 1; item >= 0; item-- {
+		if item%3 == 0 {
+			queue.PushOrdered(&amqp.Message{ID: uint64(item)})
+		}
+	}
+
+	if queue.Length() != uint64(queueLength) {
+		t.Fatalf("expected %d elements, have %d", queueLength, queue.Length())
+	}
+
+	for item := 0; item < queueLength; item++ {
+		pop := queue.Pop()
+		if uint64(item) != pop.ID {
+			t.Fatalf("Pop: expected %d, actual %d", item, pop.ID)
+		}
+	}
+}
+
 func TestSafeQueue_HeadItem(t *testing.T) {
 	queue := NewSafeQueue(SIZE)
 	queueLength := SIZE
@@ -107,4 +136,34 @@ func TestSafeQueue_Purge(t *testing.T) {
 	if nil != pop {
 		t.Fatalf("Pop: expected %v, actual %v", nil, pop)
 	}
+
+	queue.Push(&amqp.Message{ID: 1})
+	if pop = queue.Pop(); pop == nil || pop.ID != 1 {
+		t.Fatalf("Pop: expected message pushed after purge, actual %v", pop)
+	}
+}
+
+func TestSafeQueue_Peek(t *testing.T) {
+	queue := NewSafeQueue(SIZE)
+	queueLength := SIZE * 2
+	for item := 0; item < queueLength; item++ {
+		queue.Push(&amqp.Message{ID: uint64(item)})
+	}
+	queue.Pop()
+
+	peeked := queue.Peek(SIZE + 1)
+	if len(peeked) != SIZE+1 {
+		t.Fatalf("Peek: expected %d elements, actual %d", SIZE+1, len(peeked))
+	}
+	for i, message := range peeked {
+		if message.ID != uint64(i+1) {
+			t.Fatalf("Peek: expected ID %d, actual %d", i+1, message.ID)
+		}
+	}
+	if peeked = queue.Peek(-1); len(peeked) != queueLength-1 {
+		t.Fatalf("Peek: expected all %d elements, actual %d", queueLength-1, len(peeked))
+	}
+	if queue.Length() != uint64(queueLength-1) {
+		t.Fatalf("Peek: expected length %d kept, actual %d", queueLength-1, queue.Length())
+	}
 }
@@ -1,8 +1,12 @@
 package server
 
 import (
+	"fmt"
+
 	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/auth"
 	"github.com/valinurovam/garagemq/consumer"
+	"github.com/valinurovam/garagemq/exchange"
 	"github.com/valinurovam/garagemq/qos"
 	"github.com/valinurovam/garagemq/queue"
 )
@@ -27,11 +31,14 @@ func (channel *Channel) basicRoute(method amqp.Method) *amqp.Error {
 		return channel.basicGet(method)
 	}
 
-	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route basic method "+method.Name(), method.ClassIdentifier(), method.MethodIdentifier())
+	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route basic method "+method.Name(), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrUnknownMethod)
 }
 
 func (channel *Channel) basicQos(method *amqp.BasicQos) (err *amqp.Error) {
-	channel.updateQos(method.PrefetchCount, method.PrefetchSize, method.Global)
+	// non-global qos on channel with credit consumers grants credit instead of changing prefetch
+	if method.Global || !channel.grantCredit(uint32(method.PrefetchCount)) {
+		channel.updateQos(method.PrefetchCount, method.PrefetchSize, method.Global)
+	}
 	channel.SendMethod(&amqp.BasicQosOk{})
 
 	return nil
@@ -54,10 +61,26 @@ func (channel *Channel) basicPublish(method *amqp.BasicPublish) (err *amqp.Error
 		return amqp.NewChannelError(amqp.NotImplemented, "Immediate = true", method.ClassIdentifier(), method.MethodIdentifier())
 	}
 
-	if _, err = channel.getExchangeWithError(method.Exchange, method); err != nil {
+	if err = channel.checkAccessWithError(auth.AccessWrite, resourceExchange, method.Exchange, method); err != nil {
+		return err
+	}
+
+	var ex *exchange.Exchange
+	if ex, err = channel.getExchangeWithError(method.Exchange, method); err != nil {
 		return err
 	}
 
+	// @spec-note
+	// If set, the exchange may not be used directly by publishers, but only when bound to other exchanges.
+	if ex.IsInternal() {
+		return amqp.NewChannelError(
+			amqp.AccessRefused,
+			fmt.Sprintf("cannot publish to internal exchange '%s'", ex.GetName()),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		)
+	}
+
 	channel.currentMessage = amqp.NewMessage(method)
 	if channel.confirmMode {
 		channel.currentMessage.ConfirmMeta = &amqp.ConfirmMeta{
@@ -70,6 +93,14 @@ func (channel *Channel) basicPublish(method *amqp.BasicPublish) (err *amqp.Error
 }
 
 func (channel *Channel) basicConsume(method *amqp.BasicConsume) (err *amqp.Error) {
+	if method.Queue == directReplyToQueue {
+		return channel.consumeDirectReplyTo(method)
+	}
+
+	if err = channel.checkAccessWithError(auth.AccessRead, resourceQueue, method.Queue, method); err != nil {
+		return err
+	}
+
 	var cmr *consumer.Consumer
 	if cmr, err = channel.addConsumer(method); err != nil {
 		return err
@@ -79,14 +110,19 @@ func (channel *Channel) basicConsume(method *amqp.BasicConsume) (err *amqp.Error
 		channel.SendMethod(&amqp.BasicConsumeOk{ConsumerTag: cmr.Tag()})
 	}
 
+	channel.resumeConsumer(cmr)
 	cmr.Start()
 
 	return nil
 }
 
 func (channel *Channel) basicCancel(method *amqp.BasicCancel) (err *amqp.Error) {
+	if channel.cancelDirectReplyTo(method.ConsumerTag) {
+		channel.SendMethod(&amqp.BasicCancelOk{ConsumerTag: method.ConsumerTag})
+		return nil
+	}
 	if _, ok := channel.consumers[method.ConsumerTag]; !ok {
-		return amqp.NewChannelError(amqp.NotFound, "Consumer not found", method.ClassIdentifier(), method.MethodIdentifier())
+		return amqp.NewChannelError(amqp.NotFound, "Consumer not found", method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrConsumerNotFound)
 	}
 	channel.removeConsumer(method.ConsumerTag)
 	channel.SendMethod(&amqp.BasicCancelOk{ConsumerTag: method.ConsumerTag})
@@ -96,14 +132,21 @@ func (channel *Channel) basicCancel(method *amqp.BasicCancel) (err *amqp.Error)
 func (channel *Channel) basicGet(method *amqp.BasicGet) (err *amqp.Error) {
 	var qu *queue.Queue
 	var message *amqp.Message
+	if err = channel.checkAccessWithError(auth.AccessRead, resourceQueue, method.Queue, method); err != nil {
+		return err
+	}
 	if qu, err = channel.getQueueWithError(method.Queue, method); err != nil {
 		return err
 	}
 
+	if qu.IsStream() {
+		return channel.basicGetStream(qu, method)
+	}
+
 	if method.NoAck {
 		message = qu.Pop()
 	} else {
-		message = qu.PopQos([]*qos.AmqpQos{channel.qos, channel.conn.qos})
+		message = qu.PopQos([]*qos.AmqpQos{channel.qos, channel.conn.qos, channel.unackedLimit})
 	}
 
 	// how to handle if queue is not empty, but qos triggered and message is nil
@@ -115,6 +158,7 @@ func (channel *Channel) basicGet(method *amqp.BasicGet) (err *amqp.Error) {
 	dTag := channel.NextDeliveryTag()
 	if !method.NoAck {
 		channel.AddUnackedMessage(dTag, "", qu.GetName(), message)
+		qu.MarkDelivered(message)
 
 		qu.GetMetrics().Unacked.Counter.Inc(1)
 		channel.server.GetMetrics().Unacked.Counter.Inc(1)
@@ -125,7 +169,7 @@ func (channel *Channel) basicGet(method *amqp.BasicGet) (err *amqp.Error) {
 
 	channel.SendContent(&amqp.BasicGetOk{
 		DeliveryTag:  dTag,
-		Redelivered:  false,
+		Redelivered:  message.DeliveryCount > 0,
 		Exchange:     message.Exchange,
 		RoutingKey:   message.RoutingKey,
 		MessageCount: 1,
@@ -140,3 +184,40 @@ func (channel *Channel) basicGet(method *amqp.BasicGet) (err *amqp.Error) {
 
 	return nil
 }
+
+// basicGetStream reads message from stream queue at channel offset, which starts from the first retained message
+// Message is kept in stream, so queue length is not changed
+func (channel *Channel) basicGetStream(qu *queue.Queue, method *amqp.BasicGet) *amqp.Error {
+	var qosList []*qos.AmqpQos
+	if !method.NoAck {
+		qosList = []*qos.AmqpQos{channel.qos, channel.conn.qos, channel.unackedLimit}
+	}
+	message, next := qu.ReadStream(channel.streamOffsets[qu.GetName()], qosList)
+	if message == nil {
+		channel.SendMethod(&amqp.BasicGetEmpty{})
+		return nil
+	}
+	channel.streamOffsets[qu.GetName()] = next
+
+	dTag := channel.NextDeliveryTag()
+	if !method.NoAck {
+		channel.AddUnackedMessage(dTag, "", qu.GetName(), message)
+
+		qu.GetMetrics().Unacked.Counter.Inc(1)
+		channel.server.GetMetrics().Unacked.Counter.Inc(1)
+	}
+
+	channel.SendContent(&amqp.BasicGetOk{
+		DeliveryTag:  dTag,
+		Redelivered:  false,
+		Exchange:     message.Exchange,
+		RoutingKey:   message.RoutingKey,
+		MessageCount: uint32(qu.Length()),
+	}, message)
+
+	channel.server.GetMetrics().Get.Counter.Inc(1)
+	channel.metrics.Get.Counter.Inc(1)
+	qu.GetMetrics().Get.Counter.Inc(1)
+
+	return nil
+}
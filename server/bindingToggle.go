@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SetBindingsEnabled enables or disables bindings of exchange to destination queue or exchange with routing key
+// Disabled binding is kept with its definition, but messages are not routed by it until it is enabled again
+// Durable bindings are persisted with their state, returns count of changed bindings
+func (vhost *VirtualHost) SetBindingsEnabled(exName string, destination string, routingKey string, enabled bool) (int, error) {
+	if exName == exDefaultName {
+		return 0, fmt.Errorf("bindings of the default exchange can not be changed")
+	}
+	ex := vhost.GetExchange(exName)
+	if ex == nil {
+		return 0, fmt.Errorf("exchange '%s' not found", exName)
+	}
+
+	found := 0
+	changed := 0
+	for _, bind := range ex.GetBindings() {
+		if bind.GetQueue() != destination || bind.GetRoutingKey() != routingKey {
+			continue
+		}
+		found++
+		if bind.IsEnabled() == enabled {
+			continue
+		}
+		bind.SetEnabled(enabled)
+		changed++
+
+		durable := false
+		if bind.IsToExchange() {
+			dest := vhost.GetExchange(destination)
+			durable = dest != nil && dest.IsDurable()
+		} else if qu := vhost.GetQueue(destination); qu != nil {
+			durable = qu.IsDurable()
+		}
+		if ex.IsDurable() && durable {
+			vhost.PersistBinding(bind)
+		}
+		vhost.logger.WithFields(log.Fields{
+			"binding": bind.GetName(),
+			"enabled": enabled,
+		}).Info("Binding state changed")
+	}
+	if found == 0 {
+		return 0, fmt.Errorf("binding of exchange '%s' to '%s' with routing key '%s' not found", exName, destination, routingKey)
+	}
+	return changed, nil
+}
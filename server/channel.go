@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -11,6 +12,7 @@ import (
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/auth"
 	"github.com/valinurovam/garagemq/consumer"
 	"github.com/valinurovam/garagemq/exchange"
 	"github.com/valinurovam/garagemq/metrics"
@@ -19,6 +21,24 @@ import (
 	"github.com/valinurovam/garagemq/queue"
 )
 
+const (
+	consumerTimeoutArg = "x-consumer-timeout"
+	decompressArg      = "x-decompress"
+	prefetchWeightArg  = "x-prefetch-weight"
+	creditArg          = "x-credit"
+	ackBatchArg        = "x-ack-batch"
+)
+
+// frameOverhead is size of frame header and frame-end octet
+const frameOverhead = 8
+
+// resource types for access check, default exchange is checked by RabbitMQ name
+const (
+	resourceExchange = "exchange"
+	resourceQueue    = "queue"
+	exDefaultAlias   = "amq.default"
+)
+
 const (
 	channelNew = iota
 	channelOpen
@@ -57,11 +77,19 @@ type Channel struct {
 	consumerQos        *qos.AmqpQos
 	deliveryTag        uint64
 	confirmDeliveryTag uint64
+	lastActivity       int64 // unix nano time of the last incoming frame
 	confirmLock        sync.Mutex
 	confirmQueue       []*amqp.ConfirmMeta
+	confirmFlush       chan struct{}
 	ackLock            sync.Mutex
 	ackStore           map[uint64]*UnackedMessage
-	metrics            *ChannelMetricsState
+	replyToTag         string
+	replyToName        string
+	// offsets of the next message read by basic.get from stream queues, by queue name
+	streamOffsets map[string]uint64
+	metrics       *ChannelMetricsState
+	// operator cap of unacked messages, client can't change it by basic.qos
+	unackedLimit *qos.AmqpQos
 
 	bufferPool *pool.BufferPool
 
@@ -70,9 +98,10 @@ type Channel struct {
 
 // UnackedMessage represents the unacknowledged message
 type UnackedMessage struct {
-	cTag  string
-	msg   *amqp.Message
-	queue string
+	cTag        string
+	msg         *amqp.Message
+	queue       string
+	deliveredAt time.Time
 }
 
 // NewChannel returns new instance of Channel
@@ -84,26 +113,39 @@ func NewChannel(id uint16, conn *Connection) *Channel {
 		server: conn.server,
 		// for incoming channel much capacity is good for performance
 		// but it is difficult to implement processing already queued frames on shutdown or connection close
-		incoming:     make(chan *amqp.Frame, 128),
-		outgoing:     conn.outgoing,
-		status:       channelNew,
-		protoVersion: conn.server.protoVersion,
-		consumers:    make(map[string]*consumer.Consumer),
-		qos:          qos.NewAmqpQos(0, 0),
-		consumerQos:  qos.NewAmqpQos(0, 0),
-		ackStore:     make(map[uint64]*UnackedMessage),
-		confirmQueue: make([]*amqp.ConfirmMeta, 0),
-		closeCh:      make(chan bool),
-		bufferPool:   pool.NewBufferPool(0),
+		incoming:      make(chan *amqp.Frame, 128),
+		outgoing:      conn.outgoing,
+		status:        channelNew,
+		protoVersion:  conn.server.protoVersion,
+		consumers:     make(map[string]*consumer.Consumer),
+		qos:           qos.NewAmqpQos(0, 0),
+		consumerQos:   qos.NewAmqpQos(0, 0),
+		unackedLimit:  qos.NewAmqpQos(conn.server.config.Connection.MaxUnackedPerChannel, 0),
+		ackStore:      make(map[uint64]*UnackedMessage),
+		streamOffsets: make(map[string]uint64),
+		confirmQueue:  make([]*amqp.ConfirmMeta, 0),
+		confirmFlush:  make(chan struct{}, 1),
+		closeCh:       make(chan bool),
+		bufferPool:    pool.NewBufferPool(0),
+		lastActivity:  time.Now().UnixNano(),
 	}
 
 	channel.logger = log.WithFields(log.Fields{
 		"connectionId": conn.id,
 		"channelId":    id,
 	})
+	// channels are opened after connection.start-ok, so they are logged with connection name
+	if conn.clientName != "" {
+		channel.logger = channel.logger.WithField("connectionName", conn.clientName)
+	}
 
 	channel.initMetrics()
 
+	// channel inherits default prefetch of connection, channel 0 never delivers messages
+	if id != 0 && conn.defaultPrefetch > 0 {
+		channel.updateQos(conn.defaultPrefetch, 0, false)
+	}
+
 	return channel
 }
 
@@ -136,7 +178,7 @@ func (channel *Channel) handleIncoming() {
 	for {
 		select {
 		case <-channel.closeCh:
-			channel.close()
+			channel.close(true)
 			return
 		case frame := <-channel.incoming:
 			if frame == nil {
@@ -148,11 +190,12 @@ func (channel *Channel) handleIncoming() {
 			case amqp.FrameMethod:
 				buffer.Reset(frame.Payload)
 				method, err := amqp.ReadMethod(buffer, channel.protoVersion)
-				channel.logger.Debug("Incoming method <- " + method.Name())
 				if err != nil {
 					channel.logger.WithError(err).Error("Error on handling frame")
-					channel.sendError(amqp.NewConnectionError(amqp.FrameError, err.Error(), 0, 0))
+					channel.sendError(amqp.NewConnectionError(amqp.FrameError, err.Error(), 0, 0).WithCode(amqp.ErrMalformedFrame))
+					continue
 				}
+				channel.logger.Debug("Incoming method <- " + method.Name())
 
 				if err := channel.handleMethod(method); err != nil {
 					channel.sendError(err)
@@ -171,9 +214,9 @@ func (channel *Channel) handleIncoming() {
 }
 
 func (channel *Channel) sendError(err *amqp.Error) {
-	channel.logger.Error(err)
 	switch err.ErrorType {
 	case amqp.ErrorOnChannel:
+		channel.logger.Error(err)
 		channel.status = channelClosing
 		channel.SendMethod(&amqp.ChannelClose{
 			ReplyCode: err.ReplyCode,
@@ -182,15 +225,7 @@ func (channel *Channel) sendError(err *amqp.Error) {
 			MethodID:  err.MethodID,
 		})
 	case amqp.ErrorOnConnection:
-		ch := channel.conn.getChannel(0)
-		if ch != nil {
-			ch.SendMethod(&amqp.ConnectionClose{
-				ReplyCode: err.ReplyCode,
-				ReplyText: err.ReplyText,
-				ClassID:   err.ClassID,
-				MethodID:  err.MethodID,
-			})
-		}
+		channel.conn.forceClose(err)
 	}
 }
 
@@ -214,30 +249,68 @@ func (channel *Channel) handleMethod(method amqp.Method) *amqp.Error {
 }
 
 func (channel *Channel) handleContentHeader(headerFrame *amqp.Frame) *amqp.Error {
+	// content of message refused before channel.close is discarded
+	if channel.status == channelClosing {
+		return nil
+	}
+
 	reader := bytes.NewReader(headerFrame.Payload)
 	var err error
 	if channel.currentMessage == nil {
-		return amqp.NewConnectionError(amqp.FrameError, "unexpected content header frame", 0, 0)
+		return amqp.NewConnectionError(amqp.FrameError, "unexpected content header frame", 0, 0).WithCode(amqp.ErrUnexpectedFrame)
 	}
 
 	if channel.currentMessage.Header != nil {
-		return amqp.NewConnectionError(amqp.FrameError, "unexpected content header frame - header already exists", 0, 0)
+		return amqp.NewConnectionError(amqp.FrameError, "unexpected content header frame - header already exists", 0, 0).WithCode(amqp.ErrUnexpectedFrame)
 	}
 
 	if channel.currentMessage.Header, err = amqp.ReadContentHeader(reader, channel.protoVersion); err != nil {
-		return amqp.NewConnectionError(amqp.FrameError, "error on parsing content header frame", 0, 0)
+		return amqp.NewConnectionError(amqp.FrameError, "error on parsing content header frame", 0, 0).WithCode(amqp.ErrMalformedFrame)
+	}
+
+	if channel.server.config.Vhost.StrictProperties {
+		err = channel.currentMessage.Header.Validate()
+		if err == nil && reader.Len() > 0 {
+			err = fmt.Errorf("unexpected %d bytes after property list", reader.Len())
+		}
+		if err != nil {
+			channel.currentMessage = nil
+			return amqp.NewChannelError(amqp.PreconditionFailed, err.Error(), amqp.ClassBasic, amqp.MethodBasicPublish).WithCode(amqp.ErrInvalidProperty)
+		}
+	}
+
+	// user-id property, if set, must be equal to authenticated user to prevent impersonation
+	props := channel.currentMessage.Header.PropertyList
+	if props != nil && props.UserID != nil && *props.UserID != channel.conn.userName {
+		channel.currentMessage = nil
+		return amqp.NewChannelError(
+			amqp.AccessRefused,
+			fmt.Sprintf("user_id property set to '%s' but authenticated user was '%s'", *props.UserID, channel.conn.userName),
+			amqp.ClassBasic,
+			amqp.MethodBasicPublish,
+		).WithCode(amqp.ErrUserIDMismatch)
+	}
+
+	// timestamp set by publisher is never overwritten
+	if channel.server.config.Vhost.StampTimestamp && props.Timestamp == nil {
+		timestamp := time.Now()
+		props.Timestamp = &timestamp
 	}
 
 	return nil
 }
 
 func (channel *Channel) handleContentBody(bodyFrame *amqp.Frame) *amqp.Error {
+	if channel.status == channelClosing {
+		return nil
+	}
+
 	if channel.currentMessage == nil {
-		return amqp.NewConnectionError(amqp.FrameError, "unexpected content body frame", 0, 0)
+		return amqp.NewConnectionError(amqp.FrameError, "unexpected content body frame", 0, 0).WithCode(amqp.ErrUnexpectedFrame)
 	}
 
 	if channel.currentMessage.Header == nil {
-		return amqp.NewConnectionError(amqp.FrameError, "unexpected content body frame - no header yet", 0, 0)
+		return amqp.NewConnectionError(amqp.FrameError, "unexpected content body frame - no header yet", 0, 0).WithCode(amqp.ErrUnexpectedFrame)
 	}
 
 	channel.currentMessage.Append(bodyFrame)
@@ -248,64 +321,38 @@ func (channel *Channel) handleContentBody(bodyFrame *amqp.Frame) *amqp.Error {
 
 	vhost := channel.conn.GetVirtualHost()
 	message := channel.currentMessage
-	ex := vhost.GetExchange(message.Exchange)
-	if ex == nil {
-		channel.SendContent(
-			&amqp.BasicReturn{ReplyCode: amqp.NoRoute, ReplyText: "No route", Exchange: message.Exchange, RoutingKey: message.RoutingKey},
-			message,
-		)
-
-		channel.addConfirm(message.ConfirmMeta)
-
-		return nil
-	}
-	ex.GetMetrics().MsgIn.Counter.Inc(1)
-	matchedQueues := ex.GetMatchedQueues(message)
-
-	if len(matchedQueues) == 0 {
-		if message.Mandatory {
+	opts := PublishOpts{
+		Mandatory: message.Mandatory,
+		User:      channel.conn.userName,
+		Done:      channel.conn.ctx.Done(),
+		Return: func(message *amqp.Message) {
 			channel.SendContent(
 				&amqp.BasicReturn{ReplyCode: amqp.NoRoute, ReplyText: "No route", Exchange: message.Exchange, RoutingKey: message.RoutingKey},
 				message,
 			)
-		}
-
-		channel.addConfirm(message.ConfirmMeta)
-
-		return nil
+		},
+		CheckAlias: channel.checkAliasTarget,
 	}
-
-	channel.server.GetMetrics().Publish.Counter.Inc(1)
-	channel.metrics.Publish.Counter.Inc(1)
-
 	if channel.confirmMode {
-		message.ConfirmMeta.ExpectedConfirms = len(matchedQueues)
+		opts.Confirm = channel.addConfirm
+	}
+	// direct reply is not routed, so draining vhost refuses it before
+	if vhost.IsDraining() {
+		return opts.refuse(message, vhost.drainingError())
+	}
+	if err := channel.rewriteDirectReplyTo(message); err != nil {
+		return err
+	}
+	if isDirectReplyTo(message) {
+		channel.publishDirectReply(message)
+		return nil
 	}
 
-	for queueName := range matchedQueues {
-		qu := channel.conn.GetVirtualHost().GetQueue(queueName)
-		if qu == nil {
-			if message.Mandatory {
-				channel.SendContent(
-					&amqp.BasicReturn{ReplyCode: amqp.NoRoute, ReplyText: "No route", Exchange: message.Exchange, RoutingKey: message.RoutingKey},
-					message,
-				)
-			}
-
-			channel.addConfirm(message.ConfirmMeta)
-
-			return nil
-		}
-
-		qu.Push(message)
-
-		ex.GetMetrics().MsgOut.Counter.Inc(1)
-
-		if channel.confirmMode && message.ConfirmMeta.CanConfirm() && !message.IsPersistent() {
-			channel.addConfirm(message.ConfirmMeta)
-		}
+	pushed, err := vhost.publish(message, opts)
+	if pushed > 0 {
+		channel.metrics.Publish.Counter.Inc(1)
 	}
-	return nil
+	return err
 }
 
 // SendMethod send method to client
@@ -334,11 +381,19 @@ func (channel *Channel) sendOutgoing(frame *amqp.Frame) {
 			close(channel.outgoing)
 		}
 	case channel.outgoing <- frame:
+		channel.conn.output.add(len(frame.Payload))
 	}
 }
 
 // SendContent send message to consumers or returns to publishers
 func (channel *Channel) SendContent(method amqp.Method, message *amqp.Message) {
+	// body compressed by queue transparently is restored, so client receives message as it was published
+	if message.IsBrokerGzipped() {
+		if restored, err := message.Gunzipped(int(channel.conn.maxFrameSize) - frameOverhead); err == nil {
+			message = restored
+		}
+	}
+
 	channel.SendMethod(method)
 
 	var rawHeader = channel.bufferPool.Get()
@@ -350,9 +405,10 @@ func (channel *Channel) SendContent(method amqp.Method, message *amqp.Message) {
 
 	channel.sendOutgoing(&amqp.Frame{Type: byte(amqp.FrameHeader), ChannelID: channel.id, Payload: payload, CloseAfter: false})
 
-	for _, payload := range message.Body {
-		payload.ChannelID = channel.id
-		channel.sendOutgoing(payload)
+	// message body is shared between all queues it was routed to, so body frames are not modified here,
+	// each delivery gets own frame with the same payload
+	for _, frame := range message.Body {
+		channel.sendOutgoing(&amqp.Frame{Type: frame.Type, ChannelID: channel.id, Payload: frame.Payload, CloseAfter: false})
 	}
 
 	switch method.(type) {
@@ -372,11 +428,32 @@ func (channel *Channel) addConfirm(meta *amqp.ConfirmMeta) {
 		return
 	}
 	channel.confirmQueue = append(channel.confirmQueue, meta)
+	if batchSize := channel.server.config.Connection.ConfirmBatchSize; batchSize > 0 && len(channel.confirmQueue) >= batchSize {
+		select {
+		case channel.confirmFlush <- struct{}{}:
+		default:
+		}
+	}
 }
 
 func (channel *Channel) sendConfirms() {
-	tick := time.Tick(20 * time.Millisecond)
-	for range tick {
+	interval := channel.server.config.Connection.ConfirmBatchInterval
+	batchSize := channel.server.config.Connection.ConfirmBatchSize
+	var batch *confirmBatch
+	if interval > 0 || batchSize > 0 {
+		batch = newConfirmBatch()
+	}
+	if interval == 0 {
+		interval = 20 * time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-channel.confirmFlush:
+		}
 		if channel.status == channelClosed {
 			return
 		}
@@ -385,13 +462,24 @@ func (channel *Channel) sendConfirms() {
 		channel.confirmQueue = make([]*amqp.ConfirmMeta, 0)
 		channel.confirmLock.Unlock()
 
+		var methods []amqp.Method
+		if batch != nil {
+			methods = batch.methods(currentConfirms)
+		} else {
+			methods = make([]amqp.Method, 0, len(currentConfirms))
+			for _, confirm := range currentConfirms {
+				methods = append(methods, confirmMethod(confirm))
+			}
+		}
+		for _, method := range methods {
+			channel.SendMethod(method)
+		}
+
 		for _, confirm := range currentConfirms {
-			channel.SendMethod(&amqp.BasicAck{
-				DeliveryTag: confirm.DeliveryTag,
-				Multiple:    false,
-			})
-			channel.server.GetMetrics().Confirm.Counter.Inc(1)
-			channel.metrics.Confirm.Counter.Inc(1)
+			if !confirm.Nack {
+				channel.server.GetMetrics().Confirm.Counter.Inc(1)
+				channel.metrics.Confirm.Counter.Inc(1)
+			}
 		}
 	}
 }
@@ -407,21 +495,98 @@ func (channel *Channel) addConsumer(method *amqp.BasicConsume) (cmr *consumer.Co
 
 	var consumerQos []*qos.AmqpQos
 	if channel.server.protoVersion == amqp.Proto091 {
-		consumerQos = []*qos.AmqpQos{channel.qos, channel.conn.qos}
+		consumerQos = []*qos.AmqpQos{channel.qos, channel.conn.qos, channel.unackedLimit}
 	} else {
 		cmrQos := channel.consumerQos.Copy()
-		consumerQos = []*qos.AmqpQos{channel.qos, cmrQos}
+		consumerQos = []*qos.AmqpQos{channel.qos, cmrQos, channel.unackedLimit}
 	}
 
-	cmr = consumer.NewConsumer(method.Queue, method.ConsumerTag, method.NoAck, channel, qu, consumerQos)
+	cmr = consumer.NewConsumer(method.Queue, method.ConsumerTag, method.NoAck, channel, qu, consumerQos, channel.conn.scheduler)
 	if _, ok := channel.consumers[cmr.Tag()]; ok {
-		return nil, amqp.NewChannelError(amqp.NotAllowed, fmt.Sprintf("Consumer with tag '%s' already exists", cmr.Tag()), method.ClassIdentifier(), method.MethodIdentifier())
+		return nil, amqp.NewChannelError(amqp.NotAllowed, fmt.Sprintf("Consumer with tag '%s' already exists", cmr.Tag()), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrConsumerTagInUse)
+	}
+
+	if method.Arguments != nil {
+		if _, ok := (*method.Arguments)[consumerTimeoutArg]; ok {
+			timeout, ok := method.Arguments.Int64(consumerTimeoutArg)
+			if !ok || timeout < 0 {
+				return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("invalid %s argument", consumerTimeoutArg), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrInvalidArgument)
+			}
+			cmr.SetAckTimeout(time.Duration(timeout) * time.Millisecond)
+		}
+		if _, ok := (*method.Arguments)[closeGraceArg]; ok {
+			grace, ok := method.Arguments.Int64(closeGraceArg)
+			if !ok || grace < 0 {
+				return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("invalid %s argument", closeGraceArg), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrInvalidArgument)
+			}
+			closeGrace := time.Duration(grace) * time.Millisecond
+			if maxGrace := channel.server.config.Connection.CloseAckGraceMax; closeGrace > maxGrace {
+				closeGrace = maxGrace
+			}
+			cmr.SetCloseGrace(closeGrace)
+		}
+		if value, ok := (*method.Arguments)[decompressArg]; ok {
+			decompress, ok := value.(bool)
+			if !ok {
+				return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("invalid %s argument", decompressArg), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrInvalidArgument)
+			}
+			if decompress {
+				cmr.SetDecompress(int(channel.conn.maxFrameSize) - frameOverhead)
+			}
+		}
+		if _, ok := (*method.Arguments)[prefetchWeightArg]; ok {
+			weight, ok := method.Arguments.Int64(prefetchWeightArg)
+			if !ok || weight <= 0 {
+				return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("invalid %s argument", prefetchWeightArg), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrInvalidArgument)
+			}
+			cmr.SetPrefetchWeight(weight)
+		}
+		if _, ok := (*method.Arguments)[creditArg]; ok {
+			credit, ok := method.Arguments.Int64(creditArg)
+			if !ok || credit < 0 || credit > math.MaxUint32 {
+				return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("invalid %s argument", creditArg), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrInvalidArgument)
+			}
+			cmr.EnableCredit(uint32(credit))
+		}
+		if _, ok := (*method.Arguments)[ackBatchArg]; ok {
+			size, ok := method.Arguments.Int64(ackBatchArg)
+			if !ok || size <= 0 || size > math.MaxUint16 {
+				return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("invalid %s argument", ackBatchArg), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrInvalidArgument)
+			}
+			cmr.SetAckBatch(int(size))
+		}
+		if value, ok := (*method.Arguments)[consumerIDArg]; ok {
+			id, ok := value.(string)
+			if !ok || id == "" {
+				return nil, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("invalid %s argument", consumerIDArg), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrInvalidArgument)
+			}
+			if !channel.conn.GetVirtualHost().canResume(channel.conn.userName, id, qu.GetName()) {
+				return nil, amqp.NewChannelError(amqp.AccessRefused, fmt.Sprintf("%s '%s' is owned by other user", consumerIDArg, id), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrAccessDenied)
+			}
+			// no-ack consumer has no unacked messages to keep
+			if !method.NoAck {
+				cmr.SetResumeID(id)
+			}
+		}
+	}
+
+	if qu.IsStream() {
+		var value interface{}
+		if method.Arguments != nil {
+			value = (*method.Arguments)[queue.StreamOffsetArg]
+		}
+		offset, offsetErr := qu.StreamOffset(value)
+		if offsetErr != nil {
+			return nil, amqp.NewChannelError(amqp.PreconditionFailed, offsetErr.Error(), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrInvalidArgument)
+		}
+		cmr.SetStreamOffset(offset)
 	}
 
 	if quErr := qu.AddConsumer(cmr, method.Exclusive); quErr != nil {
 		return nil, amqp.NewChannelError(amqp.AccessRefused, quErr.Error(), method.ClassIdentifier(), method.MethodIdentifier())
 	}
 	channel.consumers[cmr.Tag()] = cmr
+	channel.splitPrefetch()
 
 	return cmr, nil
 }
@@ -432,20 +597,79 @@ func (channel *Channel) removeConsumer(cTag string) {
 	if cmr, ok := channel.consumers[cTag]; ok {
 		cmr.Stop()
 		delete(channel.consumers, cmr.Tag())
+		channel.splitPrefetch()
+	}
+}
+
+// splitPrefetch splits shared channel prefetch between channel consumers proportionally to their x-prefetch-weight,
+// consumers without weight have weight 1 and prefetch is not split if none of consumers has weight
+// Share of consumer is reserved for it even if its queue is empty
+// Must be called under cmrLock each time channel consumers or channel qos are changed
+func (channel *Channel) splitPrefetch() {
+	var totalWeight int64
+	weighted := false
+	for _, cmr := range channel.consumers {
+		weight := cmr.PrefetchWeight()
+		if weight > 0 {
+			weighted = true
+		} else {
+			weight = 1
+		}
+		totalWeight += weight
+	}
+
+	prefetchCount := int64(channel.qos.PrefetchCount())
+	prefetchSize := int64(channel.qos.PrefetchSize())
+	for _, cmr := range channel.consumers {
+		if !weighted {
+			cmr.ShareQos().Update(0, 0)
+			continue
+		}
+		weight := cmr.PrefetchWeight()
+		if weight == 0 {
+			weight = 1
+		}
+		cmr.ShareQos().Update(uint16(prefetchShare(prefetchCount, weight, totalWeight)), uint32(prefetchShare(prefetchSize, weight, totalWeight)))
 	}
 }
 
-func (channel *Channel) close() {
+// prefetchShare returns weighted share of prefetch limit, non-zero limit gives at least 1 to each consumer
+func prefetchShare(limit int64, weight int64, totalWeight int64) int64 {
+	if limit == 0 {
+		return 0
+	}
+	if share := limit * weight / totalWeight; share > 0 {
+		return share
+	}
+	return 1
+}
+
+// close stops consumers and requeues unacked messages, on connection teardown acks left unhandled
+// in incoming buffer are handled before requeue within close grace
+func (channel *Channel) close(teardown bool) {
 	channel.cmrLock.Lock()
+	resumeIDs := make(map[string]string)
+	grace := channel.server.config.Connection.CloseAckGrace
 	for _, cmr := range channel.consumers {
+		if cmr.CloseGrace() > grace {
+			grace = cmr.CloseGrace()
+		}
+		if cmr.ResumeID() != "" {
+			resumeIDs[cmr.Tag()] = cmr.ResumeID()
+		}
 		cmr.Stop()
 		delete(channel.consumers, cmr.Tag())
 		channel.logger.WithFields(log.Fields{
 			"consumerTag": cmr.Tag(),
 		}).Info("Consumer stopped")
 	}
+	channel.clearDirectReplyTo()
 	channel.cmrLock.Unlock()
 	if channel.id > 0 {
+		if teardown {
+			channel.handleInflightAcks(grace)
+		}
+		channel.retainUnacked(resumeIDs)
 		channel.handleReject(0, true, true, &amqp.BasicNack{})
 	}
 	channel.status = channelClosed
@@ -461,16 +685,50 @@ func (channel *Channel) updateQos(prefetchCount uint16, prefetchSize uint32, glo
 	if channel.server.protoVersion == amqp.Proto091 {
 		if global {
 			channel.conn.qos.Update(prefetchCount, prefetchSize)
-		} else {
-			channel.qos.Update(prefetchCount, prefetchSize)
+			// connection qos is shared by all channels, so all of them should re-check the delivery gate
+			for _, ch := range channel.conn.getChannels() {
+				ch.wakeConsumers()
+			}
+			return
 		}
+		channel.qos.Update(prefetchCount, prefetchSize)
 	} else {
 		if global {
 			channel.qos.Update(prefetchCount, prefetchSize)
 		} else {
+			// per-consumer qos applied only for new consumers
 			channel.consumerQos.Update(prefetchCount, prefetchSize)
+			return
 		}
 	}
+
+	channel.wakeConsumers()
+}
+
+// wakeConsumers signals all channel consumers to try to pop the next message
+// Used when qos limits are changed, otherwise consumers blocked by qos wait until next ack,
+// shared prefetch is split again by new limits
+func (channel *Channel) wakeConsumers() {
+	channel.cmrLock.Lock()
+	defer channel.cmrLock.Unlock()
+	channel.splitPrefetch()
+	for _, cmr := range channel.consumers {
+		cmr.Consume()
+	}
+}
+
+// grantCredit adds credit to all channel consumers in credit mode
+// Returns false if channel has no such consumers
+func (channel *Channel) grantCredit(credit uint32) bool {
+	channel.cmrLock.Lock()
+	defer channel.cmrLock.Unlock()
+	granted := false
+	for _, cmr := range channel.consumers {
+		if cmr.GrantCredit(credit) {
+			granted = true
+		}
+	}
+	return granted
 }
 
 func (channel *Channel) GetQos() *qos.AmqpQos {
@@ -491,9 +749,10 @@ func (channel *Channel) AddUnackedMessage(dTag uint64, cTag string, queue string
 	channel.ackLock.Lock()
 	defer channel.ackLock.Unlock()
 	channel.ackStore[dTag] = &UnackedMessage{
-		cTag:  cTag,
-		msg:   message,
-		queue: queue,
+		cTag:        cTag,
+		msg:         message,
+		queue:       queue,
+		deliveredAt: time.Now(),
 	}
 	channel.metrics.Unacked.Counter.Inc(1)
 }
@@ -515,7 +774,7 @@ func (channel *Channel) handleAck(method *amqp.BasicAck) *amqp.Error {
 	}
 
 	if uMsg, msgFound = channel.ackStore[method.DeliveryTag]; !msgFound {
-		return amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("Delivery tag [%d] not found", method.DeliveryTag), method.ClassIdentifier(), method.MethodIdentifier())
+		return amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("Delivery tag [%d] not found", method.DeliveryTag), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrUnknownDeliveryTag)
 	}
 
 	channel.ackMsg(uMsg, method.DeliveryTag)
@@ -563,7 +822,7 @@ func (channel *Channel) handleReject(deliveryTag uint64, multiple bool, requeue
 	}
 
 	if uMsg, msgFound = channel.ackStore[deliveryTag]; !msgFound {
-		return amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("Delivery tag [%d] not found", deliveryTag), method.ClassIdentifier(), method.MethodIdentifier())
+		return amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("Delivery tag [%d] not found", deliveryTag), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrUnknownDeliveryTag)
 	}
 
 	channel.rejectMsg(uMsg, deliveryTag, requeue)
@@ -592,17 +851,116 @@ func (channel *Channel) rejectMsg(unackedMessage *UnackedMessage, deliveryTag ui
 	channel.decQosAndConsumerNext(unackedMessage)
 }
 
+// requeueExpiredUnacked requeues messages which were not acked within consumer timeout
+// if cancelStuck is set consumers which exceeded timeout are cancelled before requeue
+func (channel *Channel) requeueExpiredUnacked(now time.Time, cancelStuck bool) {
+	channel.ackLock.Lock()
+	defer channel.ackLock.Unlock()
+
+	defaultTimeout := channel.server.config.Connection.ConsumerTimeout
+	expiredTags := make([]uint64, 0)
+	stuckTags := make(map[string]bool)
+	stuck := make([]string, 0)
+
+	channel.cmrLock.RLock()
+	for dTag, uMsg := range channel.ackStore {
+		timeout := defaultTimeout
+		if cmr, ok := channel.consumers[uMsg.cTag]; ok && cmr.AckTimeout() > 0 {
+			timeout = cmr.AckTimeout()
+		}
+		if timeout == 0 || now.Sub(uMsg.deliveredAt) < timeout {
+			continue
+		}
+		expiredTags = append(expiredTags, dTag)
+		if _, ok := channel.consumers[uMsg.cTag]; ok && !stuckTags[uMsg.cTag] {
+			stuckTags[uMsg.cTag] = true
+			stuck = append(stuck, uMsg.cTag)
+		}
+	}
+	channel.cmrLock.RUnlock()
+
+	if len(expiredTags) == 0 {
+		return
+	}
+
+	if cancelStuck {
+		for _, cTag := range stuck {
+			channel.cancelConsumer(cTag)
+		}
+	}
+
+	// requeue in reverse order, so messages keep their order in the head of queue
+	sort.Slice(
+		expiredTags,
+		func(i, j int) bool {
+			return expiredTags[i] > expiredTags[j]
+		},
+	)
+	for _, dTag := range expiredTags {
+		channel.logger.WithFields(log.Fields{
+			"deliveryTag": dTag,
+		}).Warn("Consumer acknowledgement timeout, message requeued")
+		channel.rejectMsg(channel.ackStore[dTag], dTag, true)
+	}
+}
+
+// requeueQueueUnacked requeues all messages of queue delivered by channel and not acked yet,
+// returns count of requeued messages
+func (channel *Channel) requeueQueueUnacked(queueName string) int {
+	channel.ackLock.Lock()
+	defer channel.ackLock.Unlock()
+
+	tags := make([]uint64, 0)
+	for dTag, uMsg := range channel.ackStore {
+		if uMsg.queue == queueName {
+			tags = append(tags, dTag)
+		}
+	}
+
+	// requeue in reverse order, so messages keep their order in the head of queue
+	sort.Slice(
+		tags,
+		func(i, j int) bool {
+			return tags[i] > tags[j]
+		},
+	)
+	for _, dTag := range tags {
+		channel.rejectMsg(channel.ackStore[dTag], dTag, true)
+	}
+	return len(tags)
+}
+
+// cancelConsumer stops consumer and notifies client with basic.cancel
+func (channel *Channel) cancelConsumer(cTag string) {
+	channel.cmrLock.Lock()
+	cmr, ok := channel.consumers[cTag]
+	if ok {
+		delete(channel.consumers, cTag)
+	}
+	channel.cmrLock.Unlock()
+
+	if ok {
+		cmr.Cancel()
+		channel.logger.WithFields(log.Fields{
+			"consumerTag": cTag,
+		}).Info("Consumer cancelled")
+	}
+}
+
 func (channel *Channel) decQosAndConsumerNext(unackedMessage *UnackedMessage) {
 	channel.cmrLock.RLock()
 	if cmr, ok := channel.consumers[unackedMessage.cTag]; ok {
-		cmr.Consume()
+		cmr.Acked()
 
 		for _, amqpQos := range cmr.Qos() {
 			amqpQos.Dec(1, uint32(unackedMessage.msg.BodySize))
 		}
+		// qos is released before consumer turn, burst delivery checks free prefetch
+		cmr.Consume()
 	} else {
 		channel.qos.Dec(1, uint32(unackedMessage.msg.BodySize))
 		channel.conn.qos.Dec(1, uint32(unackedMessage.msg.BodySize))
+		channel.unackedLimit.Dec(1, uint32(unackedMessage.msg.BodySize))
 	}
 	channel.cmrLock.RUnlock()
 }
@@ -615,7 +973,7 @@ func (channel *Channel) getExchangeWithError(exchangeName string, method amqp.Me
 			fmt.Sprintf("exchange '%s' not found", exchangeName),
 			method.ClassIdentifier(),
 			method.MethodIdentifier(),
-		)
+		).WithCode(amqp.ErrExchangeNotFound)
 	}
 	return ex, nil
 }
@@ -628,7 +986,7 @@ func (channel *Channel) getQueueWithError(queueName string, method amqp.Method)
 			fmt.Sprintf("queue '%s' not found", queueName),
 			method.ClassIdentifier(),
 			method.MethodIdentifier(),
-		)
+		).WithCode(amqp.ErrQueueNotFound)
 	}
 	return qu, nil
 }
@@ -643,16 +1001,41 @@ func (channel *Channel) checkQueueLockWithError(qu *queue.Queue, method amqp.Met
 			fmt.Sprintf("queue '%s' is locked to another connection", qu.GetName()),
 			method.ClassIdentifier(),
 			method.MethodIdentifier(),
-		)
+		).WithCode(amqp.ErrQueueLocked)
 	}
 
 	return nil
 }
 
+// checkAccessWithError checks authenticated user access to resource of connection vhost
+func (channel *Channel) checkAccessWithError(access auth.Access, resourceType string, resource string, method amqp.Method) *amqp.Error {
+	if resourceType == resourceExchange && resource == exDefaultName {
+		resource = exDefaultAlias
+	}
+	if channel.conn.getAuthorizer().Allowed(channel.conn.userName, channel.conn.vhostName, access, resource) {
+		return nil
+	}
+	return amqp.NewChannelError(
+		amqp.AccessRefused,
+		fmt.Sprintf("access to %s '%s' in vhost '%s' refused for user '%s'", resourceType, resource, channel.conn.vhostName, channel.conn.userName),
+		method.ClassIdentifier(),
+		method.MethodIdentifier(),
+	).WithCode(amqp.ErrAccessDenied)
+}
+
 func (channel *Channel) isActive() bool {
 	return channel.active
 }
 
+// isIdle returns true if channel has no consumers and there were no incoming frames for given timeout
+func (channel *Channel) isIdle(now time.Time, timeout time.Duration) bool {
+	if channel.status != channelOpen || channel.GetConsumersCount() > 0 {
+		return false
+	}
+
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&channel.lastActivity))) >= timeout
+}
+
 func (channel *Channel) changeFlow(active bool) {
 	if channel.active == active {
 		return
@@ -678,6 +1061,13 @@ func (channel *Channel) GetConsumersCount() int {
 	return len(channel.consumers)
 }
 
+// GetUnackedCount returns count of messages delivered by channel and not acked yet
+func (channel *Channel) GetUnackedCount() int {
+	channel.ackLock.Lock()
+	defer channel.ackLock.Unlock()
+	return len(channel.ackStore)
+}
+
 // GetMetrics returns metrics
 func (channel *Channel) GetMetrics() *ChannelMetricsState {
 	return channel.metrics
@@ -16,7 +16,7 @@ func (channel *Channel) channelRoute(method amqp.Method) *amqp.Error {
 		return channel.channelFlow(method)
 	}
 
-	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route channel method "+method.Name(), method.ClassIdentifier(), method.MethodIdentifier())
+	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route channel method "+method.Name(), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrUnknownMethod)
 }
 
 func (channel *Channel) channelOpen(method *amqp.ChannelOpen) (err *amqp.Error) {
@@ -35,11 +35,15 @@ func (channel *Channel) channelOpen(method *amqp.ChannelOpen) (err *amqp.Error)
 func (channel *Channel) channelClose(method *amqp.ChannelClose) (err *amqp.Error) {
 	channel.status = channelClosed
 	channel.SendMethod(&amqp.ChannelCloseOk{})
-	channel.close()
+	channel.close(false)
 	return nil
 }
 
 func (channel *Channel) channelCloseOk(method *amqp.ChannelCloseOk) (err *amqp.Error) {
+	// channel was closed by server, so consumers and unacked messages should be released
+	if channel.status == channelClosing {
+		channel.close(false)
+	}
 	channel.status = channelClosed
 	return nil
 }
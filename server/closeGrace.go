@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// Close grace lets acks sent by client right before connection is closed settle their messages instead of
+// redelivery. Frames read from socket of closed connection may be left unhandled in channel buffers, so channel
+// with unacked messages handles acks, nacks and rejects left there for connection.closeAckGrace before remaining
+// messages are requeued. Consumer can prolong it with x-close-grace argument in milliseconds up to
+// connection.closeAckGraceMax. Zero grace requeues messages immediately. Channel closed by channel.close
+// has handled all frames sent before it, so its messages are requeued immediately.
+const closeGraceArg = "x-close-grace"
+
+// handleInflightAcks handles acknowledgements left in incoming buffer of closed connection in order until
+// all messages are settled, buffer is drained or grace period is over. It stops on the first other frame,
+// acks after it could not be handled before it. It must be called by channel incoming handler
+// on connection teardown after consumers are stopped.
+func (channel *Channel) handleInflightAcks(grace time.Duration) {
+	if grace == 0 || channel.GetUnackedCount() == 0 {
+		return
+	}
+
+	deadline := time.Now().Add(grace)
+	buffer := bytes.NewReader([]byte{})
+	for channel.GetUnackedCount() > 0 && time.Now().Before(deadline) {
+		select {
+		case frame := <-channel.incoming:
+			if frame == nil || !channel.handleInflightAck(buffer, frame) {
+				return
+			}
+		default:
+			// connection is closed, so no frames arrive anymore
+			return
+		}
+	}
+}
+
+// handleInflightAck handles frame if it is basic.ack, basic.nack or basic.reject, returns false for other frames
+func (channel *Channel) handleInflightAck(buffer *bytes.Reader, frame *amqp.Frame) bool {
+	if frame.Type != amqp.FrameMethod {
+		return false
+	}
+	buffer.Reset(frame.Payload)
+	method, err := amqp.ReadMethod(buffer, channel.protoVersion)
+	if err != nil {
+		return false
+	}
+	var ackErr *amqp.Error
+	switch method := method.(type) {
+	case *amqp.BasicAck:
+		ackErr = channel.basicAck(method)
+	case *amqp.BasicNack:
+		ackErr = channel.basicNack(method)
+	case *amqp.BasicReject:
+		ackErr = channel.basicReject(method)
+	default:
+		return false
+	}
+	if ackErr != nil {
+		channel.logger.Warn(ackErr.ReplyText)
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// Confirm batching
+// When connection.confirmBatchInterval or connection.confirmBatchSize is set, confirms of channel are sent
+// every interval or as soon as batch size of them is ready. Acks of contiguous delivery tags are coalesced into
+// single basic.ack with multiple bit. Confirm is queued only after message is durable and multiple ack covers
+// only tags which are already confirmed, so batching delays confirms but never confirms message earlier.
+// Confirms which follow not yet confirmed tag and nacks are sent one by one.
+type confirmBatch struct {
+	// all delivery tags up to confirmed one are already confirmed
+	confirmed uint64
+	// delivery tags above confirmed one which are confirmed one by one
+	sent map[uint64]bool
+}
+
+func newConfirmBatch() *confirmBatch {
+	return &confirmBatch{sent: make(map[uint64]bool)}
+}
+
+// methods returns confirm methods for ready confirms
+func (batch *confirmBatch) methods(confirms []*amqp.ConfirmMeta) []amqp.Method {
+	sort.Slice(
+		confirms,
+		func(i, j int) bool {
+			return confirms[i].DeliveryTag < confirms[j].DeliveryTag
+		},
+	)
+
+	methods := make([]amqp.Method, 0)
+	var ackTag uint64
+	var ackCount int
+	flush := func() {
+		if ackCount > 0 {
+			methods = append(methods, &amqp.BasicAck{DeliveryTag: ackTag, Multiple: ackCount > 1})
+			ackCount = 0
+		}
+	}
+
+	for _, confirm := range confirms {
+		tag := confirm.DeliveryTag
+		if tag != batch.confirmed+1 {
+			// multiple ack can not cover previous tag which is not confirmed yet
+			flush()
+			if tag > batch.confirmed {
+				batch.sent[tag] = true
+			}
+			methods = append(methods, confirmMethod(confirm))
+			continue
+		}
+
+		if confirm.Nack {
+			flush()
+			methods = append(methods, confirmMethod(confirm))
+		} else {
+			ackTag = tag
+			ackCount++
+		}
+		batch.confirmed = tag
+		for batch.sent[batch.confirmed+1] {
+			delete(batch.sent, batch.confirmed+1)
+			batch.confirmed++
+		}
+	}
+	flush()
+
+	return methods
+}
+
+// confirmMethod returns single confirm method of message
+func confirmMethod(confirm *amqp.ConfirmMeta) amqp.Method {
+	if confirm.Nack {
+		return &amqp.BasicNack{
+			DeliveryTag: confirm.DeliveryTag,
+			Multiple:    false,
+		}
+	}
+	return &amqp.BasicAck{
+		DeliveryTag: confirm.DeliveryTag,
+		Multiple:    false,
+	}
+}
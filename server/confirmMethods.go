@@ -10,7 +10,7 @@ func (channel *Channel) confirmRoute(method amqp.Method) *amqp.Error {
 		return channel.confirmSelect(method)
 	}
 
-	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route channel method "+method.Name(), method.ClassIdentifier(), method.MethodIdentifier())
+	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route channel method "+method.Name(), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrUnknownMethod)
 }
 
 func (channel *Channel) confirmSelect(method *amqp.ConfirmSelect) (err *amqp.Error) {
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sort"
@@ -14,6 +15,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/auth"
 	"github.com/valinurovam/garagemq/metrics"
 	"github.com/valinurovam/garagemq/qos"
 )
@@ -42,6 +44,16 @@ const (
 // exceeding the MSS.
 const flushThreshold = 1414
 
+// batchFlushThreshold is used instead of flushThreshold in delivery batching mode
+// to coalesce as many frames as possible into one write call
+const batchFlushThreshold = 32 << 10
+
+// consumerTimeoutCheckInterval is max interval between checks of unacked messages for consumer timeout
+const consumerTimeoutCheckInterval = time.Second
+
+// closeFrameTimeout is max time to write connection.close before connection with malformed input is closed
+const closeFrameTimeout = time.Second
+
 type ConnMetricsState struct {
 	TrafficIn  *metrics.TrackCounter
 	TrafficOut *metrics.TrackCounter
@@ -50,13 +62,18 @@ type ConnMetricsState struct {
 // Connection represents AMQP-connection
 type Connection struct {
 	id               uint64
+	flushes          uint64 // write buffer flushes, each of them is a write call into the socket
+	lastActivity     int64  // unix nano time of the last incoming frame
 	server           *Server
-	netConn          *net.TCPConn
+	netConn          net.Conn
+	serverName       string // TLS server name requested by client
 	logger           *log.Entry
 	channelsLock     sync.RWMutex
 	channels         map[uint16]*Channel
 	outgoing         chan *amqp.Frame
 	clientProperties *amqp.Table
+	clientName       string // connection name provided by client, see connectionNameProperty
+	defaultPrefetch  uint16 // prefetch of opened channels until basic.qos, see defaultPrefetchProperty
 	maxChannels      uint16
 	maxFrameSize     uint32
 	statusLock       sync.RWMutex
@@ -68,6 +85,8 @@ type Connection struct {
 	srvMetrics       *SrvMetricsState
 	metrics          *ConnMetricsState
 	userName         string
+	authLock         sync.RWMutex
+	authorizer       auth.Authorizer // resolved on authentication, server authorizer or one from token
 
 	wg        *sync.WaitGroup
 	ctx       context.Context
@@ -78,10 +97,13 @@ type Connection struct {
 	heartbeatTimer    *time.Ticker
 
 	lastOutgoingTS chan time.Time
+	output         *outputBuffer
+	scheduler      *deliveryScheduler
 }
 
 // NewConnection returns new instance of amqp Connection
-func NewConnection(server *Server, netConn *net.TCPConn) (connection *Connection) {
+func NewConnection(server *Server, netConn net.Conn) (connection *Connection) {
+	output := newOutputBuffer(int(atomic.LoadInt64(&server.outputHighWatermark)))
 	connection = &Connection{
 		id:                atomic.AddUint64(&server.connSeq, 1),
 		server:            server,
@@ -96,6 +118,8 @@ func NewConnection(server *Server, netConn *net.TCPConn) (connection *Connection
 		wg:                &sync.WaitGroup{},
 		lastOutgoingTS:    make(chan time.Time),
 		heartbeatInterval: 10,
+		output:            output,
+		scheduler:         newDeliveryScheduler(output),
 	}
 
 	connection.logger = log.WithFields(log.Fields{
@@ -153,8 +177,9 @@ func (conn *Connection) close() {
 	conn.clearQueues()
 
 	conn.logger.WithFields(log.Fields{
-		"vhost": conn.vhostName,
-		"from":  conn.netConn.RemoteAddr(),
+		"vhost":          conn.vhostName,
+		"from":           conn.netConn.RemoteAddr(),
+		"connectionName": conn.clientName,
 	}).Info("Connection closed")
 	conn.server.removeConnection(conn.id)
 
@@ -168,19 +193,22 @@ func (conn *Connection) getChannel(id uint16) *Channel {
 	return channel
 }
 
+func (conn *Connection) getChannels() []*Channel {
+	conn.channelsLock.RLock()
+	defer conn.channelsLock.RUnlock()
+	channels := make([]*Channel, 0, len(conn.channels))
+	for _, channel := range conn.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
 func (conn *Connection) safeClose(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	ch := conn.getChannel(0)
-	if ch == nil {
+	if !conn.forceClose(amqp.NewConnectionError(amqp.ConnectionForced, "server shutdown", 0, 0).WithCode(amqp.ErrServerShutdown)) {
 		return
 	}
-	ch.SendMethod(&amqp.ConnectionClose{
-		ReplyCode: amqp.ConnectionForced,
-		ReplyText: "Server shutdown",
-		ClassID:   0,
-		MethodID:  0,
-	})
 
 	// let clients proper handle connection closing in 10 sec
 	timeOut := time.After(10 * time.Second)
@@ -232,6 +260,11 @@ func (conn *Connection) handleConnection() {
 		return
 	}
 
+	// TLS handshake is already done on reading protocol header
+	if tlsConn, ok := conn.netConn.(*tls.Conn); ok {
+		conn.serverName = tlsConn.ConnectionState().ServerName
+	}
+
 	conn.ctx, conn.cancelCtx = context.WithCancel(context.Background())
 
 	channel := NewChannel(0, conn)
@@ -244,6 +277,13 @@ func (conn *Connection) handleConnection() {
 	go conn.handleOutgoing()
 	conn.wg.Add(1)
 	go conn.handleIncoming()
+	go conn.scheduler.run(conn.ctx)
+
+	atomic.StoreInt64(&conn.lastActivity, time.Now().UnixNano())
+	if conn.server.config.Connection.IdleTimeout > 0 || conn.server.config.Connection.ChannelIdleTimeout > 0 {
+		go conn.idleReaper()
+	}
+	go conn.ackTimeoutSweeper()
 }
 
 func (conn *Connection) handleOutgoing() {
@@ -254,20 +294,48 @@ func (conn *Connection) handleOutgoing() {
 	}()
 
 	var err error
-	buffer := bufio.NewWriterSize(conn.netConn, 128<<10)
+	bufferSize := conn.server.config.Connection.OutputBufferSize
+	if bufferSize == 0 {
+		bufferSize = 128 << 10
+	}
+	buffer := bufio.NewWriterSize(conn.netConn, bufferSize)
+
+	// slow client which doesn't read from socket within write timeout is disconnected
+	writeTimeout := conn.server.config.Connection.WriteTimeout
+
+	// in batching mode buffered frames are flushed by timer, so added latency is bounded by flush interval
+	flushInterval := conn.server.config.Connection.FlushInterval
+	flushTimer := time.NewTimer(time.Hour)
+	flushTimer.Stop()
+	defer flushTimer.Stop()
+	flushPending := false
+
 	for {
 		select {
 		case <-conn.ctx.Done():
 			return
+		case <-flushTimer.C:
+			flushPending = false
+			if err = conn.setWriteDeadline(writeTimeout); err != nil {
+				return
+			}
+			if err = conn.flushBuffer(buffer); err != nil && !conn.isClosedError(err) {
+				conn.logger.WithError(err).Warn("writing frame")
+				return
+			}
 		case frame := <-conn.outgoing:
 			if frame == nil {
 				return
 			}
 
+			if err = conn.setWriteDeadline(writeTimeout); err != nil {
+				return
+			}
 			if err = amqp.WriteFrame(buffer, frame); err != nil && !conn.isClosedError(err) {
 				conn.logger.WithError(err).Warn("writing frame")
 				return
 			}
+			conn.output.done(len(frame.Payload))
 
 			if frame.CloseAfter {
 				if err = buffer.Flush(); err != nil && !conn.isClosedError(err) {
@@ -277,19 +345,29 @@ func (conn *Connection) handleOutgoing() {
 			}
 
 			if frame.Sync {
-				conn.srvMetrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
-				conn.metrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
-				if err = buffer.Flush(); err != nil && !conn.isClosedError(err) {
+				if err = conn.flushBuffer(buffer); err != nil && !conn.isClosedError(err) {
 					conn.logger.WithError(err).Warn("writing frame")
 					return
 				}
 			} else {
-				if err = conn.mayBeFlushBuffer(buffer); err != nil && !conn.isClosedError(err) {
+				if err = conn.mayBeFlushBuffer(buffer, flushInterval > 0); err != nil && !conn.isClosedError(err) {
 					conn.logger.WithError(err).Warn("writing frame")
 					return
 				}
 			}
 
+			if flushInterval > 0 {
+				if buffer.Buffered() == 0 {
+					if flushPending && !flushTimer.Stop() {
+						<-flushTimer.C
+					}
+					flushPending = false
+				} else if !flushPending {
+					flushTimer.Reset(flushInterval)
+					flushPending = true
+				}
+			}
+
 			select {
 			case conn.lastOutgoingTS <- time.Now():
 			default:
@@ -298,27 +376,95 @@ func (conn *Connection) handleOutgoing() {
 	}
 }
 
-func (conn *Connection) mayBeFlushBuffer(buffer *bufio.Writer) (err error) {
-	if buffer.Buffered() >= flushThreshold {
-		conn.srvMetrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
-		conn.metrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
-		if err = buffer.Flush(); err != nil {
-			return err
-		}
+// forceClose sends connection.close with reason of server-initiated close, connection is closed on client close-ok
+// Returns false if connection has no channel 0 to send close
+func (conn *Connection) forceClose(err *amqp.Error) bool {
+	ch := conn.getChannel(0)
+	if ch == nil {
+		return false
+	}
+	conn.logCloseReason(err)
+	ch.SendMethod(&amqp.ConnectionClose{
+		ReplyCode: err.ReplyCode,
+		ReplyText: err.ReplyText,
+		ClassID:   err.ClassID,
+		MethodID:  err.MethodID,
+	})
+	return true
+}
+
+// closeWithError sends connection.close on malformed or missing input
+// Incoming data can't be read anymore, so close-ok is not waited, connection is closed after close is written
+func (conn *Connection) closeWithError(err *amqp.Error) {
+	conn.logCloseReason(err)
+	payload := bytes.NewBuffer(nil)
+	closeMethod := &amqp.ConnectionClose{ReplyCode: err.ReplyCode, ReplyText: err.ReplyText, ClassID: err.ClassID, MethodID: err.MethodID}
+	if err := amqp.WriteMethod(payload, closeMethod, conn.server.protoVersion); err != nil {
+		return
+	}
+
+	frame := &amqp.Frame{Type: byte(amqp.FrameMethod), ChannelID: 0, Payload: payload.Bytes(), CloseAfter: true, Sync: true}
+	select {
+	case conn.outgoing <- frame:
+	case <-conn.ctx.Done():
+		return
+	}
+
+	timer := time.NewTimer(closeFrameTimeout)
+	defer timer.Stop()
+	select {
+	case <-conn.ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// logCloseReason logs reason of server-initiated close with identity of connection
+func (conn *Connection) logCloseReason(err *amqp.Error) {
+	conn.logger.WithFields(log.Fields{
+		"user":           conn.GetUsername(),
+		"vhost":          conn.vhostName,
+		"from":           conn.netConn.RemoteAddr(),
+		"connectionName": conn.clientName,
+		"replyCode":      err.ReplyCode,
+		"code":           err.Code,
+	}).Warn("Connection closed by server: " + err.ReplyText)
+}
+
+func (conn *Connection) setWriteDeadline(timeout time.Duration) error {
+	if timeout == 0 {
+		return nil
+	}
+	return conn.netConn.SetWriteDeadline(time.Now().Add(timeout))
+}
+
+func (conn *Connection) mayBeFlushBuffer(buffer *bufio.Writer, batching bool) (err error) {
+	threshold := flushThreshold
+	if batching {
+		threshold = batchFlushThreshold
+	}
+	if buffer.Buffered() >= threshold {
+		return conn.flushBuffer(buffer)
 	}
 
-	if len(conn.outgoing) == 0 {
+	if len(conn.outgoing) == 0 && !batching {
 		// outgoing channel is buffered and we can check is here more messages for store into buffer
 		// if nothing to store into buffer - we flush
-		conn.srvMetrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
-		conn.metrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
-		if err = buffer.Flush(); err != nil {
-			return err
-		}
+		return conn.flushBuffer(buffer)
 	}
 	return
 }
 
+func (conn *Connection) flushBuffer(buffer *bufio.Writer) error {
+	if buffer.Buffered() == 0 {
+		return nil
+	}
+	conn.srvMetrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
+	conn.metrics.TrafficOut.Counter.Inc(int64(buffer.Buffered()))
+	atomic.AddUint64(&conn.flushes, 1)
+
+	return buffer.Flush()
+}
+
 func (conn *Connection) handleIncoming() {
 	defer func() {
 		conn.wg.Done()
@@ -332,8 +478,21 @@ func (conn *Connection) handleIncoming() {
 		// @spec-note
 		// After sending connection.close , any received methods except Close and Close­OK MUST be discarded.
 		// The response to receiving a Close after sending Close must be to send Close­Ok.
-		frame, err := amqp.ReadFrame(buffer)
+		frame, err := amqp.ReadFrameMax(buffer, conn.server.config.Connection.FrameMaxSize)
 		if err != nil {
+			if decodeErr, ok := err.(*amqp.DecodeError); ok {
+				conn.closeWithError(amqp.NewConnectionError(amqp.FrameError, decodeErr.Reason, 0, 0).WithCode(amqp.ErrMalformedFrame))
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && conn.heartbeatTimeout > 0 {
+				conn.closeWithError(amqp.NewConnectionError(
+					amqp.ConnectionForced,
+					fmt.Sprintf("missed heartbeats from client, timeout %ds", conn.heartbeatTimeout),
+					0,
+					0,
+				).WithCode(amqp.ErrHeartbeatTimeout))
+				return
+			}
 			if err.Error() != "EOF" && !conn.isClosedError(err) {
 				conn.logger.WithError(err).Warn("reading frame")
 			}
@@ -341,11 +500,17 @@ func (conn *Connection) handleIncoming() {
 		}
 
 		if conn.status < ConnOpen && frame.ChannelID != 0 {
-			conn.logger.WithError(err).Error("Frame not allowed for unopened connection")
+			conn.closeWithError(amqp.NewConnectionError(
+				amqp.CommandInvalid,
+				fmt.Sprintf("frame on channel %d is not allowed before connection is opened", frame.ChannelID),
+				0,
+				0,
+			).WithCode(amqp.ErrUnexpectedFrame))
 			return
 		}
 		conn.srvMetrics.TrafficIn.Counter.Inc(int64(len(frame.Payload)))
 		conn.metrics.TrafficIn.Counter.Inc(int64(len(frame.Payload)))
+		atomic.StoreInt64(&conn.lastActivity, time.Now().UnixNano())
 
 		conn.channelsLock.RLock()
 		channel, ok := conn.channels[frame.ChannelID]
@@ -372,6 +537,11 @@ func (conn *Connection) handleIncoming() {
 			return
 		}
 
+		// heartbeats keep connection alive, but not channels
+		if frame.Type != amqp.FrameHeartbeat {
+			atomic.StoreInt64(&channel.lastActivity, time.Now().UnixNano())
+		}
+
 		select {
 		case <-conn.ctx.Done():
 			close(channel.incoming)
@@ -403,9 +573,59 @@ func (conn *Connection) heartBeater() {
 		}
 	}()
 
-	for tickTime := range conn.heartbeatTimer.C {
-		if tickTime.Sub(lastTs) >= interval-time.Second {
-			conn.outgoing <- heartbeatFrame
+	for {
+		select {
+		case tickTime := <-conn.heartbeatTimer.C:
+			if tickTime.Sub(lastTs) >= interval-time.Second {
+				select {
+				case conn.outgoing <- heartbeatFrame:
+				case <-conn.ctx.Done():
+					return
+				}
+			}
+		case <-conn.ctx.Done():
+			return
+		}
+	}
+}
+
+// idleReaper closes connection without incoming frames for connection idle timeout
+// and channels without incoming frames and consumers for channel idle timeout
+func (conn *Connection) idleReaper() {
+	idleTimeout := conn.server.config.Connection.IdleTimeout
+	channelIdleTimeout := conn.server.config.Connection.ChannelIdleTimeout
+
+	checkInterval := idleTimeout
+	if checkInterval == 0 || (channelIdleTimeout > 0 && channelIdleTimeout < checkInterval) {
+		checkInterval = channelIdleTimeout
+	}
+	ticker := time.NewTicker(checkInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if idleTimeout > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&conn.lastActivity))) >= idleTimeout {
+				conn.forceClose(amqp.NewConnectionError(
+					amqp.ConnectionForced,
+					fmt.Sprintf("no frames received within idle timeout %s", idleTimeout),
+					0,
+					0,
+				).WithCode(amqp.ErrIdleTimeout))
+				return
+			}
+
+			if channelIdleTimeout == 0 {
+				continue
+			}
+			for _, channel := range conn.getChannels() {
+				if channel.id != 0 && channel.isIdle(now, channelIdleTimeout) {
+					channel.logger.Info("Channel idle timeout")
+					channel.sendError(amqp.NewChannelError(amqp.ReplySuccess, "idle timeout", 0, 0).WithCode(amqp.ErrIdleTimeout))
+				}
+			}
 		}
 	}
 }
@@ -435,7 +655,53 @@ func (conn *Connection) GetUsername() string {
 	return conn.userName
 }
 
+// GetClientName returns connection name provided by client or empty string
+func (conn *Connection) GetClientName() string {
+	return conn.clientName
+}
+
+// getAuthorizer returns authorizer of authenticated identity, it may be replaced by connection.update-secret
+func (conn *Connection) getAuthorizer() auth.Authorizer {
+	conn.authLock.RLock()
+	defer conn.authLock.RUnlock()
+	return conn.authorizer
+}
+
+// setAuthorizer sets authorizer of authenticated identity, server authorizer is used if identity has no own one
+func (conn *Connection) setAuthorizer(authorizer auth.Authorizer) {
+	if authorizer == nil {
+		authorizer = conn.server.authorizer
+	}
+	conn.authLock.Lock()
+	defer conn.authLock.Unlock()
+	conn.authorizer = authorizer
+}
+
 // GetMetrics returns metrics
 func (conn *Connection) GetMetrics() *ConnMetricsState {
 	return conn.metrics
 }
+
+// ackTimeoutSweeper periodically requeues messages not acked within consumer timeout
+func (conn *Connection) ackTimeoutSweeper() {
+	checkInterval := consumerTimeoutCheckInterval
+	if timeout := conn.server.config.Connection.ConsumerTimeout; timeout > 0 && timeout/2 < checkInterval {
+		checkInterval = timeout / 2
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	cancelStuck := conn.server.config.Connection.CancelStuckConsumers
+	for {
+		select {
+		case <-conn.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, channel := range conn.getChannels() {
+				if channel.id != 0 {
+					channel.requeueExpiredUnacked(now, cancelStuck)
+				}
+			}
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package server
 
 import (
+	"fmt"
+	"math"
 	"os"
 	"runtime"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/valinurovam/garagemq/amqp"
 	"github.com/valinurovam/garagemq/auth"
 )
@@ -20,21 +23,24 @@ func (channel *Channel) connectionRoute(method amqp.Method) *amqp.Error {
 		return channel.connectionClose(method)
 	case *amqp.ConnectionCloseOk:
 		return channel.connectionCloseOk(method)
+	case *amqp.ConnectionUpdateSecret:
+		return channel.connectionUpdateSecret(method)
 	}
 
-	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route connection method", method.ClassIdentifier(), method.MethodIdentifier())
+	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route connection method", method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrUnknownMethod)
 }
 
 func (channel *Channel) connectionStart() {
 	var capabilities = amqp.Table{}
 	capabilities["publisher_confirms"] = true
-	capabilities["exchange_exchange_bindings"] = false
+	capabilities["exchange_exchange_bindings"] = true
 	capabilities["basic.nack"] = true
 	capabilities["consumer_cancel_notify"] = true
 	capabilities["connection.blocked"] = false
 	capabilities["consumer_priorities"] = false
 	capabilities["authentication_failure_close"] = true
 	capabilities["per_consumer_qos"] = true
+	capabilities["queue_exchange"] = channel.server.config.Exchange.QueueExchange
 
 	var serverProps = amqp.Table{}
 	serverProps["product"] = "garagemq"
@@ -49,30 +55,62 @@ func (channel *Channel) connectionStart() {
 		serverProps["host"] = host
 	}
 
-	var method = amqp.ConnectionStart{VersionMajor: 0, VersionMinor: 9, ServerProperties: &serverProps, Mechanisms: []byte("PLAIN"), Locales: []byte("en_US")}
+	var method = amqp.ConnectionStart{VersionMajor: 0, VersionMinor: 9, ServerProperties: &serverProps, Mechanisms: []byte(channel.server.saslMechanisms.Names()), Locales: []byte("en_US")}
 	channel.SendMethod(&method)
 
 	channel.conn.status = ConnStart
 }
 
+// defaultPrefetchProperty is client property with prefetch count applied to every channel of connection
+// as if channel sent basic.qos with global=false, explicit basic.qos of channel overrides it
+const defaultPrefetchProperty = "x-default-prefetch"
+
+// connectionNameProperty is client property with human readable connection name, it is shown by admin
+// connections listing and logged with connection events, so connections are known not only by address
+const connectionNameProperty = "connection_name"
+
 func (channel *Channel) connectionStartOk(method *amqp.ConnectionStartOk) *amqp.Error {
 	channel.conn.status = ConnStartOK
 
-	var saslData auth.SaslData
-	var err error
-	if saslData, err = auth.ParsePlain(method.Response); err != nil {
-		return amqp.NewConnectionError(amqp.NotAllowed, "login failure", method.ClassIdentifier(), method.MethodIdentifier())
-	}
-
-	if method.Mechanism != auth.SaslPlain {
-		channel.conn.close()
+	mechanism := channel.server.saslMechanisms.Get(method.Mechanism)
+	if mechanism == nil {
+		return amqp.NewConnectionError(
+			amqp.NotAllowed,
+			fmt.Sprintf("unsupported mechanism '%s'", method.Mechanism),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		)
 	}
 
-	if !channel.server.checkAuth(saslData) {
-		return amqp.NewConnectionError(amqp.NotAllowed, "login failure", method.ClassIdentifier(), method.MethodIdentifier())
+	identity, err := mechanism.Authenticate(method.Response)
+	if err != nil {
+		// error details are logged only, client can't find out whether user exists
+		if err != auth.ErrLoginFailure {
+			channel.logger.WithError(err).Error("Error on authentication")
+		}
+		return amqp.NewConnectionError(amqp.AccessRefused, "login failure", method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrLoginFailure)
 	}
-	channel.conn.userName = saslData.Username
+	channel.conn.userName = identity.Username
+	channel.conn.setAuthorizer(identity.Authorizer)
 	channel.conn.clientProperties = method.ClientProperties
+	if method.ClientProperties != nil {
+		// name is informational, value of other type is ignored
+		if name, ok := (*method.ClientProperties)[connectionNameProperty].(string); ok {
+			channel.conn.clientName = name
+		}
+		if _, ok := (*method.ClientProperties)[defaultPrefetchProperty]; ok {
+			prefetch, ok := method.ClientProperties.Int64(defaultPrefetchProperty)
+			if !ok || prefetch < 0 || prefetch > math.MaxUint16 {
+				return amqp.NewConnectionError(
+					amqp.NotAllowed,
+					fmt.Sprintf("invalid client property '%s', expected integer 0..%d", defaultPrefetchProperty, math.MaxUint16),
+					method.ClassIdentifier(),
+					method.MethodIdentifier(),
+				).WithCode(amqp.ErrInvalidArgument)
+			}
+			channel.conn.defaultPrefetch = uint16(prefetch)
+		}
+	}
 
 	// @todo Send HeartBeat 0 cause not supported yet
 	channel.SendMethod(&amqp.ConnectionTune{
@@ -89,8 +127,15 @@ func (channel *Channel) connectionTuneOk(method *amqp.ConnectionTuneOk) *amqp.Er
 	channel.conn.status = ConnTuneOK
 
 	if method.ChannelMax > channel.conn.maxChannels || method.FrameMax > channel.conn.maxFrameSize {
-		channel.conn.close()
-		return nil
+		return amqp.NewConnectionError(
+			amqp.NotAllowed,
+			fmt.Sprintf(
+				"negotiated channel_max %d or frame_max %d exceeds server limits %d and %d",
+				method.ChannelMax, method.FrameMax, channel.conn.maxChannels, channel.conn.maxFrameSize,
+			),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		).WithCode(amqp.ErrLimitExceeded)
 	}
 
 	channel.conn.maxChannels = method.ChannelMax
@@ -109,17 +154,39 @@ func (channel *Channel) connectionTuneOk(method *amqp.ConnectionTuneOk) *amqp.Er
 
 func (channel *Channel) connectionOpen(method *amqp.ConnectionOpen) *amqp.Error {
 	channel.conn.status = ConnOpen
+	vhostName := method.VirtualHost
+	if (vhostName == "" || vhostName == channel.server.config.Vhost.DefaultPath) && channel.conn.serverName != "" {
+		// client without explicit vhost opens vhost mapped to TLS server name,
+		// clients usually send default vhost path when vhost is not set
+		if sniVhost, ok := channel.server.config.Vhost.SNI[channel.conn.serverName]; ok {
+			vhostName = sniVhost
+		}
+	}
+
 	var vhostFound bool
-	if channel.conn.virtualHost, vhostFound = channel.server.vhosts[method.VirtualHost]; !vhostFound {
-		return amqp.NewConnectionError(amqp.InvalidPath, "virtualHost '"+method.VirtualHost+"' does not exist", method.ClassIdentifier(), method.MethodIdentifier())
+	if channel.conn.virtualHost, vhostFound = channel.server.vhosts[vhostName]; !vhostFound {
+		return amqp.NewConnectionError(amqp.InvalidPath, "virtualHost '"+vhostName+"' does not exist", method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrVhostNotFound)
+	}
+
+	if !channel.conn.getAuthorizer().VhostAllowed(channel.conn.userName, vhostName) {
+		return amqp.NewConnectionError(
+			amqp.NotAllowed,
+			fmt.Sprintf("access to vhost '%s' refused for user '%s'", vhostName, channel.conn.userName),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		).WithCode(amqp.ErrAccessDenied)
 	}
 
-	channel.conn.vhostName = method.VirtualHost
+	channel.conn.vhostName = vhostName
 
 	channel.SendMethod(&amqp.ConnectionOpenOk{})
 	channel.conn.status = ConnOpenOK
 
-	channel.logger.Info("AMQP connection open")
+	channel.logger.WithFields(log.Fields{
+		"vhost":          vhostName,
+		"user":           channel.conn.userName,
+		"connectionName": channel.conn.clientName,
+	}).Info("AMQP connection open")
 	return nil
 }
 
@@ -133,3 +200,21 @@ func (channel *Channel) connectionCloseOk(method *amqp.ConnectionCloseOk) *amqp.
 	go channel.conn.close()
 	return nil
 }
+
+// connectionUpdateSecret re-authenticates connection user with new secret, e.g. refreshed token,
+// and replaces its permissions, connection is closed if secret is refused or resolves into another user
+func (channel *Channel) connectionUpdateSecret(method *amqp.ConnectionUpdateSecret) *amqp.Error {
+	identity, err := channel.server.authenticator.Authenticate(channel.conn.userName, string(method.NewSecret))
+	if err != nil || identity.Username != channel.conn.userName {
+		if err != nil && err != auth.ErrLoginFailure {
+			channel.logger.WithError(err).Error("Error on authentication")
+		}
+		return amqp.NewConnectionError(amqp.AccessRefused, "update secret failure", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	channel.conn.setAuthorizer(identity.Authorizer)
+
+	channel.logger.WithField("reason", method.Reason).Debug("Secret updated")
+	channel.SendMethod(&amqp.ConnectionUpdateSecretOk{})
+
+	return nil
+}
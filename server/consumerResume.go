@@ -0,0 +1,193 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/consumer"
+)
+
+// Consumer resume lets consumer with stable client-supplied identity x-consumer-id keep its unacked messages
+// across reconnects. When channel is closed unacked messages of such consumers are kept by virtual host
+// for connection.consumerResumeTimeout instead of requeue, consumer with the same identity on the same queue
+// gets them first as redelivered ones. Messages which are not resumed within timeout are requeued.
+// Identity is owned by user whose consumer left messages, consumer of other user with the same identity
+// is refused while they are kept.
+const consumerIDArg = "x-consumer-id"
+
+type resumeKey struct {
+	id    string
+	queue string
+}
+
+// retainedUnacked is a set of messages kept for consumer identity of user on queue
+type retainedUnacked struct {
+	user     string
+	messages []*amqp.Message
+	timer    *time.Timer
+}
+
+// retainUnacked keeps messages for consumer identity of user on queue until timeout, then they are requeued
+// Messages are requeued at once if identity is owned by other user
+func (vhost *VirtualHost) retainUnacked(user string, id string, queueName string, messages []*amqp.Message, timeout time.Duration) bool {
+	key := resumeKey{id: id, queue: queueName}
+	vhost.resumeLock.Lock()
+	retained, ok := vhost.resume[key]
+	if ok && retained.user != user {
+		vhost.resumeLock.Unlock()
+		vhost.requeueUnacked(queueName, messages)
+		return false
+	}
+	defer vhost.resumeLock.Unlock()
+
+	if ok {
+		retained.timer.Stop()
+	} else {
+		retained = &retainedUnacked{user: user}
+		vhost.resume[key] = retained
+	}
+	retained.messages = append(retained.messages, messages...)
+	retained.timer = time.AfterFunc(timeout, func() {
+		vhost.requeueRetained(key, retained)
+	})
+	return true
+}
+
+// canResume returns is consumer identity on queue free or owned by user
+func (vhost *VirtualHost) canResume(user string, id string, queueName string) bool {
+	vhost.resumeLock.Lock()
+	defer vhost.resumeLock.Unlock()
+	retained, ok := vhost.resume[resumeKey{id: id, queue: queueName}]
+	return !ok || retained.user == user
+}
+
+// takeRetained returns messages kept for consumer identity of user on queue,
+// they are not requeued on timeout anymore
+func (vhost *VirtualHost) takeRetained(user string, id string, queueName string) []*amqp.Message {
+	key := resumeKey{id: id, queue: queueName}
+	vhost.resumeLock.Lock()
+	defer vhost.resumeLock.Unlock()
+
+	retained, ok := vhost.resume[key]
+	if !ok || retained.user != user {
+		return nil
+	}
+	retained.timer.Stop()
+	delete(vhost.resume, key)
+	return retained.messages
+}
+
+// requeueRetained requeues messages which were not resumed within timeout
+func (vhost *VirtualHost) requeueRetained(key resumeKey, retained *retainedUnacked) {
+	vhost.resumeLock.Lock()
+	// messages are already taken by resumed consumer or timer was reset
+	if vhost.resume[key] != retained {
+		vhost.resumeLock.Unlock()
+		return
+	}
+	delete(vhost.resume, key)
+	vhost.resumeLock.Unlock()
+
+	vhost.logger.WithFields(log.Fields{
+		"consumerId": key.id,
+		"queue":      key.queue,
+		"count":      len(retained.messages),
+	}).Info("Consumer is not resumed, unacked messages requeued")
+	vhost.requeueUnacked(key.queue, retained.messages)
+}
+
+func (vhost *VirtualHost) requeueUnacked(queueName string, messages []*amqp.Message) {
+	qu := vhost.GetQueue(queueName)
+	for _, message := range messages {
+		if qu != nil {
+			qu.Requeue(message)
+		} else {
+			vhost.srv.GetMetrics().Total.Counter.Dec(1)
+			vhost.srv.GetMetrics().Unacked.Counter.Dec(1)
+		}
+	}
+}
+
+// stopRetained stops timers of kept messages, persisted ones are loaded into queues on next start
+func (vhost *VirtualHost) stopRetained() {
+	vhost.resumeLock.Lock()
+	defer vhost.resumeLock.Unlock()
+	for key, retained := range vhost.resume {
+		retained.timer.Stop()
+		delete(vhost.resume, key)
+	}
+}
+
+// retainUnacked moves unacked messages of consumers with identity from channel into virtual host
+// resumeIDs maps consumer tags to identities, must be called after consumers are stopped
+func (channel *Channel) retainUnacked(resumeIDs map[string]string) {
+	timeout := channel.server.config.Connection.ConsumerResumeTimeout
+	if len(resumeIDs) == 0 || timeout == 0 {
+		return
+	}
+
+	channel.ackLock.Lock()
+	defer channel.ackLock.Unlock()
+
+	deliveryTags := make([]uint64, 0)
+	for dTag, uMsg := range channel.ackStore {
+		if _, ok := resumeIDs[uMsg.cTag]; ok {
+			deliveryTags = append(deliveryTags, dTag)
+		}
+	}
+	sort.Slice(
+		deliveryTags,
+		func(i, j int) bool {
+			return deliveryTags[i] < deliveryTags[j]
+		},
+	)
+
+	retained := make(map[resumeKey][]*amqp.Message)
+	for _, dTag := range deliveryTags {
+		uMsg := channel.ackStore[dTag]
+		delete(channel.ackStore, dTag)
+		channel.metrics.Unacked.Counter.Dec(1)
+		channel.decQosAndConsumerNext(uMsg)
+
+		key := resumeKey{id: resumeIDs[uMsg.cTag], queue: uMsg.queue}
+		retained[key] = append(retained[key], uMsg.msg)
+	}
+
+	vhost := channel.conn.GetVirtualHost()
+	for key, messages := range retained {
+		if !vhost.retainUnacked(channel.conn.userName, key.id, key.queue, messages, timeout) {
+			channel.logger.WithFields(log.Fields{
+				"consumerId": key.id,
+				"queue":      key.queue,
+				"count":      len(messages),
+			}).Warn("Consumer identity is owned by other user, unacked messages requeued")
+			continue
+		}
+		channel.logger.WithFields(log.Fields{
+			"consumerId": key.id,
+			"queue":      key.queue,
+			"count":      len(messages),
+		}).Info("Unacked messages kept for consumer resume")
+	}
+}
+
+// resumeConsumer delivers messages kept for consumer identity before consumer starts
+func (channel *Channel) resumeConsumer(cmr *consumer.Consumer) {
+	if cmr.ResumeID() == "" {
+		return
+	}
+	vhost := channel.conn.GetVirtualHost()
+	messages := vhost.takeRetained(channel.conn.userName, cmr.ResumeID(), cmr.Queue)
+	if len(messages) == 0 {
+		return
+	}
+	rest := cmr.Resume(messages)
+	vhost.requeueUnacked(cmr.Queue, rest)
+	channel.logger.WithFields(log.Fields{
+		"consumerId": cmr.ResumeID(),
+		"queue":      cmr.Queue,
+		"count":      len(messages) - len(rest),
+	}).Info("Consumer resumed unacked messages")
+}
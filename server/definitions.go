@@ -0,0 +1,490 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/binding"
+	"github.com/valinurovam/garagemq/exchange"
+	"github.com/valinurovam/garagemq/msgstorage"
+	"github.com/valinurovam/garagemq/queue"
+)
+
+// Definitions is broker topology in the form of RabbitMQ definitions document
+// Export contains user declared entities only: system exchanges, default exchange bindings,
+// exclusive queues and file bindings are skipped. Arguments are declared ones without policy definitions.
+type Definitions struct {
+	Vhosts    []*VhostDefinition    `json:"vhosts"`
+	Exchanges []*ExchangeDefinition `json:"exchanges"`
+	Queues    []*QueueDefinition    `json:"queues"`
+	Bindings  []*BindingDefinition  `json:"bindings"`
+}
+
+// VhostDefinition is virtual host of definitions, vhosts are not created by import and must exist
+type VhostDefinition struct {
+	Name string `json:"name"`
+}
+
+// ExchangeDefinition is exchange of definitions
+type ExchangeDefinition struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost"`
+	Type       string                 `json:"type"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Internal   bool                   `json:"internal"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// QueueDefinition is queue of definitions
+type QueueDefinition struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// BindingDefinition is binding of definitions, destination type is queue or exchange
+type BindingDefinition struct {
+	Source          string                 `json:"source"`
+	Vhost           string                 `json:"vhost"`
+	Destination     string                 `json:"destination"`
+	DestinationType string                 `json:"destination_type"`
+	RoutingKey      string                 `json:"routing_key"`
+	Arguments       map[string]interface{} `json:"arguments"`
+}
+
+// DefinitionsReport is count of entities created by import, existing ones are not counted
+type DefinitionsReport struct {
+	Exchanges int `json:"exchanges"`
+	Queues    int `json:"queues"`
+	Bindings  int `json:"bindings"`
+}
+
+const (
+	destinationQueue    = "queue"
+	destinationExchange = "exchange"
+)
+
+// ParseDefinitions decodes definitions document, numbers of arguments are decoded as integers if possible
+func ParseDefinitions(data []byte) (*Definitions, error) {
+	definitions := &Definitions{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(definitions); err != nil {
+		return nil, fmt.Errorf("invalid definitions: %s", err.Error())
+	}
+	return definitions, nil
+}
+
+// ExportDefinitions returns topology of all vhosts sorted by names
+func (srv *Server) ExportDefinitions() *Definitions {
+	srv.vhostsLock.Lock()
+	vhosts := make([]*VirtualHost, 0, len(srv.vhosts))
+	for _, vhost := range srv.vhosts {
+		vhosts = append(vhosts, vhost)
+	}
+	srv.vhostsLock.Unlock()
+	sort.Slice(vhosts, func(i, j int) bool {
+		return vhosts[i].name < vhosts[j].name
+	})
+
+	definitions := &Definitions{
+		Vhosts:    []*VhostDefinition{},
+		Exchanges: []*ExchangeDefinition{},
+		Queues:    []*QueueDefinition{},
+		Bindings:  []*BindingDefinition{},
+	}
+	for _, vhost := range vhosts {
+		definitions.Vhosts = append(definitions.Vhosts, &VhostDefinition{Name: vhost.name})
+		vhost.exportDefinitions(definitions)
+	}
+	return definitions
+}
+
+func (vhost *VirtualHost) exportDefinitions(definitions *Definitions) {
+	// exclusive queues and their bindings belong to connection
+	exclusive := make(map[string]bool)
+	vhost.quLock.RLock()
+	quNames := make([]string, 0, len(vhost.queues))
+	for name, qu := range vhost.queues {
+		if qu.IsExclusive() {
+			exclusive[name] = true
+			continue
+		}
+		quNames = append(quNames, name)
+	}
+	sort.Strings(quNames)
+	for _, name := range quNames {
+		qu := vhost.queues[name]
+		definitions.Queues = append(definitions.Queues, &QueueDefinition{
+			Name:       name,
+			Vhost:      vhost.name,
+			Durable:    qu.IsDurable(),
+			AutoDelete: qu.IsAutoDelete(),
+			Arguments:  exportArguments(qu.DeclaredArguments()),
+		})
+	}
+	vhost.quLock.RUnlock()
+
+	vhost.exLock.RLock()
+	defer vhost.exLock.RUnlock()
+	exNames := make([]string, 0, len(vhost.exchanges))
+	for name := range vhost.exchanges {
+		exNames = append(exNames, name)
+	}
+	sort.Strings(exNames)
+	for _, name := range exNames {
+		ex := vhost.exchanges[name]
+		if name == exDefaultName {
+			continue
+		}
+		if !ex.IsSystem() {
+			definitions.Exchanges = append(definitions.Exchanges, &ExchangeDefinition{
+				Name:       name,
+				Vhost:      vhost.name,
+				Type:       ex.GetTypeAlias(),
+				Durable:    ex.IsDurable(),
+				AutoDelete: ex.IsAutoDelete(),
+				Internal:   ex.IsInternal(),
+				Arguments:  exportArguments(ex.DeclaredArguments()),
+			})
+		}
+		for _, bind := range ex.GetBindings() {
+			if bind.IsToFile() || (!bind.IsToExchange() && exclusive[bind.GetQueue()]) {
+				continue
+			}
+			destinationType := destinationQueue
+			if bind.IsToExchange() {
+				destinationType = destinationExchange
+			}
+			definitions.Bindings = append(definitions.Bindings, &BindingDefinition{
+				Source:          name,
+				Vhost:           vhost.name,
+				Destination:     bind.GetQueue(),
+				DestinationType: destinationType,
+				RoutingKey:      bind.GetRoutingKey(),
+				Arguments:       exportArguments(bind.Arguments),
+			})
+		}
+	}
+}
+
+// ImportDefinitions declares exchanges, queues and bindings of definitions which do not exist yet
+// Whole document is validated before any change, so invalid definitions or ones inequivalent
+// to existing entities are rejected without partial import. Import of the same document is no-op.
+func (srv *Server) ImportDefinitions(definitions *Definitions) (*DefinitionsReport, error) {
+	for _, vhostDefinition := range definitions.Vhosts {
+		if _, err := srv.definitionVhost(vhostDefinition.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	plans := make(map[*VirtualHost]*definitionsPlan)
+	planOf := func(name string) (*definitionsPlan, error) {
+		vhost, err := srv.definitionVhost(name)
+		if err != nil {
+			return nil, err
+		}
+		if plans[vhost] == nil {
+			plans[vhost] = &definitionsPlan{vhost: vhost, exchanges: make(map[string]*exchange.Exchange), queues: make(map[string]*queue.Queue)}
+		}
+		return plans[vhost], nil
+	}
+	for _, exDefinition := range definitions.Exchanges {
+		plan, err := planOf(exDefinition.Vhost)
+		if err == nil {
+			err = plan.addExchange(exDefinition)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, quDefinition := range definitions.Queues {
+		plan, err := planOf(quDefinition.Vhost)
+		if err == nil {
+			err = plan.addQueue(quDefinition)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, bindDefinition := range definitions.Bindings {
+		plan, err := planOf(bindDefinition.Vhost)
+		if err == nil {
+			err = plan.addBinding(bindDefinition)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report := &DefinitionsReport{}
+	for _, plan := range plans {
+		if err := plan.apply(report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// initDefinitions imports definitions file of config on start before connections are accepted
+// Missing vhosts of definitions are created, entities left from previous start must be equivalent
+func (srv *Server) initDefinitions() error {
+	path := srv.config.Definitions
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	definitions, err := ParseDefinitions(data)
+	if err != nil {
+		return err
+	}
+	for _, vhostDefinition := range definitions.Vhosts {
+		if vhostDefinition.Name != "" && srv.getVhost(vhostDefinition.Name) == nil {
+			srv.addVhost(vhostDefinition.Name)
+		}
+	}
+	report, err := srv.ImportDefinitions(definitions)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"file":      path,
+		"exchanges": report.Exchanges,
+		"queues":    report.Queues,
+		"bindings":  report.Bindings,
+	}).Info("Definitions imported")
+	return nil
+}
+
+// addVhost creates virtual host with own message storages and persists it, so it is loaded on next start
+func (srv *Server) addVhost(name string) {
+	log.WithFields(log.Fields{
+		"vhost": name,
+	}).Info("Initialize vhost")
+
+	msgStoragePersistent := msgstorage.NewMsgStorage(srv.getMsgStorageInstance(name), srv.protoVersion)
+	msgStorageTransient := msgstorage.NewMsgStorage(srv.getStorageInstance(name, false), srv.protoVersion)
+	vhost := NewVhost(name, false, msgStoragePersistent, msgStorageTransient, srv)
+
+	srv.vhostsLock.Lock()
+	defer srv.vhostsLock.Unlock()
+	srv.vhosts[name] = vhost
+	srv.storage.AddVhost(name, false)
+}
+
+func (srv *Server) definitionVhost(name string) (*VirtualHost, error) {
+	if name == "" {
+		name = srv.config.Vhost.DefaultPath
+	}
+	vhost := srv.getVhost(name)
+	if vhost == nil {
+		return nil, fmt.Errorf("vhost '%s' not found", name)
+	}
+	return vhost, nil
+}
+
+// definitionsPlan is validated entities of one vhost to be created by import
+type definitionsPlan struct {
+	vhost     *VirtualHost
+	exchanges map[string]*exchange.Exchange
+	queues    map[string]*queue.Queue
+	bindings  []*binding.Binding
+}
+
+func (plan *definitionsPlan) addExchange(definition *ExchangeDefinition) error {
+	if definition.Name == "" {
+		return fmt.Errorf("exchange name is required")
+	}
+	if strings.HasPrefix(definition.Name, "amq.") {
+		return fmt.Errorf("exchange name '%s' contains reserved prefix 'amq.*'", definition.Name)
+	}
+	exType, err := exchange.GetExchangeTypeID(definition.Type)
+	if err != nil {
+		return err
+	}
+	ex := exchange.NewExchange(definition.Name, exType, definition.Durable, definition.AutoDelete, definition.Internal, false)
+	if err = ex.SetArguments(importArguments(definition.Arguments)); err != nil {
+		return err
+	}
+
+	if existing := plan.vhost.GetExchange(definition.Name); existing != nil {
+		return existing.EqualWithErr(ex)
+	}
+	if err = plan.vhost.ApplyExchangePolicy(ex); err != nil {
+		return err
+	}
+	if err = plan.vhost.checkAliasCycle(ex); err != nil {
+		return err
+	}
+	plan.exchanges[definition.Name] = ex
+	return nil
+}
+
+func (plan *definitionsPlan) addQueue(definition *QueueDefinition) error {
+	if definition.Name == "" {
+		return fmt.Errorf("queue name is required")
+	}
+	vhost := plan.vhost
+	qu := vhost.NewQueue(definition.Name, 0, false, definition.AutoDelete, definition.Durable, vhost.srvConfig.Queue.ShardSize)
+	if err := qu.SetArguments(importArguments(definition.Arguments)); err != nil {
+		return err
+	}
+	if err := vhost.ApplyQueuePolicy(qu); err != nil {
+		return err
+	}
+
+	if existing := vhost.GetQueue(definition.Name); existing != nil {
+		return existing.EqualWithErr(qu)
+	}
+	plan.queues[definition.Name] = qu
+	return nil
+}
+
+func (plan *definitionsPlan) addBinding(definition *BindingDefinition) error {
+	source := plan.exchange(definition.Source)
+	if source == nil {
+		return fmt.Errorf("exchange '%s' not found", definition.Source)
+	}
+	if source.GetName() == exDefaultName {
+		return fmt.Errorf("operation not permitted on the default exchange")
+	}
+	topic := source.ExType() == exchange.ExTypeTopic
+	arguments := importArguments(definition.Arguments)
+
+	var bind *binding.Binding
+	var err error
+	switch definition.DestinationType {
+	case destinationQueue:
+		if plan.queue(definition.Destination) == nil {
+			return fmt.Errorf("queue '%s' not found", definition.Destination)
+		}
+		bind, err = binding.NewBinding(definition.Destination, definition.Source, definition.RoutingKey, arguments, topic)
+	case destinationExchange:
+		if destination := plan.exchange(definition.Destination); destination == nil || destination.GetName() == exDefaultName {
+			return fmt.Errorf("exchange '%s' not found", definition.Destination)
+		}
+		bind, err = binding.NewExchangeBinding(definition.Destination, definition.Source, definition.RoutingKey, arguments, topic)
+	default:
+		return fmt.Errorf("invalid destination type '%s', expected queue or exchange", definition.DestinationType)
+	}
+	if err != nil {
+		return err
+	}
+	plan.bindings = append(plan.bindings, bind)
+	return nil
+}
+
+// exchange returns existing exchange or one to be created
+func (plan *definitionsPlan) exchange(name string) *exchange.Exchange {
+	if ex, ok := plan.exchanges[name]; ok {
+		return ex
+	}
+	return plan.vhost.GetExchange(name)
+}
+
+// queue returns existing queue or one to be created
+func (plan *definitionsPlan) queue(name string) *queue.Queue {
+	if qu, ok := plan.queues[name]; ok {
+		return qu
+	}
+	return plan.vhost.GetQueue(name)
+}
+
+// apply creates planned entities, entities declared by clients meanwhile are kept
+func (plan *definitionsPlan) apply(report *DefinitionsReport) error {
+	vhost := plan.vhost
+	for name, ex := range plan.exchanges {
+		if vhost.GetExchange(name) != nil {
+			continue
+		}
+		vhost.AppendExchange(ex)
+		vhost.ReattachBindings(ex)
+		report.Exchanges++
+	}
+	for name, qu := range plan.queues {
+		if vhost.GetQueue(name) != nil {
+			continue
+		}
+		qu.Start()
+		if err := vhost.AppendQueue(qu); err != nil {
+			return err
+		}
+		report.Queues++
+	}
+	for _, bind := range plan.bindings {
+		source := vhost.GetExchange(bind.GetExchange())
+		if source == nil {
+			continue
+		}
+		added, err := source.AppendBinding(bind)
+		if err != nil {
+			return err
+		}
+		if !added {
+			continue
+		}
+		report.Bindings++
+		// bindings of durable source to durable destination are persisted like declared ones
+		destinationDurable := false
+		if bind.IsToExchange() {
+			destination := vhost.GetExchange(bind.GetQueue())
+			destinationDurable = destination != nil && destination.IsDurable()
+		} else {
+			destination := vhost.GetQueue(bind.GetQueue())
+			destinationDurable = destination != nil && destination.IsDurable()
+		}
+		if source.IsDurable() && destinationDurable {
+			vhost.PersistBinding(bind)
+		}
+	}
+	return nil
+}
+
+// exportArguments returns arguments as json object, nil table is exported as empty one
+func exportArguments(arguments *amqp.Table) map[string]interface{} {
+	if arguments == nil {
+		return map[string]interface{}{}
+	}
+	return *arguments
+}
+
+// importArguments converts json values of arguments into amqp table values
+func importArguments(arguments map[string]interface{}) *amqp.Table {
+	table := amqp.Table{}
+	for key, value := range arguments {
+		table[key] = importValue(value)
+	}
+	return &table
+}
+
+func importValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]interface{}:
+		return *importArguments(value)
+	case []interface{}:
+		for i, item := range value {
+			value[i] = importValue(item)
+		}
+		return value
+	}
+	return value
+}
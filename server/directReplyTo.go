@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// Direct reply-to allows RPC clients to receive replies without declaring a queue.
+// Client consumes from pseudo-queue amq.rabbitmq.reply-to in no-ack mode and publishes requests
+// with reply-to amq.rabbitmq.reply-to, server replaces it with unique name of the requesting channel.
+// Replies published into default exchange with that name as routing key are delivered directly to the channel.
+const (
+	directReplyToQueue  = "amq.rabbitmq.reply-to"
+	directReplyToPrefix = directReplyToQueue + "."
+)
+
+func (vhost *VirtualHost) registerReplyTo(name string, channel *Channel) {
+	vhost.replyToLock.Lock()
+	defer vhost.replyToLock.Unlock()
+	vhost.replyTo[name] = channel
+}
+
+func (vhost *VirtualHost) unregisterReplyTo(name string) {
+	vhost.replyToLock.Lock()
+	defer vhost.replyToLock.Unlock()
+	delete(vhost.replyTo, name)
+}
+
+func (vhost *VirtualHost) getReplyTo(name string) *Channel {
+	vhost.replyToLock.RLock()
+	defer vhost.replyToLock.RUnlock()
+	return vhost.replyTo[name]
+}
+
+func (channel *Channel) consumeDirectReplyTo(method *amqp.BasicConsume) *amqp.Error {
+	if !method.NoAck {
+		return amqp.NewChannelError(amqp.PreconditionFailed, "reply consumer cannot acknowledge", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return amqp.NewChannelError(amqp.InternalError, err.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	channel.cmrLock.Lock()
+	if channel.replyToTag != "" {
+		channel.cmrLock.Unlock()
+		return amqp.NewChannelError(amqp.PreconditionFailed, "reply consumer already set", method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	cTag := method.ConsumerTag
+	if cTag == "" {
+		cTag = fmt.Sprintf("amq.ctag-%s", hex.EncodeToString(token))
+	}
+	if _, ok := channel.consumers[cTag]; ok {
+		channel.cmrLock.Unlock()
+		return amqp.NewChannelError(amqp.NotAllowed, fmt.Sprintf("Consumer with tag '%s' already exists", cTag), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrConsumerTagInUse)
+	}
+	channel.replyToTag = cTag
+	channel.replyToName = fmt.Sprintf("%s%d.%d.%s", directReplyToPrefix, channel.conn.id, channel.id, hex.EncodeToString(token))
+	channel.conn.GetVirtualHost().registerReplyTo(channel.replyToName, channel)
+	channel.cmrLock.Unlock()
+
+	if !method.NoWait {
+		channel.SendMethod(&amqp.BasicConsumeOk{ConsumerTag: cTag})
+	}
+	return nil
+}
+
+// cancelDirectReplyTo removes reply consumer of channel
+// Returns false if channel has no reply consumer with given tag
+func (channel *Channel) cancelDirectReplyTo(cTag string) bool {
+	channel.cmrLock.Lock()
+	defer channel.cmrLock.Unlock()
+	if channel.replyToTag == "" || channel.replyToTag != cTag {
+		return false
+	}
+
+	channel.clearDirectReplyTo()
+	return true
+}
+
+// clearDirectReplyTo unregisters reply consumer of channel, must be called under cmrLock
+func (channel *Channel) clearDirectReplyTo() {
+	if channel.replyToName == "" {
+		return
+	}
+	channel.conn.GetVirtualHost().unregisterReplyTo(channel.replyToName)
+	channel.replyToTag = ""
+	channel.replyToName = ""
+}
+
+// rewriteDirectReplyTo replaces pseudo-queue name in reply-to property with reply name of the channel
+func (channel *Channel) rewriteDirectReplyTo(message *amqp.Message) *amqp.Error {
+	replyTo := message.Header.PropertyList.ReplyTo
+	if replyTo == nil || *replyTo != directReplyToQueue {
+		return nil
+	}
+
+	channel.cmrLock.RLock()
+	replyToName := channel.replyToName
+	channel.cmrLock.RUnlock()
+
+	if replyToName == "" {
+		return amqp.NewChannelError(amqp.PreconditionFailed, "fast reply consumer does not exist", amqp.ClassBasic, amqp.MethodBasicPublish)
+	}
+	message.Header.PropertyList.ReplyTo = &replyToName
+	return nil
+}
+
+// publishDirectReply delivers reply straight to the requesting channel
+func (channel *Channel) publishDirectReply(message *amqp.Message) {
+	defer channel.addConfirm(message.ConfirmMeta)
+
+	target := channel.conn.GetVirtualHost().getReplyTo(message.RoutingKey)
+	if target != nil {
+		target.cmrLock.RLock()
+		cTag := target.replyToTag
+		target.cmrLock.RUnlock()
+
+		if cTag != "" {
+			channel.server.GetMetrics().Publish.Counter.Inc(1)
+			channel.metrics.Publish.Counter.Inc(1)
+
+			target.SendContent(&amqp.BasicDeliver{
+				ConsumerTag: cTag,
+				DeliveryTag: target.NextDeliveryTag(),
+				Redelivered: false,
+				Exchange:    message.Exchange,
+				RoutingKey:  message.RoutingKey,
+			}, message)
+			return
+		}
+	}
+
+	if message.Mandatory {
+		channel.SendContent(
+			&amqp.BasicReturn{ReplyCode: amqp.NoRoute, ReplyText: "No route", Exchange: message.Exchange, RoutingKey: message.RoutingKey},
+			message,
+		)
+	}
+}
+
+func isDirectReplyTo(message *amqp.Message) bool {
+	return message.Exchange == exDefaultName && strings.HasPrefix(message.RoutingKey, directReplyToPrefix)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/auth"
+	"github.com/valinurovam/garagemq/exchange"
+)
+
+// Exchange aliases
+// Publish to exchange with x-exchange-alias argument is routed by alias target as if it was published to target,
+// delivered message keeps exchange name it was published to. Alias is resolved at the start of publish routing,
+// so publisher needs write access to the target as well and target can't be internal. Alias cycles are refused
+// on declare, publish to alias in cycle made later, e.g. by policy, is refused with channel error.
+
+// ResolveExchange returns exchange which routes publishes to exchange with given name following aliases,
+// nil is returned if exchange or alias target is not found
+func (vhost *VirtualHost) ResolveExchange(exName string) (*exchange.Exchange, error) {
+	ex := vhost.GetExchange(exName)
+	visited := make(map[string]bool)
+	for ex != nil && ex.Alias() != "" {
+		visited[ex.GetName()] = true
+		alias := ex.Alias()
+		if visited[alias] {
+			return nil, fmt.Errorf("alias '%s' of exchange '%s' makes cycle", alias, ex.GetName())
+		}
+		ex = vhost.GetExchange(alias)
+	}
+	return ex, nil
+}
+
+// checkAliasCycle returns error if alias chain of new exchange leads back to it
+func (vhost *VirtualHost) checkAliasCycle(ex *exchange.Exchange) error {
+	visited := map[string]bool{ex.GetName(): true}
+	for alias := ex.Alias(); alias != ""; {
+		if visited[alias] {
+			return fmt.Errorf("alias '%s' of exchange '%s' makes cycle", ex.Alias(), ex.GetName())
+		}
+		visited[alias] = true
+		target := vhost.GetExchange(alias)
+		if target == nil {
+			return nil
+		}
+		alias = target.Alias()
+	}
+	return nil
+}
+
+// checkAliasTarget checks publish through alias to resolved target exchange is allowed
+func (channel *Channel) checkAliasTarget(ex *exchange.Exchange) *amqp.Error {
+	if err := channel.checkAccessWithError(auth.AccessWrite, resourceExchange, ex.GetName(), &amqp.BasicPublish{}); err != nil {
+		return err
+	}
+	if ex.IsInternal() {
+		return amqp.NewChannelError(
+			amqp.AccessRefused,
+			fmt.Sprintf("cannot publish to internal exchange '%s' through alias", ex.GetName()),
+			amqp.ClassBasic,
+			amqp.MethodBasicPublish,
+		)
+	}
+	return nil
+}
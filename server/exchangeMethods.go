@@ -3,6 +3,8 @@ package server
 import (
 	"fmt"
 	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/auth"
+	"github.com/valinurovam/garagemq/binding"
 	"github.com/valinurovam/garagemq/exchange"
 	"strings"
 )
@@ -13,9 +15,13 @@ func (channel *Channel) exchangeRoute(method amqp.Method) *amqp.Error {
 		return channel.exchangeDeclare(method)
 	case *amqp.ExchangeDelete:
 		return channel.exchangeDelete(method)
+	case *amqp.ExchangeBind:
+		return channel.exchangeBind(method)
+	case *amqp.ExchangeUnbind:
+		return channel.exchangeUnbind(method)
 	}
 
-	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route queue method "+method.Name(), method.ClassIdentifier(), method.MethodIdentifier())
+	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route queue method "+method.Name(), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrUnknownMethod)
 }
 
 func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Error {
@@ -30,7 +36,7 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Erro
 			"exchange name is required",
 			method.ClassIdentifier(),
 			method.MethodIdentifier(),
-		)
+		).WithCode(amqp.ErrNameRequired)
 	}
 
 	existingExchange := channel.conn.GetVirtualHost().GetExchange(method.Exchange)
@@ -45,7 +51,7 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Erro
 				fmt.Sprintf("exchange '%s' not found", method.Exchange),
 				method.ClassIdentifier(),
 				method.MethodIdentifier(),
-			)
+			).WithCode(amqp.ErrExchangeNotFound)
 		}
 
 		channel.SendMethod(&amqp.ExchangeDeclareOk{})
@@ -53,13 +59,17 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Erro
 		return nil
 	}
 
+	if err := channel.checkAccessWithError(auth.AccessConfigure, resourceExchange, method.Exchange, method); err != nil {
+		return err
+	}
+
 	if strings.HasPrefix(method.Exchange, "amq.") {
 		return amqp.NewChannelError(
 			amqp.AccessRefused,
 			fmt.Sprintf("exchange name '%s' contains reserved prefix 'amq.*'", method.Exchange),
 			method.ClassIdentifier(),
 			method.MethodIdentifier(),
-		)
+		).WithCode(amqp.ErrReservedName)
 	}
 
 	newExchange := exchange.NewExchange(
@@ -70,21 +80,50 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Erro
 		method.Internal,
 		false,
 	)
+	if err := newExchange.SetArguments(method.Arguments); err != nil {
+		return amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			err.Error(),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		).WithCode(amqp.ErrInvalidArgument)
+	}
 
 	if existingExchange != nil {
 		if err := existingExchange.EqualWithErr(newExchange); err != nil {
+			code := amqp.ErrInequivalentArg
+			if existingExchange.ExType() != newExchange.ExType() {
+				code = amqp.ErrExchangeTypeMismatch
+			}
 			return amqp.NewChannelError(
 				amqp.PreconditionFailed,
 				err.Error(),
 				method.ClassIdentifier(),
 				method.MethodIdentifier(),
-			)
+			).WithCode(code)
 		}
 		channel.SendMethod(&amqp.ExchangeDeclareOk{})
 		return nil
 	}
 
+	if err := channel.conn.GetVirtualHost().ApplyExchangePolicy(newExchange); err != nil {
+		return amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			err.Error(),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		).WithCode(amqp.ErrInvalidArgument)
+	}
+	if err := channel.conn.GetVirtualHost().checkAliasCycle(newExchange); err != nil {
+		return amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			err.Error(),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		).WithCode(amqp.ErrAliasCycle)
+	}
 	channel.conn.GetVirtualHost().AppendExchange(newExchange)
+	channel.conn.GetVirtualHost().ReattachBindings(newExchange)
 	if !method.NoWait {
 		channel.SendMethod(&amqp.ExchangeDeclareOk{})
 	}
@@ -93,5 +132,128 @@ func (channel *Channel) exchangeDeclare(method *amqp.ExchangeDeclare) *amqp.Erro
 }
 
 func (channel *Channel) exchangeDelete(method *amqp.ExchangeDelete) *amqp.Error {
+	if err := channel.checkAccessWithError(auth.AccessConfigure, resourceExchange, method.Exchange, method); err != nil {
+		return err
+	}
+
+	if _, err := channel.getExchangeWithError(method.Exchange, method); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(method.Exchange, "amq.") {
+		return amqp.NewChannelError(
+			amqp.AccessRefused,
+			fmt.Sprintf("exchange name '%s' contains reserved prefix 'amq.*'", method.Exchange),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		).WithCode(amqp.ErrReservedName)
+	}
+
+	if err := channel.conn.GetVirtualHost().DeleteExchange(method.Exchange, method.IfUnused); err != nil {
+		return amqp.NewChannelError(amqp.PreconditionFailed, err.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	if !method.NoWait {
+		channel.SendMethod(&amqp.ExchangeDeleteOk{})
+	}
+	return nil
+}
+
+func (channel *Channel) exchangeBind(method *amqp.ExchangeBind) *amqp.Error {
+	if err := channel.checkAccessWithError(auth.AccessWrite, resourceExchange, method.Destination, method); err != nil {
+		return err
+	}
+	if err := channel.checkAccessWithError(auth.AccessRead, resourceExchange, method.Source, method); err != nil {
+		return err
+	}
+
+	var source, destination *exchange.Exchange
+	var err *amqp.Error
+
+	if source, err = channel.getExchangeWithError(method.Source, method); err != nil {
+		return err
+	}
+
+	if destination, err = channel.getExchangeWithError(method.Destination, method); err != nil {
+		return err
+	}
+
+	if source.GetName() == exDefaultName || destination.GetName() == exDefaultName {
+		return amqp.NewChannelError(
+			amqp.AccessRefused,
+			fmt.Sprintf("operation not permitted on the default exchange"),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		).WithCode(amqp.ErrDefaultExchange)
+	}
+
+	bind, bindErr := binding.NewExchangeBinding(method.Destination, method.Source,
+		method.RoutingKey, method.Arguments, source.ExType() == exchange.ExTypeTopic)
+	if bindErr != nil {
+		return amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			bindErr.Error(),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		)
+	}
+
+	added, bindErr := source.AppendBinding(bind)
+	if bindErr != nil {
+		return amqp.NewChannelError(
+			amqp.ResourceError,
+			bindErr.Error(),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		)
+	}
+
+	if added && source.IsDurable() && destination.IsDurable() {
+		channel.conn.GetVirtualHost().PersistBinding(bind)
+	}
+
+	if !method.NoWait {
+		channel.SendMethod(&amqp.ExchangeBindOk{})
+	}
+
+	return nil
+}
+
+func (channel *Channel) exchangeUnbind(method *amqp.ExchangeUnbind) *amqp.Error {
+	if err := channel.checkAccessWithError(auth.AccessWrite, resourceExchange, method.Destination, method); err != nil {
+		return err
+	}
+	if err := channel.checkAccessWithError(auth.AccessRead, resourceExchange, method.Source, method); err != nil {
+		return err
+	}
+
+	var source *exchange.Exchange
+	var err *amqp.Error
+
+	if source, err = channel.getExchangeWithError(method.Source, method); err != nil {
+		return err
+	}
+
+	if _, err = channel.getExchangeWithError(method.Destination, method); err != nil {
+		return err
+	}
+
+	bind, bindErr := binding.NewExchangeBinding(method.Destination, method.Source,
+		method.RoutingKey, method.Arguments, source.ExType() == exchange.ExTypeTopic)
+	if bindErr != nil {
+		return amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			bindErr.Error(),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		)
+	}
+
+	source.RemoveBinding(bind)
+	channel.conn.GetVirtualHost().RemoveBindings([]*binding.Binding{bind})
+	if !method.NoWait {
+		channel.SendMethod(&amqp.ExchangeUnbindOk{})
+	}
+
 	return nil
 }
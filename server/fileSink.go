@@ -0,0 +1,237 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/audit"
+	"github.com/valinurovam/garagemq/auth"
+	"github.com/valinurovam/garagemq/binding"
+	"github.com/valinurovam/garagemq/exchange"
+)
+
+// fileSink is destination of file bindings, records of routed messages are appended into file by audit log writer
+// Sink is shared by bindings with the same file name and closed with the last of them
+type fileSink struct {
+	log     *audit.Log
+	limiter *exchange.RateLimiter
+	refs    int
+}
+
+// fileSinkPath returns path of sink file inside sink dir, name must be plain file name
+func (srv *Server) fileSinkPath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid file sink name '%s'", name)
+	}
+	return filepath.Join(srv.config.FileSink.Dir, name), nil
+}
+
+// acquireFileSink opens sink file or takes one more reference to already opened one
+func (srv *Server) acquireFileSink(name string) error {
+	sinkConfig := srv.config.FileSink
+	path, err := srv.fileSinkPath(name)
+	if err != nil {
+		return err
+	}
+
+	srv.fileSinkLock.Lock()
+	defer srv.fileSinkLock.Unlock()
+	if sink, ok := srv.fileSinks[name]; ok {
+		sink.refs++
+		return nil
+	}
+
+	if err := os.MkdirAll(sinkConfig.Dir, 0750); err != nil {
+		return err
+	}
+	sinkLog, err := audit.NewLog(path, sinkConfig.MaxSize, sinkConfig.MaxFiles, sinkConfig.BufferSize, audit.OverflowDrop)
+	if err != nil {
+		return err
+	}
+	srv.fileSinks[name] = &fileSink{
+		log:     sinkLog,
+		limiter: exchange.NewRateLimiter(sinkConfig.MaxRate, 0, true),
+		refs:    1,
+	}
+	return nil
+}
+
+// releaseFileSink drops reference to sink, file is closed with the last one
+func (srv *Server) releaseFileSink(name string) {
+	srv.fileSinkLock.Lock()
+	defer srv.fileSinkLock.Unlock()
+	sink, ok := srv.fileSinks[name]
+	if !ok {
+		return
+	}
+	sink.refs--
+	if sink.refs > 0 {
+		return
+	}
+	delete(srv.fileSinks, name)
+	srv.closeFileSink(name, sink)
+}
+
+// closeFileSinks closes all sinks on server stop
+func (srv *Server) closeFileSinks() {
+	srv.fileSinkLock.Lock()
+	defer srv.fileSinkLock.Unlock()
+	for name, sink := range srv.fileSinks {
+		delete(srv.fileSinks, name)
+		srv.closeFileSink(name, sink)
+	}
+}
+
+func (srv *Server) closeFileSink(name string, sink *fileSink) {
+	if err := sink.log.Close(); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"file": name,
+		}).Error("Error on closing file sink")
+	}
+}
+
+// teeToFiles queues record of routed message into each matched sink
+// Records above sink rate or over its buffer are dropped, so routing is never blocked by sinks
+func (srv *Server) teeToFiles(vhostName string, files map[string]bool, message *amqp.Message) {
+	if len(files) == 0 {
+		return
+	}
+
+	srv.fileSinkLock.RLock()
+	defer srv.fileSinkLock.RUnlock()
+	for name := range files {
+		sink, ok := srv.fileSinks[name]
+		if !ok {
+			continue
+		}
+		if _, ok := sink.limiter.Take(0); !ok {
+			continue
+		}
+		// log assigns sequence to record, so each sink gets own one
+		record := &audit.Record{
+			Timestamp:  time.Now(),
+			Vhost:      vhostName,
+			Exchange:   message.Exchange,
+			RoutingKey: message.RoutingKey,
+			Size:       message.BodySize,
+		}
+		if srv.config.FileSink.IncludeBody {
+			record.Body = make([]byte, 0, message.BodySize)
+			for _, frame := range message.Body {
+				record.Body = append(record.Body, frame.Payload...)
+			}
+		}
+		sink.log.Write(record)
+	}
+}
+
+// isFileDestination returns is binding destination a file sink by x-destination-type argument
+func isFileDestination(arguments *amqp.Table, method amqp.Method) (bool, *amqp.Error) {
+	if arguments == nil {
+		return false, nil
+	}
+	value, ok := (*arguments)[binding.DestinationTypeArg]
+	if !ok {
+		return false, nil
+	}
+	if value != binding.DestinationFile {
+		return false, amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			fmt.Sprintf("invalid %s argument, expected '%s'", binding.DestinationTypeArg, binding.DestinationFile),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		).WithCode(amqp.ErrInvalidArgument)
+	}
+	return true, nil
+}
+
+// fileBind binds exchange to file sink named by queue of queue.bind
+func (channel *Channel) fileBind(method *amqp.QueueBind) *amqp.Error {
+	bind, ex, err := channel.fileBinding(method.Queue, method.Exchange, method.RoutingKey, method.Arguments, method)
+	if err != nil {
+		return err
+	}
+
+	srv := channel.server
+	if sinkErr := srv.acquireFileSink(method.Queue); sinkErr != nil {
+		return amqp.NewChannelError(amqp.InternalError, sinkErr.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	added, bindErr := ex.AppendBinding(bind)
+	if !added {
+		srv.releaseFileSink(method.Queue)
+	}
+	if bindErr != nil {
+		return amqp.NewChannelError(amqp.ResourceError, bindErr.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+
+	if !method.NoWait {
+		channel.SendMethod(&amqp.QueueBindOk{})
+	}
+	return nil
+}
+
+// fileUnbind removes binding of exchange to file sink named by queue of queue.unbind
+func (channel *Channel) fileUnbind(method *amqp.QueueUnbind) *amqp.Error {
+	bind, ex, err := channel.fileBinding(method.Queue, method.Exchange, method.RoutingKey, method.Arguments, method)
+	if err != nil {
+		return err
+	}
+
+	if ex.RemoveBinding(bind) {
+		channel.server.releaseFileSink(method.Queue)
+	}
+	channel.SendMethod(&amqp.QueueUnbindOk{})
+	return nil
+}
+
+// fileBinding checks file bindings are enabled and returns file binding with its source exchange
+func (channel *Channel) fileBinding(file string, exName string, routingKey string, arguments *amqp.Table, method amqp.Method) (*binding.Binding, *exchange.Exchange, *amqp.Error) {
+	if !channel.server.config.FileSink.Enabled {
+		return nil, nil, amqp.NewChannelError(
+			amqp.AccessRefused,
+			"file sink bindings are disabled",
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		).WithCode(amqp.ErrAccessDenied)
+	}
+	if err := channel.checkAccessWithError(auth.AccessRead, resourceExchange, exName, method); err != nil {
+		return nil, nil, err
+	}
+
+	ex, err := channel.getExchangeWithError(exName, method)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ex.GetName() == exDefaultName {
+		return nil, nil, amqp.NewChannelError(
+			amqp.AccessRefused,
+			"operation not permitted on the default exchange",
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		).WithCode(amqp.ErrDefaultExchange)
+	}
+
+	if _, pathErr := channel.server.fileSinkPath(file); pathErr != nil {
+		return nil, nil, amqp.NewChannelError(amqp.PreconditionFailed, pathErr.Error(), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrInvalidArgument)
+	}
+	bind, bindErr := binding.NewFileBinding(file, exName, routingKey, arguments, ex.ExType() == exchange.ExTypeTopic)
+	if bindErr != nil {
+		return nil, nil, amqp.NewChannelError(amqp.PreconditionFailed, bindErr.Error(), method.ClassIdentifier(), method.MethodIdentifier())
+	}
+	return bind, ex, nil
+}
+
+// releaseFileBindings releases sinks of file bindings of deleted exchange
+func (vhost *VirtualHost) releaseFileBindings(ex *exchange.Exchange) {
+	for _, bind := range ex.GetBindings() {
+		if bind.IsToFile() {
+			vhost.srv.releaseFileSink(bind.GetQueue())
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listenTCP starts listener on given address with socket options and backlog from TCP config
+func (srv *Server) listenTCP(address string) (*net.TCPListener, error) {
+	listenConfig := &net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			return rawControl(conn, func(fd uintptr) error {
+				return setReuseAddr(fd, srv.config.TCP.ReuseAddr)
+			})
+		},
+	}
+	listener, err := listenConfig.Listen(context.Background(), "tcp4", address)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener := listener.(*net.TCPListener)
+	if srv.config.TCP.Backlog <= 0 {
+		return tcpListener, nil
+	}
+
+	// backlog can't be passed into net.ListenConfig, but listen on listening socket just updates it
+	conn, err := tcpListener.SyscallConn()
+	if err == nil {
+		err = rawControl(conn, func(fd uintptr) error {
+			return setBacklog(fd, srv.config.TCP.Backlog)
+		})
+	}
+	if err != nil {
+		tcpListener.Close()
+		return nil, err
+	}
+	return tcpListener, nil
+}
+
+// tuneConnection applies TCP config to accepted connection
+func (srv *Server) tuneConnection(conn *net.TCPConn) {
+	conn.SetReadBuffer(srv.config.TCP.ReadBufSize)
+	conn.SetWriteBuffer(srv.config.TCP.WriteBufSize)
+	conn.SetNoDelay(srv.config.TCP.Nodelay)
+	if srv.config.TCP.KeepAlive > 0 {
+		conn.SetKeepAlive(true)
+		conn.SetKeepAlivePeriod(srv.config.TCP.KeepAlive)
+	} else {
+		conn.SetKeepAlive(false)
+	}
+}
+
+// rawControl calls fn with socket descriptor and returns its error
+func rawControl(conn syscall.RawConn, fn func(fd uintptr) error) error {
+	var fnErr error
+	if err := conn.Control(func(fd uintptr) {
+		fnErr = fn(fd)
+	}); err != nil {
+		return err
+	}
+	return fnErr
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// outputBuffer tracks bytes of frames queued for the connection socket but not written yet
+// When pending bytes reach high watermark consumers of the connection are skipped until buffer is drained,
+// so a slow client can't make broker buffer messages without limit
+type outputBuffer struct {
+	highWatermark int64
+	pending       int64
+	drained       chan struct{}
+}
+
+func newOutputBuffer(highWatermark int) *outputBuffer {
+	return &outputBuffer{
+		highWatermark: int64(highWatermark),
+		drained:       make(chan struct{}, 1),
+	}
+}
+
+// add counts frame queued into outgoing channel
+func (buffer *outputBuffer) add(size int) {
+	if buffer.highWatermark == 0 {
+		return
+	}
+	atomic.AddInt64(&buffer.pending, int64(size))
+}
+
+// done counts frame written into socket buffer and wakes up waiters if buffer is drained
+func (buffer *outputBuffer) done(size int) {
+	if buffer.highWatermark == 0 {
+		return
+	}
+	if atomic.AddInt64(&buffer.pending, -int64(size)) < buffer.highWatermark {
+		select {
+		case buffer.drained <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// overloaded returns true if pending bytes reached high watermark
+func (buffer *outputBuffer) overloaded() bool {
+	return buffer.highWatermark > 0 && atomic.LoadInt64(&buffer.pending) >= buffer.highWatermark
+}
+
+// waitDrained blocks while buffer is overloaded
+// Returns false if context is done before buffer is drained
+func (buffer *outputBuffer) waitDrained(ctx context.Context) bool {
+	for buffer.overloaded() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-buffer.drained:
+		}
+	}
+	return true
+}
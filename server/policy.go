@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/exchange"
+	"github.com/valinurovam/garagemq/queue"
+)
+
+// available policy targets
+const (
+	PolicyApplyToQueues    = "queues"
+	PolicyApplyToExchanges = "exchanges"
+	PolicyApplyToAll       = "all"
+)
+
+// Policy represents vhost policy with default arguments for queues and exchanges
+// Only one policy is applied to entity whose name matches Pattern, the one with the highest Priority.
+// Definition is merged into entity arguments, explicit arguments take precedence
+type Policy struct {
+	Name       string
+	Pattern    string
+	ApplyTo    string
+	Priority   int
+	Definition amqp.Table
+	re         *regexp.Regexp
+}
+
+// NewPolicy returns new instance of Policy or error if pattern is not valid regexp or apply-to is unknown
+// Empty applyTo means policy is applied to queues and exchanges
+func NewPolicy(name string, pattern string, applyTo string, priority int, definition amqp.Table) (*Policy, error) {
+	if name == "" {
+		return nil, fmt.Errorf("policy name is required")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s' for policy '%s': %s", pattern, name, err.Error())
+	}
+	switch applyTo {
+	case "":
+		applyTo = PolicyApplyToAll
+	case PolicyApplyToQueues, PolicyApplyToExchanges, PolicyApplyToAll:
+	default:
+		return nil, fmt.Errorf("invalid apply-to '%s' for policy '%s'", applyTo, name)
+	}
+	if definition == nil {
+		definition = amqp.Table{}
+	}
+
+	return &Policy{
+		Name:       name,
+		Pattern:    pattern,
+		ApplyTo:    applyTo,
+		Priority:   priority,
+		Definition: definition,
+		re:         re,
+	}, nil
+}
+
+// Match returns is policy applicable to entity with given name and kind, queues or exchanges
+func (policy *Policy) Match(name string, kind string) bool {
+	if policy.ApplyTo != PolicyApplyToAll && policy.ApplyTo != kind {
+		return false
+	}
+	return policy.re.MatchString(name)
+}
+
+// SetPolicy adds new or replaces existing policy with the same name
+// and re-applies policies to existing queues and exchanges
+func (vhost *VirtualHost) SetPolicy(policy *Policy) {
+	vhost.policyLock.Lock()
+	vhost.policies[policy.Name] = policy
+	vhost.policyLock.Unlock()
+
+	vhost.reapplyPolicies()
+}
+
+// DeletePolicy removes policy by name and returns is it was removed
+// Existing queues and exchanges are re-evaluated against remaining policies
+func (vhost *VirtualHost) DeletePolicy(name string) bool {
+	vhost.policyLock.Lock()
+	if _, ok := vhost.policies[name]; !ok {
+		vhost.policyLock.Unlock()
+		return false
+	}
+	delete(vhost.policies, name)
+	vhost.policyLock.Unlock()
+
+	vhost.reapplyPolicies()
+	return true
+}
+
+// GetPolicies returns vhost policies sorted by priority in descending order
+func (vhost *VirtualHost) GetPolicies() []*Policy {
+	vhost.policyLock.RLock()
+	defer vhost.policyLock.RUnlock()
+	policies := make([]*Policy, 0, len(vhost.policies))
+	for _, policy := range vhost.policies {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].Priority != policies[j].Priority {
+			return policies[i].Priority > policies[j].Priority
+		}
+		return policies[i].Name < policies[j].Name
+	})
+	return policies
+}
+
+// matchPolicy returns the highest priority policy matched entity or nil
+func (vhost *VirtualHost) matchPolicy(name string, kind string) *Policy {
+	for _, policy := range vhost.GetPolicies() {
+		if policy.Match(name, kind) {
+			return policy
+		}
+	}
+	return nil
+}
+
+// ApplyQueuePolicy applies matched policy to queue or clears previous one
+func (vhost *VirtualHost) ApplyQueuePolicy(qu *queue.Queue) error {
+	if policy := vhost.matchPolicy(qu.GetName(), PolicyApplyToQueues); policy != nil {
+		return qu.SetPolicy(policy.Name, policy.Definition)
+	}
+	return qu.SetPolicy("", nil)
+}
+
+// ApplyExchangePolicy applies matched policy to exchange or clears previous one
+func (vhost *VirtualHost) ApplyExchangePolicy(ex *exchange.Exchange) error {
+	if policy := vhost.matchPolicy(ex.GetName(), PolicyApplyToExchanges); policy != nil {
+		return ex.SetPolicy(policy.Name, policy.Definition)
+	}
+	return ex.SetPolicy("", nil)
+}
+
+// reapplyPolicies re-evaluates policies for existing queues and exchanges
+// Queue or exchange keeps its current arguments if new definition is not valid for it
+func (vhost *VirtualHost) reapplyPolicies() {
+	vhost.quLock.RLock()
+	queues := make([]*queue.Queue, 0, len(vhost.queues))
+	for _, qu := range vhost.queues {
+		queues = append(queues, qu)
+	}
+	vhost.quLock.RUnlock()
+
+	for _, qu := range queues {
+		if err := vhost.ApplyQueuePolicy(qu); err != nil {
+			vhost.logger.WithFields(log.Fields{
+				"queueName": qu.GetName(),
+				"error":     err,
+			}).Warn("Unable to apply policy to queue")
+		}
+	}
+
+	vhost.exLock.RLock()
+	exchanges := make([]*exchange.Exchange, 0, len(vhost.exchanges))
+	for _, ex := range vhost.exchanges {
+		if !ex.IsSystem() {
+			exchanges = append(exchanges, ex)
+		}
+	}
+	vhost.exLock.RUnlock()
+
+	for _, ex := range exchanges {
+		if err := vhost.ApplyExchangePolicy(ex); err != nil {
+			vhost.logger.WithFields(log.Fields{
+				"exchangeName": ex.GetName(),
+				"error":        err,
+			}).Warn("Unable to apply policy to exchange")
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/audit"
+	"github.com/valinurovam/garagemq/exchange"
+)
+
+// PublishOpts are options of message published into virtual host
+// Channel sets them for basic.publish, internal publishers (trace, queue move and stream replay)
+// set only needed ones
+type PublishOpts struct {
+	// Mandatory message which is not routed into any queue is passed to Return
+	Mandatory bool
+	// User is publisher recorded by audit log
+	User string
+	// Done stops wait for publish rate limit of exchange, message is dropped then
+	Done <-chan struct{}
+	// Return receives message published into missing exchange and unroutable mandatory message
+	Return func(message *amqp.Message)
+	// Confirm receives confirm meta of message not pushed into queues or confirmed on push, persistent message
+	// is confirmed to channel by storage. Channel without Confirm does not wait for confirms, so refused message
+	// is reported by error
+	Confirm func(meta *amqp.ConfirmMeta)
+	// CheckAlias checks publisher is allowed to publish into exchange resolved by alias
+	CheckAlias func(ex *exchange.Exchange) *amqp.Error
+}
+
+// Publish routes message into queues by exchange and routing key like basic.publish does,
+// it is the single publish path of virtual host shared by channels and internal publishers
+// Refused message is reported by error. Confirm of internal publisher is called once message is handled,
+// with Nack if it is refused, persistence of message is not awaited. Message without header is published
+// with empty properties.
+func (vhost *VirtualHost) Publish(exName string, routingKey string, message *amqp.Message, opts PublishOpts) error {
+	message.Exchange = exName
+	message.RoutingKey = routingKey
+	message.Mandatory = opts.Mandatory
+	message.ConfirmMeta = nil
+	if message.Header == nil {
+		message.Header = &amqp.ContentHeader{BodySize: message.BodySize}
+	}
+	if message.Header.PropertyList == nil {
+		message.Header.PropertyList = &amqp.BasicPropertyList{}
+	}
+
+	confirm := opts.Confirm
+	opts.Confirm = nil
+	_, err := vhost.publish(message, opts)
+	if confirm != nil {
+		confirm(&amqp.ConfirmMeta{Nack: err != nil})
+	}
+	if err != nil {
+		return errors.New(err.ReplyText)
+	}
+	return nil
+}
+
+// publish routes message and returns count of queues it is pushed into
+func (vhost *VirtualHost) publish(message *amqp.Message, opts PublishOpts) (int, *amqp.Error) {
+	if vhost.IsDraining() {
+		return 0, opts.refuse(message, vhost.drainingError())
+	}
+
+	ex, aliasErr := vhost.ResolveExchange(message.Exchange)
+	if aliasErr != nil {
+		return 0, amqp.NewChannelError(amqp.PreconditionFailed, aliasErr.Error(), amqp.ClassBasic, amqp.MethodBasicPublish).WithCode(amqp.ErrAliasCycle)
+	}
+	if ex != nil && ex.GetName() != message.Exchange && opts.CheckAlias != nil {
+		if err := opts.CheckAlias(ex); err != nil {
+			return 0, err
+		}
+	}
+	if ex == nil {
+		opts.returnMessage(message)
+		opts.confirm(message.ConfirmMeta)
+		return 0, nil
+	}
+	if limiter := ex.RateLimiter(); limiter != nil {
+		wait, ok := limiter.Take(message.BodySize)
+		if !ok {
+			return 0, opts.refuse(message, amqp.NewChannelError(amqp.PreconditionFailed, fmt.Sprintf("publish rate limit of exchange '%s' exceeded", ex.GetName()), amqp.ClassBasic, amqp.MethodBasicPublish).WithCode(amqp.ErrRateLimitExceeded))
+		}
+		// delay blocks publisher, so it is throttled by unread frames
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-opts.Done:
+				timer.Stop()
+				return 0, nil
+			}
+		}
+	}
+	ex.GetMetrics().MsgIn.Counter.Inc(1)
+	vhost.srv.routingMetrics.add(message.RoutingKey)
+	vhost.auditPublish(message, opts.User)
+	matchedQueues := vhost.Route(ex, message)
+	// message routed only into retired queues is nacked in confirm mode, otherwise it is unroutable
+	if vhost.dropRetired(matchedQueues) && len(matchedQueues) == 0 && opts.Confirm != nil {
+		message.ConfirmMeta.Nack = true
+		opts.Confirm(message.ConfirmMeta)
+		return 0, nil
+	}
+
+	if len(matchedQueues) == 0 {
+		if message.Mandatory {
+			opts.returnMessage(message)
+		}
+		opts.confirm(message.ConfirmMeta)
+		return 0, nil
+	}
+
+	vhost.srv.GetMetrics().Publish.Counter.Inc(1)
+
+	if opts.Confirm != nil {
+		message.ConfirmMeta.ExpectedConfirms = len(matchedQueues)
+	}
+
+	pushed := 0
+	// message stored by any queue is confirmed by storage, otherwise it is confirmed once pushed into all queues
+	persisted := false
+	for queueName, queueMessage := range matchedQueues {
+		qu := vhost.GetQueue(queueName)
+		if qu == nil {
+			if message.Mandatory {
+				opts.returnMessage(message)
+			}
+			opts.confirm(message.ConfirmMeta)
+			return pushed, nil
+		}
+
+		qu.Push(queueMessage)
+		pushed++
+		persisted = persisted || qu.Persists(queueMessage)
+
+		ex.GetMetrics().MsgOut.Counter.Inc(1)
+
+		if opts.Confirm != nil && message.ConfirmMeta.CanConfirm() && !persisted {
+			opts.Confirm(message.ConfirmMeta)
+		}
+	}
+	return pushed, nil
+}
+
+// drainingError is error of publish into draining vhost
+func (vhost *VirtualHost) drainingError() *amqp.Error {
+	return amqp.NewChannelError(amqp.AccessRefused, fmt.Sprintf("vhost '%s' is draining, publishes are refused", vhost.GetName()), amqp.ClassBasic, amqp.MethodBasicPublish).WithCode(amqp.ErrVhostDraining)
+}
+
+// refuse nacks message of publisher waiting for confirms, other publishers get error
+func (opts *PublishOpts) refuse(message *amqp.Message, err *amqp.Error) *amqp.Error {
+	if opts.Confirm == nil {
+		return err
+	}
+	message.ConfirmMeta.Nack = true
+	opts.Confirm(message.ConfirmMeta)
+	return nil
+}
+
+func (opts *PublishOpts) returnMessage(message *amqp.Message) {
+	if opts.Return != nil {
+		opts.Return(message)
+	}
+}
+
+func (opts *PublishOpts) confirm(meta *amqp.ConfirmMeta) {
+	if opts.Confirm != nil {
+		opts.Confirm(meta)
+	}
+}
+
+// auditPublish queues audit record of message published into exchange if audit log is enabled
+func (vhost *VirtualHost) auditPublish(message *amqp.Message, user string) {
+	auditLog := vhost.srv.audit
+	if auditLog == nil {
+		return
+	}
+	record := &audit.Record{
+		Timestamp:  time.Now(),
+		Vhost:      vhost.name,
+		Exchange:   message.Exchange,
+		RoutingKey: message.RoutingKey,
+		User:       user,
+		Size:       message.BodySize,
+	}
+	if vhost.srvConfig.Audit.IncludeBody {
+		record.Body = make([]byte, 0, message.BodySize)
+		for _, frame := range message.Body {
+			record.Body = append(record.Body, frame.Payload...)
+		}
+	}
+	auditLog.Write(record)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/auth"
 	"github.com/valinurovam/garagemq/binding"
 	"github.com/valinurovam/garagemq/exchange"
 	"github.com/valinurovam/garagemq/queue"
@@ -23,7 +24,7 @@ func (channel *Channel) queueRoute(method amqp.Method) *amqp.Error {
 		return channel.queueDelete(method)
 	}
 
-	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route queue method "+method.Name(), method.ClassIdentifier(), method.MethodIdentifier())
+	return amqp.NewConnectionError(amqp.NotImplemented, "unable to route queue method "+method.Name(), method.ClassIdentifier(), method.MethodIdentifier()).WithCode(amqp.ErrUnknownMethod)
 }
 
 func (channel *Channel) queueDeclare(method *amqp.QueueDeclare) *amqp.Error {
@@ -36,7 +37,7 @@ func (channel *Channel) queueDeclare(method *amqp.QueueDeclare) *amqp.Error {
 			"queue name is required",
 			method.ClassIdentifier(),
 			method.MethodIdentifier(),
-		)
+		).WithCode(amqp.ErrNameRequired)
 	}
 
 	existingQueue, notFoundErr = channel.getQueueWithError(method.Queue, method)
@@ -55,15 +56,15 @@ func (channel *Channel) queueDeclare(method *amqp.QueueDeclare) *amqp.Error {
 			return exclusiveErr
 		}
 
-		channel.SendMethod(&amqp.QueueDeclareOk{
-			Queue:         method.Queue,
-			MessageCount:  uint32(existingQueue.Length()),
-			ConsumerCount: uint32(existingQueue.ConsumersCount()),
-		})
+		channel.SendMethod(queueDeclareOk(method.Queue, existingQueue))
 
 		return nil
 	}
 
+	if err := channel.checkAccessWithError(auth.AccessConfigure, resourceQueue, method.Queue, method); err != nil {
+		return err
+	}
+
 	newQueue := channel.conn.GetVirtualHost().NewQueue(
 		method.Queue,
 		channel.conn.id,
@@ -72,6 +73,22 @@ func (channel *Channel) queueDeclare(method *amqp.QueueDeclare) *amqp.Error {
 		method.Durable,
 		channel.server.config.Queue.ShardSize,
 	)
+	if err := newQueue.SetArguments(method.Arguments); err != nil {
+		return amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			err.Error(),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		).WithCode(amqp.ErrInvalidArgument)
+	}
+	if err := channel.conn.GetVirtualHost().ApplyQueuePolicy(newQueue); err != nil {
+		return amqp.NewChannelError(
+			amqp.PreconditionFailed,
+			err.Error(),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		).WithCode(amqp.ErrInvalidArgument)
+	}
 
 	if existingQueue != nil {
 		if exclusiveErr != nil {
@@ -84,14 +101,10 @@ func (channel *Channel) queueDeclare(method *amqp.QueueDeclare) *amqp.Error {
 				err.Error(),
 				method.ClassIdentifier(),
 				method.MethodIdentifier(),
-			)
+			).WithCode(amqp.ErrInequivalentArg)
 		}
 
-		channel.SendMethod(&amqp.QueueDeclareOk{
-			Queue:         method.Queue,
-			MessageCount:  uint32(existingQueue.Length()),
-			ConsumerCount: uint32(existingQueue.ConsumersCount()),
-		})
+		channel.SendMethod(queueDeclareOk(method.Queue, existingQueue))
 		return nil
 	}
 
@@ -115,6 +128,18 @@ func (channel *Channel) queueDeclare(method *amqp.QueueDeclare) *amqp.Error {
 }
 
 func (channel *Channel) queueBind(method *amqp.QueueBind) *amqp.Error {
+	if toFile, err := isFileDestination(method.Arguments, method); err != nil {
+		return err
+	} else if toFile {
+		return channel.fileBind(method)
+	}
+	if err := channel.checkAccessWithError(auth.AccessWrite, resourceQueue, method.Queue, method); err != nil {
+		return err
+	}
+	if err := channel.checkAccessWithError(auth.AccessRead, resourceExchange, method.Exchange, method); err != nil {
+		return err
+	}
+
 	var ex *exchange.Exchange
 	var qu *queue.Queue
 	var err *amqp.Error
@@ -131,7 +156,7 @@ func (channel *Channel) queueBind(method *amqp.QueueBind) *amqp.Error {
 			fmt.Sprintf("operation not permitted on the default exchange"),
 			method.ClassIdentifier(),
 			method.MethodIdentifier(),
-		)
+		).WithCode(amqp.ErrDefaultExchange)
 	}
 
 	if qu, err = channel.getQueueWithError(method.Queue, method); err != nil {
@@ -154,11 +179,20 @@ func (channel *Channel) queueBind(method *amqp.QueueBind) *amqp.Error {
 
 	}
 
-	ex.AppendBinding(bind)
+	added, bindErr := ex.AppendBinding(bind)
+	if bindErr != nil {
+		return amqp.NewChannelError(
+			amqp.ResourceError,
+			bindErr.Error(),
+			method.ClassIdentifier(),
+			method.MethodIdentifier(),
+		)
+	}
 
 	// @spec-note
 	// Bindings of durable queues to durable exchanges are automatically durable and the server MUST restore such bindings after a server restart.
-	if ex.IsDurable() && qu.IsDurable() {
+	// Duplicate binding is already persisted
+	if added && ex.IsDurable() && qu.IsDurable() {
 		channel.conn.GetVirtualHost().PersistBinding(bind)
 	}
 
@@ -170,6 +204,18 @@ func (channel *Channel) queueBind(method *amqp.QueueBind) *amqp.Error {
 }
 
 func (channel *Channel) queueUnbind(method *amqp.QueueUnbind) *amqp.Error {
+	if toFile, err := isFileDestination(method.Arguments, method); err != nil {
+		return err
+	} else if toFile {
+		return channel.fileUnbind(method)
+	}
+	if err := channel.checkAccessWithError(auth.AccessWrite, resourceQueue, method.Queue, method); err != nil {
+		return err
+	}
+	if err := channel.checkAccessWithError(auth.AccessRead, resourceExchange, method.Exchange, method); err != nil {
+		return err
+	}
+
 	var ex *exchange.Exchange
 	var qu *queue.Queue
 	var err *amqp.Error
@@ -205,6 +251,10 @@ func (channel *Channel) queueUnbind(method *amqp.QueueUnbind) *amqp.Error {
 }
 
 func (channel *Channel) queuePurge(method *amqp.QueuePurge) *amqp.Error {
+	if err := channel.checkAccessWithError(auth.AccessRead, resourceQueue, method.Queue, method); err != nil {
+		return err
+	}
+
 	var qu *queue.Queue
 	var err *amqp.Error
 
@@ -224,6 +274,10 @@ func (channel *Channel) queuePurge(method *amqp.QueuePurge) *amqp.Error {
 }
 
 func (channel *Channel) queueDelete(method *amqp.QueueDelete) *amqp.Error {
+	if err := channel.checkAccessWithError(auth.AccessConfigure, resourceQueue, method.Queue, method); err != nil {
+		return err
+	}
+
 	var qu *queue.Queue
 	var err *amqp.Error
 
@@ -243,3 +297,13 @@ func (channel *Channel) queueDelete(method *amqp.QueueDelete) *amqp.Error {
 	channel.SendMethod(&amqp.QueueDeleteOk{MessageCount: uint32(length)})
 	return nil
 }
+
+// queueDeclareOk returns queue.declare-ok with current counts of existing queue
+// Counts are read from atomics maintained by the queue, so they are never negative or torn
+func queueDeclareOk(name string, qu *queue.Queue) *amqp.QueueDeclareOk {
+	return &amqp.QueueDeclareOk{
+		Queue:         name,
+		MessageCount:  uint32(qu.Length()),
+		ConsumerCount: uint32(qu.ConsumersCount()),
+	}
+}
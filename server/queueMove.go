@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/valinurovam/garagemq/amqp"
+)
+
+// Moving messages
+// Messages are taken from source queue head one by one and published through exchange with routing key,
+// moved message is acked in source queue only after it is pushed into all matched queues, so it may be duplicated
+// but is not lost if server fails in between. Order of messages is kept. In copy mode taken messages are returned
+// into source queue on their positions after they are published. Messages already delivered to consumers
+// and not acked yet are not moved.
+
+// MoveMessages moves messages from queue through exchange with routing key, copyOnly keeps them in source queue
+// Up to count messages are moved, zero count means all messages ready at the moment of call
+// Returns count of moved messages
+func (vhost *VirtualHost) MoveMessages(queueName string, exName string, routingKey string, count int, copyOnly bool) (int, error) {
+	qu := vhost.GetQueue(queueName)
+	if qu == nil {
+		return 0, fmt.Errorf("queue '%s' not found", queueName)
+	}
+	if qu.IsStream() {
+		return 0, fmt.Errorf("messages of stream queue '%s' can not be moved", queueName)
+	}
+	if qu.IsPaused() {
+		return 0, fmt.Errorf("queue '%s' is paused", queueName)
+	}
+	if vhost.GetExchange(exName) == nil {
+		return 0, fmt.Errorf("exchange '%s' not found", exName)
+	}
+
+	// messages moved into source queue itself are not taken again
+	if length := int(qu.Length()); count <= 0 || count > length {
+		count = length
+	}
+
+	var taken []*amqp.Message
+	moved := 0
+	var moveErr error
+	for moved < count {
+		message := qu.Pop()
+		if message == nil {
+			break
+		}
+		qu.GetMetrics().Ready.Counter.Dec(1)
+		qu.GetMetrics().ServerReady.Counter.Dec(1)
+		qu.GetMetrics().Unacked.Counter.Inc(1)
+		qu.GetMetrics().ServerUnacked.Counter.Inc(1)
+
+		if moveErr = vhost.publishMoved(exName, routingKey, message); moveErr != nil {
+			taken = append(taken, message)
+			break
+		}
+		moved++
+
+		if copyOnly {
+			taken = append(taken, message)
+		} else {
+			qu.AckMsg(message)
+		}
+	}
+
+	// requeued messages are restored on their positions
+	for _, message := range taken {
+		// taken message is not delivered, so requeue should not count delivery
+		message.DeliveryCount--
+		qu.Requeue(message)
+	}
+
+	return moved, moveErr
+}
+
+// publishMoved publishes message copy through exchange with routing key as new message,
+// returns error if message is refused or is not routed into any queue
+func (vhost *VirtualHost) publishMoved(exName string, routingKey string, message *amqp.Message) error {
+	moved := message.Copy()
+	// new id is generated on push, so copy does not share storage key with source message
+	moved.ID = 0
+	moved.DeliveryCount = 0
+
+	routed := true
+	if err := vhost.Publish(exName, routingKey, moved, PublishOpts{
+		Mandatory: true,
+		Return: func(message *amqp.Message) {
+			routed = false
+		},
+	}); err != nil {
+		return err
+	}
+	if !routed {
+		return fmt.Errorf("message is not routed by exchange '%s' with routing key '%s'", exName, routingKey)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/queue"
+)
+
+// replayBatchSize is max count of stream messages copied at once, they are published outside of stream lock
+const replayBatchSize = 256
+
+// Replaying stream
+// Messages retained by stream queue are copied into destination queue for reprocessing. Range is given by
+// offsets or timestamps like x-stream-offset consumer argument, timestamp points to the first message stored
+// at or after it, so time range selects messages stored within it. Start is inclusive and end is exclusive,
+// absent start means the first retained message and absent end means the last one. Replayed messages are
+// published into destination queue by default exchange as new messages with x-stream-offset header of their
+// source offset, source stream is not changed.
+
+// ReplayStream copies messages of stream queue within offset or time range into destination queue
+// Returns count of replayed messages
+func (vhost *VirtualHost) ReplayStream(queueName string, destName string, from interface{}, to interface{}) (int, error) {
+	qu := vhost.GetQueue(queueName)
+	if qu == nil {
+		return 0, fmt.Errorf("queue '%s' not found", queueName)
+	}
+	if !qu.IsStream() {
+		return 0, fmt.Errorf("queue '%s' is not a stream", queueName)
+	}
+	if destName == queueName {
+		return 0, fmt.Errorf("stream '%s' can not be replayed into itself", queueName)
+	}
+	if vhost.GetQueue(destName) == nil {
+		return 0, fmt.Errorf("queue '%s' not found", destName)
+	}
+
+	if from == nil {
+		from = queue.StreamOffsetFirst
+	}
+	if to == nil {
+		to = queue.StreamOffsetNext
+	}
+	start, err := qu.StreamOffset(from)
+	if err != nil {
+		return 0, err
+	}
+	end, err := qu.StreamOffset(to)
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for start < end {
+		var messages []*amqp.Message
+		if messages, start = qu.StreamRange(start, end, replayBatchSize); len(messages) == 0 {
+			break
+		}
+		for _, message := range messages {
+			if err := vhost.publishMoved("", destName, message); err != nil {
+				return replayed, err
+			}
+			replayed++
+		}
+	}
+	return replayed, nil
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RequeueUnacked requeues all messages of queue delivered to consumers of any channel and not acked yet,
+// so messages held by stuck consumers are delivered again with redelivered flag
+// Requeued messages are removed from unacked messages of their channels, so later ack of such message
+// by client fails with unknown delivery tag, as after consumer timeout
+// Returns count of requeued messages
+func (vhost *VirtualHost) RequeueUnacked(queueName string) (int, error) {
+	qu := vhost.GetQueue(queueName)
+	if qu == nil {
+		return 0, fmt.Errorf("queue '%s' not found", queueName)
+	}
+	if qu.IsStream() {
+		return 0, fmt.Errorf("messages of stream queue '%s' can not be requeued", queueName)
+	}
+
+	requeued := 0
+	for _, conn := range vhost.srv.getConnections() {
+		if conn.GetVirtualHost() != vhost {
+			continue
+		}
+		for _, channel := range conn.getChannels() {
+			if channel.id != 0 {
+				requeued += channel.requeueQueueUnacked(queueName)
+			}
+		}
+	}
+
+	vhost.logger.WithFields(log.Fields{
+		"queueName": queueName,
+		"requeued":  requeued,
+	}).Info("Unacked messages requeued")
+	return requeued, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/queue"
+)
+
+// Retiring queue
+// Retired queue refuses new publishes: message routed only into it is nacked in confirm mode or treated
+// as unroutable otherwise. Consumers drain queued messages and queue is deleted once it has no ready
+// and unacked messages. If timeout elapses first, action is chosen by onTimeout: RetireAbort accepts
+// publishes again and keeps queue, RetireDelete deletes queue discarding remaining messages and
+// RetireDeadLetter moves remaining ready messages into dead-letter queue before delete.
+const (
+	RetireAbort      = "abort"
+	RetireDelete     = "delete"
+	RetireDeadLetter = "dead-letter"
+)
+
+// retirePollInterval is interval of checking retired queue is drained
+const retirePollInterval = 20 * time.Millisecond
+
+// RetireQueue refuses publishes into queue, waits until it is drained by consumers and deletes it
+// Returns count of messages discarded or dead-lettered on timeout
+func (vhost *VirtualHost) RetireQueue(queueName string, timeout time.Duration, onTimeout string, deadLetter string) (int, error) {
+	qu := vhost.GetQueue(queueName)
+	if qu == nil {
+		return 0, fmt.Errorf("queue '%s' not found", queueName)
+	}
+	if qu.IsStream() {
+		return 0, fmt.Errorf("stream queue '%s' is never drained and can not be retired", queueName)
+	}
+	switch onTimeout {
+	case RetireAbort, RetireDelete:
+	case RetireDeadLetter:
+		if deadLetter == "" || deadLetter == queueName || vhost.GetQueue(deadLetter) == nil {
+			return 0, fmt.Errorf("dead-letter queue '%s' not found", deadLetter)
+		}
+	default:
+		return 0, fmt.Errorf("unknown timeout action '%s'", onTimeout)
+	}
+
+	qu.SetPublishPaused(true)
+	if drained(qu, timeout) {
+		_, err := vhost.DeleteQueue(queueName, false, false)
+		return 0, err
+	}
+
+	switch onTimeout {
+	case RetireAbort:
+		qu.SetPublishPaused(false)
+		return 0, fmt.Errorf("queue '%s' is not drained in %s, %d messages left", queueName, timeout, qu.Length())
+	case RetireDeadLetter:
+		moved, err := vhost.MoveMessages(queueName, "", deadLetter, 0, false)
+		if err != nil {
+			qu.SetPublishPaused(false)
+			return moved, err
+		}
+		_, err = vhost.DeleteQueue(queueName, false, false)
+		return moved, err
+	}
+	length, err := vhost.DeleteQueue(queueName, false, false)
+	return int(length), err
+}
+
+// drained waits until queue has no ready and unacked messages, returns false on timeout
+func drained(qu *queue.Queue, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if qu.Length() == 0 && qu.GetMetrics().Unacked.Counter.Count() == 0 {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(retirePollInterval)
+	}
+}
+
+// dropRetired removes retired queues from matched ones, returns true if any is removed
+func (vhost *VirtualHost) dropRetired(matchedQueues map[string]*amqp.Message) bool {
+	dropped := false
+	for queueName := range matchedQueues {
+		if qu := vhost.GetQueue(queueName); qu != nil && qu.IsPublishPaused() {
+			delete(matchedQueues, queueName)
+			dropped = true
+		}
+	}
+	return dropped
+}
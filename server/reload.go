@@ -0,0 +1,265 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/auth"
+	"github.com/valinurovam/garagemq/config"
+)
+
+// Config reload
+// Server re-reads config file on SIGHUP and applies settings which can be changed without restart:
+// log level, users and their permissions, config policies (publish rate limits and other arguments they define)
+// and output high watermark of new connections. Connections and messages are kept. New config is validated
+// before anything is applied, so invalid config is rejected as a whole. Other changed settings, e.g. listen
+// addresses, require restart and are reported as ignored.
+
+// ReloadReport lists settings changed by reloaded config
+type ReloadReport struct {
+	Applied []string
+	Ignored []string
+}
+
+// SetConfigFile sets path of config file re-read on SIGHUP
+func (srv *Server) SetConfigFile(path string) {
+	srv.reloadLock.Lock()
+	defer srv.reloadLock.Unlock()
+	srv.configFile = path
+}
+
+// reloadConfigFile re-reads config file and applies it, called on SIGHUP
+func (srv *Server) reloadConfigFile() {
+	srv.reloadLock.Lock()
+	path := srv.configFile
+	srv.reloadLock.Unlock()
+	if path == "" {
+		log.Warn("Config file is not set, nothing to reload")
+		return
+	}
+
+	cfg, err := config.CreateFromFile(path)
+	if err == nil {
+		_, err = srv.Reload(cfg)
+	}
+	if err != nil {
+		log.WithError(err).WithField("config", path).Error("Error on reloading config")
+	}
+}
+
+// Reload applies reloadable settings of new config and returns changed settings
+// Nothing is applied if new config is not valid
+func (srv *Server) Reload(cfg *config.Config) (*ReloadReport, error) {
+	srv.reloadLock.Lock()
+	defer srv.reloadLock.Unlock()
+
+	current := srv.config
+	report := &ReloadReport{}
+
+	var level log.Level
+	levelChanged := cfg.Log.Level != current.Log.Level && cfg.Log.Level != ""
+	if levelChanged {
+		var err error
+		if level, err = log.ParseLevel(cfg.Log.Level); err != nil {
+			return nil, err
+		}
+	}
+
+	usersChanged := !reflect.DeepEqual(cfg.Users, current.Users)
+	var users map[string]string
+	var authorizer *auth.StaticAuthorizer
+	if usersChanged {
+		var err error
+		// default permissions are part of security section, which is not reloaded
+		if users, authorizer, err = buildUsers(cfg.Users, current.Security.DefaultPermissions); err != nil {
+			return nil, err
+		}
+	}
+
+	policiesChanged := !reflect.DeepEqual(cfg.Policies, current.Policies)
+	var policies map[string][]*Policy
+	if policiesChanged {
+		var err error
+		if policies, err = srv.buildPolicies(cfg.Policies); err != nil {
+			return nil, err
+		}
+	}
+
+	if levelChanged {
+		log.SetLevel(level)
+		current.Log = cfg.Log
+		report.Applied = append(report.Applied, "log.level")
+	}
+
+	if usersChanged {
+		srv.users = users
+		if srv.usersAuthenticator != nil {
+			srv.usersAuthenticator.SetUsers(users)
+		}
+		if static, ok := srv.authorizer.(*auth.StaticAuthorizer); ok {
+			static.Replace(authorizer)
+		}
+		current.Users = cfg.Users
+		report.Applied = append(report.Applied, "users")
+	}
+
+	if policiesChanged {
+		srv.applyPolicies(current.Policies, policies)
+		current.Policies = cfg.Policies
+		report.Applied = append(report.Applied, "policies")
+	}
+
+	if cfg.Connection.OutputHighWatermark != current.Connection.OutputHighWatermark {
+		atomic.StoreInt64(&srv.outputHighWatermark, int64(cfg.Connection.OutputHighWatermark))
+		report.Applied = append(report.Applied, "connection.outputHighWatermark")
+	}
+
+	report.Ignored = restartRequired(current, cfg)
+
+	log.WithFields(log.Fields{
+		"applied": report.Applied,
+		"ignored": report.Ignored,
+	}).Info("Config reloaded")
+	if len(report.Ignored) > 0 {
+		log.WithField("ignored", report.Ignored).Warn("Changed settings require restart and are ignored")
+	}
+
+	return report, nil
+}
+
+// restartRequired returns names of changed config sections which can not be applied without restart
+func restartRequired(current *config.Config, cfg *config.Config) []string {
+	// output high watermark is reloadable, other connection settings are not
+	currentConnection := current.Connection
+	currentConnection.OutputHighWatermark = 0
+	connection := cfg.Connection
+	connection.OutputHighWatermark = 0
+
+	sections := []struct {
+		name    string
+		current interface{}
+		new     interface{}
+	}{
+		{"proto", current.Proto, cfg.Proto},
+		{"tcp", current.TCP, cfg.TCP},
+		{"tls", current.TLS, cfg.TLS},
+		{"queue", current.Queue, cfg.Queue},
+		{"exchange", current.Exchange, cfg.Exchange},
+		{"db", current.Db, cfg.Db},
+		{"vhost", current.Vhost, cfg.Vhost},
+		{"security", current.Security, cfg.Security},
+		{"connection", currentConnection, connection},
+		{"admin", current.Admin, cfg.Admin},
+		{"audit", current.Audit, cfg.Audit},
+		{"replication", current.Replication, cfg.Replication},
+		{"debug", current.Debug, cfg.Debug},
+	}
+
+	var ignored []string
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.current, section.new) {
+			ignored = append(ignored, section.name)
+		}
+	}
+	return ignored
+}
+
+// buildUsers returns password hashes and permissions of config users and default permissions
+func buildUsers(users []config.User, defaults []config.Permission) (map[string]string, *auth.StaticAuthorizer, error) {
+	hashes := make(map[string]string)
+	authorizer := auth.NewStaticAuthorizer()
+	for _, permission := range defaults {
+		permissions, err := auth.NewPermissions(permission.Configure, permission.Write, permission.Read)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid default permissions for vhost '%s': %s", permission.Vhost, err.Error())
+		}
+		authorizer.SetDefaultPermissions(permission.Vhost, permissions)
+	}
+	for _, user := range users {
+		hashes[user.Username] = user.Password
+		authorizer.AddUser(user.Username)
+		for _, permission := range user.Permissions {
+			permissions, err := auth.NewPermissions(permission.Configure, permission.Write, permission.Read)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid permissions of user '%s' for vhost '%s': %s", user.Username, permission.Vhost, err.Error())
+			}
+			authorizer.SetPermissions(user.Username, permission.Vhost, permissions)
+		}
+	}
+	return hashes, authorizer, nil
+}
+
+// buildPolicies returns config policies grouped by vhost, vhosts must exist
+func (srv *Server) buildPolicies(configPolicies []config.Policy) (map[string][]*Policy, error) {
+	policies := make(map[string][]*Policy)
+	for _, configPolicy := range configPolicies {
+		vhostName := configPolicy.Vhost
+		if vhostName == "" {
+			vhostName = srv.config.Vhost.DefaultPath
+		}
+		if srv.getVhost(vhostName) == nil {
+			return nil, fmt.Errorf("vhost '%s' of policy '%s' not found", vhostName, configPolicy.Name)
+		}
+		policy, err := NewPolicy(configPolicy.Name, configPolicy.Pattern, configPolicy.ApplyTo, configPolicy.Priority, policyDefinition(configPolicy.Definition))
+		if err != nil {
+			return nil, err
+		}
+		policies[vhostName] = append(policies[vhostName], policy)
+	}
+	return policies, nil
+}
+
+// applyPolicies sets config policies and deletes ones defined by previous config but removed from new one
+func (srv *Server) applyPolicies(previous []config.Policy, policies map[string][]*Policy) {
+	for _, configPolicy := range previous {
+		vhostName := configPolicy.Vhost
+		if vhostName == "" {
+			vhostName = srv.config.Vhost.DefaultPath
+		}
+		kept := false
+		for _, policy := range policies[vhostName] {
+			kept = kept || policy.Name == configPolicy.Name
+		}
+		if vhost := srv.getVhost(vhostName); vhost != nil && !kept {
+			vhost.DeletePolicy(configPolicy.Name)
+		}
+	}
+
+	for vhostName, vhostPolicies := range policies {
+		vhost := srv.getVhost(vhostName)
+		for _, policy := range vhostPolicies {
+			vhost.SetPolicy(policy)
+		}
+	}
+}
+
+// policyDefinition converts yaml values of policy definition into amqp table values
+func policyDefinition(definition map[string]interface{}) amqp.Table {
+	table := amqp.Table{}
+	for key, value := range definition {
+		table[key] = policyValue(value)
+	}
+	return table
+}
+
+func policyValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case int:
+		return int64(value)
+	case map[interface{}]interface{}:
+		table := amqp.Table{}
+		for key, item := range value {
+			table[fmt.Sprint(key)] = policyValue(item)
+		}
+		return table
+	case []interface{}:
+		for i, item := range value {
+			value[i] = policyValue(item)
+		}
+		return value
+	}
+	return value
+}
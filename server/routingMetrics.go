@@ -0,0 +1,67 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/valinurovam/garagemq/metrics"
+)
+
+// routingMetricsOther is bucket of messages whose routing key has none of configured prefixes
+const routingMetricsOther = "other"
+
+// routingMetrics counts published messages by buckets of routing key prefixes from exchange.routingKeyPrefixes,
+// so traffic of logical streams is seen without counter per routing key
+// Prefix may end with "*" or "#" wildcard, e.g. "orders.*" counts every key starting with "orders."
+type routingMetrics struct {
+	// bucket names ordered by prefix length, so the longest matched prefix wins
+	buckets  []string
+	prefixes map[string]string
+	counters map[string]*metrics.TrackCounter
+}
+
+func newRoutingMetrics(prefixes []string) *routingMetrics {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	rm := &routingMetrics{
+		prefixes: make(map[string]string),
+		counters: make(map[string]*metrics.TrackCounter),
+	}
+	rm.counters[routingMetricsOther] = metrics.AddCounter("server.routing." + routingMetricsOther)
+	for _, bucket := range prefixes {
+		if _, ok := rm.counters[bucket]; ok {
+			continue
+		}
+		rm.counters[bucket] = metrics.AddCounter("server.routing." + bucket)
+		rm.buckets = append(rm.buckets, bucket)
+		rm.prefixes[bucket] = strings.TrimRight(bucket, "*#")
+	}
+	sort.SliceStable(rm.buckets, func(i, j int) bool {
+		return len(rm.prefixes[rm.buckets[i]]) > len(rm.prefixes[rm.buckets[j]])
+	})
+	return rm
+}
+
+// add increments bucket of routing key
+func (rm *routingMetrics) add(routingKey string) {
+	if rm == nil {
+		return
+	}
+	for _, bucket := range rm.buckets {
+		if strings.HasPrefix(routingKey, rm.prefixes[bucket]) {
+			rm.counters[bucket].Counter.Inc(1)
+			return
+		}
+	}
+	rm.counters[routingMetricsOther].Counter.Inc(1)
+}
+
+// GetRoutingMetrics returns counters of published messages by routing key prefix bucket,
+// nil if routing key prefixes are not configured
+func (srv *Server) GetRoutingMetrics() map[string]*metrics.TrackCounter {
+	if srv.routingMetrics == nil {
+		return nil
+	}
+	return srv.routingMetrics.counters
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"time"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/binding"
+	"github.com/valinurovam/garagemq/exchange"
+)
+
+// isRoutingTraced returns is routing trace enabled for virtual host by config
+func (vhost *VirtualHost) isRoutingTraced() bool {
+	for _, name := range vhost.srvConfig.Vhost.RoutingTrace {
+		if name == vhost.name {
+			return true
+		}
+	}
+	return false
+}
+
+// routingTraceEntry returns trace entry of exchange visited by message with routing keys of matched bindings
+func routingTraceEntry(ex *exchange.Exchange, bindings []*binding.Binding, now time.Time) amqp.Table {
+	keys := make([]interface{}, 0, len(bindings))
+	for _, bind := range bindings {
+		keys = append(keys, bind.GetRoutingKey())
+	}
+	return amqp.Table{
+		"exchange":     ex.GetName(),
+		"binding-keys": keys,
+		"timestamp":    now,
+	}
+}
+
+// traceRoutes replaces messages matched for queues by copies with trace entries appended to routing trace header
+// Trace is set once routing is done, so it never takes part in matching by exchanges it lists
+func traceRoutes(matchedQueues map[string]*amqp.Message, trace []interface{}) {
+	traced := make(map[*amqp.Message]*amqp.Message)
+	for queueName, message := range matchedQueues {
+		tracedMessage, ok := traced[message]
+		if !ok {
+			tracedMessage = withRoutingTrace(message, trace)
+			traced[message] = tracedMessage
+		}
+		matchedQueues[queueName] = tracedMessage
+	}
+}
+
+// withRoutingTrace returns copy of message with trace entries appended to entries already set in header
+func withRoutingTrace(message *amqp.Message, trace []interface{}) *amqp.Message {
+	traced := message.Copy()
+	if traced.Header == nil {
+		traced.Header = &amqp.ContentHeader{}
+	}
+	if traced.Header.PropertyList == nil {
+		traced.Header.PropertyList = &amqp.BasicPropertyList{}
+	}
+	if traced.Header.PropertyList.Headers == nil {
+		traced.Header.PropertyList.Headers = &amqp.Table{}
+	}
+	headers := *traced.Header.PropertyList.Headers
+	var entries []interface{}
+	if current, ok := headers[amqp.RoutingTraceHeader].([]interface{}); ok {
+		entries = append(entries, current...)
+	}
+	headers[amqp.RoutingTraceHeader] = append(entries, trace...)
+	return traced
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/valinurovam/garagemq/consumer"
+)
+
+// deliveryScheduler implements fair delivery between consumers of one connection
+// Each scheduled consumer delivers one message per turn and after that goes to the tail of the ready list,
+// so a high-volume queue can't monopolize the connection and starve consumers of low-volume queues
+// While connection output buffer is overloaded no consumer is handled
+type deliveryScheduler struct {
+	lock   sync.Mutex
+	ready  []*consumer.Consumer
+	queued map[uint64]bool
+	signal chan struct{}
+	output *outputBuffer
+}
+
+func newDeliveryScheduler(output *outputBuffer) *deliveryScheduler {
+	return &deliveryScheduler{
+		queued: make(map[uint64]bool),
+		signal: make(chan struct{}, 1),
+		output: output,
+	}
+}
+
+// Schedule appends consumer into the ready list
+// Returns false if consumer is already waiting for its turn
+func (scheduler *deliveryScheduler) Schedule(cmr *consumer.Consumer) bool {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	if scheduler.queued[cmr.ID] {
+		return false
+	}
+	scheduler.queued[cmr.ID] = true
+	scheduler.ready = append(scheduler.ready, cmr)
+
+	select {
+	case scheduler.signal <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (scheduler *deliveryScheduler) next() *consumer.Consumer {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	if len(scheduler.ready) == 0 {
+		return nil
+	}
+	cmr := scheduler.ready[0]
+	scheduler.ready[0] = nil
+	scheduler.ready = scheduler.ready[1:]
+	delete(scheduler.queued, cmr.ID)
+
+	return cmr
+}
+
+// run handles ready consumers in round-robin order until context is done
+func (scheduler *deliveryScheduler) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-scheduler.signal:
+		}
+
+		for {
+			if !scheduler.output.waitDrained(ctx) {
+				return
+			}
+			cmr := scheduler.next()
+			if cmr == nil {
+				break
+			}
+			if cmr.Deliver() {
+				scheduler.Schedule(cmr)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+		}
+	}
+}
@@ -1,10 +1,17 @@
 package server
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"sync"
@@ -12,11 +19,14 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/audit"
 	"github.com/valinurovam/garagemq/auth"
 	"github.com/valinurovam/garagemq/config"
 	"github.com/valinurovam/garagemq/interfaces"
 	"github.com/valinurovam/garagemq/metrics"
 	"github.com/valinurovam/garagemq/msgstorage"
+	"github.com/valinurovam/garagemq/queue"
+	"github.com/valinurovam/garagemq/replication"
 	"github.com/valinurovam/garagemq/srvstorage"
 	"github.com/valinurovam/garagemq/storage"
 )
@@ -30,6 +40,20 @@ const (
 	Stopping
 )
 
+// authentication backends
+const (
+	authBackendInternal = "internal"
+	authBackendLDAP     = "ldap"
+	authBackendJWT      = "jwt"
+)
+
+// replication roles
+const (
+	ReplicationStandalone = "standalone"
+	ReplicationLeader     = "leader"
+	ReplicationFollower   = "follower"
+)
+
 type SrvMetricsState struct {
 	Publish *metrics.TrackCounter
 	Deliver *metrics.TrackCounter
@@ -47,33 +71,61 @@ type SrvMetricsState struct {
 
 // Server implements AMQP server
 type Server struct {
-	host         string
-	port         string
-	protoVersion string
-	listener     *net.TCPListener
-	connSeq      uint64
-	connLock     sync.Mutex
-	connections  map[uint64]*Connection
-	config       *config.Config
-	users        map[string]string
-	vhostsLock   sync.Mutex
-	vhosts       map[string]*VirtualHost
-	status       ServerState
-	storage      *srvstorage.SrvStorage
-	metrics      *SrvMetricsState
+	host           string
+	port           string
+	protoVersion   string
+	listener       *net.TCPListener
+	tlsListener    *net.TCPListener
+	tlsConfig      *tls.Config
+	connSeq        uint64
+	connLock       sync.Mutex
+	connections    map[uint64]*Connection
+	config         *config.Config
+	users          map[string]string
+	saslMechanisms *auth.Mechanisms
+	authenticator  auth.Authenticator
+	authorizer     auth.Authorizer
+	vhostsLock     sync.Mutex
+	vhosts         map[string]*VirtualHost
+	status         ServerState
+	storage        *srvstorage.SrvStorage
+	metrics        *SrvMetricsState
+	audit          *audit.Log
+
+	replicationLock sync.Mutex
+	leader          *replication.Leader
+	follower        *replication.Follower
+	promoted        chan struct{}
+
+	reloadLock sync.Mutex
+	configFile string
+	// local users authenticator, nil if internal backend is not configured
+	usersAuthenticator *auth.UsersAuthenticator
+	// output high watermark of new connections, it is changed by config reload
+	outputHighWatermark int64
+	// debug file sinks of file bindings by file name
+	fileSinkLock sync.RWMutex
+	fileSinks    map[string]*fileSink
+	// published messages by routing key prefix, nil if prefixes are not configured
+	routingMetrics *routingMetrics
 }
 
 // NewServer returns new instance of AMQP Server
 func NewServer(host string, port string, protoVersion string, config *config.Config) (server *Server) {
 	server = &Server{
-		host:         host,
-		port:         port,
-		connections:  make(map[uint64]*Connection),
-		protoVersion: protoVersion,
-		config:       config,
-		users:        make(map[string]string),
-		vhosts:       make(map[string]*VirtualHost),
-		connSeq:      0,
+		host:           host,
+		port:           port,
+		connections:    make(map[uint64]*Connection),
+		protoVersion:   protoVersion,
+		config:         config,
+		users:          make(map[string]string),
+		authorizer:     auth.NewStaticAuthorizer(),
+		saslMechanisms: auth.NewMechanisms(),
+		vhosts:         make(map[string]*VirtualHost),
+		connSeq:        0,
+
+		outputHighWatermark: int64(config.Connection.OutputHighWatermark),
+		fileSinks:           make(map[string]*fileSink),
 	}
 	server.initMetrics()
 
@@ -95,6 +147,7 @@ func (srv *Server) initMetrics() {
 		TrafficIn:  metrics.AddCounter("server.traffic_in"),
 		TrafficOut: metrics.AddCounter("server.traffic_out"),
 	}
+	srv.routingMetrics = newRoutingMetrics(srv.config.Exchange.RoutingKeyPrefixes)
 }
 
 // Start start main server loop
@@ -105,14 +158,28 @@ func (srv *Server) Start() {
 
 	go srv.hookSignals()
 
-	srv.initServerStorage()
+	// admin API authenticates promote request of follower by broker users
 	srv.initUsers()
+	srv.follow()
+	srv.initReplicationLeader()
+	srv.initServerStorage()
+	srv.initAudit()
 	if srv.storage.IsFirstStart() {
 		srv.initDefaultVirtualHosts()
 	} else {
+		srv.migrateServerStorage()
 		srv.initVirtualHostsFromStorage()
 	}
+	srv.initPolicies()
+	if err := srv.initDefinitions(); err != nil {
+		log.WithError(err).WithField("file", srv.config.Definitions).Error("Error on importing definitions")
+		os.Exit(1)
+	}
 
+	if srv.config.TLS.Port != "" {
+		srv.initTLS()
+		go srv.listenTLS()
+	}
 	go srv.listen()
 
 	srv.storage.UpdateLastStart()
@@ -128,6 +195,11 @@ func (srv *Server) Stop() {
 
 	// stop accept new connections
 	srv.listener.Close()
+	if srv.tlsListener != nil {
+		srv.tlsListener.Close()
+	}
+
+	srv.drainConsumers()
 
 	var wg sync.WaitGroup
 	srv.connLock.Lock()
@@ -144,6 +216,22 @@ func (srv *Server) Stop() {
 		virtualHost.Stop()
 	}
 
+	if srv.audit != nil {
+		if err := srv.audit.Close(); err != nil {
+			log.WithError(err).Error("Error on closing audit log")
+		}
+	}
+	srv.closeFileSinks()
+
+	srv.replicationLock.Lock()
+	if srv.follower != nil {
+		srv.follower.Close()
+	}
+	if srv.leader != nil {
+		srv.leader.Close()
+	}
+	srv.replicationLock.Unlock()
+
 	if srv.storage != nil {
 		srv.storage.Close()
 	}
@@ -151,6 +239,32 @@ func (srv *Server) Stop() {
 	srv.status = Stopped
 }
 
+// drainConsumers lets consumers finish in-flight messages before connections are closed
+func (srv *Server) drainConsumers() {
+	timeout := srv.config.Queue.DrainTimeout
+	if timeout == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, virtualHost := range srv.vhosts {
+		for _, qu := range virtualHost.GetQueues() {
+			wg.Add(1)
+			go func(qu *queue.Queue) {
+				defer wg.Done()
+				if err := qu.DrainConsumers(ctx); err != nil {
+					log.WithError(err).WithFields(log.Fields{
+						"queueName": qu.GetName(),
+					}).Warn("Consumers are not drained")
+				}
+			}(qu)
+		}
+	}
+	wg.Wait()
+}
+
 func (srv *Server) getVhost(name string) *VirtualHost {
 	srv.vhostsLock.Lock()
 	defer srv.vhostsLock.Unlock()
@@ -159,9 +273,29 @@ func (srv *Server) getVhost(name string) *VirtualHost {
 }
 
 func (srv *Server) listen() {
-	address := srv.host + ":" + srv.port
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", address)
-	srv.listener, err = net.ListenTCP("tcp", tcpAddr)
+	srv.listener = srv.startListener(srv.port)
+	daemonReady()
+	srv.serve(srv.listener, nil)
+}
+
+// listenTLS accepts TLS connections, TLS server name of connection may select its default vhost
+func (srv *Server) listenTLS() {
+	srv.tlsListener = srv.startListener(srv.config.TLS.Port)
+	srv.serve(srv.tlsListener, srv.tlsConfig)
+}
+
+func (srv *Server) initTLS() {
+	cert, err := tls.LoadX509KeyPair(srv.config.TLS.CertFile, srv.config.TLS.KeyFile)
+	if err != nil {
+		log.WithError(err).Error("Error on loading TLS certificate")
+		os.Exit(1)
+	}
+	srv.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func (srv *Server) startListener(port string) *net.TCPListener {
+	address := srv.host + ":" + port
+	listener, err := srv.listenTCP(address)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"address": address,
@@ -171,12 +305,15 @@ func (srv *Server) listen() {
 
 	log.WithFields(log.Fields{
 		"address": address,
+		"tls":     port == srv.config.TLS.Port,
 	}).Info("Server started")
 
-	daemonReady()
+	return listener
+}
 
+func (srv *Server) serve(listener *net.TCPListener, tlsConfig *tls.Config) {
 	for {
-		conn, err := srv.listener.AcceptTCP()
+		conn, err := listener.AcceptTCP()
 		if err != nil {
 			if srv.status != Running {
 				return
@@ -188,11 +325,13 @@ func (srv *Server) listen() {
 			"to":   conn.LocalAddr().String(),
 		}).Info("accepting connection")
 
-		conn.SetReadBuffer(srv.config.TCP.ReadBufSize)
-		conn.SetWriteBuffer(srv.config.TCP.WriteBufSize)
-		conn.SetNoDelay(srv.config.TCP.Nodelay)
+		srv.tuneConnection(conn)
 
-		srv.acceptConnection(conn)
+		if tlsConfig != nil {
+			srv.acceptConnection(tls.Server(conn, tlsConfig))
+		} else {
+			srv.acceptConnection(conn)
+		}
 	}
 }
 
@@ -202,7 +341,7 @@ func (srv *Server) stopWithError(err error, msg string) {
 	os.Exit(1)
 }
 
-func (srv *Server) acceptConnection(conn *net.TCPConn) {
+func (srv *Server) acceptConnection(conn net.Conn) {
 	srv.connLock.Lock()
 	defer srv.connLock.Unlock()
 
@@ -218,24 +357,193 @@ func (srv *Server) removeConnection(connID uint64) {
 	delete(srv.connections, connID)
 }
 
-func (srv *Server) checkAuth(saslData auth.SaslData) bool {
-	for userName, passwordHash := range srv.users {
-		if userName != saslData.Username {
-			continue
+// getConnections returns copy of current connections list
+func (srv *Server) getConnections() []*Connection {
+	srv.connLock.Lock()
+	defer srv.connLock.Unlock()
+	connections := make([]*Connection, 0, len(srv.connections))
+	for _, conn := range srv.connections {
+		connections = append(connections, conn)
+	}
+	return connections
+}
+
+func (srv *Server) initUsers() {
+	users, authorizer, err := buildUsers(srv.config.Users, srv.config.Security.DefaultPermissions)
+	if err != nil {
+		log.WithError(err).Error("Error on parsing user permissions")
+		os.Exit(1)
+	}
+	srv.users = users
+	srv.authorizer = authorizer
+	srv.initAuthenticator()
+}
+
+// initPolicies applies policies defined by config
+func (srv *Server) initPolicies() {
+	policies, err := srv.buildPolicies(srv.config.Policies)
+	if err != nil {
+		log.WithError(err).Error("Error on parsing policies")
+		os.Exit(1)
+	}
+	srv.applyPolicies(nil, policies)
+}
+
+// initAuthenticator chains configured authentication backends, internal users are used by default,
+// and registers SASL mechanisms checking credentials by them
+func (srv *Server) initAuthenticator() {
+	backends := srv.config.Security.AuthBackends
+	if len(backends) == 0 {
+		backends = []string{authBackendInternal}
+	}
+
+	var chain auth.ChainAuthenticator
+	for _, backend := range backends {
+		switch backend {
+		case authBackendInternal:
+			srv.usersAuthenticator = auth.NewUsersAuthenticator(srv.users, srv.config.Security.PasswordCheck == "md5")
+			chain = append(chain, srv.usersAuthenticator)
+		case authBackendLDAP:
+			chain = append(chain, srv.newLDAPAuthenticator())
+		case authBackendJWT:
+			jwtConfig := srv.config.Security.JWT
+			chain = append(chain, auth.NewJWTAuthenticator(
+				jwtConfig.JWKSURL,
+				jwtConfig.RefreshInterval,
+				jwtConfig.ResourceServerID,
+				&http.Client{Timeout: jwtConfig.Timeout},
+			))
+		default:
+			log.WithFields(log.Fields{
+				"backend": backend,
+			}).Error("Unknown authentication backend")
+			os.Exit(1)
 		}
+	}
+	srv.authenticator = chain
+	srv.saslMechanisms.Register(auth.SaslPlain, auth.NewPlainMechanism(chain))
+}
+
+func (srv *Server) newLDAPAuthenticator() *auth.LDAPAuthenticator {
+	ldapConfig := srv.config.Security.LDAP
+	ldapURL, err := url.Parse(ldapConfig.URL)
+	if err != nil {
+		log.WithError(err).Error("Error on parsing LDAP url")
+		os.Exit(1)
+	}
 
-		return auth.CheckPasswordHash(
-			saslData.Password,
-			passwordHash,
-			srv.config.Security.PasswordCheck == "md5",
-		)
+	tlsConfig := &tls.Config{
+		ServerName:         ldapURL.Hostname(),
+		InsecureSkipVerify: ldapConfig.InsecureSkipVerify,
 	}
-	return false
+	if ldapConfig.CACertFile != "" {
+		caCert, err := ioutil.ReadFile(ldapConfig.CACertFile)
+		if err != nil {
+			log.WithError(err).Error("Error on loading LDAP CA certificate")
+			os.Exit(1)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(caCert)
+	}
+
+	return auth.NewLDAPAuthenticator(ldapConfig.URL, ldapConfig.UserDNPattern, ldapConfig.StartTLS, tlsConfig, ldapConfig.Timeout)
 }
 
-func (srv *Server) initUsers() {
-	for _, user := range srv.config.Users {
-		srv.users[user.Username] = user.Password
+// follow applies storages of replication leader if server is configured as follower
+// and blocks until server is promoted
+func (srv *Server) follow() {
+	replicationConfig := srv.config.Replication
+	if replicationConfig.LeaderAddr == "" {
+		return
+	}
+
+	if replicationConfig.Secret == "" {
+		log.Error("Replication secret is required to follow leader")
+		os.Exit(1)
+	}
+
+	srv.replicationLock.Lock()
+	srv.promoted = make(chan struct{})
+	srv.follower = replication.NewFollower(replicationConfig.LeaderAddr, replicationConfig.Secret, func(name string) interfaces.DbStorage {
+		return srv.openStorageInstance(srv.config.Db.DefaultPath, srv.config.Db.Engine, name, true)
+	}, replicationConfig.ReconnectDelay)
+	srv.follower.Start()
+	srv.replicationLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"leader": replicationConfig.LeaderAddr,
+	}).Info("Server follows replication leader until promotion")
+	<-srv.promoted
+}
+
+// Promote stops following replication leader, so server starts on replicated storages
+func (srv *Server) Promote() error {
+	srv.replicationLock.Lock()
+	defer srv.replicationLock.Unlock()
+	if srv.follower == nil {
+		return errors.New("server is not replication follower")
+	}
+
+	seq, err := srv.follower.Promote()
+	srv.follower = nil
+	close(srv.promoted)
+	log.WithFields(log.Fields{
+		"seq": seq,
+	}).Info("Server is promoted")
+	return err
+}
+
+// ReplicationState returns replication role of server and sequence number of last replicated batch
+func (srv *Server) ReplicationState() (role string, seq uint64) {
+	srv.replicationLock.Lock()
+	defer srv.replicationLock.Unlock()
+	switch {
+	case srv.follower != nil:
+		return ReplicationFollower, srv.follower.Seq()
+	case srv.leader != nil:
+		return ReplicationLeader, srv.leader.Seq()
+	}
+	return ReplicationStandalone, 0
+}
+
+// initReplicationLeader starts serving replication followers, persistent storages opened after it are replicated
+func (srv *Server) initReplicationLeader() {
+	replicationConfig := srv.config.Replication
+	if replicationConfig.Listen == "" {
+		return
+	}
+	if replicationConfig.Secret == "" {
+		log.Error("Replication secret is required to serve followers")
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", replicationConfig.Listen)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"address": replicationConfig.Listen,
+		}).Error("Error on replication listener")
+		os.Exit(1)
+	}
+	leader := replication.NewLeader(replicationConfig.TailSize, replicationConfig.Secret)
+	go leader.Serve(listener)
+
+	srv.replicationLock.Lock()
+	srv.leader = leader
+	srv.replicationLock.Unlock()
+}
+
+func (srv *Server) initAudit() {
+	auditConfig := srv.config.Audit
+	if !auditConfig.Enabled {
+		return
+	}
+	var err error
+	srv.audit, err = audit.NewLog(auditConfig.Path, auditConfig.MaxSize, auditConfig.MaxFiles, auditConfig.BufferSize, auditConfig.Overflow)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"path": auditConfig.Path,
+		}).Error("Error on opening audit log")
+		os.Exit(1)
 	}
 }
 
@@ -243,13 +551,20 @@ func (srv *Server) initServerStorage() {
 	srv.storage = srvstorage.NewSrvStorage(srv.getStorageInstance("server", true), srv.protoVersion)
 }
 
+// migrateServerStorage upgrades stored records written by previous versions to the current format
+func (srv *Server) migrateServerStorage() {
+	if err := srvstorage.Migrate(srv.storage, int(amqp.FormatVersion1), int(amqp.FormatVersionCurrent)); err != nil {
+		panic(err)
+	}
+}
+
 func (srv *Server) initDefaultVirtualHosts() {
 	log.WithFields(log.Fields{
 		"vhost": srv.config.Vhost.DefaultPath,
 	}).Info("Initialize default vhost")
 
 	log.Info("Initialize host message msgStorage")
-	msgStoragePersistent := msgstorage.NewMsgStorage(srv.getStorageInstance("vhost_default", true), srv.protoVersion)
+	msgStoragePersistent := msgstorage.NewMsgStorage(srv.getMsgStorageInstance("vhost_default"), srv.protoVersion)
 	msgStorageTransient := msgstorage.NewMsgStorage(srv.getStorageInstance("vhost_default", false), srv.protoVersion)
 
 	srv.vhostsLock.Lock()
@@ -273,7 +588,7 @@ func (srv *Server) initVirtualHostsFromStorage() {
 		} else {
 			storageName = host
 		}
-		msgStoragePersistent := msgstorage.NewMsgStorage(srv.getStorageInstance(storageName, true), srv.protoVersion)
+		msgStoragePersistent := msgstorage.NewMsgStorage(srv.getMsgStorageInstance(storageName), srv.protoVersion)
 		msgStorageTransient := msgstorage.NewMsgStorage(srv.getStorageInstance(storageName, false), srv.protoVersion)
 		srv.vhosts[host] = NewVhost(host, system, msgStoragePersistent, msgStorageTransient, srv)
 	}
@@ -282,7 +597,30 @@ func (srv *Server) initVirtualHostsFromStorage() {
 	defer srv.vhostsLock.Unlock()
 }
 
+// getMsgStorageInstance returns storage of persistent messages, mirrored into secondary storage if configured
+func (srv *Server) getMsgStorageInstance(name string) interfaces.DbStorage {
+	primary := srv.getStorageInstance(name, true)
+	mirrorConfig := srv.config.Db.Mirror
+	if mirrorConfig.Path == "" {
+		return primary
+	}
+	engine := mirrorConfig.Engine
+	if engine == "" {
+		engine = srv.config.Db.Engine
+	}
+	secondary := srv.openStorageInstance(mirrorConfig.Path, engine, name, true)
+	return storage.NewMirror(primary, secondary, mirrorConfig.WaitSecondary)
+}
+
 func (srv *Server) getStorageInstance(name string, isPersistent bool) interfaces.DbStorage {
+	db := srv.openStorageInstance(srv.config.Db.DefaultPath, srv.config.Db.Engine, name, isPersistent)
+	if isPersistent && srv.leader != nil {
+		return srv.leader.Wrap(name, db)
+	}
+	return db
+}
+
+func (srv *Server) openStorageInstance(path string, engine string, name string, isPersistent bool) interfaces.DbStorage {
 	// very ugly solution, but don't know how to deal with "/" vhost for example
 	// rabbitmq generate random uniq id for msgstore and touch .vhost file with vhost name into folder
 
@@ -290,7 +628,7 @@ func (srv *Server) getStorageInstance(name string, isPersistent bool) interfaces
 	h.Write([]byte(name))
 	name = hex.EncodeToString(h.Sum(nil))
 
-	stPath := fmt.Sprintf("%s/%s/%s", srv.config.Db.DefaultPath, srv.config.Db.Engine, name)
+	stPath := fmt.Sprintf("%s/%s/%s", path, engine, name)
 
 	if !isPersistent {
 		stPath += ".transient"
@@ -306,16 +644,16 @@ func (srv *Server) getStorageInstance(name string, isPersistent bool) interfaces
 
 	log.WithFields(log.Fields{
 		"path":   stPath,
-		"engine": srv.config.Db.Engine,
+		"engine": engine,
 	}).Info("Open db storage")
 
-	switch srv.config.Db.Engine {
+	switch engine {
 	case "badger":
 		return storage.NewBadger(stPath)
 	case "buntdb":
 		return storage.NewBuntDB(stPath)
 	default:
-		srv.stopWithError(nil, fmt.Sprintf("Unknown db engine '%s'", srv.config.Db.Engine))
+		srv.stopWithError(nil, fmt.Sprintf("Unknown db engine '%s'", engine))
 	}
 	return nil
 }
@@ -325,6 +663,8 @@ func (srv *Server) onSignal(sig os.Signal) {
 	case syscall.SIGTERM, syscall.SIGINT:
 		srv.Stop()
 		os.Exit(0)
+	case syscall.SIGHUP:
+		srv.reloadConfigFile()
 	}
 }
 
@@ -333,12 +673,14 @@ func (srv *Server) testOnSignal(sig os.Signal) {
 	switch sig {
 	case syscall.SIGTERM, syscall.SIGINT:
 		srv.Stop()
+	case syscall.SIGHUP:
+		srv.reloadConfigFile()
 	}
 }
 
 func (srv *Server) hookSignals() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		for sig := range c {
 			log.Infof("Received [%d:%s] signal from OS", sig, sig.String())
@@ -381,3 +723,11 @@ func (srv *Server) GetMetrics() *SrvMetricsState {
 func (srv *Server) GetStatus() ServerState {
 	return srv.status
 }
+
+// Authenticate checks user credentials by configured authentication backends
+func (srv *Server) Authenticate(user string, password string) (auth.Identity, error) {
+	if srv.authenticator == nil {
+		return auth.Identity{}, auth.ErrLoginFailure
+	}
+	return srv.authenticator.Authenticate(user, password)
+}
@@ -2,12 +2,22 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/streadway/amqp"
 	amqp2 "github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/audit"
+	"github.com/valinurovam/garagemq/config"
 )
 
 func Test_BasicQos_Channel_Success(t *testing.T) {
@@ -157,6 +167,375 @@ func Test_BasicQos_Check_NonGlobal_Success(t *testing.T) {
 	}
 }
 
+func Test_BasicQos_Change_MidConsumption_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	prefetchCount := 5
+	if err := ch.Qos(prefetchCount, 0, true); err != nil {
+		t.Error(err)
+	}
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+
+	msgCount := 20
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+	}
+
+	cmr, err := ch.Consume(t.Name(), "tag", false, false, false, false, emptyTable)
+	if err != nil {
+		t.Error(err)
+	}
+
+	receive := func(timeout time.Duration) int {
+		count := 0
+		tick := time.After(timeout)
+		for {
+			select {
+			case <-cmr:
+				count++
+			case <-tick:
+				return count
+			}
+		}
+	}
+
+	if count := receive(200 * time.Millisecond); count != prefetchCount {
+		t.Errorf("Expected %d messages, received %d", prefetchCount, count)
+	}
+
+	// raise prefetch without acking and re-consuming
+	if err := ch.Qos(prefetchCount*2, 0, true); err != nil {
+		t.Error(err)
+	}
+
+	if count := receive(200 * time.Millisecond); count != prefetchCount {
+		t.Errorf("Expected %d more messages after raising prefetch, received %d", prefetchCount, count)
+	}
+
+	// lowering prefetch below unacked stops deliveries until acks bring it under the limit
+	if err := ch.Qos(2, 0, true); err != nil {
+		t.Error(err)
+	}
+	if err := ch.Ack(uint64(prefetchCount), true); err != nil {
+		t.Error(err)
+	}
+
+	if count := receive(200 * time.Millisecond); count != 0 {
+		t.Errorf("Expected no messages while unacked over prefetch, received %d", count)
+	}
+}
+
+func Test_BasicConsume_FairBetweenQueues_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	floodQueue, _ := ch.QueueDeclare(t.Name()+"flood", false, false, false, false, emptyTable)
+	trickleQueue, _ := ch.QueueDeclare(t.Name()+"trickle", false, false, false, false, emptyTable)
+
+	floodCount := 5000
+	for i := 0; i < floodCount; i++ {
+		ch.Publish("", floodQueue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("flood")})
+	}
+	trickleCount := 10
+	for i := 0; i < trickleCount; i++ {
+		ch.Publish("", trickleQueue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("trickle")})
+	}
+
+	floodCmr, _ := ch.Consume(floodQueue.Name, "flood", true, false, false, false, emptyTable)
+	go func() {
+		for range floodCmr {
+		}
+	}()
+	trickleCmr, _ := ch.Consume(trickleQueue.Name, "trickle", true, false, false, false, emptyTable)
+
+	// delivery tags are sequential within the channel, so they show position in the delivery stream
+	// consumers take turns, so no more than one flood message between trickle messages
+	var firstTag, lastTag uint64
+	for i := 0; i < trickleCount; i++ {
+		select {
+		case msg := <-trickleCmr:
+			if i == 0 {
+				firstTag = msg.DeliveryTag
+			}
+			lastTag = msg.DeliveryTag
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout on waiting trickle message")
+		}
+	}
+
+	if lastTag-firstTag > uint64(2*(trickleCount-1)) {
+		t.Errorf("Expected trickle messages interleaved with flood, delivery tags %d..%d", firstTag, lastTag)
+	}
+}
+
+func Test_BasicConsume_PrefetchWeight_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	prefetchCount := 8
+	if err := ch.Qos(prefetchCount, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	highQueue, _ := ch.QueueDeclare(t.Name()+"high", false, false, false, false, emptyTable)
+	lowQueue, _ := ch.QueueDeclare(t.Name()+"low", false, false, false, false, emptyTable)
+
+	// prefetch is split again on each consume, so both consumers are started before messages
+	highCmr, _ := ch.Consume(highQueue.Name, "high", false, false, false, false, amqp.Table{"x-prefetch-weight": int32(3)})
+	lowCmr, _ := ch.Consume(lowQueue.Name, "low", false, false, false, false, amqp.Table{"x-prefetch-weight": int32(1)})
+	for i := 0; i < 20; i++ {
+		ch.Publish("", highQueue.Name, false, false, amqp.Publishing{Body: []byte("high")})
+		ch.Publish("", lowQueue.Name, false, false, amqp.Publishing{Body: []byte("low")})
+	}
+
+	receive := func(deliveries <-chan amqp.Delivery) (count int, last uint64) {
+		tick := time.After(200 * time.Millisecond)
+		for {
+			select {
+			case delivery := <-deliveries:
+				count++
+				last = delivery.DeliveryTag
+			case <-tick:
+				return
+			}
+		}
+	}
+
+	// shared prefetch of 8 is split 3:1 between consumers
+	highCount, _ := receive(highCmr)
+	lowCount, lowTag := receive(lowCmr)
+	if highCount != 6 || lowCount != 2 {
+		t.Fatalf("Expected 6 and 2 unacked messages, actual %d and %d", highCount, lowCount)
+	}
+
+	// released share of low consumer is not taken by high consumer
+	if err := ch.Ack(lowTag, false); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := receive(highCmr); count != 0 {
+		t.Errorf("Expected no messages over share of high consumer, received %d", count)
+	}
+	if count, _ := receive(lowCmr); count != 1 {
+		t.Errorf("Expected %d message for released share of low consumer, received %d", 1, count)
+	}
+}
+
+func Test_BasicConsume_PrefetchWeight_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	if _, err := ch.Consume(t.Name(), "", false, false, false, false, amqp.Table{"x-prefetch-weight": int32(0)}); err == nil || err.(*amqp.Error).Code != amqp.PreconditionFailed {
+		t.Errorf("Expected channel error with code %d, actual %v", amqp.PreconditionFailed, err)
+	}
+}
+
+func Test_BasicConsume_MaxConsumers_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, amqp.Table{"x-max-consumers": int32(2)})
+	for _, tag := range []string{"first", "second"} {
+		if _, err := ch.Consume(t.Name(), tag, false, false, false, false, emptyTable); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	refusedCh, _ := sc.client.Channel()
+	if _, err := refusedCh.Consume(t.Name(), "third", false, false, false, false, emptyTable); err == nil || err.(*amqp.Error).Code != amqp.AccessRefused {
+		t.Fatalf("Expected consumer over x-max-consumers refused with code %d, actual %v", amqp.AccessRefused, err)
+	}
+
+	// cancelled consumer frees its slot
+	ch.Cancel("first", false)
+	if _, err := ch.Consume(t.Name(), "third", false, false, false, false, emptyTable); err != nil {
+		t.Fatalf("Expected consumer attached after cancel, actual %s", err)
+	}
+}
+
+func Test_BasicConsume_Credit_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	for i := 0; i < 20; i++ {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("credit")})
+	}
+
+	deliveries, err := ch.Consume(t.Name(), "", false, false, false, false, amqp.Table{"x-credit": int32(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func() (count int) {
+		tick := time.After(200 * time.Millisecond)
+		for {
+			select {
+			case delivery := <-deliveries:
+				count++
+				// acks do not return credit
+				ch.Ack(delivery.DeliveryTag, false)
+			case <-tick:
+				return
+			}
+		}
+	}
+
+	if count := receive(); count != 2 {
+		t.Fatalf("Expected %d messages for initial credit, received %d", 2, count)
+	}
+	for _, credit := range []int{1, 5, 3} {
+		// non-global qos grants credit to credit consumers of channel
+		if err := ch.Qos(credit, 0, false); err != nil {
+			t.Fatal(err)
+		}
+		if count := receive(); count != credit {
+			t.Fatalf("Expected %d messages for granted credit, received %d", credit, count)
+		}
+	}
+
+	channel := getServerChannel(sc, 1)
+	if channel.qos.PrefetchCount() != 0 {
+		t.Errorf("Expected channel prefetch not changed by credit grant, actual %d", channel.qos.PrefetchCount())
+	}
+	if length := sc.server.getVhost("/").GetQueue(t.Name()).Length(); length != 9 {
+		t.Errorf("Expected %d messages left in queue, actual %d", 9, length)
+	}
+}
+
+func Test_BasicConsume_Credit_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	if _, err := ch.Consume(t.Name(), "", false, false, false, false, amqp.Table{"x-credit": int32(-1)}); err == nil || err.(*amqp.Error).Code != amqp.PreconditionFailed {
+		t.Errorf("Expected channel error with code %d, actual %v", amqp.PreconditionFailed, err)
+	}
+}
+
+func Test_BasicConsume_MaxUnackedPerChannel_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.MaxUnackedPerChannel = 100
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	// unlimited prefetch of client does not lift operator cap
+	if err := ch.Qos(0, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	for i := 0; i < 300; i++ {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("capped")})
+	}
+
+	deliveries, err := ch.Consume(t.Name(), "", false, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last uint64
+	receive := func() (count int) {
+		tick := time.After(300 * time.Millisecond)
+		for {
+			select {
+			case delivery := <-deliveries:
+				count++
+				last = delivery.DeliveryTag
+			case <-tick:
+				return
+			}
+		}
+	}
+
+	if count := receive(); count != 100 {
+		t.Fatalf("Expected %d unacked messages, received %d", 100, count)
+	}
+	if msg, ok, _ := ch.Get(t.Name(), false); ok {
+		t.Errorf("Expected basic.get withheld by cap, received %d", msg.DeliveryTag)
+	}
+
+	// acked messages release cap for the next ones
+	if err := ch.Ack(last-90, true); err != nil {
+		t.Fatal(err)
+	}
+	if count := receive(); count != 10 {
+		t.Errorf("Expected %d messages for released cap, received %d", 10, count)
+	}
+}
+
+func Test_BasicConsume_AckBatch_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	prefetchCount := 15
+	if err := ch.Qos(prefetchCount, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	for i := 0; i < 40; i++ {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("batch")})
+	}
+
+	deliveries, err := ch.Consume(t.Name(), "", false, false, false, false, amqp.Table{"x-ack-batch": int32(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tags []uint64
+	receive := func() (count int) {
+		tick := time.After(200 * time.Millisecond)
+		for {
+			select {
+			case delivery := <-deliveries:
+				count++
+				tags = append(tags, delivery.DeliveryTag)
+			case <-tick:
+				return
+			}
+		}
+	}
+
+	// remaining prefetch of 5 does not fit next burst
+	if count := receive(); count != 10 {
+		t.Fatalf("Expected burst of %d messages, received %d", 10, count)
+	}
+	for _, tag := range tags[:4] {
+		ch.Ack(tag, false)
+	}
+	if count := receive(); count != 0 {
+		t.Fatalf("Expected no messages until burst fits prefetch, received %d", count)
+	}
+
+	// fifth ack frees prefetch for the whole burst, prefetch is still respected
+	ch.Ack(tags[4], false)
+	if count := receive(); count != 10 {
+		t.Fatalf("Expected burst of %d messages, received %d", 10, count)
+	}
+	if unacked := len(tags) - 5; unacked != prefetchCount {
+		t.Errorf("Expected %d unacked messages, actual %d", prefetchCount, unacked)
+	}
+}
+
+func Test_BasicConsume_AckBatch_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	if _, err := ch.Consume(t.Name(), "", false, false, false, false, amqp.Table{"x-ack-batch": int32(0)}); err == nil || err.(*amqp.Error).Code != amqp.PreconditionFailed {
+		t.Errorf("Expected channel error with code %d, actual %v", amqp.PreconditionFailed, err)
+	}
+}
+
 func Test_BasicPublish_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -175,6 +554,90 @@ func Test_BasicPublish_Success(t *testing.T) {
 	}
 }
 
+// run with -race to check shared fan-out body is not modified by concurrent deliveries
+func Test_BasicPublish_Fanout_SharedBody_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	queuesCount := 4
+	msgCount := 200
+	var channels []*amqp.Channel
+	var deliveries []<-chan amqp.Delivery
+	for i := 0; i < queuesCount; i++ {
+		ch, _ := sc.client.Channel()
+		queueName := t.Name() + strconv.Itoa(i)
+		ch.QueueDeclare(queueName, false, false, false, false, emptyTable)
+		ch.QueueBind(queueName, "", "amq.fanout", false, emptyTable)
+		cmr, _ := ch.Consume(queueName, "", true, false, false, false, emptyTable)
+		channels = append(channels, ch)
+		deliveries = append(deliveries, cmr)
+	}
+
+	chEx, _ := sc.clientEx.Channel()
+	go func() {
+		for i := 0; i < msgCount; i++ {
+			chEx.Publish("amq.fanout", "", false, false, amqp.Publishing{Body: []byte(strconv.Itoa(i))})
+		}
+	}()
+
+	errCh := make(chan error, queuesCount)
+	for _, cmr := range deliveries {
+		go func(cmr <-chan amqp.Delivery) {
+			for i := 0; i < msgCount; i++ {
+				select {
+				case msg := <-cmr:
+					if string(msg.Body) != strconv.Itoa(i) {
+						errCh <- fmt.Errorf("expected body %d, actual %s", i, msg.Body)
+						return
+					}
+				case <-time.After(5 * time.Second):
+					errCh <- errors.New("timeout on waiting fan-out message")
+					return
+				}
+			}
+			errCh <- nil
+		}(cmr)
+	}
+
+	for i := 0; i < queuesCount; i++ {
+		if err := <-errCh; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// body is shared between queues, so bytes allocated per publish should not depend on body size
+func Benchmark_BasicPublish_Fanout100(b *testing.B) {
+	for _, bodySize := range []int{16, 64 << 10} {
+		b.Run("bodySize="+strconv.Itoa(bodySize), func(b *testing.B) {
+			cfg := getDefaultTestConfig()
+			cfg.srvConfig.Queue.MaxMessagesInRAM = 1 << 30
+			sc, _ := getNewSC(cfg)
+			defer sc.clean()
+			ch, _ := sc.client.Channel()
+
+			queuesCount := 100
+			lastQueue := ""
+			for i := 0; i < queuesCount; i++ {
+				lastQueue = "fanout" + strconv.Itoa(i)
+				ch.QueueDeclare(lastQueue, false, false, false, false, emptyTable)
+				ch.QueueBind(lastQueue, "", "amq.fanout", false, emptyTable)
+			}
+			qu := sc.server.GetVhost("/").GetQueue(lastQueue)
+			body := make([]byte, bodySize)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ch.Publish("amq.fanout", "", false, false, amqp.Publishing{Body: body})
+			}
+			for qu.Length() < uint64(b.N) {
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
 func Test_BasicPublish_Persistent_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -502,6 +965,122 @@ func Test_BasicCancel_Failed_Unknown_Tag(t *testing.T) {
 	}
 }
 
+func Test_BasicConsume_CompressedQueue_Gzip_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, err := ch.QueueDeclare(t.Name(), false, false, false, false, amqp.Table{"x-compress": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := bytes.Repeat([]byte("compressible body "), 1000)
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write(body)
+	writer.Close()
+
+	// already compressed by publisher and plain body compressed by queue
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentEncoding: "gzip", Body: gzipped.Bytes()})
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: body})
+	time.Sleep(50 * time.Millisecond)
+
+	// consumer without decompression capability receives body as it stored with content-encoding
+	msg, ok, err := ch.Get(queue.Name, false)
+	if err != nil || !ok {
+		t.Fatal("Expected message in queue")
+	}
+	if msg.ContentEncoding != "gzip" || !bytes.Equal(msg.Body, gzipped.Bytes()) {
+		t.Error("Expected publisher compressed body not compressed twice")
+	}
+	ch.Nack(msg.DeliveryTag, false, true)
+
+	cmr, err := ch.Consume(queue.Name, "tag", true, false, false, false, amqp.Table{"x-decompress": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case dlv := <-cmr:
+			if dlv.ContentEncoding != "" || !bytes.Equal(dlv.Body, body) {
+				t.Errorf("Expected decompressed body without content-encoding, actual encoding '%s'", dlv.ContentEncoding)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected delivery")
+		}
+	}
+
+	ch.Cancel("tag", false)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: body})
+	time.Sleep(50 * time.Millisecond)
+
+	msg, ok, _ = ch.Get(queue.Name, true)
+	if !ok || msg.ContentEncoding != "gzip" || len(msg.Body) >= len(body) {
+		t.Fatal("Expected body compressed by queue")
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decompressed, _ := ioutil.ReadAll(reader); !bytes.Equal(decompressed, body) {
+		t.Error("Expected original body after decompression")
+	}
+}
+
+func Test_BasicConsume_CompressThreshold_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, err := ch.QueueDeclare(t.Name(), false, false, false, false, amqp.Table{"x-compress-threshold": int32(1024)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := bytes.Repeat([]byte("compressible body "), 10000)
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write(body)
+	writer.Close()
+
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: body})
+	time.Sleep(50 * time.Millisecond)
+
+	qu := sc.server.getVhost("/").GetQueue(queue.Name)
+	qu.SafeQueue.Lock()
+	stored := qu.SafeQueue.HeadItem()
+	qu.SafeQueue.Unlock()
+	if stored == nil || !stored.IsBrokerGzipped() || stored.BodySize >= uint64(len(body)) {
+		t.Fatal("Expected body compressed by queue")
+	}
+
+	// already compressed by publisher is not compressed twice
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentEncoding: "gzip", Body: gzipped.Bytes()})
+	time.Sleep(50 * time.Millisecond)
+
+	msg, ok, err := ch.Get(queue.Name, true)
+	if err != nil || !ok {
+		t.Fatal("Expected message in queue")
+	}
+	if msg.ContentEncoding != "" || !bytes.Equal(msg.Body, body) {
+		t.Errorf("Expected original body without content-encoding, actual encoding '%s'", msg.ContentEncoding)
+	}
+
+	cmr, err := ch.Consume(queue.Name, "tag", true, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case dlv := <-cmr:
+		if dlv.ContentEncoding != "gzip" || !bytes.Equal(dlv.Body, gzipped.Bytes()) {
+			t.Error("Expected publisher compressed body delivered as is")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected delivery")
+	}
+}
+
 func Test_BasicAck_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -519,38 +1098,480 @@ func Test_BasicAck_Success(t *testing.T) {
 		t.Error(err)
 	}
 
-	tick := time.After(100 * time.Millisecond)
-	count := 0
-	leave := false
-	deliveries := make([]amqp.Delivery, 0, 10)
-	for {
-		select {
-		case msg := <-cmr:
-			deliveries = append(deliveries, msg)
-			count++
-		case <-tick:
-			leave = true
-		default:
+	tick := time.After(100 * time.Millisecond)
+	count := 0
+	leave := false
+	deliveries := make([]amqp.Delivery, 0, 10)
+	for {
+		select {
+		case msg := <-cmr:
+			deliveries = append(deliveries, msg)
+			count++
+		case <-tick:
+			leave = true
+		default:
+
+		}
+		if leave {
+			break
+		}
+	}
+
+	unackedLength := len(getServerChannel(sc, 1).ackStore)
+	if unackedLength != msgCount {
+		t.Errorf("Expected %d unacked, actual %d", msgCount, unackedLength)
+	}
+	for _, dlv := range deliveries {
+		ch.Ack(dlv.DeliveryTag, false)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	unackedLength = len(getServerChannel(sc, 1).ackStore)
+	if unackedLength != 0 {
+		t.Errorf("Expected %d unacked, actual %d", 0, unackedLength)
+	}
+}
+
+func Test_BasicConsume_ConsumerTimeout_Requeue_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.ConsumerTimeout = 200 * time.Millisecond
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+
+	cmr, err := ch.Consume(t.Name(), "tag", false, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var first amqp.Delivery
+	select {
+	case first = <-cmr:
+	case <-time.After(time.Second):
+		t.Fatal("Expected delivery")
+	}
+
+	// message is not acked, so it should be requeued after timeout and delivered again
+	select {
+	case dlv := <-cmr:
+		if dlv.DeliveryTag == first.DeliveryTag || string(dlv.Body) != "test" {
+			t.Error("Expected the same message delivered again after consumer timeout")
+		}
+		ch.Ack(dlv.DeliveryTag, false)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected redelivery after consumer timeout")
+	}
+}
+
+func Test_BasicConsume_ConsumerTimeout_CancelStuck_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.CancelStuckConsumers = true
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	cancels := ch.NotifyCancel(make(chan string, 1))
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+
+	cmr, err := ch.Consume(t.Name(), "tag", false, false, false, false, amqp.Table{"x-consumer-timeout": int32(200)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-cmr:
+	case <-time.After(time.Second):
+		t.Fatal("Expected delivery")
+	}
+
+	select {
+	case tag := <-cancels:
+		if tag != "tag" {
+			t.Errorf("Expected cancelled consumer %s, actual %s", "tag", tag)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected stuck consumer to be cancelled")
+	}
+
+	if _, ok, _ := ch.Get(queue.Name, true); !ok {
+		t.Error("Expected requeued message in queue")
+	}
+}
+
+func Test_BasicConsume_ConsumerResume_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.ConsumerResumeTimeout = 5 * time.Second
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	args := amqp.Table{"x-consumer-id": "worker-1"}
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	for _, body := range []string{"first", "second"} {
+		ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte(body)})
+	}
+	cmr, _ := ch.Consume(queue.Name, "", false, false, false, false, args)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-cmr:
+		case <-time.After(time.Second):
+			t.Fatal("Expected delivery")
+		}
+	}
+
+	// another consumer of queue does not get unacked messages of disconnected consumer
+	chOther, _ := sc.clientEx.Channel()
+	other, _ := chOther.Consume(queue.Name, "", false, false, false, false, emptyTable)
+	sc.client.Close()
+	select {
+	case dlv := <-other:
+		t.Fatalf("Expected unacked messages kept for consumer resume, actual delivered '%s'", dlv.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conn, err := dialUser(sc, "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, _ = conn.Channel()
+	cmr, err = ch.Consume(queue.Name, "", false, false, false, false, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second"} {
+		select {
+		case dlv := <-cmr:
+			if string(dlv.Body) != body || !dlv.Redelivered {
+				t.Errorf("Expected redelivered '%s' resumed, actual '%s' redelivered %v", body, dlv.Body, dlv.Redelivered)
+			}
+			dlv.Ack(false)
+		case <-time.After(time.Second):
+			t.Fatal("Expected unacked messages resumed by consumer with the same id")
+		}
+	}
+
+	ch.QueueDeclarePassive(queue.Name, false, false, false, false, emptyTable)
+	if length := sc.server.getVhost("/").GetQueue(queue.Name).Length(); length != 0 {
+		t.Errorf("Expected empty queue after resumed messages acked, actual length %d", length)
+	}
+}
+
+func Test_BasicConsume_ConsumerResume_OtherUser_Failed(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.ConsumerResumeTimeout = 5 * time.Second
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	args := amqp.Table{"x-consumer-id": "worker-1"}
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("test")})
+	cmr, _ := ch.Consume(queue.Name, "", false, false, false, false, args)
+	select {
+	case <-cmr:
+	case <-time.After(time.Second):
+		t.Fatal("Expected delivery")
+	}
+	sc.client.Close()
+
+	// identity is owned by user "guest" while its messages are kept
+	other, err := dialTestUser(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	chOther, _ := other.Channel()
+	if _, err := chOther.Consume(queue.Name, "", false, false, false, false, args); err == nil {
+		t.Fatal("Expected error on consumer identity owned by other user")
+	} else if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.AccessRefused {
+		t.Errorf("Expected access refused error, actual %v", err)
+	}
+
+	conn, err := dialUser(sc, "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, _ = conn.Channel()
+	cmr, _ = ch.Consume(queue.Name, "", false, false, false, false, args)
+	select {
+	case dlv := <-cmr:
+		if !dlv.Redelivered {
+			t.Error("Expected message resumed by owner redelivered")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected unacked message resumed by owner")
+	}
+}
+
+func Test_BasicConsume_ConsumerResume_Timeout_Requeue(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.ConsumerResumeTimeout = 200 * time.Millisecond
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("test")})
+	cmr, _ := ch.Consume(queue.Name, "", false, false, false, false, amqp.Table{"x-consumer-id": "worker-1"})
+	select {
+	case <-cmr:
+	case <-time.After(time.Second):
+		t.Fatal("Expected delivery")
+	}
+
+	chOther, _ := sc.clientEx.Channel()
+	other, _ := chOther.Consume(queue.Name, "", false, false, false, false, emptyTable)
+	sc.client.Close()
+
+	// consumer is not resumed within timeout, so message is requeued to other consumers
+	select {
+	case dlv := <-other:
+		if string(dlv.Body) != "test" {
+			t.Errorf("Expected requeued message, actual '%s'", dlv.Body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected message requeued after consumer resume timeout")
+	}
+}
+
+func Test_BasicConsume_CloseAckGrace_NotRedelivered(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.CloseAckGrace = time.Second
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	msgCount := 50
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("test")})
+	}
+	cmr, _ := ch.Consume(queue.Name, "", false, false, false, false, emptyTable)
+	for i := 0; i < msgCount; i++ {
+		select {
+		case dlv := <-cmr:
+			dlv.Ack(false)
+		case <-time.After(time.Second):
+			t.Fatal("Expected delivery")
+		}
+	}
+	// acks are sent right before channel is closed
+	sc.client.Close()
+
+	chOther, _ := sc.clientEx.Channel()
+	other, _ := chOther.Consume(queue.Name, "", false, false, false, false, emptyTable)
+	select {
+	case dlv := <-other:
+		t.Fatalf("Expected acked messages are not redelivered, actual redelivered %v", dlv.Redelivered)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if length := sc.server.getVhost("/").GetQueue(queue.Name).Length(); length != 0 {
+		t.Errorf("Expected empty queue, actual length %d", length)
+	}
+}
+
+func Test_BasicConsume_CloseAckGrace_Requeue(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.CloseAckGraceMax = 5 * time.Second
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("test")})
+	cmr, _ := ch.Consume(queue.Name, "", false, false, false, false, amqp.Table{"x-close-grace": int32(2000)})
+	select {
+	case <-cmr:
+	case <-time.After(time.Second):
+		t.Fatal("Expected delivery")
+	}
+
+	// grace is over once connection is gone and no acks are left in flight
+	start := time.Now()
+	sc.client.Close()
+	chOther, _ := sc.clientEx.Channel()
+	other, _ := chOther.Consume(queue.Name, "", false, false, false, false, emptyTable)
+	select {
+	case dlv := <-other:
+		if !dlv.Redelivered {
+			t.Error("Expected unacked message redelivered")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected unacked message requeued")
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected requeue without waiting whole grace, actual %s", elapsed)
+	}
+
+	chBad, _ := sc.clientEx.Channel()
+	if _, err := chBad.Consume(queue.Name, "", false, false, false, false, amqp.Table{"x-close-grace": "1s"}); err == nil {
+		t.Error("Expected error on invalid x-close-grace argument")
+	}
+}
+
+func Test_BasicConsume_CloseAckGrace_ChannelReopen(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.CloseAckGrace = 5 * time.Second
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("test")})
+
+	client, err := dialRaw(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.conn.Close()
+	steps := []struct {
+		send     amqp2.Method
+		expected amqp2.Method
+	}{
+		{&amqp2.ChannelOpen{}, &amqp2.ChannelOpenOk{}},
+		{&amqp2.BasicConsume{Queue: queue.Name, Arguments: &amqp2.Table{}}, &amqp2.BasicConsumeOk{}},
+		{nil, &amqp2.BasicDeliver{}},
+		// channel with unacked message is closed and reopened with the same id without waiting for grace
+		{&amqp2.ChannelClose{}, &amqp2.ChannelCloseOk{}},
+		{&amqp2.ChannelOpen{}, &amqp2.ChannelOpenOk{}},
+	}
+	start := time.Now()
+	for _, step := range steps {
+		if step.send != nil {
+			if err := client.writeTo(1, step.send); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := client.expect(step.expected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected channel reopened without waiting for close grace, actual %s", elapsed)
+	}
+	if length := sc.server.getVhost("/").GetQueue(queue.Name).Length(); length != 1 {
+		t.Errorf("Expected unacked message requeued on channel close, actual queue length %d", length)
+	}
+}
+
+func Test_BasicConsume_ConsumerResume_InvalidID_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	if _, err := ch.Consume(queue.Name, "", false, false, false, false, amqp.Table{"x-consumer-id": int32(1)}); err == nil {
+		t.Error("Expected error on invalid x-consumer-id")
+	}
+}
+
+func Test_BasicConsume_Stream_Offset_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, amqp.Table{"x-queue-type": "stream"})
+	for _, body := range []string{"0", "1", "2"} {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte(body)})
+	}
+
+	// consumers read stream from own offsets without consuming messages
+	chFirst, _ := sc.client.Channel()
+	first, _ := chFirst.Consume(t.Name(), "", false, false, false, false, amqp.Table{"x-stream-offset": "first"})
+	chOffset, _ := sc.clientEx.Channel()
+	fromOffset, _ := chOffset.Consume(t.Name(), "", false, false, false, false, amqp.Table{"x-stream-offset": int64(1)})
+	expect := func(deliveries <-chan amqp.Delivery, offset int64) {
+		select {
+		case dlv := <-deliveries:
+			if actual, _ := dlv.Headers["x-stream-offset"].(int64); actual != offset || string(dlv.Body) != fmt.Sprint(offset) {
+				t.Errorf("Expected message at offset %d, actual '%s' at %v", offset, dlv.Body, dlv.Headers["x-stream-offset"])
+			}
+			dlv.Ack(false)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected message at offset %d", offset)
+		}
+	}
+	for offset := int64(0); offset < 3; offset++ {
+		expect(first, offset)
+	}
+	for offset := int64(1); offset < 3; offset++ {
+		expect(fromOffset, offset)
+	}
+
+	// new messages are delivered to all consumers
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("3")})
+	expect(first, 3)
+	expect(fromOffset, 3)
 
-		}
-		if leave {
-			break
+	// basic.get reads from the first message by channel offset
+	for offset := 0; offset < 4; offset++ {
+		msg, ok, err := ch.Get(t.Name(), true)
+		if err != nil || !ok || string(msg.Body) != fmt.Sprint(offset) {
+			t.Fatalf("Expected get message at offset %d, actual '%s', %v", offset, msg.Body, err)
 		}
 	}
-
-	unackedLength := len(getServerChannel(sc, 1).ackStore)
-	if unackedLength != msgCount {
-		t.Errorf("Expected %d unacked, actual %d", msgCount, unackedLength)
+	if _, ok, _ := ch.Get(t.Name(), true); ok {
+		t.Error("Expected get empty at stream end")
 	}
-	for _, dlv := range deliveries {
-		ch.Ack(dlv.DeliveryTag, false)
+	if length := sc.server.getVhost("/").GetQueue(t.Name()).Length(); length != 4 {
+		t.Errorf("Expected stream length %d after reads, actual %d", 4, length)
 	}
 
-	time.Sleep(100 * time.Millisecond)
+	if _, err := ch.Consume(t.Name(), "", false, false, false, false, amqp.Table{"x-stream-offset": "middle"}); err == nil {
+		t.Error("Expected error on invalid x-stream-offset")
+	}
+}
 
-	unackedLength = len(getServerChannel(sc, 1).ackStore)
-	if unackedLength != 0 {
-		t.Errorf("Expected %d unacked, actual %d", 0, unackedLength)
+func Test_BasicConsume_Stream_OffsetPositions_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, amqp.Table{"x-queue-type": "stream"})
+	for _, body := range []string{"0", "1"} {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte(body)})
+	}
+	ch.QueueDeclarePassive(t.Name(), false, false, false, false, emptyTable)
+	// timestamp argument has seconds precision
+	time.Sleep(1100 * time.Millisecond)
+	timestamp := time.Now()
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("2")})
+	ch.QueueDeclarePassive(t.Name(), false, false, false, false, emptyTable)
+
+	// "next" publishes message "3", so it goes last
+	for _, tc := range []struct {
+		name     string
+		offset   interface{}
+		expected string
+	}{
+		{"last", "last", "2"},
+		{"timestamp", timestamp, "2"},
+		{"next", "next", "3"},
+	} {
+		cmrCh, _ := sc.client.Channel()
+		deliveries, err := cmrCh.Consume(t.Name(), tc.name, true, false, false, false, amqp.Table{"x-stream-offset": tc.offset})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.name == "next" {
+			ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("3")})
+		}
+		select {
+		case dlv := <-deliveries:
+			if string(dlv.Body) != tc.expected {
+				t.Errorf("Expected consumer from %s offset starts with '%s', actual '%s'", tc.name, tc.expected, dlv.Body)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected delivery to consumer from %s offset", tc.name)
+		}
+		cmrCh.Close()
 	}
 }
 
@@ -1055,3 +2076,490 @@ func Test_BasicGet_Failed_QueueNotFound(t *testing.T) {
 		t.Error("Expected NOT_FOUND error")
 	}
 }
+
+func Test_DirectReplyTo_RPC_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	clientCh, _ := sc.client.Channel()
+	serverCh, _ := sc.clientEx.Channel()
+
+	rpcQueue, _ := serverCh.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	requests, err := serverCh.Consume(rpcQueue.Name, "", true, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queuesCount := len(sc.server.GetVhost("/").GetQueues())
+	replies, err := clientCh.Consume("amq.rabbitmq.reply-to", "", true, false, false, false, emptyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCh.Publish("", rpcQueue.Name, false, false, amqp.Publishing{
+		ReplyTo:       "amq.rabbitmq.reply-to",
+		CorrelationId: "42",
+		Body:          []byte("ping"),
+	})
+
+	select {
+	case req := <-requests:
+		if !strings.HasPrefix(req.ReplyTo, "amq.rabbitmq.reply-to.") {
+			t.Fatalf("Expected rewritten reply-to, actual '%s'", req.ReplyTo)
+		}
+		serverCh.Publish("", req.ReplyTo, false, false, amqp.Publishing{
+			CorrelationId: req.CorrelationId,
+			Body:          []byte("pong"),
+		})
+	case <-time.After(time.Second):
+		t.Fatal("Expected request")
+	}
+
+	select {
+	case reply := <-replies:
+		if reply.CorrelationId != "42" || string(reply.Body) != "pong" {
+			t.Errorf("Unexpected reply %s with correlation id %s", reply.Body, reply.CorrelationId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected reply")
+	}
+
+	if len(sc.server.GetVhost("/").GetQueues()) != queuesCount {
+		t.Error("Expected no queue declared for replies")
+	}
+}
+
+func Test_DirectReplyTo_Failed_NoReplyConsumer(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{ReplyTo: "amq.rabbitmq.reply-to", Body: []byte("ping")})
+
+	select {
+	case err := <-closed:
+		if err == nil || err.Code != amqp.PreconditionFailed {
+			t.Errorf("Expected channel closed with code %d, actual %v", amqp.PreconditionFailed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel error")
+	}
+}
+
+func Test_BasicPublish_FilterExchange_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if err := ch.ExchangeDeclare(t.Name(), "x-filter", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare("large", false, false, false, false, emptyTable)
+	ch.QueueDeclare("small", false, false, false, false, emptyTable)
+	ch.QueueBind("large", "", t.Name(), false, amqp.Table{"x-filter": "headers.size >= 1000"})
+	ch.QueueBind("small", "", t.Name(), false, amqp.Table{"x-filter": "headers.size < 1000"})
+
+	for _, size := range []int32{10, 999, 1000, 5000, 7000} {
+		ch.Publish(t.Name(), "", false, false, amqp.Publishing{Headers: amqp.Table{"size": size}, Body: []byte("test")})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.GetVhost("/")
+	if length := vhost.GetQueue("large").Length(); length != 3 {
+		t.Errorf("Expected %d messages in queue, actual %d", 3, length)
+	}
+	if length := vhost.GetQueue("small").Length(); length != 2 {
+		t.Errorf("Expected %d messages in queue, actual %d", 2, length)
+	}
+
+	if err := ch.QueueBind("small", "", t.Name(), false, amqp.Table{"x-filter": "body == 1"}); err == nil {
+		t.Error("Expected error on bind with unknown field in filter")
+	}
+}
+
+func Test_BasicPublish_DrainMode(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("pending")})
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.GetVhost("/")
+	vhost.SetDraining(true)
+
+	deliveries, _ := ch.Consume(t.Name(), "", false, false, false, false, emptyTable)
+	select {
+	case delivery := <-deliveries:
+		if string(delivery.Body) != "pending" {
+			t.Errorf("Expected pending message, actual %s", delivery.Body)
+		}
+		if err := delivery.Ack(false); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected pending message delivered in drain mode")
+	}
+
+	chConfirm, _ := sc.client.Channel()
+	chConfirm.Confirm(false)
+	confirms := chConfirm.NotifyPublish(make(chan amqp.Confirmation, 1))
+	chConfirm.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("refused")})
+	select {
+	case confirm := <-confirms:
+		if confirm.Ack {
+			t.Error("Expected publish nacked in drain mode")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected publish confirm")
+	}
+
+	chPublish, _ := sc.client.Channel()
+	closed := chPublish.NotifyClose(make(chan *amqp.Error, 1))
+	chPublish.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("refused")})
+	select {
+	case err := <-closed:
+		if err == nil || err.Code != amqp.AccessRefused {
+			t.Errorf("Expected channel closed with code %d, actual %v", amqp.AccessRefused, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel error")
+	}
+
+	if length := vhost.GetQueue(t.Name()).Length(); length != 0 {
+		t.Errorf("Expected %d messages in queue, actual %d", 0, length)
+	}
+
+	vhost.SetDraining(false)
+	chConfirm.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("accepted")})
+	select {
+	case delivery := <-deliveries:
+		if string(delivery.Body) != "accepted" {
+			t.Errorf("Expected accepted message, actual %s", delivery.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected message delivered after drain mode disabled")
+	}
+}
+
+func Test_BasicPublish_UserID_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{UserId: "guest", Body: []byte("matched")})
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("absent")})
+	time.Sleep(50 * time.Millisecond)
+
+	if length := sc.server.getVhost("/").GetQueue(queue.Name).Length(); length != 2 {
+		t.Errorf("Expected %d messages in queue, actual %d", 2, length)
+	}
+
+	msg, ok, _ := ch.Get(queue.Name, true)
+	if !ok || msg.UserId != "guest" {
+		t.Errorf("Expected message with user-id 'guest', actual '%s'", msg.UserId)
+	}
+}
+
+func Test_BasicPublish_UserID_Failed_Mismatch(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{UserId: "test", Body: []byte("impersonated")})
+
+	select {
+	case err := <-closed:
+		if err == nil || err.Code != amqp.AccessRefused {
+			t.Errorf("Expected channel closed with code %d, actual %v", amqp.AccessRefused, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel error")
+	}
+
+	if length := sc.server.getVhost("/").GetQueue(queue.Name).Length(); length != 0 {
+		t.Errorf("Expected %d messages in queue, actual %d", 0, length)
+	}
+}
+
+func Test_BasicNack_Requeue_OrderedPosition_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	for i := 1; i <= 7; i++ {
+		ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte(strconv.Itoa(i))})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	deliveries := make(map[string]amqp.Delivery)
+	for i := 1; i <= 5; i++ {
+		msg, ok, err := ch.Get(queue.Name, false)
+		if err != nil || !ok {
+			t.Fatal("Expected message", err)
+		}
+		deliveries[string(msg.Body)] = msg
+	}
+
+	deliveries["2"].Nack(false, true)
+	deliveries["4"].Nack(false, true)
+
+	for _, expected := range []string{"2", "4", "6", "7"} {
+		msg, ok, err := ch.Get(queue.Name, true)
+		if err != nil || !ok {
+			t.Fatal("Expected message", err)
+		}
+		if string(msg.Body) != expected {
+			t.Errorf("Expected message %s, actual %s", expected, msg.Body)
+		}
+	}
+}
+
+func Test_BasicConsume_Drain_WaitsUnacked(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	deliveries, _ := ch.Consume(queue.Name, "drained", false, false, false, false, emptyTable)
+	for i := 0; i < 2; i++ {
+		ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("test")})
+	}
+
+	received := make([]amqp.Delivery, 0, 2)
+	for len(received) < 2 {
+		select {
+		case dlv := <-deliveries:
+			received = append(received, dlv)
+		case <-time.After(time.Second):
+			t.Fatal("Expected deliveries")
+		}
+	}
+
+	channel := getServerChannel(sc, 1)
+	channel.cmrLock.RLock()
+	cmr := channel.consumers["drained"]
+	channel.cmrLock.RUnlock()
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- cmr.Drain(context.Background())
+	}()
+
+	// draining consumer doesn't receive new messages
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("not delivered")})
+	select {
+	case <-drained:
+		t.Fatal("Expected drain waits for unacked messages")
+	case <-deliveries:
+		t.Fatal("Expected no deliveries to draining consumer")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	received[0].Ack(false)
+	select {
+	case <-drained:
+		t.Fatal("Expected drain waits for all unacked messages")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	received[1].Ack(false)
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected drain completes after messages acked")
+	}
+
+	qu := sc.server.getVhost("/").GetQueue(queue.Name)
+	if qu.ConsumersCount() != 0 {
+		t.Errorf("Expected drained consumer removed from queue, actual consumers %d", qu.ConsumersCount())
+	}
+	if qu.Length() != 1 {
+		t.Errorf("Expected %d messages in queue, actual %d", 1, qu.Length())
+	}
+}
+
+func Test_BasicConsume_Drain_Timeout(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	deliveries, _ := ch.Consume(queue.Name, "drained", false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("test")})
+	select {
+	case <-deliveries:
+	case <-time.After(time.Second):
+		t.Fatal("Expected delivery")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := sc.server.getVhost("/").GetQueue(queue.Name).DrainConsumers(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected drain deadline exceeded, actual %v", err)
+	}
+}
+
+func Test_BasicPublish_StampTimestamp_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Vhost.StampTimestamp = true
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	published := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	before := time.Now().Truncate(time.Second)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("absent")})
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Timestamp: published, Body: []byte("preserved")})
+	time.Sleep(50 * time.Millisecond)
+
+	msg, ok, _ := ch.Get(queue.Name, true)
+	if !ok || msg.Timestamp.Before(before) || msg.Timestamp.After(time.Now()) {
+		t.Errorf("Expected message with broker-set timestamp, actual '%s'", msg.Timestamp)
+	}
+
+	msg, ok, _ = ch.Get(queue.Name, true)
+	if !ok || !msg.Timestamp.Equal(published) {
+		t.Errorf("Expected message with timestamp '%s', actual '%s'", published, msg.Timestamp)
+	}
+}
+
+func Test_BasicPublish_StampTimestamp_Disabled(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("absent")})
+	time.Sleep(50 * time.Millisecond)
+
+	msg, ok, _ := ch.Get(queue.Name, true)
+	if !ok || !msg.Timestamp.IsZero() {
+		t.Errorf("Expected message without timestamp, actual '%s'", msg.Timestamp)
+	}
+}
+
+func Test_BasicPublish_StrictProperties_Failed(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Vhost.StrictProperties = true
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{DeliveryMode: amqp.Persistent, Priority: 5, Expiration: "1000", Body: []byte("valid")})
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{DeliveryMode: 3, Priority: 10, Body: []byte("invalid")})
+
+	select {
+	case err := <-closed:
+		if err == nil || err.Code != amqp.PreconditionFailed || amqp2.ParseErrorCode(err.Reason) != amqp2.ErrInvalidProperty {
+			t.Errorf("Expected channel closed with %s, actual %v", amqp2.ErrInvalidProperty, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel error")
+	}
+
+	if length := sc.server.getVhost("/").GetQueue(queue.Name).Length(); length != 1 {
+		t.Errorf("Expected %d messages in queue, actual %d", 1, length)
+	}
+}
+
+func Test_BasicPublish_StrictProperties_Disabled(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{DeliveryMode: 3, Priority: 10, Body: []byte("invalid")})
+	time.Sleep(50 * time.Millisecond)
+
+	msg, ok, _ := ch.Get(queue.Name, true)
+	if !ok || msg.DeliveryMode != 3 || msg.Priority != 10 {
+		t.Errorf("Expected message with properties passed through, actual %v", msg)
+	}
+}
+
+func Test_BasicGet_DeadlinePassed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), true, false, false, false, emptyTable)
+	past := time.Now().Add(-time.Second).UnixNano() / int64(time.Millisecond)
+	future := time.Now().Add(time.Minute).UnixNano() / int64(time.Millisecond)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Headers: amqp.Table{"x-deadline": past}, DeliveryMode: amqp.Persistent, Body: []byte("stale")})
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Headers: amqp.Table{"x-deadline": future}, Body: []byte("actual")})
+	time.Sleep(50 * time.Millisecond)
+
+	msg, ok, _ := ch.Get(queue.Name, true)
+	if !ok || string(msg.Body) != "actual" {
+		t.Errorf("Expected message with passed deadline dropped, actual '%s'", msg.Body)
+	}
+	if _, ok, _ := ch.Get(queue.Name, true); ok {
+		t.Error("Expected empty queue")
+	}
+	if length := sc.server.getVhost("/").GetQueue(queue.Name).Length(); length != 0 {
+		t.Errorf("Expected %d messages in queue, actual %d", 0, length)
+	}
+}
+
+func Test_BasicPublish_Audit_Success(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(dir)
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Audit = config.Audit{
+		Enabled:     true,
+		Path:        filepath.Join(dir, "audit.log"),
+		BufferSize:  16,
+		Overflow:    audit.OverflowBlock,
+		IncludeBody: true,
+	}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	sc.server.initAudit()
+	ch, _ := sc.client.Channel()
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("first")})
+	ch.Publish("amq.direct", "unrouted", false, false, amqp.Publishing{Body: []byte("second")})
+	ch.Get(queue.Name, true)
+	sc.server.audit.Close()
+
+	file, err := os.Open(cfg.srvConfig.Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []*audit.Record
+	audit.Replay(file, func(record *audit.Record) error {
+		records = append(records, record)
+		return nil
+	})
+
+	expected := []audit.Record{
+		{Sequence: 1, Vhost: "/", Exchange: "", RoutingKey: queue.Name, User: "guest", Size: 5, Body: []byte("first")},
+		{Sequence: 2, Vhost: "/", Exchange: "amq.direct", RoutingKey: "unrouted", User: "guest", Size: 6, Body: []byte("second")},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d audit records, actual %d", len(expected), len(records))
+	}
+	for i, record := range records {
+		if record.Timestamp.IsZero() {
+			t.Errorf("Expected audit record %d with timestamp", i)
+		}
+		record.Timestamp = expected[i].Timestamp
+		if fmt.Sprint(*record) != fmt.Sprint(expected[i]) {
+			t.Errorf("Expected audit record %+v, actual %+v", expected[i], *record)
+		}
+	}
+}
@@ -1,10 +1,16 @@
 package server
 
 import (
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/streadway/amqp"
+	amqp2 "github.com/valinurovam/garagemq/amqp"
 )
 
 func Test_Confirm_Success(t *testing.T) {
@@ -145,3 +151,117 @@ func Test_ConfirmReceive_Acks_Persistent_Success(t *testing.T) {
 		t.Errorf("Expected %d confirms, actual %d", msgCount, confirmsCount)
 	}
 }
+
+// confirmCountConn counts basic.ack and basic.nack frames read from server
+type confirmCountConn struct {
+	net.Conn
+	pipe   *io.PipeWriter
+	frames int64
+}
+
+func newConfirmCountConn(conn net.Conn) *confirmCountConn {
+	reader, writer := io.Pipe()
+	countConn := &confirmCountConn{Conn: conn, pipe: writer}
+	go func() {
+		for {
+			frame, err := amqp2.ReadFrame(reader)
+			if err != nil {
+				reader.CloseWithError(err)
+				return
+			}
+			if frame.Type != amqp2.FrameMethod || len(frame.Payload) < 4 {
+				continue
+			}
+			classID := binary.BigEndian.Uint16(frame.Payload[0:2])
+			methodID := binary.BigEndian.Uint16(frame.Payload[2:4])
+			if classID == amqp2.ClassBasic && (methodID == amqp2.MethodBasicAck || methodID == amqp2.MethodBasicNack) {
+				atomic.AddInt64(&countConn.frames, 1)
+			}
+		}
+	}()
+	return countConn
+}
+
+func (conn *confirmCountConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.pipe.Write(b[:n])
+	}
+	return n, err
+}
+
+// publishConfirmed publishes persistent messages in confirm mode and returns count of confirm frames
+func publishConfirmed(t *testing.T, cfg TestConfig, msgCount int) int64 {
+	var countConn *confirmCountConn
+	cfg.wrapConn = func(conn net.Conn) net.Conn {
+		countConn = newConfirmCountConn(conn)
+		return countConn
+	}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, msgCount))
+
+	queue, _ := ch.QueueDeclare(t.Name(), true, false, false, false, emptyTable)
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", queue.Name, false, false, amqp.Publishing{Body: []byte("test"), DeliveryMode: amqp.Persistent})
+	}
+
+	timeout := time.After(10 * time.Second)
+	for i := 1; i <= msgCount; i++ {
+		select {
+		case confirm := <-confirms:
+			if !confirm.Ack || confirm.DeliveryTag != uint64(i) {
+				t.Fatalf("Expected ack of message %d, actual %+v", i, confirm)
+			}
+		case <-timeout:
+			t.Fatalf("Expected %d confirms, actual %d", msgCount, i-1)
+		}
+	}
+	// every acked message is already persisted
+	if length := sc.server.getVhost("/").msgStorageP.GetQueueLength(queue.Name); length != uint64(msgCount) {
+		t.Errorf("Expected %d persisted messages, actual %d", msgCount, length)
+	}
+	return atomic.LoadInt64(&countConn.frames)
+}
+
+func Test_ConfirmBatching_FrameCount(t *testing.T) {
+	msgCount := 10000
+
+	frames := publishConfirmed(t, getDefaultTestConfig(), msgCount)
+	if frames != int64(msgCount) {
+		t.Errorf("Expected %d confirm frames without batching, actual %d", msgCount, frames)
+	}
+
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.ConfirmBatchInterval = 50 * time.Millisecond
+	cfg.srvConfig.Connection.ConfirmBatchSize = 1000
+	batchedFrames := publishConfirmed(t, cfg, msgCount)
+	if batchedFrames == 0 || batchedFrames > int64(msgCount/10) {
+		t.Errorf("Expected at most %d confirm frames with batching, actual %d", msgCount/10, batchedFrames)
+	}
+	t.Logf("Confirm frames for %d publishes: %d without batching, %d with batching", msgCount, frames, batchedFrames)
+}
+
+func Test_ConfirmBatch_Gap_Success(t *testing.T) {
+	batch := newConfirmBatch()
+	confirms := []*amqp2.ConfirmMeta{{DeliveryTag: 2}, {DeliveryTag: 1}, {DeliveryTag: 4}, {DeliveryTag: 5, Nack: true}}
+	methods := batch.methods(confirms)
+
+	// tag 3 is not confirmed yet, so tags after it are confirmed one by one
+	expected := []amqp2.Method{
+		&amqp2.BasicAck{DeliveryTag: 2, Multiple: true},
+		&amqp2.BasicAck{DeliveryTag: 4},
+		&amqp2.BasicNack{DeliveryTag: 5},
+	}
+	if !reflect.DeepEqual(methods, expected) {
+		t.Fatalf("Expected confirms %+v, actual %+v", expected, methods)
+	}
+
+	methods = batch.methods([]*amqp2.ConfirmMeta{{DeliveryTag: 3}, {DeliveryTag: 6}, {DeliveryTag: 7}})
+	expected = []amqp2.Method{&amqp2.BasicAck{DeliveryTag: 7, Multiple: true}}
+	if !reflect.DeepEqual(methods, expected) {
+		t.Fatalf("Expected confirms %+v after gap is filled, actual %+v", expected, methods)
+	}
+}
@@ -1,9 +1,27 @@
 package server
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/streadway/amqp"
+	amqp2 "github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/auth"
 	"github.com/valinurovam/garagemq/config"
+	"github.com/valinurovam/garagemq/msgstorage"
 )
 
 func Test_Connection_Success(t *testing.T) {
@@ -53,3 +71,630 @@ func Test_Connection_Failed_WhenWrongAuth_UnknownUser(t *testing.T) {
 		t.Error("Expected auth error")
 	}
 }
+
+// stubAuthenticator accepts any credentials and resolves them into fixed identity with given authorizer
+type stubAuthenticator struct {
+	users      []string
+	authorizer auth.Authorizer
+}
+
+func (authenticator *stubAuthenticator) Authenticate(user string, password string) (auth.Identity, error) {
+	authenticator.users = append(authenticator.users, user)
+	return auth.Identity{Username: "stub-identity", Authorizer: authenticator.authorizer}, nil
+}
+
+func Test_Connection_Authenticator_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	// identity unknown to config is denied without default permissions
+	cfg.srvConfig.Security.DefaultPermissions = []config.Permission{{Vhost: "/", Configure: ".*", Write: ".*", Read: ".*"}}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+
+	authenticator := &stubAuthenticator{}
+	sc.server.saslMechanisms.Register(auth.SaslPlain, auth.NewPlainMechanism(authenticator))
+
+	// user "test" is not known to stub, any password is accepted
+	conn, err := dialTestUser(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if len(authenticator.users) != 1 || authenticator.users[0] != "test" {
+		t.Fatalf("Expected handshake authenticated by stub, actual calls %v", authenticator.users)
+	}
+
+	found := false
+	for _, connection := range sc.server.GetConnections() {
+		if connection.GetUsername() == "stub-identity" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected connection user resolved by authenticator")
+	}
+}
+
+// rawClient speaks AMQP frames directly, for methods not supported by client library
+type rawClient struct {
+	conn         net.Conn
+	protoVersion string
+}
+
+// dialRaw opens connection authenticated as user "guest" on default vhost
+func dialRaw(sc *ServerClient) (*rawClient, error) {
+	client, err := startRaw(sc)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.write(&amqp2.ConnectionTuneOk{ChannelMax: 1, FrameMax: 65536}); err != nil {
+		return nil, err
+	}
+	if err := client.write(&amqp2.ConnectionOpen{VirtualHost: "/"}); err != nil {
+		return nil, err
+	}
+	if err := client.expect(&amqp2.ConnectionOpenOk{}); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// startRaw authenticates connection as user "guest", connection.tune-ok is not sent yet
+func startRaw(sc *ServerClient) (*rawClient, error) {
+	toServer, toServerEx, fromClient, fromClientEx, err := networkSim()
+	if err != nil {
+		return nil, err
+	}
+	toServerEx.Close()
+	fromClientEx.Close()
+	sc.server.acceptConnection(fromClient)
+
+	client := &rawClient{conn: toServer, protoVersion: sc.server.protoVersion}
+	toServer.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := toServer.Write([]byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}); err != nil {
+		return nil, err
+	}
+	if err := client.expect(&amqp2.ConnectionStart{}); err != nil {
+		return nil, err
+	}
+	if err := client.write(&amqp2.ConnectionStartOk{
+		ClientProperties: &amqp2.Table{},
+		Mechanism:        auth.SaslPlain,
+		Response:         []byte("\x00guest\x00guest"),
+		Locale:           "en_US",
+	}); err != nil {
+		return nil, err
+	}
+	if err := client.expect(&amqp2.ConnectionTune{}); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// expect reads next method and checks it is the expected one
+func (client *rawClient) expect(expected amqp2.Method) error {
+	method, err := client.read()
+	if err != nil {
+		return err
+	}
+	if method.Name() != expected.Name() {
+		return fmt.Errorf("expected %s, actual %s", expected.Name(), method.Name())
+	}
+	return nil
+}
+
+func (client *rawClient) write(method amqp2.Method) error {
+	return client.writeTo(0, method)
+}
+
+// writeTo writes method into channel with given id
+func (client *rawClient) writeTo(channelID uint16, method amqp2.Method) error {
+	payload := bytes.NewBuffer(nil)
+	if err := amqp2.WriteMethod(payload, method, client.protoVersion); err != nil {
+		return err
+	}
+	return amqp2.WriteFrame(client.conn, &amqp2.Frame{Type: byte(amqp2.FrameMethod), ChannelID: channelID, Payload: payload.Bytes()})
+}
+
+// read returns next method skipping heartbeats
+func (client *rawClient) read() (amqp2.Method, error) {
+	for {
+		frame, err := amqp2.ReadFrame(client.conn)
+		if err != nil {
+			return nil, err
+		}
+		if frame.Type == byte(amqp2.FrameMethod) {
+			return amqp2.ReadMethod(bytes.NewReader(frame.Payload), client.protoVersion)
+		}
+	}
+}
+
+func Test_Connection_UpdateSecret_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	client, err := dialRaw(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.conn.Close()
+
+	if err := client.write(&amqp2.ConnectionUpdateSecret{NewSecret: []byte("guest"), Reason: "token refresh"}); err != nil {
+		t.Fatal(err)
+	}
+	method, err := client.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := method.(*amqp2.ConnectionUpdateSecretOk); !ok {
+		t.Fatalf("Expected %s, actual %s", "ConnectionUpdateSecretOk", method.Name())
+	}
+}
+
+func Test_Connection_UpdateSecret_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	client, err := dialRaw(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.conn.Close()
+
+	if err := client.write(&amqp2.ConnectionUpdateSecret{NewSecret: []byte("wrong"), Reason: "token refresh"}); err != nil {
+		t.Fatal(err)
+	}
+	method, err := client.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeMethod, ok := method.(*amqp2.ConnectionClose)
+	if !ok {
+		t.Fatalf("Expected %s, actual %s", "ConnectionClose", method.Name())
+	}
+	if closeMethod.ReplyCode != amqp2.AccessRefused {
+		t.Errorf("Expected connection error with code %d, actual %d", amqp2.AccessRefused, closeMethod.ReplyCode)
+	}
+}
+
+func Test_Connection_MalformedFrame_FrameError(t *testing.T) {
+	frames := map[string][]byte{
+		// frame declares 1Gb payload, it must be refused before payload is allocated
+		"oversized": {byte(amqp2.FrameMethod), 0, 0, 0x40, 0, 0, 0},
+		"frame-end": {byte(amqp2.FrameMethod), 0, 0, 0, 0, 0, 1, 0, 0},
+	}
+	for name, frame := range frames {
+		sc, _ := getNewSC(getDefaultTestConfig())
+		client, err := dialRaw(sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client.conn.Write(frame)
+		method, err := client.read()
+		if err != nil {
+			t.Fatalf("Expected connection.close on %s frame, actual error %v", name, err)
+		}
+		closeMethod, ok := method.(*amqp2.ConnectionClose)
+		if !ok || closeMethod.ReplyCode != amqp2.FrameError {
+			t.Errorf("Expected connection error with code %d on %s frame, actual %v", amqp2.FrameError, name, method)
+		}
+		client.conn.Close()
+		sc.clean()
+	}
+}
+
+func Test_Connection_MalformedMethod_FrameError(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	client, err := dialRaw(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.conn.Close()
+
+	// channel.open with truncated arguments
+	payload := []byte{0, byte(amqp2.ClassChannel), 0, byte(amqp2.MethodChannelOpen)}
+	amqp2.WriteFrame(client.conn, &amqp2.Frame{Type: byte(amqp2.FrameMethod), ChannelID: 1, Payload: payload})
+
+	method, err := client.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closeMethod, ok := method.(*amqp2.ConnectionClose); !ok || closeMethod.ReplyCode != amqp2.FrameError {
+		t.Errorf("Expected connection error with code %d, actual %v", amqp2.FrameError, method)
+	}
+}
+
+func Test_Connection_FlushInterval_BoundsLatency(t *testing.T) {
+	flushInterval := 200 * time.Millisecond
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.FlushInterval = flushInterval
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	cmr, _ := ch.Consume(t.Name(), "tag", true, false, false, false, emptyTable)
+
+	// single message can not reach flush threshold, so it is written by flush timer only
+	start := time.Now()
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("a")})
+
+	select {
+	case <-cmr:
+		if latency := time.Since(start); latency > flushInterval+300*time.Millisecond {
+			t.Errorf("Expected latency bounded by flush interval %s, actual %s", flushInterval, latency)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout on waiting buffered message")
+	}
+}
+
+func Benchmark_Connection_Deliver_SmallMessages(b *testing.B) {
+	for _, flushInterval := range []time.Duration{0, time.Millisecond} {
+		b.Run("flushInterval="+flushInterval.String(), func(b *testing.B) {
+			cfg := getDefaultTestConfig()
+			cfg.srvConfig.Connection.FlushInterval = flushInterval
+			// keep all messages in memory, so only delivery path is measured
+			cfg.srvConfig.Queue.MaxMessagesInRAM = 1 << 30
+			sc, _ := getNewSC(cfg)
+			defer sc.clean()
+			ch, _ := sc.client.Channel()
+			chEx, _ := sc.clientEx.Channel()
+
+			queueName := "bench" + strconv.Itoa(int(flushInterval))
+			ch.QueueDeclare(queueName, false, false, false, false, emptyTable)
+			cmr, _ := ch.Consume(queueName, "tag", true, false, false, false, emptyTable)
+			conn := sc.server.connections[sc.server.connSeq-1]
+			flushesBefore := atomic.LoadUint64(&conn.flushes)
+
+			b.ResetTimer()
+			start := time.Now()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					chEx.Publish("", queueName, false, false, amqp.Publishing{Body: []byte("a")})
+				}
+			}()
+			for i := 0; i < b.N; i++ {
+				<-cmr
+			}
+			b.StopTimer()
+			elapsed := time.Since(start)
+
+			flushes := atomic.LoadUint64(&conn.flushes) - flushesBefore
+			b.Logf("%d messages, %d write calls, %.0f msgs/sec", b.N, flushes, float64(b.N)/elapsed.Seconds())
+		})
+	}
+}
+
+func Test_Connection_ChannelIdleTimeout_HeartbeatsKeepConnection(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.IdleTimeout = 1500 * time.Millisecond
+	cfg.srvConfig.Connection.ChannelIdleTimeout = 500 * time.Millisecond
+	cfg.clientConfig.Heartbeat = time.Second
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+
+	idleCh, _ := sc.client.Channel()
+	idleClosed := idleCh.NotifyClose(make(chan *amqp.Error, 1))
+
+	consumeCh, _ := sc.client.Channel()
+	consumeCh.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	consumeCh.Consume(t.Name(), "", true, false, false, false, emptyTable)
+
+	select {
+	case err := <-idleClosed:
+		if err == nil || err.Code != amqp2.ReplySuccess {
+			t.Errorf("Expected channel closed with code %d, actual %v", amqp2.ReplySuccess, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected idle channel to be closed")
+	}
+
+	// only heartbeats for longer than connection idle timeout
+	time.Sleep(2 * time.Second)
+
+	if sc.client.IsClosed() {
+		t.Fatal("Expected connection kept alive by heartbeats")
+	}
+
+	ch, err := sc.client.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclarePassive(t.Name(), false, false, false, false, emptyTable); err != nil {
+		t.Error("Expected channel with consumer is not closed", err)
+	}
+}
+
+func Test_Connection_IdleTimeout(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Connection.IdleTimeout = 300 * time.Millisecond
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+
+	closed := sc.client.NotifyClose(make(chan *amqp.Error, 1))
+
+	select {
+	case err := <-closed:
+		if err == nil || err.Code != amqp2.ConnectionForced {
+			t.Fatalf("Expected connection closed with code %d, actual %v", amqp2.ConnectionForced, err)
+		}
+		if code := amqp2.ParseErrorCode(err.Reason); code != amqp2.ErrIdleTimeout {
+			t.Errorf("Expected error code %s, actual %s", amqp2.ErrIdleTimeout, code)
+		}
+		if !strings.Contains(err.Reason, "idle timeout 300ms") {
+			t.Errorf("Expected reason with idle timeout, actual %s", err.Reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected idle connection to be closed")
+	}
+}
+
+func Test_Connection_TuneOkAboveLimits_LimitClose(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	client, err := startRaw(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.conn.Close()
+
+	if err := client.write(&amqp2.ConnectionTuneOk{ChannelMax: 8192, FrameMax: 65536}); err != nil {
+		t.Fatal(err)
+	}
+
+	method, err := client.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeMethod, ok := method.(*amqp2.ConnectionClose)
+	if !ok || closeMethod.ReplyCode != amqp2.NotAllowed {
+		t.Fatalf("Expected connection error with code %d, actual %v", amqp2.NotAllowed, method)
+	}
+	if code := amqp2.ParseErrorCode(closeMethod.ReplyText); code != amqp2.ErrLimitExceeded {
+		t.Errorf("Expected error code %s, actual %s", amqp2.ErrLimitExceeded, code)
+	}
+	if !strings.Contains(closeMethod.ReplyText, "channel_max 8192") {
+		t.Errorf("Expected reason with channel limit, actual %s", closeMethod.ReplyText)
+	}
+}
+
+// slowReaderConn stops reading from socket while paused
+type slowReaderConn struct {
+	net.Conn
+	paused int32
+}
+
+func (conn *slowReaderConn) Read(b []byte) (int, error) {
+	for atomic.LoadInt32(&conn.paused) == 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return conn.Conn.Read(b)
+}
+
+func Test_Connection_SlowReader_OutputBounded(t *testing.T) {
+	slowConn := &slowReaderConn{}
+	cfg := getDefaultTestConfig()
+	cfg.wrapConn = func(conn net.Conn) net.Conn {
+		slowConn.Conn = conn
+		return slowConn
+	}
+	cfg.srvConfig.Connection.OutputBufferSize = 64 << 10
+	cfg.srvConfig.Connection.OutputHighWatermark = 256 << 10
+	cfg.srvConfig.Connection.WriteTimeout = 500 * time.Millisecond
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+
+	sc.server.connLock.Lock()
+	conn := sc.server.connections[sc.server.connSeq-1]
+	sc.server.connLock.Unlock()
+
+	ch, _ := sc.client.Channel()
+	chEx, _ := sc.clientEx.Channel()
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+
+	ch.Consume(queue.Name, "", true, false, false, false, emptyTable)
+	atomic.StoreInt32(&slowConn.paused, 1)
+
+	msgCount := 400
+	body := make([]byte, 64<<10)
+	for i := 0; i < msgCount; i++ {
+		chEx.Publish("", queue.Name, false, false, amqp.Publishing{Body: body})
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// one message may be sent over watermark before consumers are skipped
+	maxPending := int64(cfg.srvConfig.Connection.OutputHighWatermark + len(body) + 1024)
+	if pending := atomic.LoadInt64(&conn.output.pending); pending > maxPending {
+		t.Errorf("Expected output pending bytes not greater than %d, actual %d", maxPending, pending)
+	}
+	if sc.server.getVhost("/").GetQueue(queue.Name).Length() == 0 {
+		t.Error("Expected messages are kept in queue for slow consumer")
+	}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		sc.server.connLock.Lock()
+		_, ok := sc.server.connections[conn.id]
+		sc.server.connLock.Unlock()
+		if !ok {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("Expected slow reader connection to be closed by write timeout")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func getTestCertificate(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func Test_Connection_TLS_SNIVhost_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Vhost.SNI = map[string]string{
+		"a.test": "vhost-a",
+		"b.test": "vhost-b",
+	}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+
+	for _, name := range []string{"vhost-a", "vhost-b"} {
+		sc.server.vhosts[name] = NewVhost(
+			name,
+			false,
+			msgstorage.NewMsgStorage(sc.server.getStorageInstance(name, true), sc.server.protoVersion),
+			msgstorage.NewMsgStorage(sc.server.getStorageInstance(name, false), sc.server.protoVersion),
+			sc.server,
+		)
+	}
+
+	cert, err := getTestCertificate("a.test", "b.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	toServerA, toServerB, fromClientA, fromClientB, err := networkSim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.server.acceptConnection(tls.Server(fromClientA, serverTLS))
+	sc.server.acceptConnection(tls.Server(fromClientB, serverTLS))
+
+	dial := func(conn net.Conn, serverName string) (*amqp.Connection, error) {
+		return amqp.DialConfig("amqp://localhost:0", amqp.Config{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}), nil
+			},
+		})
+	}
+
+	clientA, err := dial(toServerA, "a.test")
+	if err != nil {
+		t.Fatal("Expected connection to vhost mapped to SNI name", err)
+	}
+	defer clientA.Close()
+	clientB, err := dial(toServerB, "b.test")
+	if err != nil {
+		t.Fatal("Expected connection to vhost mapped to SNI name", err)
+	}
+	defer clientB.Close()
+
+	chA, _ := clientA.Channel()
+	if _, err = chA.QueueDeclare(t.Name(), false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	if sc.server.getVhost("vhost-a").GetQueue(t.Name()) == nil {
+		t.Error("Expected queue declared in vhost mapped to SNI name")
+	}
+
+	chB, _ := clientB.Channel()
+	if _, err = chB.QueueDeclarePassive(t.Name(), false, false, false, false, emptyTable); err == nil {
+		t.Error("Expected queue of other SNI vhost is not visible")
+	}
+}
+
+func Test_Connection_DefaultPrefetch_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.clientConfig = amqp.Config{Properties: amqp.Table{"x-default-prefetch": int32(2)}}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	for i := 0; i < 10; i++ {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte(strconv.Itoa(i))})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	countDeliveries := func(ch *amqp.Channel) int {
+		deliveries, _ := ch.Consume(t.Name(), "", false, false, false, false, emptyTable)
+		count := 0
+		for {
+			select {
+			case <-deliveries:
+				count++
+			case <-time.After(100 * time.Millisecond):
+				return count
+			}
+		}
+	}
+
+	// both channels inherit connection prefetch
+	for i := 0; i < 2; i++ {
+		cmrCh, _ := sc.client.Channel()
+		if count := countDeliveries(cmrCh); count != 2 {
+			t.Fatalf("Expected %d unacked deliveries by inherited prefetch, actual %d", 2, count)
+		}
+	}
+
+	// explicit basic.qos overrides connection default
+	cmrCh, _ := sc.client.Channel()
+	cmrCh.Qos(5, 0, false)
+	if count := countDeliveries(cmrCh); count != 5 {
+		t.Fatalf("Expected %d unacked deliveries by channel qos, actual %d", 5, count)
+	}
+}
+
+func Test_Connection_DefaultPrefetch_Failed(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.clientConfig = amqp.Config{Properties: amqp.Table{"x-default-prefetch": "many"}}
+	sc, err := getNewSC(cfg)
+	defer sc.clean()
+
+	if err == nil {
+		t.Fatal("Expected connection refused on invalid default prefetch")
+	}
+}
+
+func Test_Connection_ClientName_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.clientConfig.Properties = amqp.Table{"connection_name": "orders-service"}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+
+	connections := sc.server.GetConnections()
+	if len(connections) == 0 {
+		t.Fatal("Expected opened connections")
+	}
+	for _, connection := range connections {
+		if connection.GetClientName() != "orders-service" {
+			t.Errorf("Expected connection name '%s', actual '%s'", "orders-service", connection.GetClientName())
+		}
+	}
+}
+
+func Test_Connection_ClientName_Missing(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	for _, connection := range sc.server.GetConnections() {
+		if connection.GetClientName() != "" {
+			t.Errorf("Expected connection without name, actual '%s'", connection.GetClientName())
+		}
+	}
+}
@@ -1,10 +1,21 @@
 package server
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	amqpclient "github.com/streadway/amqp"
 	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/audit"
+	"github.com/valinurovam/garagemq/config"
 	"github.com/valinurovam/garagemq/exchange"
+	"github.com/valinurovam/garagemq/metrics"
 )
 
 func Test_DefaultExchanges(t *testing.T) {
@@ -113,6 +124,23 @@ func Test_ExchangeDeclare_Failed_RedeclareNotEqual(t *testing.T) {
 	}
 }
 
+func Test_ExchangeDeclare_Failed_TypeMismatchCode(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("test", "direct", false, false, false, false, emptyTable)
+
+	err := ch.ExchangeDeclare("test", "topic", false, false, false, false, emptyTable)
+	amqpErr, ok := err.(*amqpclient.Error)
+	if !ok || amqpErr.Code != amqpclient.PreconditionFailed {
+		t.Fatalf("Expected precondition failed error, actual %v", err)
+	}
+	if code := amqp.ParseErrorCode(amqpErr.Reason); code != amqp.ErrExchangeTypeMismatch {
+		t.Fatalf("Expected code %s in reason '%s', actual '%s'", amqp.ErrExchangeTypeMismatch, amqpErr.Reason, code)
+	}
+}
+
 func Test_ExchangeDeclare_Failed_EmptyName(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -156,3 +184,882 @@ func Test_ExchangeDeclarePassive_Failed_NotExists(t *testing.T) {
 		t.Error("Expected: exchange not found error")
 	}
 }
+
+func Test_ExchangeBind_InternalChain_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	// public topic exchange -> internal headers exchange -> queue
+	ch.ExchangeDeclare("public", "topic", false, false, false, false, emptyTable)
+	ch.ExchangeDeclare("stage", "headers", false, false, true, false, emptyTable)
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+
+	if err := ch.ExchangeBind("stage", "orders.#", "public", false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind(t.Name(), "", "stage", false, amqpclient.Table{"region": "eu"}); err != nil {
+		t.Fatal(err)
+	}
+	// cycle back to public exchange does not loop
+	if err := ch.ExchangeBind("public", "", "stage", false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	ch.Publish("public", "orders.created", false, false, amqpclient.Publishing{Headers: amqpclient.Table{"region": "eu"}, Body: []byte("eu")})
+	ch.Publish("public", "orders.created", false, false, amqpclient.Publishing{Headers: amqpclient.Table{"region": "us"}, Body: []byte("us")})
+	ch.Publish("public", "payments.created", false, false, amqpclient.Publishing{Headers: amqpclient.Table{"region": "eu"}, Body: []byte("payments")})
+	time.Sleep(50 * time.Millisecond)
+
+	qu := sc.server.GetVhost("/").GetQueue(t.Name())
+	if length := qu.Length(); length != 1 {
+		t.Fatalf("Expected %d messages in queue, actual %d", 1, length)
+	}
+	if message := qu.Pop(); string(message.Body[0].Payload) != "eu" {
+		t.Errorf("Expected message routed by both stages, actual %s", message.Body[0].Payload)
+	}
+
+	closed := ch.NotifyClose(make(chan *amqpclient.Error, 1))
+	ch.Publish("stage", "", false, false, amqpclient.Publishing{Headers: amqpclient.Table{"region": "eu"}, Body: []byte("direct")})
+	select {
+	case err := <-closed:
+		if err == nil || err.Code != amqpclient.AccessRefused {
+			t.Errorf("Expected channel closed with code %d, actual %v", amqpclient.AccessRefused, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel error on publish to internal exchange")
+	}
+}
+
+func Test_ExchangeUnbind_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("source", "fanout", false, false, false, false, emptyTable)
+	ch.ExchangeDeclare("destination", "fanout", false, false, false, false, emptyTable)
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.QueueBind(t.Name(), "", "destination", false, emptyTable)
+	ch.ExchangeBind("destination", "", "source", false, emptyTable)
+
+	if err := ch.ExchangeUnbind("destination", "", "source", false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if length := len(sc.server.GetVhost("/").GetExchange("source").GetBindings()); length != 0 {
+		t.Errorf("Expected %d bindings, actual %d", 0, length)
+	}
+
+	ch.Publish("source", "", false, false, amqpclient.Publishing{Body: []byte("test")})
+	time.Sleep(50 * time.Millisecond)
+	if length := sc.server.GetVhost("/").GetQueue(t.Name()).Length(); length != 0 {
+		t.Errorf("Expected %d messages in queue, actual %d", 0, length)
+	}
+}
+
+func Test_SplitterExchange_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if err := ch.ExchangeDeclare("splitter", "x-splitter", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	ch.ExchangeDeclare("pipelineA", "topic", false, false, true, false, emptyTable)
+	ch.ExchangeDeclare("pipelineB", "topic", false, false, true, false, emptyTable)
+	ch.QueueDeclare("queueA", false, false, false, false, emptyTable)
+	ch.QueueDeclare("queueB", false, false, false, false, emptyTable)
+	ch.QueueBind("queueA", "orders.#", "pipelineA", false, emptyTable)
+	ch.QueueBind("queueB", "*.created", "pipelineB", false, emptyTable)
+	ch.ExchangeBind("pipelineA", "", "splitter", false, emptyTable)
+	ch.ExchangeBind("pipelineB", "", "splitter", false, emptyTable)
+
+	ch.Publish("splitter", "orders.created", false, false, amqpclient.Publishing{Headers: amqpclient.Table{"id": "1"}, Body: []byte("created")})
+	ch.Publish("splitter", "orders.deleted", false, false, amqpclient.Publishing{Headers: amqpclient.Table{"id": "2"}, Body: []byte("deleted")})
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.GetVhost("/")
+	quA, quB := vhost.GetQueue("queueA"), vhost.GetQueue("queueB")
+	if quA.Length() != 2 || quB.Length() != 1 {
+		t.Fatalf("Expected 2 and 1 messages in pipelines, actual %d and %d", quA.Length(), quB.Length())
+	}
+
+	messageA, messageB := quA.Pop(), quB.Pop()
+	if messageA == messageB || messageA.Header.PropertyList.Headers == messageB.Header.PropertyList.Headers {
+		t.Error("Expected independent message copy in each pipeline")
+	}
+	for _, message := range []*amqp.Message{messageA, messageB} {
+		if (*message.Header.PropertyList.Headers)["id"] != "1" || message.RoutingKey != "orders.created" {
+			t.Errorf("Expected copy with original headers and routing key, actual %v %s", *message.Header.PropertyList.Headers, message.RoutingKey)
+		}
+	}
+}
+
+func Test_ExchangeDeclare_Policy_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	vhost := sc.server.getVhost("/")
+
+	policy, err := NewPolicy("ex", "^logs", PolicyApplyToExchanges, 0, amqp.Table{"x-custom": "value"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vhost.SetPolicy(policy)
+
+	if err := ch.ExchangeDeclare("logs", "fanout", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("logs", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	ex := vhost.GetExchange("logs")
+	if ex.Policy() != "ex" {
+		t.Fatalf("Expected policy 'ex', actual '%s'", ex.Policy())
+	}
+	if value := (*ex.Arguments())["x-custom"]; value != "value" {
+		t.Fatalf("Expected x-custom 'value', actual %v", value)
+	}
+	if policy := vhost.GetQueue("logs").Policy(); policy != "" {
+		t.Fatalf("Expected exchange policy is not applied to queue, actual '%s'", policy)
+	}
+
+	vhost.DeletePolicy("ex")
+	if _, ok := (*ex.Arguments())["x-custom"]; ok || ex.Policy() != "" {
+		t.Fatal("Expected exchange policy is cleared after delete")
+	}
+}
+
+func Test_ExchangeDelete_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("test", "direct", true, false, false, false, emptyTable)
+	if err := ch.ExchangeDelete("test", false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if sc.server.getVhost("/").GetExchange("test") != nil {
+		t.Fatal("Exchange exists after 'ExchangeDelete'")
+	}
+	for _, ex := range sc.server.storage.GetVhostExchanges("/") {
+		if ex.GetName() == "test" {
+			t.Fatal("Exchange persisted after 'ExchangeDelete'")
+		}
+	}
+}
+
+func Test_ExchangeDelete_Failed_IfUnused(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("test", "direct", false, false, false, false, emptyTable)
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.QueueBind(t.Name(), "rk", "test", false, emptyTable)
+
+	if err := ch.ExchangeDelete("test", true, false); err == nil {
+		t.Fatal("Expected error on delete used exchange")
+	}
+}
+
+func Test_ExchangeDelete_Failed_System(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if err := ch.ExchangeDelete("amq.direct", false, false); err == nil {
+		t.Fatal("Expected error on delete system exchange")
+	}
+}
+
+func Test_ExchangeRecreate_ReattachBindings(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	vhost := sc.server.getVhost("/")
+
+	ch.ExchangeDeclare("test", "headers", true, false, false, false, emptyTable)
+	ch.QueueDeclare("plain", true, false, false, false, emptyTable)
+	ch.QueueDeclare("headers", true, false, false, false, emptyTable)
+	ch.QueueBind("plain", "rk", "test", false, emptyTable)
+	ch.QueueBind("headers", "rk", "test", false, amqpclient.Table{"x-match": "any", "type": "log"})
+
+	if err := ch.ExchangeDelete("test", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclare("test", "direct", true, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	bindings := vhost.GetExchange("test").GetBindings()
+	if len(bindings) != 1 || bindings[0].GetQueue() != "plain" {
+		t.Fatalf("Expected only compatible binding re-attached, actual %d bindings", len(bindings))
+	}
+
+	persisted := 0
+	for _, bind := range sc.server.storage.GetVhostBindings("/") {
+		if bind.GetExchange() == "test" {
+			persisted++
+		}
+	}
+	if persisted != 1 {
+		t.Fatalf("Expected incompatible binding dropped from storage, actual %d persisted", persisted)
+	}
+
+	ch.Publish("test", "rk", false, false, amqpclient.Publishing{Body: []byte("data")})
+	time.Sleep(50 * time.Millisecond)
+	if length := vhost.GetQueue("plain").Length(); length != 1 {
+		t.Fatalf("Expected message routed through re-attached binding, actual length %d", length)
+	}
+}
+
+func Test_DefaultExchange_RoutesToExchange(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		cfg := getDefaultTestConfig()
+		cfg.srvConfig.Exchange.DefaultRoutesToExchange = enabled
+		sc, _ := getNewSC(cfg)
+		ch, _ := sc.client.Channel()
+		vhost := sc.server.getVhost("/")
+
+		ch.ExchangeDeclare("events", "fanout", false, false, false, false, emptyTable)
+		ch.QueueDeclare("events-log", false, false, false, false, emptyTable)
+		ch.QueueBind("events-log", "", "events", false, emptyTable)
+		ch.QueueDeclare("direct", false, false, false, false, emptyTable)
+
+		ch.Publish("", "events", false, false, amqpclient.Publishing{Body: []byte("data")})
+		ch.Publish("", "direct", false, false, amqpclient.Publishing{Body: []byte("data")})
+		time.Sleep(50 * time.Millisecond)
+
+		expected := uint64(0)
+		if enabled {
+			expected = 1
+		}
+		if length := vhost.GetQueue("events-log").Length(); length != expected {
+			t.Errorf("Expected %d messages routed through same-named exchange, actual %d, option enabled %t", expected, length, enabled)
+		}
+		if length := vhost.GetQueue("direct").Length(); length != 1 {
+			t.Errorf("Expected message routed into queue by name, actual length %d", length)
+		}
+		sc.clean()
+	}
+}
+
+func Test_ExchangePublish_RateLimit_Reject(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	args := amqpclient.Table{exchange.RateLimitMsgsArg: int32(5), exchange.RateLimitModeArg: exchange.RateLimitReject}
+	if err := ch.ExchangeDeclare(t.Name(), "fanout", false, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.QueueBind(t.Name(), "", t.Name(), false, emptyTable)
+
+	ch.Confirm(false)
+	confirms := ch.NotifyPublish(make(chan amqpclient.Confirmation, 10))
+	for i := 0; i < 10; i++ {
+		ch.Publish(t.Name(), "", false, false, amqpclient.Publishing{Body: []byte("test")})
+	}
+
+	acks := 0
+	for i := 0; i < 10; i++ {
+		select {
+		case confirm := <-confirms:
+			if confirm.Ack {
+				acks++
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected publish confirm")
+		}
+	}
+	// burst of one second is allowed, the rest is refused
+	if acks != 5 {
+		t.Errorf("Expected %d publishes acked, actual %d", 5, acks)
+	}
+	if length := sc.server.getVhost("/").GetQueue(t.Name()).Length(); length != 5 {
+		t.Errorf("Expected %d messages in queue, actual %d", 5, length)
+	}
+}
+
+func Test_ExchangePublish_RateLimit_Delay(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	args := amqpclient.Table{exchange.RateLimitMsgsArg: int32(20)}
+	if err := ch.ExchangeDeclare(t.Name(), "fanout", false, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.QueueBind(t.Name(), "", t.Name(), false, emptyTable)
+
+	// 20 messages are published at once, 5 messages above burst are delayed by 50ms each
+	start := time.Now()
+	for i := 0; i < 25; i++ {
+		ch.Publish(t.Name(), "", false, false, amqpclient.Publishing{Body: []byte("test")})
+	}
+	qu := sc.server.getVhost("/").GetQueue(t.Name())
+	time.Sleep(50 * time.Millisecond)
+	if length := qu.Length(); length >= 25 {
+		t.Fatalf("Expected publishes above limit delayed, actual %d messages in queue", length)
+	}
+
+	for qu.Length() < 25 {
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("Expected all delayed messages published, actual %d messages in queue", qu.Length())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected publishes throttled to limit, all published in %s", elapsed)
+	}
+}
+
+func Test_ExchangeDeclare_RateLimit_Failed_InvalidArgument(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+
+	for _, args := range []amqpclient.Table{
+		{exchange.RateLimitMsgsArg: "fast"},
+		{exchange.RateLimitBytesArg: int32(-1)},
+		{exchange.RateLimitMsgsArg: int32(10), exchange.RateLimitModeArg: "drop"},
+	} {
+		ch, _ := sc.client.Channel()
+		err := ch.ExchangeDeclare(t.Name(), "fanout", false, false, false, false, args)
+		if err == nil || err.(*amqpclient.Error).Code != amqpclient.PreconditionFailed {
+			t.Errorf("Expected channel error with code %d for %v, actual %v", amqpclient.PreconditionFailed, args, err)
+		}
+	}
+}
+
+func Test_ExchangeRoute_FanIn_Dedup_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	// queue matches message by binding on source exchange and by binding on destination exchange
+	ch.ExchangeDeclare("source", "topic", false, false, false, false, emptyTable)
+	ch.ExchangeDeclare("destination", "direct", false, false, false, false, emptyTable)
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.QueueDeclare(t.Name()+".cc", false, false, false, false, emptyTable)
+	ch.QueueBind(t.Name(), "orders.*", "source", false, emptyTable)
+	ch.QueueBind(t.Name(), "orders.created", "destination", false, emptyTable)
+	ch.QueueBind(t.Name()+".cc", "audit", "destination", false, emptyTable)
+	ch.ExchangeBind("destination", "#", "source", false, emptyTable)
+
+	ch.Publish("source", "orders.created", false, false, amqpclient.Publishing{
+		Headers: amqpclient.Table{
+			"CC":  []interface{}{"audit", "orders.created"},
+			"BCC": []interface{}{"orders.updated"},
+		},
+		Body: []byte("order"),
+	})
+	ch.QueueDeclarePassive(t.Name(), false, false, false, false, emptyTable)
+
+	vhost := sc.server.GetVhost("/")
+	if length := vhost.GetQueue(t.Name()).Length(); length != 1 {
+		t.Fatalf("Expected message enqueued once, actual %d messages", length)
+	}
+	if length := vhost.GetQueue(t.Name() + ".cc").Length(); length != 1 {
+		t.Fatalf("Expected message routed by CC key, actual %d messages", length)
+	}
+
+	msg, ok, _ := ch.Get(t.Name(), true)
+	if !ok {
+		t.Fatal("Expected message in queue")
+	}
+	if _, ok := msg.Headers["BCC"]; ok {
+		t.Error("Expected BCC header removed from delivered message")
+	}
+	if _, ok := msg.Headers["CC"]; !ok {
+		t.Error("Expected CC header delivered")
+	}
+}
+
+func Test_ExchangeAlias_Publish_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("green", "direct", false, false, false, false, emptyTable)
+	ch.ExchangeDeclare("blue", "direct", false, false, false, false, emptyTable)
+	if err := ch.ExchangeDeclare("orders", "direct", false, false, false, false, amqpclient.Table{"x-exchange-alias": "green"}); err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.QueueDeclare(t.Name()+".blue", false, false, false, false, emptyTable)
+	ch.QueueBind(t.Name(), "created", "green", false, emptyTable)
+	ch.QueueBind(t.Name()+".blue", "created", "blue", false, emptyTable)
+	// bindings of alias itself are not used
+	ch.QueueBind(t.Name()+".blue", "created", "orders", false, emptyTable)
+
+	ch.Publish("green", "created", false, false, amqpclient.Publishing{Body: []byte("target")})
+	ch.Publish("orders", "created", false, false, amqpclient.Publishing{Body: []byte("alias")})
+	ch.QueueDeclarePassive(t.Name(), false, false, false, false, emptyTable)
+
+	for _, body := range []string{"target", "alias"} {
+		msg, ok, _ := ch.Get(t.Name(), true)
+		if !ok || string(msg.Body) != body {
+			t.Fatalf("Expected message '%s' routed by alias target, actual %v", body, ok)
+		}
+	}
+	if length := sc.server.GetVhost("/").GetQueue(t.Name() + ".blue").Length(); length != 0 {
+		t.Fatalf("Expected no messages routed by other exchange, actual %d", length)
+	}
+}
+
+func Test_ExchangeRewrite_StripPrefix_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if err := ch.ExchangeDeclare("adapter", "topic", false, false, false, false, amqpclient.Table{"x-rewrite-strip-prefix": "legacy."}); err != nil {
+		t.Fatal(err)
+	}
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.QueueDeclare(t.Name()+".legacy", false, false, false, false, emptyTable)
+	ch.QueueBind(t.Name(), "orders.*", "adapter", false, emptyTable)
+	// bindings see rewritten key only
+	ch.QueueBind(t.Name()+".legacy", "legacy.#", "adapter", false, emptyTable)
+
+	ch.Publish("adapter", "legacy.orders.created", false, false, amqpclient.Publishing{Body: []byte("legacy")})
+	ch.Publish("adapter", "orders.paid", false, false, amqpclient.Publishing{Body: []byte("plain")})
+	ch.Publish("adapter", "legacy.payments.created", false, false, amqpclient.Publishing{Body: []byte("other")})
+	ch.QueueDeclarePassive(t.Name(), false, false, false, false, emptyTable)
+
+	for _, expected := range [][2]string{{"legacy", "legacy.orders.created"}, {"plain", "orders.paid"}} {
+		msg, ok, _ := ch.Get(t.Name(), true)
+		if !ok || string(msg.Body) != expected[0] || msg.RoutingKey != expected[1] {
+			t.Fatalf("Expected message '%s' with original key '%s', actual '%s' with key '%s'", expected[0], expected[1], msg.Body, msg.RoutingKey)
+		}
+	}
+	if length := sc.server.GetVhost("/").GetQueue(t.Name()).Length(); length != 0 {
+		t.Errorf("Expected no more messages, actual %d", length)
+	}
+	if length := sc.server.GetVhost("/").GetQueue(t.Name() + ".legacy").Length(); length != 0 {
+		t.Errorf("Expected no messages matched by original key, actual %d", length)
+	}
+}
+
+func Test_ExchangeAlias_Cycle_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if err := ch.ExchangeDeclare("a", "direct", false, false, false, false, amqpclient.Table{"x-exchange-alias": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	err := ch.ExchangeDeclare("b", "direct", false, false, false, false, amqpclient.Table{"x-exchange-alias": "a"})
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqp.ParseErrorCode(amqpErr.Reason) != amqp.ErrAliasCycle {
+		t.Fatalf("Expected alias cycle error, actual %v", err)
+	}
+
+	// cycle made bypassing declare check is detected on publish
+	vhost := sc.server.GetVhost("/")
+	ex := exchange.NewExchange("b", exchange.ExTypeDirect, false, false, false, false)
+	ex.SetArguments(&amqp.Table{exchange.AliasArg: "a"})
+	vhost.AppendExchange(ex)
+	if _, err := vhost.ResolveExchange("a"); err == nil {
+		t.Fatal("Expected alias cycle error on resolve")
+	}
+
+	ch, _ = sc.client.Channel()
+	closed := ch.NotifyClose(make(chan *amqpclient.Error, 1))
+	ch.Publish("a", "key", false, false, amqpclient.Publishing{Body: []byte("cycle")})
+	select {
+	case err := <-closed:
+		if err == nil || amqp.ParseErrorCode(err.Reason) != amqp.ErrAliasCycle {
+			t.Errorf("Expected channel closed with alias cycle error, actual %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected channel error")
+	}
+}
+
+func Test_ExchangeBind_FileSink_Success(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sink")
+	defer os.RemoveAll(dir)
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.FileSink = config.FileSink{
+		Enabled:     true,
+		Dir:         dir,
+		BufferSize:  16,
+		MaxRate:     100,
+		IncludeBody: true,
+	}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("tap", "topic", false, false, false, false, emptyTable)
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.QueueBind(queue.Name, "orders.*", "tap", false, emptyTable)
+	if err := ch.QueueBind("debug.jsonl", "orders.#", "tap", false, amqpclient.Table{"x-destination-type": "file"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch.Publish("tap", "orders.created", false, false, amqpclient.Publishing{Body: []byte("first")})
+	ch.Publish("tap", "payments.created", false, false, amqpclient.Publishing{Body: []byte("skipped")})
+	ch.Publish("tap", "orders.eu.paid", false, false, amqpclient.Publishing{Body: []byte("second")})
+
+	// file binding tees messages, routing to queues is not changed
+	expectQueueMessages(t, ch, queue.Name, []string{"first"})
+
+	// unbind of the last binding closes sink flushing its records
+	if err := ch.QueueUnbind("debug.jsonl", "orders.#", "tap", amqpclient.Table{"x-destination-type": "file"}); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "debug.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []*audit.Record
+	audit.Replay(file, func(record *audit.Record) error {
+		records = append(records, record)
+		return nil
+	})
+
+	expected := []audit.Record{
+		{Sequence: 1, Vhost: "/", Exchange: "tap", RoutingKey: "orders.created", Size: 5, Body: []byte("first")},
+		{Sequence: 2, Vhost: "/", Exchange: "tap", RoutingKey: "orders.eu.paid", Size: 6, Body: []byte("second")},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d file records, actual %d", len(expected), len(records))
+	}
+	for i, record := range records {
+		record.Timestamp = expected[i].Timestamp
+		if fmt.Sprint(*record) != fmt.Sprint(expected[i]) {
+			t.Errorf("Expected file record %+v, actual %+v", expected[i], *record)
+		}
+	}
+}
+
+func Test_ExchangeBind_FileSink_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("tap", "fanout", false, false, false, false, emptyTable)
+	err := ch.QueueBind("debug.jsonl", "", "tap", false, amqpclient.Table{"x-destination-type": "file"})
+	if amqpErr, ok := err.(*amqpclient.Error); !ok || amqpErr.Code != amqp.AccessRefused {
+		t.Fatalf("Expected access refused for disabled file sinks, actual %v", err)
+	}
+}
+
+func Test_ExchangeBind_RoutingTrace_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Vhost.RoutingTrace = []string{"/"}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("trace.first", "direct", false, false, false, false, emptyTable)
+	ch.ExchangeDeclare("trace.second", "headers", false, false, false, false, emptyTable)
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.ExchangeBind("trace.second", "orders", "trace.first", false, emptyTable)
+	// trace header set by previous hops does not take part in headers matching
+	ch.QueueBind(queue.Name, "", "trace.second", false, amqpclient.Table{"x-match": "all", "kind": "order"})
+
+	ch.Publish("trace.first", "orders", false, false, amqpclient.Publishing{
+		Headers: amqpclient.Table{"kind": "order"},
+		Body:    []byte("traced"),
+	})
+	time.Sleep(50 * time.Millisecond)
+	msg, ok, err := ch.Get(queue.Name, true)
+	if err != nil || !ok {
+		t.Fatalf("Expected message routed through exchange chain, ok %v, error %v", ok, err)
+	}
+
+	trace, _ := msg.Headers["x-routing-trace"].([]interface{})
+	if len(trace) != 2 {
+		t.Fatalf("Expected trace of %d hops, actual %v", 2, msg.Headers["x-routing-trace"])
+	}
+	expected := []struct {
+		exchange string
+		key      string
+	}{{"trace.first", "orders"}, {"trace.second", ""}}
+	for i, hop := range trace {
+		entry, _ := hop.(amqpclient.Table)
+		keys, _ := entry["binding-keys"].([]interface{})
+		if entry["exchange"] != expected[i].exchange || len(keys) != 1 || keys[0] != expected[i].key {
+			t.Errorf("Expected hop %d through %s by key '%s', actual %v", i, expected[i].exchange, expected[i].key, entry)
+		}
+		if _, ok := entry["timestamp"].(time.Time); !ok {
+			t.Errorf("Expected hop %d with timestamp, actual %v", i, entry)
+		}
+	}
+}
+
+func Test_ExchangeBind_DisableBinding_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	vhost := sc.server.getVhost("/")
+
+	ch.ExchangeDeclare(t.Name(), "direct", false, false, false, false, emptyTable)
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.QueueBind(queue.Name, "key", t.Name(), false, emptyTable)
+
+	if changed, err := vhost.SetBindingsEnabled(t.Name(), queue.Name, "key", false); err != nil || changed != 1 {
+		t.Fatalf("Expected binding is disabled, changed %d, error %v", changed, err)
+	}
+	ch.Publish(t.Name(), "key", false, false, amqpclient.Publishing{Body: []byte("disabled")})
+	time.Sleep(50 * time.Millisecond)
+	if _, ok, _ := ch.Get(queue.Name, true); ok {
+		t.Fatal("Expected message is not routed by disabled binding")
+	}
+	if len(vhost.GetExchange(t.Name()).GetBindings()) != 1 {
+		t.Fatal("Expected disabled binding is kept")
+	}
+
+	if changed, err := vhost.SetBindingsEnabled(t.Name(), queue.Name, "key", true); err != nil || changed != 1 {
+		t.Fatalf("Expected binding is enabled, changed %d, error %v", changed, err)
+	}
+	ch.Publish(t.Name(), "key", false, false, amqpclient.Publishing{Body: []byte("enabled")})
+	time.Sleep(50 * time.Millisecond)
+	msg, ok, err := ch.Get(queue.Name, true)
+	if err != nil || !ok || string(msg.Body) != "enabled" {
+		t.Fatalf("Expected message routed by re-enabled binding, ok %v, error %v", ok, err)
+	}
+
+	if _, err := vhost.SetBindingsEnabled(t.Name(), queue.Name, "missing", false); err == nil {
+		t.Fatal("Expected error on missing binding")
+	}
+}
+
+func Test_ExchangeQueue_Publish_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Exchange.QueueExchange = true
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	returns := ch.NotifyReturn(make(chan amqpclient.Return, 1))
+
+	queue, _ := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	// queue is bound to default exchange only
+	if err := ch.Publish("amq.queue", queue.Name, true, false, amqpclient.Publishing{Body: []byte("direct")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Publish("amq.queue", "missing", true, false, amqpclient.Publishing{Body: []byte("missing")}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ret := <-returns:
+		if ret.RoutingKey != "missing" || ret.ReplyCode != amqp.NoRoute {
+			t.Fatalf("Expected message to missing queue is returned, actual %v", ret)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected message to missing queue is returned")
+	}
+	expectQueueMessages(t, ch, queue.Name, []string{"direct"})
+}
+
+func Test_ExchangeQueue_Disabled_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if err := ch.ExchangeDeclarePassive("amq.queue", "direct", true, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected amq.queue exchange does not exist when disabled")
+	}
+}
+
+func Test_ExchangeRoutingMetrics_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Exchange.RoutingKeyPrefixes = []string{"orders.*", "orders.eu."}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	// test server counters are nil ones, so buckets are re-created with counting registry
+	metrics.NewTrackRegistry(15, time.Second, false)
+	sc.server.routingMetrics = newRoutingMetrics(cfg.srvConfig.Exchange.RoutingKeyPrefixes)
+	ch, _ := sc.client.Channel()
+
+	for _, key := range []string{"orders.created", "orders.eu.created", "orders.paid", "payments.paid", "orders"} {
+		ch.Publish("amq.topic", key, false, false, amqpclient.Publishing{Body: []byte(key)})
+	}
+	// synchronous call on the same channel is handled after publishes
+	ch.ExchangeDeclarePassive("amq.topic", "topic", true, false, false, false, emptyTable)
+
+	expected := map[string]int64{"orders.*": 2, "orders.eu.": 1, "other": 2}
+	routingMetrics := sc.server.GetRoutingMetrics()
+	if len(routingMetrics) != len(expected) {
+		t.Fatalf("Expected buckets %v, actual %v", expected, routingMetrics)
+	}
+	for bucket, count := range expected {
+		if actual := routingMetrics[bucket].Counter.Count(); actual != count {
+			t.Errorf("Expected %d messages in bucket '%s', actual %d", count, bucket, actual)
+		}
+	}
+}
+
+func Test_ExchangeDefinitions_RoundTrip(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("defs.source", "topic", true, false, false, false, amqpclient.Table{"x-max-rate": int32(1000)})
+	ch.ExchangeDeclare("defs.destination", "fanout", true, false, false, false, emptyTable)
+	ch.QueueDeclare("defs.queue", true, false, false, false, amqpclient.Table{"x-message-ttl": int32(60000)})
+	ch.QueueBind("defs.queue", "orders.*", "defs.source", false, emptyTable)
+	ch.ExchangeBind("defs.destination", "orders.#", "defs.source", false, emptyTable)
+	ch.QueueDeclare("exclusive", false, false, true, false, emptyTable)
+
+	data, err := json.Marshal(sc.server.ExportDefinitions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	definitions, err := ParseDefinitions(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(definitions.Vhosts) != 1 || len(definitions.Exchanges) != 2 || len(definitions.Queues) != 1 || len(definitions.Bindings) != 2 {
+		t.Fatalf("Expected 1 vhost, 2 exchanges, 1 queue and 2 bindings exported, actual %s", data)
+	}
+
+	// persisted bindings are re-attached to recreated durable exchange, so they are removed explicitly
+	ch.ExchangeUnbind("defs.destination", "orders.#", "defs.source", false, emptyTable)
+	ch.QueueDelete("defs.queue", false, false, false)
+	ch.ExchangeDelete("defs.source", false, false)
+	ch.ExchangeDelete("defs.destination", false, false)
+
+	report, err := sc.server.ImportDefinitions(definitions)
+	if err != nil || *report != (DefinitionsReport{Exchanges: 2, Queues: 1, Bindings: 2}) {
+		t.Fatalf("Expected topology imported, actual %+v, %v", report, err)
+	}
+	vhost := sc.server.getVhost("/")
+	qu := vhost.GetQueue("defs.queue")
+	if qu == nil || !qu.IsDurable() || (*qu.Arguments())["x-message-ttl"] != int64(60000) {
+		t.Fatal("Expected queue imported with its arguments")
+	}
+	if ex := vhost.GetExchange("defs.source"); ex == nil || ex.GetTypeAlias() != "topic" || (*ex.Arguments())["x-max-rate"] != int64(1000) {
+		t.Fatal("Expected exchange imported with its arguments")
+	}
+
+	ch.Publish("defs.source", "orders.new", false, false, amqpclient.Publishing{Body: []byte("order")})
+	time.Sleep(50 * time.Millisecond)
+	expectQueueMessages(t, ch, "defs.queue", []string{"order"})
+
+	// import is idempotent
+	if report, err = sc.server.ImportDefinitions(definitions); err != nil || *report != (DefinitionsReport{}) {
+		t.Fatalf("Expected nothing imported twice, actual %+v, %v", report, err)
+	}
+
+	// inequivalent queue rejects whole document
+	definitions.Queues[0].Durable = false
+	definitions.Queues = append(definitions.Queues, &QueueDefinition{Name: "defs.new"})
+	if _, err = sc.server.ImportDefinitions(definitions); err == nil {
+		t.Fatal("Expected error on inequivalent queue")
+	}
+	if vhost.GetQueue("defs.new") != nil {
+		t.Fatal("Expected nothing imported from rejected definitions")
+	}
+}
+
+func Test_ExchangeDefinitions_Startup(t *testing.T) {
+	file, err := ioutil.TempFile("", "definitions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	definitions := `{
+		"vhosts": [{"name": "/"}, {"name": "defs"}],
+		"exchanges": [{"name": "defs.source", "vhost": "/", "type": "direct", "durable": true}],
+		"queues": [
+			{"name": "defs.queue", "vhost": "/", "durable": true, "arguments": {"x-max-length": 10}},
+			{"name": "defs.other", "vhost": "defs"}
+		],
+		"bindings": [{"source": "defs.source", "vhost": "/", "destination": "defs.queue", "destination_type": "queue", "routing_key": "orders"}]
+	}`
+	if err = ioutil.WriteFile(file.Name(), []byte(definitions), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Definitions = file.Name()
+	sc, err := getNewSC(cfg)
+	defer sc.clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, _ := sc.client.Channel()
+
+	vhost := sc.server.getVhost("/")
+	if qu := vhost.GetQueue("defs.queue"); qu == nil || !qu.IsDurable() || (*qu.Arguments())["x-max-length"] != int64(10) {
+		t.Fatal("Expected queue declared on start")
+	}
+	if other := sc.server.getVhost("defs"); other == nil || other.GetQueue("defs.other") == nil {
+		t.Fatal("Expected vhost with queue created on start")
+	}
+	ch.Publish("defs.source", "orders", false, false, amqpclient.Publishing{Body: []byte("order")})
+	time.Sleep(50 * time.Millisecond)
+	expectQueueMessages(t, ch, "defs.queue", []string{"order"})
+
+	// existing durable queue is not equivalent to definition anymore
+	inequivalent := strings.Replace(definitions, `"durable": true, "arguments"`, `"durable": false, "arguments"`, 1)
+	if err = ioutil.WriteFile(file.Name(), []byte(inequivalent), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.server.initDefinitions(); err == nil || !strings.Contains(err.Error(), "durable") {
+		t.Fatalf("Expected start failed on inequivalent queue, actual %v", err)
+	}
+}
+
+func Test_ExchangeInternalPublish_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("events", "topic", false, false, false, false, emptyTable)
+	ch.QueueDeclare("orders", false, false, false, false, emptyTable)
+	ch.QueueDeclare("all", false, false, false, false, emptyTable)
+	ch.QueueDeclare("other", false, false, false, false, emptyTable)
+	ch.QueueBind("orders", "orders.*", "events", false, emptyTable)
+	ch.QueueBind("all", "#", "events", false, emptyTable)
+	ch.QueueBind("other", "other.*", "events", false, emptyTable)
+
+	vhost := sc.server.getVhost("/")
+	ch.Publish("events", "orders.new", false, false, amqpclient.Publishing{Body: []byte("network")})
+	time.Sleep(50 * time.Millisecond)
+	message := &amqp.Message{Body: []*amqp.Frame{{Type: byte(amqp.FrameBody), Payload: []byte("internal")}}, BodySize: 8}
+	var confirms []*amqp.ConfirmMeta
+	if err := vhost.Publish("events", "orders.new", message, PublishOpts{Confirm: func(meta *amqp.ConfirmMeta) {
+		confirms = append(confirms, meta)
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// both publishers are routed the same way
+	expectQueueMessages(t, ch, "orders", []string{"network", "internal"})
+	expectQueueMessages(t, ch, "all", []string{"network", "internal"})
+	if length := vhost.GetQueue("other").Length(); length != 0 {
+		t.Fatalf("Expected no messages in unmatched queue, actual %d", length)
+	}
+	if len(confirms) != 1 || confirms[0].Nack {
+		t.Fatalf("Expected message confirmed, actual %v", confirms)
+	}
+
+	var returned []*amqp.Message
+	unroutable := &amqp.Message{}
+	vhost.Publish("amq.direct", "none", unroutable, PublishOpts{Mandatory: true, Return: func(message *amqp.Message) {
+		returned = append(returned, message)
+	}})
+	if len(returned) != 1 || returned[0] != unroutable {
+		t.Fatal("Expected unroutable mandatory message returned")
+	}
+
+	vhost.SetDraining(true)
+	confirms = nil
+	err := vhost.Publish("events", "orders.new", &amqp.Message{}, PublishOpts{Confirm: func(meta *amqp.ConfirmMeta) {
+		confirms = append(confirms, meta)
+	}})
+	if err == nil || len(confirms) != 1 || !confirms[0].Nack {
+		t.Fatalf("Expected publish into draining vhost refused and nacked, actual %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/valinurovam/garagemq/auth"
+	"github.com/valinurovam/garagemq/config"
+)
+
+// getPermissionsTestConfig restricts user "test" with given permissions, guest stays unrestricted
+func getPermissionsTestConfig(permissions ...config.Permission) TestConfig {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Users[0].Permissions = permissions
+	return cfg
+}
+
+// dialTestUser opens connection authenticated as user "test"
+func dialTestUser(sc *ServerClient) (*amqp.Connection, error) {
+	return dialUser(sc, "test")
+}
+
+// dialUser opens connection of user with password "guest"
+func dialUser(sc *ServerClient, user string) (*amqp.Connection, error) {
+	toServer, toServerEx, fromClient, fromClientEx, err := networkSim()
+	if err != nil {
+		return nil, err
+	}
+	toServerEx.Close()
+	fromClientEx.Close()
+	sc.server.acceptConnection(fromClient)
+
+	return amqp.DialConfig("amqp://localhost:0", amqp.Config{
+		SASL: []amqp.Authentication{&amqp.PlainAuth{Username: user, Password: "guest"}},
+		Dial: func(network, addr string) (net.Conn, error) {
+			return toServer, nil
+		},
+	})
+}
+
+func Test_Permissions_WriteOnly_Publish_Success(t *testing.T) {
+	sc, _ := getNewSC(getPermissionsTestConfig(config.Permission{Vhost: "/", Write: ".*"}))
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+
+	conn, err := dialTestUser(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testCh, _ := conn.Channel()
+
+	if err := testCh.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("test")}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if length := sc.server.getVhost("/").GetQueue(t.Name()).Length(); length != 1 {
+		t.Errorf("Expected %d messages in queue, actual %d", 1, length)
+	}
+}
+
+func Test_Permissions_WriteOnly_Consume_Failed(t *testing.T) {
+	sc, _ := getNewSC(getPermissionsTestConfig(config.Permission{Vhost: "/", Write: ".*"}))
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+
+	conn, err := dialTestUser(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	testCh, _ := conn.Channel()
+	if _, err := testCh.Consume(t.Name(), "", false, false, false, false, emptyTable); err == nil || err.(*amqp.Error).Code != amqp.AccessRefused {
+		t.Errorf("Expected channel error with code %d, actual %v", amqp.AccessRefused, err)
+	}
+
+	testCh, _ = conn.Channel()
+	if _, _, err := testCh.Get(t.Name(), false); err == nil || err.(*amqp.Error).Code != amqp.AccessRefused {
+		t.Errorf("Expected channel error with code %d, actual %v", amqp.AccessRefused, err)
+	}
+
+	if count := sc.server.getVhost("/").GetQueue(t.Name()).ConsumersCount(); count != 0 {
+		t.Errorf("Expected %d consumers, actual %d", 0, count)
+	}
+}
+
+func Test_Permissions_Declare_Failed_NoConfigure(t *testing.T) {
+	sc, _ := getNewSC(getPermissionsTestConfig(config.Permission{Vhost: "/", Configure: "^allowed$", Write: ".*", Read: ".*"}))
+	defer sc.clean()
+
+	conn, err := dialTestUser(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	testCh, _ := conn.Channel()
+	if _, err := testCh.QueueDeclare(t.Name(), false, false, false, false, emptyTable); err == nil || err.(*amqp.Error).Code != amqp.AccessRefused {
+		t.Errorf("Expected channel error with code %d, actual %v", amqp.AccessRefused, err)
+	}
+	if sc.server.getVhost("/").GetQueue(t.Name()) != nil {
+		t.Error("Queue exists after refused 'QueueDeclare'")
+	}
+
+	testCh, _ = conn.Channel()
+	if err := testCh.ExchangeDeclare(t.Name(), "direct", false, false, false, false, emptyTable); err == nil || err.(*amqp.Error).Code != amqp.AccessRefused {
+		t.Errorf("Expected channel error with code %d, actual %v", amqp.AccessRefused, err)
+	}
+
+	testCh, _ = conn.Channel()
+	if _, err := testCh.QueueDeclare("allowed", false, false, false, false, emptyTable); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Permissions_Vhost_Failed(t *testing.T) {
+	sc, _ := getNewSC(getPermissionsTestConfig(config.Permission{Vhost: "other", Configure: ".*", Write: ".*", Read: ".*"}))
+	defer sc.clean()
+
+	if conn, err := dialTestUser(sc); err == nil {
+		conn.Close()
+		t.Error("Expected access to vhost refused")
+	}
+}
+
+func Test_Permissions_IdentityAuthorizer_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+
+	// permissions resolved on authentication, e.g. from token scopes, are used instead of configured ones
+	authenticator := &stubAuthenticator{authorizer: auth.NewScopeAuthorizer("", []string{"write:%2F/*"})}
+	sc.server.saslMechanisms.Register(auth.SaslPlain, auth.NewPlainMechanism(authenticator))
+
+	conn, err := dialTestUser(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	testCh, _ := conn.Channel()
+	if err := testCh.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("test")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testCh.Consume(t.Name(), "", false, false, false, false, emptyTable); err == nil || err.(*amqp.Error).Code != amqp.AccessRefused {
+		t.Errorf("Expected channel error with code %d, actual %v", amqp.AccessRefused, err)
+	}
+
+	if length := sc.server.getVhost("/").GetQueue(t.Name()).Length(); length != 1 {
+		t.Errorf("Expected %d messages in queue, actual %d", 1, length)
+	}
+}
@@ -2,7 +2,9 @@ package server
 
 import (
 	"testing"
+	"time"
 
+	"github.com/streadway/amqp"
 	"github.com/valinurovam/garagemq/exchange"
 )
 
@@ -50,3 +52,206 @@ func Test_ServerPersist_Exchange_Success(t *testing.T) {
 		t.Error("Expected topic exchange")
 	}
 }
+
+func Test_ServerPersist_ConfirmedMessage_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	acks := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+
+	ch.QueueDeclare(t.Name(), true, false, false, false, emptyTable)
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("confirmed"), DeliveryMode: amqp.Persistent})
+
+	select {
+	case confirm := <-acks:
+		if !confirm.Ack {
+			t.Fatal("Expected ack for published message")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected confirm for published message")
+	}
+
+	// in-flight message is not confirmed yet and may be lost on storage reopen
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("in-flight"), DeliveryMode: amqp.Persistent})
+	sc.server.Stop()
+
+	sc, _ = getNewSC(getDefaultTestConfig())
+	ch, _ = sc.client.Channel()
+
+	msg, ok, err := ch.Get(t.Name(), true)
+	if err != nil || !ok {
+		t.Fatal("Expected confirmed message exists after server restart", err)
+	}
+	if string(msg.Body) != "confirmed" {
+		t.Fatalf("Expected confirmed message first, actual '%s'", msg.Body)
+	}
+}
+
+func Test_ServerPersist_ConfirmConsumedBeforePersist_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	acks := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	ch.QueueDeclare(t.Name(), true, false, false, false, emptyTable)
+	deliveries, _ := ch.Consume(t.Name(), "", true, false, false, false, emptyTable)
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("data"), DeliveryMode: amqp.Persistent})
+	<-deliveries
+
+	// message is deleted from storage within the same batch it was added
+	select {
+	case confirm := <-acks:
+		if !confirm.Ack {
+			t.Fatal("Expected ack for consumed message")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected confirm for message consumed before persist")
+	}
+}
+
+func Test_ServerPersist_AckedMessage_NotRedelivered(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	acks := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+
+	ch.QueueDeclare(t.Name(), true, false, false, false, emptyTable)
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("acked"), DeliveryMode: amqp.Persistent})
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("unacked"), DeliveryMode: amqp.Persistent})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-acks:
+		case <-time.After(time.Second):
+			t.Fatal("Expected confirm for published message")
+		}
+	}
+
+	msg, ok, _ := ch.Get(t.Name(), false)
+	if !ok {
+		t.Fatal("Expected message in queue")
+	}
+	msg.Ack(false)
+	// synchronous call on the same channel is handled after ack
+	ch.QueueDeclarePassive(t.Name(), true, false, false, false, emptyTable)
+
+	// ack deletion is still queued for batch persist, it has to be persisted on stop
+	sc.server.Stop()
+
+	sc, _ = getNewSC(getDefaultTestConfig())
+	ch, _ = sc.client.Channel()
+
+	msg, ok, err := ch.Get(t.Name(), true)
+	if err != nil || !ok {
+		t.Fatal("Expected unacked message exists after server restart", err)
+	}
+	if string(msg.Body) != "unacked" {
+		t.Fatalf("Expected acked message is not redelivered, actual '%s'", msg.Body)
+	}
+}
+
+func Test_ServerPersist_ShutdownSnapshot_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	snapshotName := t.Name() + "snapshot"
+	transientName := t.Name() + "transient"
+	ch.ExchangeDeclare(t.Name(), "direct", true, false, false, false, emptyTable)
+	ch.QueueDeclare(snapshotName, false, false, false, false, amqp.Table{"x-shutdown-snapshot": true})
+	ch.QueueDeclare(transientName, false, false, false, false, emptyTable)
+	ch.QueueBind(snapshotName, "key", t.Name(), false, emptyTable)
+
+	ch.Publish("", snapshotName, false, false, amqp.Publishing{Body: []byte("first")})
+	ch.Publish(t.Name(), "key", false, false, amqp.Publishing{Body: []byte("second")})
+	ch.Publish("", transientName, false, false, amqp.Publishing{Body: []byte("lost")})
+	// synchronous call on the same channel is handled after publishes
+	ch.QueueDeclarePassive(snapshotName, false, false, false, false, emptyTable)
+	sc.server.Stop()
+
+	sc, _ = getNewSC(getDefaultTestConfig())
+	ch, _ = sc.client.Channel()
+
+	if len(sc.server.storage.GetVhostQueueSnapshots("/")) != 0 {
+		t.Fatal("Expected snapshot is cleared after restore")
+	}
+	if _, err := ch.QueueDeclarePassive(transientName, false, false, false, false, emptyTable); err == nil {
+		t.Fatal("Expected transient queue without snapshot does not exist after server restart")
+	}
+
+	ch, _ = sc.client.Channel()
+	ch.Publish(t.Name(), "key", false, false, amqp.Publishing{Body: []byte("third")})
+	expectQueueMessages(t, ch, snapshotName, []string{"first", "second", "third"})
+}
+
+func Test_ServerPersist_PersistFilter_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	acks := ch.NotifyPublish(make(chan amqp.Confirmation, 4))
+
+	ch.QueueDeclare(t.Name(), true, false, false, false, amqp.Table{"x-persist-filter": "headers.important == true"})
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Headers: amqp.Table{"important": true}, Body: []byte("first"), DeliveryMode: amqp.Persistent})
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Headers: amqp.Table{"important": false}, Body: []byte("skipped"), DeliveryMode: amqp.Persistent})
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("missing"), DeliveryMode: amqp.Persistent})
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Headers: amqp.Table{"important": true}, Body: []byte("second"), DeliveryMode: amqp.Persistent})
+	for i := 0; i < 4; i++ {
+		select {
+		case confirm := <-acks:
+			if !confirm.Ack {
+				t.Fatal("Expected ack for published message")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected confirm for published message")
+		}
+	}
+	if length := sc.server.getVhost("/").GetQueue(t.Name()).Length(); length != 4 {
+		t.Fatalf("Expected %d messages in queue, actual %d", 4, length)
+	}
+	sc.server.Stop()
+
+	sc, _ = getNewSC(getDefaultTestConfig())
+	ch, _ = sc.client.Channel()
+
+	expectQueueMessages(t, ch, t.Name(), []string{"first", "second"})
+}
+
+func Test_ServerPersist_Redelivered_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	ch.Confirm(false)
+	acks := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+
+	ch.QueueDeclare(t.Name(), true, false, false, false, emptyTable)
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("delivered"), DeliveryMode: amqp.Persistent})
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("fresh"), DeliveryMode: amqp.Persistent})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-acks:
+		case <-time.After(time.Second):
+			t.Fatal("Expected confirm for published message")
+		}
+	}
+
+	msg, ok, _ := ch.Get(t.Name(), false)
+	if !ok || msg.Redelivered {
+		t.Fatal("Expected first delivery without redelivered flag")
+	}
+	sc.server.Stop()
+
+	sc, _ = getNewSC(getDefaultTestConfig())
+	ch, _ = sc.client.Channel()
+
+	msg, ok, _ = ch.Get(t.Name(), true)
+	if !ok || string(msg.Body) != "delivered" || !msg.Redelivered {
+		t.Fatalf("Expected unacked message redelivered after server restart, actual '%s' redelivered %t", msg.Body, msg.Redelivered)
+	}
+	msg, ok, _ = ch.Get(t.Name(), true)
+	if !ok || string(msg.Body) != "fresh" || msg.Redelivered {
+		t.Fatalf("Expected fresh message not redelivered after server restart, actual '%s' redelivered %t", msg.Body, msg.Redelivered)
+	}
+}
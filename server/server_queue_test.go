@@ -1,10 +1,16 @@
 package server
 
 import (
+	"encoding/json"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/streadway/amqp"
+	amqp2 "github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/binding"
+	"github.com/valinurovam/garagemq/config"
+	"github.com/valinurovam/garagemq/exchange"
 )
 
 func Test_QueueDeclare_Success(t *testing.T) {
@@ -106,6 +112,61 @@ func Test_QueueDeclare_Failed_EmptyName(t *testing.T) {
 	}
 }
 
+func Test_QueueDeclare_Success_CountsUnderConcurrency(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	pubCh, _ := sc.client.Channel()
+	cmrCh, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+
+	msgCount := 1000
+	deliveries, _ := cmrCh.Consume(t.Name(), "", false, false, false, false, emptyTable)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < msgCount; i++ {
+			pubCh.Publish("", t.Name(), false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte("test")})
+		}
+	}()
+
+	go func() {
+		for delivery := range deliveries {
+			// every third message is requeued, so length is also increased by requeue
+			if delivery.DeliveryTag%3 == 0 && !delivery.Redelivered {
+				delivery.Nack(false, true)
+			} else {
+				delivery.Ack(false)
+			}
+		}
+	}()
+
+	declare := func() {
+		queue, err := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queue.Messages < 0 || queue.Messages > msgCount {
+			t.Fatalf("Expected: 0 <= messages <= %d, %d given", msgCount, queue.Messages)
+		}
+		if queue.Consumers < 0 || queue.Consumers > 1 {
+			t.Fatalf("Expected: 0 <= consumers <= 1, %d given", queue.Consumers)
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			declare()
+			return
+		default:
+			declare()
+		}
+	}
+}
+
 func Test_QueueDeclarePassive_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -231,6 +292,67 @@ func Test_QueueBind_Success_Rebind(t *testing.T) {
 	}
 }
 
+func Test_QueueBind_TopicExclude_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("testEx", "topic", false, false, false, false, emptyTable)
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+
+	if err := ch.QueueBind(t.Name(), "orders.#", "testEx", false, amqp.Table{"x-exclude": []interface{}{"orders.test.#"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"orders.created", "orders.test.created", "orders.eu.paid", "orders.test"} {
+		ch.Publish("testEx", key, false, false, amqp.Publishing{Body: []byte(key)})
+	}
+	expectQueueMessages(t, ch, t.Name(), []string{"orders.created", "orders.eu.paid"})
+
+	chBad, _ := sc.client.Channel()
+	if err := chBad.QueueBind(t.Name(), "orders.#", "testEx", false, amqp.Table{"x-exclude": int32(1)}); err == nil {
+		t.Error("Expected error on invalid exclude patterns")
+	}
+}
+
+func Test_QueueDeclare_ImplicitBindings(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name()+"_b", true, false, false, false, emptyTable)
+	ch.QueueDeclare(t.Name()+"_a", false, false, false, false, emptyTable)
+	ch.Publish("", t.Name()+"_a", false, false, amqp.Publishing{Body: []byte("test")})
+	ch.QueueDeclarePassive(t.Name()+"_a", false, false, false, false, emptyTable)
+
+	vhost := sc.server.getVhost("/")
+	implicit := make(map[string]*binding.Binding)
+	for _, bind := range vhost.ImplicitBindings() {
+		implicit[bind.GetQueue()] = bind
+	}
+	for _, name := range []string{t.Name() + "_a", t.Name() + "_b"} {
+		bind, ok := implicit[name]
+		if !ok || bind.GetExchange() != "" || bind.GetRoutingKey() != name {
+			t.Fatalf("Expected implicit default exchange binding of queue '%s'", name)
+		}
+	}
+	if routed := implicit[t.Name()+"_a"].RoutedCount(); routed != 1 {
+		t.Errorf("Expected %d message routed by implicit binding, actual %d", 1, routed)
+	}
+
+	for _, bind := range sc.server.storage.GetVhostBindings("/") {
+		if bind.GetExchange() == "" {
+			t.Errorf("Expected implicit binding of queue '%s' is not stored", bind.GetQueue())
+		}
+	}
+
+	ch.QueueDelete(t.Name()+"_b", false, false, false)
+	for _, bind := range vhost.ImplicitBindings() {
+		if bind.GetQueue() == t.Name()+"_b" {
+			t.Error("Expected implicit binding removed with queue")
+		}
+	}
+}
+
 func Test_QueueBind_Failed_ExchangeNotExists(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -271,6 +393,44 @@ func Test_QueueBind_Failed_OnExclusiveQueue(t *testing.T) {
 	}
 }
 
+func Test_QueueBind_Failed_MaxBindings(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Exchange.MaxBindings = 2
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.ExchangeDeclare("testEx", "direct", false, false, false, false, emptyTable)
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+
+	for _, key := range []string{"key1", "key2"} {
+		if err := ch.QueueBind(t.Name(), key, "testEx", false, emptyTable); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// duplicate binding is ignored and does not count
+	if err := ch.QueueBind(t.Name(), "key1", "testEx", false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ch.QueueBind(t.Name(), "key3", "testEx", false, emptyTable)
+	if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.ResourceError {
+		t.Fatalf("Expected resource error on bind over limit, actual %v", err)
+	}
+
+	if length := len(sc.server.getVhost("/").GetExchange("testEx").GetBindings()); length != 2 {
+		t.Errorf("Expected %d bindings, actual %d", 2, length)
+	}
+
+	// queues are still bound to default exchange without limit
+	chNew, _ := sc.client.Channel()
+	for i := 0; i < 3; i++ {
+		if _, err := chNew.QueueDeclare(t.Name()+strconv.Itoa(i), false, false, false, false, emptyTable); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func Test_QueueUnbind_Success(t *testing.T) {
 	sc, _ := getNewSC(getDefaultTestConfig())
 	defer sc.clean()
@@ -532,3 +692,705 @@ func Test_Basic_AutoDelete(t *testing.T) {
 		t.Error("Expected empty queues")
 	}
 }
+
+func Test_QueuePauseResume_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	cmr, _ := ch.Consume(t.Name(), "tag", false, false, false, false, emptyTable)
+
+	qu := sc.server.GetVhost("/").GetQueue(t.Name())
+	qu.Pause()
+
+	msgCount := 10
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{ContentType: "text/plain", Body: []byte(strconv.Itoa(i))})
+	}
+
+	select {
+	case <-cmr:
+		t.Fatal("Expected no deliveries from paused queue")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if qu.Length() != uint64(msgCount) {
+		t.Errorf("Expected queue length %d, actual %d", msgCount, qu.Length())
+	}
+	if qu.ConsumersCount() != 1 {
+		t.Errorf("Expected %d consumers, actual %d", 1, qu.ConsumersCount())
+	}
+
+	qu.Resume()
+
+	for i := 0; i < msgCount; i++ {
+		select {
+		case msg := <-cmr:
+			if string(msg.Body) != strconv.Itoa(i) {
+				t.Fatalf("Expected message %d, actual %s", i, msg.Body)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout on waiting messages after resume")
+		}
+	}
+}
+
+func Test_QueueDeclare_Failed_InvalidCompressArg(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if _, err := ch.QueueDeclare(t.Name(), false, false, false, false, amqp.Table{"x-compress": "yes"}); err == nil {
+		t.Fatal("Expected error on invalid x-compress argument")
+	}
+}
+
+func Test_QueueDeclare_MasterLocator(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if _, err := ch.QueueDeclare(t.Name(), false, false, false, false, amqp.Table{"x-queue-master-locator": "client-local"}); err != nil {
+		t.Fatal(err)
+	}
+	if locator := sc.server.getVhost("/").GetQueue(t.Name()).MasterLocator(); locator != "client-local" {
+		t.Fatalf("Expected master locator '%s', actual '%s'", "client-local", locator)
+	}
+
+	if _, err := ch.QueueDeclare(t.Name()+"invalid", false, false, false, false, amqp.Table{"x-queue-master-locator": "nearest"}); err == nil || err.(*amqp.Error).Code != amqp.PreconditionFailed {
+		t.Fatalf("Expected channel error with code %d, actual %v", amqp.PreconditionFailed, err)
+	}
+}
+
+func Test_QueueDeclare_Policy_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	policy, err := NewPolicy("ttl", "^events\\.", PolicyApplyToQueues, 0, amqp2.Table{"x-message-ttl": int32(60000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.server.getVhost("/").SetPolicy(policy)
+
+	if _, err := ch.QueueDeclare("events.orders", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("events.explicit", false, false, false, false, amqp.Table{"x-message-ttl": int32(1000)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	vhost := sc.server.getVhost("/")
+	if ttl := (*vhost.GetQueue("events.orders").Arguments())["x-message-ttl"]; ttl != int32(60000) {
+		t.Fatalf("Expected policy x-message-ttl 60000, actual %v", ttl)
+	}
+	if ttl := (*vhost.GetQueue("events.explicit").Arguments())["x-message-ttl"]; ttl != int32(1000) {
+		t.Fatalf("Expected explicit x-message-ttl 1000, actual %v", ttl)
+	}
+	if _, ok := (*vhost.GetQueue(t.Name()).Arguments())["x-message-ttl"]; ok {
+		t.Fatal("Expected policy is not applied to not matched queue")
+	}
+}
+
+func Test_QueueDeclare_Policy_Priority(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	vhost := sc.server.getVhost("/")
+
+	low, _ := NewPolicy("low", "^events\\.", PolicyApplyToAll, 1, amqp2.Table{"x-message-ttl": int32(1000), "x-max-length": int32(10)})
+	high, _ := NewPolicy("high", "^events\\.orders$", PolicyApplyToQueues, 10, amqp2.Table{"x-message-ttl": int32(5000)})
+	vhost.SetPolicy(low)
+	vhost.SetPolicy(high)
+
+	if _, err := ch.QueueDeclare("events.orders", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("events.users", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	orders := vhost.GetQueue("events.orders")
+	if orders.Policy() != "high" {
+		t.Fatalf("Expected policy 'high', actual '%s'", orders.Policy())
+	}
+	if ttl := (*orders.Arguments())["x-message-ttl"]; ttl != int32(5000) {
+		t.Fatalf("Expected x-message-ttl 5000, actual %v", ttl)
+	}
+	if _, ok := (*orders.Arguments())["x-max-length"]; ok {
+		t.Fatal("Expected only the highest priority policy is applied")
+	}
+	if policy := vhost.GetQueue("events.users").Policy(); policy != "low" {
+		t.Fatalf("Expected policy 'low', actual '%s'", policy)
+	}
+
+	// existing queues are re-evaluated on policy change
+	vhost.DeletePolicy("high")
+	if orders.Policy() != "low" {
+		t.Fatalf("Expected policy 'low' after delete, actual '%s'", orders.Policy())
+	}
+	if ttl := (*orders.Arguments())["x-message-ttl"]; ttl != int32(1000) {
+		t.Fatalf("Expected x-message-ttl 1000, actual %v", ttl)
+	}
+
+	invalid, _ := NewPolicy("invalid", ".*", PolicyApplyToQueues, 20, amqp2.Table{"x-compress": "yes"})
+	vhost.SetPolicy(invalid)
+	if orders.Policy() != "low" {
+		t.Fatalf("Expected queue keeps policy 'low' on invalid definition, actual '%s'", orders.Policy())
+	}
+}
+
+func Test_Vhost_Snapshot_ConcurrentMutation(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	vhost := sc.server.getVhost("/")
+	qu := vhost.NewQueue(t.Name(), 0, false, false, false, 0)
+	vhost.AppendQueue(qu)
+	systemExchanges := len(vhost.SnapshotExchanges())
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			name := t.Name() + strconv.Itoa(i)
+			vhost.AppendQueue(vhost.NewQueue(name, 0, false, false, false, 0))
+			vhost.AppendExchange(exchange.NewExchange(name, exchange.ExTypeDirect, false, false, false, false))
+			vhost.DeleteQueue(name, false, false)
+			vhost.DeleteExchange(name, false)
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		queues := vhost.SnapshotQueues()
+		exchanges := vhost.SnapshotExchanges()
+		if _, err := json.Marshal(queues); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := json.Marshal(exchanges); err != nil {
+			t.Fatal(err)
+		}
+
+		// registries change between snapshots, but each of them is complete and has no duplicates
+		names := make(map[string]bool)
+		for _, snapshot := range queues {
+			if names[snapshot.Name] {
+				t.Fatalf("Duplicated queue '%s' in snapshot", snapshot.Name)
+			}
+			names[snapshot.Name] = true
+		}
+		if !names[t.Name()] {
+			t.Fatalf("Expected queue '%s' in snapshot", t.Name())
+		}
+		if len(exchanges) < systemExchanges {
+			t.Fatalf("Expected %d system exchanges in snapshot, actual %d exchanges", systemExchanges, len(exchanges))
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func Test_QueueDeclare_QueueType(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	vhost := sc.server.getVhost("/")
+
+	for _, queueType := range []string{"classic", "quorum", "stream"} {
+		name := t.Name() + queueType
+		if _, err := ch.QueueDeclare(name, true, false, false, false, amqp.Table{"x-queue-type": queueType}); err != nil {
+			t.Fatal(err)
+		}
+		qu := vhost.GetQueue(name)
+		if qu.Type() != queueType || qu.IsStream() != (queueType == "stream") || !qu.IsDurable() {
+			t.Errorf("Expected durable %s queue, actual %s, stream %t", queueType, qu.Type(), qu.IsStream())
+		}
+	}
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	if qu := vhost.GetQueue(t.Name()); qu.Type() != "classic" {
+		t.Errorf("Expected classic queue by default, actual %s", qu.Type())
+	}
+
+	// quorum queue is kept as durable classic queue, so it can't be transient
+	if _, err := ch.QueueDeclare(t.Name()+"transient", false, false, false, false, amqp.Table{"x-queue-type": "quorum"}); err == nil || err.(*amqp.Error).Code != amqp.PreconditionFailed {
+		t.Fatalf("Expected channel error with code %d, actual %v", amqp.PreconditionFailed, err)
+	}
+
+	ch, _ = sc.client.Channel()
+	if _, err := ch.QueueDeclare(t.Name()+"unknown", true, false, false, false, amqp.Table{"x-queue-type": "lazy"}); err == nil || err.(*amqp.Error).Code != amqp.PreconditionFailed {
+		t.Fatalf("Expected channel error with code %d, actual %v", amqp.PreconditionFailed, err)
+	}
+
+	// queue type can't be changed on redeclare
+	ch, _ = sc.client.Channel()
+	if _, err := ch.QueueDeclare(t.Name()+"classic", true, false, false, false, amqp.Table{"x-queue-type": "quorum"}); err == nil {
+		t.Error("Expected error on redeclare classic queue as quorum")
+	}
+}
+
+func Test_QueueDeclare_Stream_Inequivalent_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	if _, err := ch.QueueDeclare(t.Name(), false, false, false, false, amqp.Table{"x-queue-type": "stream"}); err == nil {
+		t.Error("Expected error on redeclare classic queue as stream")
+	}
+}
+
+// expectQueueMessages gets all messages from queue and checks their bodies are in order
+func expectQueueMessages(t *testing.T, ch *amqp.Channel, queueName string, bodies []string) {
+	for _, body := range bodies {
+		msg, ok, err := ch.Get(queueName, true)
+		if err != nil || !ok || string(msg.Body) != body || msg.Redelivered {
+			t.Fatalf("Expected message '%s' from queue '%s', actual '%s' (redelivered %t), %v", body, queueName, msg.Body, msg.Redelivered, err)
+		}
+	}
+	if _, ok, _ := ch.Get(queueName, true); ok {
+		t.Fatalf("Expected queue '%s' to be empty", queueName)
+	}
+}
+
+func Test_QueueReplayStream_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	stream, dest := t.Name()+"_stream", t.Name()+"_dest"
+	ch.QueueDeclare(stream, true, false, false, false, amqp.Table{"x-queue-type": "stream"})
+	ch.QueueDeclare(dest, false, false, false, false, emptyTable)
+	publish := func(bodies ...string) {
+		for _, body := range bodies {
+			ch.Publish("", stream, false, false, amqp.Publishing{Body: []byte(body), DeliveryMode: amqp.Persistent})
+		}
+		ch.QueueDeclarePassive(stream, true, false, false, false, amqp.Table{"x-queue-type": "stream"})
+		time.Sleep(20 * time.Millisecond)
+	}
+	publish("0", "1")
+	from := time.Now()
+	publish("2", "3", "4")
+	to := time.Now()
+	publish("5")
+
+	vhost := sc.server.getVhost("/")
+	replayed, err := vhost.ReplayStream(stream, dest, from, to)
+	if err != nil || replayed != 3 {
+		t.Fatalf("Expected %d messages replayed, actual %d, %v", 3, replayed, err)
+	}
+	expectQueueMessages(t, ch, dest, []string{"2", "3", "4"})
+
+	if replayed, err = vhost.ReplayStream(stream, dest, int64(4), nil); err != nil || replayed != 2 {
+		t.Fatalf("Expected %d messages replayed from offset, actual %d, %v", 2, replayed, err)
+	}
+	expectQueueMessages(t, ch, dest, []string{"4", "5"})
+
+	if length := vhost.GetQueue(stream).Length(); length != 6 {
+		t.Errorf("Expected source stream unchanged, actual length %d", length)
+	}
+	if _, err = vhost.ReplayStream(dest, stream, nil, nil); err == nil {
+		t.Error("Expected error on replay of non-stream queue")
+	}
+	if _, err = vhost.ReplayStream(stream, t.Name()+"_missing", nil, nil); err == nil {
+		t.Error("Expected error on replay into missing queue")
+	}
+}
+
+func Test_QueueMove_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	src, dest := t.Name()+"_src", t.Name()+"_dest"
+	ch.QueueDeclare(src, true, false, false, false, emptyTable)
+	ch.QueueDeclare(dest, true, false, false, false, emptyTable)
+	msgCount := 100
+	bodies := make([]string, msgCount)
+	for i := range bodies {
+		bodies[i] = strconv.Itoa(i)
+		ch.Publish("", src, false, false, amqp.Publishing{Body: []byte(bodies[i]), DeliveryMode: amqp.Persistent})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.getVhost("/")
+	if moved, err := vhost.MoveMessages(src, "", dest, 0, false); err != nil || moved != msgCount {
+		t.Fatalf("Expected %d moved messages, actual %d, %v", msgCount, moved, err)
+	}
+	if length := vhost.GetQueue(src).Length(); length != 0 {
+		t.Errorf("Expected source queue drained, actual length %d", length)
+	}
+	if length := vhost.GetQueue(dest).Length(); length != uint64(msgCount) {
+		t.Errorf("Expected %d messages in destination queue, actual %d", msgCount, length)
+	}
+	expectQueueMessages(t, ch, dest, bodies)
+}
+
+func Test_QueueMove_CountCopy_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	src, dest := t.Name()+"_src", t.Name()+"_dest"
+	ch.QueueDeclare(src, false, false, false, false, emptyTable)
+	ch.QueueDeclare(dest, false, false, false, false, emptyTable)
+	ch.QueueBind(dest, "moved", "amq.direct", false, emptyTable)
+	bodies := []string{"0", "1", "2", "3", "4"}
+	for _, body := range bodies {
+		ch.Publish("", src, false, false, amqp.Publishing{Body: []byte(body)})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.getVhost("/")
+	if moved, err := vhost.MoveMessages(src, "amq.direct", "moved", 3, true); err != nil || moved != 3 {
+		t.Fatalf("Expected %d copied messages, actual %d, %v", 3, moved, err)
+	}
+	// copied messages are kept in source queue on their positions
+	expectQueueMessages(t, ch, src, bodies)
+	expectQueueMessages(t, ch, dest, bodies[:3])
+}
+
+func Test_QueueMove_NoRoute_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	bodies := []string{"0", "1", "2"}
+	for _, body := range bodies {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte(body)})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.getVhost("/")
+	if moved, err := vhost.MoveMessages(t.Name(), "", "missing", 0, false); err == nil || moved != 0 {
+		t.Fatalf("Expected error on move into missing queue, actual %d moved", moved)
+	}
+	if _, err := vhost.MoveMessages(t.Name(), "missing", "", 0, false); err == nil {
+		t.Fatal("Expected error on move through missing exchange")
+	}
+	expectQueueMessages(t, ch, t.Name(), bodies)
+}
+
+func Test_QueueMove_Draining_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	src, dest := t.Name()+"_src", t.Name()+"_dest"
+	ch.QueueDeclare(src, false, false, false, false, emptyTable)
+	ch.QueueDeclare(dest, false, false, false, false, emptyTable)
+	bodies := []string{"0", "1", "2"}
+	for _, body := range bodies {
+		ch.Publish("", src, false, false, amqp.Publishing{Body: []byte(body)})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// move publishes like clients do, so draining vhost refuses it
+	vhost := sc.server.getVhost("/")
+	vhost.SetDraining(true)
+	if moved, err := vhost.MoveMessages(src, "", dest, 0, false); err == nil || moved != 0 {
+		t.Fatalf("Expected error on move in draining vhost, actual %d moved", moved)
+	}
+	vhost.SetDraining(false)
+
+	if length := vhost.GetQueue(dest).Length(); length != 0 {
+		t.Errorf("Expected no messages in destination queue, actual %d", length)
+	}
+	expectQueueMessages(t, ch, src, bodies)
+}
+
+func Test_QueuePeek_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	bodies := []string{"0", "1", "2", "3", "4"}
+	for _, body := range bodies {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte(body)})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	qu := sc.server.getVhost("/").GetQueue(t.Name())
+	peeked := qu.Peek(3)
+	if len(peeked) != 3 {
+		t.Fatalf("Expected %d peeked messages, actual %d", 3, len(peeked))
+	}
+	for i, message := range peeked {
+		if body := string(message.Body[0].Payload); body != bodies[i] {
+			t.Errorf("Expected peeked message '%s', actual '%s'", bodies[i], body)
+		}
+	}
+	if peeked = qu.Peek(-1); len(peeked) != len(bodies) {
+		t.Errorf("Expected all %d messages peeked, actual %d", len(bodies), len(peeked))
+	}
+
+	// peeked messages are kept in queue in order and are not redelivered
+	if length := qu.Length(); length != uint64(len(bodies)) {
+		t.Errorf("Expected queue length %d after peek, actual %d", len(bodies), length)
+	}
+	expectQueueMessages(t, ch, t.Name(), bodies)
+}
+
+func Test_QueueDeclare_VhostLimits(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.Vhost.Limits = map[string]config.VhostLimits{"/": {MessageTTL: 10000, MaxLength: 3}}
+	sc, _ := getNewSC(cfg)
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	if _, err := ch.QueueDeclare(t.Name()+"_ttl", false, false, false, false, amqp.Table{"x-message-ttl": int32(60000)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	vhost := sc.server.getVhost("/")
+	if ttl := (*vhost.GetQueue(t.Name() + "_ttl").Arguments())["x-message-ttl"]; ttl != int64(10000) {
+		t.Fatalf("Expected x-message-ttl clamped to vhost limit 10000, actual %v", ttl)
+	}
+	arguments := *vhost.GetQueue(t.Name()).Arguments()
+	if arguments["x-message-ttl"] != int64(10000) || arguments["x-max-length"] != int64(3) {
+		t.Fatalf("Expected vhost limits as defaults, actual %v", arguments)
+	}
+
+	bodies := []string{"0", "1", "2", "3", "4"}
+	for _, body := range bodies {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte(body)})
+	}
+	time.Sleep(50 * time.Millisecond)
+	expectQueueMessages(t, ch, t.Name(), bodies[2:])
+}
+
+func Test_QueueRetire_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	msgCount := 10
+	for i := 0; i < msgCount; i++ {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte(strconv.Itoa(i))})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.getVhost("/")
+	qu := vhost.GetQueue(t.Name())
+	retired := make(chan error, 1)
+	go func() {
+		_, err := vhost.RetireQueue(t.Name(), 5*time.Second, RetireAbort, "")
+		retired <- err
+	}()
+	for !qu.IsPublishPaused() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// publishes into retired queue are rejected
+	pubCh, _ := sc.client.Channel()
+	pubCh.Confirm(false)
+	acks, nacks := pubCh.NotifyConfirm(make(chan uint64, 1), make(chan uint64, 1))
+	pubCh.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("rejected")})
+	select {
+	case <-nacks:
+	case <-acks:
+		t.Fatal("Expected publish into retired queue nacked")
+	case <-time.After(time.Second):
+		t.Fatal("Expected publish confirm")
+	}
+
+	// consumer drains queue, acking messages
+	deliveries, _ := ch.Consume(t.Name(), "", false, false, false, false, emptyTable)
+	consumed := 0
+	for consumed < msgCount {
+		delivery := <-deliveries
+		if delivery.Body == nil {
+			break
+		}
+		time.Sleep(2 * time.Millisecond)
+		delivery.Ack(false)
+		consumed++
+	}
+
+	select {
+	case err := <-retired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected queue retired")
+	}
+	if consumed != msgCount {
+		t.Errorf("Expected %d drained messages, actual %d", msgCount, consumed)
+	}
+	if vhost.GetQueue(t.Name()) != nil {
+		t.Error("Expected retired queue deleted")
+	}
+}
+
+func Test_QueueRequeueUnacked_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	stuckCh, _ := sc.client.Channel()
+
+	stuckCh.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	msgCount := 3
+	for i := 0; i < msgCount; i++ {
+		stuckCh.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte(strconv.Itoa(i))})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// messages are taken without ack and never acked
+	for i := 0; i < msgCount; i++ {
+		if _, ok, err := stuckCh.Get(t.Name(), false); err != nil || !ok {
+			t.Fatal("Expected message in queue", err)
+		}
+	}
+
+	vhost := sc.server.getVhost("/")
+	if requeued, err := vhost.RequeueUnacked(t.Name()); err != nil || requeued != msgCount {
+		t.Fatalf("Expected %d requeued messages, actual %d, %v", msgCount, requeued, err)
+	}
+
+	ch, _ := sc.client.Channel()
+	deliveries, _ := ch.Consume(t.Name(), "", false, false, false, false, emptyTable)
+	for i := 0; i < msgCount; i++ {
+		select {
+		case delivery := <-deliveries:
+			if string(delivery.Body) != strconv.Itoa(i) || !delivery.Redelivered {
+				t.Fatalf("Expected redelivered message '%d', actual '%s' (redelivered %t)", i, delivery.Body, delivery.Redelivered)
+			}
+			delivery.Ack(false)
+		case <-time.After(time.Second):
+			t.Fatal("Expected requeued message delivered to fresh consumer")
+		}
+	}
+
+	if _, err := vhost.RequeueUnacked("missing"); err == nil {
+		t.Fatal("Expected error on missing queue")
+	}
+}
+
+func Test_QueueRequeueBackoff_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, amqp.Table{"x-requeue-backoff": int32(50), "x-requeue-backoff-max": int32(1000)})
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("0")})
+	deliveries, _ := ch.Consume(t.Name(), "", false, false, false, false, emptyTable)
+
+	// each redelivery waits twice as long as previous one: 50ms, 100ms, 200ms
+	var gaps []time.Duration
+	last := time.Now()
+	for i := 0; i < 4; i++ {
+		select {
+		case delivery := <-deliveries:
+			if i > 0 {
+				gaps = append(gaps, time.Since(last))
+			}
+			last = time.Now()
+			if i < 3 {
+				delivery.Nack(false, true)
+			} else {
+				delivery.Ack(false)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected redelivery %d", i)
+		}
+	}
+
+	for i, gap := range gaps {
+		expected := time.Duration(50<<uint(i)) * time.Millisecond
+		if gap < expected {
+			t.Fatalf("Expected redelivery %d after at least %v, actual %v", i+1, expected, gap)
+		}
+		if i > 0 && gap <= gaps[i-1] {
+			t.Fatalf("Expected increasing redelivery delays, actual %v", gaps)
+		}
+	}
+}
+
+func Test_QueueConsumerFairness_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	fastCh, _ := sc.client.Channel()
+	slowCh, _ := sc.client.Channel()
+	slowCh.Qos(1, 0, false)
+
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	slow, _ := slowCh.Consume(t.Name(), "slow", false, false, false, false, emptyTable)
+	ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte("0")})
+
+	// slow consumer holds ack of the first message
+	var held amqp.Delivery
+	select {
+	case held = <-slow:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected message delivered to slow consumer")
+	}
+
+	fast, _ := fastCh.Consume(t.Name(), "fast", false, false, false, false, emptyTable)
+	msgCount := 20
+	for i := 1; i <= msgCount; i++ {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte(strconv.Itoa(i))})
+	}
+
+	// slow consumer is passed over while its ack is held, so every following message goes to fast one
+	for i := 1; i <= msgCount; i++ {
+		select {
+		case delivery := <-fast:
+			if string(delivery.Body) != strconv.Itoa(i) {
+				t.Fatalf("Expected message %d delivered to fast consumer, actual %s", i, delivery.Body)
+			}
+			delivery.Ack(false)
+		case delivery := <-slow:
+			t.Fatalf("Expected message %s not delivered to slow consumer with held ack", delivery.Body)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected message %d delivered to fast consumer", i)
+		}
+	}
+	held.Ack(false)
+}
+
+func Test_QueueRetire_Timeout(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+
+	dlq := t.Name() + "_dlq"
+	ch.QueueDeclare(t.Name(), false, false, false, false, emptyTable)
+	ch.QueueDeclare(dlq, false, false, false, false, emptyTable)
+	bodies := []string{"0", "1", "2"}
+	for _, body := range bodies {
+		ch.Publish("", t.Name(), false, false, amqp.Publishing{Body: []byte(body)})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	vhost := sc.server.getVhost("/")
+	if _, err := vhost.RetireQueue(t.Name(), 50*time.Millisecond, RetireAbort, ""); err == nil {
+		t.Fatal("Expected retire aborted on timeout")
+	}
+	if qu := vhost.GetQueue(t.Name()); qu == nil || qu.IsPublishPaused() || qu.Length() != uint64(len(bodies)) {
+		t.Fatal("Expected queue kept accepting publishes after aborted retire")
+	}
+
+	moved, err := vhost.RetireQueue(t.Name(), 50*time.Millisecond, RetireDeadLetter, dlq)
+	if err != nil || moved != len(bodies) {
+		t.Fatalf("Expected %d dead-lettered messages, actual %d, %v", len(bodies), moved, err)
+	}
+	if vhost.GetQueue(t.Name()) != nil {
+		t.Error("Expected retired queue deleted")
+	}
+	expectQueueMessages(t, ch, dlq, bodies)
+}
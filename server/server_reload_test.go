@@ -0,0 +1,68 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/config"
+)
+
+func Test_Reload_LogLevel_Policy_Success(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	ch, _ := sc.client.Channel()
+	defer log.SetLevel(log.GetLevel())
+
+	if _, err := ch.QueueDeclare("events.orders", false, false, false, false, emptyTable); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := *sc.server.config
+	cfg.Log.Level = "trace"
+	cfg.Policies = []config.Policy{
+		{Name: "ttl", Pattern: "^events\\.", ApplyTo: PolicyApplyToQueues, Definition: map[string]interface{}{"x-message-ttl": 60000}},
+	}
+	cfg.TCP.Port = "5673"
+	report, err := sc.server.Reload(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Applied, []string{"log.level", "policies"}) || !reflect.DeepEqual(report.Ignored, []string{"tcp"}) {
+		t.Fatalf("Expected applied log.level and policies and ignored tcp, actual %v and %v", report.Applied, report.Ignored)
+	}
+
+	if log.GetLevel() != log.TraceLevel {
+		t.Errorf("Expected log level %s, actual %s", log.TraceLevel, log.GetLevel())
+	}
+	qu := sc.server.getVhost("/").GetQueue("events.orders")
+	if ttl := (*qu.Arguments())["x-message-ttl"]; qu.Policy() != "ttl" || ttl != int64(60000) {
+		t.Fatalf("Expected reloaded policy x-message-ttl 60000, actual '%s' %v", qu.Policy(), ttl)
+	}
+
+	// policy removed from config is deleted
+	cfg.Policies = nil
+	if _, err := sc.server.Reload(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if qu.Policy() != "" {
+		t.Errorf("Expected policy deleted on reload, actual '%s'", qu.Policy())
+	}
+}
+
+func Test_Reload_Invalid_Failed(t *testing.T) {
+	sc, _ := getNewSC(getDefaultTestConfig())
+	defer sc.clean()
+	defer log.SetLevel(log.GetLevel())
+	level := log.GetLevel()
+
+	cfg := *sc.server.config
+	cfg.Log.Level = "trace"
+	cfg.Policies = []config.Policy{{Vhost: "unknown", Name: "ttl", Pattern: ".*"}}
+	if _, err := sc.server.Reload(&cfg); err == nil {
+		t.Fatal("Expected error on policy of unknown vhost")
+	}
+	if log.GetLevel() != level {
+		t.Errorf("Expected log level not changed by rejected config, actual %s", log.GetLevel())
+	}
+}
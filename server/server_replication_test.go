@@ -0,0 +1,82 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/valinurovam/garagemq/metrics"
+	"github.com/valinurovam/garagemq/replication"
+)
+
+func Test_Replication_PromoteFollower_Success(t *testing.T) {
+	metrics.NewTrackRegistry(15, time.Second, true)
+	defer metrics.Destroy()
+	dir, _ := ioutil.TempDir("", "replication")
+	defer os.RemoveAll(dir)
+
+	leaderConfig := getDefaultTestConfig().srvConfig
+	leaderConfig.Db.DefaultPath = dir + "/leader"
+	leaderSrv := NewServer("localhost", "0", proto, &leaderConfig)
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	leaderSrv.leader = replication.NewLeader(100, "secret")
+	go leaderSrv.leader.Serve(listener)
+	leaderSrv.initServerStorage()
+	leaderSrv.initUsers()
+	leaderSrv.initDefaultVirtualHosts()
+	leaderSrv.storage.AddVhost("replicated", false)
+	defer leaderSrv.Stop()
+
+	followerConfig := getDefaultTestConfig().srvConfig
+	followerConfig.Db.DefaultPath = dir + "/follower"
+	followerConfig.Replication.LeaderAddr = listener.Addr().String()
+	followerConfig.Replication.Secret = "secret"
+	followerConfig.Replication.ReconnectDelay = 10 * time.Millisecond
+	followerSrv := NewServer("localhost", "0", proto, &followerConfig)
+	if err := followerSrv.Promote(); err == nil {
+		t.Fatal("Expected error on promote not following server")
+	}
+
+	promoted := make(chan struct{})
+	go func() {
+		followerSrv.follow()
+		close(promoted)
+	}()
+
+	_, leaderSeq := leaderSrv.ReplicationState()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		role, seq := followerSrv.ReplicationState()
+		if role == ReplicationFollower && seq == leaderSeq {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected follower at batch %d, actual %s at %d", leaderSeq, role, seq)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := followerSrv.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-promoted:
+	case <-time.After(time.Second):
+		t.Fatal("Expected follower server started after promotion")
+	}
+	if role, _ := followerSrv.ReplicationState(); role != ReplicationStandalone {
+		t.Errorf("Expected promoted server role %s, actual %s", ReplicationStandalone, role)
+	}
+
+	followerSrv.initServerStorage()
+	defer followerSrv.storage.Close()
+	vhosts := followerSrv.storage.GetVhosts()
+	if system, ok := vhosts["/"]; !ok || !system {
+		t.Errorf("Expected replicated system vhost '/', actual %v", vhosts)
+	}
+	if _, ok := vhosts["replicated"]; !ok {
+		t.Errorf("Expected replicated vhost 'replicated', actual %v", vhosts)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func getSockopt(t *testing.T, conn syscall.Conn, level int, opt int) int {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	err = rawControl(rawConn, func(fd uintptr) (err error) {
+		value, err = syscall.GetsockoptInt(int(fd), level, opt)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func Test_TCP_TuneConnection_Success(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	cfg.srvConfig.TCP.Nodelay = true
+	cfg.srvConfig.TCP.KeepAlive = 30 * time.Second
+	srv := &Server{config: &cfg.srvConfig}
+
+	toServer, _, fromClient, fromClientEx, err := networkSim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toServer.Close()
+	defer fromClient.Close()
+	defer fromClientEx.Close()
+
+	srv.tuneConnection(fromClient)
+
+	if getSockopt(t, fromClient, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+		t.Error("Expected TCP_NODELAY is set on accepted connection")
+	}
+	if getSockopt(t, fromClient, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+		t.Error("Expected SO_KEEPALIVE is set on accepted connection")
+	}
+	if idle := getSockopt(t, fromClient, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != 30 {
+		t.Errorf("Expected: keepalive idle = 30, %d given", idle)
+	}
+}
+
+func Test_TCP_TuneConnection_Success_Disabled(t *testing.T) {
+	cfg := getDefaultTestConfig()
+	srv := &Server{config: &cfg.srvConfig}
+
+	toServer, _, fromClient, fromClientEx, err := networkSim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer toServer.Close()
+	defer fromClient.Close()
+	defer fromClientEx.Close()
+
+	srv.tuneConnection(fromClient)
+
+	if getSockopt(t, fromClient, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0 {
+		t.Error("Expected TCP_NODELAY is not set on accepted connection")
+	}
+	if getSockopt(t, fromClient, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0 {
+		t.Error("Expected SO_KEEPALIVE is not set on accepted connection")
+	}
+}
+
+func Test_TCP_Listen_Success(t *testing.T) {
+	for _, reuseAddr := range []bool{true, false} {
+		cfg := getDefaultTestConfig()
+		cfg.srvConfig.TCP.ReuseAddr = reuseAddr
+		cfg.srvConfig.TCP.Backlog = 16
+		srv := &Server{config: &cfg.srvConfig}
+
+		listener, err := srv.listenTCP("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value := getSockopt(t, listener, syscall.SOL_SOCKET, syscall.SO_REUSEADDR); (value != 0) != reuseAddr {
+			t.Errorf("Expected: SO_REUSEADDR = %t, %d given", reuseAddr, value)
+		}
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := listener.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted.Close()
+		conn.Close()
+		listener.Close()
+	}
+}
@@ -19,6 +19,9 @@ import (
 var emptyTable = make(amqpclient.Table)
 var proto = amqp.ProtoRabbit
 
+// testDbPath is storage directory of test servers, it is created out of source tree so tests don't leave files in it
+var testDbPath, _ = ioutil.TempDir("", "garagemq_db_test")
+
 func init() {
 	logrus.SetOutput(ioutil.Discard)
 	//logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
@@ -36,6 +39,8 @@ type ServerClient struct {
 type TestConfig struct {
 	srvConfig    config.Config
 	clientConfig amqpclient.Config
+	// wrapConn wraps client side of the first test connection, if set
+	wrapConn func(conn net.Conn) net.Conn
 }
 
 func (sc *ServerClient) clean() {
@@ -73,7 +78,7 @@ func getDefaultTestConfig() TestConfig {
 				MaxMessagesInRAM: 4096,
 			},
 			Db: config.Db{
-				DefaultPath: "db_test",
+				DefaultPath: testDbPath,
 				Engine:      "badger",
 			},
 			Vhost: config.Vhost{
@@ -98,6 +103,9 @@ func getNewSC(config TestConfig) (*ServerClient, error) {
 	sc.server.initServerStorage()
 	sc.server.initUsers()
 	sc.server.initDefaultVirtualHosts()
+	if err := sc.server.initDefinitions(); err != nil {
+		return sc, err
+	}
 	sc.server.status = Running
 
 	// the only chance to disable badger logger
@@ -110,6 +118,9 @@ func getNewSC(config TestConfig) (*ServerClient, error) {
 	sc.server.acceptConnection(fromClient)
 	sc.server.acceptConnection(fromClientEx)
 
+	if config.wrapConn != nil {
+		toServer = config.wrapConn(toServer)
+	}
 	clientConfig := config.clientConfig
 	clientConfig.Dial = func(network, addr string) (net.Conn, error) {
 		return toServer, nil
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/binding"
+	"github.com/valinurovam/garagemq/queue"
+)
+
+// snapshotQueues stores non-durable queues with x-shutdown-snapshot argument into server storage
+// Snapshot keeps queue itself, its bindings and messages held in memory, messages swapped to disk are not kept
+// Vhost locks must be held by caller
+func (vhost *VirtualHost) snapshotQueues() {
+	for name, qu := range vhost.queues {
+		if !qu.IsShutdownSnapshot() {
+			continue
+		}
+		data, err := vhost.marshalQueueSnapshot(qu)
+		if err == nil {
+			err = vhost.srvStorage.AddQueueSnapshot(vhost.name, name, data)
+		}
+		if err != nil {
+			vhost.logger.WithError(err).WithField("queueName", name).Error("Error on queue snapshot")
+			continue
+		}
+		vhost.logger.WithFields(log.Fields{
+			"queueName": name,
+			"length":    qu.Length(),
+		}).Info("Queue snapshotted")
+	}
+}
+
+func (vhost *VirtualHost) marshalQueueSnapshot(qu *queue.Queue) ([]byte, error) {
+	protoVersion := vhost.srv.protoVersion
+	buf := bytes.NewBuffer(make([]byte, 0))
+
+	data, err := qu.Marshal(protoVersion)
+	if err != nil {
+		return nil, err
+	}
+	if err = amqp.WriteLongstr(buf, data); err != nil {
+		return nil, err
+	}
+
+	// binding into default exchange is created with queue itself
+	var bindings []*binding.Binding
+	for exName, ex := range vhost.exchanges {
+		if exName == exDefaultName {
+			continue
+		}
+		for _, bind := range ex.GetBindings() {
+			if bind.GetQueue() == qu.GetName() && !bind.IsToExchange() && !bind.IsToFile() {
+				bindings = append(bindings, bind)
+			}
+		}
+	}
+	if err = amqp.WriteLong(buf, uint32(len(bindings))); err != nil {
+		return nil, err
+	}
+	for _, bind := range bindings {
+		if data, err = bind.Marshal(protoVersion); err != nil {
+			return nil, err
+		}
+		if err = amqp.WriteLongstr(buf, data); err != nil {
+			return nil, err
+		}
+	}
+
+	messages := qu.Peek(-1)
+	if err = amqp.WriteLong(buf, uint32(len(messages))); err != nil {
+		return nil, err
+	}
+	for _, message := range messages {
+		if data, err = message.Marshal(protoVersion); err != nil {
+			return nil, err
+		}
+		if err = amqp.WriteLongstr(buf, data); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// restoreSnapshots re-creates snapshotted queues on start, restore is best-effort:
+// snapshot is removed from storage whether queue is restored or not
+func (vhost *VirtualHost) restoreSnapshots() {
+	for name, data := range vhost.srvStorage.GetVhostQueueSnapshots(vhost.name) {
+		if err := vhost.restoreQueueSnapshot(name, data); err != nil {
+			vhost.logger.WithError(err).WithField("queueName", name).Warn("Skip queue snapshot")
+		}
+		vhost.srvStorage.DelQueueSnapshot(vhost.name, name)
+	}
+}
+
+func (vhost *VirtualHost) restoreQueueSnapshot(name string, data []byte) error {
+	protoVersion := vhost.srv.protoVersion
+	buf := bytes.NewReader(data)
+
+	raw, err := amqp.ReadLongstr(buf)
+	if err != nil {
+		return err
+	}
+	snapshotted := &queue.Queue{}
+	if err = snapshotted.Unmarshal(raw, protoVersion); err != nil {
+		return err
+	}
+
+	var bindings []*binding.Binding
+	count, err := amqp.ReadLong(buf)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		if raw, err = amqp.ReadLongstr(buf); err != nil {
+			return err
+		}
+		bind := &binding.Binding{}
+		if err = bind.Unmarshal(raw, protoVersion); err != nil {
+			return err
+		}
+		bindings = append(bindings, bind)
+	}
+
+	var messages []*amqp.Message
+	if count, err = amqp.ReadLong(buf); err != nil {
+		return err
+	}
+	for i := uint32(0); i < count; i++ {
+		if raw, err = amqp.ReadLongstr(buf); err != nil {
+			return err
+		}
+		message := &amqp.Message{}
+		if err = message.Unmarshal(raw, protoVersion); err != nil {
+			return err
+		}
+		messages = append(messages, message)
+	}
+
+	// queue with the same name was declared durable meanwhile
+	if vhost.GetQueue(name) != nil {
+		return nil
+	}
+	qu := vhost.NewQueue(name, 0, false, snapshotted.IsAutoDelete(), false, vhost.srvConfig.Queue.ShardSize)
+	if err = qu.SetArguments(snapshotted.Arguments()); err != nil {
+		return err
+	}
+	if err = vhost.AppendQueue(qu); err != nil {
+		return err
+	}
+	qu.Start()
+	for _, message := range messages {
+		qu.Push(message)
+	}
+
+	for _, bind := range bindings {
+		ex := vhost.GetExchange(bind.GetExchange())
+		if ex == nil {
+			continue
+		}
+		if _, err = ex.AppendBinding(bind); err != nil {
+			vhost.logger.WithError(err).WithField("binding", bind.GetName()).Warn("Skip binding")
+		}
+	}
+	vhost.logger.WithFields(log.Fields{
+		"queueName": name,
+		"length":    qu.Length(),
+	}).Info("Queue restored from snapshot")
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"syscall"
+)
+
+func setReuseAddr(fd uintptr, reuse bool) error {
+	value := 0
+	if reuse {
+		value = 1
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, value)
+}
+
+func setBacklog(fd uintptr, backlog int) error {
+	return syscall.Listen(int(fd), backlog)
+}
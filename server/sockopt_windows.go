@@ -0,0 +1,10 @@
+package server
+
+// SO_REUSEADDR on windows allows to steal bound port, so it is never set
+func setReuseAddr(fd uintptr, reuse bool) error {
+	return nil
+}
+
+func setBacklog(fd uintptr, backlog int) error {
+	return nil
+}
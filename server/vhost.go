@@ -3,7 +3,10 @@ package server
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/valinurovam/garagemq/amqp"
@@ -18,6 +21,10 @@ import (
 
 const exDefaultName = ""
 
+// exQueueName is system exchange routing message into queue named by routing key without bindings,
+// it is declared if enabled by exchange.queueExchange config
+const exQueueName = "amq.queue"
+
 // VirtualHost represents AMQP virtual host
 // Each virtual host is "parent" for its queues and exchanges
 type VirtualHost struct {
@@ -34,6 +41,13 @@ type VirtualHost struct {
 	srvConfig       *config.Config
 	logger          *log.Entry
 	autoDeleteQueue chan string
+	replyToLock     sync.RWMutex
+	replyTo         map[string]*Channel
+	draining        int32
+	policyLock      sync.RWMutex
+	policies        map[string]*Policy
+	resumeLock      sync.Mutex
+	resume          map[resumeKey]*retainedUnacked
 }
 
 // NewVhost returns instance of VirtualHost
@@ -41,7 +55,8 @@ type VirtualHost struct {
 // 1) init system exchanges
 // 2) load durable exchanges, queues and bindings from server storage
 // 3) load persisted messages from message store into all initiated queues
-// 4) run confirm loop
+// 4) restore snapshotted non-durable queues, see snapshotQueues
+// 5) run confirm loop
 // Only after that vhost is in state running msgStoragePersistent, msgStorageTransient
 func NewVhost(name string, system bool, msgStoragePersistent *msgstorage.MsgStorage, msgStorageTransient *msgstorage.MsgStorage, srv *Server) *VirtualHost {
 	vhost := &VirtualHost{
@@ -55,6 +70,9 @@ func NewVhost(name string, system bool, msgStoragePersistent *msgstorage.MsgStor
 		srvConfig:       srv.config,
 		srv:             srv,
 		autoDeleteQueue: make(chan string, 1),
+		replyTo:         make(map[string]*Channel),
+		policies:        make(map[string]*Policy),
+		resume:          make(map[resumeKey]*retainedUnacked),
 	}
 
 	vhost.logger = log.WithFields(log.Fields{
@@ -76,6 +94,7 @@ func NewVhost(name string, system bool, msgStoragePersistent *msgstorage.MsgStor
 			"length": q.Length(),
 		}).Info("Messages loaded into queue")
 	}
+	vhost.restoreSnapshots()
 
 	go vhost.handleConfirms()
 	go vhost.handleAutoDeleteQueue()
@@ -143,6 +162,10 @@ func (vhost *VirtualHost) initSystemExchanges() {
 
 	systemExchange := exchange.NewExchange(exDefaultName, exchange.ExTypeDirect, true, false, false, true)
 	vhost.AppendExchange(systemExchange)
+
+	if vhost.srvConfig.Exchange.QueueExchange {
+		vhost.AppendExchange(exchange.NewExchange(exQueueName, exchange.ExTypeDirect, true, false, false, true))
+	}
 }
 
 // GetQueue returns queue by name or nil if not exists
@@ -163,6 +186,52 @@ func (vhost *VirtualHost) getQueue(name string) *queue.Queue {
 	return vhost.queues[name]
 }
 
+// QueueSnapshot is copy of queue metadata and counters taken under queues lock
+type QueueSnapshot struct {
+	Name          string
+	Durable       bool
+	AutoDelete    bool
+	Exclusive     bool
+	Paused        bool
+	Policy        string
+	MasterLocator string
+	Counters      map[string]*metrics.TrackItem
+	Stats         queue.Stats
+}
+
+// SnapshotQueues returns snapshots of vhost queues, so they can be rendered without holding queues lock
+// while queues are declared and deleted
+func (vhost *VirtualHost) SnapshotQueues() []*QueueSnapshot {
+	vhost.quLock.RLock()
+	defer vhost.quLock.RUnlock()
+
+	snapshots := make([]*QueueSnapshot, 0, len(vhost.queues))
+	for _, qu := range vhost.queues {
+		quMetrics := qu.GetMetrics()
+		snapshots = append(snapshots, &QueueSnapshot{
+			Name:          qu.GetName(),
+			Durable:       qu.IsDurable(),
+			AutoDelete:    qu.IsAutoDelete(),
+			Exclusive:     qu.IsExclusive(),
+			Paused:        qu.IsPaused(),
+			Policy:        qu.Policy(),
+			MasterLocator: qu.MasterLocator(),
+			Counters: map[string]*metrics.TrackItem{
+				"ready":   quMetrics.Ready.Track.GetLastTrackItem(),
+				"total":   quMetrics.Total.Track.GetLastTrackItem(),
+				"unacked": quMetrics.Unacked.Track.GetLastTrackItem(),
+
+				"get":      quMetrics.Get.Track.GetLastDiffTrackItem(),
+				"ack":      quMetrics.Ack.Track.GetLastDiffTrackItem(),
+				"incoming": quMetrics.Incoming.Track.GetLastDiffTrackItem(),
+				"deliver":  quMetrics.Deliver.Track.GetLastDiffTrackItem(),
+			},
+			Stats: qu.Stats(),
+		})
+	}
+	return snapshots
+}
+
 // GetExchange returns exchange by name or nil if not exists
 func (vhost *VirtualHost) GetExchange(name string) *exchange.Exchange {
 	vhost.exLock.RLock()
@@ -178,11 +247,77 @@ func (vhost *VirtualHost) GetExchanges() map[string]*exchange.Exchange {
 	return vhost.exchanges
 }
 
+// ExchangeSnapshot is copy of exchange metadata and counters taken under exchanges lock
+type ExchangeSnapshot struct {
+	Name       string
+	Type       string
+	Durable    bool
+	Internal   bool
+	AutoDelete bool
+	Policy     string
+	MsgRateIn  *metrics.TrackItem
+	MsgRateOut *metrics.TrackItem
+}
+
+// SnapshotExchanges returns snapshots of vhost exchanges, so they can be rendered without holding exchanges lock
+// while exchanges are declared and deleted
+func (vhost *VirtualHost) SnapshotExchanges() []*ExchangeSnapshot {
+	vhost.exLock.RLock()
+	defer vhost.exLock.RUnlock()
+
+	snapshots := make([]*ExchangeSnapshot, 0, len(vhost.exchanges))
+	for _, ex := range vhost.exchanges {
+		snapshots = append(snapshots, &ExchangeSnapshot{
+			Name:       ex.GetName(),
+			Type:       ex.GetTypeAlias(),
+			Durable:    ex.IsDurable(),
+			Internal:   ex.IsInternal(),
+			AutoDelete: ex.IsAutoDelete(),
+			Policy:     ex.Policy(),
+			MsgRateIn:  ex.GetMetrics().MsgIn.Track.GetLastDiffTrackItem(),
+			MsgRateOut: ex.GetMetrics().MsgOut.Track.GetLastDiffTrackItem(),
+		})
+	}
+	return snapshots
+}
+
 // GetDefaultExchange returns default exchange
 func (vhost *VirtualHost) GetDefaultExchange() *exchange.Exchange {
 	return vhost.exchanges[exDefaultName]
 }
 
+// ImplicitBindings returns bindings of default exchange implied by queues, one per queue with queue name
+// as routing key, sorted by queue name. They are synthesized from queue registry, routing stats are taken
+// from binding held by default exchange if it exists. Implicit bindings are never stored.
+func (vhost *VirtualHost) ImplicitBindings() []*binding.Binding {
+	held := make(map[string]*binding.Binding)
+	if ex := vhost.GetDefaultExchange(); ex != nil {
+		for _, bind := range ex.GetBindings() {
+			held[bind.GetQueue()] = bind
+		}
+	}
+
+	vhost.quLock.RLock()
+	names := make([]string, 0, len(vhost.queues))
+	for name := range vhost.queues {
+		names = append(names, name)
+	}
+	vhost.quLock.RUnlock()
+	sort.Strings(names)
+
+	bindings := make([]*binding.Binding, 0, len(names))
+	for _, name := range names {
+		if bind, ok := held[name]; ok {
+			bindings = append(bindings, bind)
+			continue
+		}
+		// the only error paths are on topic and headers bindings
+		bind, _ := binding.NewBinding(name, exDefaultName, name, &amqp.Table{}, false)
+		bindings = append(bindings, bind)
+	}
+	return bindings
+}
+
 // AppendExchange append new exchange and persist if it is durable
 func (vhost *VirtualHost) AppendExchange(ex *exchange.Exchange) {
 	vhost.exLock.Lock()
@@ -194,6 +329,11 @@ func (vhost *VirtualHost) AppendExchange(ex *exchange.Exchange) {
 	}).Info("Append exchange")
 	vhost.exchanges[ex.GetName()] = ex
 
+	// default exchange has binding for each queue, so it is limited by queues count only
+	if ex.GetName() != exDefaultName {
+		ex.SetMaxBindings(vhost.srvConfig.Exchange.MaxBindings)
+	}
+
 	if ex.IsDurable() && !ex.IsSystem() {
 		vhost.srvStorage.AddExchange(vhost.name, ex)
 	}
@@ -208,7 +348,7 @@ func (vhost *VirtualHost) AppendExchange(ex *exchange.Exchange) {
 // NewQueue returns new instance of queue by params
 // we can't use just queue.NewQueue, cause we need to set msgStorage to queue
 func (vhost *VirtualHost) NewQueue(name string, connID uint64, exclusive bool, autoDelete bool, durable bool, shardSize int) *queue.Queue {
-	return queue.NewQueue(
+	qu := queue.NewQueue(
 		name,
 		connID,
 		exclusive,
@@ -219,6 +359,10 @@ func (vhost *VirtualHost) NewQueue(name string, connID uint64, exclusive bool, a
 		vhost.msgStorageT,
 		vhost.autoDeleteQueue,
 	)
+	// operator limits of vhost bound queue arguments set after
+	limits := vhost.srvConfig.Vhost.Limits[vhost.name]
+	qu.SetLimits(queue.Limits{MessageTTL: limits.MessageTTL, MaxLength: limits.MaxLength})
+	return qu
 }
 
 // AppendQueue append new queue and persist if it is durable and
@@ -244,7 +388,9 @@ func (vhost *VirtualHost) AppendQueue(qu *queue.Queue) error {
 		return bindErr
 	}
 
-	ex.AppendBinding(bind)
+	if _, err := ex.AppendBinding(bind); err != nil {
+		return err
+	}
 
 	if qu.IsDurable() {
 		vhost.srvStorage.AddQueue(vhost.name, qu)
@@ -269,6 +415,115 @@ func (vhost *VirtualHost) AppendQueue(qu *queue.Queue) error {
 	return nil
 }
 
+// Route returns queues matched for message published into given exchange with message to push into each queue
+// Message is routed through exchange-to-exchange bindings recursively, including internal exchanges
+// Splitter exchange passes own copy of message to each bound exchange, other exchanges pass message as is
+// Each exchange is visited once, so cyclic bindings are safe
+// Routing keys from CC and BCC headers are matched at every exchange along with message routing key,
+// matched queues are united as a set, so queue matched by several keys or exchanges gets message once
+// Messages matched by file bindings are recorded into file sinks once per file
+// If routing trace is enabled for vhost, messages pushed into queues get entry of each visited exchange
+func (vhost *VirtualHost) Route(ex *exchange.Exchange, message *amqp.Message) map[string]*amqp.Message {
+	type stage struct {
+		ex      *exchange.Exchange
+		message *amqp.Message
+	}
+
+	routingKeys := message.RoutingKeys()
+	message = message.WithoutBCC()
+	matchedQueues := make(map[string]*amqp.Message)
+	matchedFiles := make(map[string]bool)
+	tracing := vhost.isRoutingTraced()
+	var trace []interface{}
+	visited := map[string]bool{ex.GetName(): true}
+	stages := []stage{{ex: ex, message: message}}
+	for len(stages) > 0 {
+		current := stages[0]
+		stages = stages[1:]
+
+		queues, exchanges, files, bindings := routeKeys(current.ex, current.message, routingKeys)
+		if tracing {
+			trace = append(trace, routingTraceEntry(current.ex, bindings, time.Now()))
+		}
+		if current.ex.GetName() == exQueueName {
+			// missing queue is not created, so message routed only into it is unroutable
+			for _, key := range routingKeys {
+				if vhost.GetQueue(key) != nil {
+					queues[key] = true
+				}
+			}
+		}
+		if len(queues) == 0 && current.ex.GetName() == exDefaultName && vhost.srvConfig.Exchange.DefaultRoutesToExchange {
+			// internal exchange may be used only by bindings, so it is not a fallback target
+			if fallback := vhost.GetExchange(current.message.RoutingKey); fallback != nil && !fallback.IsInternal() {
+				exchanges[fallback.GetName()] = true
+			}
+		}
+		for queueName := range queues {
+			if _, ok := matchedQueues[queueName]; !ok {
+				matchedQueues[queueName] = current.message
+			}
+		}
+		for file := range files {
+			matchedFiles[file] = true
+		}
+		for exName := range exchanges {
+			if visited[exName] {
+				continue
+			}
+			visited[exName] = true
+			next := vhost.GetExchange(exName)
+			if next == nil {
+				continue
+			}
+			next.GetMetrics().MsgIn.Counter.Inc(1)
+			nextMessage := current.message
+			if current.ex.ExType() == exchange.ExTypeSplitter {
+				nextMessage = current.message.Copy()
+			}
+			stages = append(stages, stage{ex: next, message: nextMessage})
+		}
+	}
+	vhost.srv.teeToFiles(vhost.name, matchedFiles, message)
+	if len(trace) > 0 {
+		traceRoutes(matchedQueues, trace)
+	}
+	return matchedQueues
+}
+
+// routeKeys returns union of queues, exchanges and file sinks matched by exchange for each routing key
+// along with bindings matched by any of keys
+func routeKeys(ex *exchange.Exchange, message *amqp.Message, routingKeys []string) (queues map[string]bool, exchanges map[string]bool, files map[string]bool, bindings []*binding.Binding) {
+	queues = make(map[string]bool)
+	exchanges = make(map[string]bool)
+	files = make(map[string]bool)
+	matched := make(map[*binding.Binding]bool)
+	for i, key := range routingKeys {
+		keyed := message
+		if i > 0 {
+			// exchange does not modify message, so shallow copy is enough
+			keyedCopy := *message
+			keyedCopy.RoutingKey = key
+			keyed = &keyedCopy
+		}
+		for _, bind := range ex.MatchBindings(keyed) {
+			if matched[bind] {
+				continue
+			}
+			matched[bind] = true
+			bindings = append(bindings, bind)
+			if bind.IsToExchange() {
+				exchanges[bind.GetQueue()] = true
+			} else if bind.IsToFile() {
+				files[bind.GetQueue()] = true
+			} else {
+				queues[bind.GetQueue()] = true
+			}
+		}
+	}
+	return
+}
+
 // PersistBinding store binding into server storage
 func (vhost *VirtualHost) PersistBinding(binding *binding.Binding) {
 	vhost.srvStorage.AddBinding(vhost.name, binding)
@@ -288,9 +543,9 @@ func (vhost *VirtualHost) loadQueues() {
 		return
 	}
 	for _, q := range queues {
-		vhost.AppendQueue(
-			vhost.NewQueue(q.GetName(), 0, false, q.IsAutoDelete(), q.IsDurable(), vhost.srvConfig.Queue.ShardSize),
-		)
+		qu := vhost.NewQueue(q.GetName(), 0, false, q.IsAutoDelete(), q.IsDurable(), vhost.srvConfig.Queue.ShardSize)
+		qu.SetArguments(q.Arguments())
+		vhost.AppendQueue(qu)
 	}
 }
 
@@ -325,8 +580,11 @@ func (vhost *VirtualHost) loadBindings() {
 	}
 	for _, bind := range bindings {
 		ex := vhost.getExchange(bind.Exchange)
-		if ex != nil {
-			ex.AppendBinding(bind)
+		if ex == nil {
+			continue
+		}
+		if _, err := ex.AppendBinding(bind); err != nil {
+			vhost.logger.WithError(err).WithField("binding", bind.GetName()).Warn("Skip binding")
 		}
 	}
 }
@@ -359,6 +617,70 @@ func (vhost *VirtualHost) DeleteQueue(queueName string, ifUnused bool, ifEmpty b
 	return length, nil
 }
 
+// DeleteExchange delete exchange from virtual host and server storage
+// Persisted bindings of durable exchange are kept in server storage to be re-attached
+// when exchange is declared again, see ReattachBindings
+func (vhost *VirtualHost) DeleteExchange(exchangeName string, ifUnused bool) error {
+	vhost.exLock.Lock()
+	defer vhost.exLock.Unlock()
+
+	ex := vhost.getExchange(exchangeName)
+	if ex == nil {
+		return errors.New("not found")
+	}
+	if ex.IsSystem() || exchangeName == exDefaultName {
+		return fmt.Errorf("exchange '%s' is system and can not be deleted", exchangeName)
+	}
+	if ifUnused && len(ex.GetBindings()) > 0 {
+		return fmt.Errorf("exchange '%s' in use", exchangeName)
+	}
+
+	if ex.IsDurable() {
+		vhost.srvStorage.DelExchange(vhost.name, ex)
+	}
+	delete(vhost.exchanges, exchangeName)
+	vhost.releaseFileBindings(ex)
+	vhost.logger.WithField("name", exchangeName).Info("Delete exchange")
+
+	return nil
+}
+
+// ReattachBindings restores persisted bindings of recreated durable exchange
+// Bindings incompatible with new exchange type or with missing destination are dropped from server storage
+func (vhost *VirtualHost) ReattachBindings(ex *exchange.Exchange) {
+	if !ex.IsDurable() {
+		return
+	}
+
+	for _, bind := range vhost.srvStorage.GetVhostBindings(vhost.name) {
+		if bind.GetExchange() != ex.GetName() {
+			continue
+		}
+
+		var err error
+		if bind.IsToExchange() {
+			if vhost.GetExchange(bind.GetQueue()) == nil {
+				err = fmt.Errorf("destination exchange '%s' not found", bind.GetQueue())
+			}
+		} else if vhost.GetQueue(bind.GetQueue()) == nil {
+			err = fmt.Errorf("queue '%s' not found", bind.GetQueue())
+		}
+		if err == nil {
+			err = ex.CheckBinding(bind)
+		}
+		if err == nil {
+			_, err = ex.AppendBinding(bind)
+		}
+
+		if err != nil {
+			vhost.logger.WithError(err).WithField("binding", bind.GetName()).Warn("Drop binding of recreated exchange")
+			vhost.srvStorage.DelBinding(vhost.name, bind)
+			continue
+		}
+		vhost.logger.WithField("binding", bind.GetName()).Info("Re-attach binding")
+	}
+}
+
 // Stop properly stop virtual host
 // TODO: properly stop confirm loop
 func (vhost *VirtualHost) Stop() error {
@@ -367,6 +689,8 @@ func (vhost *VirtualHost) Stop() error {
 	defer vhost.quLock.Unlock()
 	defer vhost.exLock.Unlock()
 	vhost.logger.Info("Stop virtual host")
+	vhost.stopRetained()
+	vhost.snapshotQueues()
 	for _, qu := range vhost.queues {
 		qu.Stop()
 		vhost.logger.WithFields(log.Fields{
@@ -375,6 +699,7 @@ func (vhost *VirtualHost) Stop() error {
 	}
 
 	vhost.msgStorageP.Close()
+	vhost.msgStorageT.Close()
 	vhost.logger.Info("Storage closed")
 	close(vhost.autoDeleteQueue)
 	return nil
@@ -383,3 +708,19 @@ func (vhost *VirtualHost) Stop() error {
 func (vhost *VirtualHost) GetName() string {
 	return vhost.name
 }
+
+// SetDraining enables or disables drain mode
+// Draining vhost refuses publishes, but queued messages are still delivered and acked
+func (vhost *VirtualHost) SetDraining(draining bool) {
+	var value int32
+	if draining {
+		value = 1
+	}
+	atomic.StoreInt32(&vhost.draining, value)
+	vhost.logger.WithField("draining", draining).Info("Drain mode changed")
+}
+
+// IsDraining returns is vhost in drain mode
+func (vhost *VirtualHost) IsDraining() bool {
+	return atomic.LoadInt32(&vhost.draining) == 1
+}
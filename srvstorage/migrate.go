@@ -0,0 +1,101 @@
+package srvstorage
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/binding"
+	"github.com/valinurovam/garagemq/exchange"
+	"github.com/valinurovam/garagemq/interfaces"
+	"github.com/valinurovam/garagemq/queue"
+)
+
+const migrateBatchSize = 1000
+
+// record represents stored entity which can be rewritten in the current format
+type record interface {
+	Marshal(protoVersion string) ([]byte, error)
+	Unmarshal(data []byte, protoVersion string) error
+}
+
+var recordFactories = map[string]func() record{
+	queuePrefix:    func() record { return &queue.Queue{} },
+	exchangePrefix: func() record { return &exchange.Exchange{} },
+	bindingPrefix:  func() record { return &binding.Binding{} },
+}
+
+// Migrate rewrites stored queues, exchanges and bindings with format version in [fromVersion, toVersion)
+// (records without version prefix are version 1) in the toVersion format
+// Records are written by batched transactions, already migrated records are skipped,
+// so migration is idempotent and can be resumed after failure
+func Migrate(storage *SrvStorage, fromVersion int, toVersion int) error {
+	if fromVersion < int(amqp.FormatVersion1) || fromVersion > toVersion {
+		return fmt.Errorf("bad migration versions range %d -> %d", fromVersion, toVersion)
+	}
+	if toVersion != int(amqp.FormatVersionCurrent) {
+		return fmt.Errorf("unable to migrate to version %d, current version is %d", toVersion, amqp.FormatVersionCurrent)
+	}
+
+	var batch []*interfaces.Operation
+	var iterErr error
+	storage.db.Iterate(
+		func(key []byte, value []byte) {
+			if iterErr != nil {
+				return
+			}
+
+			var newRecord func() record
+			for prefix, factory := range recordFactories {
+				if bytes.HasPrefix(key, []byte(prefix)) {
+					newRecord = factory
+					break
+				}
+			}
+			if newRecord == nil {
+				return
+			}
+
+			version, err := amqp.ReadFormatVersion(bytes.NewReader(value))
+			if err != nil {
+				iterErr = fmt.Errorf("record %s: %s", key, err)
+				return
+			}
+			if int(version) < fromVersion || int(version) > toVersion {
+				return
+			}
+			if int(version) == toVersion && amqp.IsVersionedFormat(value) {
+				return
+			}
+
+			rec := newRecord()
+			if err = rec.Unmarshal(value, storage.protoVersion); err != nil {
+				iterErr = fmt.Errorf("record %s: %s", key, err)
+				return
+			}
+			data, err := rec.Marshal(storage.protoVersion)
+			if err != nil {
+				iterErr = fmt.Errorf("record %s: %s", key, err)
+				return
+			}
+
+			batch = append(batch, &interfaces.Operation{Key: string(key), Value: data, Op: interfaces.OpSet})
+		},
+	)
+	if iterErr != nil {
+		return iterErr
+	}
+
+	for len(batch) > 0 {
+		size := migrateBatchSize
+		if len(batch) < size {
+			size = len(batch)
+		}
+		if err := storage.db.ProcessBatch(batch[:size]); err != nil {
+			return err
+		}
+		batch = batch[size:]
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package srvstorage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/valinurovam/garagemq/amqp"
+	"github.com/valinurovam/garagemq/storage"
+)
+
+func seedVersion1Storage(t *testing.T) (*SrvStorage, func()) {
+	dir, err := ioutil.TempDir("", "srvstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := storage.NewBuntDB(dir)
+
+	// records written before format versioning, without version prefix
+	queueRecord := []byte{2, 'q', '1', 1}
+	exchangeRecord := []byte{3, 'e', 'x', '1', 3}
+
+	bindingBuf := bytes.NewBuffer(make([]byte, 0))
+	amqp.WriteShortstr(bindingBuf, "q1")
+	amqp.WriteShortstr(bindingBuf, "ex1")
+	amqp.WriteShortstr(bindingBuf, "key.*")
+	amqp.WriteTable(bindingBuf, &amqp.Table{}, amqp.ProtoRabbit)
+	amqp.WriteOctet(bindingBuf, 1)
+
+	db.Set(queuePrefix+".test.q1", queueRecord)
+	db.Set(exchangePrefix+".test.ex1", exchangeRecord)
+	db.Set(bindingPrefix+".test.binding1", bindingBuf.Bytes())
+	db.Set("lastStartTime", []byte{1})
+
+	return NewSrvStorage(db, amqp.ProtoRabbit), func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func assertVersionedRecords(t *testing.T, srvStorage *SrvStorage) {
+	count := 0
+	srvStorage.db.Iterate(func(key []byte, value []byte) {
+		for prefix := range recordFactories {
+			if !bytes.HasPrefix(key, []byte(prefix)) {
+				continue
+			}
+			count++
+			if !amqp.IsVersionedFormat(value) || value[1] != amqp.FormatVersionCurrent {
+				t.Errorf("Expected record %s in format version %d", key, amqp.FormatVersionCurrent)
+			}
+		}
+	})
+	if count != 3 {
+		t.Fatalf("Expected %d records, actual %d", 3, count)
+	}
+}
+
+func TestMigrate_Version1(t *testing.T) {
+	srvStorage, clean := seedVersion1Storage(t)
+	defer clean()
+
+	if err := Migrate(srvStorage, int(amqp.FormatVersion1), int(amqp.FormatVersionCurrent)); err != nil {
+		t.Fatal(err)
+	}
+	assertVersionedRecords(t, srvStorage)
+
+	queues := srvStorage.GetVhostQueues("test")
+	if len(queues) != 1 || queues[0].GetName() != "q1" || !queues[0].IsAutoDelete() {
+		t.Error("Unexpected migrated queue")
+	}
+	exchanges := srvStorage.GetVhostExchanges("test")
+	if len(exchanges) != 1 || exchanges[0].GetName() != "ex1" || exchanges[0].ExType() != 3 {
+		t.Error("Unexpected migrated exchange")
+	}
+	bindings := srvStorage.GetVhostBindings("test")
+	if len(bindings) != 1 || bindings[0].Queue != "q1" || bindings[0].Exchange != "ex1" || bindings[0].RoutingKey != "key.*" {
+		t.Error("Unexpected migrated binding")
+	}
+
+	// second run has nothing to do
+	if err := Migrate(srvStorage, int(amqp.FormatVersion1), int(amqp.FormatVersionCurrent)); err != nil {
+		t.Fatal(err)
+	}
+	assertVersionedRecords(t, srvStorage)
+}
+
+func TestMigrate_Failed_BadVersions(t *testing.T) {
+	srvStorage, clean := seedVersion1Storage(t)
+	defer clean()
+
+	if Migrate(srvStorage, int(amqp.FormatVersionCurrent)+1, int(amqp.FormatVersionCurrent)) == nil {
+		t.Error("Expected error on bad versions range")
+	}
+	if Migrate(srvStorage, int(amqp.FormatVersion1), int(amqp.FormatVersionCurrent)+1) == nil {
+		t.Error("Expected error on unknown target version")
+	}
+}
@@ -17,6 +17,7 @@ const queuePrefix = "vhost.queue"
 const exchangePrefix = "vhost.exchange"
 const bindingPrefix = "vhost.binding"
 const vhostPrefix = "server.vhost"
+const snapshotPrefix = "vhost.snapshot"
 
 // SrvStorage implements storage for store all durable server entities
 type SrvStorage struct {
@@ -152,7 +153,7 @@ func (storage *SrvStorage) GetVhostExchanges(vhost string) []*exchange.Exchange
 				return
 			}
 			ex := &exchange.Exchange{}
-			ex.Unmarshal(value)
+			ex.Unmarshal(value, storage.protoVersion)
 			exchanges = append(exchanges, ex)
 		},
 	)
@@ -177,6 +178,37 @@ func (storage *SrvStorage) GetVhostBindings(vhost string) []*binding.Binding {
 	return bindings
 }
 
+// AddQueueSnapshot stores raw shutdown snapshot of non-durable queue
+func (storage *SrvStorage) AddQueueSnapshot(vhost string, queueName string, data []byte) error {
+	key := fmt.Sprintf("%s.%s.%s", snapshotPrefix, vhost, queueName)
+	return storage.db.Set(key, data)
+}
+
+// DelQueueSnapshot removes shutdown snapshot of queue
+func (storage *SrvStorage) DelQueueSnapshot(vhost string, queueName string) error {
+	key := fmt.Sprintf("%s.%s.%s", snapshotPrefix, vhost, queueName)
+	return storage.db.Del(key)
+}
+
+// GetVhostQueueSnapshots returns raw shutdown snapshots of given vhost by queue name
+func (storage *SrvStorage) GetVhostQueueSnapshots(vhost string) map[string][]byte {
+	snapshots := make(map[string][]byte)
+	prefix := fmt.Sprintf("%s.%s.", snapshotPrefix, vhost)
+	storage.db.Iterate(
+		func(key []byte, value []byte) {
+			if !bytes.HasPrefix(key, []byte(prefix)) {
+				return
+			}
+			// value is valid only inside iteration
+			data := make([]byte, len(value))
+			copy(data, value)
+			snapshots[string(key[len(prefix):])] = data
+		},
+	)
+
+	return snapshots
+}
+
 func getVhostFromKey(key string) string {
 	parts := strings.Split(key, ".")
 	return parts[2]
@@ -9,12 +9,13 @@ import (
 
 // Badger implements wrapper for badger database
 type Badger struct {
-	db *badger.DB
+	db      *badger.DB
+	closeCh chan struct{}
 }
 
 // NewBadger returns new instance of badger wrapper
 func NewBadger(storageDir string) *Badger {
-	storage := &Badger{}
+	storage := &Badger{closeCh: make(chan struct{})}
 	opts := badger.DefaultOptions(storageDir)
 	opts.SyncWrites = true
 	opts.Dir = storageDir
@@ -51,6 +52,7 @@ func (storage *Badger) ProcessBatch(batch []*interfaces.Operation) (err error) {
 
 // Close properly closes badger database
 func (storage *Badger) Close() error {
+	close(storage.closeCh)
 	return storage.db.Close()
 }
 
@@ -228,10 +230,13 @@ func (storage *Badger) IterateByPrefixFrom(prefix []byte, from []byte, limit uin
 
 func (storage *Badger) runStorageGC() {
 	timer := time.NewTicker(10 * time.Minute)
+	defer timer.Stop()
 	for {
 		select {
 		case <-timer.C:
 			storage.storageGC()
+		case <-storage.closeCh:
+			return
 		}
 	}
 }
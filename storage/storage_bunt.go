@@ -39,10 +39,14 @@ func (storage *BuntDB) ProcessBatch(batch []*interfaces.Operation) (err error) {
 	return storage.db.Update(func(tx *buntdb.Tx) error {
 		for _, op := range batch {
 			if op.Op == interfaces.OpSet {
-				tx.Set(op.Key, string(op.Value), nil)
+				if _, _, err := tx.Set(op.Key, string(op.Value), nil); err != nil {
+					return err
+				}
 			}
 			if op.Op == interfaces.OpDel {
-				tx.Delete(op.Key)
+				if _, err := tx.Delete(op.Key); err != nil && err != buntdb.ErrNotFound {
+					return err
+				}
 			}
 		}
 		return nil
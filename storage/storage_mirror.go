@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valinurovam/garagemq/interfaces"
+)
+
+// Mirror implements storage writing into primary and secondary storages
+// Writes into secondary are applied in order by background writer, ProcessBatch waits for them
+// only if waitSecondary is set, so by default confirms wait for primary only
+// When write into primary fails, primary is considered lost and all reads and writes go to secondary
+type Mirror struct {
+	primary       interfaces.DbStorage
+	secondary     interfaces.DbStorage
+	waitSecondary bool
+	primaryLost   int32
+	secondaryCh   chan *mirrorOp
+	done          chan struct{}
+}
+
+type mirrorOp struct {
+	apply  func(db interfaces.DbStorage) error
+	result chan error
+}
+
+// NewMirror returns new instance of Mirror storage
+func NewMirror(primary interfaces.DbStorage, secondary interfaces.DbStorage, waitSecondary bool) *Mirror {
+	storage := &Mirror{
+		primary:       primary,
+		secondary:     secondary,
+		waitSecondary: waitSecondary,
+		secondaryCh:   make(chan *mirrorOp, 1024),
+		done:          make(chan struct{}),
+	}
+	go storage.writeSecondary()
+
+	return storage
+}
+
+// IsPrimaryLost returns is primary storage failed and is not used anymore
+func (storage *Mirror) IsPrimaryLost() bool {
+	return atomic.LoadInt32(&storage.primaryLost) == 1
+}
+
+func (storage *Mirror) writeSecondary() {
+	defer close(storage.done)
+	for op := range storage.secondaryCh {
+		err := op.apply(storage.secondary)
+		if op.result != nil {
+			op.result <- err
+		} else if err != nil {
+			log.WithError(err).Error("Error on writing into secondary storage")
+		}
+	}
+}
+
+// write applies operation to primary and secondary storages
+func (storage *Mirror) write(apply func(db interfaces.DbStorage) error) error {
+	if !storage.IsPrimaryLost() {
+		if err := apply(storage.primary); err != nil {
+			log.WithError(err).Error("Error on writing into primary storage, switch to secondary")
+			atomic.StoreInt32(&storage.primaryLost, 1)
+		}
+	}
+
+	op := &mirrorOp{apply: apply}
+	// secondary is the only copy after primary is lost
+	if storage.waitSecondary || storage.IsPrimaryLost() {
+		op.result = make(chan error, 1)
+	}
+	storage.secondaryCh <- op
+	if op.result == nil {
+		return nil
+	}
+	return <-op.result
+}
+
+// reader returns storage to read from
+func (storage *Mirror) reader() interfaces.DbStorage {
+	if storage.IsPrimaryLost() {
+		return storage.secondary
+	}
+	return storage.primary
+}
+
+// ProcessBatch process batch of operations
+func (storage *Mirror) ProcessBatch(batch []*interfaces.Operation) (err error) {
+	return storage.write(func(db interfaces.DbStorage) error {
+		return db.ProcessBatch(batch)
+	})
+}
+
+// Close closes both storages after queued writes into secondary are applied
+func (storage *Mirror) Close() error {
+	close(storage.secondaryCh)
+	<-storage.done
+
+	primaryErr := storage.primary.Close()
+	if err := storage.secondary.Close(); err != nil {
+		return err
+	}
+	if storage.IsPrimaryLost() {
+		return nil
+	}
+	return primaryErr
+}
+
+// Set adds a key-value pair to the database
+func (storage *Mirror) Set(key string, value []byte) (err error) {
+	return storage.write(func(db interfaces.DbStorage) error {
+		return db.Set(key, value)
+	})
+}
+
+// Del deletes a key
+func (storage *Mirror) Del(key string) (err error) {
+	return storage.write(func(db interfaces.DbStorage) error {
+		return db.Del(key)
+	})
+}
+
+// Get returns value by key from primary, falling back to secondary on error
+func (storage *Mirror) Get(key string) (value []byte, err error) {
+	if value, err = storage.reader().Get(key); err == nil || storage.IsPrimaryLost() {
+		return
+	}
+	if secondaryValue, secondaryErr := storage.secondary.Get(key); secondaryErr == nil {
+		return secondaryValue, nil
+	}
+	return
+}
+
+// Iterate iterates over all keys
+func (storage *Mirror) Iterate(fn func(key []byte, value []byte)) {
+	storage.reader().Iterate(fn)
+}
+
+// IterateByPrefix iterates over keys with prefix
+func (storage *Mirror) IterateByPrefix(prefix []byte, limit uint64, fn func(key []byte, value []byte)) uint64 {
+	return storage.reader().IterateByPrefix(prefix, limit, fn)
+}
+
+// IterateByPrefixFrom iterates over keys with prefix starting from key
+func (storage *Mirror) IterateByPrefixFrom(prefix []byte, from []byte, limit uint64, fn func(key []byte, value []byte)) uint64 {
+	return storage.reader().IterateByPrefixFrom(prefix, from, limit, fn)
+}
+
+// DeleteByPrefix deletes keys with prefix
+func (storage *Mirror) DeleteByPrefix(prefix []byte) {
+	storage.write(func(db interfaces.DbStorage) error {
+		db.DeleteByPrefix(prefix)
+		return nil
+	})
+}
+
+// KeysByPrefixCount returns count of keys with prefix
+func (storage *Mirror) KeysByPrefixCount(prefix []byte) uint64 {
+	return storage.reader().KeysByPrefixCount(prefix)
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/valinurovam/garagemq/interfaces"
+)
+
+var errLost = errors.New("storage is lost")
+
+// lostStorage fails all operations after it is lost
+type lostStorage struct {
+	interfaces.DbStorage
+	lost bool
+}
+
+func (storage *lostStorage) ProcessBatch(batch []*interfaces.Operation) error {
+	if storage.lost {
+		return errLost
+	}
+	return storage.DbStorage.ProcessBatch(batch)
+}
+
+func (storage *lostStorage) Get(key string) ([]byte, error) {
+	if storage.lost {
+		return nil, errLost
+	}
+	return storage.DbStorage.Get(key)
+}
+
+func (storage *lostStorage) IterateByPrefix(prefix []byte, limit uint64, fn func(key []byte, value []byte)) uint64 {
+	if storage.lost {
+		return 0
+	}
+	return storage.DbStorage.IterateByPrefix(prefix, limit, fn)
+}
+
+func newTestMirror(t *testing.T, waitSecondary bool) (*Mirror, *lostStorage, func()) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "primary"), 0777)
+	os.MkdirAll(filepath.Join(dir, "secondary"), 0777)
+
+	primary := &lostStorage{DbStorage: NewBadger(filepath.Join(dir, "primary"))}
+	mirror := NewMirror(primary, NewBadger(filepath.Join(dir, "secondary")), waitSecondary)
+	return mirror, primary, func() {
+		mirror.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func setBatch(keys ...string) []*interfaces.Operation {
+	batch := make([]*interfaces.Operation, 0, len(keys))
+	for _, key := range keys {
+		batch = append(batch, &interfaces.Operation{Key: key, Value: []byte(key), Op: interfaces.OpSet})
+	}
+	return batch
+}
+
+func TestMirror_PrimaryLost(t *testing.T) {
+	mirror, primary, clean := newTestMirror(t, false)
+	defer clean()
+
+	if err := mirror.ProcessBatch(setBatch("msg.q.1", "msg.q.2")); err != nil {
+		t.Fatal(err)
+	}
+	primary.lost = true
+
+	// failed write switches mirror to secondary, batch is still stored
+	if err := mirror.ProcessBatch(setBatch("msg.q.3")); err != nil {
+		t.Fatal(err)
+	}
+	if !mirror.IsPrimaryLost() {
+		t.Fatal("Expected primary storage lost")
+	}
+
+	var keys []string
+	mirror.IterateByPrefix([]byte("msg.q."), 0, func(key []byte, value []byte) {
+		keys = append(keys, string(key))
+	})
+	if len(keys) != 3 {
+		t.Errorf("Expected %d messages read from secondary, actual %v", 3, keys)
+	}
+	if value, err := mirror.Get("msg.q.1"); err != nil || string(value) != "msg.q.1" {
+		t.Errorf("Expected value read from secondary, actual '%s', %v", value, err)
+	}
+}
+
+func TestMirror_Get_FallbackToSecondary(t *testing.T) {
+	mirror, primary, clean := newTestMirror(t, true)
+	defer clean()
+
+	if err := mirror.ProcessBatch(setBatch("msg.q.1")); err != nil {
+		t.Fatal(err)
+	}
+	primary.lost = true
+
+	if value, err := mirror.Get("msg.q.1"); err != nil || string(value) != "msg.q.1" {
+		t.Errorf("Expected value read from secondary, actual '%s', %v", value, err)
+	}
+	if _, err := mirror.Get("msg.q.2"); err == nil {
+		t.Error("Expected error on get unknown key")
+	}
+	// reads do not switch mirror, only failed writes do
+	if mirror.IsPrimaryLost() {
+		t.Error("Expected primary storage not lost")
+	}
+}